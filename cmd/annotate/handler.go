@@ -0,0 +1,106 @@
+package annotate
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"p0-ssh-agent/internal/annotations"
+	"p0-ssh-agent/internal/config"
+	"p0-ssh-agent/internal/install"
+)
+
+func NewAnnotateCommand(verbose *bool, configPath *string) *cobra.Command {
+	var (
+		ttl   time.Duration
+		list  bool
+		clear bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "annotate [message]",
+		Short: "Attach a transient annotation reported in heartbeats",
+		Long: `Attach a short note to this host that is carried in every heartbeat and
+shown to fleet operators in the P0 backend, for example during maintenance.
+
+Annotations expire after --ttl (use 0 to keep until cleared).
+
+Examples:
+  sudo p0-ssh-agent annotate "patching until 3pm" --ttl 4h
+  p0-ssh-agent annotate --list
+  sudo p0-ssh-agent annotate --clear`,
+		Args: func(cmd *cobra.Command, args []string) error {
+			if list || clear {
+				return cobra.NoArgs(cmd, args)
+			}
+			return cobra.MinimumNArgs(1)(cmd, args)
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runAnnotate(*configPath, strings.Join(args, " "), ttl, list, clear)
+		},
+	}
+
+	cmd.Flags().DurationVar(&ttl, "ttl", 24*time.Hour, "How long the annotation is reported (0 keeps it until cleared)")
+	cmd.Flags().BoolVar(&list, "list", false, "List active annotations")
+	cmd.Flags().BoolVar(&clear, "clear", false, "Remove all annotations")
+
+	return cmd
+}
+
+func runAnnotate(configPath, message string, ttl time.Duration, list, clear bool) error {
+	configPath = install.ConfigPath(configPath)
+
+	cfg, err := config.LoadWithOverrides(configPath, nil)
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+
+	switch {
+	case clear:
+		if err := annotations.Clear(cfg.StateDir); err != nil {
+			return err
+		}
+		fmt.Println("✅ Annotations cleared")
+		return nil
+
+	case list:
+		active, err := annotations.Load(cfg.StateDir)
+		if err != nil {
+			return err
+		}
+		if len(active) == 0 {
+			fmt.Println("No active annotations")
+			return nil
+		}
+		for _, annotation := range active {
+			expires := "never"
+			if annotation.ExpiresAt != "" {
+				expires = annotation.ExpiresAt
+			}
+			fmt.Printf("📝 %s (by %s, created %s, expires %s)\n", annotation.Message, annotation.Author, annotation.CreatedAt, expires)
+		}
+		return nil
+	}
+
+	annotation, err := annotations.Add(cfg.StateDir, message, currentUser(), ttl)
+	if err != nil {
+		return fmt.Errorf("%w (try running with sudo)", err)
+	}
+
+	fmt.Printf("✅ Annotation added: %q\n", annotation.Message)
+	if annotation.ExpiresAt != "" {
+		fmt.Printf("   Expires: %s\n", annotation.ExpiresAt)
+	}
+	fmt.Println("💡 It will be included in the next heartbeat")
+	return nil
+}
+
+func currentUser() string {
+	if user := os.Getenv("SUDO_USER"); user != "" {
+		return user
+	}
+	return os.Getenv("USER")
+}
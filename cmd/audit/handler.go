@@ -0,0 +1,188 @@
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	auditlog "p0-ssh-agent/internal/audit"
+	"p0-ssh-agent/internal/config"
+	"p0-ssh-agent/internal/install"
+)
+
+type filter struct {
+	requestID string
+	userName  string
+	command   string
+	since     string
+	failed    bool
+	limit     int
+}
+
+func NewAuditCommand(verbose *bool, configPath *string) *cobra.Command {
+	var (
+		f          filter
+		jsonOutput bool
+		verify     bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "audit",
+		Short: "Query and verify the provisioning audit log",
+		Long: `Show provisioning actions recorded in <stateDir>/audit.log. Every grant and
+revoke is appended as a JSON line chained to the previous entry by a SHA-256
+hash, so removed or edited entries are detected by --verify.
+
+Examples:
+  sudo p0-ssh-agent audit --user alice --since 24h
+  sudo p0-ssh-agent audit --request-id req-123 --json
+  sudo p0-ssh-agent audit --verify`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runAudit(*configPath, f, jsonOutput, verify)
+		},
+	}
+
+	cmd.Flags().StringVar(&f.requestID, "request-id", "", "Only show entries for this request ID")
+	cmd.Flags().StringVar(&f.userName, "user", "", "Only show entries for this user")
+	cmd.Flags().StringVar(&f.command, "command", "", "Only show entries for this command")
+	cmd.Flags().StringVar(&f.since, "since", "", "Only show entries after an RFC 3339 time or a duration ago such as 24h")
+	cmd.Flags().BoolVar(&f.failed, "failed", false, "Only show failed actions")
+	cmd.Flags().IntVar(&f.limit, "limit", 0, "Show at most this many of the most recent matching entries (0 for all)")
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "Print matching entries as JSON lines")
+	cmd.Flags().BoolVar(&verify, "verify", false, "Verify the hash chain of the whole log")
+
+	return cmd
+}
+
+func runAudit(configPath string, f filter, jsonOutput, verify bool) error {
+	configPath = install.ConfigPath(configPath)
+
+	cfg, err := config.LoadWithOverrides(configPath, nil)
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+
+	path := auditlog.Path(cfg.StateDir)
+	entries, err := auditlog.Read(path)
+	if err != nil {
+		if errors.Is(err, os.ErrPermission) {
+			return fmt.Errorf("%w (try running with sudo)", err)
+		}
+		if !verify {
+			return err
+		}
+		// Report the entries that could be parsed before the corrupt line
+		fmt.Printf("❌ %v\n", err)
+	}
+
+	if verify {
+		return runVerify(path, entries, err)
+	}
+
+	since, err := parseSince(f.since, time.Now())
+	if err != nil {
+		return err
+	}
+
+	var matched []auditlog.Entry
+	for _, entry := range entries {
+		if f.matches(entry, since) {
+			matched = append(matched, entry)
+		}
+	}
+	if f.limit > 0 && len(matched) > f.limit {
+		matched = matched[len(matched)-f.limit:]
+	}
+
+	if jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		for _, entry := range matched {
+			if err := encoder.Encode(entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if len(matched) == 0 {
+		fmt.Println("No matching audit entries")
+		return nil
+	}
+
+	for _, entry := range matched {
+		icon := "✅"
+		detail := entry.Message
+		if !entry.Success {
+			icon = "❌"
+			detail = entry.Error
+		}
+		source := "unknown"
+		if entry.Origin != nil {
+			source = entry.Origin.Source
+		}
+		dryRun := ""
+		if entry.DryRun {
+			dryRun = " (dry-run)"
+		}
+		fmt.Printf("%s #%d %s %s %s user=%s request=%s via %s%s: %s\n",
+			icon, entry.Seq, entry.Time, entry.Command, entry.Action, entry.UserName, entry.RequestID, source, dryRun, detail)
+	}
+	return nil
+}
+
+func runVerify(path string, entries []auditlog.Entry, readErr error) error {
+	verified, err := auditlog.Verify(entries)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if readErr != nil {
+		return fmt.Errorf("%s: %d entries verified before an unreadable line", path, verified)
+	}
+
+	fmt.Printf("✅ %s: %d entries, hash chain intact\n", path, verified)
+	return nil
+}
+
+func (f filter) matches(entry auditlog.Entry, since time.Time) bool {
+	if f.requestID != "" && entry.RequestID != f.requestID {
+		return false
+	}
+	if f.userName != "" && entry.UserName != f.userName {
+		return false
+	}
+	if f.command != "" && entry.Command != f.command {
+		return false
+	}
+	if f.failed && entry.Success {
+		return false
+	}
+	if !since.IsZero() {
+		t, err := time.Parse(time.RFC3339Nano, entry.Time)
+		if err != nil || t.Before(since) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseSince accepts an RFC 3339 time or a duration before now
+func parseSince(since string, now time.Time) (time.Time, error) {
+	if since == "" {
+		return time.Time{}, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, since); err == nil {
+		return t, nil
+	}
+
+	if ago, err := time.ParseDuration(since); err == nil {
+		return now.Add(-ago), nil
+	}
+
+	return time.Time{}, fmt.Errorf("invalid --since %q: use an RFC 3339 time (2025-03-01T09:30:00Z) or a duration such as 24h", since)
+}
@@ -0,0 +1,84 @@
+package backup
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"p0-ssh-agent/internal/backup"
+	"p0-ssh-agent/internal/bundle"
+	"p0-ssh-agent/internal/config"
+	"p0-ssh-agent/internal/install"
+)
+
+func NewBackupCommand(verbose *bool, configPath *string) *cobra.Command {
+	var (
+		output         string
+		passphraseFile string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "backup",
+		Short: "Create an encrypted backup of keys, config and state",
+		Long: `Create an encrypted archive of the agent configuration, JWT keys, trusted CA
+and state directory for disaster recovery. Use 'p0-ssh-agent restore' on a
+rebuilt host to bring it back with the same identity.
+
+The archive is encrypted with AES-256-GCM using a key derived from the
+passphrase (read from --passphrase-file or ` + backup.PassphraseEnv + `).
+
+Examples:
+  sudo p0-ssh-agent backup --output host-backup.tar.enc --passphrase-file /root/backup.pass`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runBackup(*verbose, *configPath, output, passphraseFile)
+		},
+	}
+
+	cmd.Flags().StringVarP(&output, "output", "o", "", "Path of the encrypted archive to write (required)")
+	cmd.Flags().StringVar(&passphraseFile, "passphrase-file", "", "File containing the encryption passphrase")
+
+	cmd.MarkFlagRequired("output")
+
+	return cmd
+}
+
+func runBackup(verbose bool, configPath, output, passphraseFile string) error {
+	logger := logrus.New()
+	if verbose {
+		logger.SetLevel(logrus.DebugLevel)
+	} else {
+		logger.SetLevel(logrus.InfoLevel)
+	}
+
+	configPath = install.ConfigPath(configPath)
+
+	passphrase, err := backup.ReadPassphrase(passphraseFile)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := config.LoadWithOverrides(configPath, nil)
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+
+	archive, err := backup.Create(cfg, configPath, logger)
+	if err != nil {
+		return fmt.Errorf("failed to create backup: %w", err)
+	}
+
+	encrypted, err := bundle.Encrypt(archive, passphrase)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt backup: %w", err)
+	}
+
+	if err := os.WriteFile(output, encrypted, 0600); err != nil {
+		return fmt.Errorf("failed to write backup: %w", err)
+	}
+
+	fmt.Printf("\n✅ Encrypted backup written to %s\n", output)
+	fmt.Println("⚠️  IMPORTANT: This archive contains the host private key. Store it and the passphrase separately.")
+	return nil
+}
@@ -8,18 +8,30 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 
+	"p0-ssh-agent/internal/audit"
+	"p0-ssh-agent/internal/config"
+	"p0-ssh-agent/internal/filebackup"
+	"p0-ssh-agent/internal/install"
+	"p0-ssh-agent/internal/osplugins"
+	"p0-ssh-agent/internal/state"
+	"p0-ssh-agent/internal/userdb"
 	"p0-ssh-agent/scripts"
 )
 
 func NewCommandCommand(verbose *bool, configPath *string) *cobra.Command {
 	var (
-		command   string
-		userName  string
-		action    string
-		requestID string
-		publicKey string
-		sudo      bool
-		dryRun    bool
+		command      string
+		userName     string
+		action       string
+		requestID    string
+		publicKey    string
+		validTo      string
+		permitOpen   []string
+		sudo         bool
+		sudoCommands []string
+		sudoRunAs    []string
+		sudoPassword bool
+		dryRun       bool
 	)
 
 	cmd := &cobra.Command{
@@ -29,19 +41,29 @@ func NewCommandCommand(verbose *bool, configPath *string) *cobra.Command {
 This command allows you to test user provisioning, SSH key management, and sudo access
 without needing a full P0 backend connection.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
+			var sudoSpec *scripts.SudoSpec
+			if len(sudoCommands) > 0 || len(sudoRunAs) > 0 || sudoPassword {
+				noPassword := !sudoPassword
+				sudoSpec = &scripts.SudoSpec{Commands: sudoCommands, RunAs: sudoRunAs, NoPassword: &noPassword}
+			}
 			return runCommand(
 				*verbose, *configPath,
-				command, userName, action, requestID, publicKey, sudo, dryRun,
+				command, userName, action, requestID, publicKey, validTo, permitOpen, sudo, sudoSpec, dryRun,
 			)
 		},
 	}
 
-	cmd.Flags().StringVar(&command, "command", "", "Command to execute (provisionUser, provisionAuthorizedKeys, provisionSudo, provisionSession)")
+	cmd.Flags().StringVar(&command, "command", "", "Command to execute (provisionUser, provisionAuthorizedKeys, provisionSudo, provisionSession, provisionBanner, provisionPortForward, provisionCertificate)")
 	cmd.Flags().StringVar(&userName, "username", "", "Username for the operation")
 	cmd.Flags().StringVar(&action, "action", "grant", "Action to perform (grant or revoke)")
 	cmd.Flags().StringVar(&requestID, "request-id", "", "Request ID for tracking (auto-generated if empty)")
 	cmd.Flags().StringVar(&publicKey, "public-key", "", "SSH public key for authorized keys operations")
+	cmd.Flags().StringVar(&validTo, "valid-to", "", "Access expiry shown in login notices (RFC 3339)")
+	cmd.Flags().StringSliceVar(&permitOpen, "permit-open", nil, "Forwarding destinations (host:port) for provisionPortForward")
 	cmd.Flags().BoolVar(&sudo, "sudo", false, "Grant sudo access")
+	cmd.Flags().StringArrayVar(&sudoCommands, "sudo-command", nil, "Limit sudo to this command, an absolute path with optional arguments (repeatable)")
+	cmd.Flags().StringSliceVar(&sudoRunAs, "sudo-run-as", nil, "Limit sudo to running commands as these users")
+	cmd.Flags().BoolVar(&sudoPassword, "sudo-password", false, "Require the user's password for sudo")
 	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "Log commands but don't execute them (safe testing mode)")
 
 	cmd.MarkFlagRequired("command")
@@ -52,7 +74,8 @@ without needing a full P0 backend connection.`,
 
 func runCommand(
 	verbose bool, configPath string,
-	command, userName, action, requestID, publicKey string, sudo, dryRun bool,
+	command, userName, action, requestID, publicKey, validTo string, permitOpen []string, sudo bool,
+	sudoSpec *scripts.SudoSpec, dryRun bool,
 ) error {
 	logger := logrus.New()
 	if verbose {
@@ -65,6 +88,30 @@ func runCommand(
 		requestID = fmt.Sprintf("cmd-%d", generateRequestID(userName))
 	}
 
+	// Use the agent's audit log and file backups when an installed configuration is found
+	configPath = install.ConfigPath(configPath)
+	if cfg, err := config.LoadWithOverrides(configPath, nil); err == nil {
+		scripts.SetAuditLogPath(audit.Path(cfg.StateDir))
+		if err := scripts.ConfigureAuditSinks(cfg.AuditSinks, cfg.HostID); err != nil {
+			logger.WithError(err).Warn("Audit sinks unavailable, recording to the audit log only")
+		}
+		defer scripts.FlushAuditLog(logger)
+		scripts.SetStatePath(state.Path(cfg.StateDir))
+		scripts.SetFileBackupDir(filebackup.Dir(cfg.StateDir))
+		scripts.SetCertificateAuthorityDir(scripts.CertificateAuthorityDir(cfg.StateDir))
+		scripts.SetAuthorizedKeysFile(cfg.GetAuthorizedKeysFile())
+		scripts.SetSudoersLayout(cfg.GetSudoersLayout())
+		scripts.SetSessionRecording(cfg.GetSessionRecording())
+		if err := scripts.SetScriptLimits(cfg.ScriptLimits); err != nil {
+			logger.WithError(err).Warn("Script limits unavailable, running without them")
+		}
+		osplugins.SetSELinuxUser(cfg.SELinuxUser)
+		osplugins.SetOverride(cfg.OSPlugin)
+		userdb.Configure(cfg)
+	} else {
+		logger.WithError(err).Debug("No agent configuration loaded, using default state directory")
+	}
+
 	logger.WithFields(logrus.Fields{
 		"command":    command,
 		"username":   userName,
@@ -76,11 +123,15 @@ func runCommand(
 	}).Info("🧪 Executing provisioning command")
 
 	req := scripts.ProvisioningRequest{
-		UserName:  userName,
-		Action:    action,
-		RequestID: requestID,
-		PublicKey: publicKey,
-		Sudo:      sudo,
+		UserName:   userName,
+		Action:     action,
+		RequestID:  requestID,
+		PublicKey:  publicKey,
+		Sudo:       sudo,
+		SudoSpec:   sudoSpec,
+		ValidTo:    validTo,
+		PermitOpen: permitOpen,
+		Origin:     &audit.Origin{Source: "cli"},
 	}
 
 	fmt.Println("📋 Provisioning Request:")
@@ -123,4 +174,4 @@ func hash(s string) int {
 		h = -h
 	}
 	return h
-}
\ No newline at end of file
+}
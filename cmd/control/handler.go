@@ -0,0 +1,227 @@
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"p0-ssh-agent/internal/config"
+	"p0-ssh-agent/internal/connection"
+	"p0-ssh-agent/internal/control"
+	"p0-ssh-agent/internal/install"
+	"p0-ssh-agent/types"
+)
+
+// requestTimeout bounds control calls other than drain
+const requestTimeout = 10 * time.Second
+
+func NewControlCommand(verbose *bool, configPath *string) *cobra.Command {
+	var socket string
+
+	cmd := &cobra.Command{
+		Use:   "control",
+		Short: "Query and control the running agent over its local socket",
+		Long: `The running agent serves a small JSON API on a unix socket, by default
+/run/p0-ssh-agent.sock (see controlSocket). Only root can connect to it.
+Each subcommand makes one call and prints the reply as JSON.`,
+	}
+
+	cmd.PersistentFlags().StringVar(&socket, "socket", "", "Control socket path (default: controlSocket from the configuration)")
+
+	getter := func(use, short, path string, out func() interface{}) *cobra.Command {
+		return &cobra.Command{
+			Use:   use,
+			Short: short,
+			Args:  cobra.NoArgs,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				client, err := newClient(*configPath, socket, requestTimeout)
+				if err != nil {
+					return err
+				}
+				reply := out()
+				if err := client.Get(path, reply); err != nil {
+					return explain(err)
+				}
+				return printJSON(reply)
+			},
+		}
+	}
+
+	cmd.AddCommand(getter("health", "Show whether the agent is connected and serving requests", control.PathHealth,
+		func() interface{} { return &control.Health{} }))
+	cmd.AddCommand(getter("connection", "Show the live tunnel connection", control.PathConnection,
+		func() interface{} { return &connection.State{} }))
+	cmd.AddCommand(getter("grants", "List grants in effect or scheduled on this host", control.PathGrants,
+		func() interface{} { return &[]control.Grant{} }))
+	cmd.AddCommand(newReconnectCommand(configPath, &socket))
+	cmd.AddCommand(newDrainCommand(configPath, &socket))
+	cmd.AddCommand(newReloadCommand(configPath, &socket))
+	cmd.AddCommand(newGoingDownCommand(configPath, &socket))
+
+	return cmd
+}
+
+func newReconnectCommand(configPath, socket *string) *cobra.Command {
+	return &cobra.Command{
+		Use:   "reconnect",
+		Short: "Drop the tunnel connection and dial again",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			client, err := newClient(*configPath, *socket, requestTimeout)
+			if err != nil {
+				return err
+			}
+			if err := client.Post(control.PathReconnect, nil); err != nil {
+				return explain(err)
+			}
+			fmt.Println("🔄 Reconnect started")
+			return nil
+		},
+	}
+}
+
+func newDrainCommand(configPath, socket *string) *cobra.Command {
+	var timeout time.Duration
+
+	cmd := &cobra.Command{
+		Use:   "drain",
+		Short: "Stop accepting requests and wait for running provisioning",
+		Long: `Make the agent reject new requests from the backend and wait for running
+provisioning to finish. The agent stays drained until it is restarted, which
+makes this the first step of planned maintenance. Scheduled grants and
+expiry revokes keep running.
+
+Examples:
+  sudo p0-ssh-agent control drain
+  sudo p0-ssh-agent control drain --timeout 2m`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if timeout < 0 {
+				return fmt.Errorf("--timeout cannot be negative")
+			}
+
+			// The agent bounds the wait itself
+			client, err := newClient(*configPath, *socket, 0)
+			if err != nil {
+				return err
+			}
+
+			path := control.PathDrain
+			if timeout > 0 {
+				path += "?" + url.Values{"timeout": {timeout.String()}}.Encode()
+			}
+
+			var result control.DrainResult
+			if err := client.Post(path, &result); err != nil {
+				return explain(err)
+			}
+			return printJSON(result)
+		},
+	}
+
+	cmd.Flags().DurationVar(&timeout, "timeout", 0, "How long to wait for running provisioning (default: shutdownDrainSeconds)")
+
+	return cmd
+}
+
+func newReloadCommand(configPath, socket *string) *cobra.Command {
+	return &cobra.Command{
+		Use:   "reload",
+		Short: "Re-read the configuration file without restarting",
+		Long: `Make the agent re-read and validate its configuration. Requests use the new
+values as soon as they start; TLS, proxy, transport and heartbeat settings
+apply from the next connection. Changing the identity (orgId, hostId), keyPath,
+stateDir, the tunnel endpoints, authorizedKeysLayout, userResolution,
+dryRun, metricsAddress or controlSocket requires a restart, and such a
+configuration is rejected whole.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			client, err := newClient(*configPath, *socket, requestTimeout)
+			if err != nil {
+				return err
+			}
+			var result control.ReloadResult
+			if err := client.Post(control.PathReload, &result); err != nil {
+				return explain(err)
+			}
+			return printJSON(result)
+		},
+	}
+}
+
+func newGoingDownCommand(configPath, socket *string) *cobra.Command {
+	var reason, message string
+
+	cmd := &cobra.Command{
+		Use:   "going-down",
+		Short: "Announce why the agent is about to be stopped",
+		Long: `Record why the agent will be stopped next. When it stops, the agent sends
+the reason to the backend, which then shows the host as deliberately taken
+down instead of crashed. Without an announcement the agent reports
+"shutdown" while the host powers off or reboots and "restart" otherwise.
+The announcement lasts until the agent restarts.
+
+Examples:
+  sudo p0-ssh-agent control going-down --reason maintenance --message "kernel patching"
+  sudo p0-ssh-agent control going-down --reason upgrade`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			client, err := newClient(*configPath, *socket, requestTimeout)
+			if err != nil {
+				return err
+			}
+
+			path := control.PathGoingDown + "?" + url.Values{"reason": {reason}, "message": {message}}.Encode()
+			if err := client.Post(path, nil); err != nil {
+				return explain(err)
+			}
+			fmt.Printf("📴 The agent will report %q when it stops\n", reason)
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&reason, "reason", types.GoingDownMaintenance, fmt.Sprintf("Why the agent is stopped: one of %v", types.GoingDownReasons))
+	cmd.Flags().StringVar(&message, "message", "", "Free-form note for the backend")
+
+	return cmd
+}
+
+// newClient resolves the socket from the flag or the configuration
+func newClient(configPath, socket string, timeout time.Duration) (*control.Client, error) {
+	if socket == "" {
+		configPath = install.ConfigPath(configPath)
+		cfg, err := config.LoadWithOverrides(configPath, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load configuration: %w", err)
+		}
+		socket = cfg.GetControlSocket()
+		if socket == "" {
+			return nil, fmt.Errorf("the control socket is disabled (controlSocket: %s)", types.ControlSocketDisabled)
+		}
+	}
+
+	return control.NewClient(socket, timeout), nil
+}
+
+// explain adds a hint to the usual reasons the socket cannot be reached
+func explain(err error) error {
+	switch {
+	case errors.Is(err, os.ErrPermission):
+		return fmt.Errorf("%w (try running with sudo)", err)
+	case errors.Is(err, os.ErrNotExist), errors.Is(err, syscall.ECONNREFUSED):
+		return fmt.Errorf("%w (is the agent running?)", err)
+	}
+	return err
+}
+
+func printJSON(value interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
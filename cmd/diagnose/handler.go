@@ -0,0 +1,81 @@
+package diagnose
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"p0-ssh-agent/internal/config"
+	"p0-ssh-agent/internal/diagnostics"
+	"p0-ssh-agent/internal/install"
+	"p0-ssh-agent/types"
+)
+
+func NewDiagnoseCommand(verbose *bool, configPath *string) *cobra.Command {
+	var (
+		output      string
+		serviceName string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "diagnose",
+		Short: "Collect a diagnostics bundle for support",
+		Long: `Collect agent, service and host details into a compressed tar bundle that
+can be shared with support. The same bundle can be requested remotely by the
+backend through the collectDiagnostics RPC when it is allowlisted.
+
+The bundle includes the config file, public key, service status and recent
+journal entries. The private key is never included.
+
+Examples:
+  sudo p0-ssh-agent diagnose
+  sudo p0-ssh-agent diagnose --output /tmp/p0-diagnostics.tar.gz`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runDiagnose(*verbose, *configPath, output, serviceName)
+		},
+	}
+
+	cmd.Flags().StringVarP(&output, "output", "o", "", "Path of the bundle to write (default: p0-diagnostics-<host>-<timestamp>.tar.gz)")
+	cmd.Flags().StringVar(&serviceName, "service-name", "p0-ssh-agent", "Name of the systemd service")
+
+	return cmd
+}
+
+func runDiagnose(verbose bool, configPath, output, serviceName string) error {
+	logger := logrus.New()
+	if verbose {
+		logger.SetLevel(logrus.DebugLevel)
+	} else {
+		logger.SetLevel(logrus.InfoLevel)
+	}
+
+	configPath = install.ConfigPath(configPath)
+
+	cfg, err := config.LoadWithOverrides(configPath, nil)
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+
+	if output == "" {
+		hostname := cfg.HostID
+		if cfg.GetCollection().Allows(types.CollectHostname) {
+			hostname, _ = os.Hostname()
+		}
+		output = fmt.Sprintf("p0-diagnostics-%s-%s.tar.gz", hostname, time.Now().UTC().Format("20060102T150405Z"))
+	}
+
+	data, err := diagnostics.Collect(cfg, configPath, serviceName, logger)
+	if err != nil {
+		return fmt.Errorf("failed to collect diagnostics: %w", err)
+	}
+
+	if err := os.WriteFile(output, data, 0600); err != nil {
+		return fmt.Errorf("failed to write diagnostics bundle: %w", err)
+	}
+
+	fmt.Printf("\n✅ Diagnostics bundle written to %s (%d bytes)\n", output, len(data))
+	return nil
+}
@@ -0,0 +1,99 @@
+package doctor
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"p0-ssh-agent/internal/doctor"
+)
+
+func NewDoctorCommand(verbose *bool, configPath *string) *cobra.Command {
+	var (
+		serviceName string
+		fix         bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "doctor",
+		Short: "Detect and repair common installation problems",
+		Long: `Detect common installation problems and optionally repair them.
+
+Checks:
+- The systemd unit's ExecStart and the installed binary refer to the same
+  file and report the same version (e.g. unit points at /usr/bin while an
+  upgrade landed in /usr/local/bin)
+
+Examples:
+  p0-ssh-agent doctor
+  sudo p0-ssh-agent doctor --fix`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runDoctor(*verbose, serviceName, fix)
+		},
+	}
+
+	cmd.Flags().StringVar(&serviceName, "service-name", "p0-ssh-agent", "Name of the systemd service")
+	cmd.Flags().BoolVar(&fix, "fix", false, "Repair detected problems")
+
+	return cmd
+}
+
+func runDoctor(verbose bool, serviceName string, fix bool) error {
+	logger := logrus.New()
+	if verbose {
+		logger.SetLevel(logrus.DebugLevel)
+	} else {
+		logger.SetLevel(logrus.InfoLevel)
+	}
+
+	fmt.Println("🩺 P0 SSH Agent Doctor")
+	fmt.Println(strings.Repeat("=", 40))
+
+	problems := 0
+
+	fmt.Print("🔗 Unit ExecStart matches installed binary... ")
+	check, err := doctor.CheckUnitBinary(serviceName, logger)
+	switch {
+	case err != nil:
+		fmt.Println("❌ UNABLE TO CHECK")
+		fmt.Printf("   %v\n", err)
+		problems++
+	case check.OK():
+		fmt.Println("✅ OK")
+	default:
+		fmt.Println("❌ MISMATCH")
+		fmt.Printf("   Unit:      %s (%s)\n", check.UnitBinary, versionOrUnknown(check.UnitVersion))
+		fmt.Printf("   Installed: %s (%s)\n", check.DetectedBinary, versionOrUnknown(check.DetectedVersion))
+
+		if fix {
+			if err := doctor.FixUnitBinary(check, logger); err != nil {
+				fmt.Printf("   ❌ Fix failed: %v\n", err)
+				problems++
+			} else {
+				fmt.Printf("   🔧 Fixed: unit now runs %s\n", check.DetectedBinary)
+				fmt.Printf("   💡 Restart to apply: sudo systemctl restart %s\n", serviceName)
+			}
+		} else {
+			fmt.Println("   💡 Run: sudo p0-ssh-agent doctor --fix")
+			problems++
+		}
+	}
+
+	fmt.Println(strings.Repeat("=", 40))
+
+	if problems > 0 {
+		return fmt.Errorf("%d problem(s) found", problems)
+	}
+
+	fmt.Println("🎉 No problems found")
+	return nil
+}
+
+func versionOrUnknown(version string) string {
+	if version == "" {
+		return "version unknown"
+	}
+	return "version " + version
+}
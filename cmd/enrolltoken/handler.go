@@ -0,0 +1,184 @@
+package enrolltoken
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"p0-ssh-agent/types"
+)
+
+const (
+	// minTTL and maxTTL bound how long an enrollment token stays usable
+	minTTL = time.Minute
+	maxTTL = 7 * 24 * time.Hour
+
+	// requestTimeout bounds the call to the backend
+	requestTimeout = 30 * time.Second
+)
+
+func NewEnrollTokenCommand(verbose *bool, configPath *string) *cobra.Command {
+	var (
+		auth        string
+		url         string
+		ttl         time.Duration
+		uses        int
+		labels      []string
+		description string
+		jsonOutput  bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "enroll-token",
+		Short: "Mint a single-use enrollment token for register",
+		Long: `Ask the P0 backend for a narrowly scoped enrollment token, so a host can
+be registered without handing out the org bearer token. The token expires
+after --ttl, can be used --uses times (once by default) and hosts registered
+with it get exactly the given labels.
+
+--url is the same registration URL passed to register.
+
+Examples:
+  p0-ssh-agent enroll-token --auth "admin-token" \
+    --url "https://p0.dev/o/myorg/integrations/self-hosted/computers/default/register" \
+    --ttl 1h --labels env=staging
+
+  sudo p0-ssh-agent register --enroll-token "<token>" \
+    --url "https://p0.dev/o/myorg/integrations/self-hosted/computers/default/register"`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runEnrollToken(*verbose, auth, url, ttl, uses, labels, description, jsonOutput)
+		},
+	}
+
+	cmd.Flags().StringVar(&auth, "auth", "", "Org bearer token of an admin (required)")
+	cmd.Flags().StringVar(&url, "url", "", "Registration URL, as passed to register (required)")
+	cmd.Flags().DurationVar(&ttl, "ttl", time.Hour, "How long the token can be used")
+	cmd.Flags().IntVar(&uses, "uses", 1, "How many hosts may register with the token")
+	cmd.Flags().StringSliceVar(&labels, "labels", nil, "Labels in key=value format given to hosts registered with the token")
+	cmd.Flags().StringVar(&description, "description", "", "Note stored with the token, e.g. who it was issued to")
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "Print the backend response as JSON")
+
+	cmd.MarkFlagRequired("auth")
+	cmd.MarkFlagRequired("url")
+
+	return cmd
+}
+
+func runEnrollToken(verbose bool, auth, url string, ttl time.Duration, uses int, labels []string, description string, jsonOutput bool) error {
+	logger := logrus.New()
+	if verbose {
+		logger.SetLevel(logrus.DebugLevel)
+	} else {
+		logger.SetLevel(logrus.WarnLevel)
+	}
+
+	if ttl < minTTL || ttl > maxTTL {
+		return fmt.Errorf("--ttl must be between %s and %s", minTTL, maxTTL)
+	}
+	if uses < 1 {
+		return fmt.Errorf("--uses must be at least 1")
+	}
+	for _, label := range labels {
+		if key, _, ok := strings.Cut(label, "="); !ok || key == "" {
+			return fmt.Errorf("invalid label %q: expected key=value", label)
+		}
+	}
+
+	tokenURL, err := enrollmentTokenURL(url)
+	if err != nil {
+		return err
+	}
+
+	response, err := requestToken(auth, tokenURL, types.EnrollmentTokenRequest{
+		TTLSeconds:  int(ttl.Seconds()),
+		MaxUses:     uses,
+		Labels:      labels,
+		Description: description,
+	}, logger)
+	if err != nil {
+		return err
+	}
+
+	if jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(response)
+	}
+
+	fmt.Println("🎟️  Enrollment token created")
+	fmt.Printf("   Token:   %s\n", response.Token)
+	fmt.Printf("   Expires: %s\n", response.ExpiresAt)
+	fmt.Printf("   Uses:    %d\n", response.MaxUses)
+	if len(response.Labels) > 0 {
+		fmt.Printf("   Labels:  %s\n", strings.Join(response.Labels, ", "))
+	}
+	fmt.Println()
+	fmt.Println("Register a host with:")
+	fmt.Printf("   sudo p0-ssh-agent register --enroll-token %q --url %q\n", response.Token, url)
+	return nil
+}
+
+// enrollmentTokenURL derives the token endpoint from the registration URL,
+// which ends in /register
+func enrollmentTokenURL(registerURL string) (string, error) {
+	base, ok := strings.CutSuffix(strings.TrimRight(registerURL, "/"), "/register")
+	if !ok {
+		return "", fmt.Errorf("--url must be the registration URL ending in /register")
+	}
+	return base + "/enrollment-tokens", nil
+}
+
+func requestToken(auth, tokenURL string, request types.EnrollmentTokenRequest, logger *logrus.Logger) (*types.EnrollmentTokenResponse, error) {
+	requestJSON, err := json.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request body: %w", err)
+	}
+
+	req, err := http.NewRequest("POST", tokenURL, bytes.NewBuffer(requestJSON))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+auth)
+
+	logger.WithFields(logrus.Fields{
+		"url":         tokenURL,
+		"ttl_seconds": request.TTLSeconds,
+		"max_uses":    request.MaxUses,
+		"labels":      request.Labels,
+	}).Debug("Requesting enrollment token")
+
+	client := &http.Client{Timeout: requestTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request enrollment token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("enrollment token request failed with status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var response types.EnrollmentTokenResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("failed to parse enrollment token response: %w", err)
+	}
+	if !response.Ok || response.Token == "" {
+		return nil, fmt.Errorf("backend did not issue an enrollment token")
+	}
+	return &response, nil
+}
@@ -0,0 +1,260 @@
+package grants
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+
+	"p0-ssh-agent/internal/config"
+	"p0-ssh-agent/internal/install"
+	"p0-ssh-agent/internal/state"
+	"p0-ssh-agent/scripts"
+)
+
+// User is the access one JIT user holds on this host. Times are RFC 3339.
+type User struct {
+	UserName   string   `json:"userName"`
+	Sudo       bool     `json:"sudo"`
+	Keys       []Key    `json:"keys"`
+	RequestIDs []string `json:"requestIds"`
+	Commands   []string `json:"commands"`
+	GrantedAt  string   `json:"grantedAt,omitempty"`
+	// ExpiresAt is when the last of the user's grants expires; empty when
+	// any of them has no expiry
+	ExpiresAt string `json:"expiresAt,omitempty"`
+	Expired   bool   `json:"expired"`
+}
+
+// Key is a public key or CA key granted to a user
+type Key struct {
+	Fingerprint string `json:"fingerprint"`
+	Type        string `json:"type"`
+	Comment     string `json:"comment,omitempty"`
+	CA          bool   `json:"ca"`
+	RequestID   string `json:"requestId"`
+}
+
+func NewGrantsCommand(verbose *bool, configPath *string) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "grants",
+		Short: "Inspect access provisioned on this host",
+		Long: `Show what the agent has provisioned on this host, as recorded in
+<stateDir>/provisioning.json. The agent does not need to be running.`,
+	}
+
+	cmd.AddCommand(newListCommand(configPath))
+
+	return cmd
+}
+
+func newListCommand(configPath *string) *cobra.Command {
+	var (
+		jsonOutput bool
+		userName   string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List JIT users with their keys, sudo access and expiry",
+		Long: `List every user holding a grant, with the fingerprints of their SSH keys and
+CA keys, whether they have sudo, when their access expires and the requests
+that granted it. Users whose grants have expired but not yet been revoked are
+marked as expired.
+
+Examples:
+  sudo p0-ssh-agent grants list
+  sudo p0-ssh-agent grants list --user alice --json`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runList(*configPath, userName, jsonOutput)
+		},
+	}
+
+	cmd.Flags().StringVar(&userName, "user", "", "Only show this user")
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "Print users as JSON")
+
+	return cmd
+}
+
+func runList(configPath, userName string, jsonOutput bool) error {
+	configPath = install.ConfigPath(configPath)
+
+	cfg, err := config.LoadWithOverrides(configPath, nil)
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+
+	recorded, err := state.Load(state.Path(cfg.StateDir))
+	if err != nil {
+		if errors.Is(err, os.ErrPermission) {
+			return fmt.Errorf("%w (try running with sudo)", err)
+		}
+		return err
+	}
+
+	users := activeUsers(recorded, time.Now())
+	if userName != "" {
+		var matched []User
+		for _, user := range users {
+			if user.UserName == userName {
+				matched = append(matched, user)
+			}
+		}
+		users = matched
+	}
+
+	if jsonOutput {
+		if users == nil {
+			users = []User{}
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(users)
+	}
+
+	if len(users) == 0 {
+		fmt.Println("No active grants")
+		return nil
+	}
+
+	for _, user := range users {
+		icon := "👤"
+		expiry := "never"
+		if user.ExpiresAt != "" {
+			expiry = user.ExpiresAt
+		}
+		if user.Expired {
+			icon = "⌛"
+			expiry += " (expired, revoke pending)"
+		}
+		sudo := "no"
+		if user.Sudo {
+			sudo = "yes"
+		}
+
+		fmt.Printf("%s %s\n", icon, user.UserName)
+		fmt.Printf("   Sudo:     %s\n", sudo)
+		fmt.Printf("   Expires:  %s\n", expiry)
+		fmt.Printf("   Requests: %s\n", strings.Join(user.RequestIDs, ", "))
+		for _, key := range user.Keys {
+			kind := "key"
+			if key.CA {
+				kind = "CA"
+			}
+			fmt.Printf("   🔑 %s (%s, request %s)\n", strings.TrimSpace(key.Type+" "+key.Fingerprint+" "+key.Comment), kind, key.RequestID)
+		}
+	}
+	return nil
+}
+
+// activeUsers groups granted entries by user, sorted by name
+func activeUsers(recorded []state.Grant, now time.Time) []User {
+	byName := make(map[string]*User)
+	latest := make(map[string]time.Time)
+	earliest := make(map[string]time.Time)
+	forever := make(map[string]bool)
+	seen := make(map[string]bool)
+
+	for _, grant := range recorded {
+		if grant.Status != state.StatusGranted || grant.UserName == "" {
+			continue
+		}
+
+		user, ok := byName[grant.UserName]
+		if !ok {
+			user = &User{UserName: grant.UserName, Keys: []Key{}}
+			byName[grant.UserName] = user
+		}
+
+		if !containsString(user.RequestIDs, grant.RequestID) {
+			user.RequestIDs = append(user.RequestIDs, grant.RequestID)
+		}
+		if !containsString(user.Commands, grant.Command) {
+			user.Commands = append(user.Commands, grant.Command)
+		}
+
+		if grant.ExpiresAt.IsZero() {
+			forever[grant.UserName] = true
+		} else if grant.ExpiresAt.After(latest[grant.UserName]) {
+			latest[grant.UserName] = grant.ExpiresAt
+		}
+		if !grant.GrantedAt.IsZero() && (earliest[grant.UserName].IsZero() || grant.GrantedAt.Before(earliest[grant.UserName])) {
+			earliest[grant.UserName] = grant.GrantedAt
+		}
+
+		var req scripts.ProvisioningRequest
+		if err := json.Unmarshal(grant.Request, &req); err != nil {
+			continue
+		}
+		if scripts.Command(grant.Command) == scripts.CommandProvisionSudo && (req.Sudo || req.SudoSpec != nil) {
+			user.Sudo = true
+		}
+		for _, candidate := range []struct {
+			text string
+			ca   bool
+		}{{req.PublicKey, false}, {req.CAPublicKey, true}} {
+			key, ok := parseKey(candidate.text, candidate.ca, grant.RequestID)
+			if !ok || seen[grant.UserName+" "+key.Fingerprint] {
+				continue
+			}
+			seen[grant.UserName+" "+key.Fingerprint] = true
+			user.Keys = append(user.Keys, key)
+		}
+	}
+
+	users := make([]User, 0, len(byName))
+	for name, user := range byName {
+		sort.Strings(user.RequestIDs)
+		sort.Strings(user.Commands)
+		user.GrantedAt = formatTime(earliest[name])
+		if !forever[name] {
+			user.ExpiresAt = formatTime(latest[name])
+			user.Expired = !now.Before(latest[name])
+		}
+		users = append(users, *user)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].UserName < users[j].UserName
+	})
+	return users
+}
+
+func parseKey(text string, ca bool, requestID string) (Key, bool) {
+	if text == "" || text == "N/A" {
+		return Key{}, false
+	}
+	key, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(text))
+	if err != nil {
+		return Key{}, false
+	}
+	return Key{
+		Fingerprint: ssh.FingerprintSHA256(key),
+		Type:        key.Type(),
+		Comment:     comment,
+		CA:          ca,
+		RequestID:   requestID,
+	}, true
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func containsString(list []string, value string) bool {
+	for _, existing := range list {
+		if existing == value {
+			return true
+		}
+	}
+	return false
+}
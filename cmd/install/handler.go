@@ -0,0 +1,107 @@
+package install
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"p0-ssh-agent/internal/install"
+	"p0-ssh-agent/internal/osplugins"
+)
+
+func NewInstallCommand(verbose *bool, configPath *string) *cobra.Command {
+	var (
+		serviceName  string
+		allowRoot    bool
+		importBundle string
+		writableDir  string
+		osPlugin     string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "install",
+		Short: "Install P0 SSH Agent binary, keys and service without registering",
+		Long: `Install the P0 SSH Agent on this machine without contacting the P0 backend.
+This command will:
+- Install the P0 SSH Agent binary and service files
+- Import operator-provided keys, config and trusted CA (with --import-bundle)
+- Generate JWT keys if none were provided
+- Set up systemd service
+
+On hosts with a read-only root filesystem, pass --writable-dir to relocate the
+binary, keys, state (and config when /etc is read-only) to a writable volume.
+
+The OS plugin is detected automatically; pass --os-plugin to force one (see
+"p0-ssh-agent plugins list") and set osPlugin in the config so the agent uses
+the same plugin.
+
+Bundles are tar archives that may contain:
+  config.yaml, keys/jwk.private.json, keys/jwk.public.json, trusted-ca.pub
+
+Examples:
+  # Golden image workflow with a pipeline-baked bundle
+  p0-ssh-agent install --import-bundle /tmp/p0-bundle.tar
+
+  # Appliance with read-only root
+  p0-ssh-agent install --writable-dir /data/p0-ssh-agent`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runInstall(*verbose, *configPath, serviceName, allowRoot, importBundle, writableDir, osPlugin)
+		},
+	}
+
+	cmd.Flags().StringVar(&serviceName, "service-name", "p0-ssh-agent", "Name for the systemd service")
+	cmd.Flags().BoolVar(&allowRoot, "allow-root", false, "Allow installation to run as root")
+	cmd.Flags().StringVar(&importBundle, "import-bundle", "", "Tar bundle with pre-seeded config, keys and trusted CA")
+	cmd.Flags().StringVar(&writableDir, "writable-dir", "", "Writable volume for keys, state and binary on read-only root filesystems")
+	cmd.Flags().StringVar(&osPlugin, "os-plugin", "", "OS plugin to use instead of auto-detection (see plugins list)")
+
+	return cmd
+}
+
+func runInstall(verbose bool, configPath, serviceName string, allowRoot bool, importBundle, writableDir, pluginName string) error {
+	logger := logrus.New()
+	if verbose {
+		logger.SetLevel(logrus.DebugLevel)
+	} else {
+		logger.SetLevel(logrus.InfoLevel)
+	}
+
+	configPath = install.ConfigPath(configPath)
+
+	if importBundle != "" {
+		if _, err := os.Stat(importBundle); err != nil {
+			return fmt.Errorf("bundle not accessible: %w", err)
+		}
+	}
+
+	logger.Info("📦 Installing P0 SSH Agent...")
+
+	osplugins.SetOverride(pluginName)
+	osPlugin, err := osplugins.GetPlugin(logger)
+	if err != nil {
+		return fmt.Errorf("failed to select OS plugin: %w", err)
+	}
+
+	installConfig := osplugins.InstallConfig{
+		ServiceName: serviceName,
+		ConfigPath:  configPath,
+		KeyPath:     install.DefaultKeyPath,
+		AllowRoot:   allowRoot,
+		BundlePath:  importBundle,
+		WritableDir: writableDir,
+	}
+
+	if err := install.Run(logger, osPlugin, &installConfig); err != nil {
+		return fmt.Errorf("installation failed: %w", err)
+	}
+	configPath = installConfig.ConfigPath
+
+	if _, err := os.Stat(configPath); os.IsNotExist(err) {
+		fmt.Printf("\n⚠️  No configuration found at %s - run 'p0-ssh-agent register' or provide one before starting the service\n", configPath)
+	}
+
+	osPlugin.DisplayInstallationSuccess(serviceName, configPath, verbose)
+	return nil
+}
@@ -14,12 +14,12 @@ import (
 
 func NewJWTCommand(verbose *bool, configPath *string) *cobra.Command {
 	var (
-		keyPath     string
-		clientID    string
-		orgID       string
-		hostID      string
-		tunnelID    string
-		expiration  string
+		keyPath    string
+		clientID   string
+		orgID      string
+		hostID     string
+		tunnelID   string
+		expiration string
 	)
 
 	cmd := &cobra.Command{
@@ -65,10 +65,12 @@ func runJWT(verbose bool, configPath, keyPath, clientID, orgID, hostID, tunnelID
 		logger = logging.SetupLogger(verbose)
 	}
 
-	// Determine key path
+	// Determine key path, in the directory of the configured key profile
 	finalKeyPath = keyPath
-	if finalKeyPath == "" && cfg != nil {
-		finalKeyPath = cfg.KeyPath
+	var profile string
+	if cfg != nil {
+		finalKeyPath = cfg.GetKeyDir()
+		profile = cfg.KeyProfile
 	}
 
 	// Determine client ID
@@ -77,18 +79,18 @@ func runJWT(verbose bool, configPath, keyPath, clientID, orgID, hostID, tunnelID
 	} else {
 		finalOrgID := orgID
 		finalHostID := hostID
-		
+
 		if finalOrgID == "" && cfg != nil {
 			finalOrgID = cfg.OrgID
 		}
 		if finalHostID == "" && cfg != nil {
 			finalHostID = cfg.HostID
 		}
-		
+
 		if finalOrgID == "" || finalHostID == "" {
 			return fmt.Errorf("either --client-id or both --org-id and --host-id must be provided")
 		}
-		
+
 		finalClientID = finalOrgID + ":" + finalHostID + ":ssh"
 	}
 
@@ -106,9 +108,15 @@ func runJWT(verbose bool, configPath, keyPath, clientID, orgID, hostID, tunnelID
 
 	// Create JWT manager and load keys
 	jwtManager := jwt.NewManager(logger)
+	jwtManager.SetProfile(profile)
 	if err := jwtManager.LoadKey(finalKeyPath); err != nil {
 		return fmt.Errorf("failed to load JWT keys: %w", err)
 	}
+	var leeway time.Duration
+	if cfg != nil {
+		leeway = cfg.GetJWTExpiryLeeway()
+		jwtManager.SetClockSkew(cfg.GetJWTNotBefore(), leeway)
+	}
 
 	// Create custom JWT with tunnel ID and expiration
 	token, err := jwtManager.CreateJWTWithOptions(finalClientID, tunnelID, duration)
@@ -119,7 +127,7 @@ func runJWT(verbose bool, configPath, keyPath, clientID, orgID, hostID, tunnelID
 	fmt.Println("\n🔐 JWT Token Generated Successfully!")
 	fmt.Printf("👤 Client ID: %s\n", finalClientID)
 	fmt.Printf("🎯 Tunnel ID: %s\n", tunnelID)
-	fmt.Printf("⏰ Expires: %s\n", time.Now().Add(duration).Format(time.RFC3339))
+	fmt.Printf("⏰ Expires: %s\n", time.Now().Add(duration+leeway).Format(time.RFC3339))
 	fmt.Println("\n📋 JWT Token:")
 	fmt.Println("=================================")
 	fmt.Println(token)
@@ -129,4 +137,4 @@ func runJWT(verbose bool, configPath, keyPath, clientID, orgID, hostID, tunnelID
 	fmt.Println("\n⚠️  SECURITY: This token grants access to your websocket. Keep it secure!")
 
 	return nil
-}
\ No newline at end of file
+}
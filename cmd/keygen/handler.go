@@ -11,13 +11,15 @@ import (
 	"p0-ssh-agent/internal/config"
 	"p0-ssh-agent/internal/jwt"
 	"p0-ssh-agent/internal/logging"
+	"p0-ssh-agent/types"
 )
 
 func NewKeygenCommand(verbose *bool, configPath *string) *cobra.Command {
 	var (
 		keyPath string
+		profile string
 		force   bool
-		
+
 		keygenPath string
 	)
 
@@ -26,27 +28,41 @@ func NewKeygenCommand(verbose *bool, configPath *string) *cobra.Command {
 		Short: "Generate JWT keypair for P0 SSH Agent",
 		Long: `Generate ES384 JWT keypair for P0 SSH Agent authentication.
 This command should be run once to create the keypair that will be registered
-with the P0 backend. The public key will be used for machine registration.`,
+with the P0 backend. The public key will be used for machine registration.
+
+A host registered with more than one P0 backend (e.g. staging and production)
+uses a separate key pair for each: --profile (or keyProfile in the config)
+stores the pair in a subdirectory of keyPath and records the profile in the kid.
+
+Examples:
+  p0-ssh-agent keygen
+  p0-ssh-agent keygen --profile staging`,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return runKeygen(*verbose, *configPath, keyPath, force, keygenPath)
+			return runKeygen(*verbose, *configPath, keyPath, profile, force, keygenPath)
 		},
 	}
 
 	cmd.Flags().StringVar(&keyPath, "key-path", "", "Directory to store JWT key files")
+	cmd.Flags().StringVar(&profile, "profile", "", "Key profile to generate the key pair for (default: the config's keyProfile)")
 	cmd.Flags().BoolVar(&force, "force", false, "Overwrite existing keys")
 	cmd.Flags().StringVar(&keygenPath, "path", "", "Directory to store JWT key files (deprecated, use --key-path)")
 
 	return cmd
 }
 
-func runKeygen(verbose bool, configPath, keyPath string, force bool, keygenPath string) error {
+func runKeygen(verbose bool, configPath, keyPath, profile string, force bool, keygenPath string) error {
+	if profile != "" && !types.IsKeyProfile(profile) {
+		return fmt.Errorf("invalid --profile %q: use lowercase letters, digits, - and _", profile)
+	}
+
 	flagOverrides := map[string]interface{}{
-		"keyPath": keyPath,
+		"keyPath":    keyPath,
+		"keyProfile": profile,
 	}
-	
+
 	var logger *logrus.Logger
 	var finalKeyPath string
-	
+
 	cfg, err := config.LoadWithOverrides(configPath, flagOverrides)
 	if err != nil {
 		logger = logrus.New()
@@ -57,21 +73,31 @@ func runKeygen(verbose bool, configPath, keyPath string, force bool, keygenPath
 	} else {
 		logger = logging.SetupLogger(verbose)
 	}
-	
+
 	finalKeyPath = keyPath
 	if finalKeyPath == "" && keygenPath != "" {
 		finalKeyPath = keygenPath
 	}
-	
+
 	if finalKeyPath == "" && cfg != nil {
 		finalKeyPath = cfg.KeyPath
 	}
-	
-	logger.WithField("path", finalKeyPath).Info("P0 SSH Agent Key Generator")
-	
+
+	if profile == "" && cfg != nil {
+		profile = cfg.KeyProfile
+	}
+	if profile != "" {
+		finalKeyPath = filepath.Join(finalKeyPath, profile)
+	}
+
+	logger.WithFields(logrus.Fields{
+		"path":    finalKeyPath,
+		"profile": profile,
+	}).Info("P0 SSH Agent Key Generator")
+
 	privateKeyPath := filepath.Join(finalKeyPath, jwt.PrivateKeyFile)
 	publicKeyPath := filepath.Join(finalKeyPath, jwt.PublicKeyFile)
-	
+
 	if !force {
 		if _, err := os.Stat(privateKeyPath); err == nil {
 			logger.WithField("path", privateKeyPath).Error("Private key already exists")
@@ -80,24 +106,31 @@ func runKeygen(verbose bool, configPath, keyPath string, force bool, keygenPath
 			return fmt.Errorf("keys already exist at %s", finalKeyPath)
 		}
 	}
-	
+
 	jwtManager := jwt.NewManager(logger)
-	
+	jwtManager.SetProfile(profile)
+
 	if err := jwtManager.GenerateKeyPair(finalKeyPath); err != nil {
 		logger.WithError(err).Error("Failed to generate keypair")
 		return err
 	}
-	
+
 	publicKey, err := os.ReadFile(publicKeyPath)
 	if err != nil {
 		logger.WithError(err).Error("Failed to read generated public key")
 		return err
 	}
-	
+
+	keyID, err := jwtManager.KeyID()
+	if err != nil {
+		return err
+	}
+
 	fmt.Println("\n🔑 JWT Keypair Generated Successfully!")
 	fmt.Printf("📁 Location: %s\n", finalKeyPath)
 	fmt.Printf("🔒 Private Key: %s\n", privateKeyPath)
 	fmt.Printf("🔓 Public Key: %s\n", publicKeyPath)
+	fmt.Printf("🏷️  Key ID: %s\n", keyID)
 	fmt.Println("\n📋 Public Key for Registration:")
 	fmt.Println("=================================")
 	fmt.Print(string(publicKey))
@@ -105,8 +138,12 @@ func runKeygen(verbose bool, configPath, keyPath string, force bool, keygenPath
 	fmt.Println("\n💡 Next Steps:")
 	fmt.Println("1. Register the public key above with your P0 backend")
 	fmt.Println("2. Keep the private key secure and backed up")
-	fmt.Printf("3. Run: p0-ssh-agent start --org-id YOUR_ORG --host-id YOUR_HOST --key-path %s\n", finalKeyPath)
+	if profile != "" {
+		fmt.Printf("3. Set keyProfile: %s in the config of the agent for this backend\n", profile)
+	} else {
+		fmt.Printf("3. Run: p0-ssh-agent start --org-id YOUR_ORG --host-id YOUR_HOST --key-path %s\n", finalKeyPath)
+	}
 	fmt.Println("\n⚠️  IMPORTANT: Back up these keys! Losing them will require re-registration.")
-	
+
 	return nil
-}
\ No newline at end of file
+}
@@ -5,10 +5,30 @@ import (
 
 	"github.com/spf13/cobra"
 
+	"p0-ssh-agent/cmd/annotate"
+	"p0-ssh-agent/cmd/audit"
+	"p0-ssh-agent/cmd/backup"
 	"p0-ssh-agent/cmd/command"
+	"p0-ssh-agent/cmd/control"
+	"p0-ssh-agent/cmd/diagnose"
+	"p0-ssh-agent/cmd/doctor"
+	"p0-ssh-agent/cmd/enrolltoken"
+	"p0-ssh-agent/cmd/grants"
+	"p0-ssh-agent/cmd/install"
 	"p0-ssh-agent/cmd/jwt"
 	"p0-ssh-agent/cmd/keygen"
+	"p0-ssh-agent/cmd/migrate"
+	"p0-ssh-agent/cmd/pkg"
+	"p0-ssh-agent/cmd/plugins"
+	"p0-ssh-agent/cmd/queue"
+	"p0-ssh-agent/cmd/reconcile"
+	"p0-ssh-agent/cmd/recordsession"
 	"p0-ssh-agent/cmd/register"
+	"p0-ssh-agent/cmd/restore"
+	"p0-ssh-agent/cmd/restorefile"
+	"p0-ssh-agent/cmd/revoke"
+	"p0-ssh-agent/cmd/rotatekeys"
+	"p0-ssh-agent/cmd/simulate"
 	"p0-ssh-agent/cmd/start"
 	"p0-ssh-agent/cmd/status"
 	"p0-ssh-agent/cmd/uninstall"
@@ -34,12 +54,32 @@ func init() {
 
 	rootCmd.AddCommand(start.NewStartCommand(&verbose, &configPath))
 	rootCmd.AddCommand(keygen.NewKeygenCommand(&verbose, &configPath))
+	rootCmd.AddCommand(rotatekeys.NewRotateKeysCommand(&verbose, &configPath))
 	rootCmd.AddCommand(jwt.NewJWTCommand(&verbose, &configPath))
 	rootCmd.AddCommand(register.NewRegisterCommand(&verbose, &configPath))
+	rootCmd.AddCommand(enrolltoken.NewEnrollTokenCommand(&verbose, &configPath))
+	rootCmd.AddCommand(install.NewInstallCommand(&verbose, &configPath))
+	rootCmd.AddCommand(migrate.NewMigrateCommand(&verbose, &configPath))
+	rootCmd.AddCommand(pkg.NewPackageCommand(&verbose, &configPath))
+	rootCmd.AddCommand(backup.NewBackupCommand(&verbose, &configPath))
+	rootCmd.AddCommand(restore.NewRestoreCommand(&verbose, &configPath))
+	rootCmd.AddCommand(restorefile.NewRestoreFileCommand(&verbose, &configPath))
+	rootCmd.AddCommand(annotate.NewAnnotateCommand(&verbose, &configPath))
+	rootCmd.AddCommand(audit.NewAuditCommand(&verbose, &configPath))
+	rootCmd.AddCommand(diagnose.NewDiagnoseCommand(&verbose, &configPath))
+	rootCmd.AddCommand(doctor.NewDoctorCommand(&verbose, &configPath))
+	rootCmd.AddCommand(grants.NewGrantsCommand(&verbose, &configPath))
+	rootCmd.AddCommand(reconcile.NewReconcileCommand(&verbose, &configPath))
+	rootCmd.AddCommand(revoke.NewRevokeCommand(&verbose, &configPath))
+	rootCmd.AddCommand(queue.NewQueueCommand(&verbose, &configPath))
 	rootCmd.AddCommand(uninstall.NewUninstallCommand(&verbose, &configPath))
+	rootCmd.AddCommand(plugins.NewPluginsCommand(&verbose, &configPath))
 	rootCmd.AddCommand(status.NewStatusCommand(&verbose, &configPath))
+	rootCmd.AddCommand(control.NewControlCommand(&verbose, &configPath))
 	rootCmd.AddCommand(command.NewCommandCommand(&verbose, &configPath))
+	rootCmd.AddCommand(simulate.NewSimulateCommand(&verbose, &configPath))
 	rootCmd.AddCommand(version.NewVersionCommand())
+	rootCmd.AddCommand(recordsession.NewRecordSessionCommand())
 }
 
 func main() {
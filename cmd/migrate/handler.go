@@ -0,0 +1,154 @@
+package migrate
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"p0-ssh-agent/internal/elevate"
+	"p0-ssh-agent/internal/install"
+	"p0-ssh-agent/internal/jwt"
+	"p0-ssh-agent/internal/migrate"
+	"p0-ssh-agent/internal/osplugins"
+	"p0-ssh-agent/types"
+)
+
+func NewMigrateCommand(verbose *bool, configPath *string) *cobra.Command {
+	var (
+		serviceName string
+		allowRoot   bool
+		dryRun      bool
+		force       bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "migrate",
+		Short: "Migrate a legacy p0-ssh-agent/ install to the current layout",
+		Long: `Convert a host installed from the older nested p0-ssh-agent/ binary, whose
+service passes --jwk-path and the tunnel port and path as flags, to the current
+layout. This command will:
+- Read the legacy service unit and config file
+- Convert them to config.yaml, folding the tunnel port and path into tunnelHost
+- Convert the PEM private key to jwk.private.json/jwk.public.json, keeping the
+  key the backend registered so the host does not need to register again
+- Stop the legacy service, install the binary, config and keys like install
+  --import-bundle and replace the service unit, then start it again
+
+The legacy directory is left in place; remove it once the agent has connected.
+If the install fails the legacy service is started again.
+
+Examples:
+  p0-ssh-agent migrate --dry-run
+  p0-ssh-agent migrate`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runMigrate(*verbose, *configPath, serviceName, allowRoot, dryRun, force)
+		},
+	}
+
+	cmd.Flags().StringVar(&serviceName, "service-name", "p0-ssh-agent", "Name of the legacy systemd service")
+	cmd.Flags().BoolVar(&allowRoot, "allow-root", false, "Allow the migration to run as root")
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "Show the converted configuration without changing anything")
+	cmd.Flags().BoolVar(&force, "force", false, "Overwrite an existing configuration and key pair")
+
+	return cmd
+}
+
+func runMigrate(verbose bool, configPath, serviceName string, allowRoot, dryRun, force bool) error {
+	logger := logrus.New()
+	if verbose {
+		logger.SetLevel(logrus.DebugLevel)
+	} else {
+		logger.SetLevel(logrus.InfoLevel)
+	}
+
+	if runtime.GOOS != "linux" {
+		return fmt.Errorf("legacy installs only exist on Linux")
+	}
+
+	configPath = install.ConfigPath(configPath)
+
+	legacy, err := migrate.Detect(migrate.UnitPath(serviceName))
+	if err != nil {
+		return err
+	}
+	if legacy == nil {
+		fmt.Printf("✅ No legacy install found for service %s\n", serviceName)
+		return nil
+	}
+
+	fmt.Printf("🔎 Legacy install found: %s\n", legacy.Binary)
+	if legacy.ConfigPath != "" {
+		fmt.Printf("   Config:   %s\n", legacy.ConfigPath)
+	}
+	fmt.Printf("   Keys:     %s\n", legacy.JWKPath)
+	if len(legacy.Ignored) > 0 {
+		fmt.Printf("   ⚠️  Dropped settings without an equivalent: %s\n", strings.Join(legacy.Ignored, ", "))
+	}
+
+	config, err := legacy.Config(install.DefaultKeyPath, types.DefaultStateDir)
+	if err != nil {
+		return err
+	}
+	keys, err := migrate.ConvertKeys(legacy.JWKPath)
+	if err != nil {
+		return fmt.Errorf("failed to convert legacy keys: %w", err)
+	}
+	fmt.Printf("   Key:      %s\n", keys.Source)
+	fmt.Printf("   Tunnel:   %s\n", config.TunnelHost)
+
+	if dryRun {
+		fmt.Printf("\n🔍 DRY-RUN: would write %s and keys to %s, and replace the %s service\n", configPath, config.KeyPath, serviceName)
+		return nil
+	}
+
+	for _, existing := range []string{configPath, filepath.Join(config.KeyPath, jwt.PrivateKeyFile)} {
+		if _, err := os.Stat(existing); err == nil && !force {
+			return fmt.Errorf("%s already exists; use --force to replace it with the migrated one", existing)
+		}
+	}
+
+	bundlePath, err := migrate.WriteBundle(legacy, config, keys)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(bundlePath)
+
+	osPlugin, err := osplugins.GetPlugin(logger)
+	if err != nil {
+		return fmt.Errorf("failed to select OS plugin: %w", err)
+	}
+
+	logger.WithField("service", serviceName).Info("⏹️ Stopping legacy service")
+	if err := elevate.Command("systemctl", "stop", serviceName).Run(); err != nil {
+		logger.WithError(err).Warn("Failed to stop legacy service, continuing")
+	}
+
+	installConfig := osplugins.InstallConfig{
+		ServiceName: serviceName,
+		ConfigPath:  configPath,
+		KeyPath:     config.KeyPath,
+		StateDir:    config.StateDir,
+		AllowRoot:   allowRoot,
+		BundlePath:  bundlePath,
+	}
+	if err := install.Run(logger, osPlugin, &installConfig); err != nil {
+		if startErr := elevate.Command("systemctl", "start", serviceName).Run(); startErr != nil {
+			logger.WithError(startErr).Error("Failed to restart legacy service")
+		}
+		return fmt.Errorf("migration failed, legacy service left in place: %w", err)
+	}
+
+	if err := elevate.Command("systemctl", "enable", "--now", serviceName).Run(); err != nil {
+		return fmt.Errorf("migrated, but failed to start %s: %w", serviceName, err)
+	}
+
+	fmt.Printf("\n✅ Migrated to %s\n", installConfig.ConfigPath)
+	fmt.Printf("   Remove %s once 'p0-ssh-agent status' shows the agent connected\n", legacy.Dir)
+	return nil
+}
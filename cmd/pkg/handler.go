@@ -0,0 +1,119 @@
+package pkg
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"p0-ssh-agent/internal/logging"
+	"p0-ssh-agent/internal/packaging"
+	"p0-ssh-agent/internal/version"
+)
+
+func NewPackageCommand(verbose *bool, configPath *string) *cobra.Command {
+	var (
+		format      string
+		binary      string
+		arch        string
+		pkgVersion  string
+		release     string
+		serviceName string
+		maintainer  string
+		outputDir   string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "package",
+		Short: "Build a .deb or .rpm package of the agent",
+		Long: `Build a native Debian or RPM package containing a Linux agent binary, the
+same systemd unit the install command writes, a configuration skeleton and
+maintainer scripts that generate JWT keys on first install.
+
+The package does not register the host; run 'p0-ssh-agent register' after
+installing it, then enable the service.`,
+		Example: `  # Package this binary for the current architecture
+  p0-ssh-agent package --format deb
+
+  # Package a cross-compiled binary
+  p0-ssh-agent package --format rpm --binary dist/linux/arm64/p0-ssh-agent --arch arm64 --output dist/packages`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runPackage(*verbose, packaging.Spec{
+				Format:      format,
+				Version:     pkgVersion,
+				Release:     release,
+				Arch:        arch,
+				Binary:      binary,
+				ServiceName: serviceName,
+				Maintainer:  maintainer,
+			}, outputDir)
+		},
+	}
+
+	cmd.Flags().StringVar(&format, "format", "", "Package format: deb or rpm")
+	cmd.Flags().StringVar(&binary, "binary", "", "Linux agent binary to package (default: this executable)")
+	cmd.Flags().StringVar(&arch, "arch", runtime.GOARCH, "Go architecture of the binary (amd64, arm64, arm, 386)")
+	cmd.Flags().StringVar(&pkgVersion, "version", version.GetVersion(), "Package version")
+	cmd.Flags().StringVar(&release, "release", "1", "Package release (deb revision)")
+	cmd.Flags().StringVar(&serviceName, "service-name", "p0-ssh-agent", "Name of the packaged systemd service")
+	cmd.Flags().StringVar(&maintainer, "maintainer", "P0 Security", "Package maintainer")
+	cmd.Flags().StringVar(&outputDir, "output", ".", "Directory to write the package to")
+	cmd.MarkFlagRequired("format")
+
+	return cmd
+}
+
+func runPackage(verbose bool, spec packaging.Spec, outputDir string) error {
+	logger := logging.SetupLogger(verbose)
+
+	if spec.Format != packaging.FormatDeb && spec.Format != packaging.FormatRPM {
+		return fmt.Errorf("unsupported package format %q (use %s or %s)", spec.Format, packaging.FormatDeb, packaging.FormatRPM)
+	}
+
+	if spec.Binary == "" {
+		if runtime.GOOS != "linux" || spec.Arch != runtime.GOARCH {
+			return fmt.Errorf("--binary is required when packaging for linux/%s from %s/%s", spec.Arch, runtime.GOOS, runtime.GOARCH)
+		}
+		executable, err := os.Executable()
+		if err != nil {
+			return fmt.Errorf("failed to get current executable path: %w", err)
+		}
+		spec.Binary = executable
+	}
+
+	name, err := spec.FileName()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return fmt.Errorf("failed to create output directory: %w", err)
+	}
+	outputPath := filepath.Join(outputDir, name)
+
+	logger.WithFields(logrus.Fields{
+		"format":  spec.Format,
+		"binary":  spec.Binary,
+		"arch":    spec.Arch,
+		"version": spec.Version,
+	}).Info("📦 Building package...")
+
+	file, err := os.Create(outputPath)
+	if err != nil {
+		return fmt.Errorf("failed to create package file: %w", err)
+	}
+	if err := packaging.Build(spec, file); err != nil {
+		file.Close()
+		os.Remove(outputPath)
+		return fmt.Errorf("failed to build package: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write package: %w", err)
+	}
+
+	logger.WithField("path", outputPath).Info("✅ Package built")
+	return nil
+}
@@ -0,0 +1,103 @@
+package plugins
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"p0-ssh-agent/internal/config"
+	"p0-ssh-agent/internal/install"
+	"p0-ssh-agent/internal/osplugins"
+)
+
+func NewPluginsCommand(verbose *bool, configPath *string) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "plugins",
+		Short: "Inspect the OS plugins that install the agent and manage JIT users",
+		Long: `The agent picks one OS plugin for the host: the first candidate whose
+detection matches, in order from most to least specific, with the generic
+plugin for the OS matching last. Set osPlugin in the config (or pass
+--os-plugin to start, install, register and uninstall) to force a plugin when
+detection guesses wrong.`,
+	}
+
+	cmd.AddCommand(newListCommand(configPath))
+
+	return cmd
+}
+
+func newListCommand(configPath *string) *cobra.Command {
+	var osPlugin string
+
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the OS plugins available on this system and which one is selected",
+		Long: `List the candidate OS plugins in detection order, whether each one detects
+this host, and the plugin the agent selects.
+
+Examples:
+  p0-ssh-agent plugins list
+  p0-ssh-agent plugins list --os-plugin nixos`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runList(*configPath, osPlugin)
+		},
+	}
+
+	cmd.Flags().StringVar(&osPlugin, "os-plugin", "", "Show the selection with this plugin instead of the config's osPlugin")
+
+	return cmd
+}
+
+func runList(configPath, override string) error {
+	configPath = install.ConfigPath(configPath)
+
+	source := "--os-plugin"
+	if override == "" {
+		source = "osPlugin"
+		cfg, err := config.LoadWithOverrides(configPath, nil)
+		if err == nil {
+			override = cfg.OSPlugin
+		} else if _, statErr := os.Stat(configPath); statErr == nil {
+			fmt.Printf("⚠️  Could not read osPlugin from %s: %v\n\n", configPath, err)
+		}
+	}
+
+	candidates := osplugins.Candidates()
+	selected := ""
+	for _, candidate := range candidates {
+		if override != "" && candidate.Name == override {
+			selected = candidate.Name
+		}
+		if override == "" && selected == "" && candidate.Detected {
+			selected = candidate.Name
+		}
+	}
+
+	fmt.Println("OS plugins in detection order:")
+	for _, candidate := range candidates {
+		detected := "not detected"
+		if candidate.Detected {
+			detected = "detected"
+		}
+		marker := "  "
+		if candidate.Name == selected {
+			marker = "▶ "
+		}
+		fmt.Printf("  %s%-10s %s\n", marker, candidate.Name, detected)
+	}
+	fmt.Println()
+
+	switch {
+	case override != "" && selected == "":
+		return fmt.Errorf("%s %q is not a plugin available on this system", source, override)
+	case override != "":
+		fmt.Printf("✅ Selected: %s (set by %s)\n", selected, source)
+	case selected != "":
+		fmt.Printf("✅ Selected: %s (auto-detected)\n", selected)
+	default:
+		fmt.Println("❌ No plugin detected this system")
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package queue
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"p0-ssh-agent/internal/config"
+	"p0-ssh-agent/internal/install"
+	"p0-ssh-agent/internal/journal"
+)
+
+func NewQueueCommand(verbose *bool, configPath *string) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "queue",
+		Short: "Inspect responses waiting to be delivered to the backend",
+		Long: `When the tunnel drops while a provisioning request is running, the response
+cannot be sent. The agent keeps it in <stateDir>/journal.json and hands it to
+the backend after the next reconnect, then asks the backend to re-send any
+revokes issued while the agent was unreachable.`,
+	}
+
+	cmd.AddCommand(newListCommand(configPath))
+
+	return cmd
+}
+
+func newListCommand(configPath *string) *cobra.Command {
+	var jsonOutput bool
+
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List journaled responses that have not been delivered",
+		Long: `List the responses held in the journal, oldest first.
+
+Examples:
+  sudo p0-ssh-agent queue list
+  sudo p0-ssh-agent queue list --json`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runList(*configPath, jsonOutput)
+		},
+	}
+
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "Print the journal as JSON")
+
+	return cmd
+}
+
+func runList(configPath string, jsonOutput bool) error {
+	configPath = install.ConfigPath(configPath)
+
+	cfg, err := config.LoadWithOverrides(configPath, nil)
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+
+	pending, err := journal.Load(journal.Path(cfg.StateDir))
+	if err != nil {
+		if errors.Is(err, os.ErrPermission) {
+			return fmt.Errorf("%w (try running with sudo)", err)
+		}
+		return err
+	}
+
+	if jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(pending)
+	}
+
+	if pending.LastContact.IsZero() {
+		fmt.Println("Last contact: never")
+	} else {
+		fmt.Printf("Last contact: %s\n", pending.LastContact.Local().Format(time.RFC3339))
+	}
+
+	if len(pending.Entries) == 0 {
+		fmt.Println("✅ No undelivered responses")
+		return nil
+	}
+
+	fmt.Printf("📒 %d undelivered response(s):\n", len(pending.Entries))
+	for _, entry := range pending.Entries {
+		fmt.Printf("  %s  %s  %s %s %s (user %s, %d attempt(s))\n",
+			entry.ID,
+			entry.RecordedAt.Local().Format(time.RFC3339),
+			entry.RequestID, entry.Command, entry.Action, entry.UserName, entry.Attempts)
+		if entry.LastError != "" {
+			fmt.Printf("      last error: %s\n", entry.LastError)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package reconcile
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"p0-ssh-agent/internal/audit"
+	"p0-ssh-agent/internal/config"
+	"p0-ssh-agent/internal/filebackup"
+	"p0-ssh-agent/internal/install"
+	"p0-ssh-agent/internal/osplugins"
+	"p0-ssh-agent/internal/state"
+	"p0-ssh-agent/internal/userdb"
+	"p0-ssh-agent/scripts"
+)
+
+func NewReconcileCommand(verbose *bool, configPath *string) *cobra.Command {
+	var (
+		repair     bool
+		dryRun     bool
+		jsonOutput bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "reconcile",
+		Short: "Detect and repair drift between recorded grants and the host",
+		Long: `Compare the grants recorded in <stateDir>/provisioning.json with the host.
+Granted users, keys, sudo rules, login notices, forwarding rules and
+certificate CA entries must still be present, revoked ones must stay removed,
+and grants past their expiry must have been revoked.
+
+Without --repair drift is only reported and the command exits non-zero when
+any is found. With --repair the recorded request is re-applied or revoked;
+repairs are written to the audit log with source "reconcile".
+
+Examples:
+  sudo p0-ssh-agent reconcile
+  sudo p0-ssh-agent reconcile --repair
+  sudo p0-ssh-agent reconcile --repair --dry-run`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runReconcile(*verbose, *configPath, repair, dryRun, jsonOutput)
+		},
+	}
+
+	cmd.Flags().BoolVar(&repair, "repair", false, "Re-apply missing grants and revoke leftover or expired ones")
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "With --repair, log the repairs without making changes")
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "Print drift as JSON")
+
+	return cmd
+}
+
+func runReconcile(verbose bool, configPath string, repair, dryRun, jsonOutput bool) error {
+	logger := logrus.New()
+	if verbose {
+		logger.SetLevel(logrus.DebugLevel)
+	} else {
+		logger.SetLevel(logrus.WarnLevel)
+	}
+
+	configPath = install.ConfigPath(configPath)
+
+	cfg, err := config.LoadWithOverrides(configPath, nil)
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+
+	scripts.SetStatePath(state.Path(cfg.StateDir))
+	scripts.SetAuditLogPath(audit.Path(cfg.StateDir))
+	if err := scripts.ConfigureAuditSinks(cfg.AuditSinks, cfg.HostID); err != nil {
+		return fmt.Errorf("failed to set up audit sinks: %w", err)
+	}
+	defer scripts.FlushAuditLog(logger)
+	scripts.SetFileBackupDir(filebackup.Dir(cfg.StateDir))
+	scripts.SetCertificateAuthorityDir(scripts.CertificateAuthorityDir(cfg.StateDir))
+	scripts.SetAuthorizedKeysFile(cfg.GetAuthorizedKeysFile())
+	scripts.SetSudoersLayout(cfg.GetSudoersLayout())
+	scripts.SetSessionRecording(cfg.GetSessionRecording())
+	if err := scripts.SetScriptLimits(cfg.ScriptLimits); err != nil {
+		return err
+	}
+	osplugins.SetSELinuxUser(cfg.SELinuxUser)
+	osplugins.SetOverride(cfg.OSPlugin)
+	userdb.Configure(cfg)
+
+	drifts, err := scripts.FindDrift(context.Background(), time.Now(), logger)
+	if err != nil {
+		if errors.Is(err, os.ErrPermission) {
+			return fmt.Errorf("%w (try running with sudo)", err)
+		}
+		return err
+	}
+
+	if jsonOutput && !repair {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(drifts); err != nil {
+			return err
+		}
+		if len(drifts) > 0 {
+			return fmt.Errorf("%d grant(s) drifted", len(drifts))
+		}
+		return nil
+	}
+
+	if len(drifts) == 0 {
+		fmt.Println("✅ Host matches the recorded provisioning state")
+		return nil
+	}
+
+	for _, drift := range drifts {
+		fmt.Printf("⚠️  %s (%s): %s\n", drift.Key, drift.UserName, drift.Problem)
+	}
+
+	if !repair {
+		fmt.Println("💡 Run with --repair to fix")
+		return fmt.Errorf("%d grant(s) drifted", len(drifts))
+	}
+
+	failed := 0
+	for _, drift := range drifts {
+		result := scripts.RepairDrift(drift, dryRun, logger)
+		if !result.Success {
+			failed++
+			fmt.Printf("❌ %s: %s failed: %s\n", drift.Key, drift.Repair, result.Error)
+			continue
+		}
+		fmt.Printf("✅ %s: %s\n", drift.Key, result.Message)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d repair(s) failed", failed, len(drifts))
+	}
+	return nil
+}
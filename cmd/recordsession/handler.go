@@ -0,0 +1,52 @@
+package recordsession
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"p0-ssh-agent/internal/recording"
+	"p0-ssh-agent/types"
+)
+
+// NewRecordSessionCommand returns the ForceCommand sshd runs for users whose
+// sessions are recorded. It runs as the user and never reads the agent
+// configuration; everything it needs comes from its flags, and the agent
+// writes the recording.
+func NewRecordSessionCommand() *cobra.Command {
+	var (
+		recorder   string
+		socket     string
+		requestIDs string
+	)
+
+	cmd := &cobra.Command{
+		Use:    "record-session",
+		Short:  "Run an SSH session under the session recorder",
+		Hidden: true,
+		Args:   cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			options := recording.Options{Recorder: recorder, Socket: socket}
+			if requestIDs != "" {
+				options.RequestIDs = strings.Split(requestIDs, ",")
+			}
+
+			code, err := recording.Run(options)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "p0-ssh-agent: session recording failed: %v\n", err)
+			}
+			os.Exit(code)
+		},
+	}
+
+	cmd.Flags().StringVar(&recorder, "recorder", types.SessionRecorderScript, "Recorder: script or tlog")
+	cmd.Flags().StringVar(&socket, "socket", types.RecordingSocketPath, "Socket of the agent that records the session")
+	// Named by the drop-ins of earlier versions until they are rewritten
+	cmd.Flags().String("spool-dir", "", "")
+	cmd.Flags().MarkHidden("spool-dir")
+	cmd.Flags().StringVar(&requestIDs, "request-id", "", "Comma-separated requests granting the access being recorded")
+
+	return cmd
+}
@@ -2,18 +2,26 @@ package register
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"os"
-	"os/exec"
-	"path/filepath"
+	"runtime"
+	"strings"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
 
+	"p0-ssh-agent/internal/attestation"
+	agentconfig "p0-ssh-agent/internal/config"
+	"p0-ssh-agent/internal/elevate"
+	"p0-ssh-agent/internal/install"
 	"p0-ssh-agent/internal/osplugins"
+	"p0-ssh-agent/scripts"
 	"p0-ssh-agent/types"
 	"p0-ssh-agent/utils"
 )
@@ -21,11 +29,17 @@ import (
 func NewRegisterCommand(verbose *bool, configPath *string) *cobra.Command {
 	var (
 		auth        string
+		enrollToken string
 		url         string
 		hostname    string
 		labels      []string
 		serviceName string
 		allowRoot   bool
+		writableDir string
+		ipOptions   utils.IPDiscoveryOptions
+		disabled    []string
+		attest      string
+		osPlugin    string
 	)
 
 	cmd := &cobra.Command{
@@ -37,12 +51,16 @@ This command will:
 - Generate JWT keys
 - Send registration key to the P0 backend
 - Receive configuration from P0 backend
-- Save configuration and trusted CA
+- Save configuration
 - Configure SSH daemon to trust the P0 CA
 - Set up systemd service
 
 Usage:
   p0 register --auth "bearer-token" --url "https://p0.dev/o/<org-id>/integrations/self-hosted/computers/<environment-id>/register"
+  p0 register --enroll-token "p0e_..." --url "https://p0.dev/o/<org-id>/integrations/self-hosted/computers/<environment-id>/register"
+
+Use --enroll-token with a single-use credential from "p0-ssh-agent enroll-token"
+instead of sharing the org bearer token.
 
 Examples:
   # Basic registration
@@ -55,23 +73,56 @@ Examples:
     --label "team=backend" \
     --label "region=us-west-2"`,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return runRegister(*verbose, auth, url, hostname, labels, serviceName, allowRoot)
+			authorization, err := registrationAuthorization(auth, enrollToken)
+			if err != nil {
+				return err
+			}
+			if !attestation.ValidMode(attest) {
+				return fmt.Errorf("invalid --attestation %q (use %s, %s or %s)", attest, attestation.ModeAuto, attestation.ModeRequired, attestation.ModeOff)
+			}
+			collection := types.Collection(disabled)
+			if err := collection.Validate(); err != nil {
+				return fmt.Errorf("invalid --disable-collection: %w", err)
+			}
+			return runRegister(*verbose, authorization, url, hostname, labels, serviceName, allowRoot, writableDir, ipOptions, collection, attest, osPlugin)
 		},
 	}
 
-	cmd.Flags().StringVar(&auth, "auth", "", "Bearer token for authentication (required)")
+	cmd.Flags().StringVar(&auth, "auth", "", "Bearer token for authentication (this or --enroll-token is required)")
+	cmd.Flags().StringVar(&enrollToken, "enroll-token", "", "Single-use enrollment token from enroll-token, instead of --auth")
 	cmd.Flags().StringVar(&url, "url", "", "Registration URL (required)")
 	cmd.Flags().StringVar(&hostname, "hostname", "", "Override machine hostname")
 	cmd.Flags().StringSliceVar(&labels, "label", []string{}, "Machine labels in key=value format (can be used multiple times)")
 	cmd.Flags().StringVar(&serviceName, "service-name", "p0-ssh-agent", "Name for the systemd service")
 	cmd.Flags().BoolVar(&allowRoot, "allow-root", false, "Allow installation to run as root")
+	cmd.Flags().StringVar(&writableDir, "writable-dir", "", "Writable volume for keys, state and binary on read-only root filesystems")
+	cmd.Flags().StringVar(&ipOptions.StaticIP, "public-ip", "", "Report this IP address instead of discovering it")
+	cmd.Flags().StringSliceVar(&ipOptions.Endpoints, "ip-echo-endpoint", nil, "IP echo endpoint to query instead of the public services (can be used multiple times)")
+	cmd.Flags().BoolVar(&ipOptions.PrivateOnly, "private-ip-only", false, "Report a private interface address and make no external IP lookups")
+	cmd.Flags().StringVar(&attest, "attestation", attestation.ModeAuto, "Self-reported TPM quote: auto (when a TPM is present), required or off")
+	cmd.Flags().StringSliceVar(&disabled, "disable-collection", nil, "System details not to collect: hostname, publicIp, macAddresses (saved to the config)")
+	cmd.Flags().StringVar(&osPlugin, "os-plugin", "", "OS plugin to use instead of auto-detection, see plugins list (saved to the config)")
 
-	cmd.MarkFlagRequired("auth")
 	cmd.MarkFlagRequired("url")
 
 	return cmd
 }
 
+// registrationAuthorization returns the Authorization header for exactly one
+// of an org bearer token or an enrollment token. Enrollment tokens use their
+// own scheme so the backend can enforce their scope and single use.
+func registrationAuthorization(auth, enrollToken string) (string, error) {
+	switch {
+	case auth != "" && enrollToken != "":
+		return "", fmt.Errorf("use either --auth or --enroll-token, not both")
+	case enrollToken != "":
+		return "Enrollment " + enrollToken, nil
+	case auth != "":
+		return "Bearer " + auth, nil
+	}
+	return "", fmt.Errorf("--auth or --enroll-token is required")
+}
+
 type RegistrationResponse struct {
 	Ok            bool   `json:"ok"`
 	EnvironmentId string `json:"environmentId"`
@@ -81,7 +132,7 @@ type RegistrationResponse struct {
 	TunnelHost    string `json:"tunnelHost"`
 }
 
-func runRegister(verbose bool, auth, url, hostname string, labels []string, serviceName string, allowRoot bool) error {
+func runRegister(verbose bool, authorization, url, hostname string, labels []string, serviceName string, allowRoot bool, writableDir string, ipOptions utils.IPDiscoveryOptions, collection types.Collection, attest, pluginName string) error {
 	logger := logrus.New()
 	if verbose {
 		logger.SetLevel(logrus.DebugLevel)
@@ -89,26 +140,44 @@ func runRegister(verbose bool, auth, url, hostname string, labels []string, serv
 		logger.SetLevel(logrus.InfoLevel)
 	}
 
+	if ipOptions.StaticIP != "" && net.ParseIP(ipOptions.StaticIP) == nil {
+		return fmt.Errorf("invalid --public-ip %q: not an IP address", ipOptions.StaticIP)
+	}
+
+	// Fail before installing anything when the evidence can never be produced
+	if attest == attestation.ModeRequired && !attestation.Available() {
+		return fmt.Errorf("--attestation required but no TPM device or tpm2-tools found")
+	}
+
 	logger.Info("🚀 Starting P0 SSH Agent registration and installation...")
 
 	// Step 1: Perform installation steps (merged from install command)
 	logger.Info("📦 Step 1: Installing P0 SSH Agent...")
+	osplugins.SetOverride(pluginName)
 	osPlugin, err := osplugins.GetPlugin(logger)
 	if err != nil {
 		return fmt.Errorf("failed to select OS plugin: %w", err)
 	}
 
 	// Use standard config location for registration (both OS plugins use /etc/p0-ssh-agent)
-	configPath := "/etc/p0-ssh-agent/config.yaml"
+	configPath := install.DefaultConfigPath
 
 	// Run installation steps
-	if err := runInstallationSteps(logger, osPlugin, serviceName, configPath, allowRoot); err != nil {
+	installConfig := osplugins.InstallConfig{
+		ServiceName: serviceName,
+		ConfigPath:  configPath,
+		KeyPath:     install.DefaultKeyPath,
+		AllowRoot:   allowRoot,
+		WritableDir: writableDir,
+	}
+	if err := install.Run(logger, osPlugin, &installConfig); err != nil {
 		return fmt.Errorf("installation failed: %w", err)
 	}
+	configPath = installConfig.ConfigPath
 
 	// Step 2: Send registration request to P0 backend
 	logger.Info("🔗 Step 2: Registering with P0 backend...")
-	response, err := sendRegistrationRequest(auth, url, hostname, labels, logger)
+	response, err := sendRegistrationRequest(authorization, url, hostname, labels, installConfig.KeyPath, ipOptions, collection, attest, logger)
 	if err != nil {
 		return fmt.Errorf("registration failed: %w", err)
 	}
@@ -119,12 +188,26 @@ func runRegister(verbose bool, auth, url, hostname string, labels []string, serv
 
 	// Step 3: Save configuration
 	logger.Info("💾 Step 3: Saving configuration...")
-	if err := saveConfiguration(response, configPath, logger); err != nil {
+	if err := saveConfiguration(response, &installConfig, ipOptions, collection, pluginName, logger); err != nil {
 		return fmt.Errorf("failed to save configuration: %w", err)
 	}
 
-	// Step 4: Registration complete
-	logger.Info("✅ Step 4: Registration completed successfully")
+	// Step 4: Trust the P0 CA for certificate logins. The host is registered
+	// by now, so a failure is reported without undoing the registration.
+	logger.Info("🔐 Step 4: Configuring SSH daemon to trust the P0 CA...")
+	switch {
+	case response.TrustedCa == "":
+		logger.Info("Registration returned no CA; skipping")
+	case runtime.GOOS == "windows":
+		logger.Info("Trusting the P0 CA is not supported on Windows; skipping")
+	default:
+		if err := scripts.InstallTrustedCA(context.Background(), response.TrustedCa, logger); err != nil {
+			logger.WithError(err).Warn("⚠️ Failed to configure sshd to trust the P0 CA; certificate logins signed by it will be refused")
+		}
+	}
+
+	// Step 5: Registration complete
+	logger.Info("✅ Step 5: Registration completed successfully")
 
 	// Display OS-specific post-registration instructions
 	fmt.Printf("\n✅ Registration successful. Configuration saved to %s\n", configPath)
@@ -133,17 +216,33 @@ func runRegister(verbose bool, auth, url, hostname string, labels []string, serv
 	return nil
 }
 
-func sendRegistrationRequest(auth, url, hostname string, labels []string, logger *logrus.Logger) (*RegistrationResponse, error) {
+func sendRegistrationRequest(authorization, url, hostname string, labels []string, keyPath string, ipOptions utils.IPDiscoveryOptions, collection types.Collection, attest string, logger *logrus.Logger) (*RegistrationResponse, error) {
 	// Generate the registration request using the key path
-	keyPath := "/etc/p0-ssh-agent/keys"
-	encodedRequest, err := utils.GenerateRegistrationRequestCodeWithOptions(keyPath, hostname, labels, logger)
+	request, err := utils.CreateRegistrationRequestWithOptions(keyPath, hostname, labels, ipOptions, collection, logger)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate registration request: %w", err)
 	}
 
+	if attest != attestation.ModeOff {
+		qualifyingData, err := attestation.QualifyingData(request.JWKPublicKey, request.Timestamp)
+		if err != nil {
+			return nil, fmt.Errorf("failed to prepare attestation: %w", err)
+		}
+		request.Attestation, err = attestation.Collect(attest, qualifyingData, logger)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	encodedRequest, err := utils.EncodeRegistrationRequest(request, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate registration request: %w", err)
+	}
+
+	scheme, _, _ := strings.Cut(authorization, " ")
 	logger.WithFields(logrus.Fields{
 		"url":  url,
-		"auth": auth[:8] + "...", // Log only first 8 chars for security
+		"auth": scheme + " <redacted>",
 	}).Debug("Sending registration request")
 
 	// Wrap the encoded request in a JSON object
@@ -156,14 +255,14 @@ func sendRegistrationRequest(auth, url, hostname string, labels []string, logger
 		return nil, fmt.Errorf("failed to marshal request body: %w", err)
 	}
 
-	// Create HTTP request with bearer token
+	// Create HTTP request with the bearer or enrollment token
 	req, err := http.NewRequest("POST", url, bytes.NewBuffer(requestJSON))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+auth)
+	req.Header.Set("Authorization", authorization)
 
 	client := &http.Client{}
 	resp, err := client.Do(req)
@@ -196,19 +295,33 @@ func sendRegistrationRequest(auth, url, hostname string, labels []string, logger
 	return &response, nil
 }
 
-func saveConfiguration(response *RegistrationResponse, configPath string, logger *logrus.Logger) error {
-	config := types.Config{
-		Version:                  "1.0",
-		OrgID:                    response.OrgId,
-		HostID:                   response.HostId,
-		TunnelHost:               response.TunnelHost,
-		KeyPath:                  "/etc/p0-ssh-agent/keys",
-		EnvironmentId:            response.EnvironmentId,
-		HeartbeatIntervalSeconds: 60,
-		DryRun:                   false,
+func saveConfiguration(response *RegistrationResponse, installConfig *osplugins.InstallConfig, ipOptions utils.IPDiscoveryOptions, collection types.Collection, pluginName string, logger *logrus.Logger) error {
+	configPath := installConfig.ConfigPath
+
+	tunnelURL, err := agentconfig.NormalizeTunnelHost(response.TunnelHost, 0, "")
+	if err != nil {
+		return fmt.Errorf("registration returned an unusable tunnel host: %w", err)
+	}
+
+	config := types.DefaultConfig()
+	config.OrgID = response.OrgId
+	config.HostID = response.HostId
+	config.TunnelHost = tunnelURL
+	config.KeyPath = installConfig.KeyPath
+	config.StateDir = installConfig.StateDir
+	config.WritableDir = installConfig.WritableDir
+	config.EnvironmentId = response.EnvironmentId
+	config.PublicIP = ipOptions.StaticIP
+	config.IPEchoEndpoints = ipOptions.Endpoints
+	config.PrivateIPOnly = ipOptions.PrivateOnly
+	config.DisableCollection = collection
+	config.OSPlugin = pluginName
+
+	if err := config.Validate(); err != nil {
+		return fmt.Errorf("registration response produced an invalid configuration: %w", err)
 	}
 
-	// Config will be saved to /etc/p0-ssh-agent/config.yaml (directory already created in runInstallationSteps)
+	// Config will be saved to the resolved config path (directory already created by install.Run)
 
 	// Create a temporary file for the config
 	tmpFile, err := os.CreateTemp("", "config_*.yaml")
@@ -217,27 +330,13 @@ func saveConfiguration(response *RegistrationResponse, configPath string, logger
 	}
 	defer os.Remove(tmpFile.Name())
 
-	configYAML := fmt.Sprintf(`# P0 SSH Agent Configuration File
-# Auto-generated from registration response
-
-version: "%s"
-orgId: "%s"
-hostId: "%s"
-tunnelHost: "%s"
-keyPath: "%s"
-environmentId: "%s"
-heartbeatIntervalSeconds: %d
-dryRun: %t
-`,
-		config.Version,
-		config.OrgID,
-		config.HostID,
-		config.TunnelHost,
-		config.KeyPath,
-		config.EnvironmentId,
-		config.HeartbeatIntervalSeconds,
-		config.DryRun,
-	)
+	body, err := yaml.Marshal(config)
+	if err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("failed to marshal configuration: %w", err)
+	}
+
+	configYAML := "# P0 SSH Agent Configuration File\n# Auto-generated from registration response\n\n" + string(body)
 
 	if _, err := tmpFile.WriteString(configYAML); err != nil {
 		tmpFile.Close()
@@ -245,150 +344,17 @@ dryRun: %t
 	}
 	tmpFile.Close()
 
-	// Copy temp file to final location using sudo
-	cmd := exec.Command("sudo", "cp", tmpFile.Name(), configPath)
-	if err := cmd.Run(); err != nil {
+	// Copy temp file to final location as root
+	files := elevate.Privileged()
+	if err := files.Copy(tmpFile.Name(), configPath); err != nil {
 		return fmt.Errorf("failed to copy config file: %w", err)
 	}
 
 	// Set proper permissions
-	cmd = exec.Command("sudo", "chmod", "644", configPath)
-	if err := cmd.Run(); err != nil {
+	if err := files.Chmod(configPath, 0644); err != nil {
 		return fmt.Errorf("failed to set config file permissions: %w", err)
 	}
 
 	logger.WithField("path", configPath).Info("Configuration saved successfully")
 	return nil
 }
-
-func runInstallationSteps(logger *logrus.Logger, osPlugin osplugins.OSPlugin, serviceName string, configPath string, allowRoot bool) error {
-	// This incorporates the key functionality from the install command
-
-	// Security check
-	if os.Geteuid() == 0 && !allowRoot {
-		return fmt.Errorf("register command should not be run as root, please run as regular user with sudo privileges (or use --allow-root flag to bypass this check)")
-	}
-
-	if os.Geteuid() == 0 && allowRoot {
-		logger.Warn("⚠️  Running as root - this bypasses security restrictions and is not recommended")
-	}
-
-	// Get current executable
-	currentExe, err := os.Executable()
-	if err != nil {
-		return fmt.Errorf("failed to get current executable path: %w", err)
-	}
-
-	// Install binary using OS-specific install directories
-	installDirs := osPlugin.GetInstallDirectories()
-	var destPath string
-	var installSuccess bool
-
-	for _, installDir := range installDirs {
-		destPath = filepath.Join(installDir, "p0-ssh-agent")
-
-		// Check if binary already exists at this location
-		if _, err := os.Stat(destPath); err == nil {
-			logger.WithField("path", destPath).Info("✅ Binary already exists at system location")
-			installSuccess = true
-			break
-		}
-
-		// Try to install to this directory
-		logger.WithField("installDir", installDir).Info("📦 Attempting to install binary...")
-		if err := copyBinary(currentExe, destPath, logger); err != nil {
-			logger.WithError(err).WithField("installDir", installDir).Warn("Failed to install to directory, trying next...")
-			continue
-		}
-
-		logger.WithField("path", destPath).Info("✅ Binary installed successfully")
-		installSuccess = true
-		break
-	}
-
-	if !installSuccess {
-		return fmt.Errorf("failed to install binary to any of the available directories: %v", installDirs)
-	}
-
-	// Create config and key directories using OS plugin
-	configDir := "/etc/p0-ssh-agent"
-	keyPath := filepath.Join(configDir, "keys")
-
-	dirsToSetup := []string{configDir, keyPath}
-	if err := osPlugin.SetupDirectories(dirsToSetup, "root", logger); err != nil {
-		return fmt.Errorf("failed to setup directories: %w", err)
-	}
-
-	// Set proper permissions on key directory (readable for public key access, private key will be protected individually)
-	cmd := exec.Command("sudo", "chmod", "755", keyPath)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to set key directory permissions: %w", err)
-	}
-
-	// Generate JWT keys
-	if err := generateJWTKeys(keyPath, destPath, logger); err != nil {
-		return fmt.Errorf("failed to generate JWT keys: %w", err)
-	}
-
-	// Create systemd service
-	if err := osPlugin.CreateSystemdService(serviceName, destPath, configPath, logger); err != nil {
-		return fmt.Errorf("failed to create systemd service: %w", err)
-	}
-
-	return nil
-}
-
-func copyBinary(srcPath, destPath string, logger *logrus.Logger) error {
-	logger.WithFields(logrus.Fields{
-		"src":  srcPath,
-		"dest": destPath,
-	}).Debug("Copying binary using sudo")
-
-	// Use sudo to copy the binary to the system location
-	cmd := exec.Command("sudo", "cp", srcPath, destPath)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to copy binary with sudo: %w", err)
-	}
-
-	// Use sudo to set executable permissions
-	cmd = exec.Command("sudo", "chmod", "755", destPath)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to set executable permissions with sudo: %w", err)
-	}
-
-	return nil
-}
-
-func generateJWTKeys(keyPath, executablePath string, logger *logrus.Logger) error {
-	// Check if keys already exist
-	privateKeyPath := filepath.Join(keyPath, "jwk.private.json")
-	publicKeyPath := filepath.Join(keyPath, "jwk.public.json")
-
-	if _, err := os.Stat(privateKeyPath); err == nil {
-		if _, err := os.Stat(publicKeyPath); err == nil {
-			logger.Info("✅ JWT keys already exist")
-			return nil
-		}
-	}
-
-	// Generate new keys using sudo
-	cmd := exec.Command("sudo", executablePath, "keygen", "--key-path", keyPath)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("failed to generate JWT keys: %w (output: %s)", err, string(output))
-	}
-
-	// Set appropriate permissions: public key readable by all, private key root-only
-	chmodCmd := exec.Command("sudo", "chmod", "644", publicKeyPath)
-	if err := chmodCmd.Run(); err != nil {
-		return fmt.Errorf("failed to set public key permissions: %w", err)
-	}
-
-	chmodPrivateCmd := exec.Command("sudo", "chmod", "600", privateKeyPath)
-	if err := chmodPrivateCmd.Run(); err != nil {
-		return fmt.Errorf("failed to set private key permissions: %w", err)
-	}
-
-	logger.Info("✅ JWT keys generated successfully")
-	return nil
-}
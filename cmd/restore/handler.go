@@ -0,0 +1,94 @@
+package restore
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"p0-ssh-agent/internal/backup"
+	"p0-ssh-agent/internal/bundle"
+	"p0-ssh-agent/internal/config"
+	"p0-ssh-agent/internal/install"
+	"p0-ssh-agent/types"
+)
+
+func NewRestoreCommand(verbose *bool, configPath *string) *cobra.Command {
+	var (
+		input          string
+		passphraseFile string
+		force          bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "restore",
+		Short: "Restore keys, config and state from an encrypted backup",
+		Long: `Restore an archive created with 'p0-ssh-agent backup' onto this host.
+Files are written back to the paths recorded in the archive, so a rebuilt
+host keeps the same identity and can reconnect without re-registering.
+Only the config file, trusted CA, key directory and state directory of this
+host, as its configuration resolves them, are restored; an archive naming
+any other path is refused.
+
+Examples:
+  sudo p0-ssh-agent restore --input host-backup.tar.enc --passphrase-file /root/backup.pass`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runRestore(*verbose, *configPath, input, passphraseFile, force)
+		},
+	}
+
+	cmd.Flags().StringVarP(&input, "input", "i", "", "Path of the encrypted archive to restore (required)")
+	cmd.Flags().StringVar(&passphraseFile, "passphrase-file", "", "File containing the encryption passphrase")
+	cmd.Flags().BoolVar(&force, "force", false, "Overwrite existing files that differ from the backup")
+
+	cmd.MarkFlagRequired("input")
+
+	return cmd
+}
+
+func runRestore(verbose bool, configPath, input, passphraseFile string, force bool) error {
+	logger := logrus.New()
+	if verbose {
+		logger.SetLevel(logrus.DebugLevel)
+	} else {
+		logger.SetLevel(logrus.InfoLevel)
+	}
+
+	configPath = install.ConfigPath(configPath)
+
+	// A rebuilt host may have no config yet; its paths are then the defaults
+	cfg := types.DefaultConfig()
+	if _, err := os.Stat(configPath); err == nil {
+		if cfg, err = config.LoadWithOverrides(configPath, nil); err != nil {
+			return fmt.Errorf("failed to load configuration: %w", err)
+		}
+	}
+
+	passphrase, err := backup.ReadPassphrase(passphraseFile)
+	if err != nil {
+		return err
+	}
+
+	encrypted, err := os.ReadFile(input)
+	if err != nil {
+		return fmt.Errorf("failed to read backup: %w", err)
+	}
+
+	archive, err := bundle.Decrypt(encrypted, passphrase)
+	if err != nil {
+		return err
+	}
+
+	manifest, err := backup.Restore(archive, backup.DestinationsOf(cfg, configPath), force, logger)
+	if err != nil {
+		return fmt.Errorf("failed to restore backup: %w", err)
+	}
+
+	fmt.Printf("\n✅ Restored %d files from backup of %s (%s) created %s\n",
+		len(manifest.Files), manifest.Hostname, manifest.ClientID, manifest.CreatedAt)
+	fmt.Println("\n💡 Next Steps:")
+	fmt.Println("1. Reinstall the service if needed: p0-ssh-agent install")
+	fmt.Println("2. Restart the agent: sudo systemctl restart p0-ssh-agent")
+	return nil
+}
@@ -0,0 +1,110 @@
+package restorefile
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"p0-ssh-agent/internal/config"
+	"p0-ssh-agent/internal/filebackup"
+	"p0-ssh-agent/internal/install"
+)
+
+func NewRestoreFileCommand(verbose *bool, configPath *string) *cobra.Command {
+	var (
+		at   string
+		list bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "restore-file <path>",
+		Short: "Restore a managed file from the backup taken before a change",
+		Long: `Restore authorized_keys, sudoers or sshd_config from the copy the agent saved
+before modifying it. Backups live in <stateDir>/file-backups; the most recent
+backup taken at or before --at is restored (default: the latest one).
+
+The current content is backed up first, so a restore can itself be undone.
+
+Examples:
+  sudo p0-ssh-agent restore-file /etc/sudoers-p0 --list
+  sudo p0-ssh-agent restore-file /etc/sudoers-p0 --at 2025-03-01T09:30:00Z
+  sudo p0-ssh-agent restore-file /home/alice/.ssh/authorized_keys --at 15m`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runRestoreFile(*configPath, args[0], at, list)
+		},
+	}
+
+	cmd.Flags().StringVar(&at, "at", "", "Point in time to restore: RFC 3339 time or a duration ago such as 15m (default: latest backup)")
+	cmd.Flags().BoolVar(&list, "list", false, "List available backups of the file")
+
+	return cmd
+}
+
+func runRestoreFile(configPath, filePath, at string, list bool) error {
+	configPath = install.ConfigPath(configPath)
+
+	cfg, err := config.LoadWithOverrides(configPath, nil)
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+
+	filePath, err = filepath.Abs(filePath)
+	if err != nil {
+		return fmt.Errorf("invalid path: %w", err)
+	}
+
+	backupDir := filebackup.Dir(cfg.StateDir)
+
+	if list {
+		backups, err := filebackup.List(backupDir, filePath)
+		if err != nil {
+			return fmt.Errorf("%w (try running with sudo)", err)
+		}
+		if len(backups) == 0 {
+			fmt.Printf("No backups of %s\n", filePath)
+			return nil
+		}
+		for _, backup := range backups {
+			fmt.Printf("🗂️  %s  %d bytes\n", backup.Time.Format(time.RFC3339Nano), backup.Size)
+		}
+		return nil
+	}
+
+	target, err := parseAt(at, time.Now())
+	if err != nil {
+		return err
+	}
+
+	backup, err := filebackup.Find(backupDir, filePath, target)
+	if err != nil {
+		return err
+	}
+
+	if err := filebackup.Restore(backupDir, *backup, time.Now()); err != nil {
+		return fmt.Errorf("%w (try running with sudo)", err)
+	}
+
+	fmt.Printf("✅ Restored %s from backup taken %s\n", filePath, backup.Time.Format(time.RFC3339))
+	fmt.Println("💡 If this was sshd_config, reload sshd: sudo systemctl reload sshd")
+	return nil
+}
+
+// parseAt accepts an RFC 3339 time or a duration before now
+func parseAt(at string, now time.Time) (time.Time, error) {
+	if at == "" {
+		return now, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, at); err == nil {
+		return t, nil
+	}
+
+	if ago, err := time.ParseDuration(at); err == nil {
+		return now.Add(-ago), nil
+	}
+
+	return time.Time{}, fmt.Errorf("invalid --at %q: use an RFC 3339 time (2025-03-01T09:30:00Z) or a duration such as 15m", at)
+}
@@ -0,0 +1,210 @@
+package revoke
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"p0-ssh-agent/internal/audit"
+	"p0-ssh-agent/internal/config"
+	"p0-ssh-agent/internal/control"
+	"p0-ssh-agent/internal/filebackup"
+	"p0-ssh-agent/internal/grants"
+	"p0-ssh-agent/internal/install"
+	"p0-ssh-agent/internal/osplugins"
+	"p0-ssh-agent/internal/state"
+	"p0-ssh-agent/internal/userdb"
+	"p0-ssh-agent/scripts"
+	"p0-ssh-agent/types"
+)
+
+func NewRevokeCommand(verbose *bool, configPath *string) *cobra.Command {
+	var (
+		filter     scripts.RevokeFilter
+		dryRun     bool
+		local      bool
+		jsonOutput bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "revoke",
+		Short: "Immediately revoke provisioned access without the backend",
+		Long: `Revoke grants recorded in <stateDir>/provisioning.json on this host alone,
+for incident response when the backend or the tunnel is unavailable.
+Authorized keys, CA keys, sudo rules and every other recorded effect of the
+selected grants are removed. P0 blocks and drop-ins the selection covers but
+the state does not record are swept as well, then the affected users' SSH
+sessions are terminated. Revokes are recorded in the audit log with source "revoke".
+
+When the agent is running the revoke is handed to it over the control
+socket, so grants it holds for a future window are cancelled as well.
+Otherwise the command revokes directly and cancels them in grants.json.
+
+Examples:
+  sudo p0-ssh-agent revoke --all
+  sudo p0-ssh-agent revoke --user alice
+  sudo p0-ssh-agent revoke --request-id req-123 --dry-run`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runRevoke(*verbose, *configPath, filter, dryRun, local, jsonOutput)
+		},
+	}
+
+	cmd.Flags().BoolVar(&filter.All, "all", false, "Revoke every recorded grant")
+	cmd.Flags().StringVar(&filter.UserName, "user", "", "Revoke the grants of this user")
+	cmd.Flags().StringVar(&filter.RequestID, "request-id", "", "Revoke the grants of this request")
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "Log the revokes without making changes")
+	cmd.Flags().BoolVar(&local, "local", false, "Revoke directly even when the agent is running")
+	cmd.Flags().BoolVar(&jsonOutput, "json", false, "Print the result as JSON")
+
+	return cmd
+}
+
+func runRevoke(verbose bool, configPath string, filter scripts.RevokeFilter, dryRun, local, jsonOutput bool) error {
+	if err := filter.Validate(); err != nil {
+		return fmt.Errorf("%w (use --all, --user or --request-id)", err)
+	}
+
+	logger := logrus.New()
+	if verbose {
+		logger.SetLevel(logrus.DebugLevel)
+	} else {
+		logger.SetLevel(logrus.WarnLevel)
+	}
+
+	configPath = install.ConfigPath(configPath)
+
+	cfg, err := config.LoadWithOverrides(configPath, nil)
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+
+	var result control.RevokeResult
+	handled := false
+	// The agent runs with its own dryRun setting, so a dry run always stays local
+	if !local && !dryRun && cfg.GetControlSocket() != "" {
+		result, handled, err = revokeThroughAgent(cfg.GetControlSocket(), filter)
+		if err != nil {
+			return err
+		}
+		if !handled {
+			logger.Info("Agent is not running, revoking directly")
+		}
+	}
+	if !handled {
+		result, err = revokeLocally(cfg, filter, dryRun || cfg.DryRun, logger)
+		if err != nil {
+			return err
+		}
+	}
+
+	if jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(result); err != nil {
+			return err
+		}
+	} else {
+		printResult(result, dryRun)
+	}
+
+	if !result.Success {
+		return fmt.Errorf("revoke incomplete: %s", result.Error)
+	}
+	return nil
+}
+
+// revokeThroughAgent asks the running agent to revoke. handled is false when
+// no agent is listening on the socket.
+func revokeThroughAgent(socket string, filter scripts.RevokeFilter) (control.RevokeResult, bool, error) {
+	query := url.Values{}
+	if filter.All {
+		query.Set("all", "true")
+	}
+	if filter.UserName != "" {
+		query.Set("user", filter.UserName)
+	}
+	if filter.RequestID != "" {
+		query.Set("requestId", filter.RequestID)
+	}
+
+	var result control.RevokeResult
+	// Terminating sessions can take a while; the agent bounds each step itself
+	err := control.NewClient(socket, 0).Post(control.PathRevoke+"?"+query.Encode(), &result)
+	switch {
+	case err == nil:
+		return result, true, nil
+	case errors.Is(err, os.ErrNotExist), errors.Is(err, syscall.ECONNREFUSED):
+		return result, false, nil
+	case errors.Is(err, os.ErrPermission):
+		return result, false, fmt.Errorf("%w (try running with sudo)", err)
+	}
+	return result, false, fmt.Errorf("%w (use --local to revoke without the agent)", err)
+}
+
+func revokeLocally(cfg *types.Config, filter scripts.RevokeFilter, dryRun bool, logger *logrus.Logger) (control.RevokeResult, error) {
+	scripts.SetStatePath(state.Path(cfg.StateDir))
+	scripts.SetAuditLogPath(audit.Path(cfg.StateDir))
+	if err := scripts.ConfigureAuditSinks(cfg.AuditSinks, cfg.HostID); err != nil {
+		// Revoking must not depend on the sinks being reachable or valid
+		logger.WithError(err).Warn("Audit sinks unavailable, recording to the audit log only")
+	}
+	defer scripts.FlushAuditLog(logger)
+	scripts.SetFileBackupDir(filebackup.Dir(cfg.StateDir))
+	scripts.SetCertificateAuthorityDir(scripts.CertificateAuthorityDir(cfg.StateDir))
+	scripts.SetAuthorizedKeysFile(cfg.GetAuthorizedKeysFile())
+	scripts.SetSudoersLayout(cfg.GetSudoersLayout())
+	scripts.SetSessionRecording(cfg.GetSessionRecording())
+	if err := scripts.SetScriptLimits(cfg.ScriptLimits); err != nil {
+		logger.WithError(err).Warn("Script limits unavailable, revoking without them")
+	}
+	osplugins.SetOverride(cfg.OSPlugin)
+	userdb.Configure(cfg)
+
+	store, err := grants.Open(cfg.StateDir)
+	if err != nil {
+		if errors.Is(err, os.ErrPermission) {
+			return control.RevokeResult{}, fmt.Errorf("%w (try running with sudo)", err)
+		}
+		return control.RevokeResult{}, err
+	}
+
+	var cancelled []string
+	if !dryRun {
+		cancelled = grants.NewScheduler(store, dryRun, logger).CancelMatching(func(req scripts.ProvisioningRequest) bool {
+			return filter.Matches(req.UserName, req.RequestID)
+		})
+	}
+
+	return control.NewRevokeResult(cancelled, scripts.RevokeRecorded(filter, dryRun, logger)), nil
+}
+
+func printResult(result control.RevokeResult, dryRun bool) {
+	for _, key := range result.Cancelled {
+		fmt.Printf("⏰ %s: scheduled grant cancelled\n", key)
+	}
+	for _, item := range result.Revoked {
+		if !item.Success {
+			fmt.Printf("❌ %s/%s (%s): %s\n", item.RequestID, item.Command, item.UserName, item.Error)
+			continue
+		}
+		fmt.Printf("✅ %s/%s (%s): %s\n", item.RequestID, item.Command, item.UserName, item.Message)
+	}
+
+	if len(result.Cancelled) == 0 && len(result.Revoked) == 0 {
+		fmt.Println("No matching grants")
+		return
+	}
+	if result.Success {
+		fmt.Printf("🚨 %s\n", result.Message)
+		if dryRun {
+			fmt.Println("🔍 DRY-RUN: No actual changes were made to the system")
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package rotatekeys
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"p0-ssh-agent/internal/client"
+	"p0-ssh-agent/internal/config"
+	"p0-ssh-agent/internal/install"
+	"p0-ssh-agent/internal/jwt"
+	"p0-ssh-agent/internal/logging"
+	"p0-ssh-agent/types"
+	"p0-ssh-agent/utils"
+)
+
+// DefaultOverlap is how long the backend keeps accepting the old key
+const DefaultOverlap = 24 * time.Hour
+
+func NewRotateKeysCommand(verbose *bool, configPath *string) *cobra.Command {
+	var (
+		overlap time.Duration
+		profile string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "rotate-keys",
+		Short: "Rotate the JWT key pair without re-registering",
+		Long: `Generate a new ES384 key pair, register its public key with the P0 backend
+over the tunnel (authenticated with the current key) and swap it into keyPath.
+
+The backend keeps accepting the current key for --overlap, so the running agent
+stays connected and switches to the new key on its next reconnect. The replaced
+key pair is kept as jwk.previous.*.json in keyPath.
+
+With a key profile (keyProfile in the config, or --profile) only that profile's
+key pair, in its subdirectory of keyPath, is rotated. Pass the --config of the
+agent registered with that profile's backend.
+
+Examples:
+  sudo p0-ssh-agent rotate-keys
+  sudo p0-ssh-agent rotate-keys --overlap 1h
+  sudo p0-ssh-agent rotate-keys --config /etc/p0-ssh-agent/staging.yaml --profile staging`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runRotateKeys(*verbose, *configPath, overlap, profile)
+		},
+	}
+
+	cmd.Flags().DurationVar(&overlap, "overlap", DefaultOverlap, "How long the backend keeps accepting the current key")
+	cmd.Flags().StringVar(&profile, "profile", "", "Key profile to rotate (default: the config's keyProfile)")
+
+	return cmd
+}
+
+func runRotateKeys(verbose bool, configPath string, overlap time.Duration, profile string) error {
+	if overlap <= 0 {
+		return fmt.Errorf("--overlap must be greater than 0")
+	}
+
+	configPath = install.ConfigPath(configPath)
+
+	cfg, err := config.LoadWithOverrides(configPath, map[string]interface{}{
+		"keyProfile": profile,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+
+	logger := logging.SetupLogger(verbose)
+	keyDir := cfg.GetKeyDir()
+
+	currentKey := jwt.NewManager(logger)
+	currentKey.SetProfile(cfg.KeyProfile)
+	if err := currentKey.LoadKey(keyDir); err != nil {
+		return fmt.Errorf("failed to load current key: %w", err)
+	}
+
+	// Stage the new pair inside the key directory so installing it is a rename
+	stagingDir := filepath.Join(keyDir, jwt.StagingDir)
+	if err := os.RemoveAll(stagingDir); err != nil {
+		return fmt.Errorf("failed to clear %s: %w (try running with sudo)", stagingDir, err)
+	}
+	if err := os.Mkdir(stagingDir, 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %w (try running with sudo)", stagingDir, err)
+	}
+
+	newKey := jwt.NewManager(logger)
+	newKey.SetProfile(cfg.KeyProfile)
+	if err := newKey.GenerateKeyPair(stagingDir); err != nil {
+		os.RemoveAll(stagingDir)
+		return fmt.Errorf("failed to generate new key pair: %w", err)
+	}
+
+	publicKey, err := utils.GetJWKPublicKey(stagingDir, logger)
+	if err != nil {
+		os.RemoveAll(stagingDir)
+		return err
+	}
+
+	fmt.Println("🔑 Registering new public key with the P0 backend...")
+	result, err := client.CallOnce(cfg, currentKey, "rotateKey", types.RotateKeyRequest{
+		ClientID:       cfg.GetClientID(),
+		JWKPublicKey:   publicKey,
+		OverlapSeconds: int(overlap.Seconds()),
+	}, logger)
+	if err != nil {
+		os.RemoveAll(stagingDir)
+		return fmt.Errorf("failed to register new key, current key left in place: %w", err)
+	}
+
+	var response types.RotateKeyResponse
+	if err := json.Unmarshal(result, &response); err != nil {
+		os.RemoveAll(stagingDir)
+		return fmt.Errorf("failed to parse rotateKey response, current key left in place: %w", err)
+	}
+	if !response.Ok {
+		os.RemoveAll(stagingDir)
+		return fmt.Errorf("backend rejected the new key, current key left in place: %s", response.Error)
+	}
+
+	if err := jwt.InstallKeyPair(stagingDir, keyDir); err != nil {
+		// The backend already knows the new key; keep it so the swap can be finished by hand
+		return fmt.Errorf("new key registered but not installed (staged in %s): %w", stagingDir, err)
+	}
+
+	validUntil := response.OldKeyValidUntil
+	if validUntil == "" {
+		validUntil = time.Now().Add(overlap).UTC().Format(time.RFC3339)
+	}
+
+	fmt.Printf("✅ Key rotated in %s\n", keyDir)
+	if keyID, err := newKey.KeyID(); err == nil {
+		fmt.Printf("   New key ID: %s\n", keyID)
+	}
+	fmt.Printf("   Previous key accepted until: %s\n", validUntil)
+	fmt.Println("💡 The running agent switches to the new key on its next reconnect")
+	return nil
+}
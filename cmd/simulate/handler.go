@@ -0,0 +1,447 @@
+package simulate
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+
+	"p0-ssh-agent/internal/audit"
+	"p0-ssh-agent/internal/client"
+	"p0-ssh-agent/internal/config"
+	"p0-ssh-agent/internal/harness"
+	"p0-ssh-agent/internal/install"
+	"p0-ssh-agent/internal/policy"
+	"p0-ssh-agent/scripts"
+	"p0-ssh-agent/types"
+)
+
+// progressInterval is how often the remaining time is shown while waiting
+// for a grant to expire, the interval at which the agent checks for expiry
+const progressInterval = 30 * time.Second
+
+// simulatedExpiry is a point at which part or all of the grant expires
+type simulatedExpiry struct {
+	name string
+	ttl  time.Duration
+	at   time.Time
+}
+
+type grantOptions struct {
+	userName  string
+	ttl       time.Duration
+	sudoTTL   time.Duration
+	publicKey string
+	sudo      bool
+	metadata  map[string]string
+	dir       string
+	keep      bool
+	fast      bool
+}
+
+func NewSimulateCommand(verbose *bool, configPath *string) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "simulate",
+		Short: "Rehearse what the agent does in a sandbox, without changing this host",
+		Long: `Run the agent's provisioning pipeline against a sandbox directory instead
+of the real system, to learn how grants behave on a production host safely.
+Files such as authorized_keys and sudoers are written under the sandbox;
+commands such as visudo, systemctl or pkill are only recorded and listed.`,
+	}
+
+	cmd.AddCommand(newGrantCommand(verbose, configPath))
+
+	return cmd
+}
+
+func newGrantCommand(verbose *bool, configPath *string) *cobra.Command {
+	var opts grantOptions
+
+	cmd := &cobra.Command{
+		Use:   "grant",
+		Short: "Walk a grant through policy, provisioning, audit, expiry and revoke",
+		Long: `Simulate one JIT grant from start to finish in a sandbox:
+
+  1. Policy: the settings of the agent configuration, if one is installed,
+     are shown; the kill switch and requiredMetadata apply to the grant
+  2. Provisioning: the user is created and given an SSH key, and sudo with
+     --sudo, through the same checks and scripts as a request from P0
+  3. Audit: the entries recorded in the sandbox audit log are shown
+  4. Expiry: the grant is held until its --ttl passes, or revoked at once with
+     --fast or Ctrl-C; with --sudo-ttl sudo expires first, on its own
+  5. Revoke: the expiry revoke the agent performs, followed by what is left
+
+The sandbox is a temporary directory removed afterwards unless --keep or
+--dir is given. Nothing outside it is changed.
+
+Examples:
+  p0-ssh-agent simulate grant --username demo --ttl 5m
+  p0-ssh-agent simulate grant --username demo --sudo --fast
+  p0-ssh-agent simulate grant --username demo --ttl 8m --sudo-ttl 1m
+  p0-ssh-agent simulate grant --username demo --metadata ticket=CHG-1234 --dir /tmp/p0-sim`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runGrant(*verbose, *configPath, opts)
+		},
+	}
+
+	cmd.Flags().StringVar(&opts.userName, "username", "demo", "JIT user to grant access to")
+	cmd.Flags().DurationVar(&opts.ttl, "ttl", 5*time.Minute, "How long the grant lasts before it expires")
+	cmd.Flags().StringVar(&opts.publicKey, "public-key", "", "SSH public key to grant (a throwaway key is generated if empty)")
+	cmd.Flags().BoolVar(&opts.sudo, "sudo", false, "Grant sudo access as well")
+	cmd.Flags().DurationVar(&opts.sudoTTL, "sudo-ttl", 0, "Expire sudo after this long, before the rest of the grant (implies --sudo)")
+	cmd.Flags().StringToStringVar(&opts.metadata, "metadata", nil, "Grant metadata checked by requiredMetadata, as key=value (repeatable)")
+	cmd.Flags().StringVar(&opts.dir, "dir", "", "Empty directory to use as the sandbox, kept afterwards")
+	cmd.Flags().BoolVar(&opts.keep, "keep", false, "Keep the temporary sandbox for inspection")
+	cmd.Flags().BoolVar(&opts.fast, "fast", false, "Expire the grant at once instead of waiting for --ttl")
+
+	return cmd
+}
+
+func runGrant(verbose bool, configPath string, opts grantOptions) error {
+	if runtime.GOOS == "windows" {
+		return fmt.Errorf("simulate is not supported on Windows")
+	}
+	if opts.ttl <= 0 {
+		return fmt.Errorf("--ttl must be positive")
+	}
+	if opts.sudoTTL < 0 || (opts.sudoTTL > 0 && opts.sudoTTL >= opts.ttl) {
+		return fmt.Errorf("--sudo-ttl must be positive and shorter than --ttl")
+	}
+	if opts.sudoTTL > 0 {
+		opts.sudo = true
+	}
+
+	logger := logrus.New()
+	if verbose {
+		logger.SetLevel(logrus.DebugLevel)
+	} else {
+		logger.SetLevel(logrus.WarnLevel)
+	}
+
+	publicKey := opts.publicKey
+	if publicKey == "" {
+		generated, err := throwawayKey()
+		if err != nil {
+			return fmt.Errorf("failed to generate a key: %w", err)
+		}
+		publicKey = generated
+	}
+
+	cfg, source := installedConfig(configPath)
+
+	root := opts.dir
+	keep := opts.keep || opts.dir != ""
+	if root == "" {
+		dir, err := os.MkdirTemp("", "p0-simulate-")
+		if err != nil {
+			return fmt.Errorf("failed to create sandbox directory: %w", err)
+		}
+		root = dir
+	} else if err := checkEmptyDir(root); err != nil {
+		return err
+	}
+	if !keep {
+		defer os.RemoveAll(root)
+	}
+
+	sandbox, err := harness.NewSandbox(root)
+	if err != nil {
+		return err
+	}
+	defer sandbox.Close()
+	// The sandbox user never logs in, so it has no processes to terminate
+	sandbox.Executor.On("pgrep").Exit(1)
+
+	simulator, err := client.NewSimulator(cfg, sandbox.StateDir, logger)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("🧪 Simulating a grant for %s in %s\n", opts.userName, root)
+	fmt.Println("   Files are written under the sandbox; commands are recorded, not run.")
+
+	requestID := fmt.Sprintf("simulate-%d", time.Now().Unix())
+	grantedAt := time.Now()
+	expiresAt := grantedAt.Add(opts.ttl).UTC().Truncate(time.Second)
+	expiries := []simulatedExpiry{{name: "the grant", ttl: opts.ttl, at: expiresAt}}
+	sudoExpiresAt := ""
+	if opts.sudoTTL > 0 {
+		at := grantedAt.Add(opts.sudoTTL).UTC().Truncate(time.Second)
+		sudoExpiresAt = at.Format(time.RFC3339)
+		expiries = append([]simulatedExpiry{{name: "sudo", ttl: opts.sudoTTL, at: at}}, expiries...)
+	}
+	origin := &audit.Origin{Source: "simulate"}
+
+	fmt.Println()
+	fmt.Println("1️⃣  Policy")
+	if source == "" {
+		fmt.Println("   No agent configuration installed; the defaults apply")
+	} else {
+		fmt.Printf("   Settings from %s, sudoersLayout %s\n", source, cfg.GetSudoersLayout())
+	}
+	if len(cfg.RequiredMetadata) == 0 {
+		fmt.Println("   No requiredMetadata configured; every grant is accepted")
+	} else {
+		fmt.Printf("   requiredMetadata: %s\n", strings.Join(cfg.RequiredMetadata, ", "))
+	}
+
+	fmt.Println()
+	fmt.Printf("2️⃣  Provisioning request %s, expiring at %s\n", requestID, expiresAt.Format(time.RFC3339))
+	commands := []scripts.Command{scripts.CommandProvisionUser, scripts.CommandProvisionAuthorizedKeys}
+	if opts.sudo {
+		commands = append(commands, scripts.CommandProvisionSudo)
+	}
+	for _, command := range commands {
+		data, err := requestData(command, scripts.ProvisioningRequest{
+			UserName:      opts.userName,
+			Action:        "grant",
+			RequestID:     requestID,
+			PublicKey:     publicKey,
+			Sudo:          opts.sudo,
+			ExpiresAt:     expiresAt.Format(time.RFC3339),
+			SudoExpiresAt: sudoExpiresAt,
+			Metadata:      opts.metadata,
+		})
+		if err != nil {
+			return err
+		}
+		// The same path a call from the backend takes
+		result := simulator.Provision(context.Background(), string(command), data, origin)
+		if result.Status == policy.StatusRejected {
+			fmt.Printf("   🚫 %s: %s\n", command, result.Error)
+			fmt.Println("   The backend receives a 403 and nothing is provisioned.")
+			printAudit(sandbox, 0)
+			printSandbox(sandbox, keep)
+			return errors.New(result.Error)
+		}
+		if !result.Success {
+			fmt.Printf("   ❌ %s: %s\n", command, result.Error)
+			printSandbox(sandbox, keep)
+			return fmt.Errorf("%s failed: %s", command, result.Error)
+		}
+		fmt.Printf("   ✅ %s: %s\n", command, sandboxed(sandbox, result.Message))
+	}
+	printFiles(sandbox)
+
+	fmt.Println()
+	fmt.Println("3️⃣  Audit log")
+	seen := printAudit(sandbox, 0)
+
+	for _, expiry := range expiries {
+		fmt.Println()
+		fmt.Printf("4️⃣  Expiry of %s after %s\n", expiry.name, expiry.ttl)
+		now := waitForExpiry(expiry.at, opts.fast)
+
+		fmt.Println()
+		fmt.Printf("5️⃣  Expiry revoke of %s\n", expiry.name)
+		revoked, err := scripts.RevokeExpired(now, nil, "simulate", false, logger)
+		if err != nil {
+			return fmt.Errorf("failed to read the sandbox provisioning state: %w", err)
+		}
+		login := false
+		for _, grant := range revoked {
+			fmt.Printf("   ✅ %s revoked\n", grant.Command)
+			login = login || scripts.Command(grant.Command) != scripts.CommandProvisionSudo
+		}
+		if login {
+			fmt.Printf("   ✅ Sessions of %s opened with the grant terminated\n", opts.userName)
+		} else if len(revoked) > 0 {
+			fmt.Printf("   ✅ SSH access and sessions of %s left intact\n", opts.userName)
+		}
+		printFiles(sandbox)
+		seen = printAudit(sandbox, seen)
+	}
+
+	fmt.Println()
+	fmt.Println("🖥️  Commands that would have run on the host")
+	for _, call := range sandbox.Executor.Calls() {
+		fmt.Printf("   $ %s\n", sandboxed(sandbox, strings.Join(call.Args, " ")))
+	}
+
+	printSandbox(sandbox, keep)
+	return nil
+}
+
+// waitForExpiry blocks until expiresAt, showing the time left, and returns
+// the time to check expiry at. With fast, or once interrupted, it returns
+// expiresAt at once, as if the time had passed.
+func waitForExpiry(expiresAt time.Time, fast bool) time.Time {
+	if fast {
+		fmt.Println("   ⏩ Skipping ahead to the expiry (--fast)")
+		return expiresAt
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	fmt.Println("   The agent checks for expired grants every 30 seconds. Press Ctrl-C to skip ahead.")
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	timer := time.NewTimer(time.Until(expiresAt))
+	defer timer.Stop()
+
+	for {
+		fmt.Printf("   ⏳ %s left\n", time.Until(expiresAt).Round(time.Second))
+		select {
+		case <-timer.C:
+			return time.Now()
+		case <-ctx.Done():
+			fmt.Println("   ⏩ Skipping ahead to the expiry")
+			return expiresAt
+		case <-ticker.C:
+		}
+	}
+}
+
+// installedConfig returns the installed agent configuration and where it
+// was read from, or the defaults when there is none
+func installedConfig(configPath string) (*types.Config, string) {
+	configPath = install.ConfigPath(configPath)
+	cfg, err := config.LoadWithOverrides(configPath, nil)
+	if err != nil {
+		return &types.Config{}, ""
+	}
+	return cfg, configPath
+}
+
+// requestData returns req as the data of a call carrying command
+func requestData(command scripts.Command, req scripts.ProvisioningRequest) (map[string]interface{}, error) {
+	encoded, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode the %s request: %w", command, err)
+	}
+	var data map[string]interface{}
+	if err := json.Unmarshal(encoded, &data); err != nil {
+		return nil, fmt.Errorf("failed to encode the %s request: %w", command, err)
+	}
+	data["command"] = string(command)
+	return data, nil
+}
+
+func checkEmptyDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return os.MkdirAll(dir, 0755)
+	}
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("--dir %s is not empty", dir)
+	}
+	return nil
+}
+
+// throwawayKey returns a new Ed25519 public key in authorized_keys format
+func throwawayKey() (string, error) {
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	key, err := ssh.NewPublicKey(public)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))) + " p0-simulate", nil
+}
+
+// printFiles shows every file the scripts left in the sandbox, by the host
+// path it stands for
+func printFiles(sandbox *harness.Sandbox) {
+	var paths []string
+	filepath.WalkDir(sandbox.Root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if entry.IsDir() && (path == sandbox.StateDir || entry.Name() == ".harness") {
+			return filepath.SkipDir
+		}
+		if entry.Type().IsRegular() {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	sort.Strings(paths)
+
+	fmt.Println("   Files in the sandbox:")
+	if len(paths) == 0 {
+		fmt.Println("     (none)")
+	}
+	for _, path := range paths {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		hostPath := "/" + filepath.ToSlash(strings.TrimPrefix(path, sandbox.Root+string(filepath.Separator)))
+		if len(content) == 0 {
+			fmt.Printf("     %s (empty)\n", hostPath)
+			continue
+		}
+		fmt.Printf("     %s\n", hostPath)
+		for _, line := range strings.Split(strings.TrimRight(string(content), "\n"), "\n") {
+			fmt.Printf("       │ %s\n", line)
+		}
+	}
+}
+
+// printAudit shows the audit entries after the first skip and returns how
+// many there are in total
+func printAudit(sandbox *harness.Sandbox, skip int) int {
+	entries, err := audit.Read(audit.Path(sandbox.StateDir))
+	if err != nil {
+		fmt.Printf("   ⚠️  Could not read the audit log: %v\n", err)
+		return skip
+	}
+	if skip == 0 {
+		fmt.Printf("   Entries in <stateDir>/%s:\n", audit.FileName)
+	}
+	for _, entry := range entries[min(skip, len(entries)):] {
+		outcome := "✅"
+		if !entry.Success {
+			outcome = "❌"
+		}
+		status := entry.Status
+		if status == "" {
+			status = entry.Action
+		}
+		fmt.Printf("     #%d %s %s %s %s (%s, source %s)\n", entry.Seq, outcome, entry.Action, entry.Command, entry.UserName, status, originSource(entry))
+	}
+	return len(entries)
+}
+
+func originSource(entry audit.Entry) string {
+	if entry.Origin == nil {
+		return "-"
+	}
+	return entry.Origin.Source
+}
+
+func printSandbox(sandbox *harness.Sandbox, keep bool) {
+	fmt.Println()
+	if keep {
+		fmt.Printf("📁 Sandbox kept in %s\n", sandbox.Root)
+	} else {
+		fmt.Println("🧹 Sandbox removed; use --keep to inspect it")
+	}
+}
+
+// sandboxed shows host paths under the sandbox as the paths they stand for
+func sandboxed(sandbox *harness.Sandbox, text string) string {
+	return strings.ReplaceAll(text, sandbox.Root, "")
+}
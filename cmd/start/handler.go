@@ -1,9 +1,10 @@
 package start
 
 import (
+	"errors"
 	"os"
 	"os/signal"
-	"strings"
+	"runtime"
 	"syscall"
 
 	"github.com/sirupsen/logrus"
@@ -11,7 +12,14 @@ import (
 
 	"p0-ssh-agent/internal/client"
 	"p0-ssh-agent/internal/config"
+	"p0-ssh-agent/internal/control"
+	"p0-ssh-agent/internal/jwt"
 	"p0-ssh-agent/internal/logging"
+	"p0-ssh-agent/internal/metrics"
+	"p0-ssh-agent/internal/recording"
+	"p0-ssh-agent/internal/userdb"
+	"p0-ssh-agent/scripts"
+	"p0-ssh-agent/types"
 )
 
 func NewStartCommand(verbose *bool, configPath *string) *cobra.Command {
@@ -23,7 +31,9 @@ func NewStartCommand(verbose *bool, configPath *string) *cobra.Command {
 		labels          []string
 		environment     string
 		tunnelTimeoutMs int
+		metricsAddress  string
 		dryRun          bool
+		osPlugin        string
 	)
 
 	cmd := &cobra.Command{
@@ -32,23 +42,28 @@ func NewStartCommand(verbose *bool, configPath *string) *cobra.Command {
 		Long: `Start the P0 SSH Agent WebSocket proxy that connects to the P0 backend 
 and logs incoming requests for monitoring and debugging purposes.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return runStart(
-				*verbose, *configPath,
-				orgID, hostID, tunnelHost,
-				keyPath, labels, environment,
-				tunnelTimeoutMs, dryRun,
-			)
+			return runAsService(func() error {
+				return runStart(
+					*verbose, *configPath,
+					orgID, hostID, tunnelHost,
+					keyPath, labels, environment,
+					tunnelTimeoutMs, metricsAddress, dryRun,
+					osPlugin,
+				)
+			})
 		},
 	}
 
 	cmd.Flags().StringVar(&orgID, "org-id", "", "Organization identifier (required)")
 	cmd.Flags().StringVar(&hostID, "host-id", "", "Host identifier (required)")
-	cmd.Flags().StringVar(&tunnelHost, "tunnel-host", "", "WebSocket URL (e.g., ws://localhost:8079 or wss://example.ngrok.app)")
+	cmd.Flags().StringVar(&tunnelHost, "tunnel-host", "", "WebSocket URL or host[:port][/path] (e.g., ws://localhost:8079 or example.ngrok.app)")
 	cmd.Flags().StringVar(&keyPath, "key-path", "", "Path to store JWT key files")
 	cmd.Flags().StringSliceVar(&labels, "labels", []string{}, "Machine labels for registration (can be used multiple times)")
 	cmd.Flags().StringVar(&environment, "environment", "", "Environment ID for registration")
 	cmd.Flags().IntVar(&tunnelTimeoutMs, "tunnel-timeout", 0, "Tunnel timeout in milliseconds")
+	cmd.Flags().StringVar(&metricsAddress, "metrics-address", "", "Serve Prometheus metrics on this address (e.g., 127.0.0.1:9273)")
 	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "Log commands but don't execute them (safe testing mode)")
+	cmd.Flags().StringVar(&osPlugin, "os-plugin", "", "OS plugin to use instead of auto-detection (see plugins list)")
 
 	return cmd
 }
@@ -57,7 +72,8 @@ func runStart(
 	verbose bool, configPath string,
 	orgID, hostID, tunnelHost string,
 	keyPath string, labels []string, environment string,
-	tunnelTimeoutMs int, dryRun bool,
+	tunnelTimeoutMs int, metricsAddress string, dryRun bool,
+	osPlugin string,
 ) error {
 	flagOverrides := map[string]interface{}{
 		"orgId":           orgID,
@@ -65,9 +81,11 @@ func runStart(
 		"tunnelHost":      tunnelHost,
 		"keyPath":         keyPath,
 		"labels":          labels,
-		"environment":     environment,
+		"environmentId":   environment,
 		"tunnelTimeoutMs": tunnelTimeoutMs,
+		"metricsAddress":  metricsAddress,
 		"dryRun":          dryRun,
+		"osPlugin":        osPlugin,
 	}
 
 	cfg, err := config.LoadWithOverrides(configPath, flagOverrides)
@@ -82,16 +100,24 @@ func runStart(
 
 	logger := logging.SetupLogger(verbose)
 
+	for _, deprecation := range cfg.Deprecations {
+		logger.Warn("⚠️  Deprecated configuration: " + deprecation)
+	}
+
 	client, err := client.New(cfg, logger)
 	if err != nil {
 		logger.WithError(err).Error("Failed to create P0 SSH Agent client")
 
-		if strings.Contains(err.Error(), "failed to load JWT key") {
+		if errors.Is(err, jwt.ErrKeyNotFound) || errors.Is(err, jwt.ErrInvalidKey) {
 			logger.Error("🔑 Keys not found or invalid! Generate them first:")
-			logger.Errorf("   1. Generate keys: p0-ssh-agent keygen --key-path %s", cfg.KeyPath)
+			if cfg.KeyProfile != "" {
+				logger.Errorf("   1. Generate keys: p0-ssh-agent keygen --key-path %s --profile %s", cfg.KeyPath, cfg.KeyProfile)
+			} else {
+				logger.Errorf("   1. Generate keys: p0-ssh-agent keygen --key-path %s", cfg.KeyPath)
+			}
 			logger.Error("   2. Register public key with P0 backend")
 			logger.Error("   3. Run agent again")
-		} else if strings.Contains(err.Error(), "permission denied") {
+		} else if errors.Is(err, os.ErrPermission) {
 			logger.Error("💡 Fix: Try running with --key-path pointing to a writable directory")
 			logger.Error("   Example: --key-path $HOME/.p0/keys")
 			logger.Error("   Or: mkdir -p ~/.p0/keys && chmod 700 ~/.p0/keys")
@@ -100,12 +126,61 @@ func runStart(
 		return err
 	}
 
+	if cfg.MetricsAddress != "" {
+		metricsServer := metrics.Serve(cfg.MetricsAddress, logger)
+		defer metricsServer.Close()
+	}
+
+	client.SetConfigLoader(func() (*types.Config, error) {
+		return config.LoadWithOverrides(configPath, flagOverrides)
+	})
+
+	if socket := cfg.GetControlSocket(); socket != "" {
+		controlServer, err := control.Serve(socket, client, logger)
+		if err != nil {
+			logger.WithError(err).Warn("⚠️ Control socket unavailable; the agent runs without it")
+		} else {
+			defer controlServer.Close()
+		}
+	}
+
+	if userdb.Enabled(cfg) {
+		userdbServer, err := userdb.Serve(userdb.SocketPath(), userdb.Path(cfg.StateDir), logger)
+		if err != nil {
+			logger.WithError(err).Error("❌ Failed to serve JIT users through userdb; new users cannot log in")
+		} else {
+			defer userdbServer.Close()
+		}
+		if err := userdb.CheckNSS(); err != nil {
+			logger.WithError(err).Warn("⚠️ JIT users will not resolve")
+		}
+	} else if cfg.GetUserResolution() == types.UserResolutionUserdb {
+		logger.Warn("⚠️ userResolution userdb is only supported on Linux; creating local accounts")
+	}
+
+	if sessionRecording := cfg.GetSessionRecording(); sessionRecording != nil && runtime.GOOS != "windows" {
+		recordingServer, err := recording.Serve(types.RecordingSocketPath, recording.ServerConfig{
+			SpoolDir:          sessionRecording.GetSpoolDir(),
+			Recorded:          scripts.RecordedRequests,
+			MaxRecordingBytes: sessionRecording.GetMaxRecordingBytes(),
+			MaxSpoolBytes:     sessionRecording.GetMaxSpoolBytes(),
+		}, logger)
+		if err != nil {
+			logger.WithError(err).Error("❌ Failed to serve session recording; recorded users cannot log in")
+		} else {
+			defer recordingServer.Close()
+		}
+	}
+
 	var gracefulShutdown bool
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
 	go func() {
-		<-sigChan
+		select {
+		case <-sigChan:
+		case <-serviceStop:
+		}
 		logger.Info("Received shutdown signal, shutting down P0 SSH Agent gracefully...")
 		gracefulShutdown = true
 		client.Shutdown()
@@ -118,6 +193,7 @@ func runStart(
 		"clientId":    cfg.GetClientID(),
 		"tunnelHost":  cfg.TunnelHost,
 		"keyPath":     cfg.KeyPath,
+		"keyProfile":  cfg.KeyProfile,
 		"labels":      cfg.Labels,
 		"environment": cfg.EnvironmentId,
 		"dryRun":      cfg.DryRun,
@@ -0,0 +1,12 @@
+//go:build !windows
+
+package start
+
+import "os"
+
+// serviceStop is never signalled outside Windows
+var serviceStop chan os.Signal
+
+func runAsService(start func() error) error {
+	return start()
+}
@@ -0,0 +1,71 @@
+//go:build windows
+
+package start
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/windows/svc"
+)
+
+// serviceStop delivers stop and shutdown requests from the service control
+// manager to the same shutdown path as SIGTERM
+var serviceStop = make(chan os.Signal, 1)
+
+// runAsService runs start under the service control manager when the process
+// was launched as a Windows service, and directly otherwise
+func runAsService(start func() error) error {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		return fmt.Errorf("failed to detect Windows service context: %w", err)
+	}
+	if !isService {
+		return start()
+	}
+
+	handler := &agentService{start: start}
+	// The name is ignored for services running in their own process
+	if err := svc.Run("p0-ssh-agent", handler); err != nil {
+		return fmt.Errorf("failed to run as Windows service: %w", err)
+	}
+	return handler.err
+}
+
+type agentService struct {
+	start func() error
+	err   error
+}
+
+func (s *agentService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+
+	done := make(chan error, 1)
+	go func() { done <- s.start() }()
+
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case err := <-done:
+			s.err = err
+			if err != nil {
+				// A non-zero exit code lets the recovery actions restart the service
+				return true, 1
+			}
+			return false, 0
+		case request := <-requests:
+			switch request.Cmd {
+			case svc.Interrogate:
+				status <- request.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				select {
+				case serviceStop <- syscall.SIGTERM:
+				default:
+				}
+			}
+		}
+	}
+}
@@ -1,21 +1,76 @@
 package status
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
 
 	"p0-ssh-agent/internal/config"
+	"p0-ssh-agent/internal/connection"
+	"p0-ssh-agent/internal/doctor"
+	"p0-ssh-agent/internal/endpoint"
+	"p0-ssh-agent/internal/install"
 	"p0-ssh-agent/internal/logging"
+	"p0-ssh-agent/internal/osplugins"
+	"p0-ssh-agent/internal/policy"
+	"p0-ssh-agent/internal/userdb"
+	"p0-ssh-agent/scripts"
 	"p0-ssh-agent/types"
 )
 
+// Output formats of the status command
+const (
+	outputText = "text"
+	outputJSON = "json"
+	outputYAML = "yaml"
+)
+
+// Check results in structured output. Warnings are informational and do not
+// affect overall health.
+const (
+	checkPass = "pass"
+	checkFail = "fail"
+	checkWarn = "warn"
+)
+
+// check is the outcome of one status check
+type check struct {
+	Name     string   `json:"name" yaml:"name"`
+	Status   string   `json:"status" yaml:"status"`
+	Detail   string   `json:"detail" yaml:"detail"`
+	Warnings []string `json:"warnings,omitempty" yaml:"warnings,omitempty"`
+
+	// Data carries structured details of checks that have them
+	Data interface{} `json:"data,omitempty" yaml:"data,omitempty"`
+
+	// label, result and lines render the check in text output
+	label  string
+	result string
+	lines  []string
+}
+
+// report is the machine-readable status document
+type report struct {
+	Healthy    bool    `json:"healthy" yaml:"healthy"`
+	ConfigPath string  `json:"configPath" yaml:"configPath"`
+	CheckedAt  string  `json:"checkedAt" yaml:"checkedAt"`
+	Checks     []check `json:"checks" yaml:"checks"`
+}
+
 func NewStatusCommand(verbose *bool, configPath *string) *cobra.Command {
+	var output string
+
 	cmd := &cobra.Command{
 		Use:   "status",
 		Short: "Check P0 SSH Agent installation and system status",
@@ -27,20 +82,31 @@ func NewStatusCommand(verbose *bool, configPath *string) *cobra.Command {
 - Systemd service status and configuration
 - Directory permissions and ownership
 
-This command provides a comprehensive health check of your P0 SSH Agent installation.`,
+This command provides a comprehensive health check of your P0 SSH Agent installation.
+With --output json or yaml it prints each check's name, status (pass, fail or
+warn) and detail with the overall health, for monitoring. The exit status is
+non-zero whenever a check fails.`,
+		Example: `  sudo p0-ssh-agent status
+  sudo p0-ssh-agent status --output json`,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return runStatusCheck(*verbose, *configPath)
+			return runStatusCheck(*verbose, *configPath, output)
 		},
 	}
 
+	cmd.Flags().StringVarP(&output, "output", "o", outputText, "Output format: text, json or yaml")
+
 	return cmd
 }
 
-func runStatusCheck(verbose bool, configPath string) error {
-	if configPath == "" {
-		configPath = "/etc/p0-ssh-agent/config.yaml"
+func runStatusCheck(verbose bool, configPath, output string) error {
+	switch output {
+	case outputText, outputJSON, outputYAML:
+	default:
+		return fmt.Errorf("unsupported output format %q (use %s, %s or %s)", output, outputText, outputJSON, outputYAML)
 	}
 
+	configPath = install.ConfigPath(configPath)
+
 	var logger *logrus.Logger
 	cfg, err := config.LoadWithOverrides(configPath, nil)
 	if err != nil {
@@ -52,126 +118,213 @@ func runStatusCheck(verbose bool, configPath string) error {
 	} else {
 		logger = logging.SetupLogger(verbose)
 	}
+	if output != outputText {
+		// Keep stdout for the document
+		logger.SetOutput(os.Stderr)
+	}
 
 	logger.WithField("config_path", configPath).Info("🔍 P0 SSH Agent Status Check")
 
-	fmt.Println("🔍 P0 SSH Agent Status Check")
-	fmt.Println(strings.Repeat("=", 40))
+	result := report{
+		Healthy:    true,
+		ConfigPath: configPath,
+		CheckedAt:  time.Now().UTC().Format(time.RFC3339),
+	}
+	for _, c := range runChecks(cfg, configPath, logger) {
+		if c.Status == checkFail {
+			result.Healthy = false
+		}
+		result.Checks = append(result.Checks, c)
+	}
 
-	allChecksPass := true
+	switch output {
+	case outputJSON:
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(result); err != nil {
+			return err
+		}
+	case outputYAML:
+		data, err := yaml.Marshal(result)
+		if err != nil {
+			return err
+		}
+		os.Stdout.Write(data)
+	default:
+		printReport(result)
+	}
 
-	fmt.Print("📝 Configuration file... ")
-	var configValid bool
+	if !result.Healthy {
+		return fmt.Errorf("system validation failed")
+	}
+	return nil
+}
+
+// runChecks runs every status check in display order
+func runChecks(cfg *types.Config, configPath string, logger *logrus.Logger) []check {
+	var checks []check
+
+	configCheck := check{Name: "configuration", label: "📝 Configuration file"}
+	var configErr error
 	if cfg == nil {
-		cfg, configValid = checkConfiguration(configPath, logger)
+		cfg, configErr = checkConfiguration(configPath, logger)
 	} else {
-		configValid = true
 		logger.WithField("config_path", configPath).Debug("Configuration file is valid")
 	}
-	if configValid {
-		fmt.Println("✅ VALID")
+	if configErr == nil {
+		configCheck.pass("✅ VALID", "loaded from "+configPath)
+		for _, deprecation := range cfg.Deprecations {
+			configCheck.Warnings = append(configCheck.Warnings, "deprecated: "+deprecation)
+			configCheck.lines = append(configCheck.lines, "⚠️  Deprecated: "+deprecation)
+		}
 	} else {
-		fmt.Println("❌ INVALID")
-		allChecksPass = false
+		configCheck.fail("❌ INVALID", configErr.Error())
 	}
+	checks = append(checks, configCheck)
 
-	fmt.Print("🔐 JWT keys... ")
-	keysValid := false
-	if cfg != nil {
-		keysValid = checkJWTKeys(cfg.KeyPath, logger)
+	keysCheck := check{Name: "jwtKeys", label: "🔐 JWT keys"}
+	if cfg == nil {
+		keysCheck.fail("❌ MISSING", "configuration not loaded")
+	} else if err := checkJWTKeys(cfg.GetKeyDir(), logger); err != nil {
+		keysCheck.fail("❌ MISSING", err.Error())
+	} else if cfg.KeyProfile != "" {
+		keysCheck.pass("✅ PRESENT", "key pair for profile "+cfg.KeyProfile+" present in "+cfg.GetKeyDir())
+	} else {
+		keysCheck.pass("✅ PRESENT", "key pair present in "+cfg.KeyPath)
 	}
-	if keysValid {
-		fmt.Println("✅ PRESENT")
+	checks = append(checks, keysCheck)
+
+	dirsCheck := check{Name: "directories", label: "📁 Directory permissions"}
+	if cfg == nil {
+		dirsCheck.fail("❌ INCORRECT", "configuration not loaded")
+	} else if err := checkDirectoryPermissions(cfg, logger); err != nil {
+		dirsCheck.fail("❌ INCORRECT", err.Error())
 	} else {
-		fmt.Println("❌ MISSING")
-		allChecksPass = false
+		dirsCheck.pass("✅ CORRECT", "key and state directories exist")
 	}
+	checks = append(checks, dirsCheck)
 
-	fmt.Print("📁 Directory permissions... ")
-	dirsValid := false
-	if cfg != nil {
-		dirsValid = checkDirectoryPermissions(cfg, logger)
+	logCheck := check{Name: "logs", label: "📄 Log file"}
+	if cfg == nil {
+		logCheck.fail("❌ ISSUES", "configuration not loaded")
+	} else {
+		// Always valid since we use journalctl
+		logCheck.pass("✅ ACCESSIBLE", "logs are written to the systemd journal")
 	}
-	if dirsValid {
-		fmt.Println("✅ CORRECT")
+	checks = append(checks, logCheck)
+
+	serviceName := "p0-ssh-agent"
+	serviceCheck := check{Name: "service", label: "⚙️  Systemd service"}
+	if err := checkSystemdService(serviceName, logger); err != nil {
+		serviceCheck.fail("❌ NOT RUNNING", err.Error())
 	} else {
-		fmt.Println("❌ INCORRECT")
-		allChecksPass = false
+		serviceCheck.pass("✅ RUNNING", serviceName+" is enabled and active")
 	}
+	checks = append(checks, serviceCheck)
+
+	checks = append(checks, checkSSHD(logger))
 
-	fmt.Print("📄 Log file... ")
-	logValid := false
 	if cfg != nil {
-		logValid = true // Always valid since we use journalctl
+		checks = append(checks, checkKillSwitch(cfg))
+		checks = append(checks, checkAuthorizedKeys(cfg, logger))
+		if userdb.Enabled(cfg) {
+			checks = append(checks, checkUserdb(cfg, logger))
+		}
+		checks = append(checks, checkTunnelEndpoint(cfg, logger))
+		checks = append(checks, checkTunnelConnection(cfg, time.Now(), logger))
 	}
-	if logValid {
-		fmt.Println("✅ ACCESSIBLE")
+
+	executableCheck := check{Name: "executable", label: "🚀 Executable"}
+	if path, err := checkExecutable(logger); err != nil {
+		executableCheck.fail("❌ NOT FOUND", err.Error())
 	} else {
-		fmt.Println("❌ ISSUES")
-		allChecksPass = false
+		executableCheck.pass("✅ FOUND", path)
 	}
+	checks = append(checks, executableCheck)
 
-	fmt.Print("⚙️  Systemd service... ")
-	serviceName := "p0-ssh-agent"
-	serviceValid := checkSystemdService(serviceName, logger)
-	if serviceValid {
-		fmt.Println("✅ RUNNING")
+	unitCheck := check{Name: "unitBinary", label: "🔗 Unit/binary path"}
+	unit, err := doctor.CheckUnitBinary(serviceName, logger)
+	if err != nil {
+		logger.WithError(err).Debug("Unit/binary comparison unavailable")
+		unitCheck.Status, unitCheck.result, unitCheck.Detail = checkWarn, "⚠️  SKIPPED", err.Error()
+	} else if unit.OK() {
+		unitCheck.pass("✅ CONSISTENT", "unit runs "+unit.UnitBinary)
+	} else if !unit.VersionMismatch() && unit.UnitVersion != "" {
+		// Another copy of the same release runs the same code
+		unitCheck.Status, unitCheck.result, unitCheck.Detail = checkWarn, "⚠️  OTHER COPY", fmt.Sprintf("unit runs %s, installed is %s, both %s", unit.UnitBinary, unit.DetectedBinary, unit.UnitVersion)
+		unitCheck.lines = []string{"💡 Point the unit at the installed binary with: sudo p0-ssh-agent doctor --fix"}
 	} else {
-		fmt.Println("❌ NOT RUNNING")
-		allChecksPass = false
+		unitCheck.fail("❌ MISMATCH", fmt.Sprintf("unit runs %s %s, installed is %s %s", unit.UnitBinary, unit.UnitVersion, unit.DetectedBinary, unit.DetectedVersion))
+		unitCheck.lines = []string{
+			fmt.Sprintf("Unit runs:  %s %s", unit.UnitBinary, unit.UnitVersion),
+			fmt.Sprintf("Installed:  %s %s", unit.DetectedBinary, unit.DetectedVersion),
+			"💡 Fix with: sudo p0-ssh-agent doctor --fix",
+		}
 	}
+	checks = append(checks, unitCheck)
 
-	fmt.Print("🚀 Executable... ")
-	executableValid := checkExecutable(logger)
-	if executableValid {
-		fmt.Println("✅ FOUND")
-	} else {
-		fmt.Println("❌ NOT FOUND")
-		allChecksPass = false
+	return checks
+}
+
+func (c *check) pass(result, detail string) {
+	c.Status, c.result, c.Detail = checkPass, result, detail
+}
+
+func (c *check) fail(result, detail string) {
+	c.Status, c.result, c.Detail = checkFail, result, detail
+}
+
+// printReport renders the report as the emoji checklist
+func printReport(result report) {
+	fmt.Println("🔍 P0 SSH Agent Status Check")
+	fmt.Println(strings.Repeat("=", 40))
+
+	for _, c := range result.Checks {
+		fmt.Printf("%s... %s\n", c.label, c.result)
+		for _, line := range c.lines {
+			fmt.Printf("   %s\n", line)
+		}
 	}
 
 	fmt.Println(strings.Repeat("=", 40))
 
-	if allChecksPass {
+	if result.Healthy {
 		fmt.Println("🎉 All checks passed! P0 SSH Agent is properly installed and configured.")
-		return nil
-	} else {
-		fmt.Println("⚠️  Some checks failed. Please review the issues above.")
-		fmt.Println("\n💡 Quick fixes:")
-		fmt.Println("   • Run: sudo p0-ssh-agent install")
-		fmt.Println("   • Check configuration file syntax")
-		fmt.Println("   • Verify service logs: sudo journalctl -u p0-ssh-agent")
-		return fmt.Errorf("system validation failed")
+		return
 	}
+	fmt.Println("⚠️  Some checks failed. Please review the issues above.")
+	fmt.Println("\n💡 Quick fixes:")
+	fmt.Println("   • Run: sudo p0-ssh-agent install")
+	fmt.Println("   • Check configuration file syntax")
+	fmt.Println("   • Verify service logs: sudo journalctl -u p0-ssh-agent")
 }
 
-func checkConfiguration(configPath string, logger *logrus.Logger) (*types.Config, bool) {
+func checkConfiguration(configPath string, logger *logrus.Logger) (*types.Config, error) {
 	logger.WithField("path", configPath).Debug("Checking configuration")
 
 	if _, err := os.Stat(configPath); os.IsNotExist(err) {
 		logger.WithField("path", configPath).Error("Configuration file not found")
-		return nil, false
+		return nil, fmt.Errorf("configuration file not found: %s", configPath)
 	}
 
 	cfg, err := config.LoadWithOverrides(configPath, nil)
 	if err != nil {
 		logger.WithError(err).Error("Failed to load configuration")
-		return nil, false
+		return nil, fmt.Errorf("failed to load configuration: %w", err)
 	}
 
 	if cfg.OrgID == "" || cfg.HostID == "" || cfg.TunnelHost == "" {
 		logger.Error("Required configuration fields missing")
-		return cfg, false
+		return cfg, fmt.Errorf("required fields missing: orgId, hostId and tunnelHost must be set")
 	}
 
-	return cfg, true
+	return cfg, nil
 }
 
-
-func checkJWTKeys(keyPath string, logger *logrus.Logger) bool {
+func checkJWTKeys(keyPath string, logger *logrus.Logger) error {
 	if keyPath == "" {
 		logger.Debug("No key path specified")
-		return true
+		return nil
 	}
 
 	logger.WithField("path", keyPath).Debug("Checking JWT keys")
@@ -181,26 +334,26 @@ func checkJWTKeys(keyPath string, logger *logrus.Logger) bool {
 
 	if _, err := os.Stat(privateKeyPath); os.IsNotExist(err) {
 		logger.WithField("path", privateKeyPath).Error("Private key file not found")
-		return false
+		return fmt.Errorf("private key file not found: %s", privateKeyPath)
 	}
 
 	if _, err := os.Stat(publicKeyPath); os.IsNotExist(err) {
 		logger.WithField("path", publicKeyPath).Error("Public key file not found")
-		return false
+		return fmt.Errorf("public key file not found: %s", publicKeyPath)
 	}
 
 	// Since service runs as root, just check if files are readable by root
 	if _, err := os.Open(privateKeyPath); err != nil {
 		logger.WithField("path", privateKeyPath).Error("Cannot read private key")
-		return false
+		return fmt.Errorf("cannot read private key: %w", err)
 	}
 
-	return true
+	return nil
 }
 
-func checkDirectoryPermissions(cfg *types.Config, logger *logrus.Logger) bool {
-	directories := []string{cfg.KeyPath}
-	
+func checkDirectoryPermissions(cfg *types.Config, logger *logrus.Logger) error {
+	directories := []string{cfg.KeyPath, cfg.StateDir}
+
 	// No log directories to check - using journalctl
 
 	for _, dir := range directories {
@@ -212,23 +365,23 @@ func checkDirectoryPermissions(cfg *types.Config, logger *logrus.Logger) bool {
 
 		if _, err := os.Stat(dir); os.IsNotExist(err) {
 			logger.WithField("dir", dir).Error("Directory not found")
-			return false
+			return fmt.Errorf("directory not found: %s", dir)
 		}
 
 		// Since service runs as root, just check if directory exists and is accessible
 		info, err := os.Stat(dir)
 		if err != nil {
 			logger.WithField("dir", dir).Error("Cannot access directory")
-			return false
+			return fmt.Errorf("cannot access directory: %w", err)
 		}
 
 		if !info.IsDir() {
 			logger.WithField("dir", dir).Error("Path is not a directory")
-			return false
+			return fmt.Errorf("path is not a directory: %s", dir)
 		}
 	}
 
-	return true
+	return nil
 }
 
 func checkLogFile(logPath string, logger *logrus.Logger) bool {
@@ -255,31 +408,29 @@ func checkLogFile(logPath string, logger *logrus.Logger) bool {
 	return true
 }
 
-func checkSystemdService(serviceName string, logger *logrus.Logger) bool {
+func checkSystemdService(serviceName string, logger *logrus.Logger) error {
 	logger.WithField("service", serviceName).Debug("Checking systemd service")
 
-	servicePath := fmt.Sprintf("/etc/systemd/system/%s.service", serviceName)
-	if _, err := os.Stat(servicePath); os.IsNotExist(err) {
-		logger.WithField("path", servicePath).Error("Service file not found")
-		return false
+	status := osplugins.Selected().ServiceStatus(serviceName)
+	if !status.Installed {
+		logger.WithField("service", serviceName).Error("Service file not found")
+		return fmt.Errorf("service %s is not installed", serviceName)
 	}
 
-	cmd := exec.Command("systemctl", "is-enabled", serviceName)
-	if err := cmd.Run(); err != nil {
+	if !status.Enabled {
 		logger.WithField("service", serviceName).Error("Service is not enabled")
-		return false
+		return fmt.Errorf("service %s is not enabled", serviceName)
 	}
 
-	cmd = exec.Command("systemctl", "is-active", serviceName)
-	if err := cmd.Run(); err != nil {
+	if !status.Active {
 		logger.WithField("service", serviceName).Error("Service is not active")
-		return false
+		return fmt.Errorf("service %s is not active", serviceName)
 	}
 
-	return true
+	return nil
 }
 
-func checkExecutable(logger *logrus.Logger) bool {
+func checkExecutable(logger *logrus.Logger) (string, error) {
 	logger.Debug("Checking executable")
 
 	locations := []string{
@@ -292,15 +443,202 @@ func checkExecutable(logger *logrus.Logger) bool {
 			cmd := exec.Command("test", "-x", location)
 			if err := cmd.Run(); err == nil {
 				logger.WithField("path", location).Debug("Found executable")
-				return true
+				return location, nil
 			}
 		}
 	}
 
-	if _, err := exec.LookPath("p0-ssh-agent"); err == nil {
-		return true
+	if path, err := exec.LookPath("p0-ssh-agent"); err == nil {
+		return path, nil
 	}
 
 	logger.Error("Executable not found in common locations or PATH")
-	return false
-}
\ No newline at end of file
+	return "", fmt.Errorf("executable not found in %s or PATH", strings.Join(locations, ", "))
+}
+
+// checkAuthorizedKeys verifies that sshd reads keys from where the agent
+// provisions them. Only the global AuthorizedKeysFile is compared; Match
+// blocks are not evaluated.
+func checkAuthorizedKeys(cfg *types.Config, logger *logrus.Logger) check {
+	c := check{Name: "authorizedKeys", label: "🗝️  Authorized keys"}
+
+	if runtime.GOOS == "windows" {
+		c.Status, c.result, c.Detail = checkWarn, "⚠️  SKIPPED", "authorizedKeysLayout is not used on Windows"
+		return c
+	}
+	template, source, err := scripts.ResolveAuthorizedKeysFile(context.Background(), cfg.GetAuthorizedKeysFile())
+	if err != nil {
+		c.fail("❌ NO PER-USER FILE", err.Error())
+		c.lines = []string{"💡 Fix: add a file with %h, %u or %U to AuthorizedKeysFile in sshd_config, or set authorizedKeysLayout"}
+		return c
+	}
+
+	entries, err := scripts.SSHDAuthorizedKeysFiles(context.Background())
+	if err != nil {
+		logger.WithError(err).Debug("Failed to read sshd AuthorizedKeysFile")
+		c.Status, c.result, c.Detail = checkWarn, "⚠️  UNKNOWN", err.Error()
+		return c
+	}
+	data := map[string]interface{}{
+		"layout":     template,
+		"detected":   cfg.GetAuthorizedKeysFile() == "",
+		"sshdConfig": entries,
+	}
+	if source != "" {
+		data["source"] = source
+	}
+	c.Data = data
+
+	for _, entry := range entries {
+		if entry == template {
+			detail := "sshd reads " + template
+			if source != "" {
+				detail += " (detected from " + source + ")"
+			}
+			c.pass("✅ "+template, detail)
+			return c
+		}
+	}
+
+	c.fail("❌ NOT READ BY SSHD", fmt.Sprintf("sshd AuthorizedKeysFile is %q; keys provisioned to %s are ignored", strings.Join(entries, " "), template))
+	c.lines = []string{
+		"sshd reads: " + strings.Join(entries, " "),
+		"💡 Fix: add " + template + " to AuthorizedKeysFile in sshd_config, or change authorizedKeysLayout",
+	}
+	return c
+}
+
+// checkSSHD verifies that sshd can accept logins, as reported in heartbeats
+func checkSSHD(logger *logrus.Logger) check {
+	c := check{Name: "sshd", label: "🔑 SSH daemon"}
+
+	if runtime.GOOS == "windows" {
+		c.Status, c.result, c.Detail = checkWarn, "⚠️  SKIPPED", "sshd is not checked on Windows"
+		return c
+	}
+
+	health := scripts.CheckSSHD(context.Background(), logger)
+	c.Data = health
+
+	ports := make([]string, len(health.Ports))
+	for i, port := range health.Ports {
+		ports[i] = strconv.Itoa(port)
+	}
+	if health.Healthy {
+		c.pass("✅ ACCEPTING LOGINS", "sshd is running and listening on port "+strings.Join(ports, ", "))
+		return c
+	}
+
+	c.fail("❌ LOGINS WILL FAIL", strings.Join(health.Problems, "; "))
+	c.lines = health.Problems
+	return c
+}
+
+// checkKillSwitch reports whether the kill switch file refuses grants. A
+// host owner turns it on deliberately, so it warns rather than fails.
+func checkKillSwitch(cfg *types.Config) check {
+	c := check{Name: "killSwitch", label: "🛑 Kill switch"}
+
+	disabled := policy.CheckDisabled(cfg.GetDisabledFile())
+	if disabled == nil {
+		c.pass("✅ OFF", "grants are allowed; create "+cfg.GetDisabledFile()+" to refuse them")
+		return c
+	}
+
+	c.Data = disabled
+	c.Status, c.result, c.Detail = checkWarn, "⚠️  ON - GRANTS REFUSED", policy.DisabledViolation(disabled).Message
+	c.lines = []string{"💡 Remove " + disabled.File + " to resume grants; revokes still run"}
+	return c
+}
+
+// checkUserdb verifies that JIT users resolve through systemd's userdb:
+// NSS must consult systemd and the agent must be serving its socket
+func checkUserdb(cfg *types.Config, logger *logrus.Logger) check {
+	c := check{Name: "userdb", label: "👥 JIT user resolution"}
+
+	if err := userdb.CheckNSS(); err != nil {
+		c.fail("❌ NOT RESOLVED", err.Error())
+		c.lines = []string{"💡 Fix: add systemd to the passwd, group and shadow lines of /etc/nsswitch.conf"}
+		return c
+	}
+
+	socket := userdb.SocketPath()
+	if _, err := os.Stat(socket); err != nil {
+		logger.WithError(err).Debug("userdb socket not found")
+		c.fail("❌ NOT SERVED", "the agent is not serving "+socket)
+		return c
+	}
+
+	identities, err := userdb.List(userdb.Path(cfg.StateDir))
+	if err != nil {
+		c.fail("❌ UNREADABLE", err.Error())
+		return c
+	}
+	c.pass("✅ USERDB", fmt.Sprintf("%d JIT user(s) served on %s", len(identities), socket))
+	return c
+}
+
+// checkTunnelEndpoint reports the endpoint the agent last connected to, as it
+// recorded it. It is informational and never fails the status check.
+func checkTunnelEndpoint(cfg *types.Config, logger *logrus.Logger) check {
+	c := check{Name: "tunnelEndpoint", label: "🌐 Tunnel endpoint"}
+
+	current, ok, err := endpoint.Load(endpoint.Path(cfg.StateDir))
+	if err != nil {
+		logger.WithError(err).Debug("Failed to read tunnel endpoint record")
+	}
+	if err != nil || !ok {
+		c.Status, c.result, c.Detail = checkWarn, "⚠️  UNKNOWN (agent has not started)", "agent has not recorded a tunnel endpoint"
+		return c
+	}
+
+	c.pass(current.URL, fmt.Sprintf("%s, priority %d of %d, selected by %s at %s", current.URL, current.Priority, current.Candidates, current.Reason, current.SelectedAt))
+	c.lines = []string{fmt.Sprintf("Priority %d of %d, selected by %s at %s", current.Priority, current.Candidates, current.Reason, current.SelectedAt)}
+	return c
+}
+
+// checkTunnelConnection reports the live tunnel connection as the running
+// agent records it, failing when the agent is disconnected or its heartbeats
+// have stopped
+func checkTunnelConnection(cfg *types.Config, now time.Time, logger *logrus.Logger) check {
+	c := check{Name: "tunnelConnection", label: "📡 Tunnel connection"}
+
+	state, ok, err := connection.Load(connection.Path(cfg.StateDir))
+	if err != nil {
+		logger.WithError(err).Debug("Failed to read connection record")
+		c.fail("❌ UNKNOWN", err.Error())
+		return c
+	}
+	if !ok {
+		c.fail("❌ UNKNOWN", "agent has not recorded a connection (agent has not started)")
+		return c
+	}
+	c.Data = state
+
+	if state.Connected {
+		c.lines = append(c.lines, fmt.Sprintf("Connected to %s since %s", state.Endpoint, state.ConnectedSince))
+	}
+	if lastHeartbeat, err := time.Parse(time.RFC3339, state.LastHeartbeat); err == nil {
+		c.lines = append(c.lines, fmt.Sprintf("Last heartbeat: %s (%s ago)", state.LastHeartbeat, now.Sub(lastHeartbeat).Round(time.Second)))
+	}
+	if state.GaveUp {
+		c.lines = append(c.lines, fmt.Sprintf("Gave up reconnecting: %d failed attempts since %s", state.FailedAttempts, state.FailingSince))
+	} else if state.Reconnecting || state.FailedAttempts > 0 {
+		c.lines = append(c.lines, fmt.Sprintf("Reconnecting: %d failed attempts since %s, next attempt at %s (backoff %.0fs)", state.FailedAttempts, state.FailingSince, state.NextAttempt, state.BackoffSeconds))
+	}
+
+	if reason := state.Stale(now); reason != "" {
+		if state.LastError != "" {
+			c.lines = append(c.lines, "Last error: "+state.LastError)
+		}
+		result := "❌ DISCONNECTED"
+		if state.Connected {
+			result = "❌ STALE"
+		}
+		c.fail(result, reason)
+		return c
+	}
+
+	c.pass("✅ CONNECTED", fmt.Sprintf("connected to %s, last heartbeat at %s", state.Endpoint, state.LastHeartbeat))
+	return c
+}
@@ -1,18 +1,25 @@
 package uninstall
 
 import (
+	"context"
 	"fmt"
+	"runtime"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 
+	"p0-ssh-agent/internal/config"
+	"p0-ssh-agent/internal/elevate"
+	"p0-ssh-agent/internal/install"
 	"p0-ssh-agent/internal/osplugins"
+	"p0-ssh-agent/scripts"
 )
 
 func NewUninstallCommand(verbose *bool, configPath *string) *cobra.Command {
 	var (
 		serviceName string
 		force       bool
+		osPlugin    string
 	)
 
 	cmd := &cobra.Command{
@@ -22,6 +29,7 @@ func NewUninstallCommand(verbose *bool, configPath *string) *cobra.Command {
 - Stop and disable systemd service
 - Remove service files and configuration
 - Remove service user and directories
+- Stop sshd from trusting the P0 CA
 - Remove binary from system location
 - Clean up all installation artifacts
 
@@ -29,17 +37,18 @@ This command reverses everything done by the install command.
 
 WARNING: This will permanently delete all configuration, keys, and logs.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return runUninstall(*verbose, *configPath, serviceName, force)
+			return runUninstall(*verbose, *configPath, serviceName, force, osPlugin)
 		},
 	}
 
 	cmd.Flags().StringVar(&serviceName, "service-name", "p0-ssh-agent", "Name of the systemd service to remove")
 	cmd.Flags().BoolVar(&force, "force", false, "Force removal without confirmation prompts")
+	cmd.Flags().StringVar(&osPlugin, "os-plugin", "", "OS plugin to use instead of the config's osPlugin or auto-detection")
 
 	return cmd
 }
 
-func runUninstall(verbose bool, configPath string, serviceName string, force bool) error {
+func runUninstall(verbose bool, configPath string, serviceName string, force bool, pluginName string) error {
 	logger := logrus.New()
 	if verbose {
 		logger.SetLevel(logrus.DebugLevel)
@@ -47,9 +56,15 @@ func runUninstall(verbose bool, configPath string, serviceName string, force boo
 		logger.SetLevel(logrus.InfoLevel)
 	}
 
-	if configPath == "" {
-		configPath = "/etc/p0-ssh-agent/config.yaml"
+	configPath = install.ConfigPath(configPath)
+
+	// Remove the agent with the plugin it was installed with
+	if pluginName == "" {
+		if cfg, err := config.LoadWithOverrides(configPath, nil); err == nil {
+			pluginName = cfg.OSPlugin
+		}
 	}
+	osplugins.SetOverride(pluginName)
 
 	// Get the appropriate OS plugin
 	osPlugin, err := osplugins.GetPlugin(logger)
@@ -57,6 +72,11 @@ func runUninstall(verbose bool, configPath string, serviceName string, force boo
 		return fmt.Errorf("failed to get OS plugin: %w", err)
 	}
 
+	// Every step removes system locations; fail once here rather than on each of them
+	if err := elevate.Check(); err != nil {
+		return fmt.Errorf("cannot uninstall: %w", err)
+	}
+
 	logger.WithFields(logrus.Fields{
 		"service_name": serviceName,
 		"config_path":  configPath,
@@ -69,14 +89,14 @@ func runUninstall(verbose bool, configPath string, serviceName string, force boo
 		fmt.Printf("- Systemd service (%s)\n", serviceName)
 		fmt.Printf("- Configuration directory (/etc/p0-ssh-agent/)\n")
 		fmt.Printf("- Log files and keys\n")
-		
+
 		// Show OS-specific binary paths
 		installDirs := osPlugin.GetInstallDirectories()
 		for _, dir := range installDirs {
 			fmt.Printf("- System binary (%s/p0-ssh-agent)\n", dir)
 		}
 		fmt.Printf("\n")
-		
+
 		fmt.Printf("Are you sure you want to continue? (y/N): ")
 
 		var response string
@@ -92,6 +112,12 @@ func runUninstall(verbose bool, configPath string, serviceName string, force boo
 		fn   func() error
 	}{
 		{"Uninstall service", func() error { return osPlugin.UninstallService(serviceName, logger) }},
+		{"Stop trusting the P0 CA", func() error {
+			if runtime.GOOS == "windows" {
+				return nil
+			}
+			return scripts.RemoveTrustedCA(context.Background(), logger)
+		}},
 		{"Clean up installation", func() error { return osPlugin.CleanupInstallation(serviceName, logger) }},
 	}
 
@@ -118,5 +144,3 @@ func runUninstall(verbose bool, configPath string, serviceName string, force boo
 	osPlugin.DisplayUninstallationSuccess(false, nil)
 	return nil
 }
-
-
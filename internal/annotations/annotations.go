@@ -0,0 +1,122 @@
+package annotations
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"p0-ssh-agent/types"
+)
+
+// FileName is the annotations file inside the agent state directory
+const FileName = "annotations.json"
+
+// Path returns the location of the annotations file for a state directory
+func Path(stateDir string) string {
+	return filepath.Join(stateDir, FileName)
+}
+
+// Load returns the annotations that have not yet expired
+func Load(stateDir string) ([]types.Annotation, error) {
+	all, err := readAll(stateDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return active(all, time.Now()), nil
+}
+
+// Add stores a new annotation. A zero ttl keeps it until cleared.
+func Add(stateDir, message, author string, ttl time.Duration) (types.Annotation, error) {
+	if message == "" {
+		return types.Annotation{}, fmt.Errorf("annotation message cannot be empty")
+	}
+
+	now := time.Now()
+	annotation := types.Annotation{
+		Message:   message,
+		Author:    author,
+		CreatedAt: now.UTC().Format(time.RFC3339),
+	}
+	if ttl > 0 {
+		annotation.ExpiresAt = now.Add(ttl).UTC().Format(time.RFC3339)
+	}
+
+	all, err := readAll(stateDir)
+	if err != nil {
+		return types.Annotation{}, err
+	}
+
+	// Expired annotations are dropped whenever the file is rewritten
+	all = append(active(all, now), annotation)
+
+	if err := writeAll(stateDir, all); err != nil {
+		return types.Annotation{}, err
+	}
+
+	return annotation, nil
+}
+
+// Clear removes all annotations
+func Clear(stateDir string) error {
+	if err := os.Remove(Path(stateDir)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to clear annotations: %w", err)
+	}
+	return nil
+}
+
+func readAll(stateDir string) ([]types.Annotation, error) {
+	data, err := os.ReadFile(Path(stateDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read annotations: %w", err)
+	}
+
+	var all []types.Annotation
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, fmt.Errorf("failed to parse annotations: %w", err)
+	}
+
+	return all, nil
+}
+
+func writeAll(stateDir string, all []types.Annotation) error {
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(all, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal annotations: %w", err)
+	}
+
+	tmpPath := Path(stateDir) + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write annotations: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, Path(stateDir)); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write annotations: %w", err)
+	}
+
+	return nil
+}
+
+func active(all []types.Annotation, now time.Time) []types.Annotation {
+	var result []types.Annotation
+	for _, annotation := range all {
+		if annotation.ExpiresAt != "" {
+			expiresAt, err := time.Parse(time.RFC3339, annotation.ExpiresAt)
+			if err == nil && !now.Before(expiresAt) {
+				continue
+			}
+		}
+		result = append(result, annotation)
+	}
+	return result
+}
@@ -0,0 +1,225 @@
+package attestation
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
+	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/types"
+)
+
+// Modes of the register --attestation flag
+const (
+	// ModeAuto attaches evidence when a TPM is present and registers without it otherwise
+	ModeAuto = "auto"
+
+	// ModeRequired fails registration when evidence cannot be produced
+	ModeRequired = "required"
+
+	// ModeOff never touches the TPM
+	ModeOff = "off"
+)
+
+// Format identifies the evidence layout for the backend
+const Format = "tpm2-quote"
+
+// PCRSelection covers the firmware and boot loader measurements
+const PCRSelection = "sha256:0,1,2,3,4,5,6,7"
+
+// commandTimeout bounds each tpm2-tools call; key creation is the slow one
+const commandTimeout = 60 * time.Second
+
+// ekCertificateIndices are the TCG NV indices of the RSA and ECC EK
+// certificates provisioned by the TPM manufacturer
+var ekCertificateIndices = []string{"0x01c00002", "0x01c0000a"}
+
+// devicePaths are the kernel TPM devices, resource manager first
+var devicePaths = []string{"/dev/tpmrm0", "/dev/tpm0"}
+
+// ValidMode reports whether mode is a known --attestation value
+func ValidMode(mode string) bool {
+	switch mode {
+	case ModeAuto, ModeRequired, ModeOff:
+		return true
+	}
+	return false
+}
+
+// Available reports whether a TPM device and tpm2-tools are present
+func Available() bool {
+	if _, err := exec.LookPath("tpm2_quote"); err != nil {
+		return false
+	}
+	for _, path := range devicePaths {
+		if _, err := os.Stat(path); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// QualifyingData binds a quote to a registration: the SHA-256 of the RFC 7638
+// thumbprint of the agent's public JWK followed by the request timestamp.
+// The backend recomputes it from the same registration request.
+func QualifyingData(jwkPublicKey map[string]string, timestamp string) ([]byte, error) {
+	data, err := json.Marshal(jwkPublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode JWK: %w", err)
+	}
+
+	var jwk jose.JSONWebKey
+	if err := json.Unmarshal(data, &jwk); err != nil {
+		return nil, fmt.Errorf("failed to parse JWK: %w", err)
+	}
+
+	thumbprint, err := jwk.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute key thumbprint: %w", err)
+	}
+
+	digest := sha256.Sum256(append(thumbprint, []byte(timestamp)...))
+	return digest[:], nil
+}
+
+// Collect produces evidence according to mode. In auto mode a missing TPM or
+// a failed quote is logged and nil evidence is returned; in required mode it
+// is an error.
+func Collect(mode string, qualifyingData []byte, logger *logrus.Logger) (*types.AttestationEvidence, error) {
+	if mode == ModeOff {
+		logger.Debug("TPM attestation disabled")
+		return nil, nil
+	}
+
+	if !Available() {
+		if mode == ModeRequired {
+			return nil, fmt.Errorf("TPM attestation required but no TPM device or tpm2-tools found")
+		}
+		logger.Info("🔏 Attestation: no TPM found, registering without hardware evidence")
+		return nil, nil
+	}
+
+	evidence, err := quote(qualifyingData, logger)
+	if err != nil {
+		if mode == ModeRequired {
+			return nil, fmt.Errorf("TPM attestation failed: %w", err)
+		}
+		logger.WithError(err).Warn("🔏 Attestation: TPM quote failed, registering without hardware evidence")
+		return nil, nil
+	}
+
+	logger.WithFields(logrus.Fields{
+		"ek_certificates": len(evidence.EKCertificates),
+		"pcrs":            evidence.PCRSelection,
+	}).Info("🔏 Attestation: TPM quote attached to registration")
+	return evidence, nil
+}
+
+// quote creates an EK and an AK under it, then quotes the boot PCRs with
+// qualifyingData. The AK is reported with the EK but not certified by it, as
+// that takes a credential activation round trip registration does not make,
+// so the quote is self-reported. Objects live in context files in a
+// temporary directory and are flushed by the resource manager when each
+// command exits.
+func quote(qualifyingData []byte, logger *logrus.Logger) (*types.AttestationEvidence, error) {
+	dir, err := os.MkdirTemp("", "p0-attestation-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create working directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := func(name string) string { return filepath.Join(dir, name) }
+
+	steps := [][]string{
+		{"tpm2_createek", "-c", path("ek.ctx"), "-G", "rsa", "-u", path("ek.pub")},
+		{"tpm2_readpublic", "-c", path("ek.ctx"), "-f", "pem", "-o", path("ek.pem")},
+		{"tpm2_createak", "-C", path("ek.ctx"), "-c", path("ak.ctx"), "-G", "rsa", "-g", "sha256", "-s", "rsassa", "-u", path("ak.pub"), "-n", path("ak.name")},
+		{"tpm2_quote", "-c", path("ak.ctx"), "-l", PCRSelection, "-q", hex.EncodeToString(qualifyingData), "-m", path("quote.msg"), "-s", path("quote.sig"), "-o", path("quote.pcrs"), "-g", "sha256"},
+	}
+	for _, step := range steps {
+		if err := run(step[0], step[1:]...); err != nil {
+			return nil, err
+		}
+	}
+
+	evidence := &types.AttestationEvidence{
+		Format:         Format,
+		PCRSelection:   PCRSelection,
+		QualifyingData: hex.EncodeToString(qualifyingData),
+	}
+
+	files := []struct {
+		name   string
+		target *string
+		encode func([]byte) string
+	}{
+		{"ek.pem", &evidence.EKPublic, func(data []byte) string { return string(data) }},
+		{"ak.pub", &evidence.AKPublic, base64.StdEncoding.EncodeToString},
+		{"ak.name", &evidence.AKName, hex.EncodeToString},
+		{"quote.pcrs", &evidence.PCRs, base64.StdEncoding.EncodeToString},
+		{"quote.msg", &evidence.Quote, base64.StdEncoding.EncodeToString},
+		{"quote.sig", &evidence.Signature, base64.StdEncoding.EncodeToString},
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(path(file.name))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", file.name, err)
+		}
+		*file.target = file.encode(data)
+	}
+
+	evidence.EKCertificates = ekCertificates(dir, logger)
+	return evidence, nil
+}
+
+// ekCertificates reads the manufacturer EK certificates as PEM. TPMs without
+// them (common for firmware TPMs) still produce a usable quote; the backend
+// then trusts the EK on first use.
+func ekCertificates(dir string, logger *logrus.Logger) []string {
+	var certificates []string
+	for _, index := range ekCertificateIndices {
+		output := filepath.Join(dir, "ekcert-"+index+".der")
+		if err := run("tpm2_nvread", "-C", "o", "-o", output, index); err != nil {
+			logger.WithError(err).WithField("index", index).Debug("No EK certificate at NV index")
+			continue
+		}
+
+		data, err := os.ReadFile(output)
+		if err != nil {
+			continue
+		}
+
+		// NV indices are often padded past the end of the DER certificate
+		var certificate asn1.RawValue
+		if _, err := asn1.Unmarshal(data, &certificate); err != nil {
+			logger.WithError(err).WithField("index", index).Warn("EK certificate NV index does not hold a certificate")
+			continue
+		}
+		certificates = append(certificates, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.FullBytes})))
+	}
+	return certificates
+}
+
+func run(name string, args ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s failed: %w: %s", name, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package attestation
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+
+	"github.com/go-jose/go-jose/v3"
+)
+
+func TestQualifyingData(t *testing.T) {
+	private, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwk := publicJWK(t, private)
+	jwk["kid"] = "ignored by the thumbprint"
+
+	first, err := QualifyingData(jwk, "2026-03-01T09:00:00Z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first) != 32 {
+		t.Fatalf("qualifying data of %d bytes, want a SHA-256", len(first))
+	}
+
+	again, err := QualifyingData(jwk, "2026-03-01T09:00:00Z")
+	if err != nil || !bytes.Equal(first, again) {
+		t.Errorf("the backend would compute %x (%v), not %x", again, err, first)
+	}
+
+	later, err := QualifyingData(jwk, "2026-03-01T09:00:01Z")
+	if err != nil || bytes.Equal(first, later) {
+		t.Errorf("another request timestamp gives the same qualifying data (%v)", err)
+	}
+
+	other, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := QualifyingData(publicJWK(t, other), "2026-03-01T09:00:00Z"); err != nil || bytes.Equal(first, data) {
+		t.Errorf("another key gives the same qualifying data (%v)", err)
+	}
+
+	// The kid is not part of the thumbprint
+	without := map[string]string{}
+	for key, value := range jwk {
+		if key != "kid" {
+			without[key] = value
+		}
+	}
+	if data, err := QualifyingData(without, "2026-03-01T09:00:00Z"); err != nil || !bytes.Equal(first, data) {
+		t.Errorf("qualifying data depends on kid (%v)", err)
+	}
+}
+
+func TestQualifyingDataRejectsInvalidKey(t *testing.T) {
+	if _, err := QualifyingData(map[string]string{"kty": "EC"}, "2026-03-01T09:00:00Z"); err == nil {
+		t.Error("QualifyingData accepted a JWK without key material")
+	}
+}
+
+func TestValidMode(t *testing.T) {
+	for _, mode := range []string{ModeAuto, ModeRequired, ModeOff} {
+		if !ValidMode(mode) {
+			t.Errorf("ValidMode(%q) = false", mode)
+		}
+	}
+	if ValidMode("on") {
+		t.Error(`ValidMode("on") = true`)
+	}
+}
+
+// publicJWK returns the public half of key the way registration sends it
+func publicJWK(t *testing.T, key *ecdsa.PrivateKey) map[string]string {
+	t.Helper()
+	data, err := json.Marshal(jose.JSONWebKey{Key: &key.PublicKey, Algorithm: "ES384"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwk := map[string]string{}
+	if err := json.Unmarshal(data, &jwk); err != nil {
+		t.Fatal(err)
+	}
+	return jwk
+}
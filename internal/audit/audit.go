@@ -0,0 +1,240 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"p0-ssh-agent/internal/filelock"
+)
+
+// FileName is the audit log inside the agent state directory
+const FileName = "audit.log"
+
+// genesisHash is the previous hash of the first entry in a log
+const genesisHash = "0000000000000000000000000000000000000000000000000000000000000000"
+
+// Path returns the audit log path for a state directory
+func Path(stateDir string) string {
+	return filepath.Join(stateDir, FileName)
+}
+
+// Origin describes what initiated a provisioning action
+type Origin struct {
+	Source  string            `json:"source"`
+	Method  string            `json:"method,omitempty"`
+	Path    string            `json:"path,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// Entry is one line of the audit log. Hash covers every other field and the
+// previous entry's hash, so removing or editing a line breaks the chain.
+type Entry struct {
+	Seq       int64             `json:"seq"`
+	Time      string            `json:"time"`
+	RequestID string            `json:"requestId"`
+	Command   string            `json:"command"`
+	UserName  string            `json:"userName"`
+	Action    string            `json:"action"`
+	DryRun    bool              `json:"dryRun,omitempty"`
+	Success   bool              `json:"success"`
+	Status    string            `json:"status,omitempty"`
+	Message   string            `json:"message,omitempty"`
+	Error     string            `json:"error,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	Origin    *Origin           `json:"origin,omitempty"`
+	PrevHash  string            `json:"prevHash"`
+	Hash      string            `json:"hash"`
+}
+
+func (e Entry) computeHash() (string, error) {
+	e.Hash = ""
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal audit entry: %w", err)
+	}
+
+	sum := sha256.Sum256(append([]byte(e.PrevHash+"\n"), data...))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Append chains entry onto the log at path and writes it as a single line.
+// The file is locked while the tail is read so concurrent writers (the agent
+// and the command CLI) cannot fork the chain.
+func Append(path string, entry Entry) (Entry, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return entry, fmt.Errorf("failed to create audit directory: %w", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return entry, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer file.Close()
+
+	if err := filelock.Lock(file); err != nil {
+		return entry, fmt.Errorf("failed to lock audit log: %w", err)
+	}
+	defer filelock.Unlock(file)
+
+	last, err := lastEntry(file)
+	if err != nil {
+		return entry, err
+	}
+
+	entry.Seq = 1
+	entry.PrevHash = genesisHash
+	if last != nil {
+		entry.Seq = last.Seq + 1
+		entry.PrevHash = last.Hash
+	}
+	if entry.Time == "" {
+		entry.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	}
+
+	entry.Hash, err = entry.computeHash()
+	if err != nil {
+		return entry, err
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return entry, fmt.Errorf("failed to marshal audit entry: %w", err)
+	}
+
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return entry, fmt.Errorf("failed to write audit log: %w", err)
+	}
+
+	return entry, nil
+}
+
+// Head returns the newest entry of the log at path, or nil when the log is
+// missing or empty. The agent reports it in every heartbeat, so the backend
+// holds an anchor for the chain that truncating the log cannot move.
+func Head(path string) (*Entry, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer file.Close()
+
+	// Appends hold the lock, so the last line is never read half written
+	if err := filelock.Lock(file); err != nil {
+		return nil, fmt.Errorf("failed to lock audit log: %w", err)
+	}
+	defer filelock.Unlock(file)
+
+	return lastEntry(file)
+}
+
+// tailSize is how much of the file is read to find the last entry
+const tailSize = 64 * 1024
+
+func lastEntry(file *os.File) (*Entry, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat audit log: %w", err)
+	}
+	if info.Size() == 0 {
+		return nil, nil
+	}
+
+	offset := info.Size() - tailSize
+	if offset < 0 {
+		offset = 0
+	}
+
+	buf := make([]byte, info.Size()-offset)
+	if _, err := file.ReadAt(buf, offset); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to read audit log: %w", err)
+	}
+
+	lines := bytes.Split(bytes.TrimRight(buf, "\n"), []byte("\n"))
+	var entry Entry
+	if err := json.Unmarshal(lines[len(lines)-1], &entry); err != nil {
+		return nil, fmt.Errorf("last audit entry is unreadable, refusing to extend the chain: %w", err)
+	}
+	return &entry, nil
+}
+
+// Read returns every entry of the log in order. A missing log has no entries.
+func Read(path string) ([]Entry, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer file.Close()
+
+	var entries []Entry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return entries, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return entries, fmt.Errorf("failed to read audit log: %w", err)
+	}
+
+	return entries, nil
+}
+
+// VerifyError points at the first entry that breaks the chain
+type VerifyError struct {
+	Seq    int64
+	Line   int
+	Reason string
+}
+
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("audit log chain broken at line %d (seq %d): %s", e.Line, e.Seq, e.Reason)
+}
+
+// Verify checks sequence numbers and hashes of every entry. It returns the
+// number of verified entries and a *VerifyError for the first broken link.
+func Verify(entries []Entry) (int, error) {
+	prevHash := genesisHash
+	var prevSeq int64
+
+	for i, entry := range entries {
+		line := i + 1
+
+		if entry.Seq != prevSeq+1 {
+			return i, &VerifyError{Seq: entry.Seq, Line: line, Reason: fmt.Sprintf("expected seq %d", prevSeq+1)}
+		}
+		if entry.PrevHash != prevHash {
+			return i, &VerifyError{Seq: entry.Seq, Line: line, Reason: "previous hash does not match, an entry was removed or altered"}
+		}
+
+		hash, err := entry.computeHash()
+		if err != nil {
+			return i, err
+		}
+		if hash != entry.Hash {
+			return i, &VerifyError{Seq: entry.Seq, Line: line, Reason: "entry hash does not match its content"}
+		}
+
+		prevHash = entry.Hash
+		prevSeq = entry.Seq
+	}
+
+	return len(entries), nil
+}
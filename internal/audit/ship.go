@@ -0,0 +1,185 @@
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"p0-ssh-agent/internal/filelock"
+	"p0-ssh-agent/types"
+)
+
+// CursorFileName records, beside the audit log, the seq of the last entry
+// each sink has received
+const CursorFileName = "audit-sinks.json"
+
+// CursorPath returns the sink cursor file of the audit log at logPath
+func CursorPath(logPath string) string {
+	return filepath.Join(filepath.Dir(logPath), CursorFileName)
+}
+
+// InitCursors starts a cursor at the end of the log for every sink without
+// one, so a sink added to the configuration receives the entries appended
+// from now on rather than the whole history. Cursors of sinks no longer
+// configured are dropped.
+func InitCursors(logPath string, sinks []Sink) error {
+	if len(sinks) == 0 {
+		return nil
+	}
+	return updateCursors(logPath, func(cursors map[string]int64) error {
+		head, err := Head(logPath)
+		if err != nil {
+			return err
+		}
+		var seq int64
+		if head != nil {
+			seq = head.Seq
+		}
+
+		configured := make(map[string]bool)
+		for _, sink := range sinks {
+			configured[sink.Name()] = true
+			if _, ok := cursors[sink.Name()]; !ok {
+				cursors[sink.Name()] = seq
+			}
+		}
+		for name := range cursors {
+			if !configured[name] {
+				delete(cursors, name)
+			}
+		}
+		return nil
+	})
+}
+
+// Ship delivers the entries of the log past each sink's cursor, in order,
+// and advances the cursors, returning how many entries were delivered. A
+// sink stops at the first entry it fails to take, which is retried by the
+// next call, so entries are delivered at least once however long a sink is
+// down. Processes shipping the same log take turns.
+func Ship(logPath string, sinks []Sink) (int, error) {
+	if len(sinks) == 0 {
+		return 0, nil
+	}
+
+	delivered := 0
+	err := updateCursors(logPath, func(cursors map[string]int64) error {
+		entries, readErr := Read(logPath)
+
+		var mu sync.Mutex
+		errs := make([]error, len(sinks))
+		var wg sync.WaitGroup
+		for i, sink := range sinks {
+			cursor := cursors[sink.Name()]
+			// A log with fewer entries than the cursor was replaced
+			if len(entries) > 0 && entries[len(entries)-1].Seq < cursor {
+				cursor = 0
+			}
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				last, count, err := shipTo(sink, entries, cursor)
+
+				mu.Lock()
+				defer mu.Unlock()
+				cursors[sink.Name()] = last
+				delivered += count
+				errs[i] = err
+			}()
+		}
+		wg.Wait()
+
+		// Entries before an unreadable line are still delivered
+		return errors.Join(append(errs, readErr)...)
+	})
+	return delivered, err
+}
+
+// shipTo writes the entries after cursor that sink's filter matches and
+// returns the seq it got to and how many entries it took
+func shipTo(sink Sink, entries []Entry, cursor int64) (int64, int, error) {
+	count := 0
+	for _, entry := range entries {
+		if entry.Seq <= cursor {
+			continue
+		}
+		if filtered, ok := sink.(*filteredSink); !ok || Matches(filtered.filter, entry) {
+			if err := write(sink, entry); err != nil {
+				return cursor, count, fmt.Errorf("seq %d: %w", entry.Seq, err)
+			}
+			count++
+		}
+		cursor = entry.Seq
+	}
+	return cursor, count, nil
+}
+
+// write delivers entry to sink, giving up after the sink's timeout. A write
+// that times out is left to complete on its own and retried, so the sink may
+// receive the entry twice.
+func write(sink Sink, entry Entry) error {
+	timeout := time.Duration(types.DefaultAuditSinkTimeoutSeconds) * time.Second
+	if filtered, ok := sink.(*filteredSink); ok {
+		timeout = filtered.timeout
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- sink.Write(entry) }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("%s: %w", sink.Name(), err)
+		}
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("%s: no response within %s", sink.Name(), timeout)
+	}
+}
+
+// updateCursors runs change on the cursors of the log at logPath while
+// holding their lock and saves them, also when change fails partway
+func updateCursors(logPath string, change func(map[string]int64) error) error {
+	path := CursorPath(logPath)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create audit directory: %w", err)
+	}
+
+	release, err := filelock.Acquire(path + ".lock")
+	if err != nil {
+		return fmt.Errorf("failed to lock audit sink cursors: %w", err)
+	}
+	defer release()
+
+	cursors := make(map[string]int64)
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read audit sink cursors: %w", err)
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &cursors); err != nil {
+			return fmt.Errorf("failed to parse audit sink cursors: %w", err)
+		}
+	}
+
+	changeErr := change(cursors)
+
+	data, err = json.MarshalIndent(cursors, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode audit sink cursors: %w", err)
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to write audit sink cursors: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to save audit sink cursors: %w", err)
+	}
+	return changeErr
+}
@@ -0,0 +1,130 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"p0-ssh-agent/internal/filelock"
+	"p0-ssh-agent/types"
+)
+
+// Sink is a destination that receives a copy of appended audit entries
+type Sink interface {
+	// Name identifies the sink in logs
+	Name() string
+
+	// Write delivers one entry. Ship stops waiting for it after the sink's
+	// timeout.
+	Write(entry Entry) error
+}
+
+// filteredSink passes on the entries its filter matches
+type filteredSink struct {
+	Sink
+	filter  types.AuditSinkFilter
+	timeout time.Duration
+}
+
+// NewSinks builds the configured sinks. hostID names this host in object
+// keys of s3 sinks.
+func NewSinks(configs []types.AuditSink, hostID string) ([]Sink, error) {
+	var sinks []Sink
+	for i, config := range configs {
+		var sink Sink
+		var err error
+
+		switch config.Type {
+		case types.AuditSinkFile:
+			sink = &fileSink{path: config.Path}
+		case types.AuditSinkSyslog:
+			sink, err = newSyslogSink(config)
+		case types.AuditSinkHTTP:
+			sink = newHTTPSink(config)
+		case types.AuditSinkS3:
+			sink = newS3Sink(config, hostID)
+		default:
+			err = fmt.Errorf("unknown sink type %q", config.Type)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("auditSinks[%d]: %w", i, err)
+		}
+
+		sinks = append(sinks, &filteredSink{Sink: sink, filter: config.Filter, timeout: config.GetTimeout()})
+	}
+	return sinks, nil
+}
+
+// Matches reports whether entry passes filter
+func Matches(filter types.AuditSinkFilter, entry Entry) bool {
+	if filter.SkipDryRun && entry.DryRun {
+		return false
+	}
+
+	switch filter.Outcome {
+	case types.AuditOutcomeSuccess:
+		if !entry.Success {
+			return false
+		}
+	case types.AuditOutcomeFailure:
+		if entry.Success {
+			return false
+		}
+	}
+
+	source := ""
+	if entry.Origin != nil {
+		source = entry.Origin.Source
+	}
+	return matchesAny(filter.Commands, entry.Command) &&
+		matchesAny(filter.Actions, entry.Action) &&
+		matchesAny(filter.Sources, source)
+}
+
+func matchesAny(allowed []string, value string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, candidate := range allowed {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+// fileSink appends entries as JSON lines to a further file, e.g. one a log
+// shipper tails
+type fileSink struct {
+	path string
+}
+
+func (s *fileSink) Name() string {
+	return "file " + s.path
+}
+
+func (s *fileSink) Write(entry Entry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit entry: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := filelock.Lock(file); err != nil {
+		return fmt.Errorf("failed to lock: %w", err)
+	}
+	defer filelock.Unlock(file)
+
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
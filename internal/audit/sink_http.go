@@ -0,0 +1,60 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"p0-ssh-agent/types"
+)
+
+// httpSink posts each entry as a JSON object to a collector
+type httpSink struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+func newHTTPSink(config types.AuditSink) *httpSink {
+	return &httpSink{
+		url:     config.URL,
+		headers: config.Headers,
+		client:  &http.Client{Timeout: config.GetTimeout()},
+	}
+}
+
+func (s *httpSink) Name() string {
+	return "http " + s.url
+}
+
+func (s *httpSink) Write(entry Entry) error {
+	body, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit entry: %w", err)
+	}
+
+	request, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for name, value := range s.headers {
+		// Keeps tokens out of the configuration file
+		request.Header.Set(name, os.ExpandEnv(value))
+	}
+
+	resp, err := s.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
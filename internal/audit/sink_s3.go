@@ -0,0 +1,118 @@
+package audit
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"p0-ssh-agent/internal/awsv4"
+	"p0-ssh-agent/types"
+)
+
+// s3Sink stores every entry as its own object, named
+// <prefix><hostId>/<yyyy>/<mm>/<dd>/<seq>-<hash>.json. Objects are never
+// rewritten, so a bucket with Object Lock in compliance mode keeps the trail
+// immutable even from the host.
+type s3Sink struct {
+	bucket   string
+	region   string
+	prefix   string
+	endpoint string
+	hostID   string
+	client   *http.Client
+}
+
+func newS3Sink(config types.AuditSink, hostID string) *s3Sink {
+	return &s3Sink{
+		bucket:   config.Bucket,
+		region:   config.Region,
+		prefix:   config.Prefix,
+		endpoint: strings.TrimRight(config.Endpoint, "/"),
+		hostID:   hostID,
+		client:   &http.Client{Timeout: config.GetTimeout()},
+	}
+}
+
+func (s *s3Sink) Name() string {
+	return "s3://" + s.bucket + "/" + s.prefix
+}
+
+// objectKey names the object of entry. The hash keeps keys unique should the
+// local log ever be started afresh.
+func (s *s3Sink) objectKey(entry Entry) string {
+	day := time.Now().UTC()
+	if t, err := time.Parse(time.RFC3339Nano, entry.Time); err == nil {
+		day = t.UTC()
+	}
+	hash := entry.Hash
+	if len(hash) > 16 {
+		hash = hash[:16]
+	}
+	return fmt.Sprintf("%s%s/%s/%010d-%s.json", s.prefix, s.hostID, day.Format("2006/01/02"), entry.Seq, hash)
+}
+
+// objectURL uses virtual-hosted addressing on AWS and path addressing on a
+// custom endpoint, which S3-compatible services support more widely
+func (s *s3Sink) objectURL(key string) (*url.URL, error) {
+	escaped := (&url.URL{Path: "/" + key}).EscapedPath()
+	if s.endpoint != "" {
+		return url.Parse(s.endpoint + "/" + s.bucket + escaped)
+	}
+	return url.Parse(fmt.Sprintf("https://%s.s3.%s.amazonaws.com%s", s.bucket, s.region, escaped))
+}
+
+func (s *s3Sink) Write(entry Entry) error {
+	accessKey, secretKey := os.Getenv(awsv4.AccessKeyIDEnv), os.Getenv(awsv4.SecretAccessKeyEnv)
+	if accessKey == "" || secretKey == "" {
+		return fmt.Errorf("%s and %s must be set in the agent's environment", awsv4.AccessKeyIDEnv, awsv4.SecretAccessKeyEnv)
+	}
+
+	body, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit entry: %w", err)
+	}
+
+	target, err := s.objectURL(s.objectKey(entry))
+	if err != nil {
+		return fmt.Errorf("invalid object URL: %w", err)
+	}
+	request, err := http.NewRequest(http.MethodPut, target.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	// Buckets with Object Lock refuse uploads without an integrity header
+	digest := md5.Sum(body)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(digest[:]))
+	// Never replace an object that already exists
+	request.Header.Set("If-None-Match", "*")
+	if token := os.Getenv(awsv4.SessionTokenEnv); token != "" {
+		request.Header.Set("X-Amz-Security-Token", token)
+	}
+	awsv4.Sign(request, body, accessKey, secretKey, s.region, "s3", time.Now().UTC())
+
+	resp, err := s.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	detail, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+
+	// The object was stored by an earlier attempt
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		return nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("bucket returned %s: %s", resp.Status, strings.TrimSpace(string(detail)))
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+//go:build !windows && !plan9
+
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/syslog"
+	"sync"
+
+	"p0-ssh-agent/types"
+)
+
+// syslogTag is the tag of syslog messages unless the sink sets one
+const syslogTag = "p0-ssh-agent"
+
+// syslogSink sends each entry as a JSON message with facility authpriv,
+// at warning severity for failed actions and info otherwise
+type syslogSink struct {
+	network string
+	address string
+	tag     string
+
+	mu     sync.Mutex
+	writer *syslog.Writer
+}
+
+func newSyslogSink(config types.AuditSink) (Sink, error) {
+	tag := config.Tag
+	if tag == "" {
+		tag = syslogTag
+	}
+	return &syslogSink{network: config.Network, address: config.Address, tag: tag}, nil
+}
+
+func (s *syslogSink) Name() string {
+	if s.address == "" {
+		return "syslog"
+	}
+	return "syslog " + s.network + "://" + s.address
+}
+
+func (s *syslogSink) Write(entry Entry) error {
+	message, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit entry: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Dialed on first use so an agent starting before the syslog daemon
+	// still delivers once it is up; the writer reconnects by itself
+	if s.writer == nil {
+		writer, err := syslog.Dial(s.network, s.address, syslog.LOG_AUTHPRIV|syslog.LOG_INFO, s.tag)
+		if err != nil {
+			return err
+		}
+		s.writer = writer
+	}
+
+	if entry.Success {
+		return s.writer.Info(string(message))
+	}
+	return s.writer.Warning(string(message))
+}
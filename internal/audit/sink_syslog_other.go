@@ -0,0 +1,14 @@
+//go:build windows || plan9
+
+package audit
+
+import (
+	"fmt"
+	"runtime"
+
+	"p0-ssh-agent/types"
+)
+
+func newSyslogSink(config types.AuditSink) (Sink, error) {
+	return nil, fmt.Errorf("syslog sinks are not supported on %s", runtime.GOOS)
+}
@@ -1,62 +1,154 @@
 package backoff
 
 import (
+	"errors"
 	"fmt"
 	"math"
 	"math/rand"
 	"time"
 )
 
+// Jitter spreads the delays of clients that failed at the same time, such as
+// every agent when the backend restarts, so they do not retry in step
+type Jitter string
+
+const (
+	// JitterFull waits a random time up to the delay, spreading retries the most
+	JitterFull Jitter = "full"
+
+	// JitterEqual waits half the delay plus a random time up to the other half
+	JitterEqual Jitter = "equal"
+
+	// JitterNone waits the delay itself
+	JitterNone Jitter = "none"
+)
+
+// ErrExhausted is returned by Exhausted once the policy allows no more attempts
+var ErrExhausted = errors.New("retries exhausted")
+
+// Policy configures a Backoff. Zero MaxAttempts and MaxElapsed retry
+// indefinitely; zero ResetAfter starts over at the first success.
+type Policy struct {
+	Start  time.Duration
+	Max    time.Duration
+	Jitter Jitter
+
+	// MaxAttempts bounds consecutive failed attempts and MaxElapsed the time
+	// since the first of them
+	MaxAttempts int
+	MaxElapsed  time.Duration
+
+	// ResetAfter is how long a success must last before the delays start
+	// over, so a connection that fails right after it is made keeps backing
+	// off instead of retrying at the start delay
+	ResetAfter time.Duration
+}
+
 type Backoff struct {
 	startDuration time.Duration
 	maxDuration   time.Duration
 	count         int
+
+	policy       Policy
+	failingSince time.Time
+	succeededAt  time.Time
 }
 
+// New returns a backoff with full jitter that retries indefinitely
 func New(startDuration, maxDuration time.Duration) (*Backoff, error) {
+	return NewPolicy(Policy{Start: startDuration, Max: maxDuration, Jitter: JitterFull})
+}
+
+// NewPolicy returns a backoff following policy
+func NewPolicy(policy Policy) (*Backoff, error) {
+	startDuration, maxDuration := policy.Start, policy.Max
 	if startDuration <= 0 {
 		return nil, fmt.Errorf("startDuration must be greater than 0")
 	}
 	if maxDuration < startDuration {
 		return nil, fmt.Errorf("maxDuration must be greater than or equal to startDuration")
 	}
-	
+	switch policy.Jitter {
+	case "":
+		policy.Jitter = JitterFull
+	case JitterFull, JitterEqual, JitterNone:
+	default:
+		return nil, fmt.Errorf("unknown jitter %q", policy.Jitter)
+	}
+
 	return &Backoff{
 		startDuration: startDuration,
 		maxDuration:   maxDuration,
 		count:         0,
+		policy:        policy,
 	}, nil
 }
 
+// Next counts a failed attempt and returns the delay before the next one:
+// the start delay doubled for every consecutive failure, capped at the
+// maximum, with the policy's jitter applied
 func (b *Backoff) Next() time.Duration {
+	now := time.Now()
+	if !b.succeededAt.IsZero() {
+		if now.Sub(b.succeededAt) >= b.policy.ResetAfter {
+			b.Reset()
+		}
+		b.succeededAt = time.Time{}
+	}
+	if b.count == 0 {
+		b.failingSince = now
+	}
 	b.count++
-	
-	duration := time.Duration(float64(b.startDuration) * math.Pow(2, float64(b.count-1)))
-	
-	if duration > b.maxDuration {
-		duration = b.maxDuration
-	}
-	
-	// Add jitter: ±25% of the duration to prevent thundering herd
-	jitterRange := float64(duration) * 0.25
-	jitter := time.Duration(rand.Float64()*jitterRange*2 - jitterRange)
-	duration += jitter
-	
-	// Ensure we don't go below 0 or above maxDuration
-	if duration < 0 {
-		duration = b.startDuration
-	}
-	if duration > b.maxDuration {
-		duration = b.maxDuration
-	}
-	
+
+	// Compared as floats, as the doubling overflows a Duration long before
+	// the count stops growing
+	duration := b.maxDuration
+	if exp := float64(b.startDuration) * math.Pow(2, float64(b.count-1)); exp < float64(b.maxDuration) {
+		duration = time.Duration(exp)
+	}
+
+	switch b.policy.Jitter {
+	case JitterFull:
+		duration = time.Duration(rand.Int63n(int64(duration) + 1))
+	case JitterEqual:
+		duration = duration/2 + time.Duration(rand.Int63n(int64(duration/2)+1))
+	}
+
 	return duration
 }
 
+// Succeeded records a successful attempt. The delays start over at the next
+// failure if the success lasted ResetAfter by then.
+func (b *Backoff) Succeeded() {
+	b.succeededAt = time.Now()
+}
+
+// Exhausted returns ErrExhausted, with the attempts made, once the failures
+// counted by Next reach MaxAttempts or have gone on for MaxElapsed
+func (b *Backoff) Exhausted() error {
+	if b.policy.MaxAttempts > 0 && b.count >= b.policy.MaxAttempts {
+		return fmt.Errorf("%w: %d consecutive attempts failed", ErrExhausted, b.count)
+	}
+	if b.policy.MaxElapsed > 0 && b.count > 0 && time.Since(b.failingSince) >= b.policy.MaxElapsed {
+		return fmt.Errorf("%w: attempts failed for %s", ErrExhausted, time.Since(b.failingSince).Round(time.Second))
+	}
+	return nil
+}
+
+// FailingSince returns when the current run of failures began, or the zero
+// time when there is none
+func (b *Backoff) FailingSince() time.Time {
+	if b.count == 0 {
+		return time.Time{}
+	}
+	return b.failingSince
+}
+
 func (b *Backoff) Reset() {
 	b.count = 0
+	b.failingSince = time.Time{}
 }
 
 func (b *Backoff) Count() int {
 	return b.count
-}
\ No newline at end of file
+}
@@ -0,0 +1,278 @@
+package backup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/internal/audit"
+	"p0-ssh-agent/internal/bundle"
+	"p0-ssh-agent/internal/filebackup"
+	"p0-ssh-agent/scripts"
+	"p0-ssh-agent/types"
+)
+
+const (
+	manifestEntry   = "manifest.json"
+	manifestVersion = 1
+)
+
+// Manifest records where each archived file came from so restore can put it back
+type Manifest struct {
+	Version   int            `json:"version"`
+	CreatedAt string         `json:"createdAt"`
+	Hostname  string         `json:"hostname"`
+	ClientID  string         `json:"clientId"`
+	Files     []ManifestFile `json:"files"`
+}
+
+type ManifestFile struct {
+	Name string      `json:"name"`
+	Path string      `json:"path"`
+	Mode os.FileMode `json:"mode"`
+}
+
+// Create archives the config file, JWT keys, trusted CA and state directory.
+// A file too large for an archive entry fails the backup rather than the
+// restore.
+func Create(cfg *types.Config, configPath string, logger *logrus.Logger) ([]byte, error) {
+	hostname, _ := os.Hostname()
+	manifest := Manifest{
+		Version:   manifestVersion,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+		Hostname:  hostname,
+		ClientID:  cfg.GetClientID(),
+	}
+
+	var entries []bundle.Entry
+
+	addFile := func(name, filePath string) error {
+		info, err := os.Stat(filePath)
+		if err != nil {
+			return fmt.Errorf("cannot access %s: %w", filePath, err)
+		}
+
+		// A larger entry would be refused when restore reads the archive back
+		if info.Size() > bundle.MaxEntrySize {
+			return fmt.Errorf("%s is %d bytes, more than the %d a backup entry may hold", filePath, info.Size(), bundle.MaxEntrySize)
+		}
+
+		data, err := os.ReadFile(filePath)
+		if err != nil {
+			return fmt.Errorf("cannot read %s: %w (try running with sudo)", filePath, err)
+		}
+
+		logger.WithFields(logrus.Fields{
+			"name": name,
+			"path": filePath,
+			"size": len(data),
+		}).Debug("Adding file to backup")
+
+		entries = append(entries, bundle.Entry{Name: name, Mode: info.Mode().Perm(), Data: data})
+		manifest.Files = append(manifest.Files, ManifestFile{Name: name, Path: filePath, Mode: info.Mode().Perm()})
+		return nil
+	}
+
+	if err := addFile("config/"+filepath.Base(configPath), configPath); err != nil {
+		return nil, err
+	}
+
+	if err := addDirectory("keys", cfg.GetKeyDir(), nil, addFile); err != nil {
+		return nil, err
+	}
+
+	if _, err := os.Stat(scripts.TrustedCAPath); err == nil {
+		if err := addFile("ca/"+filepath.Base(scripts.TrustedCAPath), scripts.TrustedCAPath); err != nil {
+			return nil, err
+		}
+	}
+
+	// The audit log, the copies of managed files and a recording spool kept
+	// in the state directory grow with the host's age and are not needed to
+	// restore it
+	skip := []string{audit.Path(cfg.StateDir), filebackup.Dir(cfg.StateDir)}
+	if recording := cfg.GetSessionRecording(); recording != nil {
+		skip = append(skip, recording.GetSpoolDir())
+	}
+
+	if _, err := os.Stat(cfg.StateDir); err == nil {
+		if err := addDirectory("state", cfg.StateDir, skip, addFile); err != nil {
+			return nil, err
+		}
+	} else {
+		logger.WithField("path", cfg.StateDir).Debug("State directory not present, skipping")
+	}
+
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal manifest: %w", err)
+	}
+	entries = append([]bundle.Entry{{Name: manifestEntry, Mode: 0600, Data: manifestData}}, entries...)
+
+	var buf bytes.Buffer
+	if err := bundle.Write(&buf, entries); err != nil {
+		return nil, err
+	}
+
+	logger.WithField("files", len(manifest.Files)).Info("📦 Backup archive created")
+	return buf.Bytes(), nil
+}
+
+// Destinations are where Restore may install files, resolved from the
+// configuration of the host restored to rather than from the archive
+type Destinations struct {
+	ConfigPath string
+	KeyDir     string
+	CAPath     string
+	StateDir   string
+}
+
+// DestinationsOf returns the destinations of cfg loaded from configPath
+func DestinationsOf(cfg *types.Config, configPath string) Destinations {
+	return Destinations{
+		ConfigPath: configPath,
+		KeyDir:     cfg.GetKeyDir(),
+		CAPath:     scripts.TrustedCAPath,
+		StateDir:   cfg.StateDir,
+	}
+}
+
+// allows reports whether a file may be restored to path: the config file or
+// the trusted CA themselves, or a file inside the key or state directory
+func (d Destinations) allows(path string) bool {
+	path = filepath.Clean(path)
+	if path == filepath.Clean(d.ConfigPath) || path == filepath.Clean(d.CAPath) {
+		return true
+	}
+	for _, dir := range []string{d.KeyDir, d.StateDir} {
+		if dir == "" {
+			continue
+		}
+		rel, err := filepath.Rel(filepath.Clean(dir), path)
+		if err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Restore reinstalls archived files at their original paths. Every path must
+// be one of destinations; an archive naming any other path, as a tampered or
+// foreign one may, is refused before anything is written. Existing files with
+// different content are only replaced when force is set, since overwriting
+// keys changes the host identity.
+func Restore(archive []byte, destinations Destinations, force bool, logger *logrus.Logger) (*Manifest, error) {
+	entries, err := bundle.Read(bytes.NewReader(archive))
+	if err != nil {
+		return nil, err
+	}
+
+	manifestData, ok := bundle.Find(entries, manifestEntry)
+	if !ok {
+		return nil, fmt.Errorf("backup archive has no %s", manifestEntry)
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(manifestData.Data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+
+	if manifest.Version != manifestVersion {
+		return nil, fmt.Errorf("unsupported backup version %d", manifest.Version)
+	}
+
+	var conflicts []string
+	for _, file := range manifest.Files {
+		entry, ok := bundle.Find(entries, file.Name)
+		if !ok {
+			return nil, fmt.Errorf("manifest references missing entry %s", file.Name)
+		}
+
+		if !filepath.IsAbs(file.Path) {
+			return nil, fmt.Errorf("manifest path %q for %s is not absolute", file.Path, file.Name)
+		}
+		if !destinations.allows(file.Path) {
+			return nil, fmt.Errorf("manifest path %q for %s is not the config file, trusted CA, key directory or state directory of this host", file.Path, file.Name)
+		}
+
+		if existing, err := os.ReadFile(file.Path); err == nil && !bytes.Equal(existing, entry.Data) {
+			conflicts = append(conflicts, file.Path)
+		}
+	}
+
+	if len(conflicts) > 0 && !force {
+		return nil, fmt.Errorf("restore would overwrite existing files with different content: %v (use --force to replace them)", conflicts)
+	}
+
+	for _, file := range manifest.Files {
+		entry, _ := bundle.Find(entries, file.Name)
+		if err := bundle.Install(entry, file.Path, file.Mode.Perm(), logger); err != nil {
+			return nil, err
+		}
+	}
+
+	return &manifest, nil
+}
+
+// addDirectory adds the regular files under dir, leaving out the files and
+// directories in skip
+func addDirectory(prefix, dir string, skip []string, addFile func(name, filePath string) error) error {
+	return filepath.WalkDir(dir, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return fmt.Errorf("cannot read %s: %w (try running with sudo)", filePath, err)
+		}
+
+		for _, skipped := range skip {
+			if filepath.Clean(filePath) != filepath.Clean(skipped) {
+				continue
+			}
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, filePath)
+		if err != nil {
+			return err
+		}
+
+		return addFile(path.Join(prefix, filepath.ToSlash(rel)), filePath)
+	})
+}
+
+// PassphraseEnv is consulted when no passphrase file is given
+const PassphraseEnv = "P0_SSH_AGENT_BACKUP_PASSPHRASE"
+
+// ReadPassphrase loads the archive passphrase from a file or the environment
+func ReadPassphrase(passphraseFile string) (string, error) {
+	if passphraseFile != "" {
+		data, err := os.ReadFile(passphraseFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read passphrase file: %w", err)
+		}
+		passphrase := string(bytes.TrimRight(data, "\r\n"))
+		if passphrase == "" {
+			return "", fmt.Errorf("passphrase file %s is empty", passphraseFile)
+		}
+		return passphrase, nil
+	}
+
+	if passphrase := os.Getenv(PassphraseEnv); passphrase != "" {
+		return passphrase, nil
+	}
+
+	return "", fmt.Errorf("no passphrase provided: use --passphrase-file or set %s", PassphraseEnv)
+}
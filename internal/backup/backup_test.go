@@ -0,0 +1,209 @@
+package backup
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/internal/audit"
+	"p0-ssh-agent/internal/bundle"
+	"p0-ssh-agent/internal/filebackup"
+	"p0-ssh-agent/types"
+)
+
+// archive builds a backup whose manifest restores each entry to its path
+func archive(t *testing.T, paths map[string]string) []byte {
+	t.Helper()
+	manifest := Manifest{Version: manifestVersion}
+	var entries []bundle.Entry
+	for name, path := range paths {
+		entries = append(entries, bundle.Entry{Name: name, Mode: 0600, Data: []byte("restored " + name)})
+		manifest.Files = append(manifest.Files, ManifestFile{Name: name, Path: path, Mode: 0600})
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries = append([]bundle.Entry{{Name: manifestEntry, Mode: 0600, Data: data}}, entries...)
+
+	var buf bytes.Buffer
+	if err := bundle.Write(&buf, entries); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestRestorePaths(t *testing.T) {
+	tests := []struct {
+		name string
+		// paths maps archive entries to where the manifest restores them
+		paths   func(destinations Destinations) map[string]string
+		wantErr string
+	}{
+		{
+			name: "config, CA, keys and state",
+			paths: func(destinations Destinations) map[string]string {
+				return map[string]string{
+					"config/config.yaml":    destinations.ConfigPath,
+					"ca/ca.pem":             destinations.CAPath,
+					"keys/jwk.private.json": filepath.Join(destinations.KeyDir, "jwk.private.json"),
+					"state/grants/a.json":   filepath.Join(destinations.StateDir, "grants", "a.json"),
+				}
+			},
+		},
+		{
+			name: "system file",
+			paths: func(destinations Destinations) map[string]string {
+				return map[string]string{"keys/jwk.private.json": "/etc/shadow"}
+			},
+			wantErr: `"/etc/shadow"`,
+		},
+		{
+			name: "system file among the host's files",
+			paths: func(destinations Destinations) map[string]string {
+				return map[string]string{
+					"config/config.yaml": destinations.ConfigPath,
+					"state/sudoers":      "/etc/sudoers",
+				}
+			},
+			wantErr: `"/etc/sudoers"`,
+		},
+		{
+			name: "escape from the state directory",
+			paths: func(destinations Destinations) map[string]string {
+				return map[string]string{"state/x": filepath.Join(destinations.StateDir, "..", "etc", "sudoers")}
+			},
+			wantErr: "is not the config file",
+		},
+		{
+			name: "the key directory itself",
+			paths: func(destinations Destinations) map[string]string {
+				return map[string]string{"keys/x": destinations.KeyDir}
+			},
+			wantErr: "is not the config file",
+		},
+		{
+			name: "sibling with the state directory as prefix",
+			paths: func(destinations Destinations) map[string]string {
+				return map[string]string{"state/x": destinations.StateDir + "-other/x"}
+			},
+			wantErr: "is not the config file",
+		},
+		{
+			name: "relative path",
+			paths: func(destinations Destinations) map[string]string {
+				return map[string]string{"state/x": "state/x"}
+			},
+			wantErr: "is not absolute",
+		},
+	}
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.wantErr == "" && os.Geteuid() != 0 {
+				t.Skip("restored files are owned by root")
+			}
+
+			dir := t.TempDir()
+			destinations := Destinations{
+				ConfigPath: filepath.Join(dir, "etc", "config.yaml"),
+				KeyDir:     filepath.Join(dir, "etc", "keys"),
+				CAPath:     filepath.Join(dir, "etc", "ca.pem"),
+				StateDir:   filepath.Join(dir, "state"),
+			}
+			paths := tt.paths(destinations)
+
+			_, err := Restore(archive(t, paths), destinations, false, logger)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Restore error = %v, want one containing %q", err, tt.wantErr)
+				}
+				// Nothing is written when any path is refused
+				if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+					t.Errorf("Restore wrote %v", entries)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Restore: %v", err)
+			}
+			for name, path := range paths {
+				if data, err := os.ReadFile(path); err != nil || string(data) != "restored "+name {
+					t.Errorf("%s = %q (%v), want the archived %s", path, data, err, name)
+				}
+			}
+		})
+	}
+}
+
+func TestCreateStateDir(t *testing.T) {
+	dir := t.TempDir()
+	cfg := types.DefaultConfig()
+	cfg.KeyPath = filepath.Join(dir, "keys")
+	cfg.StateDir = filepath.Join(dir, "state")
+	configPath := filepath.Join(dir, "config.yaml")
+
+	overLimit := bytes.Repeat([]byte("x"), bundle.MaxEntrySize+1)
+	write := func(path string, data []byte) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(configPath, []byte("orgId: org\n"))
+	write(filepath.Join(cfg.KeyPath, "jwk.private.json"), []byte("{}"))
+	write(filepath.Join(cfg.StateDir, "grants.json"), []byte("[]"))
+	write(audit.Path(cfg.StateDir), overLimit)
+	write(filepath.Join(filebackup.Dir(cfg.StateDir), "sudoers", "copy"), overLimit)
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	archived, err := Create(cfg, configPath, logger)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	entries, err := bundle.Read(bytes.NewReader(archived))
+	if err != nil {
+		t.Fatalf("the backup cannot be read back: %v", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name)
+	}
+	for _, name := range []string{"config/config.yaml", "keys/jwk.private.json", "state/grants.json"} {
+		if _, ok := bundle.Find(entries, name); !ok {
+			t.Errorf("backup %v has no %s", names, name)
+		}
+	}
+	for _, name := range []string{"state/" + audit.FileName, "state/" + filebackup.DirName + "/sudoers/copy"} {
+		if _, ok := bundle.Find(entries, name); ok {
+			t.Errorf("backup holds %s", name)
+		}
+	}
+
+	if os.Geteuid() == 0 {
+		if _, err := Restore(archived, DestinationsOf(cfg, configPath), false, logger); err != nil {
+			t.Errorf("Restore: %v", err)
+		}
+	}
+
+	// Any other file too large fails the backup, not the restore
+	write(filepath.Join(cfg.StateDir, "provisioning.json"), overLimit)
+	if _, err := Create(cfg, configPath, logger); err == nil || !strings.Contains(err.Error(), "provisioning.json") {
+		t.Errorf("Create error = %v, want one naming provisioning.json", err)
+	}
+}
@@ -0,0 +1,144 @@
+package bundle
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// MaxEntrySize caps the size of a single archive entry to guard against
+// decompression bombs in operator-provided bundles
+const MaxEntrySize = 16 * 1024 * 1024
+
+// Entry describes a single file stored in a bundle archive
+type Entry struct {
+	Name string
+	Mode os.FileMode
+	Data []byte
+}
+
+// Write serializes the given entries into a tar stream
+func Write(w io.Writer, entries []Entry) error {
+	tw := tar.NewWriter(w)
+
+	for _, entry := range entries {
+		header := &tar.Header{
+			Name:     entry.Name,
+			Mode:     int64(entry.Mode.Perm()),
+			Size:     int64(len(entry.Data)),
+			Typeflag: tar.TypeReg,
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			return fmt.Errorf("failed to write header for %s: %w", entry.Name, err)
+		}
+
+		if _, err := tw.Write(entry.Data); err != nil {
+			return fmt.Errorf("failed to write data for %s: %w", entry.Name, err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to finalize archive: %w", err)
+	}
+
+	return nil
+}
+
+// Read parses a tar stream into memory, rejecting anything other than
+// regular files with clean relative names
+func Read(r io.Reader) ([]Entry, error) {
+	tr := tar.NewReader(r)
+
+	var entries []Entry
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read archive: %w", err)
+		}
+
+		if header.Typeflag == tar.TypeDir {
+			continue
+		}
+
+		if header.Typeflag != tar.TypeReg {
+			return nil, fmt.Errorf("unsupported entry type for %s: only regular files are allowed", header.Name)
+		}
+
+		name, err := cleanName(header.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		if header.Size > MaxEntrySize {
+			return nil, fmt.Errorf("entry %s exceeds maximum size of %d bytes", name, MaxEntrySize)
+		}
+
+		data, err := io.ReadAll(io.LimitReader(tr, MaxEntrySize+1))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read entry %s: %w", name, err)
+		}
+
+		entries = append(entries, Entry{
+			Name: name,
+			Mode: os.FileMode(header.Mode).Perm(),
+			Data: data,
+		})
+	}
+
+	return entries, nil
+}
+
+// ReadFile opens and parses a tar archive from disk
+func ReadFile(archivePath string) ([]Entry, error) {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive %s: %w", archivePath, err)
+	}
+	defer file.Close()
+
+	return Read(file)
+}
+
+// Find returns the entry with the given name, if present
+func Find(entries []Entry, name string) (Entry, bool) {
+	for _, entry := range entries {
+		if entry.Name == name {
+			return entry, true
+		}
+	}
+	return Entry{}, false
+}
+
+// WriteTemp stores entry data in a private temporary file so it can be
+// installed into a privileged location with sudo
+func WriteTemp(entry Entry) (string, error) {
+	tmpFile, err := os.CreateTemp("", "p0-bundle-*-"+filepath.Base(entry.Name))
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary file: %w", err)
+	}
+
+	if _, err := tmpFile.Write(entry.Data); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+		return "", fmt.Errorf("failed to write temporary file: %w", err)
+	}
+	tmpFile.Close()
+
+	return tmpFile.Name(), nil
+}
+
+func cleanName(name string) (string, error) {
+	cleaned := path.Clean(strings.TrimPrefix(name, "./"))
+	if cleaned == "." || path.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("invalid entry name %q in archive", name)
+	}
+	return cleaned, nil
+}
@@ -0,0 +1,86 @@
+package bundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestEncryptRoundTrip(t *testing.T) {
+	plaintext := []byte("keys, config and state")
+
+	encrypted, err := Encrypt(plaintext, "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(encrypted, plaintext) {
+		t.Fatal("the archive holds the plaintext")
+	}
+
+	decrypted, err := Decrypt(encrypted, "correct horse")
+	if err != nil || !bytes.Equal(decrypted, plaintext) {
+		t.Errorf("Decrypt = %q, %v; want the plaintext", decrypted, err)
+	}
+
+	if _, err := Decrypt(encrypted, "wrong horse"); err == nil {
+		t.Error("Decrypt succeeded with the wrong passphrase")
+	}
+
+	tampered := append([]byte(nil), encrypted...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := Decrypt(tampered, "correct horse"); err == nil {
+		t.Error("Decrypt succeeded on a tampered archive")
+	}
+}
+
+func TestReadWrite(t *testing.T) {
+	entries := []Entry{
+		{Name: "manifest.json", Mode: 0600, Data: []byte("{}")},
+		{Name: "keys/jwk.public.json", Mode: 0644, Data: []byte("public")},
+	}
+
+	var buf bytes.Buffer
+	if err := Write(&buf, entries); err != nil {
+		t.Fatal(err)
+	}
+	got, err := Read(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, entries) {
+		t.Errorf("Read = %+v, want %+v", got, entries)
+	}
+	if entry, ok := Find(got, "keys/jwk.public.json"); !ok || string(entry.Data) != "public" {
+		t.Errorf("Find = %+v, %v", entry, ok)
+	}
+}
+
+func TestReadRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		header tar.Header
+	}{
+		{name: "parent directory", header: tar.Header{Name: "../etc/shadow", Typeflag: tar.TypeReg}},
+		{name: "nested escape", header: tar.Header{Name: "keys/../../etc/shadow", Typeflag: tar.TypeReg}},
+		{name: "absolute path", header: tar.Header{Name: "/etc/shadow", Typeflag: tar.TypeReg}},
+		{name: "symlink", header: tar.Header{Name: "keys/link", Typeflag: tar.TypeSymlink, Linkname: "/etc/shadow"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			tw := tar.NewWriter(&buf)
+			header := tt.header
+			header.Mode = 0600
+			if err := tw.WriteHeader(&header); err != nil {
+				t.Fatal(err)
+			}
+			tw.Close()
+
+			if entries, err := Read(&buf); err == nil {
+				t.Errorf("Read = %+v, want an error", entries)
+			}
+		})
+	}
+}
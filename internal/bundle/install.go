@@ -0,0 +1,46 @@
+package bundle
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/internal/elevate"
+)
+
+// Install copies an entry to a root-owned destination with the given permission
+func Install(entry Entry, destPath string, permission os.FileMode, logger *logrus.Logger) error {
+	logger.WithFields(logrus.Fields{
+		"entry":      entry.Name,
+		"path":       destPath,
+		"permission": fmt.Sprintf("%o", permission),
+	}).Info("Installing bundle entry")
+
+	tmpPath, err := WriteTemp(entry)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+
+	files := elevate.Privileged()
+	if err := files.MkdirAll(filepath.Dir(destPath)); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %w", destPath, err)
+	}
+
+	if err := files.Copy(tmpPath, destPath); err != nil {
+		return fmt.Errorf("failed to install %s: %w", destPath, err)
+	}
+
+	// Group 0 is root on Linux but wheel on FreeBSD
+	if err := files.Chown(destPath, 0, 0); err != nil {
+		return fmt.Errorf("failed to set ownership on %s: %w", destPath, err)
+	}
+
+	if err := files.Chmod(destPath, permission); err != nil {
+		return fmt.Errorf("failed to set permissions on %s: %w", destPath, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,41 @@
+package client
+
+import (
+	"time"
+
+	"p0-ssh-agent/scripts"
+)
+
+// auditShipInterval is how often entries an audit sink missed are retried
+const auditShipInterval = 30 * time.Second
+
+// runAuditShipper delivers audit log entries to the audit sinks as they are
+// recorded, off the provisioning path, and retries those a sink missed. The
+// entries the command CLIs record are delivered too, should they exit before
+// a sink took them.
+func (c *Client) runAuditShipper(stop <-chan struct{}) {
+	ticker := time.NewTicker(auditShipInterval)
+	defer ticker.Stop()
+
+	failing := false
+	for {
+		delivered, err := scripts.ShipAuditLog()
+		switch {
+		case err != nil && !failing:
+			c.logger.WithError(err).Error("🚨 Failed to deliver audit log entries to a sink, retrying")
+		case err == nil && failing:
+			c.logger.Info("✅ Audit sinks caught up")
+		}
+		failing = err != nil
+		if delivered > 0 {
+			c.logger.WithField("entries", delivered).Debug("Delivered audit log entries to sinks")
+		}
+
+		select {
+		case <-scripts.AuditAppended():
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/internal/connection"
+	"p0-ssh-agent/types"
+)
+
+// lowBandwidthProgressInterval batches progress notifications on the low
+// bandwidth profile, so a bulk revoke reports a handful of updates instead
+// of one every ProgressNotifyInterval
+const lowBandwidthProgressInterval = 30 * time.Second
+
+// Sources of the bandwidth profile in effect
+const (
+	bandwidthSourceConfig = "config"
+	bandwidthSourceRPC    = "rpc"
+)
+
+// bandwidthProfile returns the profile in effect: the one the backend set
+// with setBandwidthProfile, or else bandwidthProfile from the configuration
+func (c *Client) bandwidthProfile() (profile, source string) {
+	c.bandwidthMu.RLock()
+	override := c.bandwidthOverride
+	c.bandwidthMu.RUnlock()
+
+	if override != "" {
+		return override, bandwidthSourceRPC
+	}
+	return c.currentConfig().GetBandwidthProfile(), bandwidthSourceConfig
+}
+
+func (c *Client) lowBandwidth() bool {
+	profile, _ := c.bandwidthProfile()
+	return profile == types.BandwidthProfileLow
+}
+
+// heartbeatInterval is heartbeatIntervalSeconds, raised to
+// LowBandwidthHeartbeatSeconds on the low bandwidth profile
+func (c *Client) heartbeatInterval() time.Duration {
+	interval := c.currentConfig().GetHeartbeatInterval()
+	if c.lowBandwidth() && interval < types.LowBandwidthHeartbeatSeconds*time.Second {
+		return types.LowBandwidthHeartbeatSeconds * time.Second
+	}
+	return interval
+}
+
+// compressThreshold is compressResponsesOver, or LowBandwidthCompressOver on
+// the low bandwidth profile when compression is not configured. Zero
+// disables compression.
+func (c *Client) compressThreshold() int {
+	threshold := c.currentConfig().CompressResponsesOver
+	if threshold == 0 && c.lowBandwidth() {
+		return types.LowBandwidthCompressOver
+	}
+	return threshold
+}
+
+// progressInterval throttles progress notifications for the profile in effect
+func (c *Client) progressInterval() time.Duration {
+	if c.lowBandwidth() {
+		return lowBandwidthProgressInterval
+	}
+	return ProgressNotifyInterval
+}
+
+// handleSetBandwidthProfile switches the bandwidth profile until the agent
+// restarts. The heartbeat interval, response compression, event batching and
+// inventory change at once; frame compression is negotiated from the next
+// connection.
+func (c *Client) handleSetBandwidthProfile(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var request types.SetBandwidthProfileRequest
+	if err := json.Unmarshal(params, &request); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal SetBandwidthProfileRequest: %w", err)
+	}
+	if request.Profile != "" && !types.IsBandwidthProfile(request.Profile) {
+		return nil, fmt.Errorf("unknown bandwidth profile %q (supported: %s, %s)", request.Profile, types.BandwidthProfileStandard, types.BandwidthProfileLow)
+	}
+
+	c.bandwidthMu.Lock()
+	c.bandwidthOverride = request.Profile
+	c.bandwidthMu.Unlock()
+
+	profile, source := c.bandwidthProfile()
+	c.applyBandwidthProfile()
+
+	c.logger.WithFields(logrus.Fields{
+		"profile": profile,
+		"source":  source,
+	}).Info("📶 Bandwidth profile changed")
+
+	return types.SetBandwidthProfileResponse{
+		Profile:                  profile,
+		Source:                   source,
+		HeartbeatIntervalSeconds: int(c.heartbeatInterval() / time.Second),
+	}, nil
+}
+
+// applyBandwidthProfile restarts the heartbeat ticker at the interval of the
+// profile in effect
+func (c *Client) applyBandwidthProfile() {
+	select {
+	case c.heartbeatReset <- struct{}{}:
+	default:
+	}
+
+	c.updateConnection(func(*connection.State) {})
+}
@@ -0,0 +1,42 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/internal/jwt"
+	"p0-ssh-agent/internal/rpc"
+	"p0-ssh-agent/types"
+)
+
+// callOnceTimeout bounds a CallOnce round trip after the connection is established
+const callOnceTimeout = 30 * time.Second
+
+// CallOnce opens a separate tunnel connection, makes a single RPC call to the
+// backend and closes it. Commands use it while the agent keeps its own connection.
+func CallOnce(config *types.Config, jwtManager *jwt.Manager, method string, params interface{}, logger *logrus.Logger) (json.RawMessage, error) {
+	conn, resp, err := dialTunnel(config, config.TunnelHost, config.GetBandwidthProfile() == types.BandwidthProfileLow, jwtManager, logger)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("WebSocket handshake failed: HTTP %d %s", resp.StatusCode, resp.Status)
+		}
+		return nil, fmt.Errorf("failed to dial WebSocket: %w", err)
+	}
+
+	rpcClient := rpc.NewClient()
+	defer rpcClient.Close()
+
+	if err := rpcClient.ConnectWebSocket(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to connect JSON-RPC client: %w", err)
+	}
+
+	// Closing the client unblocks a call the backend never answers
+	timer := time.AfterFunc(callOnceTimeout, func() { rpcClient.Close() })
+	defer timer.Stop()
+
+	return rpcClient.Call(method, params)
+}
@@ -2,21 +2,54 @@ package client
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/sirupsen/logrus"
 
+	"p0-ssh-agent/internal/annotations"
+	"p0-ssh-agent/internal/audit"
 	"p0-ssh-agent/internal/backoff"
+	"p0-ssh-agent/internal/connection"
+	"p0-ssh-agent/internal/diagnostics"
+	"p0-ssh-agent/internal/endpoint"
+	"p0-ssh-agent/internal/fetchfile"
+	"p0-ssh-agent/internal/filebackup"
+	"p0-ssh-agent/internal/forward"
+	"p0-ssh-agent/internal/grants"
 	"p0-ssh-agent/internal/jwt"
+	"p0-ssh-agent/internal/labels"
+	"p0-ssh-agent/internal/metrics"
+	"p0-ssh-agent/internal/osplugins"
+	"p0-ssh-agent/internal/policy"
 	"p0-ssh-agent/internal/rpc"
+	"p0-ssh-agent/internal/state"
+	"p0-ssh-agent/internal/timewindow"
+	"p0-ssh-agent/internal/userdb"
 	"p0-ssh-agent/scripts"
 	"p0-ssh-agent/types"
+	"p0-ssh-agent/utils"
+)
+
+var (
+	// ErrAuth matches every AuthenticationError: the backend rejected the
+	// agent's credentials, so retrying cannot succeed
+	ErrAuth = errors.New("authentication rejected by the backend")
+
+	// ErrShutdown is returned when connecting a client that has been shut down
+	ErrShutdown = errors.New("client is shutdown")
 )
 
 // AuthenticationError represents an authentication failure that should cause immediate exit
@@ -29,144 +62,334 @@ func (e *AuthenticationError) Error() string {
 	return e.Message
 }
 
+// Is makes errors.Is(err, ErrAuth) report authentication failures
+func (e *AuthenticationError) Is(target error) bool {
+	return target == ErrAuth
+}
+
 const (
-	DefaultBackoffStart   = 1 * time.Second
-	DefaultBackoffMax     = 30 * time.Second
+	// ProgressNotifyInterval throttles progress notifications for long-running requests
+	ProgressNotifyInterval = 2 * time.Second
+
+	// DiagnosticsChunkSize is the raw size of each diagnostics chunk before base64 encoding
+	DiagnosticsChunkSize = 256 * 1024
+
+	// drainPollInterval is how often shutdown checks for running scripts
+	drainPollInterval = 100 * time.Millisecond
+
+	// ServiceName is the systemd unit inspected when collecting diagnostics
+	ServiceName = "p0-ssh-agent"
+
+	// MaxHeartbeatTimeout bounds the wait for a heartbeat reply; shorter
+	// heartbeat intervals use the interval instead
+	MaxHeartbeatTimeout = 30 * time.Second
+
+	// supportLane serves diagnostics and file reads apart from provisioning
+	// requests, so support can inspect a host while a script hangs
+	supportLane = "support"
+
+	// bulkRevokeLane runs bulk revokes apart from other provisioning
+	// requests, which would otherwise wait for hundreds of revokes
+	bulkRevokeLane = "bulkRevoke"
 )
 
 type Client struct {
-	config     *types.Config
+	config     atomic.Pointer[types.Config]
 	logger     *logrus.Logger
 	jwtManager *jwt.Manager
 	rpcClient  *rpc.Client
 	backoff    *backoff.Backoff
 
-	conn          *websocket.Conn
-	connMu        sync.RWMutex
-	ctx           context.Context
-	cancel        context.CancelFunc
-	connected     chan struct{}
-	isShutdown    bool
-	shutdownMu    sync.RWMutex
-	heartbeatStop chan struct{}
-	lastHeartbeat time.Time
-	heartbeatMu   sync.RWMutex
-	reconnecting  bool
-	reconnectMu   sync.Mutex
+	conn            *websocket.Conn
+	tokenExpiresAt  time.Time
+	connMu          sync.RWMutex
+	ctx             context.Context
+	cancel          context.CancelFunc
+	isShutdown      bool
+	shutdownMu      sync.RWMutex
+	lastHeartbeat   time.Time
+	heartbeatMu     sync.RWMutex
+	scheduler       *grants.Scheduler
+	schedulerStop   chan struct{}
+	endpoint        types.TunnelEndpoint
+	endpointMu      sync.RWMutex
+	connectFailures int
+	probeStop       chan struct{}
+	connState       connection.State
+	connStateMu     sync.Mutex
+	startedAt       time.Time
+	draining        atomic.Bool
+	disabled        atomic.Bool
+	loadConfig      func() (*types.Config, error)
+
+	// goingDownReason and goingDownMessage are guarded by shutdownMu
+	goingDownReason  string
+	goingDownMessage string
+
+	bandwidthOverride string
+	bandwidthMu       sync.RWMutex
+	heartbeatReset    chan struct{}
+
+	sshdHealth   *types.SSHDHealth
+	sshdHealthMu sync.Mutex
+
+	// targets routes forwarded requests to HTTP services, replaced on reload
+	targets atomic.Pointer[forward.Router]
+
+	// streams are the event streams and WebSockets open to targets, by ID
+	streams   map[string]targetStream
+	streamsMu sync.Mutex
+
+	// streamPacer paces the data relayed from all target streams
+	streamPacer streamPacer
+
+	// The supervisor owns the tunnel's lifecycle, see supervisor.go. events
+	// feeds it, generation counts the connections it made, stopping is
+	// closed by Shutdown and stopped once it returned. supervising is
+	// guarded by shutdownMu.
+	events      chan lifecycleEvent
+	generation  atomic.Uint64
+	state       lifecycleState
+	stateMu     sync.Mutex
+	supervising bool
+	stopping    chan struct{}
+	stopped     chan struct{}
 }
 
 func New(config *types.Config, logger *logrus.Logger) (*Client, error) {
 	jwtManager := jwt.NewManager(logger)
-	if err := jwtManager.LoadKey(config.KeyPath); err != nil {
+	jwtManager.SetProfile(config.KeyProfile)
+	if err := jwtManager.LoadKey(config.GetKeyDir()); err != nil {
 		return nil, fmt.Errorf("failed to load JWT key: %w", err)
 	}
-
-	backoffInstance, err := backoff.New(DefaultBackoffStart, DefaultBackoffMax)
+	jwtManager.SetClockSkew(config.GetJWTNotBefore(), config.GetJWTExpiryLeeway())
+	jwtManager.SetLifetime(config.GetJWTLifetime())
+
+	reconnect := config.Reconnect
+	backoffInstance, err := backoff.NewPolicy(backoff.Policy{
+		Start:       reconnect.GetInitialDelay(),
+		Max:         reconnect.GetMaxDelay(),
+		Jitter:      reconnect.GetJitter(),
+		MaxAttempts: reconnect.MaxAttempts,
+		MaxElapsed:  reconnect.GetMaxElapsed(),
+		ResetAfter:  reconnect.GetResetAfter(),
+	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to create backoff: %w", err)
 	}
 
+	grantStore, err := grants.Open(config.StateDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open grant store: %w", err)
+	}
+
+	// Let managed-file edits drop blocks of grants that have already ended
+	scripts.SetFinishedGrantLookup(grantStore.IsGrantFinished)
+	scripts.SetFileBackupDir(filebackup.Dir(config.StateDir))
+	scripts.SetAuditLogPath(audit.Path(config.StateDir))
+	if err := scripts.ConfigureAuditSinks(config.AuditSinks, config.HostID); err != nil {
+		return nil, fmt.Errorf("failed to set up audit sinks: %w", err)
+	}
+	scripts.SetStatePath(state.Path(config.StateDir))
+	scripts.SetCertificateAuthorityDir(scripts.CertificateAuthorityDir(config.StateDir))
+	scripts.SetAuthorizedKeysFile(config.GetAuthorizedKeysFile())
+	if config.GetAuthorizedKeysFile() == "" && runtime.GOOS != "windows" {
+		keysFile, source, err := scripts.DetectAuthorizedKeysFile(context.Background())
+		if source == "" {
+			source = "sshd default"
+		}
+		if err != nil {
+			logger.WithError(err).Warn("⚠️ No AuthorizedKeysFile to provision keys to, key grants will fail")
+		} else {
+			logger.WithFields(logrus.Fields{
+				"authorizedKeysFile": keysFile,
+				"source":             source,
+			}).Info("🗝️ Provisioning keys to the AuthorizedKeysFile detected from sshd_config")
+		}
+	}
+	scripts.SetSudoersLayout(config.GetSudoersLayout())
+	scripts.SetSessionRecording(config.GetSessionRecording())
+	if err := scripts.SetScriptLimits(config.ScriptLimits); err != nil {
+		return nil, err
+	}
+	osplugins.SetSELinuxUser(config.SELinuxUser)
+	osplugins.SetOverride(config.OSPlugin)
+	userdb.Configure(config)
+
+	if config.TLSInsecureSkipVerify {
+		logger.Error("🚨 tlsInsecureSkipVerify is set: the tunnel certificate is NOT verified. Use tlsCaFile instead outside of testing")
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 
 	client := &Client{
-		config:        config,
-		logger:        logger,
-		jwtManager:    jwtManager,
-		backoff:       backoffInstance,
-		ctx:           ctx,
-		cancel:        cancel,
-		connected:     make(chan struct{}),
-		heartbeatStop: make(chan struct{}),
+		logger:         logger,
+		jwtManager:     jwtManager,
+		backoff:        backoffInstance,
+		ctx:            ctx,
+		cancel:         cancel,
+		heartbeatReset: make(chan struct{}, 1),
+		scheduler:      grants.NewScheduler(grantStore, config.DryRun, logger),
+		schedulerStop:  make(chan struct{}),
+		endpoint:       types.TunnelEndpoint{URL: config.TunnelHost, Candidates: 1, SelectedAt: time.Now().UTC().Format(time.RFC3339), Priority: 1, Reason: endpointReasonConfigured},
+		probeStop:      make(chan struct{}),
+		startedAt:      time.Now(),
+		events:         make(chan lifecycleEvent),
+		stopping:       make(chan struct{}),
+		stopped:        make(chan struct{}),
 	}
 
+	client.config.Store(config)
+	targets, err := forward.NewRouter(config.Targets, config.TargetCache)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up targets: %w", err)
+	}
+	client.targets.Store(targets)
+	client.scheduler.SetHold(func() bool {
+		return client.hostDisabled() != nil
+	})
 	client.rpcClient = rpc.NewClient()
 
 	client.rpcClient.AddMethod("call", client.handleCallMethod)
+	client.rpcClient.SetLaneFunc("call", callLane)
+	client.rpcClient.AddMethod("setBandwidthProfile", client.handleSetBandwidthProfile)
+	client.rpcClient.AddMethod("describeAgent", client.handleDescribeAgent)
+	client.rpcClient.AddMethodInLane("collectDiagnostics", supportLane, client.handleCollectDiagnostics)
+	client.rpcClient.AddMethodInLane("fetchFile", supportLane, client.handleFetchFile)
+	client.rpcClient.AddMethodInLane("targetStreamSend", targetStreamLane, client.handleTargetStreamSend)
+	client.rpcClient.AddMethodInLane("targetStreamClose", targetStreamLane, client.handleTargetStreamClose)
 
-	client.rpcClient.SetOnConnected(func() {
-		client.logger.Info("WebSocket connection established, sending setClientId")
-		if _, err := client.rpcClient.Call("setClientId", types.SetClientIDRequest{
-			ClientID: client.config.GetClientID(),
-		}); err != nil {
-			client.logger.WithError(err).Error("Failed to set client ID - triggering reconnection")
-			client.forceReconnect()
-			return
-		}
-		client.logger.Info("Client ID set successfully")
-
-		client.heartbeatMu.Lock()
-		client.lastHeartbeat = time.Now()
-		client.heartbeatMu.Unlock()
-
-		go client.startHeartbeat()
-
-		select {
-		case client.connected <- struct{}{}:
-		default:
-		}
-	})
+	client.rpcClient.SetOnReplyFailed(client.journalUndelivered)
 
 	return client, nil
 }
 
-func (c *Client) Connect() error {
-	return c.connect()
-}
-
-func (c *Client) connect() error {
+// connect dials the tunnel until a connection is made, backing off between
+// failed attempts. It returns ErrShutdown once Shutdown was called.
+func (c *Client) connect() (*tunnel, error) {
 	for {
-		c.shutdownMu.RLock()
-		if c.isShutdown {
-			c.shutdownMu.RUnlock()
-			return fmt.Errorf("client is shutdown")
+		select {
+		case <-c.stopping:
+			return nil, ErrShutdown
+		default:
 		}
-		c.shutdownMu.RUnlock()
 
-		if err := c.connectOnce(); err != nil {
+		t := c.newTunnel()
+		if err := c.connectOnce(t); err != nil {
+			t.cancel()
+
 			// Check if this is an authentication error - exit immediately
-			if authErr, ok := err.(*AuthenticationError); ok {
+			var authErr *AuthenticationError
+			if errors.As(err, &authErr) {
 				c.logger.WithFields(logrus.Fields{
 					"status_code": authErr.StatusCode,
 					"error":       authErr.Message,
 				}).Error("💀 Authentication failed - exiting for systemd restart management")
-				return authErr
+				return nil, authErr
 			}
 
-			c.logger.WithError(err).Warn("Connection failed, retrying...")
+			// The chosen endpoint may be the one that is down
+			c.connectFailed()
 
-			select {
-			case <-c.ctx.Done():
-				return c.ctx.Err()
-			case <-time.After(c.backoff.Next()):
-				continue
+			delay := c.backoff.Next()
+			if exhausted := c.backoff.Exhausted(); exhausted != nil {
+				c.logger.WithError(err).WithField("policy", exhausted.Error()).Error("💀 Giving up reconnecting - exiting for systemd restart management")
+				c.connectionGaveUp(err)
+				return nil, fmt.Errorf("%w: %w", exhausted, err)
 			}
+			c.logger.WithError(err).WithFields(logrus.Fields{
+				"attempt": c.backoff.Count(),
+				"delay":   delay.Round(time.Millisecond),
+			}).Warn("Connection failed, retrying...")
+			c.connectionAttemptFailed(err, delay)
+
+			if !c.waitBackoff(delay) {
+				return nil, ErrShutdown
+			}
+			continue
 		}
 
-		c.backoff.Reset()
-		return nil
+		c.backoff.Succeeded()
+		c.connectSucceeded()
+		return t, nil
 	}
 }
 
-func (c *Client) connectOnce() error {
-	token, err := c.jwtManager.CreateJWT(c.config.GetClientID())
+// dialTunnel opens a WebSocket connection to tunnelURL, authenticated with a
+// JWT. With compress the connection offers per-message compression.
+func dialTunnel(config *types.Config, tunnelURL string, compress bool, jwtManager *jwt.Manager, logger *logrus.Logger) (*websocket.Conn, *http.Response, error) {
+	token, err := jwtManager.CreateJWT(config.GetClientID())
 	if err != nil {
-		return fmt.Errorf("failed to create JWT: %w", err)
+		return nil, nil, fmt.Errorf("failed to create JWT: %w", err)
 	}
 
-	tunnelURL := c.config.TunnelHost
 	if tunnelURL == "" {
-		return fmt.Errorf("tunnel host URL not configured")
+		return nil, nil, fmt.Errorf("tunnel host URL not configured")
 	}
 
 	headers := http.Header{}
 	headers.Set("Authorization", "Bearer "+token)
 
-	c.logger.WithFields(logrus.Fields{
+	logger.WithFields(logrus.Fields{
 		"url":     tunnelURL,
 		"headers": map[string]string{"Authorization": "Bearer <redacted>"},
 	}).Debug("Attempting WebSocket connection")
 
-	conn, resp, err := websocket.DefaultDialer.Dial(tunnelURL, headers)
+	tlsClientConfig, err := tlsConfig(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	if config.TLSInsecureSkipVerify {
+		logger.WithField("url", tunnelURL).Warn("🚨 TLS certificate verification is DISABLED (tlsInsecureSkipVerify) - the tunnel can be intercepted")
+	}
+
+	dialer := *websocket.DefaultDialer
+	dialer.HandshakeTimeout = config.GetHandshakeTimeout()
+	dialer.Proxy = proxyFunc(config, logger)
+	dialer.TLSClientConfig = tlsClientConfig
+	dialer.EnableCompression = compress
+	// Also used to reach the proxy, if any
+	dialer.NetDialContext = (&net.Dialer{KeepAlive: config.GetTCPKeepAlive()}).DialContext
+	// Zero keeps gorilla/websocket's 4 KiB buffers
+	dialer.ReadBufferSize = config.ReadBufferBytes
+	dialer.WriteBufferSize = config.WriteBufferBytes
+
+	return dialer.Dial(tunnelURL, headers)
+}
+
+// logClockSkew compares the Date of a rejected handshake with the local clock.
+// Drift beyond jwtNotBeforeSeconds or jwtExpiryLeewaySeconds makes the backend
+// reject fresh tokens, typically on VMs after live migration or resume.
+func (c *Client) logClockSkew(resp *http.Response) {
+	serverTime, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return
+	}
+
+	// Positive when the agent's clock is ahead of the backend's
+	skew := time.Since(serverTime).Round(time.Second)
+	if skew <= c.currentConfig().GetJWTNotBefore() && -skew <= c.currentConfig().GetJWTExpiryLeeway() {
+		return
+	}
+
+	c.logger.WithFields(logrus.Fields{
+		"skew":              skew.String(),
+		"server_time":       serverTime.UTC().Format(time.RFC3339),
+		"jwt_not_before":    c.currentConfig().GetJWTNotBefore().String(),
+		"jwt_expiry_leeway": c.currentConfig().GetJWTExpiryLeeway().String(),
+	}).Error("⏰ Clock skew with the backend exceeds the JWT tolerance - sync the clock (NTP) or raise jwtNotBeforeSeconds")
+}
+
+func (c *Client) connectOnce(t *tunnel) error {
+	// Pick up a key installed by rotate-keys since the last connection
+	if reloaded, err := c.jwtManager.ReloadIfChanged(c.currentConfig().GetKeyDir()); err != nil {
+		c.logger.WithError(err).Warn("Failed to reload JWT key, using the key already loaded")
+	} else if reloaded {
+		c.logger.Info("🔑 Reloaded rotated JWT key")
+	}
+
+	tokenExpiresAt := time.Now().Add(c.jwtManager.Lifetime())
+	conn, resp, err := dialTunnel(c.currentConfig(), c.tunnelURL(), c.lowBandwidth(), c.jwtManager, c.logger)
 	if err != nil {
 		if resp != nil {
 			c.logger.WithFields(logrus.Fields{
@@ -178,8 +401,9 @@ func (c *Client) connectOnce() error {
 			if resp.StatusCode == 401 {
 				c.logger.Error("🔐 Authentication failed - JWT token rejected by server")
 				c.logger.Error("💡 Check: 1) Client ID is registered 2) JWT key is correct 3) Token not expired")
+				c.logClockSkew(resp)
 				c.logger.Error("💀 Exiting to let systemd handle restart rate limiting")
-				
+
 				return &AuthenticationError{
 					StatusCode: 401,
 					Message:    "authentication failed - JWT token rejected by server",
@@ -188,7 +412,7 @@ func (c *Client) connectOnce() error {
 				c.logger.Error("🚫 Forbidden - Client ID may not be authorized")
 				c.logger.Error("💡 Check: Client ID is registered and authorized for this environment")
 				c.logger.Error("💀 Exiting to let systemd handle restart rate limiting")
-				
+
 				return &AuthenticationError{
 					StatusCode: 403,
 					Message:    "forbidden - client ID may not be authorized",
@@ -205,11 +429,16 @@ func (c *Client) connectOnce() error {
 
 	c.connMu.Lock()
 	c.conn = conn
+	c.tokenExpiresAt = tokenExpiresAt
 	c.connMu.Unlock()
 
 	c.logger.Info("WebSocket connection established, connecting JSON-RPC client")
 
-	if err := c.rpcClient.ConnectWebSocketWithContext(c.ctx, conn); err != nil {
+	c.rpcClient.SetWriteTimeout(c.currentConfig().GetWriteTimeout())
+	c.rpcClient.SetPing(c.currentConfig().GetPingInterval(), c.currentConfig().GetPongTimeout())
+	c.rpcClient.SetOnConnected(c.onConnected(t))
+	c.rpcClient.SetOnDisconnected(c.onDisconnected(t))
+	if err := c.rpcClient.ConnectWebSocketWithContext(t.ctx, conn); err != nil {
 		conn.Close()
 		return fmt.Errorf("failed to connect JSON-RPC client: %w", err)
 	}
@@ -217,6 +446,43 @@ func (c *Client) connectOnce() error {
 	return nil
 }
 
+// onConnected registers the connection of t with setClientId. Events carry
+// t's generation, so a reply that arrives after t was replaced is ignored.
+func (c *Client) onConnected(t *tunnel) func() {
+	return func() {
+		c.logger.Info("WebSocket connection established, sending setClientId")
+		result, err := c.rpcClient.CallWithTimeout("setClientId", c.heartbeatRequest(), c.heartbeatTimeout())
+		if err == nil {
+			err = c.checkHeartbeatAck(result)
+		}
+		if err != nil {
+			c.logger.WithError(err).Error("Failed to set client ID - triggering reconnection")
+			c.connectionFailed(err)
+			c.reconnect(t.generation, err)
+			return
+		}
+		c.logger.Info("Client ID set successfully")
+		c.send(lifecycleEvent{kind: eventRegistered, generation: t.generation})
+	}
+}
+
+// onDisconnected reconnects when pings find the connection of t dead,
+// without waiting for the next heartbeat
+func (c *Client) onDisconnected(t *tunnel) func(error) {
+	return func(err error) {
+		c.shutdownMu.RLock()
+		shutdown := c.isShutdown
+		c.shutdownMu.RUnlock()
+		if shutdown {
+			return
+		}
+
+		c.logger.WithError(err).Warn("💔 Tunnel connection dropped - triggering reconnection")
+		c.connectionFailed(err)
+		c.reconnect(t.generation, err)
+	}
+}
+
 func (c *Client) handleCallMethod(ctx context.Context, params json.RawMessage) (interface{}, error) {
 	c.logger.Info("🔄 Received 'call' method - processing provisioning request")
 
@@ -239,9 +505,9 @@ func (c *Client) handleCallMethod(ctx context.Context, params json.RawMessage) (
 		"headers":   logHeaders,
 		"params":    request.Params,
 		"data":      request.Data,
-		"client_id": c.config.GetClientID(),
+		"client_id": c.currentConfig().GetClientID(),
 		"has_data":  request.Data != nil,
-		"dry_run":   c.config.DryRun,
+		"dry_run":   c.currentConfig().DryRun,
 	}).Info("📥 P0 SSH Agent received provisioning request")
 
 	var scriptResult scripts.ProvisioningResult
@@ -257,8 +523,24 @@ func (c *Client) handleCallMethod(ctx context.Context, params json.RawMessage) (
 		}
 	}
 
-	if command != "" && request.Data != nil {
-		scriptResult = scripts.ExecuteScript(command, request.Data, c.config.DryRun, c.logger)
+	// Provisioning commands are dispatched first, so no target can take them over
+	if command == "" {
+		if route := c.targets.Load().Match(request); route != nil {
+			return c.forwardToTarget(ctx, route, request, params), nil
+		}
+	}
+
+	if command != "" {
+		metrics.ProvisioningRequests.Inc(scripts.MetricsLabel(command))
+	}
+
+	if command != "" {
+		scriptCtx, cancel := provisioningContext(request)
+		scriptCtx = scripts.WithLateResult(scriptCtx, func(late scripts.ProvisioningResult) {
+			c.journalUndelivered("call", params, c.provisioningResponse(command, params, late), errLateResult)
+		})
+		scriptResult = c.provision(scriptCtx, command, request.Data, requestOrigin(request))
+		cancel()
 	} else {
 		scriptResult = scripts.ProvisioningResult{
 			Success: true,
@@ -266,6 +548,67 @@ func (c *Client) handleCallMethod(ctx context.Context, params json.RawMessage) (
 		}
 	}
 
+	return c.provisioningResponse(command, params, scriptResult), nil
+}
+
+// callLane moves calls carrying a bulkRevoke to their own lane
+func callLane(params json.RawMessage) string {
+	var request struct {
+		Data struct {
+			Command string `json:"command"`
+		} `json:"data"`
+	}
+	if json.Unmarshal(params, &request) == nil && scripts.Command(request.Data.Command) == scripts.CommandBulkRevoke {
+		return bulkRevokeLane
+	}
+	return ""
+}
+
+// provision runs a provisioning command through the checks every request
+// passes: the kill switch and the command's schema, before the command
+// itself
+func (c *Client) provision(ctx context.Context, command string, data interface{}, origin *audit.Origin) scripts.ProvisioningResult {
+	if disabled := c.grantDisabled(command, data); disabled != nil {
+		return c.refuseDisabled(command, data, origin, disabled)
+	}
+
+	invalid, err := scripts.ValidateRequest(command, data)
+	if err != nil {
+		c.logger.WithError(err).WithField("command", command).Error("❌ Request schemas unavailable - nothing was run")
+		return scripts.ProvisioningResult{
+			Success: false,
+			Error:   fmt.Sprintf("request schemas unavailable: %v", err),
+		}
+	}
+	if invalid != nil {
+		c.logger.WithFields(logrus.Fields{
+			"command": command,
+			"errors":  invalid.Errors,
+		}).Warn("🚫 Provisioning request does not match its schema - nothing was run")
+		return scripts.ProvisioningResult{
+			Success: false,
+			Error:   invalid.Error(),
+			Data:    invalid,
+		}
+	}
+
+	switch {
+	case scripts.Command(command) == scripts.CommandBulkRevoke:
+		return c.executeBulkRevoke(data, origin)
+	case scripts.Command(command) == scripts.CommandStageGrants:
+		return c.executeStageGrants(data, origin)
+	case data == nil:
+		return scripts.ProvisioningResult{
+			Success: true,
+			Message: "Request logged - no command specified",
+		}
+	}
+	return c.executeProvisioning(ctx, command, data, origin)
+}
+
+// provisioningResponse answers a provisioning request with the result of its
+// command, compressed and signed as configured
+func (c *Client) provisioningResponse(command string, params json.RawMessage, scriptResult scripts.ProvisioningResult) types.ForwardedResponse {
 	response := types.ForwardedResponse{
 		Headers:    map[string]interface{}{"content-type": "application/json"},
 		Status:     200,
@@ -273,42 +616,469 @@ func (c *Client) handleCallMethod(ctx context.Context, params json.RawMessage) (
 	}
 
 	if scriptResult.Success {
-		response.Data = map[string]interface{}{
+		status := "completed"
+		if scriptResult.Status != "" {
+			status = scriptResult.Status
+		}
+		responseData := map[string]interface{}{
 			"success":   true,
 			"message":   scriptResult.Message,
-			"client_id": c.config.GetClientID(),
+			"client_id": c.currentConfig().GetClientID(),
 			"command":   command,
 			"timestamp": time.Now().UTC().Format(time.RFC3339),
-			"status":    "completed",
+			"status":    status,
+		}
+		if scriptResult.Data != nil {
+			responseData["results"] = scriptResult.Data
 		}
+		response.Data = responseData
 		c.logger.WithFields(logrus.Fields{
 			"command": command,
 			"message": scriptResult.Message,
 		}).Info("✅ Script executed successfully")
 	} else {
+		metrics.ProvisioningFailures.Inc(scripts.MetricsLabel(command))
 		response.Status = 500
 		response.StatusText = "Internal Server Error"
-		response.Data = map[string]interface{}{
+		responseData := map[string]interface{}{
 			"success":   false,
 			"error":     scriptResult.Error,
-			"client_id": c.config.GetClientID(),
+			"client_id": c.currentConfig().GetClientID(),
 			"command":   command,
 			"timestamp": time.Now().UTC().Format(time.RFC3339),
 			"status":    "failed",
 		}
+		if violation, ok := scriptResult.Data.(*policy.Violation); ok {
+			response.Status = 403
+			response.StatusText = "Forbidden"
+			responseData["status"] = policy.StatusRejected
+			responseData["policy"] = violation
+		} else if scriptResult.Status == scripts.StatusTimeout {
+			response.Status = 504
+			response.StatusText = "Gateway Timeout"
+			responseData["status"] = scripts.StatusTimeout
+		} else if invalid, ok := scriptResult.Data.(*scripts.ValidationError); ok {
+			response.Status = 400
+			response.StatusText = "Bad Request"
+			responseData["status"] = scripts.StatusInvalid
+			responseData["validationErrors"] = invalid.Errors
+		} else if scriptResult.Data != nil {
+			responseData["results"] = scriptResult.Data
+		}
+		response.Data = responseData
 		c.logger.WithFields(logrus.Fields{
 			"command": command,
 			"error":   scriptResult.Error,
 		}).Error("❌ Script execution failed")
 	}
 
+	if threshold := c.compressThreshold(); threshold > 0 {
+		c.compressResponse(&response, threshold)
+	}
+
+	if c.currentConfig().SignResponses {
+		c.signResponse(&response, params)
+	}
+
 	c.logger.WithFields(logrus.Fields{
 		"status":      response.Status,
 		"status_text": response.StatusText,
 		"command":     command,
 	}).Info("📤 P0 SSH Agent sending response")
 
-	return response, nil
+	return response
+}
+
+// signResponse attaches a JWS over the response, bound to the request by a
+// digest of its params, so the backend can detect changes made in transit.
+// If signing fails the response is sent unsigned and the backend decides.
+func (c *Client) signResponse(response *types.ForwardedResponse, params json.RawMessage) {
+	digest := sha256.Sum256(params)
+	payload, err := json.Marshal(types.SignedResponse{
+		ClientID:      c.currentConfig().GetClientID(),
+		RequestDigest: hex.EncodeToString(digest[:]),
+		Status:        response.Status,
+		Data:          response.Data,
+		IssuedAt:      time.Now().Unix(),
+
+		ContentEncoding: response.ContentEncoding,
+	})
+	if err != nil {
+		c.logger.WithError(err).Error("Failed to encode response for signing")
+		return
+	}
+
+	signature, err := c.jwtManager.SignResponse(payload)
+	if err != nil {
+		c.logger.WithError(err).Error("Failed to sign response")
+		return
+	}
+	response.Signature = signature
+}
+
+// originHeaders are the request headers recorded as the origin of an action,
+// along with X-P0-Metadata-* headers. Any other header is left out of the
+// audit log, so credentials the backend adds never reach it or its sinks.
+var originHeaders = map[string]bool{
+	"Traceparent":      true,
+	"User-Agent":       true,
+	"X-Correlation-Id": true,
+	"X-Forwarded-For":  true,
+	"X-Request-Id":     true,
+}
+
+// requestOrigin records the backend request that initiated a provisioning
+// action for the audit log, with the headers in originHeaders
+func requestOrigin(request types.ForwardedRequest) *audit.Origin {
+	origin := &audit.Origin{
+		Source: "backend",
+		Method: request.Method,
+		Path:   request.Path,
+	}
+
+	for key, value := range request.Headers {
+		if !originHeaders[http.CanonicalHeaderKey(key)] && !strings.HasPrefix(strings.ToLower(key), policy.MetadataHeaderPrefix) {
+			continue
+		}
+		if origin.Headers == nil {
+			origin.Headers = make(map[string]string)
+		}
+		origin.Headers[key] = fmt.Sprint(value)
+	}
+
+	return origin
+}
+
+// errLateResult is journaled with the result of a provisioning command that
+// finished after the request was answered with a timeout
+var errLateResult = errors.New("finished after the request was answered with a timeout")
+
+// provisioningContext bounds a provisioning command by the request's
+// timeoutMillis, if any. It does not derive from the call's context: a lost
+// connection must not stop a command halfway, as its result is journaled for
+// delivery.
+func provisioningContext(request types.ForwardedRequest) (context.Context, context.CancelFunc) {
+	if request.Options == nil || request.Options.TimeoutMillis == nil || *request.Options.TimeoutMillis <= 0 {
+		return context.Background(), func() {}
+	}
+	return context.WithTimeout(context.Background(), time.Duration(*request.Options.TimeoutMillis)*time.Millisecond)
+}
+
+// executeProvisioning runs a provisioning command, deferring grants with a
+// validFrom/validTo window to the grant scheduler
+func (c *Client) executeProvisioning(ctx context.Context, command string, data interface{}, origin *audit.Origin) scripts.ProvisioningResult {
+	dataBytes, err := json.Marshal(data)
+	if err != nil {
+		return scripts.ProvisioningResult{
+			Success: false,
+			Error:   fmt.Sprintf("failed to marshal script data: %v", err),
+		}
+	}
+
+	var req scripts.ProvisioningRequest
+	if err := json.Unmarshal(dataBytes, &req); err != nil {
+		return scripts.ProvisioningResult{
+			Success: false,
+			Error:   fmt.Sprintf("failed to unmarshal ProvisioningRequest: %v", err),
+		}
+	}
+	req.Origin = origin
+
+	if req.Action == "grant" {
+		if violation := policy.RequireMetadata(c.currentConfig().RequiredMetadata, req.Metadata, origin.Headers); violation != nil {
+			c.logger.WithFields(logrus.Fields{
+				"command":    command,
+				"request_id": req.RequestID,
+				"username":   req.UserName,
+				"missing":    violation.Missing,
+			}).Warn("🚫 Rejected grant - required metadata missing")
+
+			result := scripts.ProvisioningResult{
+				Success: false,
+				Error:   violation.Message,
+				Status:  policy.StatusRejected,
+				Data:    violation,
+			}
+			scripts.RecordRejected(command, req, c.currentConfig().DryRun, result, c.logger)
+			return result
+		}
+	}
+
+	if req.Action == "grant" && req.ExpiresAt != "" {
+		expiresAt, err := timewindow.ParseTime("expiresAt", req.ExpiresAt, req.TimeZone)
+		if err != nil {
+			return scripts.ProvisioningResult{
+				Success: false,
+				Error:   err.Error(),
+			}
+		}
+		if !time.Now().Before(expiresAt) {
+			return scripts.ProvisioningResult{
+				Success: false,
+				Error:   "grant has already expired at " + expiresAt.UTC().Format(time.RFC3339),
+			}
+		}
+	}
+
+	if req.Action == "grant" {
+		c.scheduler.CancelPendingRevokes(req.RequestID)
+	}
+
+	if req.Action == "revoke" {
+		c.scheduler.Cancel(req.RequestID, command)
+		if command == string(scripts.CommandProvisionSession) && !req.Force && !c.currentConfig().DryRun {
+			if grace := c.currentConfig().GetSessionGrace(req.GraceSeconds); grace > 0 {
+				return c.revokeSessionAfterGrace(command, req, grace)
+			}
+		}
+		return c.runScript(ctx, command, req)
+	}
+
+	window, err := grants.ParseWindow(req.ValidFrom, req.ValidTo, req.TimeZone)
+	if err == nil {
+		window, err = grants.CommandWindow(command, req, window)
+	}
+	if err != nil {
+		return scripts.ProvisioningResult{
+			Success: false,
+			Error:   err.Error(),
+		}
+	}
+
+	if req.Action != "grant" || window.IsZero() {
+		return c.runScript(ctx, command, req)
+	}
+
+	return c.scheduler.Schedule(ctx, command, req, window)
+}
+
+// revokeSessionAfterGrace warns the user's terminals and leaves the session
+// termination to the scheduler, so the user has grace to save their work
+func (c *Client) revokeSessionAfterGrace(command string, req scripts.ProvisioningRequest, grace time.Duration) scripts.ProvisioningResult {
+	warned, err := scripts.WarnUserSessions(context.Background(), req.UserName, grace, c.logger)
+	if errors.Is(err, scripts.ErrInvalidUsername) {
+		return scripts.ProvisioningResult{
+			Success: false,
+			Error:   err.Error(),
+		}
+	}
+	if err != nil {
+		c.logger.WithError(err).WithField("username", req.UserName).Warn("Failed to warn sessions, terminating them after the grace period anyway")
+	}
+
+	terminateAt := time.Now().Add(grace)
+	result := c.scheduler.ScheduleRevoke(command, req, terminateAt)
+	if result.Success {
+		result.Data = map[string]interface{}{
+			"terminateAt":     terminateAt.UTC().Format(time.RFC3339),
+			"warnedTerminals": warned,
+		}
+	}
+	return result
+}
+
+// executeBulkRevoke runs a bulkRevoke request, sending throttled progress notifications
+func (c *Client) executeBulkRevoke(data interface{}, origin *audit.Origin) scripts.ProvisioningResult {
+	dataBytes, err := json.Marshal(data)
+	if err != nil {
+		return scripts.ProvisioningResult{
+			Success: false,
+			Error:   fmt.Sprintf("failed to marshal bulk revoke data: %v", err),
+		}
+	}
+
+	var req scripts.BulkRevokeRequest
+	if err := json.Unmarshal(dataBytes, &req); err != nil {
+		return scripts.ProvisioningResult{
+			Success: false,
+			Error:   fmt.Sprintf("failed to unmarshal BulkRevokeRequest: %v", err),
+		}
+	}
+
+	for i, item := range req.Items {
+		c.scheduler.Cancel(item.RequestID, item.Command)
+		req.Items[i].Origin = origin
+	}
+
+	var lastProgress time.Time
+	onProgress := func(progress scripts.BulkRevokeProgress) {
+		if progress.Completed < progress.Total && time.Since(lastProgress) < c.progressInterval() {
+			return
+		}
+		lastProgress = time.Now()
+
+		notification := types.ProgressNotification{
+			ClientID:  c.currentConfig().GetClientID(),
+			RequestID: req.RequestID,
+			Command:   string(scripts.CommandBulkRevoke),
+			Completed: progress.Completed,
+			Total:     progress.Total,
+			Succeeded: progress.Succeeded,
+			Failed:    progress.Failed,
+		}
+		if err := c.rpcClient.Notify("progress", notification); err != nil {
+			c.logger.WithError(err).Debug("Failed to send progress notification")
+		}
+	}
+
+	return scripts.BulkRevoke(req, c.currentConfig().GetBulkRevokeConcurrency(), c.currentConfig().DryRun, onProgress, c.logger)
+}
+
+// executeStageGrants pre-stages a batch of grants with the scheduler. Every
+// item must pass the metadata policy, or the whole batch is rejected.
+func (c *Client) executeStageGrants(data interface{}, origin *audit.Origin) scripts.ProvisioningResult {
+	dataBytes, err := json.Marshal(data)
+	if err != nil {
+		return scripts.ProvisioningResult{
+			Success: false,
+			Error:   fmt.Sprintf("failed to marshal stage grants data: %v", err),
+		}
+	}
+
+	var req grants.StageRequest
+	if err := json.Unmarshal(dataBytes, &req); err != nil {
+		return scripts.ProvisioningResult{
+			Success: false,
+			Error:   fmt.Sprintf("failed to unmarshal StageRequest: %v", err),
+		}
+	}
+
+	for i, item := range req.Items {
+		item.Action = "grant"
+		item.Origin = origin
+		req.Items[i] = item
+
+		if violation := policy.RequireMetadata(c.currentConfig().RequiredMetadata, item.Metadata, origin.Headers); violation != nil {
+			c.logger.WithFields(logrus.Fields{
+				"batch":      req.RequestID,
+				"command":    item.Command,
+				"request_id": item.RequestID,
+				"username":   item.UserName,
+				"missing":    violation.Missing,
+			}).Warn("🚫 Rejected staged batch - required metadata missing")
+
+			result := scripts.ProvisioningResult{
+				Success: false,
+				Error:   fmt.Sprintf("item %d: %s", i, violation.Message),
+				Status:  policy.StatusRejected,
+				Data:    violation,
+			}
+			scripts.RecordRejected(item.Command, item.ProvisioningRequest, c.currentConfig().DryRun, result, c.logger)
+			return result
+		}
+	}
+
+	return c.scheduler.Stage(req)
+}
+
+// handleCollectDiagnostics collects the same bundle as 'p0-ssh-agent diagnose' and streams
+// it back as diagnosticsChunk notifications before replying with a summary
+func (c *Client) handleCollectDiagnostics(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	if !c.currentConfig().IsRPCAllowed("collectDiagnostics") {
+		c.logger.Warn("🚫 Rejected collectDiagnostics request - method not in rpcAllowlist")
+		return nil, fmt.Errorf("collectDiagnostics is not enabled on this host (add it to rpcAllowlist)")
+	}
+
+	var request types.CollectDiagnosticsRequest
+	if len(params) > 0 {
+		if err := json.Unmarshal(params, &request); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal CollectDiagnosticsRequest: %w", err)
+		}
+	}
+
+	c.logger.WithField("request_id", request.RequestID).Info("🩺 Collecting diagnostics for backend")
+
+	data, err := diagnostics.Collect(c.currentConfig(), c.currentConfig().ConfigPath, ServiceName, c.logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to collect diagnostics: %w", err)
+	}
+
+	total := (len(data) + DiagnosticsChunkSize - 1) / DiagnosticsChunkSize
+	for i := 0; i < total; i++ {
+		end := (i + 1) * DiagnosticsChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+
+		chunk := types.DiagnosticsChunk{
+			ClientID:  c.currentConfig().GetClientID(),
+			RequestID: request.RequestID,
+			Index:     i,
+			Total:     total,
+			Data:      base64.StdEncoding.EncodeToString(data[i*DiagnosticsChunkSize : end]),
+		}
+		if err := c.rpcClient.Notify("diagnosticsChunk", chunk); err != nil {
+			return nil, fmt.Errorf("failed to send diagnostics chunk %d/%d: %w", i+1, total, err)
+		}
+	}
+
+	sum := sha256.Sum256(data)
+	c.logger.WithFields(logrus.Fields{
+		"request_id": request.RequestID,
+		"size":       len(data),
+		"chunks":     total,
+	}).Info("📤 Diagnostics bundle sent")
+
+	return types.CollectDiagnosticsResponse{
+		RequestID: request.RequestID,
+		Size:      len(data),
+		Chunks:    total,
+		SHA256:    hex.EncodeToString(sum[:]),
+	}, nil
+}
+
+// handleFetchFile returns an excerpt of an allowlisted file. Every request,
+// including rejected ones, is logged as an audit record.
+func (c *Client) handleFetchFile(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var request types.FetchFileRequest
+	if len(params) > 0 {
+		if err := json.Unmarshal(params, &request); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal FetchFileRequest: %w", err)
+		}
+	}
+
+	audit := c.logger.WithFields(logrus.Fields{
+		"audit":      "fetchFile",
+		"request_id": request.RequestID,
+		"path":       request.Path,
+	})
+
+	if !c.currentConfig().IsRPCAllowed("fetchFile") {
+		audit.WithField("outcome", "rejected").Warn("🚫 Rejected fetchFile request - method not in rpcAllowlist")
+		return nil, fmt.Errorf("fetchFile is not enabled on this host (add it to rpcAllowlist)")
+	}
+
+	config := c.currentConfig()
+	maxBytes := config.GetFetchFileMaxBytes()
+	if request.MaxBytes > 0 && request.MaxBytes < maxBytes {
+		maxBytes = request.MaxBytes
+	}
+
+	result, err := fetchfile.Read(request.Path, config.FetchFileAllowlist, fetchfile.Denied(config), maxBytes, request.Tail)
+	if err != nil {
+		audit.WithError(err).WithField("outcome", "denied").Warn("🚫 fetchFile request refused")
+		return nil, err
+	}
+
+	audit.WithFields(logrus.Fields{
+		"outcome":   "served",
+		"size":      result.Size,
+		"offset":    result.Offset,
+		"length":    len(result.Data),
+		"truncated": result.Truncated,
+		"sha256":    result.SHA256,
+	}).Info("📄 File excerpt sent to backend")
+
+	return types.FetchFileResponse{
+		RequestID: request.RequestID,
+		Path:      result.Path,
+		Size:      result.Size,
+		Offset:    result.Offset,
+		Length:    len(result.Data),
+		Truncated: result.Truncated,
+		SHA256:    result.SHA256,
+		Data:      base64.StdEncoding.EncodeToString(result.Data),
+	}, nil
 }
 
 func (c *Client) WaitUntilConnected() error {
@@ -316,31 +1086,105 @@ func (c *Client) WaitUntilConnected() error {
 }
 
 func (c *Client) Run() error {
-	if err := c.Connect(); err != nil {
-		return err
+	c.shutdownMu.Lock()
+	if c.isShutdown {
+		c.shutdownMu.Unlock()
+		return ErrShutdown
+	}
+	c.supervising = true
+	c.shutdownMu.Unlock()
+
+	go c.scheduler.Run(c.schedulerStop)
+	go c.runReaper(c.schedulerStop)
+	go c.runAuditShipper(c.schedulerStop)
+	if runtime.GOOS != "windows" {
+		go c.runSSHDChecker(c.schedulerStop)
+	}
+	if c.currentConfig().GetSessionRecording() != nil && runtime.GOOS != "windows" {
+		go c.runRecordingShipper(c.schedulerStop)
+	}
+	if c.currentConfig().GetSessionReportInterval() > 0 && runtime.GOOS != "windows" {
+		go c.runSessionReporter(c.schedulerStop)
+	}
+
+	if len(c.currentConfig().GetTunnelEndpoints()) > 1 {
+		if c.currentConfig().GetEndpointSelection() == types.EndpointSelectionPriority {
+			c.setEndpoint(endpoint.Probe{URL: c.currentConfig().TunnelHost}, c.currentConfig().GetTunnelEndpoints(), endpointReasonConfigured)
+		} else {
+			c.selectEndpoint()
+		}
+		go c.startEndpointProbe()
+	} else {
+		c.recordEndpoint()
 	}
 
-	<-c.ctx.Done()
-	return c.ctx.Err()
+	// Forget the previous run's connection
+	c.updateConnection(func(state *connection.State) {
+		*state = connection.State{}
+	})
+
+	return c.supervise()
 }
 
+// Shutdown drains the agent and closes the tunnel, returning once the agent
+// has stopped. Calls after the first only wait for that.
 func (c *Client) Shutdown() {
 	c.shutdownMu.Lock()
+	if c.isShutdown {
+		c.shutdownMu.Unlock()
+		<-c.stopped
+		return
+	}
 	c.isShutdown = true
+	supervising := c.supervising
 	c.shutdownMu.Unlock()
 
-	close(c.heartbeatStop)
-	c.cancel()
+	close(c.stopping)
+	if !supervising {
+		c.stop(nil)
+		close(c.stopped)
+	}
+	<-c.stopped
+}
+
+// drain rejects new requests and waits up to timeout for requests being
+// handled and scheduled grants being applied to finish. It reports whether
+// they did.
+func (c *Client) drain(timeout time.Duration) bool {
+	requests := c.rpcClient.Drain()
 
-	if err := c.rpcClient.Close(); err != nil {
-		c.logger.WithError(err).Warn("Error closing RPC client")
+	scriptsDone := make(chan struct{})
+	go func() {
+		<-requests
+		for scripts.InFlight() > 0 {
+			time.Sleep(drainPollInterval)
+		}
+		close(scriptsDone)
+	}()
+
+	select {
+	case <-scriptsDone:
+		return true
+	case <-time.After(drainPollInterval):
 	}
 
-	c.logger.Info("Client shutdown completed")
+	c.logger.WithFields(logrus.Fields{
+		"in_flight": scripts.InFlight(),
+		"timeout":   timeout,
+	}).Info("⏳ Waiting for in-flight provisioning to finish")
+
+	select {
+	case <-scriptsDone:
+		c.logger.Info("✅ In-flight provisioning finished")
+		return true
+	case <-time.After(timeout):
+		c.logger.WithField("in_flight", scripts.InFlight()).Warn("⚠️ Drain timed out, provisioning scripts are still running")
+		return false
+	}
 }
 
-func (c *Client) startHeartbeat() {
-	heartbeatInterval := c.config.GetHeartbeatInterval()
+func (c *Client) startHeartbeat(t *tunnel) {
+	heartbeatInterval := c.heartbeatInterval()
 	ticker := time.NewTicker(heartbeatInterval)
 	defer ticker.Stop()
 
@@ -351,10 +1195,13 @@ func (c *Client) startHeartbeat() {
 		case <-ticker.C:
 			if err := c.sendHeartbeat(); err != nil {
 				c.logger.WithError(err).Error("💔 Heartbeat failed - connection may be lost")
-				c.forceReconnect()
+				c.connectionFailed(err)
+				c.reconnect(t.generation, err)
 				return
 			}
-		case <-c.heartbeatStop:
+		case <-c.heartbeatReset:
+			ticker.Reset(c.heartbeatInterval())
+		case <-t.stop:
 			c.logger.Info("🫀 Heartbeat monitor stopped")
 			return
 		case <-c.ctx.Done():
@@ -367,9 +1214,10 @@ func (c *Client) sendHeartbeat() error {
 	c.logger.Debug("🫀 Sending heartbeat (setClientId)")
 
 	start := time.Now()
-	_, err := c.rpcClient.Call("setClientId", types.SetClientIDRequest{
-		ClientID: c.config.GetClientID(),
-	})
+	result, err := c.rpcClient.CallWithTimeout("setClientId", c.heartbeatRequest(), c.heartbeatTimeout())
+	if err == nil {
+		err = c.checkHeartbeatAck(result)
+	}
 
 	if err != nil {
 		duration := time.Since(start)
@@ -377,6 +1225,7 @@ func (c *Client) sendHeartbeat() error {
 			"error":    err.Error(),
 			"duration": duration,
 		}).Error("🚨 Heartbeat call failed")
+		metrics.HeartbeatFailures.Inc()
 		return err
 	}
 
@@ -384,64 +1233,105 @@ func (c *Client) sendHeartbeat() error {
 	c.lastHeartbeat = time.Now()
 	c.heartbeatMu.Unlock()
 
+	c.touchJournal()
+	c.updateConnection(func(state *connection.State) {
+		state.LastHeartbeat = time.Now().UTC().Format(time.RFC3339)
+	})
+
 	duration := time.Since(start)
+	metrics.HeartbeatLatency.Observe(duration.Seconds())
+	metrics.LastHeartbeat.Set(float64(c.lastHeartbeat.Unix()))
 	c.logger.WithFields(logrus.Fields{
 		"duration":  duration,
-		"client_id": c.config.GetClientID(),
+		"client_id": c.currentConfig().GetClientID(),
 		"timestamp": c.lastHeartbeat.Format(time.RFC3339),
 	}).Info("💚 Heartbeat successful")
 
 	return nil
 }
 
-func (c *Client) resetContext() {
-	c.cancel()
-	c.ctx, c.cancel = context.WithCancel(context.Background())
+// heartbeatTimeout is how long a heartbeat waits for its reply before the
+// connection is treated as lost. Requests are handled off the connection's read
+// loop, so the reply is never queued behind running provisioning scripts.
+func (c *Client) heartbeatTimeout() time.Duration {
+	if interval := c.heartbeatInterval(); interval < MaxHeartbeatTimeout {
+		return interval
+	}
+	return MaxHeartbeatTimeout
 }
 
-func (c *Client) forceReconnect() {
-	c.reconnectMu.Lock()
-	if c.reconnecting {
-		c.reconnectMu.Unlock()
-		c.logger.Debug("🔄 Reconnection already in progress, skipping")
-		return
+// checkHeartbeatAck fails when the reply to setClientId shows the backend no
+// longer recognizes this client. The reconnection that follows is then
+// refused with 401 or 403, which stops the agent as at startup.
+func (c *Client) checkHeartbeatAck(result json.RawMessage) error {
+	var ack types.SetClientIDResponse
+	if err := json.Unmarshal(result, &ack); err != nil {
+		// Older backends reply with a bare value
+		return nil
 	}
 
-	c.reconnecting = true
-	c.reconnectMu.Unlock()
-
-	c.logger.Warn("🔄 Forcing reconnection due to connection failure")
-
-	close(c.heartbeatStop)
-	c.heartbeatStop = make(chan struct{})
-
-	c.connMu.Lock()
-	if c.conn != nil {
-		c.conn.Close()
-		c.conn = nil
+	clientID := c.currentConfig().GetClientID()
+	if ack.OK != nil && !*ack.OK {
+		if ack.Error != "" {
+			return fmt.Errorf("backend no longer recognizes client %s: %s", clientID, ack.Error)
+		}
+		return fmt.Errorf("backend no longer recognizes client %s", clientID)
 	}
-	c.connMu.Unlock()
-
-	if err := c.rpcClient.Close(); err != nil {
-		c.logger.WithError(err).Debug("Error closing RPC client during reconnect")
+	if ack.ClientID != "" && ack.ClientID != clientID {
+		return fmt.Errorf("backend acknowledged client %s instead of %s", ack.ClientID, clientID)
 	}
+	return nil
+}
 
-	c.resetContext()
+// heartbeatRequest builds the setClientId payload, including the grant backlog,
+// interface addresses, current labels, sshd health and any operator
+// annotations. The low bandwidth profile leaves out the interface inventory.
+func (c *Client) heartbeatRequest() types.SetClientIDRequest {
+	backlog := c.scheduler.Backlog()
+	request := types.SetClientIDRequest{
+		ClientID: c.currentConfig().GetClientID(),
+		Backlog: &types.GrantBacklog{
+			Queued:       backlog.Queued,
+			InFlight:     scripts.InFlight(),
+			Failed:       backlog.Failed,
+			ExpiringSoon: backlog.ExpiringSoon,
+			Undelivered:  c.undeliveredCount(),
+		},
+		Interfaces: utils.GetNetworkInterfaces(c.currentConfig().GetCollection(), c.logger),
+		Labels:     labels.Evaluate(c.currentConfig(), c.logger),
+		Endpoint:   c.currentEndpoint(),
+		Omitted:    c.currentConfig().GetCollection().Omitted(),
+		SSHD:       c.currentSSHDHealth(),
+		Disabled:   c.hostDisabled(),
+		AuditHead:  c.auditHead(),
+	}
+	if c.lowBandwidth() {
+		request.Interfaces = nil
+		request.BandwidthProfile = types.BandwidthProfileLow
+	}
 
-	go func() {
-		defer func() {
-			c.reconnectMu.Lock()
-			c.reconnecting = false
-			c.reconnectMu.Unlock()
-		}()
+	active, err := annotations.Load(c.currentConfig().StateDir)
+	if err != nil {
+		c.logger.WithError(err).Warn("Failed to load annotations, sending heartbeat without them")
+		return request
+	}
 
-		c.logger.Info("🔄 Starting reconnection process")
-		if err := c.Connect(); err != nil {
-			c.logger.WithError(err).Error("❌ Reconnection failed")
-		}
-	}()
+	request.Annotations = active
+	return request
 }
 
+// auditHead returns the newest audit log entry for heartbeats
+func (c *Client) auditHead() *types.AuditHead {
+	head, err := audit.Head(audit.Path(c.currentConfig().StateDir))
+	if err != nil {
+		c.logger.WithError(err).Warn("Failed to read the audit log head, sending heartbeat without it")
+		return nil
+	}
+	if head == nil {
+		return nil
+	}
+	return &types.AuditHead{Seq: head.Seq, Hash: head.Hash}
+}
 
 func (c *Client) GetLastHeartbeat() time.Time {
 	c.heartbeatMu.RLock()
@@ -459,7 +1349,7 @@ func (c *Client) IsConnectionHealthy() bool {
 	}
 
 	timeSinceLastHeartbeat := time.Since(lastHeartbeat)
-	maxAllowedGap := c.config.GetHeartbeatInterval() * 2
+	maxAllowedGap := c.heartbeatInterval() * 2
 
 	healthy := timeSinceLastHeartbeat < maxAllowedGap
 
@@ -474,4 +1364,3 @@ func (c *Client) IsConnectionHealthy() bool {
 
 	return healthy
 }
-
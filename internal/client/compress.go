@@ -0,0 +1,51 @@
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+
+	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/types"
+)
+
+// compressResponse replaces response data whose JSON encoding exceeds
+// threshold bytes with its gzipped, base64-encoded form. Data that does not
+// shrink is sent as is.
+func (c *Client) compressResponse(response *types.ForwardedResponse, threshold int) {
+	// Binary bodies of targets are already encoded
+	if response.ContentEncoding != "" {
+		return
+	}
+
+	data, err := json.Marshal(response.Data)
+	if err != nil || len(data) <= threshold {
+		return
+	}
+
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(data); err != nil {
+		c.logger.WithError(err).Warn("Failed to compress response, sending it uncompressed")
+		return
+	}
+	if err := writer.Close(); err != nil {
+		c.logger.WithError(err).Warn("Failed to compress response, sending it uncompressed")
+		return
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(buf.Bytes())
+	if len(encoded) >= len(data) {
+		return
+	}
+
+	c.logger.WithFields(logrus.Fields{
+		"original_bytes":   len(data),
+		"compressed_bytes": len(encoded),
+	}).Debug("Compressed response data")
+
+	response.Data = encoded
+	response.ContentEncoding = types.ContentEncodingGzipBase64
+}
@@ -0,0 +1,82 @@
+package client
+
+import (
+	"time"
+
+	"p0-ssh-agent/internal/connection"
+	"p0-ssh-agent/internal/metrics"
+)
+
+// updateConnection applies change to the connection record and saves it for
+// the status command
+func (c *Client) updateConnection(change func(*connection.State)) {
+	c.connStateMu.Lock()
+	defer c.connStateMu.Unlock()
+
+	change(&c.connState)
+	c.connState.HeartbeatIntervalSeconds = int(c.heartbeatInterval() / time.Second)
+	c.connState.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+
+	if err := connection.Save(connection.Path(c.currentConfig().StateDir), c.connState); err != nil {
+		c.logger.WithError(err).Debug("Failed to record connection state")
+	}
+}
+
+// connectionEstablished records a connection whose setClientId succeeded
+func (c *Client) connectionEstablished() {
+	now := time.Now().UTC().Format(time.RFC3339)
+	c.updateConnection(func(state *connection.State) {
+		state.Connected = true
+		state.Endpoint = c.tunnelURL()
+		state.ConnectedSince = now
+		state.TokenExpiresAt = c.tokenExpiry().UTC().Format(time.RFC3339)
+		state.LastHeartbeat = now
+		state.Reconnecting = false
+		state.FailedAttempts = 0
+		state.FailingSince = ""
+		state.BackoffSeconds = 0
+		state.NextAttempt = ""
+		state.GaveUp = false
+		state.LastError = ""
+	})
+	metrics.ReconnectAttempts.Set(0)
+	metrics.ReconnectBackoff.Set(0)
+}
+
+// connectionAttemptFailed records a failed connection attempt and the backoff
+// before the next one
+func (c *Client) connectionAttemptFailed(err error, delay time.Duration) {
+	c.updateConnection(func(state *connection.State) {
+		state.Connected = false
+		state.FailedAttempts = c.backoff.Count()
+		state.FailingSince = c.backoff.FailingSince().UTC().Format(time.RFC3339)
+		state.BackoffSeconds = delay.Seconds()
+		state.NextAttempt = time.Now().Add(delay).UTC().Format(time.RFC3339)
+		state.LastError = err.Error()
+	})
+	metrics.ReconnectAttempts.Set(float64(c.backoff.Count()))
+	metrics.ReconnectBackoff.Set(delay.Seconds())
+}
+
+// connectionGaveUp records that the reconnect policy ran out after err
+func (c *Client) connectionGaveUp(err error) {
+	c.updateConnection(func(state *connection.State) {
+		state.Connected = false
+		state.Reconnecting = false
+		state.FailedAttempts = c.backoff.Count()
+		state.FailingSince = c.backoff.FailingSince().UTC().Format(time.RFC3339)
+		state.BackoffSeconds = 0
+		state.NextAttempt = ""
+		state.GaveUp = true
+		state.LastError = err.Error()
+	})
+	metrics.ReconnectAttempts.Set(float64(c.backoff.Count()))
+	metrics.ReconnectBackoff.Set(0)
+}
+
+// connectionFailed records the error that is about to force a reconnect
+func (c *Client) connectionFailed(err error) {
+	c.updateConnection(func(state *connection.State) {
+		state.LastError = err.Error()
+	})
+}
@@ -0,0 +1,142 @@
+package client
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"p0-ssh-agent/internal/connection"
+	"p0-ssh-agent/internal/control"
+	"p0-ssh-agent/internal/state"
+	"p0-ssh-agent/internal/version"
+	"p0-ssh-agent/scripts"
+)
+
+// Client implements control.Agent for the control socket
+var _ control.Agent = (*Client)(nil)
+
+func (c *Client) Health() control.Health {
+	config := c.currentConfig()
+	conn := c.Connection()
+
+	profile, _ := c.bandwidthProfile()
+	reason, _ := c.announcedShutdown()
+	return control.Health{
+		Healthy:          conn.Connected && c.IsConnectionHealthy(),
+		Version:          version.GetVersion(),
+		ClientID:         config.GetClientID(),
+		PID:              os.Getpid(),
+		StartedAt:        control.FormatTime(c.startedAt),
+		Connected:        conn.Connected,
+		LastHeartbeat:    conn.LastHeartbeat,
+		Draining:         c.draining.Load(),
+		InFlight:         scripts.InFlight(),
+		DryRun:           config.DryRun,
+		BandwidthProfile: profile,
+		GoingDown:        reason,
+	}
+}
+
+func (c *Client) Connection() connection.State {
+	c.connStateMu.Lock()
+	defer c.connStateMu.Unlock()
+	return c.connState
+}
+
+// Grants lists provisioned grants that have not expired or been revoked,
+// joined with grants the scheduler is still holding for a window
+func (c *Client) Grants() ([]control.Grant, error) {
+	byKey := make(map[string]control.Grant)
+
+	for _, record := range c.scheduler.Pending() {
+		byKey[record.Key] = control.Grant{
+			Key:       record.Key,
+			RequestID: record.Request.RequestID,
+			Command:   record.Command,
+			UserName:  record.Request.UserName,
+			Status:    record.Status,
+			ValidFrom: control.FormatTime(record.ValidFrom),
+			ValidTo:   control.FormatTime(record.ValidTo),
+			Batch:     record.Batch,
+		}
+	}
+
+	provisioned, err := state.Load(state.Path(c.currentConfig().StateDir))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read provisioning state: %w", err)
+	}
+	now := time.Now()
+	for _, applied := range provisioned {
+		if applied.Status != state.StatusGranted || applied.Expired(now) {
+			continue
+		}
+		grant := byKey[applied.Key]
+		grant.Key = applied.Key
+		grant.RequestID = applied.RequestID
+		grant.Command = applied.Command
+		grant.UserName = applied.UserName
+		grant.Status = applied.Status
+		grant.GrantedAt = control.FormatTime(applied.GrantedAt)
+		grant.ExpiresAt = control.FormatTime(applied.ExpiresAt)
+		byKey[applied.Key] = grant
+	}
+
+	grants := make([]control.Grant, 0, len(byKey))
+	for _, grant := range byKey {
+		grants = append(grants, grant)
+	}
+	sort.Slice(grants, func(i, j int) bool { return grants[i].Key < grants[j].Key })
+	return grants, nil
+}
+
+// Reconnect drops the tunnel and dials again. While disconnected the agent
+// is already retrying, so there is nothing to drop.
+func (c *Client) Reconnect() error {
+	switch c.lifecycle() {
+	case stateDraining, stateStopped:
+		return fmt.Errorf("the agent is stopping: %w", control.ErrConflict)
+	}
+	if !c.Connection().Connected {
+		return fmt.Errorf("the tunnel is not connected and is already being retried: %w", control.ErrConflict)
+	}
+	c.forceReconnect()
+	return nil
+}
+
+// Drain stops taking requests from the backend, then waits up to timeout
+// (shutdownDrainSeconds when zero) for running provisioning. The agent stays
+// drained until it is restarted; scheduled grants and expiry revokes keep
+// running so access still starts and ends on time.
+func (c *Client) Drain(timeout time.Duration) control.DrainResult {
+	if timeout <= 0 {
+		timeout = c.currentConfig().GetShutdownDrainTimeout()
+	}
+
+	if !c.draining.Swap(true) {
+		c.logger.Warn("🚧 Draining: new requests are rejected until the agent restarts")
+	}
+	idle := c.drain(timeout)
+
+	return control.DrainResult{
+		Draining: true,
+		Idle:     idle,
+		InFlight: scripts.InFlight(),
+	}
+}
+
+// Revoke cancels matching grants the scheduler still holds, so a window that
+// has not started never grants access, then revokes matching recorded
+// grants and terminates the users' sessions
+func (c *Client) Revoke(filter scripts.RevokeFilter) control.RevokeResult {
+	dryRun := c.currentConfig().DryRun
+
+	var cancelled []string
+	if !dryRun {
+		cancelled = c.scheduler.CancelMatching(func(req scripts.ProvisioningRequest) bool {
+			return filter.Matches(req.UserName, req.RequestID)
+		})
+	}
+
+	return control.NewRevokeResult(cancelled, scripts.RevokeRecorded(filter, dryRun, c.logger))
+}
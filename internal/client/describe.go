@@ -0,0 +1,118 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"p0-ssh-agent/internal/version"
+	"p0-ssh-agent/scripts"
+	"p0-ssh-agent/types"
+)
+
+// optionalRPCs are registered on every agent but only answered when listed in
+// rpcAllowlist
+var optionalRPCs = map[string]bool{
+	"collectDiagnostics": true,
+	"fetchFile":          true,
+}
+
+// handleDescribeAgent reports the build, the commands and RPC methods it
+// supports and the optional features the configuration enables, so the
+// backend can render capability matrices and stage feature rollouts
+func (c *Client) handleDescribeAgent(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	config := c.currentConfig()
+
+	var methods []string
+	for _, method := range c.rpcClient.Methods() {
+		if !optionalRPCs[method] || config.IsRPCAllowed(method) {
+			methods = append(methods, method)
+		}
+	}
+
+	return types.DescribeAgentResponse{
+		Version:                 version.GetVersion(),
+		GitCommit:               version.GetGitCommit(),
+		BuildTime:               version.GetBuildTime(),
+		GoVersion:               runtime.Version(),
+		OS:                      runtime.GOOS,
+		Arch:                    runtime.GOARCH,
+		ConfigVersion:           config.Version,
+		SupportedConfigVersions: types.SupportedConfigVersions,
+		Commands:                scripts.KnownCommands(),
+		Methods:                 methods,
+		Features:                c.features(config),
+	}, nil
+}
+
+// features lists the optional behaviour of this agent and whether the
+// configuration in effect turns it on
+func (c *Client) features(config *types.Config) []types.AgentFeature {
+	profile, _ := c.bandwidthProfile()
+
+	compress := types.AgentFeature{Name: "compressResponses"}
+	if threshold := c.compressThreshold(); threshold > 0 {
+		compress.Enabled, compress.Value = true, strconv.Itoa(threshold)
+	}
+	sinks := types.AgentFeature{Name: "auditSinks"}
+	if len(config.AuditSinks) > 0 {
+		var kinds []string
+		for _, sink := range config.AuditSinks {
+			kinds = append(kinds, sink.Type)
+		}
+		sinks.Enabled, sinks.Value = true, strings.Join(kinds, ",")
+	}
+	keysFile, _, _ := scripts.ResolveAuthorizedKeysFile(context.Background(), config.GetAuthorizedKeysFile())
+	failover := types.AgentFeature{Name: "endpointFailover"}
+	if len(config.TunnelHosts) > 0 {
+		failover.Enabled, failover.Value = true, config.GetEndpointSelection()
+	}
+	targets := types.AgentFeature{Name: "targets"}
+	if len(config.Targets) > 0 {
+		var names []string
+		for _, target := range config.Targets {
+			names = append(names, target.Name)
+		}
+		targets.Enabled, targets.Value = true, strings.Join(names, ",")
+	}
+	sessions := types.AgentFeature{Name: "sessionReport"}
+	if interval := config.GetSessionReportInterval(); interval > 0 {
+		sessions.Enabled, sessions.Value = true, strconv.Itoa(int(interval.Seconds()))
+	}
+	recording := types.AgentFeature{Name: "sessionRecording"}
+	if sessionRecording := config.GetSessionRecording(); sessionRecording != nil {
+		recording.Enabled, recording.Value = true, sessionRecording.GetDestination()
+	}
+
+	scriptTimeout := types.AgentFeature{Name: "scriptTimeout"}
+	if timeout := config.ScriptLimits.GetDefaultTimeout(); timeout > 0 {
+		scriptTimeout.Enabled, scriptTimeout.Value = true, strconv.Itoa(int(timeout.Seconds()))
+	}
+
+	return []types.AgentFeature{
+		sinks,
+		{Name: "authorizedKeysLayout", Enabled: true, Value: keysFile},
+		{Name: "bandwidthProfile", Enabled: true, Value: profile},
+		{Name: "collectDiagnostics", Enabled: config.IsRPCAllowed("collectDiagnostics")},
+		compress,
+		{Name: "controlSocket", Enabled: config.GetControlSocket() != ""},
+		{Name: "dryRun", Enabled: config.DryRun},
+		failover,
+		{Name: "fetchFile", Enabled: config.IsRPCAllowed("fetchFile")},
+		{Name: "killSwitch", Enabled: true, Value: config.GetDisabledFile()},
+		{Name: "metrics", Enabled: config.MetricsAddress != ""},
+		{Name: "reconnectJitter", Enabled: true, Value: string(config.Reconnect.GetJitter())},
+		{Name: "requiredMetadata", Enabled: len(config.RequiredMetadata) > 0},
+		scriptTimeout,
+		recording,
+		sessions,
+		{Name: "signResponses", Enabled: config.SignResponses},
+		{Name: "streamOutput", Enabled: config.StreamOutput},
+		{Name: "sudoersLayout", Enabled: true, Value: config.GetSudoersLayout()},
+		{Name: "targetCache", Enabled: config.TargetCache != nil && config.TargetCache.Enabled},
+		targets,
+		{Name: "userResolution", Enabled: true, Value: config.GetUserResolution()},
+	}
+}
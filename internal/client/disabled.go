@@ -0,0 +1,81 @@
+package client
+
+import (
+	"encoding/json"
+
+	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/internal/audit"
+	"p0-ssh-agent/internal/metrics"
+	"p0-ssh-agent/internal/policy"
+	"p0-ssh-agent/scripts"
+	"p0-ssh-agent/types"
+)
+
+// hostDisabled returns the state of the kill switch, which is checked anew
+// every time so that creating or removing the file takes effect at once. It
+// logs when the switch is turned on or off.
+func (c *Client) hostDisabled() *types.HostDisabled {
+	disabled := policy.CheckDisabled(c.currentConfig().GetDisabledFile())
+	on := disabled != nil
+	if c.disabled.Swap(on) == on {
+		return disabled
+	}
+
+	if on {
+		metrics.HostDisabled.Set(1)
+		c.logger.WithFields(logrus.Fields{
+			"file":   disabled.File,
+			"reason": disabled.Reason,
+		}).Warn("🛑 Kill switch is on - refusing grants")
+	} else {
+		metrics.HostDisabled.Set(0)
+		c.logger.WithField("file", c.currentConfig().GetDisabledFile()).Info("✅ Kill switch is off - provisioning resumed")
+	}
+	return disabled
+}
+
+// grantDisabled returns the kill switch state when command grants access and
+// the switch is on. Revokes, bulkRevoke and provisionSession always go
+// through, so the switch, or a kill switch file that cannot be checked, never
+// keeps access in place.
+func (c *Client) grantDisabled(command string, data interface{}) *types.HostDisabled {
+	if command == "" {
+		return nil
+	}
+	if scripts.Command(command) != scripts.CommandStageGrants {
+		fields, _ := data.(map[string]interface{})
+		if action, _ := fields["action"].(string); action != "grant" {
+			return nil
+		}
+	}
+	return c.hostDisabled()
+}
+
+// refuseDisabled answers a grant while the kill switch is on
+// and records the refusal in the audit log
+func (c *Client) refuseDisabled(command string, data interface{}, origin *audit.Origin, disabled *types.HostDisabled) scripts.ProvisioningResult {
+	violation := policy.DisabledViolation(disabled)
+
+	// Only for the audit log; bulk commands record their batch ID
+	var req scripts.ProvisioningRequest
+	if dataBytes, err := json.Marshal(data); err == nil {
+		json.Unmarshal(dataBytes, &req)
+	}
+	req.Origin = origin
+
+	c.logger.WithFields(logrus.Fields{
+		"command":    command,
+		"request_id": req.RequestID,
+		"file":       disabled.File,
+	}).Warn("🛑 Refused provisioning request - kill switch is on")
+
+	result := scripts.ProvisioningResult{
+		Success: false,
+		Error:   violation.Message,
+		Status:  policy.StatusRejected,
+		Data:    violation,
+	}
+	scripts.RecordRejected(command, req, c.currentConfig().DryRun, result, c.logger)
+	return result
+}
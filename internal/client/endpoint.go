@@ -0,0 +1,239 @@
+package client
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/internal/endpoint"
+	"p0-ssh-agent/internal/metrics"
+	"p0-ssh-agent/scripts"
+	"p0-ssh-agent/types"
+)
+
+// tunnelURL is the endpoint the next connection attempt dials
+func (c *Client) tunnelURL() string {
+	c.endpointMu.RLock()
+	defer c.endpointMu.RUnlock()
+	return c.endpoint.URL
+}
+
+// currentEndpoint is the selected endpoint as reported in heartbeats
+func (c *Client) currentEndpoint() *types.TunnelEndpoint {
+	c.endpointMu.RLock()
+	defer c.endpointMu.RUnlock()
+	current := c.endpoint
+	return &current
+}
+
+// Reasons reported for the selected endpoint
+const (
+	endpointReasonConfigured = "configured"
+	endpointReasonLatency    = "latency"
+	endpointReasonFailover   = "failover"
+	endpointReasonFailback   = "failback"
+)
+
+func (c *Client) setEndpoint(probe endpoint.Probe, candidates []string, reason string) {
+	c.endpointMu.Lock()
+	c.endpoint = types.TunnelEndpoint{
+		URL:        probe.URL,
+		RTTMs:      float64(probe.RTT.Microseconds()) / 1000,
+		Candidates: len(candidates),
+		SelectedAt: time.Now().UTC().Format(time.RFC3339),
+		Priority:   endpoint.Priority(candidates, probe.URL),
+		Reason:     reason,
+	}
+	c.connectFailures = 0
+	c.endpointMu.Unlock()
+
+	c.recordEndpoint()
+}
+
+// recordEndpoint saves the connection target for the status command
+func (c *Client) recordEndpoint() {
+	if err := endpoint.Save(endpoint.Path(c.currentConfig().StateDir), *c.currentEndpoint()); err != nil {
+		c.logger.WithError(err).Debug("Failed to record tunnel endpoint")
+	}
+}
+
+// connectFailed runs after a failed connection attempt. With latency
+// selection the endpoints are probed again; with priority selection the agent
+// moves to the next endpoint once the current one has failed
+// failoverAfterAttempts times in a row.
+func (c *Client) connectFailed() {
+	candidates := c.currentConfig().GetTunnelEndpoints()
+	if len(candidates) < 2 {
+		return
+	}
+
+	if c.currentConfig().GetEndpointSelection() != types.EndpointSelectionPriority {
+		c.selectEndpoint()
+		return
+	}
+
+	c.endpointMu.Lock()
+	c.connectFailures++
+	failures := c.connectFailures
+	c.endpointMu.Unlock()
+
+	if failures < c.currentConfig().GetFailoverAfterAttempts() {
+		return
+	}
+
+	current := c.tunnelURL()
+	next := endpoint.Next(candidates, current)
+	c.setEndpoint(endpoint.Probe{URL: next}, candidates, endpointReasonFailover)
+
+	c.logger.WithFields(logrus.Fields{
+		"from":     current,
+		"to":       next,
+		"attempts": failures,
+		"priority": endpoint.Priority(candidates, next),
+	}).Warn("🔀 Tunnel endpoint unreachable, failing over to the next endpoint")
+	metrics.EndpointSwitches.Inc()
+}
+
+// connectSucceeded clears the failed attempts counted towards a failover
+func (c *Client) connectSucceeded() {
+	c.endpointMu.Lock()
+	defer c.endpointMu.Unlock()
+	c.connectFailures = 0
+}
+
+// selectEndpoint probes every configured tunnel host and picks the one with
+// the lowest connect time. The current endpoint is kept when none answers.
+func (c *Client) selectEndpoint() {
+	candidates := c.currentConfig().GetTunnelEndpoints()
+	if len(candidates) < 2 {
+		return
+	}
+
+	probes := endpoint.ProbeAll(c.ctx, candidates, c.currentConfig().GetTunnelTimeout())
+	for _, probe := range probes {
+		fields := logrus.Fields{"url": probe.URL, "rtt": probe.RTT}
+		if probe.Err != nil {
+			c.logger.WithFields(fields).WithError(probe.Err).Debug("Tunnel endpoint probe failed")
+			continue
+		}
+		c.logger.WithFields(fields).Debug("Tunnel endpoint probed")
+	}
+
+	best := probes[0]
+	if best.Err != nil {
+		c.logger.WithField("url", c.tunnelURL()).Warn("⚠️ No tunnel endpoint answered latency probes, keeping the current one")
+		return
+	}
+
+	changed := best.URL != c.tunnelURL()
+	c.setEndpoint(best, candidates, endpointReasonLatency)
+
+	if changed {
+		c.logger.WithFields(logrus.Fields{
+			"url": best.URL,
+			"rtt": best.RTT,
+		}).Info("🌐 Selected lowest-latency tunnel endpoint")
+	}
+}
+
+// startEndpointProbe re-measures endpoints periodically and moves the
+// connection when another endpoint is clearly faster or, with priority
+// selection, when a higher-priority endpoint has recovered. The move waits
+// for a probe with no provisioning in flight.
+func (c *Client) startEndpointProbe() {
+	interval := c.currentConfig().GetEndpointProbeInterval()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	c.logger.WithField("interval", interval).Info("🌐 Starting tunnel endpoint probes")
+
+	for {
+		select {
+		case <-ticker.C:
+			c.reevaluateEndpoint()
+		case <-c.probeStop:
+			return
+		}
+	}
+}
+
+func (c *Client) reevaluateEndpoint() {
+	if c.currentConfig().GetEndpointSelection() == types.EndpointSelectionPriority {
+		c.failBack()
+		return
+	}
+
+	candidates := c.currentConfig().GetTunnelEndpoints()
+	probes := endpoint.ProbeAll(c.ctx, candidates, c.currentConfig().GetTunnelTimeout())
+
+	current := c.tunnelURL()
+	var currentRTT time.Duration
+	for _, probe := range probes {
+		if probe.URL == current && probe.Err == nil {
+			currentRTT = probe.RTT
+		}
+	}
+
+	best := probes[0]
+	if best.Err != nil || best.URL == current || !endpoint.ShouldSwitch(currentRTT, best.RTT) {
+		return
+	}
+
+	if scripts.InFlight() > 0 {
+		c.logger.WithField("url", best.URL).Debug("Faster tunnel endpoint found, switching after provisioning finishes")
+		return
+	}
+
+	c.setEndpoint(best, candidates, endpointReasonLatency)
+
+	c.logger.WithFields(logrus.Fields{
+		"from":        current,
+		"to":          best.URL,
+		"current_rtt": currentRTT,
+		"rtt":         best.RTT,
+	}).Info("🌐 Moving to a faster tunnel endpoint")
+	metrics.EndpointSwitches.Inc()
+
+	c.forceReconnect()
+}
+
+// failBack returns to the highest-priority endpoint that answers a probe
+// when the agent is connected to a lower-priority one
+func (c *Client) failBack() {
+	candidates := c.currentConfig().GetTunnelEndpoints()
+	current := c.tunnelURL()
+
+	preferred := candidates
+	if priority := endpoint.Priority(candidates, current); priority > 0 {
+		preferred = candidates[:priority-1]
+	}
+	if len(preferred) == 0 {
+		return
+	}
+
+	probes := endpoint.ProbeAll(c.ctx, preferred, c.currentConfig().GetTunnelTimeout())
+	for _, candidate := range preferred {
+		for _, probe := range probes {
+			if probe.URL != candidate || probe.Err != nil {
+				continue
+			}
+
+			if scripts.InFlight() > 0 {
+				c.logger.WithField("url", probe.URL).Debug("Higher-priority tunnel endpoint recovered, failing back after provisioning finishes")
+				return
+			}
+
+			c.setEndpoint(probe, candidates, endpointReasonFailback)
+
+			c.logger.WithFields(logrus.Fields{
+				"from":     current,
+				"to":       probe.URL,
+				"priority": endpoint.Priority(candidates, probe.URL),
+			}).Info("🔙 Higher-priority tunnel endpoint recovered, failing back")
+			metrics.EndpointSwitches.Inc()
+
+			c.forceReconnect()
+			return
+		}
+	}
+}
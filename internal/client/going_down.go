@@ -0,0 +1,79 @@
+package client
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/internal/control"
+	"p0-ssh-agent/internal/osplugins"
+	"p0-ssh-agent/internal/rpc"
+	"p0-ssh-agent/types"
+)
+
+// goingDownTimeout bounds the goingDown call, so a backend that does not
+// answer never holds up a shutdown
+const goingDownTimeout = 3 * time.Second
+
+// AnnounceShutdown records why the agent is about to be stopped, e.g. before
+// a package upgrade restarts it. The reason is reported by the goingDown call
+// on shutdown and lasts until the agent restarts.
+func (c *Client) AnnounceShutdown(reason, message string) error {
+	switch reason {
+	case types.GoingDownShutdown, types.GoingDownUpgrade, types.GoingDownMaintenance, types.GoingDownRestart:
+	default:
+		return fmt.Errorf("reason must be one of %v (got %q): %w", types.GoingDownReasons, reason, control.ErrInvalid)
+	}
+
+	c.shutdownMu.Lock()
+	c.goingDownReason, c.goingDownMessage = reason, message
+	c.shutdownMu.Unlock()
+
+	c.logger.WithFields(logrus.Fields{
+		"reason":  reason,
+		"message": message,
+	}).Info("📴 Shutdown announced")
+	return nil
+}
+
+// announcedShutdown returns the reason recorded with AnnounceShutdown, if any
+func (c *Client) announcedShutdown() (reason, message string) {
+	c.shutdownMu.RLock()
+	defer c.shutdownMu.RUnlock()
+	return c.goingDownReason, c.goingDownMessage
+}
+
+// notifyGoingDown tells the backend the agent is stopping on purpose. Without
+// an announced reason it reports a shutdown while the host is going down and
+// a restart otherwise. It is best effort: a backend that is unreachable or
+// predates goingDown simply sees the connection close.
+func (c *Client) notifyGoingDown() {
+	reason, message := c.announcedShutdown()
+	if reason == "" {
+		reason = types.GoingDownRestart
+		if osplugins.Selected().ShuttingDown() {
+			reason = types.GoingDownShutdown
+		}
+	}
+
+	logger := c.logger.WithField("reason", reason)
+	if !c.Connection().Connected {
+		logger.Debug("Not connected, skipping goingDown notice")
+		return
+	}
+
+	_, err := c.rpcClient.CallWithTimeout("goingDown", types.GoingDownRequest{
+		ClientID: c.currentConfig().GetClientID(),
+		Reason:   reason,
+		Message:  message,
+	}, goingDownTimeout)
+	switch {
+	case err == nil:
+		logger.Info("📴 Told the backend the agent is going down")
+	case rpc.IsMethodNotFound(err):
+		logger.Debug("Backend does not support goingDown")
+	default:
+		logger.WithError(err).Warn("Failed to tell the backend the agent is going down")
+	}
+}
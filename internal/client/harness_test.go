@@ -0,0 +1,131 @@
+package client_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/internal/client"
+	"p0-ssh-agent/internal/harness"
+	"p0-ssh-agent/types"
+)
+
+func TestProvisionSudoThroughTunnel(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "freebsd" {
+		t.Skip("sudoers live in /etc on Linux only")
+	}
+
+	// visudo only has to be found on PATH; the executor answers it
+	bin := t.TempDir()
+	if err := os.WriteFile(filepath.Join(bin, "visudo"), []byte("#!/bin/sh\nexit 0\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	sandbox, err := harness.NewSandbox(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sandbox.Close()
+	if _, err := sandbox.AddUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	backend := harness.NewBackend()
+	defer backend.Close()
+
+	config, err := sandbox.AgentConfig(backend.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.StreamOutput = true
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	agent, err := client.New(config, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go agent.Run()
+	defer agent.Shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := backend.WaitConnected(ctx); err != nil {
+		t.Fatalf("agent never connected: %v", err)
+	}
+
+	var registered struct {
+		ClientID string `json:"clientId"`
+	}
+	if calls := backend.Received("setClientId"); len(calls) == 0 {
+		t.Fatal("setClientId was not called")
+	} else if err := json.Unmarshal(calls[0], &registered); err != nil || registered.ClientID != config.GetClientID() {
+		t.Errorf("setClientId params %s (%v), want client ID %s", calls[0], err, config.GetClientID())
+	}
+	if authz := backend.Authorizations(); len(authz) == 0 || !strings.HasPrefix(authz[0], "Bearer ") {
+		t.Errorf("Authorization headers %q, want a bearer token", authz)
+	}
+
+	response, err := backend.Call(ctx, map[string]interface{}{
+		"command":   "provisionSudo",
+		"action":    "grant",
+		"userName":  "alice",
+		"requestId": "req-1",
+		"sudo":      true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(response.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result struct {
+		Success bool   `json:"success"`
+		Command string `json:"command"`
+		Error   string `json:"error"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		t.Fatalf("response data %s: %v", data, err)
+	}
+	if response.Status != 200 || !result.Success || result.Command != "provisionSudo" {
+		t.Fatalf("response %d %s, want a successful provisionSudo", response.Status, data)
+	}
+
+	sudoers, err := sandbox.ReadFile("/etc/sudoers-p0")
+	if err != nil || !strings.Contains(sudoers, "alice ALL=(ALL) NOPASSWD: ALL") {
+		t.Errorf("/etc/sudoers-p0 = %q (%v), want alice's rule", sudoers, err)
+	}
+
+	// Output is sent in batches, so it may trail the response
+	var output []types.OutputNotification
+	for i := 0; i < 100 && len(output) == 0; i++ {
+		for _, params := range backend.Received("output") {
+			var notification types.OutputNotification
+			if err := json.Unmarshal(params, &notification); err != nil {
+				t.Fatalf("output notification %s: %v", params, err)
+			}
+			output = append(output, notification)
+		}
+		if len(output) == 0 {
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	if len(output) == 0 {
+		t.Fatal("no output notification was sent")
+	}
+	for _, notification := range output {
+		if notification.RequestID != "req-1" || notification.Command != "provisionSudo" {
+			t.Errorf("output notification for %s %s, want req-1 provisionSudo", notification.Command, notification.RequestID)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/internal/journal"
+	"p0-ssh-agent/internal/metrics"
+	"p0-ssh-agent/internal/rpc"
+	"p0-ssh-agent/types"
+)
+
+// replayActions are the request actions the backend is asked to re-send after
+// an outage. Missed grants are retried by the user; a missed revoke would
+// leave access in place.
+var replayActions = []string{"revoke"}
+
+func (c *Client) journalPath() string {
+	return journal.Path(c.currentConfig().StateDir)
+}
+
+// journalUndelivered keeps a result whose reply was lost so it can be handed
+// to the backend after the next reconnect
+func (c *Client) journalUndelivered(method string, params json.RawMessage, result interface{}, replyErr error) {
+	response, err := json.Marshal(result)
+	if err != nil {
+		c.logger.WithError(err).Error("Failed to encode undelivered result for the journal")
+		return
+	}
+
+	digest := sha256.Sum256(params)
+	entry := types.UndeliveredResult{
+		Method:        method,
+		RequestDigest: hex.EncodeToString(digest[:]),
+		Response:      response,
+		Attempts:      1,
+		LastError:     replyErr.Error(),
+	}
+
+	var request types.ForwardedRequest
+	if err := json.Unmarshal(params, &request); err == nil {
+		if data, ok := request.Data.(map[string]interface{}); ok {
+			entry.RequestID, _ = data["requestId"].(string)
+			entry.Command, _ = data["command"].(string)
+			entry.UserName, _ = data["userName"].(string)
+			entry.Action, _ = data["action"].(string)
+		}
+	}
+
+	entry, err = journal.Append(c.journalPath(), entry)
+	if err != nil {
+		c.logger.WithError(err).Error("Failed to journal undelivered result, it is lost")
+		return
+	}
+
+	c.updateUndeliveredMetric()
+	c.logger.WithFields(logrus.Fields{
+		"entry":      entry.ID,
+		"request_id": entry.RequestID,
+		"command":    entry.Command,
+		"error":      replyErr.Error(),
+	}).Warn("📒 Response could not be delivered, journaled for replay")
+}
+
+// replayJournal runs after setClientId succeeds: it delivers journaled
+// results, then asks the backend to re-send revokes issued since the agent
+// was last in contact. Backends without these methods are tolerated.
+func (c *Client) replayJournal(pending journal.Journal) {
+	path := c.journalPath()
+
+	if len(pending.Entries) > 0 {
+		ids := make([]string, 0, len(pending.Entries))
+		for _, entry := range pending.Entries {
+			ids = append(ids, entry.ID)
+		}
+
+		_, err := c.rpcClient.Call("deliverResults", types.DeliverResultsRequest{
+			ClientID: c.currentConfig().GetClientID(),
+			Results:  pending.Entries,
+		})
+		switch {
+		case err == nil:
+			if err := journal.Remove(path, ids); err != nil {
+				c.logger.WithError(err).Error("Failed to remove delivered results from the journal")
+			}
+			c.logger.WithField("count", len(ids)).Info("📒 Delivered journaled results")
+		case rpc.IsMethodNotFound(err):
+			c.logger.Warn("Backend does not accept journaled results, keeping them for inspection")
+		default:
+			c.logger.WithError(err).Warn("Failed to deliver journaled results, will retry on next connect")
+			if err := journal.MarkAttempt(path, ids, err); err != nil {
+				c.logger.WithError(err).Error("Failed to update journal")
+			}
+		}
+		c.updateUndeliveredMetric()
+	}
+
+	replay := types.ReplayRequest{
+		ClientID: c.currentConfig().GetClientID(),
+		Actions:  replayActions,
+	}
+	if !pending.LastContact.IsZero() {
+		replay.Since = pending.LastContact.Format(time.RFC3339)
+	}
+
+	if _, err := c.rpcClient.Call("requestReplay", replay); err != nil {
+		if rpc.IsMethodNotFound(err) {
+			c.logger.Debug("Backend does not support replay requests")
+		} else {
+			c.logger.WithError(err).Warn("Failed to request replay of missed revokes")
+			return
+		}
+	} else {
+		c.logger.WithField("since", replay.Since).Info("📒 Requested replay of missed revokes")
+	}
+
+	c.touchJournal()
+}
+
+// touchJournal records that the backend was reachable now
+func (c *Client) touchJournal() {
+	if err := journal.Touch(c.journalPath(), time.Now()); err != nil {
+		c.logger.WithError(err).Warn("Failed to record last contact in the journal")
+	}
+}
+
+// undeliveredCount is the number of journaled results, for heartbeats and metrics
+func (c *Client) undeliveredCount() int {
+	pending, err := journal.Load(c.journalPath())
+	if err != nil {
+		c.logger.WithError(err).Warn("Failed to read the journal")
+		return 0
+	}
+	return len(pending.Entries)
+}
+
+func (c *Client) updateUndeliveredMetric() {
+	metrics.UndeliveredResults.Set(float64(c.undeliveredCount()))
+}
@@ -0,0 +1,300 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/internal/elevate"
+	"p0-ssh-agent/scripts"
+	"p0-ssh-agent/types"
+)
+
+// Limits of streamOutput. Lines over the rate or beyond a full queue are
+// dropped and counted rather than slowing down provisioning.
+const (
+	outputMaxLineBytes    = 512
+	outputLinesPerSecond  = 20
+	outputBurst           = 50
+	outputQueueSize       = 200
+	outputBatchLines      = 20
+	outputFlushInterval   = 500 * time.Millisecond
+	outputCloseTimeout    = 2 * time.Second
+	outputTruncatedSuffix = "…"
+)
+
+// outputStream is a logrus hook that forwards the log lines of one request to
+// the backend as "output" notifications. Lines are queued without blocking
+// and sent in batches by a single goroutine, so a slow connection only ever
+// stalls the sender; once the queue is full further lines are dropped.
+type outputStream struct {
+	notify  func(method string, params interface{}) error
+	logger  *logrus.Logger
+	base    types.OutputNotification
+	lines   chan types.OutputLine
+	done    chan struct{}
+	stopped chan struct{}
+
+	mu      sync.Mutex
+	tokens  float64
+	refill  time.Time
+	dropped int
+}
+
+func newOutputStream(notify func(string, interface{}) error, clientID, requestID, command string, logger *logrus.Logger) *outputStream {
+	s := &outputStream{
+		notify:  notify,
+		logger:  logger,
+		base:    types.OutputNotification{ClientID: clientID, RequestID: requestID, Command: command},
+		lines:   make(chan types.OutputLine, outputQueueSize),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+		tokens:  outputBurst,
+		refill:  time.Now(),
+	}
+	go s.run()
+	return s
+}
+
+func (s *outputStream) Levels() []logrus.Level {
+	return []logrus.Level{logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel, logrus.WarnLevel, logrus.InfoLevel}
+}
+
+func (s *outputStream) Fire(entry *logrus.Entry) error {
+	s.add(types.OutputLine{
+		Time:    entry.Time.UTC().Format(time.RFC3339Nano),
+		Level:   entry.Level.String(),
+		Message: truncateLine(formatLine(entry), outputMaxLineBytes),
+	})
+	return nil
+}
+
+// add queues line unless it is over the rate or the queue is full
+func (s *outputStream) add(line types.OutputLine) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.tokens += now.Sub(s.refill).Seconds() * outputLinesPerSecond
+	if s.tokens > outputBurst {
+		s.tokens = outputBurst
+	}
+	s.refill = now
+
+	if s.tokens < 1 {
+		s.dropped++
+		return
+	}
+	select {
+	case s.lines <- line:
+		s.tokens--
+	default:
+		s.dropped++
+	}
+}
+
+// outputWriter passes what the tools a script runs print to the stream, one
+// line at a time at level "stdout" or "stderr"
+type outputWriter struct {
+	stream *outputStream
+	level  string
+
+	mu      sync.Mutex
+	partial []byte
+}
+
+func (w *outputWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		w.send(w.partial[:i])
+		w.partial = w.partial[i+1:]
+	}
+	// A line without end is sent in pieces rather than held in memory
+	if len(w.partial) >= outputMaxLineBytes {
+		w.send(w.partial)
+		w.partial = nil
+	}
+	return len(p), nil
+}
+
+// Flush sends the last line when it did not end with a newline
+func (w *outputWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.send(w.partial)
+	w.partial = nil
+}
+
+func (w *outputWriter) send(line []byte) {
+	message := strings.ToValidUTF8(strings.TrimRight(string(line), "\r"), "\uFFFD")
+	if strings.TrimSpace(message) == "" {
+		return
+	}
+	w.stream.add(types.OutputLine{
+		Time:    time.Now().UTC().Format(time.RFC3339Nano),
+		Level:   w.level,
+		Message: truncateLine(message, outputMaxLineBytes),
+	})
+}
+
+// takeDropped returns and resets the number of lines dropped so far
+func (s *outputStream) takeDropped() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dropped := s.dropped
+	s.dropped = 0
+	return dropped
+}
+
+func (s *outputStream) run() {
+	defer close(s.stopped)
+
+	ticker := time.NewTicker(outputFlushInterval)
+	defer ticker.Stop()
+
+	var batch []types.OutputLine
+	for {
+		select {
+		case line := <-s.lines:
+			batch = append(batch, line)
+			if len(batch) >= outputBatchLines {
+				s.send(batch, false)
+				batch = nil
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				s.send(batch, false)
+				batch = nil
+			}
+		case <-s.done:
+			batch = append(batch, s.drain()...)
+			for len(batch) > outputBatchLines {
+				s.send(batch[:outputBatchLines], false)
+				batch = batch[outputBatchLines:]
+			}
+			s.send(batch, true)
+			return
+		}
+	}
+}
+
+// drain takes the lines still queued
+func (s *outputStream) drain() []types.OutputLine {
+	var lines []types.OutputLine
+	for {
+		select {
+		case line := <-s.lines:
+			lines = append(lines, line)
+		default:
+			return lines
+		}
+	}
+}
+
+func (s *outputStream) send(lines []types.OutputLine, done bool) {
+	notification := s.base
+	notification.Lines = lines
+	notification.Dropped = s.takeDropped()
+	notification.Done = done
+	s.base.Seq++
+
+	// The stream is best effort: lines that could not be sent are reported
+	// as dropped in the next notification, and the result still reaches the
+	// backend in the response
+	if err := s.notify("output", notification); err != nil {
+		s.logger.WithError(err).Debug("Failed to send output notification")
+		s.mu.Lock()
+		s.dropped += len(lines)
+		s.mu.Unlock()
+	}
+}
+
+// Close flushes the queued lines and the final notification. It gives up
+// after outputCloseTimeout so a stalled connection does not hold back the
+// response.
+func (s *outputStream) Close() {
+	close(s.done)
+	select {
+	case <-s.stopped:
+	case <-time.After(outputCloseTimeout):
+	}
+}
+
+// formatLine renders entry as its message followed by its fields in key order
+func formatLine(entry *logrus.Entry) string {
+	if len(entry.Data) == 0 {
+		return entry.Message
+	}
+
+	keys := make([]string, 0, len(entry.Data))
+	for key := range entry.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(entry.Message)
+	for _, key := range keys {
+		fmt.Fprintf(&b, " %s=%v", key, entry.Data[key])
+	}
+	return b.String()
+}
+
+// truncateLine cuts line to at most max bytes without splitting a character
+func truncateLine(line string, max int) string {
+	if len(line) <= max {
+		return line
+	}
+	cut := max - len(outputTruncatedSuffix)
+	for cut > 0 && !utf8.RuneStart(line[cut]) {
+		cut--
+	}
+	return line[:cut] + outputTruncatedSuffix
+}
+
+// runScript executes command, streaming its log lines and the output of the
+// tools it runs to the backend when streamOutput is on. The low bandwidth
+// profile turns streaming off. It is terminated when ctx is done.
+func (c *Client) runScript(ctx context.Context, command string, req scripts.ProvisioningRequest) scripts.ProvisioningResult {
+	config := c.currentConfig()
+	if !config.StreamOutput || c.lowBandwidth() {
+		return scripts.ExecuteScriptContext(ctx, command, req, config.DryRun, c.logger)
+	}
+
+	stream := newOutputStream(c.rpcClient.Notify, config.GetClientID(), req.RequestID, command, c.logger)
+	defer stream.Close()
+
+	logger := logrus.New()
+	logger.SetOutput(c.logger.Out)
+	logger.SetFormatter(c.logger.Formatter)
+	logger.SetLevel(c.logger.GetLevel())
+	logger.SetReportCaller(c.logger.ReportCaller)
+	for level, hooks := range c.logger.Hooks {
+		for _, hook := range hooks {
+			logger.Hooks[level] = append(logger.Hooks[level], hook)
+		}
+	}
+	logger.AddHook(stream)
+
+	stdout := &outputWriter{stream: stream, level: "stdout"}
+	stderr := &outputWriter{stream: stream, level: "stderr"}
+	defer stderr.Flush()
+	defer stdout.Flush()
+
+	ctx = elevate.WithOutput(ctx, stdout, stderr)
+	return scripts.ExecuteScriptContext(ctx, command, req, config.DryRun, logger)
+}
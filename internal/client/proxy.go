@@ -0,0 +1,43 @@
+package client
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/http/httpproxy"
+
+	"p0-ssh-agent/types"
+)
+
+// proxyFunc selects the proxy used to dial the tunnel. proxyUrl takes precedence
+// over HTTP_PROXY/HTTPS_PROXY; hosts in noProxy and NO_PROXY are dialed directly.
+// The WebSocket dialer tunnels through the proxy with CONNECT, sending any
+// credentials in the proxy URL as basic auth.
+func proxyFunc(config *types.Config, logger *logrus.Logger) func(*http.Request) (*url.URL, error) {
+	proxyConfig := httpproxy.FromEnvironment()
+	if config.ProxyURL != "" {
+		proxyConfig.HTTPProxy = config.ProxyURL
+		proxyConfig.HTTPSProxy = config.ProxyURL
+	}
+	if len(config.NoProxy) > 0 {
+		noProxy := append([]string{}, config.NoProxy...)
+		if proxyConfig.NoProxy != "" {
+			noProxy = append(noProxy, proxyConfig.NoProxy)
+		}
+		proxyConfig.NoProxy = strings.Join(noProxy, ",")
+	}
+
+	proxyForURL := proxyConfig.ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		proxyURL, err := proxyForURL(req.URL)
+		if err != nil {
+			return nil, err
+		}
+		if proxyURL != nil {
+			logger.WithField("proxy", proxyURL.Redacted()).Debug("Dialing tunnel through proxy")
+		}
+		return proxyURL, nil
+	}
+}
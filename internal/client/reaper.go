@@ -0,0 +1,37 @@
+package client
+
+import (
+	"time"
+
+	"p0-ssh-agent/scripts"
+)
+
+// reapInterval is how often recorded grants are checked for expiry
+const reapInterval = 30 * time.Second
+
+// runReaper revokes grants whose expiresAt or validTo has passed until stop
+// is closed. It covers grants the backend never revokes; grants with a
+// window tracked by the scheduler are left to it.
+func (c *Client) runReaper(stop <-chan struct{}) {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+
+	c.logger.WithField("interval", reapInterval).Info("⌛ Grant expiry reaper started")
+
+	c.reap(time.Now())
+	for {
+		select {
+		case now := <-ticker.C:
+			c.reap(now)
+		case <-stop:
+			c.logger.Info("⌛ Grant expiry reaper stopped")
+			return
+		}
+	}
+}
+
+func (c *Client) reap(now time.Time) {
+	if _, err := scripts.RevokeExpired(now, c.scheduler.Tracks, "reaper", c.currentConfig().DryRun, c.logger); err != nil {
+		c.logger.WithError(err).Warn("Failed to read provisioning state, skipping expiry check")
+	}
+}
@@ -0,0 +1,121 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"p0-ssh-agent/internal/connection"
+	"p0-ssh-agent/internal/metrics"
+	"p0-ssh-agent/internal/rpc"
+	"p0-ssh-agent/types"
+)
+
+// reauthenticateRetry is how long after a failed reauthenticate call it is
+// tried again
+const reauthenticateRetry = time.Minute
+
+// errTokenRefused is returned when the backend replies to reauthenticate
+// with ok false
+var errTokenRefused = errors.New("backend refused the renewed token")
+
+// tokenExpiry returns when the JWT presented for the current connection
+// expires, leeway aside
+func (c *Client) tokenExpiry() time.Time {
+	c.connMu.RLock()
+	defer c.connMu.RUnlock()
+	return c.tokenExpiresAt
+}
+
+// runReauthenticator renews the connection's JWT with a reauthenticate call
+// once four fifths of its lifetime have passed, so the backend keeps
+// accepting a long-lived connection without a reconnect that would interrupt
+// provisioning in flight. It runs until t is torn down, or until the backend
+// turns out not to implement reauthenticate.
+func (c *Client) runReauthenticator(t *tunnel) {
+	timer := time.NewTimer(c.renewalDelay())
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			err := c.reauthenticate()
+			switch {
+			case err == nil:
+				metrics.Reauthentications.Inc("ok")
+				timer.Reset(c.renewalDelay())
+			case rpc.IsMethodNotFound(err):
+				c.logger.Debug("Backend does not support reauthenticate, keeping the token the connection was opened with")
+				return
+			case errors.Is(err, errTokenRefused):
+				metrics.Reauthentications.Inc("rejected")
+				c.logger.WithError(err).Error("🔐 Token renewal refused, reconnecting")
+				c.connectionFailed(err)
+				c.reconnect(t.generation, err)
+				return
+			default:
+				metrics.Reauthentications.Inc("failed")
+				c.logger.WithError(err).WithField("expiresAt", c.tokenExpiry().UTC().Format(time.RFC3339)).Warn("Failed to renew the tunnel token, retrying")
+				timer.Reset(reauthenticateRetry)
+			}
+		case <-t.stop:
+			return
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+// renewalDelay returns the time until the current token is due for renewal
+func (c *Client) renewalDelay() time.Duration {
+	delay := time.Until(c.tokenExpiry()) - c.jwtManager.Lifetime()/5
+	if delay < 0 {
+		return 0
+	}
+	return delay
+}
+
+// reauthenticate presents a fresh JWT, signed with the key installed by
+// rotate-keys if there is a new one, and records its expiry once accepted
+func (c *Client) reauthenticate() error {
+	if reloaded, err := c.jwtManager.ReloadIfChanged(c.currentConfig().GetKeyDir()); err != nil {
+		c.logger.WithError(err).Warn("Failed to reload JWT key, using the key already loaded")
+	} else if reloaded {
+		c.logger.Info("🔑 Reloaded rotated JWT key")
+	}
+
+	clientID := c.currentConfig().GetClientID()
+	expiresAt := time.Now().Add(c.jwtManager.Lifetime())
+	token, err := c.jwtManager.CreateJWT(clientID)
+	if err != nil {
+		return fmt.Errorf("failed to create JWT: %w", err)
+	}
+
+	result, err := c.rpcClient.CallWithTimeout("reauthenticate", types.ReauthenticateRequest{
+		ClientID:  clientID,
+		Token:     token,
+		ExpiresAt: expiresAt.UTC().Format(time.RFC3339),
+	}, c.heartbeatTimeout())
+	if err != nil {
+		return err
+	}
+
+	var response types.ReauthenticateResponse
+	if err := json.Unmarshal(result, &response); err == nil && response.OK != nil && !*response.OK {
+		if response.Error != "" {
+			return fmt.Errorf("%w: %s", errTokenRefused, response.Error)
+		}
+		return errTokenRefused
+	}
+
+	c.connMu.Lock()
+	c.tokenExpiresAt = expiresAt
+	c.connMu.Unlock()
+	c.updateConnection(func(state *connection.State) {
+		state.TokenExpiresAt = expiresAt.UTC().Format(time.RFC3339)
+	})
+
+	c.logger.WithField("expiresAt", expiresAt.UTC().Format(time.RFC3339)).Info("🔐 Renewed the tunnel token without reconnecting")
+	return nil
+}
@@ -0,0 +1,59 @@
+package client
+
+import (
+	"fmt"
+	"time"
+
+	"p0-ssh-agent/internal/recording"
+	"p0-ssh-agent/types"
+)
+
+// recordingShipInterval is how often finished session recordings are shipped
+const recordingShipInterval = time.Minute
+
+// runRecordingShipper ships finished session recordings from the spool until
+// stop is closed. Recordings that fail to ship stay in the spool and are
+// retried on the next tick, unless the destination rejected them.
+func (c *Client) runRecordingShipper(stop <-chan struct{}) {
+	config := c.currentConfig().GetSessionRecording()
+	shipper, err := recording.NewShipper(config, c.currentConfig().HostID, c.uploadSessionRecording)
+	if err != nil {
+		c.logger.WithError(err).Error("Session recordings will not be shipped")
+		return
+	}
+
+	ticker := time.NewTicker(recordingShipInterval)
+	defer ticker.Stop()
+
+	logger := c.logger.WithField("destination", shipper.Name())
+	logger.Info("🎥 Session recording shipper started")
+
+	for {
+		select {
+		case <-ticker.C:
+			shipped, err := recording.ShipFinished(config.GetSpoolDir(), shipper)
+			if shipped > 0 {
+				logger.WithField("recordings", shipped).Info("🎥 Shipped session recordings")
+			}
+			if err != nil {
+				logger.WithError(err).Warn("Failed to ship session recordings")
+			}
+		case <-stop:
+			logger.Info("🎥 Session recording shipper stopped")
+			return
+		}
+	}
+}
+
+// uploadSessionRecording sends a recording to the backend with the tunnel
+// destination. Recordings wait in the spool while the agent is disconnected.
+func (c *Client) uploadSessionRecording(request types.UploadSessionRecordingRequest) error {
+	if !c.Connection().Connected {
+		return fmt.Errorf("the tunnel is not connected")
+	}
+
+	request.ClientID = c.currentConfig().GetClientID()
+	request.HostID = c.currentConfig().HostID
+	_, err := c.rpcClient.CallWithTimeout("uploadSessionRecording", request, c.currentConfig().GetSessionRecording().GetTimeout())
+	return err
+}
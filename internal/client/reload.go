@@ -0,0 +1,172 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/internal/audit"
+	"p0-ssh-agent/internal/control"
+	"p0-ssh-agent/internal/forward"
+	"p0-ssh-agent/internal/osplugins"
+	"p0-ssh-agent/scripts"
+	"p0-ssh-agent/types"
+)
+
+// restartOnlyKeys are configuration keys fixed for the life of the process:
+// the agent's identity, where it keeps keys and state, the tunnel endpoints
+// it selects between and how it reconnects to them, where it provisions
+// authorized keys, how it resolves users, the OS plugin, session recording
+// and reporting, and listeners opened at startup
+var restartOnlyKeys = []string{
+	"orgId",
+	"hostId",
+	"keyPath",
+	"keyProfile",
+	"stateDir",
+	"writableDir",
+	"tunnelHost",
+	"tunnelHosts",
+	"tunnelPort",
+	"tunnelPath",
+	"endpointSelection",
+	"endpointProbeSeconds",
+	"reconnect",
+	"authorizedKeysLayout",
+	"userResolution",
+	"dryRun",
+	"metricsAddress",
+	"controlSocket",
+	"osPlugin",
+	"sessionRecording",
+	"sessionReportSeconds",
+}
+
+// currentConfig returns the configuration in effect. Callers that read
+// several fields should take it once, as a reload may replace it.
+func (c *Client) currentConfig() *types.Config {
+	return c.config.Load()
+}
+
+// SetConfigLoader sets how Reload re-reads the configuration, normally the
+// same file and flag overrides the agent started with
+func (c *Client) SetConfigLoader(load func() (*types.Config, error)) {
+	c.loadConfig = load
+}
+
+// Reload re-reads and validates the configuration and applies it. Requests
+// use the new values as soon as they start; connection settings such as
+// TLS, proxy and heartbeat interval apply from the next connection. A
+// configuration changing a restart-only key is rejected whole.
+func (c *Client) Reload() (control.ReloadResult, error) {
+	if c.loadConfig == nil {
+		return control.ReloadResult{}, fmt.Errorf("configuration reload is not available: %w", control.ErrConflict)
+	}
+
+	next, err := c.loadConfig()
+	if err != nil {
+		return control.ReloadResult{}, err
+	}
+
+	current := c.currentConfig()
+	changed, err := changedKeys(current, next)
+	if err != nil {
+		return control.ReloadResult{}, err
+	}
+
+	var restart []string
+	for _, key := range changed {
+		for _, restartOnly := range restartOnlyKeys {
+			if key == restartOnly {
+				restart = append(restart, key)
+			}
+		}
+	}
+	if len(restart) > 0 {
+		return control.ReloadResult{}, fmt.Errorf("changing %s requires a restart: %w", strings.Join(restart, ", "), control.ErrConflict)
+	}
+
+	for _, deprecation := range next.Deprecations {
+		c.logger.Warn("⚠️  Deprecated configuration: " + deprecation)
+	}
+
+	sinks, err := audit.NewSinks(next.AuditSinks, next.HostID)
+	if err != nil {
+		return control.ReloadResult{}, err
+	}
+	targets, err := forward.NewRouter(next.Targets, next.TargetCache)
+	if err != nil {
+		return control.ReloadResult{}, err
+	}
+	if err := scripts.SetScriptLimits(next.ScriptLimits); err != nil {
+		return control.ReloadResult{}, err
+	}
+
+	c.config.Store(next)
+	if err := scripts.SetAuditSinks(sinks); err != nil {
+		c.logger.WithError(err).Warn("⚠️ Failed to record where new audit sinks start, they will receive the whole audit log")
+	}
+	c.targets.Store(targets)
+	c.closeRemovedTargetStreams(next.Targets)
+	c.jwtManager.SetClockSkew(next.GetJWTNotBefore(), next.GetJWTExpiryLeeway())
+	c.jwtManager.SetLifetime(next.GetJWTLifetime())
+	scripts.SetSudoersLayout(next.GetSudoersLayout())
+	osplugins.SetSELinuxUser(next.SELinuxUser)
+	if current.GetBandwidthProfile() != next.GetBandwidthProfile() {
+		c.applyBandwidthProfile()
+	}
+
+	c.logger.WithFields(logrus.Fields{
+		"config":  next.ConfigPath,
+		"changed": changed,
+	}).Info("🔁 Configuration reloaded")
+
+	if changed == nil {
+		changed = []string{}
+	}
+	return control.ReloadResult{Changed: changed}, nil
+}
+
+// changedKeys returns the configuration keys whose values differ, sorted
+func changedKeys(before, after *types.Config) ([]string, error) {
+	beforeFields, err := configFields(before)
+	if err != nil {
+		return nil, err
+	}
+	afterFields, err := configFields(after)
+	if err != nil {
+		return nil, err
+	}
+
+	var changed []string
+	for key, value := range afterFields {
+		if !reflect.DeepEqual(beforeFields[key], value) {
+			changed = append(changed, key)
+		}
+	}
+	for key := range beforeFields {
+		if _, ok := afterFields[key]; !ok {
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+	return changed, nil
+}
+
+// configFields maps each configuration key to its value as JSON sees it
+func configFields(config *types.Config) (map[string]interface{}, error) {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compare configurations: %w", err)
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, fmt.Errorf("failed to compare configurations: %w", err)
+	}
+	return fields, nil
+}
@@ -0,0 +1,71 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"p0-ssh-agent/scripts"
+	"p0-ssh-agent/types"
+)
+
+// sessionReportRefresh is how often an unchanged session list is sent again,
+// so the backend can tell a quiet host from a silent one
+const sessionReportRefresh = 10 * time.Minute
+
+// runSessionReporter sends the host's logged-in sessions to the backend as
+// activeSessions notifications until stop is closed. A report goes out when
+// the sessions change, after every reconnect and otherwise every
+// sessionReportRefresh.
+func (c *Client) runSessionReporter(stop <-chan struct{}) {
+	interval := c.currentConfig().GetSessionReportInterval()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	c.logger.WithField("interval", interval).Info("👥 Session reporter started")
+
+	var lastReport string
+	var lastSent time.Time
+	for {
+		select {
+		case <-ticker.C:
+			connection := c.Connection()
+			if !connection.Connected {
+				continue
+			}
+
+			sessions, err := scripts.ActiveSessions(context.Background())
+			if err != nil {
+				c.logger.WithError(err).Warn("Failed to list logged-in sessions")
+				continue
+			}
+			if sessions == nil {
+				sessions = []types.ActiveSession{}
+			}
+
+			encoded, _ := json.Marshal(sessions)
+			report := connection.ConnectedSince + string(encoded)
+			if report == lastReport && time.Since(lastSent) < sessionReportRefresh {
+				continue
+			}
+
+			if err := c.rpcClient.Notify("activeSessions", types.ActiveSessionsNotification{
+				ClientID:    c.currentConfig().GetClientID(),
+				HostID:      c.currentConfig().HostID,
+				CollectedAt: time.Now().UTC().Format(time.RFC3339),
+				Sessions:    sessions,
+			}); err != nil {
+				c.logger.WithError(err).Debug("Failed to send active sessions")
+				continue
+			}
+
+			if report != lastReport {
+				c.logger.WithField("sessions", len(sessions)).Debug("Reported changed active sessions")
+			}
+			lastReport, lastSent = report, time.Now()
+		case <-stop:
+			c.logger.Info("👥 Session reporter stopped")
+			return
+		}
+	}
+}
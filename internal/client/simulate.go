@@ -0,0 +1,57 @@
+package client
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/internal/audit"
+	"p0-ssh-agent/internal/grants"
+	"p0-ssh-agent/scripts"
+	"p0-ssh-agent/types"
+)
+
+// Simulator runs provisioning requests through the pipeline of the agent
+// without a connection: the kill switch, schema validation, host policy,
+// expiry checks and the grant scheduler, then the command itself. simulate
+// uses it against a sandbox, so a rehearsal is refused or carried out
+// exactly as the agent would.
+type Simulator struct {
+	client *Client
+}
+
+// NewSimulator returns a Simulator with the settings of config that shape
+// provisioning, such as requiredMetadata, disabledFile, sudoersLayout and
+// sessionRecording. Grants are recorded and scheduled in stateDir. Output
+// is never streamed, and dryRun is ignored, as the sandbox already keeps
+// the host unchanged.
+func NewSimulator(config *types.Config, stateDir string, logger *logrus.Logger) (*Simulator, error) {
+	simulated := *config
+	simulated.StateDir = stateDir
+	simulated.StreamOutput = false
+	simulated.DryRun = false
+
+	grantStore, err := grants.Open(stateDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open grant store: %w", err)
+	}
+
+	scripts.SetSudoersLayout(simulated.GetSudoersLayout())
+	scripts.SetSessionRecording(simulated.GetSessionRecording())
+	if err := scripts.SetScriptLimits(simulated.ScriptLimits); err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		logger:    logger,
+		scheduler: grants.NewScheduler(grantStore, false, logger),
+	}
+	c.config.Store(&simulated)
+	return &Simulator{client: c}, nil
+}
+
+// Provision handles command as the agent handles a call carrying it
+func (s *Simulator) Provision(ctx context.Context, command string, data interface{}, origin *audit.Origin) scripts.ProvisioningResult {
+	return s.client.provision(ctx, command, data, origin)
+}
@@ -0,0 +1,79 @@
+package client
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/internal/metrics"
+	"p0-ssh-agent/scripts"
+	"p0-ssh-agent/types"
+)
+
+const (
+	// sshdHealthInterval is how often sshd is checked. Heartbeats can be
+	// more frequent, and every check runs sshd -T through sudo, which is
+	// logged.
+	sshdHealthInterval = time.Minute
+
+	// sshdCheckTimeout bounds a check, so a hung sudo or sshd -T never
+	// leaves the last result in place for good
+	sshdCheckTimeout = 20 * time.Second
+)
+
+// runSSHDChecker checks sshd every sshdHealthInterval until stop is closed.
+// Heartbeats report the last result rather than waiting for a check.
+func (c *Client) runSSHDChecker(stop <-chan struct{}) {
+	ticker := time.NewTicker(sshdHealthInterval)
+	defer ticker.Stop()
+
+	for {
+		c.checkSSHD()
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// checkSSHD checks sshd, records the result for heartbeats and logs when
+// sshd stops accepting logins or recovers
+func (c *Client) checkSSHD() {
+	ctx, cancel := context.WithTimeout(c.ctx, sshdCheckTimeout)
+	health := scripts.CheckSSHD(ctx, c.logger)
+	cancel()
+
+	c.sshdHealthMu.Lock()
+	previous := c.sshdHealth
+	c.sshdHealth = &health
+	c.sshdHealthMu.Unlock()
+
+	if health.Healthy {
+		metrics.SSHDHealthy.Set(1)
+		if previous != nil && !previous.Healthy {
+			c.logger.Info("🔑 sshd is accepting logins again")
+		}
+	} else {
+		metrics.SSHDHealthy.Set(0)
+		if previous == nil || previous.Healthy {
+			c.logger.WithFields(logrus.Fields{
+				"running":      health.Running,
+				"listening":    health.Listening,
+				"config_valid": health.ConfigValid,
+				"problems":     health.Problems,
+			}).Warn("🚪 sshd cannot accept logins; reporting it in heartbeats")
+		}
+	}
+}
+
+// currentSSHDHealth returns the sshd health reported in heartbeats: the
+// result of the last check, nil before the first one and on Windows, where
+// OpenSSH Server is not checked
+func (c *Client) currentSSHDHealth() *types.SSHDHealth {
+	c.sshdHealthMu.Lock()
+	defer c.sshdHealthMu.Unlock()
+	return c.sshdHealth
+}
@@ -0,0 +1,279 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/internal/forward"
+	"p0-ssh-agent/internal/metrics"
+	"p0-ssh-agent/types"
+)
+
+const (
+	// maxTargetStreams bounds the event streams and WebSockets open to targets
+	maxTargetStreams = 32
+
+	// targetStreamLane carries messages for streams apart from provisioning
+	// requests, so a running script does not hold up a WebSocket
+	targetStreamLane = "targetStream"
+
+	// targetStreamBytesPerSecond and targetStreamBurstBytes bound the data
+	// all target streams together relay to the backend
+	targetStreamBytesPerSecond = 1 << 20
+	targetStreamBurstBytes     = 4 << 20
+)
+
+// targetStream is a stream open to the target named target
+type targetStream struct {
+	stream forward.Stream
+	target string
+}
+
+// streamPacer is a token bucket shared by the target streams, so a chatty
+// target cannot crowd heartbeats and provisioning responses out of the
+// tunnel. A relay waits for its turn instead of buffering, which stops
+// reading from the target and leaves it to its own send window.
+type streamPacer struct {
+	mu     sync.Mutex
+	tokens float64
+	refill time.Time
+}
+
+// wait reserves n bytes and blocks until they may be sent. It returns false
+// if done is closed first.
+func (p *streamPacer) wait(n int, done <-chan struct{}) bool {
+	p.mu.Lock()
+	now := time.Now()
+	if p.refill.IsZero() {
+		p.tokens = targetStreamBurstBytes
+	} else {
+		p.tokens = math.Min(p.tokens+now.Sub(p.refill).Seconds()*targetStreamBytesPerSecond, targetStreamBurstBytes)
+	}
+	p.refill = now
+	p.tokens -= float64(n)
+	delay := time.Duration(-p.tokens / targetStreamBytesPerSecond * float64(time.Second))
+	p.mu.Unlock()
+
+	if delay <= 0 {
+		return true
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// openTargetStream forwards a WebSocket upgrade or event stream request. When
+// the target opens the stream, its data is relayed to the backend as
+// targetStream notifications until either side closes it or the tunnel drops.
+func (c *Client) openTargetStream(route *forward.Route, request types.ForwardedRequest) types.ForwardedResponse {
+	if c.targetStreamCount() >= maxTargetStreams {
+		return forward.ErrorResponse(http.StatusServiceUnavailable, fmt.Errorf("%d streams to targets are already open", maxTargetStreams))
+	}
+
+	response, stream := route.Open(request)
+	if stream == nil {
+		return response
+	}
+
+	id, err := c.addTargetStream(stream, route.Name())
+	if err != nil {
+		stream.Close()
+		return forward.ErrorResponse(http.StatusServiceUnavailable, err)
+	}
+	response.StreamID = id
+
+	go c.relayTargetStream(id, route.Name(), stream)
+	return response
+}
+
+func (c *Client) targetStreamCount() int {
+	c.streamsMu.Lock()
+	defer c.streamsMu.Unlock()
+	return len(c.streams)
+}
+
+func (c *Client) addTargetStream(stream forward.Stream, target string) (string, error) {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", fmt.Errorf("failed to generate stream id: %w", err)
+	}
+
+	c.streamsMu.Lock()
+	defer c.streamsMu.Unlock()
+	if len(c.streams) >= maxTargetStreams {
+		return "", fmt.Errorf("%d streams to targets are already open", maxTargetStreams)
+	}
+	if c.streams == nil {
+		c.streams = make(map[string]targetStream)
+	}
+	c.streams[hex.EncodeToString(id[:])] = targetStream{stream: stream, target: target}
+	metrics.TargetStreams.Set(float64(len(c.streams)))
+	return hex.EncodeToString(id[:]), nil
+}
+
+// removeTargetStream forgets the stream and reports whether it was open, so
+// it is closed and reported done only once
+func (c *Client) removeTargetStream(id string) (forward.Stream, bool) {
+	c.streamsMu.Lock()
+	defer c.streamsMu.Unlock()
+	open, ok := c.streams[id]
+	delete(c.streams, id)
+	metrics.TargetStreams.Set(float64(len(c.streams)))
+	return open.stream, ok
+}
+
+func (c *Client) closeTargetStream(id string) bool {
+	stream, ok := c.removeTargetStream(id)
+	if ok {
+		stream.Close()
+	}
+	return ok
+}
+
+// closeTargetStreams closes every stream, as when the tunnel drops
+func (c *Client) closeTargetStreams() {
+	c.streamsMu.Lock()
+	streams := c.streams
+	c.streams = nil
+	c.streamsMu.Unlock()
+	metrics.TargetStreams.Set(0)
+
+	for _, open := range streams {
+		open.stream.Close()
+	}
+}
+
+// closeRemovedTargetStreams closes the streams to targets that are not in
+// targets, as after a reload removed them. The relays report them done with
+// an error, as when the target ends a stream.
+func (c *Client) closeRemovedTargetStreams(targets []types.Target) {
+	kept := make(map[string]bool)
+	for _, target := range targets {
+		kept[target.Name] = true
+	}
+
+	c.streamsMu.Lock()
+	var removed []forward.Stream
+	for id, open := range c.streams {
+		if !kept[open.target] {
+			removed = append(removed, open.stream)
+			c.logger.WithFields(logrus.Fields{"target": open.target, "stream": id}).Info("📡 Closing stream to a target removed by reload")
+		}
+	}
+	c.streamsMu.Unlock()
+
+	// Closing makes Receive fail, so each relay sends its done notification
+	for _, stream := range removed {
+		stream.Close()
+	}
+}
+
+// relayTargetStream sends the data of a stream to the backend, paced by
+// streamPacer. The last notification has done set, unless the backend closed
+// the stream itself.
+func (c *Client) relayTargetStream(id, target string, stream forward.Stream) {
+	logger := c.logger.WithFields(logrus.Fields{"target": target, "stream": id})
+	message := types.TargetStreamMessage{ClientID: c.currentConfig().GetClientID(), StreamID: id}
+
+	for {
+		data, binary, err := stream.Receive()
+		if err != nil {
+			if !c.closeTargetStream(id) {
+				logger.Debug("Target stream closed")
+				return
+			}
+
+			message.Data, message.ContentEncoding = "", ""
+			message.Done = true
+			if !errors.Is(err, io.EOF) {
+				message.Error = err.Error()
+			}
+			if err := c.rpcClient.Notify("targetStream", message); err != nil {
+				logger.WithError(err).Debug("Failed to send the end of a target stream")
+			}
+			logger.WithField("error", message.Error).Info("📡 Target stream ended")
+			return
+		}
+
+		if !c.streamPacer.wait(len(data), c.ctx.Done()) {
+			c.closeTargetStream(id)
+			return
+		}
+
+		message.Data, message.ContentEncoding = string(data), ""
+		if binary || !utf8.Valid(data) {
+			message.Data, message.ContentEncoding = base64.StdEncoding.EncodeToString(data), types.ContentEncodingBase64
+		}
+		if err := c.rpcClient.Notify("targetStream", message); err != nil {
+			logger.WithError(err).Warn("Failed to relay a target stream, closing it")
+			c.closeTargetStream(id)
+			return
+		}
+		message.Seq++
+	}
+}
+
+// handleTargetStreamSend passes a message from the backend to a WebSocket target
+func (c *Client) handleTargetStreamSend(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var request types.TargetStreamSendRequest
+	if err := json.Unmarshal(params, &request); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal TargetStreamSendRequest: %w", err)
+	}
+
+	c.streamsMu.Lock()
+	open, ok := c.streams[request.StreamID]
+	c.streamsMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("stream %s is not open", request.StreamID)
+	}
+	stream := open.stream
+
+	data := []byte(request.Data)
+	binary := request.ContentEncoding == types.ContentEncodingBase64
+	if binary {
+		decoded, err := base64.StdEncoding.DecodeString(request.Data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64 data: %w", err)
+		}
+		data = decoded
+	} else if request.ContentEncoding != "" {
+		return nil, fmt.Errorf("unsupported contentEncoding %q", request.ContentEncoding)
+	}
+
+	if err := stream.Send(data, binary); err != nil {
+		return nil, fmt.Errorf("failed to send to stream %s: %w", request.StreamID, err)
+	}
+	return map[string]interface{}{"success": true}, nil
+}
+
+// handleTargetStreamClose ends a stream the backend no longer reads
+func (c *Client) handleTargetStreamClose(ctx context.Context, params json.RawMessage) (interface{}, error) {
+	var request types.TargetStreamCloseRequest
+	if err := json.Unmarshal(params, &request); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal TargetStreamCloseRequest: %w", err)
+	}
+
+	closed := c.closeTargetStream(request.StreamID)
+	if closed {
+		c.logger.WithField("stream", request.StreamID).Info("📡 Target stream closed by the backend")
+	}
+	return map[string]interface{}{"success": true, "closed": closed}, nil
+}
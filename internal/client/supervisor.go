@@ -0,0 +1,289 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/internal/connection"
+	"p0-ssh-agent/internal/journal"
+	"p0-ssh-agent/internal/metrics"
+)
+
+// lifecycleState is where the supervisor is in the life of the tunnel
+type lifecycleState string
+
+const (
+	// stateConnecting dials the tunnel, backing off between failed attempts
+	stateConnecting lifecycleState = "connecting"
+
+	// stateConnected has a tunnel, registered with setClientId or about to be
+	stateConnected lifecycleState = "connected"
+
+	// stateDraining lets running work finish before the agent stops
+	stateDraining lifecycleState = "draining"
+
+	// stateStopped is final
+	stateStopped lifecycleState = "stopped"
+)
+
+type lifecycleEventKind int
+
+const (
+	// eventRegistered is sent once setClientId succeeded on a connection
+	eventRegistered lifecycleEventKind = iota
+
+	// eventLost is sent when a connection failed or must be replaced
+	eventLost
+)
+
+// lifecycleEvent reports something that happened to the connection of
+// generation. Events of a connection already replaced are ignored.
+type lifecycleEvent struct {
+	kind       lifecycleEventKind
+	generation uint64
+	err        error
+}
+
+// tunnel is one connection made by the supervisor. Its goroutines run until
+// stop is closed, which happens exactly once, when it is torn down.
+type tunnel struct {
+	generation uint64
+	ctx        context.Context
+	cancel     context.CancelFunc
+	stop       chan struct{}
+}
+
+// supervisorOps are the steps the supervisor takes on a tunnel. The Client
+// implements them; tests drive the state machine with their own.
+type supervisorOps interface {
+	// connect makes a tunnel, returning ErrShutdown once Shutdown was called
+	connect() (*tunnel, error)
+
+	// registered starts the work of a tunnel whose setClientId succeeded
+	registered(t *tunnel)
+
+	// lost tears down a tunnel that failed, before the next one is made
+	lost(t *tunnel)
+
+	// stop drains running work and closes t, which is nil while connecting
+	stop(t *tunnel)
+}
+
+func (c *Client) newTunnel() *tunnel {
+	ctx, cancel := context.WithCancel(c.ctx)
+	return &tunnel{
+		generation: c.generation.Add(1),
+		ctx:        ctx,
+		cancel:     cancel,
+		stop:       make(chan struct{}),
+	}
+}
+
+// supervise runs the lifecycle of the tunnel until the agent stops. It is the
+// only goroutine that connects, tears connections down and drains, so
+// failures reported from anywhere turn into one reconnect at a time. It
+// returns the error that stopped the agent, or context.Canceled after
+// Shutdown.
+func (c *Client) supervise() error {
+	return c.superviseWith(c)
+}
+
+// superviseWith runs the state machine of supervise, taking its steps with ops
+func (c *Client) superviseWith(ops supervisorOps) error {
+	var current *tunnel
+	state := stateConnecting
+	for {
+		c.setState(state)
+
+		switch state {
+		case stateConnecting:
+			t, err := ops.connect()
+			if errors.Is(err, ErrShutdown) {
+				state = stateDraining
+				continue
+			}
+			if err != nil {
+				c.setState(stateStopped)
+				close(c.stopped)
+				return err
+			}
+			current = t
+			state = stateConnected
+
+		case stateConnected:
+			select {
+			case event := <-c.events:
+				if event.generation != current.generation {
+					c.logger.WithField("generation", event.generation).Debug("Ignoring event of a replaced connection")
+					continue
+				}
+				switch event.kind {
+				case eventRegistered:
+					ops.registered(current)
+				case eventLost:
+					ops.lost(current)
+					current = nil
+					state = stateConnecting
+				}
+			case <-c.stopping:
+				state = stateDraining
+			}
+
+		case stateDraining:
+			ops.stop(current)
+			current = nil
+			state = stateStopped
+
+		case stateStopped:
+			close(c.stopped)
+			return context.Canceled
+		}
+	}
+}
+
+// setState records a transition of the lifecycle
+func (c *Client) setState(state lifecycleState) {
+	c.stateMu.Lock()
+	previous := c.state
+	c.state = state
+	c.stateMu.Unlock()
+
+	if previous != state {
+		c.logger.WithFields(logrus.Fields{
+			"from": previous,
+			"to":   state,
+		}).Debug("🔁 Connection lifecycle changed")
+	}
+}
+
+// lifecycle returns the state of the supervisor
+func (c *Client) lifecycle() lifecycleState {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	return c.state
+}
+
+// send passes an event to the supervisor, giving up once the agent stopped
+func (c *Client) send(event lifecycleEvent) {
+	select {
+	case c.events <- event:
+	case <-c.stopped:
+	}
+}
+
+// reconnect asks the supervisor to replace the connection of generation
+func (c *Client) reconnect(generation uint64, err error) {
+	c.send(lifecycleEvent{kind: eventLost, generation: generation, err: err})
+}
+
+// forceReconnect asks the supervisor to replace the current connection,
+// e.g. to move to another endpoint
+func (c *Client) forceReconnect() {
+	c.reconnect(c.generation.Load(), nil)
+}
+
+// waitBackoff waits delay before the next connection attempt and reports
+// whether to make it. Events sent meanwhile are dropped, as there is no
+// connection for them to act on.
+func (c *Client) waitBackoff(delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			return true
+		case <-c.events:
+		case <-c.stopping:
+			return false
+		}
+	}
+}
+
+// registered starts the work of a connection whose setClientId succeeded
+func (c *Client) registered(t *tunnel) {
+	// Read before heartbeats move the last contact time forward
+	pending, err := journal.Load(c.journalPath())
+	if err != nil {
+		c.logger.WithError(err).Error("Failed to read the journal, skipping replay")
+	} else {
+		go c.replayJournal(pending)
+	}
+
+	c.heartbeatMu.Lock()
+	c.lastHeartbeat = time.Now()
+	c.heartbeatMu.Unlock()
+	c.connectionEstablished()
+
+	metrics.Connected.Set(1)
+	metrics.LastHeartbeat.Set(float64(time.Now().Unix()))
+
+	go c.startHeartbeat(t)
+	go c.runReauthenticator(t)
+}
+
+// lost tears down t after it failed, so the supervisor can reconnect
+func (c *Client) lost(t *tunnel) {
+	c.logger.Warn("🔄 Forcing reconnection due to connection failure")
+	metrics.Reconnects.Inc()
+	c.updateConnection(func(state *connection.State) {
+		state.Connected = false
+		state.Reconnecting = true
+		state.Reconnects++
+	})
+	c.teardown(t)
+	c.logger.Info("🔄 Starting reconnection process")
+}
+
+// teardown stops the goroutines of t and closes its connection
+func (c *Client) teardown(t *tunnel) {
+	metrics.Connected.Set(0)
+	close(t.stop)
+	t.cancel()
+
+	// The backend's ends of the streams went with the connection
+	c.closeTargetStreams()
+
+	c.connMu.Lock()
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+	c.connMu.Unlock()
+
+	if err := c.rpcClient.Close(); err != nil {
+		c.logger.WithError(err).Debug("Error closing RPC client")
+	}
+}
+
+// stop drains running work and closes the connection t, if any, for good
+func (c *Client) stop(t *tunnel) {
+	// Before draining, so the backend stops routing requests here
+	c.notifyGoingDown()
+
+	// Stop taking new work and let running scripts finish before the
+	// connection goes away, so no managed file is left half-written
+	close(c.schedulerStop)
+	close(c.probeStop)
+	c.drain(c.currentConfig().GetShutdownDrainTimeout())
+
+	if t != nil {
+		c.teardown(t)
+	} else {
+		c.closeTargetStreams()
+		if err := c.rpcClient.Close(); err != nil {
+			c.logger.WithError(err).Warn("Error closing RPC client")
+		}
+	}
+	c.cancel()
+	metrics.Connected.Set(0)
+	c.updateConnection(func(state *connection.State) {
+		state.Connected = false
+		state.Reconnecting = false
+		state.Stopped = true
+	})
+
+	c.logger.Info("Client shutdown completed")
+}
@@ -0,0 +1,185 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// fakeOps records the steps the supervisor takes, with the lifecycle state
+// it was in, and makes the tunnels connect returns from connects in turn
+type fakeOps struct {
+	c        *Client
+	connects []error
+
+	mu    sync.Mutex
+	made  uint64
+	steps []string
+}
+
+func (f *fakeOps) record(step string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.steps = append(f.steps, fmt.Sprintf("%s %s", f.c.lifecycle(), step))
+}
+
+func (f *fakeOps) connect() (*tunnel, error) {
+	f.mu.Lock()
+	var err error
+	if len(f.connects) > 0 {
+		err, f.connects = f.connects[0], f.connects[1:]
+	}
+	if err == nil {
+		f.made++
+	}
+	generation := f.made
+	f.mu.Unlock()
+
+	if err != nil {
+		f.record(fmt.Sprintf("connect: %v", err))
+		return nil, err
+	}
+	f.record(fmt.Sprintf("connect %d", generation))
+	return &tunnel{generation: generation}, nil
+}
+
+func (f *fakeOps) registered(t *tunnel) { f.record(fmt.Sprintf("registered %d", t.generation)) }
+func (f *fakeOps) lost(t *tunnel)       { f.record(fmt.Sprintf("lost %d", t.generation)) }
+
+func (f *fakeOps) stop(t *tunnel) {
+	if t == nil {
+		f.record("stop")
+		return
+	}
+	f.record(fmt.Sprintf("stop %d", t.generation))
+}
+
+func TestSupervisorTransitions(t *testing.T) {
+	errFatal := errors.New("authentication failed")
+
+	tests := []struct {
+		name     string
+		connects []error
+		events   []lifecycleEvent
+		shutdown bool
+		want     []string
+		wantErr  error
+	}{
+		{
+			name: "lost connection reconnects",
+			events: []lifecycleEvent{
+				{kind: eventRegistered, generation: 1},
+				{kind: eventLost, generation: 1},
+				{kind: eventRegistered, generation: 2},
+			},
+			shutdown: true,
+			want: []string{
+				"connecting connect 1",
+				"connected registered 1",
+				"connected lost 1",
+				"connecting connect 2",
+				"connected registered 2",
+				"draining stop 2",
+			},
+			wantErr: context.Canceled,
+		},
+		{
+			name:     "shutdown drains and stops",
+			events:   []lifecycleEvent{{kind: eventRegistered, generation: 1}},
+			shutdown: true,
+			want: []string{
+				"connecting connect 1",
+				"connected registered 1",
+				"draining stop 1",
+			},
+			wantErr: context.Canceled,
+		},
+		{
+			name:     "shutdown while connecting drains without a tunnel",
+			connects: []error{ErrShutdown},
+			want: []string{
+				"connecting connect: " + ErrShutdown.Error(),
+				"draining stop",
+			},
+			wantErr: context.Canceled,
+		},
+		{
+			name:     "fatal connect error stops",
+			connects: []error{errFatal},
+			want:     []string{"connecting connect: " + errFatal.Error()},
+			wantErr:  errFatal,
+		},
+		{
+			name: "events of a replaced connection are ignored",
+			events: []lifecycleEvent{
+				{kind: eventLost, generation: 1},
+				{kind: eventLost, generation: 1},
+				{kind: eventRegistered, generation: 1},
+				{kind: eventRegistered, generation: 2},
+			},
+			shutdown: true,
+			want: []string{
+				"connecting connect 1",
+				"connected lost 1",
+				"connecting connect 2",
+				"connected registered 2",
+				"draining stop 2",
+			},
+			wantErr: context.Canceled,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := logrus.New()
+			logger.SetOutput(io.Discard)
+			c := &Client{
+				logger:   logger,
+				events:   make(chan lifecycleEvent),
+				stopping: make(chan struct{}),
+				stopped:  make(chan struct{}),
+			}
+			ops := &fakeOps{c: c, connects: tt.connects}
+
+			done := make(chan error, 1)
+			go func() { done <- c.superviseWith(ops) }()
+
+			// The events channel is unbuffered, so each event is taken
+			// before the next is sent
+			for _, event := range tt.events {
+				c.send(event)
+			}
+			if tt.shutdown {
+				close(c.stopping)
+			}
+
+			select {
+			case err := <-done:
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("supervise returned %v, want %v", err, tt.wantErr)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("supervise did not return")
+			}
+
+			select {
+			case <-c.stopped:
+			default:
+				t.Error("stopped was not closed")
+			}
+			if state := c.lifecycle(); state != stateStopped {
+				t.Errorf("final state %s, want %s", state, stateStopped)
+			}
+			if !reflect.DeepEqual(ops.steps, tt.want) {
+				t.Errorf("steps\n got %q\nwant %q", ops.steps, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/internal/forward"
+	"p0-ssh-agent/internal/metrics"
+	"p0-ssh-agent/scripts"
+	"p0-ssh-agent/types"
+)
+
+// forwardToTarget answers a call routed to a target with the target's own
+// response, compressed and signed like provisioning responses
+func (c *Client) forwardToTarget(ctx context.Context, route *forward.Route, request types.ForwardedRequest, params json.RawMessage) types.ForwardedResponse {
+	logger := c.logger.WithFields(logrus.Fields{
+		"target": route.Name(),
+		"method": request.Method,
+		"path":   request.Path,
+	})
+	logger.Info("🔀 Forwarding request to target")
+
+	start := time.Now()
+	var response types.ForwardedResponse
+	var cached bool
+	if forward.IsStream(request) {
+		response = c.openTargetStream(route, request)
+	} else {
+		response, cached = route.Forward(ctx, request)
+	}
+	metrics.TargetRequests.Inc(route.Name(), fmt.Sprintf("%dxx", response.Status/100))
+	if cached {
+		metrics.TargetCacheHits.Inc(route.Name())
+	}
+
+	logger = logger.WithFields(logrus.Fields{
+		"status":   response.Status,
+		"cached":   cached,
+		"duration": time.Since(start).Round(time.Millisecond),
+	})
+	if response.StreamID != "" {
+		logger.WithField("stream", response.StreamID).Info("📡 Target stream opened")
+	} else if response.Status >= 500 {
+		logger.Warn("📤 Target request failed")
+	} else {
+		logger.Info("📤 Target responded")
+	}
+
+	scripts.RecordTargetCall(route.Name(), response.Status, cached, requestOrigin(request), c.logger)
+
+	if threshold := c.compressThreshold(); threshold > 0 {
+		c.compressResponse(&response, threshold)
+	}
+	if c.currentConfig().SignResponses {
+		c.signResponse(&response, params)
+	}
+	return response
+}
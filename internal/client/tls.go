@@ -0,0 +1,51 @@
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"p0-ssh-agent/types"
+)
+
+// tlsConfig builds the TLS settings for the tunnel handshake: a client
+// certificate for edges that require mutual TLS, the CAs to trust and the
+// name to verify. tlsCaFile replaces the system roots. Files are read on every
+// dial so renewed certificates are picked up on the next reconnect. It returns
+// nil when nothing is configured.
+func tlsConfig(config *types.Config) (*tls.Config, error) {
+	if !config.HasTLSOptions() {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         config.TLSServerName,
+		InsecureSkipVerify: config.TLSInsecureSkipVerify,
+	}
+
+	if config.ClientCertPath != "" {
+		certificate, err := tls.LoadX509KeyPair(config.ClientCertPath, config.ClientKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate %s: %w", config.ClientCertPath, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	if config.TLSCAFile == "" {
+		return tlsConfig, nil
+	}
+
+	bundle, err := os.ReadFile(config.TLSCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %w", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(bundle) {
+		return nil, fmt.Errorf("no certificates found in CA file %s", config.TLSCAFile)
+	}
+	tlsConfig.RootCAs = roots
+
+	return tlsConfig, nil
+}
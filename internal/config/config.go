@@ -2,8 +2,8 @@ package config
 
 import (
 	"fmt"
-	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/spf13/viper"
@@ -12,7 +12,7 @@ import (
 
 func LoadWithOverrides(configPath string, flagOverrides map[string]interface{}) (*types.Config, error) {
 	v := viper.New()
-	
+
 	if configPath != "" {
 		v.SetConfigFile(configPath)
 	} else {
@@ -27,19 +27,21 @@ func LoadWithOverrides(configPath string, flagOverrides map[string]interface{})
 			v.AddConfigPath("/etc/p0")
 		}
 	}
-	
+
 	v.SetEnvPrefix("P0_SSH_AGENT")
 	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 	v.AutomaticEnv()
-	
+
 	setDefaults(v)
-	
+
 	if err := v.ReadInConfig(); err != nil {
 		if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
 			return nil, fmt.Errorf("error reading config file: %w", err)
 		}
 	}
-	
+
+	applyWritableDir(v)
+
 	for key, value := range flagOverrides {
 		switch val := value.(type) {
 		case string:
@@ -64,16 +66,20 @@ func LoadWithOverrides(configPath string, flagOverrides map[string]interface{})
 			}
 		}
 	}
-	
+
+	deprecations := applyDeprecations(v)
+
 	config := &types.Config{}
 	if err := v.Unmarshal(config); err != nil {
 		return nil, fmt.Errorf("error unmarshaling config: %w", err)
 	}
-	
+	config.ConfigPath = v.ConfigFileUsed()
+	config.Deprecations = deprecations
+
 	if err := validateConfig(config); err != nil {
 		return nil, fmt.Errorf("config validation failed: %w", err)
 	}
-	
+
 	return config, nil
 }
 
@@ -82,48 +88,72 @@ func Load() (*types.Config, error) {
 }
 
 func setDefaults(v *viper.Viper) {
-	v.SetDefault("version", "1.0")
-	v.SetDefault("tunnelHost", "wss://api.p0.app")
-	v.SetDefault("keyPath", "/etc/p0-ssh-agent/keys")
-	v.SetDefault("environmentId", "default")
-	v.SetDefault("heartbeatIntervalSeconds", 60)
-	v.SetDefault("labels", []string{})
+	defaults := types.DefaultConfig()
+	v.SetDefault("version", defaults.Version)
+	v.SetDefault("tunnelHost", defaults.TunnelHost)
+	v.SetDefault("tunnelTimeoutMs", defaults.TunnelTimeoutMs)
+	v.SetDefault("jwtNotBeforeSeconds", defaults.JWTNotBeforeSeconds)
+	v.SetDefault("jwtExpiryLeewaySeconds", defaults.JWTExpiryLeewaySeconds)
+	v.SetDefault("keyPath", defaults.KeyPath)
+	v.SetDefault("stateDir", defaults.StateDir)
+	v.SetDefault("environmentId", defaults.EnvironmentId)
+	v.SetDefault("heartbeatIntervalSeconds", defaults.HeartbeatIntervalSeconds)
+	v.SetDefault("bulkRevokeConcurrency", defaults.BulkRevokeConcurrency)
+	v.SetDefault("shutdownDrainSeconds", defaults.ShutdownDrainSeconds)
+	v.SetDefault("rpcAllowlist", defaults.RPCAllowlist)
+	v.SetDefault("fetchFileAllowlist", defaults.FetchFileAllowlist)
+	v.SetDefault("fetchFileMaxBytes", defaults.FetchFileMaxBytes)
+	v.SetDefault("endpointProbeSeconds", defaults.EndpointProbeSeconds)
+	v.SetDefault("endpointSelection", defaults.EndpointSelection)
+	v.SetDefault("failoverAfterAttempts", defaults.FailoverAfterAttempts)
+	v.SetDefault("controlSocket", defaults.ControlSocket)
+	v.SetDefault("labels", defaults.Labels)
 }
 
-func validateConfig(config *types.Config) error {
-	if config.TunnelHost == "" {
-		return fmt.Errorf("tunnelHost is required")
-	}
-	
-	u, err := url.Parse(config.TunnelHost)
-	if err != nil {
-		return fmt.Errorf("invalid tunnelHost URL: %w", err)
-	}
-	
-	if u.Scheme != "ws" && u.Scheme != "wss" {
-		return fmt.Errorf("tunnelHost URL must use ws:// or wss:// scheme, got %q", u.Scheme)
-	}
-	
-	if u.Host == "" {
-		return fmt.Errorf("tunnelHost URL must include a host")
-	}
-	
-	if config.KeyPath == "" {
-		return fmt.Errorf("keyPath is required")
+// applyWritableDir moves the defaults of mutable paths under writableDir, used on
+// hosts with a read-only root filesystem. Paths set explicitly are kept.
+func applyWritableDir(v *viper.Viper) {
+	writableDir := v.GetString("writableDir")
+	if writableDir == "" {
+		return
 	}
-	
-	
-	if config.HeartbeatIntervalSeconds <= 0 {
-		return fmt.Errorf("heartbeatIntervalSeconds must be greater than 0")
+
+	v.SetDefault("keyPath", filepath.Join(writableDir, "keys"))
+	v.SetDefault("stateDir", filepath.Join(writableDir, "state"))
+}
+
+// applyDeprecations copies deprecated keys onto their replacements unless the
+// replacement is set explicitly, and returns a message for each one found
+func applyDeprecations(v *viper.Viper) []string {
+	var messages []string
+	for _, deprecated := range types.DeprecatedKeys {
+		if !v.IsSet(deprecated.Key) {
+			continue
+		}
+
+		messages = append(messages, deprecated.Message())
+
+		if deprecated.Replacement != "" && !v.InConfig(deprecated.Replacement) {
+			v.Set(deprecated.Replacement, v.Get(deprecated.Key))
+		}
 	}
-	
-	if config.OrgID == "" {
-		return fmt.Errorf("orgId is required")
+	return messages
+}
+
+func validateConfig(config *types.Config) error {
+	tunnelURL, err := NormalizeTunnelHost(config.TunnelHost, config.TunnelPort, config.TunnelPath)
+	if err != nil {
+		return err
 	}
-	
-	if config.HostID == "" {
-		return fmt.Errorf("hostId is required")
+	config.TunnelHost = tunnelURL
+
+	for i, host := range config.TunnelHosts {
+		tunnelURL, err := NormalizeTunnelHost(host, config.TunnelPort, config.TunnelPath)
+		if err != nil {
+			return fmt.Errorf("tunnelHosts: %w", err)
+		}
+		config.TunnelHosts[i] = tunnelURL
 	}
-	
-	return nil
-}
\ No newline at end of file
+
+	return config.Validate()
+}
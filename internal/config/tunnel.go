@@ -0,0 +1,91 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// schemeAliases maps accepted URL schemes to the WebSocket scheme used to dial
+var schemeAliases = map[string]string{
+	"ws":    "ws",
+	"wss":   "wss",
+	"http":  "ws",
+	"https": "wss",
+}
+
+// NormalizeTunnelHost turns the accepted tunnelHost variants into a full WebSocket URL:
+//
+//	wss://p0.example.com/websocket   full URL (query params are kept)
+//	https://p0.example.com           http(s) is mapped to ws(s)
+//	p0.example.com:8443/websocket    no scheme defaults to wss://
+//	[2001:db8::1]:8443, 2001:db8::1  IPv6 literals, with or without brackets
+//
+// tunnelPort and tunnelPath are applied when the host does not already specify them.
+func NormalizeTunnelHost(tunnelHost string, tunnelPort int, tunnelPath string) (string, error) {
+	raw := strings.TrimSpace(tunnelHost)
+	if raw == "" {
+		return "", fmt.Errorf("tunnelHost is required")
+	}
+
+	if !strings.Contains(raw, "://") {
+		// A bare IPv6 address has several colons and must be bracketed before parsing
+		if ip := net.ParseIP(raw); ip != nil && strings.Contains(raw, ":") {
+			raw = "[" + raw + "]"
+		}
+		raw = "wss://" + raw
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("invalid tunnelHost %q: %w", tunnelHost, err)
+	}
+
+	scheme, ok := schemeAliases[strings.ToLower(u.Scheme)]
+	if !ok {
+		return "", fmt.Errorf("invalid tunnelHost %q: unsupported scheme %q (use ws://, wss://, http:// or https://)", tunnelHost, u.Scheme)
+	}
+	u.Scheme = scheme
+
+	if u.Hostname() == "" {
+		return "", fmt.Errorf("invalid tunnelHost %q: missing host", tunnelHost)
+	}
+
+	if u.User != nil {
+		return "", fmt.Errorf("invalid tunnelHost %q: credentials in the URL are not supported", tunnelHost)
+	}
+
+	if u.Fragment != "" {
+		return "", fmt.Errorf("invalid tunnelHost %q: fragments (#%s) are not supported", tunnelHost, u.Fragment)
+	}
+
+	if port := u.Port(); port != "" {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return "", fmt.Errorf("invalid tunnelHost %q: port %q must be between 1 and 65535", tunnelHost, port)
+		}
+	}
+
+	if tunnelPort != 0 {
+		if tunnelPort < 1 || tunnelPort > 65535 {
+			return "", fmt.Errorf("tunnelPort %d must be between 1 and 65535", tunnelPort)
+		}
+		if port := u.Port(); port != "" && port != strconv.Itoa(tunnelPort) {
+			return "", fmt.Errorf("tunnelPort %d conflicts with port %s in tunnelHost %q", tunnelPort, port, tunnelHost)
+		}
+		u.Host = net.JoinHostPort(u.Hostname(), strconv.Itoa(tunnelPort))
+	}
+
+	if tunnelPath != "" {
+		if !strings.HasPrefix(tunnelPath, "/") {
+			tunnelPath = "/" + tunnelPath
+		}
+		if u.Path != "" && u.Path != "/" && u.Path != tunnelPath {
+			return "", fmt.Errorf("tunnelPath %q conflicts with path %q in tunnelHost %q", tunnelPath, u.Path, tunnelHost)
+		}
+		u.Path = tunnelPath
+	}
+
+	return u.String(), nil
+}
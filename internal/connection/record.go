@@ -0,0 +1,111 @@
+package connection
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// FileName records the tunnel connection inside the agent state directory so
+// status can report it without asking the running agent
+const FileName = "connection.json"
+
+// State is the running agent's view of its tunnel connection. The agent
+// rewrites it on every connection change and successful heartbeat.
+type State struct {
+	Connected bool   `json:"connected" yaml:"connected"`
+	Endpoint  string `json:"endpoint,omitempty" yaml:"endpoint,omitempty"`
+
+	// ConnectedSince and LastHeartbeat are RFC 3339 timestamps
+	ConnectedSince string `json:"connectedSince,omitempty" yaml:"connectedSince,omitempty"`
+	LastHeartbeat  string `json:"lastHeartbeat,omitempty" yaml:"lastHeartbeat,omitempty"`
+
+	HeartbeatIntervalSeconds int `json:"heartbeatIntervalSeconds" yaml:"heartbeatIntervalSeconds"`
+
+	// TokenExpiresAt is when the JWT authenticating the connection expires,
+	// as an RFC 3339 timestamp; reauthenticate moves it forward
+	TokenExpiresAt string `json:"tokenExpiresAt,omitempty" yaml:"tokenExpiresAt,omitempty"`
+
+	// Reconnecting is set while a reconnect is pending, FailedAttempts counts
+	// consecutive failed connection attempts since FailingSince and
+	// NextAttempt is when the backoff allows the next one. GaveUp is set when
+	// the reconnect policy ran out and the agent exited.
+	Reconnecting   bool    `json:"reconnecting" yaml:"reconnecting"`
+	FailedAttempts int     `json:"failedAttempts" yaml:"failedAttempts"`
+	FailingSince   string  `json:"failingSince,omitempty" yaml:"failingSince,omitempty"`
+	BackoffSeconds float64 `json:"backoffSeconds,omitempty" yaml:"backoffSeconds,omitempty"`
+	NextAttempt    string  `json:"nextAttempt,omitempty" yaml:"nextAttempt,omitempty"`
+	GaveUp         bool    `json:"gaveUp,omitempty" yaml:"gaveUp,omitempty"`
+	Reconnects     int     `json:"reconnects" yaml:"reconnects"`
+	LastError      string  `json:"lastError,omitempty" yaml:"lastError,omitempty"`
+
+	// Stopped is set when the agent shuts down
+	Stopped   bool   `json:"stopped,omitempty" yaml:"stopped,omitempty"`
+	UpdatedAt string `json:"updatedAt" yaml:"updatedAt"`
+}
+
+// Path returns the connection record path for a state directory
+func Path(stateDir string) string {
+	return filepath.Join(stateDir, FileName)
+}
+
+// Save records the connection state
+func Save(path string, state State) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal connection state: %w", err)
+	}
+
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write connection record: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to replace connection record: %w", err)
+	}
+	return nil
+}
+
+// Load returns the recorded state; ok is false when none was recorded
+func Load(path string) (state State, ok bool, err error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, false, nil
+	}
+	if err != nil {
+		return state, false, fmt.Errorf("failed to read connection record: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, false, fmt.Errorf("failed to parse connection record %s: %w", path, err)
+	}
+	return state, true, nil
+}
+
+// Stale explains why the connection cannot be considered live at now, or
+// returns "" when it is: the agent must be connected and have completed a
+// heartbeat within two heartbeat intervals, as the agent itself requires
+func (s State) Stale(now time.Time) string {
+	if s.Stopped {
+		return "agent is stopped"
+	}
+	if !s.Connected {
+		if s.Reconnecting || s.FailedAttempts > 0 {
+			return "agent is reconnecting"
+		}
+		return "agent is not connected"
+	}
+
+	lastHeartbeat, err := time.Parse(time.RFC3339, s.LastHeartbeat)
+	if err != nil {
+		return "no heartbeat recorded"
+	}
+
+	interval := time.Duration(s.HeartbeatIntervalSeconds) * time.Second
+	if age := now.Sub(lastHeartbeat); interval > 0 && age > 2*interval {
+		return fmt.Sprintf("last heartbeat %s ago exceeds twice the %s interval", age.Round(time.Second), interval)
+	}
+	return ""
+}
@@ -0,0 +1,72 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Client calls the control API of a running agent
+type Client struct {
+	socket string
+	http   *http.Client
+}
+
+// NewClient returns a client for the agent listening on socket. timeout
+// bounds each call; zero waits as long as the agent takes.
+func NewClient(socket string, timeout time.Duration) *Client {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socket)
+		},
+	}
+
+	return &Client{
+		socket: socket,
+		http:   &http.Client{Transport: transport, Timeout: timeout},
+	}
+}
+
+// Get calls a GET endpoint and decodes the reply into out
+func (c *Client) Get(path string, out interface{}) error {
+	return c.do(http.MethodGet, path, out)
+}
+
+// Post calls a POST endpoint and decodes the reply, if any, into out
+func (c *Client) Post(path string, out interface{}) error {
+	return c.do(http.MethodPost, path, out)
+}
+
+func (c *Client) do(method, path string, out interface{}) error {
+	// The host is ignored; every request goes to the socket
+	req, err := http.NewRequest(method, "http://agent"+path, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach the agent on %s: %w", c.socket, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var failure errorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&failure); err != nil || failure.Error == "" {
+			return fmt.Errorf("agent returned %s", resp.Status)
+		}
+		return fmt.Errorf("agent returned %s: %s", resp.Status, failure.Error)
+	}
+
+	if out == nil || resp.StatusCode == http.StatusAccepted {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode agent response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package control
+
+import (
+	"errors"
+	"time"
+
+	"p0-ssh-agent/internal/connection"
+	"p0-ssh-agent/scripts"
+)
+
+// API paths served on the control socket
+const (
+	PathHealth     = "/v1/health"
+	PathConnection = "/v1/connection"
+	PathGrants     = "/v1/grants"
+	PathReconnect  = "/v1/reconnect"
+	PathDrain      = "/v1/drain"
+	PathReload     = "/v1/reload"
+	PathRevoke     = "/v1/revoke"
+	PathGoingDown  = "/v1/going-down"
+)
+
+// ErrConflict is returned by an Agent when a request cannot be honoured in
+// the agent's current state, such as a reconnect while disconnected
+var ErrConflict = errors.New("rejected by the running agent")
+
+// ErrInvalid is returned by an Agent for a request with invalid parameters
+var ErrInvalid = errors.New("invalid request")
+
+// Agent is the running agent as seen through the control socket
+type Agent interface {
+	Health() Health
+	Connection() connection.State
+	Grants() ([]Grant, error)
+	Reconnect() error
+	Drain(timeout time.Duration) DrainResult
+	Reload() (ReloadResult, error)
+	Revoke(filter scripts.RevokeFilter) RevokeResult
+	AnnounceShutdown(reason, message string) error
+}
+
+// Health summarises the running agent. Times are RFC 3339.
+type Health struct {
+	Healthy       bool   `json:"healthy"`
+	Version       string `json:"version"`
+	ClientID      string `json:"clientId"`
+	PID           int    `json:"pid"`
+	StartedAt     string `json:"startedAt"`
+	Connected     bool   `json:"connected"`
+	LastHeartbeat string `json:"lastHeartbeat,omitempty"`
+	Draining      bool   `json:"draining"`
+	InFlight      int    `json:"inFlight"`
+	DryRun        bool   `json:"dryRun"`
+
+	// BandwidthProfile is the profile in effect, from the configuration or
+	// the backend's setBandwidthProfile
+	BandwidthProfile string `json:"bandwidthProfile"`
+
+	// GoingDown is the reason announced for the next shutdown, if any
+	GoingDown string `json:"goingDown,omitempty"`
+}
+
+// Grant is access the agent currently holds open on this host: applied and
+// not yet expired, or scheduled for a future window. Times are RFC 3339.
+type Grant struct {
+	Key       string `json:"key"`
+	RequestID string `json:"requestId"`
+	Command   string `json:"command"`
+	UserName  string `json:"userName"`
+	Status    string `json:"status"`
+	GrantedAt string `json:"grantedAt,omitempty"`
+	ExpiresAt string `json:"expiresAt,omitempty"`
+	ValidFrom string `json:"validFrom,omitempty"`
+	ValidTo   string `json:"validTo,omitempty"`
+	Batch     string `json:"batch,omitempty"`
+}
+
+// FormatTime formats t for the API, or "" for the zero time
+func FormatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// DrainResult reports a drain. Idle is false when provisioning was still
+// running once the timeout passed.
+type DrainResult struct {
+	Draining bool `json:"draining"`
+	Idle     bool `json:"idle"`
+	InFlight int  `json:"inFlight"`
+}
+
+// ReloadResult lists the configuration keys a reload changed
+type ReloadResult struct {
+	Changed []string `json:"changed"`
+}
+
+// RevokeResult reports a local revoke: scheduled grants that were cancelled
+// and the outcome of every revoke that ran
+type RevokeResult struct {
+	Success   bool                           `json:"success"`
+	Message   string                         `json:"message,omitempty"`
+	Error     string                         `json:"error,omitempty"`
+	Cancelled []string                       `json:"cancelled"`
+	Revoked   []scripts.BulkRevokeItemResult `json:"revoked"`
+}
+
+// NewRevokeResult combines cancelled scheduled grants with the result of scripts.RevokeRecorded
+func NewRevokeResult(cancelled []string, result scripts.ProvisioningResult) RevokeResult {
+	revoked, _ := result.Data.([]scripts.BulkRevokeItemResult)
+	if cancelled == nil {
+		cancelled = []string{}
+	}
+	if revoked == nil {
+		revoked = []scripts.BulkRevokeItemResult{}
+	}
+	return RevokeResult{
+		Success:   result.Success,
+		Message:   result.Message,
+		Error:     result.Error,
+		Cancelled: cancelled,
+		Revoked:   revoked,
+	}
+}
+
+// errorResponse is the body of every failed request
+type errorResponse struct {
+	Error string `json:"error"`
+}
@@ -0,0 +1,142 @@
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/internal/unixsocket"
+	"p0-ssh-agent/scripts"
+)
+
+// Serve listens on the unix socket at path and serves the control API for
+// agent until the server is closed. Only root can connect: the socket is
+// created with mode 0600. A socket left behind by a previous run is
+// replaced, but one another agent is still listening on is not.
+func Serve(path string, agent Agent, logger *logrus.Logger) (*http.Server, error) {
+	listener, err := unixsocket.Listen(path, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &http.Server{
+		Handler:           newHandler(agent, logger),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	go func() {
+		logger.WithField("socket", path).Info("🎛️ Serving control API")
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.WithError(err).Error("Control socket stopped")
+		}
+	}()
+
+	return server, nil
+}
+
+func newHandler(agent Agent, logger *logrus.Logger) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET "+PathHealth, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, agent.Health())
+	})
+
+	mux.HandleFunc("GET "+PathConnection, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, agent.Connection())
+	})
+
+	mux.HandleFunc("GET "+PathGrants, func(w http.ResponseWriter, r *http.Request) {
+		grants, err := agent.Grants()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, grants)
+	})
+
+	mux.HandleFunc("POST "+PathReconnect, func(w http.ResponseWriter, r *http.Request) {
+		logger.Info("🎛️ Reconnect requested on the control socket")
+		if err := agent.Reconnect(); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	mux.HandleFunc("POST "+PathDrain, func(w http.ResponseWriter, r *http.Request) {
+		var timeout time.Duration
+		if value := r.URL.Query().Get("timeout"); value != "" {
+			parsed, err := time.ParseDuration(value)
+			if err != nil || parsed < 0 {
+				writeJSON(w, http.StatusBadRequest, errorResponse{Error: fmt.Sprintf("invalid timeout %q", value)})
+				return
+			}
+			timeout = parsed
+		}
+
+		logger.WithField("timeout", timeout).Info("🎛️ Drain requested on the control socket")
+		writeJSON(w, http.StatusOK, agent.Drain(timeout))
+	})
+
+	mux.HandleFunc("POST "+PathReload, func(w http.ResponseWriter, r *http.Request) {
+		logger.Info("🎛️ Configuration reload requested on the control socket")
+		result, err := agent.Reload()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, result)
+	})
+
+	mux.HandleFunc("POST "+PathRevoke, func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		filter := scripts.RevokeFilter{
+			All:       query.Get("all") == "true",
+			UserName:  query.Get("user"),
+			RequestID: query.Get("requestId"),
+		}
+		if err := filter.Validate(); err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+			return
+		}
+
+		logger.WithFields(logrus.Fields{
+			"all":        filter.All,
+			"username":   filter.UserName,
+			"request_id": filter.RequestID,
+		}).Warn("🎛️ Revoke requested on the control socket")
+		writeJSON(w, http.StatusOK, agent.Revoke(filter))
+	})
+
+	mux.HandleFunc("POST "+PathGoingDown, func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if err := agent.AnnounceShutdown(query.Get("reason"), query.Get("message")); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	return mux
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrConflict):
+		status = http.StatusConflict
+	case errors.Is(err, ErrInvalid):
+		status = http.StatusBadRequest
+	}
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,127 @@
+package control
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/internal/connection"
+	"p0-ssh-agent/scripts"
+)
+
+// fakeAgent answers the control API and records the revokes it was asked for
+type fakeAgent struct {
+	reconnectErr error
+	revoked      []scripts.RevokeFilter
+}
+
+func (a *fakeAgent) Health() Health {
+	return Health{Healthy: true, Version: "1.2.3", ClientID: "org:host:ssh"}
+}
+
+func (a *fakeAgent) Connection() connection.State {
+	return connection.State{}
+}
+
+func (a *fakeAgent) Grants() ([]Grant, error) {
+	return []Grant{{RequestID: "req-1", Command: "provisionSudo", UserName: "alice"}}, nil
+}
+
+func (a *fakeAgent) Reconnect() error {
+	return a.reconnectErr
+}
+
+func (a *fakeAgent) Drain(timeout time.Duration) DrainResult {
+	return DrainResult{Draining: true, Idle: true}
+}
+
+func (a *fakeAgent) Reload() (ReloadResult, error) {
+	return ReloadResult{}, fmt.Errorf("%w: nothing to reload", ErrInvalid)
+}
+
+func (a *fakeAgent) Revoke(filter scripts.RevokeFilter) RevokeResult {
+	a.revoked = append(a.revoked, filter)
+	return NewRevokeResult(nil, scripts.ProvisioningResult{Success: true})
+}
+
+func (a *fakeAgent) AnnounceShutdown(reason, message string) error {
+	return nil
+}
+
+func serve(t *testing.T, agent Agent) (*Client, string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the control socket is a unix socket")
+	}
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	socket := filepath.Join(t.TempDir(), "control.sock")
+	server, err := Serve(socket, agent, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return NewClient(socket, 10*time.Second), socket
+}
+
+func TestServeSocketIsRootOnly(t *testing.T) {
+	_, socket := serve(t, &fakeAgent{})
+
+	info, err := os.Stat(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("socket mode %o, want 600", perm)
+	}
+}
+
+func TestServeAPI(t *testing.T) {
+	agent := &fakeAgent{reconnectErr: fmt.Errorf("%w: not connected", ErrConflict)}
+	client, _ := serve(t, agent)
+
+	var health Health
+	if err := client.Get(PathHealth, &health); err != nil || !health.Healthy || health.Version != "1.2.3" {
+		t.Errorf("health = %+v, %v", health, err)
+	}
+
+	var grants []Grant
+	if err := client.Get(PathGrants, &grants); err != nil || len(grants) != 1 || grants[0].RequestID != "req-1" {
+		t.Errorf("grants = %+v, %v", grants, err)
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		wantErr string
+	}{
+		{name: "conflict", path: PathReconnect, wantErr: "409"},
+		{name: "invalid request", path: PathReload, wantErr: "400"},
+		{name: "revoke without a selection", path: PathRevoke, wantErr: "400"},
+		{name: "drain with a negative timeout", path: PathDrain + "?timeout=-1s", wantErr: "400"},
+		{name: "revoke a user", path: PathRevoke + "?user=alice"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := client.Post(tt.path, nil)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("Post: %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("Post error = %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+
+	if len(agent.revoked) != 1 || agent.revoked[0].UserName != "alice" {
+		t.Errorf("revokes %+v, want only alice's", agent.revoked)
+	}
+}
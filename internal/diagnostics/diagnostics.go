@@ -0,0 +1,182 @@
+package diagnostics
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/internal/bundle"
+	"p0-ssh-agent/internal/elevate"
+	"p0-ssh-agent/internal/jwt"
+	"p0-ssh-agent/internal/osplugins"
+	"p0-ssh-agent/internal/version"
+	"p0-ssh-agent/types"
+)
+
+// commandTimeout bounds each external command so a hung tool cannot stall collection
+const commandTimeout = 10 * time.Second
+
+// AgentInfo describes the agent build and identity at collection time
+type AgentInfo struct {
+	Version     string `json:"version"`
+	BuildTime   string `json:"buildTime"`
+	GitCommit   string `json:"gitCommit"`
+	GoVersion   string `json:"goVersion"`
+	OS          string `json:"os"`
+	Arch        string `json:"arch"`
+	Hostname    string `json:"hostname"`
+	ClientID    string `json:"clientId"`
+	CollectedAt string `json:"collectedAt"`
+
+	// Omitted names the details disableCollection keeps out of the bundle
+	Omitted []string `json:"omitted,omitempty"`
+}
+
+// Collect builds a gzip-compressed tar bundle with agent, service and host details.
+// The private key is never included, nor anything disableCollection withholds:
+// without hostname collection uname leaves out the node name and the journal
+// is exported without its hostname column. Secrets in the configuration file
+// are redacted.
+func Collect(cfg *types.Config, configPath, serviceName string, logger *logrus.Logger) ([]byte, error) {
+	var entries []bundle.Entry
+
+	add := func(name string, data []byte) {
+		logger.WithFields(logrus.Fields{
+			"name": name,
+			"size": len(data),
+		}).Debug("Adding diagnostics entry")
+		entries = append(entries, bundle.Entry{Name: name, Mode: 0644, Data: data})
+	}
+
+	collection := cfg.GetCollection()
+
+	var hostname string
+	if collection.Allows(types.CollectHostname) {
+		hostname, _ = os.Hostname()
+	}
+	info := AgentInfo{
+		Version:     version.GetVersion(),
+		BuildTime:   version.GetBuildTime(),
+		GitCommit:   version.GetGitCommit(),
+		GoVersion:   runtime.Version(),
+		OS:          runtime.GOOS,
+		Arch:        runtime.GOARCH,
+		Hostname:    hostname,
+		ClientID:    cfg.GetClientID(),
+		CollectedAt: time.Now().UTC().Format(time.RFC3339),
+		Omitted:     collection.Omitted(),
+	}
+	infoData, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal agent info: %w", err)
+	}
+	add("agent.json", infoData)
+
+	if configPath != "" {
+		add("config/"+filepath.Base(configPath), readConfig(configPath))
+	}
+	add("keys/"+jwt.PublicKeyFile, readFile(filepath.Join(cfg.GetKeyDir(), jwt.PublicKeyFile)))
+	add("state/listing.txt", listDirectory(cfg.StateDir))
+
+	add("system/os-release", readFile("/etc/os-release"))
+	if collection.Allows(types.CollectHostname) {
+		add("system/uname.txt", runCommand("uname", "-a"))
+	} else {
+		add("system/uname.txt", runCommand("uname", "-s", "-r", "-v", "-m"))
+	}
+	add("system/uptime.txt", runCommand("uptime"))
+	add("system/ip-addr.txt", runCommand("ip", "-brief", "addr"))
+
+	add("service/status.txt", runCommand("systemctl", "status", serviceName, "--no-pager"))
+	add("service/unit.txt", runCommand("systemctl", "cat", serviceName, "--no-pager"))
+	journalArgs := []string{"-u", serviceName, "-n", "1000", "--no-pager"}
+	if !collection.Allows(types.CollectHostname) {
+		journalArgs = append(journalArgs, "-o", "cat")
+	}
+	add("service/journal.txt", runCommand("journalctl", journalArgs...))
+
+	add("sshd/effective-config.txt", runPrivileged(osplugins.Selected().SSHDPath(), "-T"))
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if err := bundle.Write(gz, entries); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, fmt.Errorf("failed to compress diagnostics: %w", err)
+	}
+
+	logger.WithFields(logrus.Fields{
+		"entries": len(entries),
+		"size":    buf.Len(),
+	}).Info("🩺 Diagnostics bundle collected")
+
+	return buf.Bytes(), nil
+}
+
+// readFile returns the file content, or a description of why it could not be read,
+// so a single missing file does not fail the whole bundle
+func readFile(path string) []byte {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return []byte(fmt.Sprintf("unavailable: %v\n", err))
+	}
+	return data
+}
+
+// readConfig returns the configuration file with its secrets redacted
+func readConfig(path string) []byte {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return []byte(fmt.Sprintf("unavailable: %v\n", err))
+	}
+	return redactConfig(data)
+}
+
+func runCommand(name string, args ...string) []byte {
+	return run(exec.CommandContext, name, args...)
+}
+
+// runPrivileged is runCommand as root: directly when the agent is root and
+// through sudo otherwise
+func runPrivileged(name string, args ...string) []byte {
+	return run(elevate.CommandContext, name, args...)
+}
+
+func run(command func(ctx context.Context, name string, arg ...string) *exec.Cmd, name string, args ...string) []byte {
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+
+	output, err := command(ctx, name, args...).CombinedOutput()
+	if err != nil {
+		header := fmt.Sprintf("$ %s %s\ncommand failed: %v\n\n", name, strings.Join(args, " "), err)
+		return append([]byte(header), output...)
+	}
+	return output
+}
+
+func listDirectory(dir string) []byte {
+	var b strings.Builder
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			fmt.Fprintf(&b, "%s: %v\n", path, err)
+			return nil
+		}
+		fmt.Fprintf(&b, "%s %10d %s %s\n", info.Mode(), info.Size(), info.ModTime().UTC().Format(time.RFC3339), path)
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintf(&b, "walk failed: %v\n", err)
+	}
+	return []byte(b.String())
+}
@@ -0,0 +1,66 @@
+package diagnostics
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// redactedValue replaces secrets in the configuration file of a bundle
+const redactedValue = "REDACTED"
+
+// redactConfig returns the configuration file with its secrets replaced: the
+// password of proxyUrl and the header values of audit sinks, which commonly
+// hold tokens. Keys match case-insensitively, as when the agent reads them. A
+// file that cannot be parsed is left out rather than copied unredacted.
+func redactConfig(data []byte) []byte {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return []byte(fmt.Sprintf("unavailable: cannot parse the configuration to redact it: %v\n", err))
+	}
+	redactNode(&root)
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&root); err != nil {
+		return []byte(fmt.Sprintf("unavailable: cannot encode the redacted configuration: %v\n", err))
+	}
+	encoder.Close()
+	return buf.Bytes()
+}
+
+func redactNode(node *yaml.Node) {
+	if node.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			switch {
+			case strings.EqualFold(key.Value, "proxyUrl") && value.Kind == yaml.ScalarNode:
+				value.Value = redactURL(value.Value)
+			case strings.EqualFold(key.Value, "headers") && value.Kind == yaml.MappingNode:
+				for j := 1; j < len(value.Content); j += 2 {
+					value.Content[j] = &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: redactedValue}
+				}
+			}
+		}
+	}
+	for _, child := range node.Content {
+		redactNode(child)
+	}
+}
+
+// redactURL replaces the password of rawURL, keeping the user name so
+// proxy authentication problems can still be diagnosed
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return redactedValue
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), redactedValue)
+	}
+	return u.String()
+}
@@ -0,0 +1,199 @@
+package doctor
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/internal/elevate"
+)
+
+// executableLocations are checked when the binary is not on PATH
+var executableLocations = []string{
+	"/usr/local/bin/p0-ssh-agent",
+	"/usr/bin/p0-ssh-agent",
+	"/opt/p0/bin/p0-ssh-agent",
+}
+
+// UnitBinaryCheck compares the binary referenced by the unit's ExecStart with
+// the binary an operator would run, which diverge after upgrades to a new path
+type UnitBinaryCheck struct {
+	UnitPath        string
+	UnitBinary      string
+	UnitVersion     string
+	DetectedBinary  string
+	DetectedVersion string
+}
+
+// PathMismatch reports whether the unit runs a different file than the detected binary
+func (c UnitBinaryCheck) PathMismatch() bool {
+	return !sameFile(c.UnitBinary, c.DetectedBinary)
+}
+
+// VersionMismatch reports whether both binaries exist but report different versions
+func (c UnitBinaryCheck) VersionMismatch() bool {
+	return c.UnitVersion != "" && c.DetectedVersion != "" && c.UnitVersion != c.DetectedVersion
+}
+
+// OK reports whether the unit runs the detected binary
+func (c UnitBinaryCheck) OK() bool {
+	return !c.PathMismatch()
+}
+
+// UnitPath returns the systemd unit file path for a service
+func UnitPath(serviceName string) string {
+	return fmt.Sprintf("/etc/systemd/system/%s.service", serviceName)
+}
+
+// CheckUnitBinary inspects the service unit and the installed executable
+func CheckUnitBinary(serviceName string, logger *logrus.Logger) (UnitBinaryCheck, error) {
+	check := UnitBinaryCheck{UnitPath: UnitPath(serviceName)}
+
+	content, err := os.ReadFile(check.UnitPath)
+	if err != nil {
+		return check, fmt.Errorf("failed to read unit file: %w", err)
+	}
+
+	execStart, err := parseExecStart(string(content))
+	if err != nil {
+		return check, err
+	}
+	check.UnitBinary = execStart[0]
+
+	detected, err := detectExecutable()
+	if err != nil {
+		return check, err
+	}
+	check.DetectedBinary = detected
+
+	check.UnitVersion = binaryVersion(check.UnitBinary)
+	check.DetectedVersion = binaryVersion(check.DetectedBinary)
+
+	logger.WithFields(logrus.Fields{
+		"unit_binary":      check.UnitBinary,
+		"unit_version":     check.UnitVersion,
+		"detected_binary":  check.DetectedBinary,
+		"detected_version": check.DetectedVersion,
+	}).Debug("Compared unit ExecStart with detected executable")
+
+	return check, nil
+}
+
+// FixUnitBinary rewrites ExecStart to use the detected binary, keeping its arguments
+// and every other unit setting, then reloads systemd
+func FixUnitBinary(check UnitBinaryCheck, logger *logrus.Logger) error {
+	content, err := os.ReadFile(check.UnitPath)
+	if err != nil {
+		return fmt.Errorf("failed to read unit file: %w", err)
+	}
+
+	var out strings.Builder
+	scanner := bufio.NewScanner(strings.NewReader(string(content)))
+	replaced := false
+	for scanner.Scan() {
+		line := scanner.Text()
+		if value, ok := execStartValue(line); ok && !replaced {
+			fields := strings.Fields(value)
+			if len(fields) > 0 && fields[0] == check.UnitBinary {
+				fields[0] = check.DetectedBinary
+				line = "ExecStart=" + strings.Join(fields, " ")
+				replaced = true
+			}
+		}
+		out.WriteString(line + "\n")
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to parse unit file: %w", err)
+	}
+
+	if !replaced {
+		return fmt.Errorf("ExecStart referencing %s not found in %s", check.UnitBinary, check.UnitPath)
+	}
+
+	if err := elevate.Privileged().WriteFile(check.UnitPath, []byte(out.String())); err != nil {
+		return fmt.Errorf("failed to write unit file: %w", err)
+	}
+
+	if err := elevate.Command("systemctl", "daemon-reload").Run(); err != nil {
+		return fmt.Errorf("failed to reload systemd: %w", err)
+	}
+
+	logger.WithFields(logrus.Fields{
+		"unit":   check.UnitPath,
+		"binary": check.DetectedBinary,
+	}).Info("✅ Unit ExecStart updated")
+
+	return nil
+}
+
+func parseExecStart(content string) ([]string, error) {
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		if value, ok := execStartValue(scanner.Text()); ok {
+			fields := strings.Fields(value)
+			if len(fields) > 0 {
+				return fields, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("unit file has no ExecStart")
+}
+
+func execStartValue(line string) (string, bool) {
+	trimmed := strings.TrimSpace(line)
+	if !strings.HasPrefix(trimmed, "ExecStart=") {
+		return "", false
+	}
+	// Strip systemd executable prefixes such as "-" or "@"
+	return strings.TrimLeft(strings.TrimPrefix(trimmed, "ExecStart="), "-@:+!"), true
+}
+
+func detectExecutable() (string, error) {
+	if path, err := exec.LookPath("p0-ssh-agent"); err == nil {
+		if abs, err := filepath.Abs(path); err == nil {
+			return abs, nil
+		}
+		return path, nil
+	}
+
+	for _, location := range executableLocations {
+		if _, err := os.Stat(location); err == nil {
+			return location, nil
+		}
+	}
+
+	return "", fmt.Errorf("p0-ssh-agent executable not found in PATH or %v", executableLocations)
+}
+
+// binaryVersion runs "<binary> version" and returns the reported version, or
+// an empty string when the binary is missing or does not report one
+func binaryVersion(binary string) string {
+	output, err := exec.Command(binary, "version").Output()
+	if err != nil {
+		return ""
+	}
+
+	firstLine := strings.SplitN(string(output), "\n", 2)[0]
+	if _, version, ok := strings.Cut(firstLine, " version "); ok {
+		return strings.TrimSpace(version)
+	}
+	return ""
+}
+
+func sameFile(a, b string) bool {
+	if a == b {
+		return true
+	}
+
+	aInfo, errA := os.Stat(a)
+	bInfo, errB := os.Stat(b)
+	if errA != nil || errB != nil {
+		return false
+	}
+	return os.SameFile(aInfo, bInfo)
+}
@@ -0,0 +1,51 @@
+// Package elevate runs the commands that need root privileges: directly when
+// the process already is root, through sudo otherwise. Minimal images often
+// ship without sudo, where only the first works.
+package elevate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+)
+
+// ErrUnavailable is returned when a step needs root privileges but the
+// process is not root and sudo is not installed
+var ErrUnavailable = errors.New("root privileges are required, but the process is not root and sudo is not installed")
+
+// IsRoot reports whether the process runs as root. Windows has no root; an
+// elevated shell is checked by the operations themselves.
+func IsRoot() bool {
+	return runtime.GOOS != "windows" && os.Geteuid() == 0
+}
+
+// SudoAvailable reports whether sudo is on the PATH
+func SudoAvailable() bool {
+	_, err := exec.LookPath("sudo")
+	return err == nil
+}
+
+// Check reports ErrUnavailable when Command cannot gain root privileges
+func Check() error {
+	if runtime.GOOS == "windows" || IsRoot() || SudoAvailable() {
+		return nil
+	}
+	return fmt.Errorf("%w: run as root or install sudo", ErrUnavailable)
+}
+
+// Command builds name to run with root privileges: as is when the process is
+// root, which also works without sudo, and through sudo otherwise
+func Command(name string, arg ...string) *exec.Cmd {
+	return CommandContext(context.Background(), name, arg...)
+}
+
+// CommandContext is Command for a process that ends with ctx, as ExecContext
+func CommandContext(ctx context.Context, name string, arg ...string) *exec.Cmd {
+	if IsRoot() || runtime.GOOS == "windows" {
+		return ExecContext(ctx, name, arg...)
+	}
+	return ExecContext(ctx, "sudo", append([]string{name}, arg...)...)
+}
@@ -0,0 +1,437 @@
+package elevate
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// ErrNotRegular refuses a path that is a symlink, directory or other
+// non-regular file where only a regular file is expected
+var ErrNotRegular = errors.New("not a regular file")
+
+// Files changes files only root may change. Direct makes the changes with the
+// os package, which needs the process to be root; otherwise each one runs the
+// equivalent command (cp, chmod, tee...) built by Command, normally through
+// sudo. Both leave a file with the same content, mode and owner.
+type Files struct {
+	Direct  bool
+	Command func(name string, arg ...string) *exec.Cmd
+}
+
+// Privileged returns Files for this process: direct when it is root, or on
+// Windows where an elevated shell needs no sudo, and through sudo otherwise
+func Privileged() Files {
+	return Files{
+		Direct:  IsRoot() || runtime.GOOS == "windows",
+		Command: Command,
+	}
+}
+
+// MkdirAll creates path and its missing parents like mkdir -p
+func (f Files) MkdirAll(path string) error {
+	if f.Direct {
+		return os.MkdirAll(path, 0755)
+	}
+	return f.run(nil, "mkdir", "-p", path)
+}
+
+// Chmod sets the permission bits of path, along with the setuid, setgid and
+// sticky bits of mode
+func (f Files) Chmod(path string, mode os.FileMode) error {
+	if f.Direct {
+		return os.Chmod(path, mode)
+	}
+
+	bits := uint64(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		bits |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		bits |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		bits |= 01000
+	}
+	return f.run(nil, "chmod", strconv.FormatUint(bits, 8), path)
+}
+
+// Chown sets the owner and group of path. IDs are numeric, so root's group
+// can be given as 0 on systems where it is called wheel. A symlink is changed
+// itself, never the file it points to.
+func (f Files) Chown(path string, uid, gid int) error {
+	if f.Direct {
+		return os.Lchown(path, uid, gid)
+	}
+	return f.run(nil, "chown", "-h", fmt.Sprintf("%d:%d", uid, gid), path)
+}
+
+// ChownAll sets the owner and group of path and everything beneath it
+func (f Files) ChownAll(path string, uid, gid int) error {
+	if f.Direct {
+		return filepath.WalkDir(path, func(name string, _ fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			return os.Lchown(name, uid, gid)
+		})
+	}
+	return f.run(nil, "chown", "-R", fmt.Sprintf("%d:%d", uid, gid), path)
+}
+
+// Copy copies src to dst like cp: a new dst gets the mode of src, an
+// existing one keeps its mode and owner
+func (f Files) Copy(src, dst string) error {
+	if !f.Direct {
+		return f.run(nil, "cp", src, dst)
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Rename moves src to dst like mv -f, replacing dst. Across filesystems, such
+// as from /tmp, src is copied with its mode and then removed.
+func (f Files) Rename(src, dst string) error {
+	if !f.Direct {
+		return f.run(nil, "mv", "-f", src, dst)
+	}
+
+	err := os.Rename(src, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := f.Copy(src, dst); err != nil {
+		return err
+	}
+	if err := os.Chmod(dst, info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// WriteFile replaces the content of path like tee: a new file gets mode 0644
+// less the umask, an existing one keeps its mode and owner
+func (f Files) WriteFile(path string, data []byte) error {
+	if f.Direct {
+		return os.WriteFile(path, data, 0644)
+	}
+	return f.run(data, "tee", path)
+}
+
+// ReplaceFile atomically replaces the content of path, creating it with mode
+// if needed. data is written to a new temporary file with a random name next
+// to path, flushed to disk and renamed over path, so readers and a crash in
+// between see either the old or the new content, never part of it. An
+// existing file keeps its mode and owner. A path that is a symlink or other
+// non-regular file is refused with ErrNotRegular. On Windows the file is
+// rewritten in place instead, since a new file would not carry its ACL.
+func (f Files) ReplaceFile(path string, data []byte, mode os.FileMode) error {
+	kind, exists, err := f.FileType(path)
+	if err != nil {
+		return err
+	}
+	if exists && !kind.IsRegular() {
+		return fmt.Errorf("%s: %w", path, ErrNotRegular)
+	}
+	if !f.Direct {
+		return f.replaceWithCommands(path, data, mode, exists)
+	}
+
+	info, err := os.Lstat(path)
+	if err != nil && exists {
+		return err
+	}
+
+	if runtime.GOOS == "windows" {
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+		if err != nil {
+			return err
+		}
+		return writeSynced(file, data)
+	}
+
+	if exists {
+		mode = info.Mode().Perm()
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".p0-*")
+	if err != nil {
+		return err
+	}
+	if err := writeSynced(tmp, data); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	// Set after creation, which applies the umask
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if exists {
+		if err := copyOwner(tmp.Name(), info); err != nil {
+			os.Remove(tmp.Name())
+			return err
+		}
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// replaceWithCommands is ReplaceFile through commands: mktemp creates the
+// temporary file, so nothing else can have put a symlink in its place, and
+// cp -p gives it the mode and owner of path before tee writes the new content
+func (f Files) replaceWithCommands(path string, data []byte, mode os.FileMode, exists bool) error {
+	var stderr bytes.Buffer
+	cmd := f.Command("mktemp", path+".p0-XXXXXXXX")
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return commandError("mktemp", []string{path + ".p0-XXXXXXXX"}, err, stderr.String())
+	}
+	tmp := strings.TrimSpace(string(output))
+
+	err = func() error {
+		if exists {
+			if err := f.run(nil, "cp", "-p", path, tmp); err != nil {
+				return err
+			}
+		}
+		if err := f.run(data, "tee", tmp); err != nil {
+			return err
+		}
+		if !exists {
+			if err := f.Chmod(tmp, mode); err != nil {
+				return err
+			}
+		}
+		if err := f.Sync(tmp); err != nil {
+			return err
+		}
+		return f.run(nil, "mv", "-f", tmp, path)
+	}()
+	if err != nil {
+		f.run(nil, "rm", "-f", tmp)
+	}
+	return err
+}
+
+// Sync flushes the content of path to disk. Through commands it falls back to
+// flushing every filesystem when sync does not take a file, as in older BusyBox.
+func (f Files) Sync(path string) error {
+	if !f.Direct {
+		if f.run(nil, "sync", path) == nil {
+			return nil
+		}
+		return f.run(nil, "sync")
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// writeSynced writes data to file, flushes it to disk and closes it
+func writeSynced(file *os.File, data []byte) error {
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// AppendFile adds data to the end of path like tee -a, creating it if needed
+func (f Files) AppendFile(path string, data []byte) error {
+	if !f.Direct {
+		return f.run(data, "tee", "-a", path)
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// ReadRegularFile is ReadFile for a path that must be a regular file. A
+// symlink or other non-regular file is refused with ErrNotRegular, and is
+// never followed when the process opens path itself.
+func (f Files) ReadRegularFile(path string) ([]byte, error) {
+	kind, exists, err := f.FileType(path)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+	}
+	if !kind.IsRegular() {
+		return nil, fmt.Errorf("%s: %w", path, ErrNotRegular)
+	}
+	if !f.Direct {
+		return f.ReadFile(path)
+	}
+
+	file, err := openNoFollow(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// Checked again on the open file, in case path changed after the first check
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s: %w", path, ErrNotRegular)
+	}
+	return io.ReadAll(file)
+}
+
+// FileType returns the type bits of path, without following a final symlink,
+// and whether it exists. When the process cannot look at path itself, test
+// is run through commands instead, which tells symlinks, directories and
+// regular files apart and reports anything else as irregular.
+func (f Files) FileType(path string) (kind fs.FileMode, exists bool, err error) {
+	info, err := os.Lstat(path)
+	if err == nil {
+		return info.Mode().Type(), true, nil
+	}
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	}
+	if f.Direct || !os.IsPermission(err) {
+		return 0, false, err
+	}
+
+	for _, check := range []struct {
+		flag string
+		kind fs.FileMode
+	}{
+		{"-L", fs.ModeSymlink},
+		{"-d", fs.ModeDir},
+		{"-f", 0},
+		{"-e", fs.ModeIrregular},
+	} {
+		if f.Command("test", check.flag, path).Run() == nil {
+			return check.kind, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// ReadFile returns the content of a file the process may not be able to read
+func (f Files) ReadFile(path string) ([]byte, error) {
+	if f.Direct {
+		return os.ReadFile(path)
+	}
+
+	var stderr bytes.Buffer
+	cmd := f.Command("cat", path)
+	cmd.Stderr = &stderr
+	data, err := cmd.Output()
+	if err != nil {
+		return nil, commandError("cat", []string{path}, err, stderr.String())
+	}
+	return data, nil
+}
+
+// Remove deletes the file path like rm -f; a missing file is not an error
+func (f Files) Remove(path string) error {
+	if f.Direct {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return f.run(nil, "rm", "-f", path)
+}
+
+// RemoveAll deletes path and everything beneath it like rm -rf
+func (f Files) RemoveAll(path string) error {
+	if f.Direct {
+		return os.RemoveAll(path)
+	}
+	return f.run(nil, "rm", "-rf", path)
+}
+
+// RemoveDir deletes the directory path like rmdir, failing when it is not empty
+func (f Files) RemoveDir(path string) error {
+	if f.Direct {
+		return os.Remove(path)
+	}
+	return f.run(nil, "rmdir", path)
+}
+
+// run runs a command, feeding it stdin when set, and reports its error output
+func (f Files) run(stdin []byte, name string, arg ...string) error {
+	var stderr bytes.Buffer
+	cmd := f.Command(name, arg...)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return commandError(name, arg, err, stderr.String())
+	}
+	return nil
+}
+
+func commandError(name string, arg []string, err error, stderr string) error {
+	if stderr = strings.TrimSpace(stderr); stderr != "" {
+		return fmt.Errorf("%s %s: %w (%s)", name, strings.Join(arg, " "), err, stderr)
+	}
+	return fmt.Errorf("%s %s: %w", name, strings.Join(arg, " "), err)
+}
@@ -0,0 +1,21 @@
+//go:build !unix
+
+package elevate
+
+import "os"
+
+// copyOwner is a no-op where files have no Unix owner
+func copyOwner(path string, info os.FileInfo) error {
+	return nil
+}
+
+// openNoFollow opens path for reading. Symlinks are caught by the checks
+// of the caller where O_NOFOLLOW is not available.
+func openNoFollow(path string) (*os.File, error) {
+	return os.Open(path)
+}
+
+// syncDir is a no-op where directories cannot be opened for syncing
+func syncDir(dir string) error {
+	return nil
+}
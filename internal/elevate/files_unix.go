@@ -0,0 +1,35 @@
+//go:build unix
+
+package elevate
+
+import (
+	"os"
+	"syscall"
+)
+
+// copyOwner gives path the owner and group of the file described by info
+func copyOwner(path string, info os.FileInfo) error {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	return os.Chown(path, int(stat.Uid), int(stat.Gid))
+}
+
+// openNoFollow opens path for reading, failing if it is a symlink
+func openNoFollow(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+}
+
+// syncDir flushes dir to disk so a rename inside it survives a crash
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,155 @@
+package elevate
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"sync"
+)
+
+// Limits apply to the processes built by Exec and Command
+type Limits struct {
+	// Nice is the niceness processes start with on Unix; 0 leaves it
+	Nice int
+
+	// Cgroup is the cgroup v2 directory processes start in on Linux
+	Cgroup string
+
+	// MaxOutputBytes bounds the output Output and CombinedOutput accept; 0
+	// accepts all of it
+	MaxOutputBytes int
+}
+
+// ErrOutputLimit fails a process whose output goes beyond MaxOutputBytes,
+// rather than acting on a part of it
+var ErrOutputLimit = errors.New("output exceeds maxOutputBytes")
+
+var (
+	limitsMu sync.RWMutex
+	limits   Limits
+	cgroupFD = -1
+)
+
+// SetLimits applies limits to the processes built from now on. It changes
+// nothing when they cannot be applied on this host.
+func SetLimits(next Limits) error {
+	if next.Nice != 0 && runtime.GOOS != "windows" {
+		if _, err := exec.LookPath("nice"); err != nil {
+			return fmt.Errorf("nice is set but the nice command is not available: %w", err)
+		}
+	}
+	fd := -1
+	if next.Cgroup != "" {
+		var err error
+		if fd, err = openCgroup(next.Cgroup); err != nil {
+			return fmt.Errorf("failed to open cgroup %s: %w", next.Cgroup, err)
+		}
+	}
+
+	limitsMu.Lock()
+	defer limitsMu.Unlock()
+	limits = next
+	cgroupFD = fd
+	return nil
+}
+
+// limited returns name and arg to run under the limits, and the cgroup to
+// start the process in, or -1
+func limited(name string, arg []string) (string, []string, int) {
+	limitsMu.RLock()
+	defer limitsMu.RUnlock()
+
+	if limits.Nice != 0 && runtime.GOOS != "windows" {
+		arg = append([]string{"-n", strconv.Itoa(limits.Nice), name}, arg...)
+		name = "nice"
+	}
+	return name, arg, cgroupFD
+}
+
+// Output runs cmd and returns its standard output, like cmd.Output. Once
+// either output goes beyond MaxOutputBytes the rest is not read, which the
+// process sees as a closed pipe, and the error wraps ErrOutputLimit. Writers
+// already set on cmd receive a copy.
+func Output(cmd *exec.Cmd) ([]byte, error) {
+	stdout := newCappedBuffer()
+	cmd.Stdout = withCopy(stdout, cmd.Stdout)
+	stderr := newCappedBuffer()
+	cmd.Stderr = withCopy(stderr, cmd.Stderr)
+
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		exitErr.Stderr = stderr.Bytes()
+	}
+	return stdout.Bytes(), capped(err, stdout, stderr)
+}
+
+// CombinedOutput runs cmd and returns its standard output and error, like
+// cmd.CombinedOutput, failing with ErrOutputLimit as Output does
+func CombinedOutput(cmd *exec.Cmd) ([]byte, error) {
+	output := newCappedBuffer()
+	cmd.Stdout = withCopy(output, cmd.Stdout)
+	cmd.Stderr = withCopy(output, cmd.Stderr)
+	err := cmd.Run()
+	return output.Bytes(), capped(err, output)
+}
+
+// capped reports ErrOutputLimit when one of buffers overflowed, whatever
+// error the process ended with after its output stopped being read
+func capped(err error, buffers ...*cappedBuffer) error {
+	for _, buffer := range buffers {
+		if buffer != nil && buffer.Overflowed() {
+			if err == nil || errors.Is(err, ErrOutputLimit) {
+				return fmt.Errorf("%w (%d bytes)", ErrOutputLimit, buffer.max)
+			}
+			return fmt.Errorf("%w (%d bytes): %v", ErrOutputLimit, buffer.max, err)
+		}
+	}
+	return err
+}
+
+// cappedBuffer keeps the bytes written to it up to max and fails the write
+// that goes beyond it
+type cappedBuffer struct {
+	mu         sync.Mutex
+	buf        bytes.Buffer
+	max        int
+	overflowed bool
+}
+
+func newCappedBuffer() *cappedBuffer {
+	limitsMu.RLock()
+	defer limitsMu.RUnlock()
+	return &cappedBuffer{max: limits.MaxOutputBytes}
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.max <= 0 {
+		return b.buf.Write(p)
+	}
+	room := b.max - b.buf.Len()
+	if len(p) > room {
+		b.buf.Write(p[:max(room, 0)])
+		b.overflowed = true
+		return max(room, 0), ErrOutputLimit
+	}
+	return b.buf.Write(p)
+}
+
+// Overflowed reports whether more than max bytes were written
+func (b *cappedBuffer) Overflowed() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.overflowed
+}
+
+func (b *cappedBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Bytes()
+}
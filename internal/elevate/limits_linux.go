@@ -0,0 +1,44 @@
+package elevate
+
+import (
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+)
+
+var (
+	cgroupsMu sync.Mutex
+
+	// cgroups stay open for good, as commands built with one may start after
+	// the limits changed
+	cgroups = map[string]*os.File{}
+)
+
+// openCgroup opens the cgroup v2 directory at path for starting processes in
+func openCgroup(path string) (int, error) {
+	cgroupsMu.Lock()
+	defer cgroupsMu.Unlock()
+
+	if dir, ok := cgroups[path]; ok {
+		return int(dir.Fd()), nil
+	}
+	if _, err := os.Stat(path + "/cgroup.procs"); err != nil {
+		return -1, err
+	}
+	dir, err := os.Open(path)
+	if err != nil {
+		return -1, err
+	}
+	cgroups[path] = dir
+	return int(dir.Fd()), nil
+}
+
+// inCgroup makes cmd start in the cgroup fd
+func inCgroup(cmd *exec.Cmd, fd int) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = fd
+}
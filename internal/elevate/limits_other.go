@@ -0,0 +1,16 @@
+//go:build !linux
+
+package elevate
+
+import (
+	"errors"
+	"os/exec"
+)
+
+// openCgroup fails where there are no cgroups
+func openCgroup(path string) (int, error) {
+	return -1, errors.New("cgroups are only supported on Linux")
+}
+
+// inCgroup is never called where there are no cgroups
+func inCgroup(cmd *exec.Cmd, fd int) {}
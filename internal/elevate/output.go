@@ -0,0 +1,47 @@
+package elevate
+
+import (
+	"context"
+	"io"
+)
+
+type outputKey struct{}
+
+// output is where processes built with a context copy what they print
+type output struct {
+	stdout io.Writer
+	stderr io.Writer
+}
+
+// WithOutput makes the processes built with ctx copy their standard output to
+// stdout and their standard error to stderr as they run, e.g. so the output
+// of a provisioning command can be watched live. Output and CombinedOutput
+// still return it as well. The writers must not fail.
+func WithOutput(ctx context.Context, stdout, stderr io.Writer) context.Context {
+	return context.WithValue(ctx, outputKey{}, &output{stdout: stdout, stderr: stderr})
+}
+
+// WithoutOutput undoes WithOutput for processes whose output is not to be
+// shown, such as the commands Files reads and writes files with
+func WithoutOutput(ctx context.Context) context.Context {
+	if ctx.Value(outputKey{}) == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, outputKey{}, (*output)(nil))
+}
+
+// outputOf returns where processes built with ctx copy their output, if
+// anywhere
+func outputOf(ctx context.Context) *output {
+	out, _ := ctx.Value(outputKey{}).(*output)
+	return out
+}
+
+// withCopy makes buffer take what a process writes to w, passing it on to w
+// when cmd had w set already, as WithOutput does
+func withCopy(buffer *cappedBuffer, w io.Writer) io.Writer {
+	if w == nil {
+		return buffer
+	}
+	return io.MultiWriter(buffer, w)
+}
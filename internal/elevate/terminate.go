@@ -0,0 +1,38 @@
+package elevate
+
+import (
+	"context"
+	"os/exec"
+	"time"
+)
+
+// terminateDelay is how long a process asked to exit when its context is
+// done has before it is killed
+const terminateDelay = 5 * time.Second
+
+// Exec builds name to run with the privileges of the process, like
+// exec.Command, but under the limits set by SetLimits
+func Exec(name string, arg ...string) *exec.Cmd {
+	return ExecContext(context.Background(), name, arg...)
+}
+
+// ExecContext is Exec for a process that ends with ctx, e.g. when the
+// provisioning command it belongs to times out. It is asked to exit, which
+// sudo passes on to the command it runs, and killed when it has not within
+// terminateDelay. Only the processes built with ctx are affected. Their
+// output is copied as WithOutput set on ctx.
+func ExecContext(ctx context.Context, name string, arg ...string) *exec.Cmd {
+	name, arg, cgroup := limited(name, arg)
+	cmd := exec.CommandContext(ctx, name, arg...)
+	cmd.Cancel = func() error {
+		return interrupt(cmd.Process)
+	}
+	cmd.WaitDelay = terminateDelay
+	if cgroup >= 0 {
+		inCgroup(cmd, cgroup)
+	}
+	if out := outputOf(ctx); out != nil {
+		cmd.Stdout, cmd.Stderr = out.stdout, out.stderr
+	}
+	return cmd
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package elevate
+
+import "os"
+
+// interrupt kills process where it cannot be asked to exit
+func interrupt(process *os.Process) error {
+	return process.Kill()
+}
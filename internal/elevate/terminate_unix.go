@@ -0,0 +1,13 @@
+//go:build unix
+
+package elevate
+
+import (
+	"os"
+	"syscall"
+)
+
+// interrupt asks process to exit with SIGTERM, which sudo relays
+func interrupt(process *os.Process) error {
+	return process.Signal(syscall.SIGTERM)
+}
@@ -0,0 +1,125 @@
+package endpoint
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// probeAttempts is how many connections are timed per endpoint; the fastest
+// one counts so a single slow handshake does not decide the result
+const probeAttempts = 3
+
+// Probe is the result of timing connections to one tunnel endpoint
+type Probe struct {
+	URL string
+	RTT time.Duration
+	Err error
+}
+
+// ProbeAll measures the TCP connect time to every endpoint concurrently and
+// returns the results fastest first, unreachable endpoints last. Connections
+// are made directly, so probes fail for every endpoint when only a proxy can
+// reach them.
+func ProbeAll(ctx context.Context, urls []string, timeout time.Duration) []Probe {
+	probes := make([]Probe, len(urls))
+
+	var wg sync.WaitGroup
+	for i, rawURL := range urls {
+		wg.Add(1)
+		go func(i int, rawURL string) {
+			defer wg.Done()
+			probes[i] = probe(ctx, rawURL, timeout)
+		}(i, rawURL)
+	}
+	wg.Wait()
+
+	sort.SliceStable(probes, func(i, j int) bool {
+		if (probes[i].Err == nil) != (probes[j].Err == nil) {
+			return probes[i].Err == nil
+		}
+		return probes[i].RTT < probes[j].RTT
+	})
+	return probes
+}
+
+func probe(ctx context.Context, rawURL string, timeout time.Duration) Probe {
+	result := Probe{URL: rawURL}
+
+	address, err := dialAddress(rawURL)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	dialer := net.Dialer{Timeout: timeout}
+	for attempt := 0; attempt < probeAttempts; attempt++ {
+		start := time.Now()
+		conn, err := dialer.DialContext(ctx, "tcp", address)
+		if err != nil {
+			result.Err = err
+			continue
+		}
+		rtt := time.Since(start)
+		conn.Close()
+
+		if result.RTT == 0 || rtt < result.RTT {
+			result.RTT = rtt
+		}
+	}
+
+	if result.RTT > 0 {
+		result.Err = nil
+	}
+	return result
+}
+
+// dialAddress returns host:port for a ws:// or wss:// URL
+func dialAddress(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = "443"
+		if u.Scheme == "ws" {
+			port = "80"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port), nil
+}
+
+// ShouldSwitch reports whether candidate is enough faster than current to be
+// worth a reconnect, so endpoints with similar latency do not flap
+func ShouldSwitch(current, candidate time.Duration) bool {
+	if current == 0 {
+		return true
+	}
+	return candidate < current*4/5 && current-candidate >= 10*time.Millisecond
+}
+
+// Next returns the endpoint after current in priority order, wrapping to the
+// first, or the first when current is not configured
+func Next(endpoints []string, current string) string {
+	for i, candidate := range endpoints {
+		if candidate == current {
+			return endpoints[(i+1)%len(endpoints)]
+		}
+	}
+	return endpoints[0]
+}
+
+// Priority is the 1-based position of url in endpoints, 0 when absent
+func Priority(endpoints []string, url string) int {
+	for i, candidate := range endpoints {
+		if candidate == url {
+			return i + 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,52 @@
+package endpoint
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"p0-ssh-agent/types"
+)
+
+// FileName records the connection target inside the agent state directory so
+// status can show it without asking the running agent
+const FileName = "endpoint.json"
+
+// Path returns the endpoint record path for a state directory
+func Path(stateDir string) string {
+	return filepath.Join(stateDir, FileName)
+}
+
+// Save records the endpoint the agent is connecting to
+func Save(path string, current types.TunnelEndpoint) error {
+	data, err := json.MarshalIndent(current, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal endpoint: %w", err)
+	}
+
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write endpoint record: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to replace endpoint record: %w", err)
+	}
+	return nil
+}
+
+// Load returns the recorded endpoint; ok is false when none was recorded
+func Load(path string) (current types.TunnelEndpoint, ok bool, err error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return current, false, nil
+	}
+	if err != nil {
+		return current, false, fmt.Errorf("failed to read endpoint record: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &current); err != nil {
+		return current, false, fmt.Errorf("failed to parse endpoint record %s: %w", path, err)
+	}
+	return current, true, nil
+}
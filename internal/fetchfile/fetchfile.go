@@ -0,0 +1,161 @@
+package fetchfile
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"p0-ssh-agent/internal/jwt"
+	"p0-ssh-agent/types"
+)
+
+// ErrNotAllowed is returned for paths outside the allowlist
+var ErrNotAllowed = errors.New("path is not in fetchFileAllowlist")
+
+// deniedSuffixes are never served even when an allowlist pattern matches,
+// so a broad pattern cannot expose host or agent private keys
+var deniedSuffixes = []string{"_key", ".key", ".private.json", ".pem"}
+
+// Denied returns the files of cfg that are never served whatever their
+// name: the agent's JWT keys, the tunnel's client certificate, key and CA,
+// and those of targets
+func Denied(cfg *types.Config) []string {
+	keyDir := cfg.GetKeyDir()
+	denied := []string{
+		filepath.Join(keyDir, jwt.PrivateKeyFile),
+		filepath.Join(keyDir, jwt.PreviousPrivateKeyFile),
+		filepath.Join(keyDir, jwt.StagingDir, jwt.PrivateKeyFile),
+		cfg.ClientCertPath,
+		cfg.ClientKeyPath,
+		cfg.TLSCAFile,
+	}
+	for _, target := range cfg.Targets {
+		if target.TLS != nil {
+			denied = append(denied, target.TLS.CAFile, target.TLS.CertFile, target.TLS.KeyFile)
+		}
+	}
+
+	var paths []string
+	for _, path := range denied {
+		if path != "" {
+			paths = append(paths, filepath.Clean(path))
+		}
+	}
+	return paths
+}
+
+// Result is an excerpt of a file, at most maxBytes long
+type Result struct {
+	Path      string
+	Size      int64
+	Offset    int64
+	Data      []byte
+	Truncated bool
+	SHA256    string
+}
+
+// Read returns up to maxBytes of path after checking it, and the file it
+// resolves to, against the allowlist and the denied files. With tail set the
+// excerpt is taken from the end of the file, which suits logs.
+func Read(path string, allowlist, denied []string, maxBytes int, tail bool) (*Result, error) {
+	if !filepath.IsAbs(path) {
+		return nil, fmt.Errorf("path %q must be absolute", path)
+	}
+
+	path = filepath.Clean(path)
+	if !isAllowed(path, allowlist, denied) {
+		return nil, ErrNotAllowed
+	}
+
+	// Symlinks must not lead outside the allowlist
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", path, err)
+	}
+	if resolved != path && !isAllowed(resolved, allowlist, denied) {
+		return nil, fmt.Errorf("%w: %s resolves to %s", ErrNotAllowed, path, resolved)
+	}
+
+	// A link put in place of the resolved file since is not followed, and the
+	// file opened is checked again rather than the path
+	file, err := os.OpenFile(resolved, os.O_RDONLY|noFollow, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", path)
+	}
+	if opened, ok := openedPath(file); ok && opened != resolved && !isAllowed(opened, allowlist, denied) {
+		return nil, fmt.Errorf("%w: %s resolves to %s", ErrNotAllowed, path, opened)
+	}
+	if isDeniedFile(info, denied) {
+		return nil, fmt.Errorf("%w: %s is a key of the agent", ErrNotAllowed, path)
+	}
+
+	size := info.Size()
+	var offset int64
+	if tail && size > int64(maxBytes) {
+		offset = size - int64(maxBytes)
+	}
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to seek in %s: %w", path, err)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(file, int64(maxBytes)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	sum := sha256.Sum256(data)
+	return &Result{
+		Path:      path,
+		Size:      size,
+		Offset:    offset,
+		Data:      data,
+		Truncated: int64(len(data)) < size,
+		SHA256:    hex.EncodeToString(sum[:]),
+	}, nil
+}
+
+func isAllowed(path string, allowlist, denied []string) bool {
+	for _, suffix := range deniedSuffixes {
+		if strings.HasSuffix(path, suffix) {
+			return false
+		}
+	}
+	for _, deniedPath := range denied {
+		if path == deniedPath {
+			return false
+		}
+	}
+
+	for _, pattern := range allowlist {
+		if matched, err := filepath.Match(pattern, path); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// isDeniedFile reports whether info is one of the denied files, reached
+// through a hard link or a path that was swapped after it was checked
+func isDeniedFile(info os.FileInfo, denied []string) bool {
+	for _, path := range denied {
+		if deniedInfo, err := os.Stat(path); err == nil && os.SameFile(info, deniedInfo) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,122 @@
+package fetchfile
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"p0-ssh-agent/internal/jwt"
+	"p0-ssh-agent/types"
+)
+
+func TestRead(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("links need privileges on Windows")
+	}
+
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowed := filepath.Join(dir, "allowed")
+	outside := filepath.Join(dir, "outside")
+	keys := filepath.Join(allowed, "keys")
+	for _, d := range []string{allowed, outside, keys} {
+		if err := os.MkdirAll(d, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := types.DefaultConfig()
+	cfg.KeyPath = keys
+	cfg.ClientKeyPath = filepath.Join(allowed, "client-identity")
+	cfg.TLSCAFile = filepath.Join(allowed, "tunnel-ca")
+
+	files := map[string]string{
+		filepath.Join(allowed, "app.log"):       "line 1\nline 2\n",
+		filepath.Join(allowed, "server.key"):    "key",
+		filepath.Join(keys, jwt.PrivateKeyFile): "{}",
+		cfg.ClientKeyPath:                       "client key",
+		cfg.TLSCAFile:                           "ca",
+		filepath.Join(outside, "secret"):        "secret",
+	}
+	for path, content := range files {
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		filepath.Join(allowed, "to-outside"): filepath.Join(outside, "secret"),
+		filepath.Join(allowed, "to-log"):     filepath.Join(allowed, "app.log"),
+		filepath.Join(allowed, "to-ca"):      cfg.TLSCAFile,
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, link); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A hard link to a denied file under an innocent name
+	if err := os.Link(cfg.ClientKeyPath, filepath.Join(allowed, "notes.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	allowlist := []string{filepath.Join(allowed, "*"), filepath.Join(keys, "*")}
+	denied := Denied(cfg)
+
+	tests := []struct {
+		name    string
+		path    string
+		want    string
+		denied  bool
+		wantErr bool
+	}{
+		{name: "allowed file", path: filepath.Join(allowed, "app.log"), want: "line 1\nline 2\n"},
+		{name: "link inside the allowlist", path: filepath.Join(allowed, "to-log"), want: "line 1\nline 2\n"},
+		{name: "outside the allowlist", path: filepath.Join(outside, "secret"), denied: true},
+		{name: "link leading outside", path: filepath.Join(allowed, "to-outside"), denied: true},
+		{name: "key suffix", path: filepath.Join(allowed, "server.key"), denied: true},
+		{name: "JWT private key", path: filepath.Join(keys, jwt.PrivateKeyFile), denied: true},
+		{name: "client key", path: cfg.ClientKeyPath, denied: true},
+		{name: "tunnel CA", path: cfg.TLSCAFile, denied: true},
+		{name: "link to the tunnel CA", path: filepath.Join(allowed, "to-ca"), denied: true},
+		{name: "hard link to the client key", path: filepath.Join(allowed, "notes.txt"), denied: true},
+		{name: "relative path", path: "allowed/app.log", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := Read(tt.path, allowlist, denied, 1024, false)
+			switch {
+			case tt.denied:
+				if !errors.Is(err, ErrNotAllowed) {
+					t.Errorf("Read error = %v, want %v", err, ErrNotAllowed)
+				}
+			case tt.wantErr:
+				if err == nil {
+					t.Error("Read succeeded, want an error")
+				}
+			case err != nil:
+				t.Errorf("Read: %v", err)
+			case string(result.Data) != tt.want:
+				t.Errorf("Read data = %q, want %q", result.Data, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	if err := os.WriteFile(path, []byte("0123456789"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := Read(path, []string{path}, nil, 4, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result.Data) != "6789" || result.Offset != 6 || result.Size != 10 || !result.Truncated {
+		t.Errorf("Read = %+v, want the last 4 of 10 bytes", result)
+	}
+}
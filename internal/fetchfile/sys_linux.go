@@ -0,0 +1,16 @@
+package fetchfile
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// noFollow makes opening a file fail on a symbolic link
+const noFollow = syscall.O_NOFOLLOW
+
+// openedPath returns the path the kernel has for the open file
+func openedPath(file *os.File) (string, bool) {
+	path, err := os.Readlink(fmt.Sprintf("/proc/self/fd/%d", file.Fd()))
+	return path, err == nil
+}
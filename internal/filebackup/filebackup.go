@@ -0,0 +1,176 @@
+package filebackup
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	// DirName is the backup directory inside the agent state directory
+	DirName = "file-backups"
+
+	// MaxPerFile is how many backups are kept for each managed file
+	MaxPerFile = 20
+
+	// MaxAge is how long backups are kept regardless of count
+	MaxAge = 30 * 24 * time.Hour
+
+	timestampFormat = "20060102T150405.000000000Z"
+)
+
+// Backup is one saved copy of a managed file
+type Backup struct {
+	Path    string
+	Time    time.Time
+	Size    int64
+	Storage string
+}
+
+// Dir returns the backup directory for a state directory
+func Dir(stateDir string) string {
+	return filepath.Join(stateDir, DirName)
+}
+
+// Save copies filePath into dir before it is modified and applies the
+// retention limits. Missing files are not an error; there is nothing to lose.
+func Save(dir, filePath string, now time.Time) (*Backup, error) {
+	info, err := os.Stat(filePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat %s: %w", filePath, err)
+	}
+
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", filePath, err)
+	}
+
+	fileDir := filepath.Join(dir, url.PathEscape(filepath.Clean(filePath)))
+	if err := os.MkdirAll(fileDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create backup directory: %w", err)
+	}
+
+	now = now.UTC()
+	storage := filepath.Join(fileDir, now.Format(timestampFormat))
+	if err := os.WriteFile(storage, data, info.Mode().Perm()); err != nil {
+		return nil, fmt.Errorf("failed to write backup of %s: %w", filePath, err)
+	}
+
+	if err := prune(fileDir, now); err != nil {
+		return nil, err
+	}
+
+	return &Backup{Path: filePath, Time: now, Size: int64(len(data)), Storage: storage}, nil
+}
+
+// List returns the backups of filePath, oldest first
+func List(dir, filePath string) ([]Backup, error) {
+	fileDir := filepath.Join(dir, url.PathEscape(filepath.Clean(filePath)))
+	entries, err := os.ReadDir(fileDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backup directory: %w", err)
+	}
+
+	var backups []Backup
+	for _, entry := range entries {
+		timestamp, err := time.Parse(timestampFormat, entry.Name())
+		if err != nil || !entry.Type().IsRegular() {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		backups = append(backups, Backup{
+			Path:    filePath,
+			Time:    timestamp,
+			Size:    info.Size(),
+			Storage: filepath.Join(fileDir, entry.Name()),
+		})
+	}
+
+	sort.Slice(backups, func(i, j int) bool { return backups[i].Time.Before(backups[j].Time) })
+	return backups, nil
+}
+
+// Find returns the most recent backup of filePath taken at or before at
+func Find(dir, filePath string, at time.Time) (*Backup, error) {
+	backups, err := List(dir, filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(backups) - 1; i >= 0; i-- {
+		if !backups[i].Time.After(at) {
+			return &backups[i], nil
+		}
+	}
+
+	return nil, fmt.Errorf("no backup of %s at or before %s", filePath, at.Format(time.RFC3339))
+}
+
+// Restore writes a backup over its original path. The current content is
+// backed up first so the restore itself can be undone.
+func Restore(dir string, backup Backup, now time.Time) error {
+	data, err := os.ReadFile(backup.Storage)
+	if err != nil {
+		return fmt.Errorf("failed to read backup: %w", err)
+	}
+
+	info, err := os.Stat(backup.Storage)
+	if err != nil {
+		return fmt.Errorf("failed to stat backup: %w", err)
+	}
+
+	if _, err := Save(dir, backup.Path, now); err != nil {
+		return fmt.Errorf("failed to back up current content: %w", err)
+	}
+
+	// Writing in place keeps the owner of an existing file
+	if err := os.WriteFile(backup.Path, data, info.Mode().Perm()); err != nil {
+		return fmt.Errorf("failed to restore %s: %w", backup.Path, err)
+	}
+
+	return nil
+}
+
+func prune(fileDir string, now time.Time) error {
+	entries, err := os.ReadDir(fileDir)
+	if err != nil {
+		return fmt.Errorf("failed to read backup directory: %w", err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if _, err := time.Parse(timestampFormat, entry.Name()); err == nil {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	for i, name := range names {
+		timestamp, _ := time.Parse(timestampFormat, name)
+		if i < len(names)-MaxPerFile || now.Sub(timestamp) > MaxAge {
+			// Never drop the backup that was just written
+			if i == len(names)-1 {
+				continue
+			}
+			if err := os.Remove(filepath.Join(fileDir, name)); err != nil {
+				return fmt.Errorf("failed to remove old backup: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,25 @@
+// Package filelock serializes the processes that change a file, such as the
+// agent and the CLI commands run beside it, with an advisory lock. Without
+// flock, on Windows, the agent is assumed to be the only writer.
+package filelock
+
+import (
+	"os"
+)
+
+// Acquire takes the exclusive lock on the lock file at path, creating it,
+// and waits while another process holds it. release gives it up.
+func Acquire(path string) (release func(), err error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := Lock(file); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return func() {
+		Unlock(file)
+		file.Close()
+	}, nil
+}
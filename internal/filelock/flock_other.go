@@ -0,0 +1,15 @@
+//go:build !unix
+
+package filelock
+
+import "os"
+
+// Lock does nothing without flock
+func Lock(file *os.File) error {
+	return nil
+}
+
+// Unlock does nothing without flock
+func Unlock(file *os.File) error {
+	return nil
+}
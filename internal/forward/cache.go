@@ -0,0 +1,202 @@
+package forward
+
+import (
+	"container/list"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"p0-ssh-agent/types"
+)
+
+// cache keeps GET responses of targets in memory for as long as their
+// Cache-Control allows. It is a shared cache in the HTTP sense: responses
+// setting cookies or marked private, and responses to requests with
+// credentials unless marked public or s-maxage, are never stored.
+type cache struct {
+	maxEntries    int
+	maxEntryBytes int
+	maxTTL        time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type cacheEntry struct {
+	key      string
+	response types.ForwardedResponse
+	stored   time.Time
+	expires  time.Time
+
+	// vary holds the request headers the response varies on, with the
+	// values of the request it answered
+	vary map[string]string
+}
+
+func newCache(config *types.TargetCache) *cache {
+	if config == nil || !config.Enabled {
+		return nil
+	}
+	return &cache{
+		maxEntries:    config.GetMaxEntries(),
+		maxEntryBytes: config.GetMaxEntryBytes(),
+		maxTTL:        config.GetMaxTTL(),
+		entries:       make(map[string]*list.Element),
+		order:         list.New(),
+	}
+}
+
+// cacheKey identifies a GET by target, path and query, with params sorted
+func cacheKey(target string, u *url.URL) string {
+	return target + " " + u.EscapedPath() + "?" + u.Query().Encode()
+}
+
+// get returns a fresh response for key whose varying headers match request,
+// with an Age header as HTTP caches add
+func (c *cache) get(key string, request *http.Request, now time.Time) (types.ForwardedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if !ok {
+		return types.ForwardedResponse{}, false
+	}
+	entry := element.Value.(*cacheEntry)
+	if !now.Before(entry.expires) {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		return types.ForwardedResponse{}, false
+	}
+	for name, value := range entry.vary {
+		if request.Header.Get(name) != value {
+			return types.ForwardedResponse{}, false
+		}
+	}
+	c.order.MoveToFront(element)
+
+	response := entry.response
+	response.Headers = make(map[string]interface{}, len(entry.response.Headers)+1)
+	for name, value := range entry.response.Headers {
+		response.Headers[name] = value
+	}
+	response.Headers["age"] = strconv.Itoa(int(now.Sub(entry.stored).Seconds()))
+	return response, true
+}
+
+// put stores response under key when its headers allow it, evicting the
+// least recently used entries beyond maxEntries
+func (c *cache) put(key string, request *http.Request, resp *http.Response, response types.ForwardedResponse, size int, now time.Time) {
+	if resp.StatusCode != http.StatusOK || size > c.maxEntryBytes || !storable(resp.Header) {
+		return
+	}
+	ttl, ok := cacheTTL(resp.Header, request.Header.Get("Authorization") != "" || request.Header.Get("Cookie") != "")
+	if !ok {
+		return
+	}
+	if ttl > c.maxTTL {
+		ttl = c.maxTTL
+	}
+
+	vary := make(map[string]string)
+	for _, value := range resp.Header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return
+			}
+			if name != "" {
+				vary[http.CanonicalHeaderKey(name)] = request.Header.Get(name)
+			}
+		}
+	}
+
+	entry := &cacheEntry{key: key, response: response, stored: now, expires: now.Add(ttl), vary: vary}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		element.Value = entry
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// storable reports whether a shared cache may keep a response at all. One
+// setting a cookie belongs to the client it answered, and one marked
+// no-store or private is never kept, whatever else its Cache-Control says.
+func storable(header http.Header) bool {
+	if len(header.Values("Set-Cookie")) > 0 {
+		return false
+	}
+	directives := cacheControl(header)
+	for _, name := range []string{"no-store", "private"} {
+		if _, ok := directives[name]; ok {
+			return false
+		}
+	}
+	return true
+}
+
+// cacheControl returns the Cache-Control directives of header by lowercase
+// name, with their unquoted arguments
+func cacheControl(header http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			directives[strings.ToLower(name)] = strings.Trim(arg, `"`)
+		}
+	}
+	return directives
+}
+
+// cacheTTL returns how long a shared cache may serve a response according to
+// its Cache-Control: s-maxage, then max-age. Responses without either are not
+// cached, as no expiry is guessed from Last-Modified.
+func cacheTTL(header http.Header, credentials bool) (time.Duration, bool) {
+	directives := cacheControl(header)
+	if _, ok := directives["no-cache"]; ok {
+		return 0, false
+	}
+
+	_, public := directives["public"]
+	_, shared := directives["s-maxage"]
+	if credentials && !public && !shared {
+		return 0, false
+	}
+
+	for _, name := range []string{"s-maxage", "max-age"} {
+		if arg, ok := directives[name]; ok {
+			seconds, err := strconv.Atoi(arg)
+			if err != nil || seconds <= 0 {
+				return 0, false
+			}
+			return time.Duration(seconds) * time.Second, true
+		}
+	}
+	return 0, false
+}
+
+// bypassCache reports whether the request asks for a response from the
+// target itself
+func bypassCache(header http.Header) bool {
+	values := append(header.Values("Cache-Control"), header.Values("Pragma")...)
+	for _, value := range values {
+		value = strings.ToLower(value)
+		if strings.Contains(value, "no-cache") || strings.Contains(value, "no-store") || strings.Contains(value, "max-age=0") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,387 @@
+package forward
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"p0-ssh-agent/types"
+)
+
+// MaxResponseBytes bounds the body read from a target; larger responses are
+// refused rather than sent over the tunnel
+const MaxResponseBytes = 16 << 20
+
+// hopHeaders are connection-specific and never forwarded
+var hopHeaders = map[string]bool{
+	"Connection":          true,
+	"Content-Length":      true,
+	"Host":                true,
+	"Keep-Alive":          true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+}
+
+// backendHeaders carry the backend's credentials for the agent and are never
+// passed on to a target
+var backendHeaders = map[string]bool{
+	"Authorization": true,
+}
+
+// Router selects the target of forwarded requests
+type Router struct {
+	routes []*Route
+	cache  *cache
+}
+
+// Route sends requests to one target
+type Route struct {
+	target types.Target
+	base   *url.URL
+	client *http.Client
+	tls    *tls.Config
+	cache  *cache
+}
+
+// NewRouter builds a route for every target, in the order they are matched,
+// sharing one response cache when cacheConfig enables it. TLS files are read
+// here, so a reload picks up renewed certificates.
+func NewRouter(targets []types.Target, cacheConfig *types.TargetCache) (*Router, error) {
+	router := &Router{cache: newCache(cacheConfig)}
+	for i, target := range targets {
+		base, err := url.Parse(target.URL)
+		if err != nil {
+			return nil, fmt.Errorf("targets[%d]: invalid url: %w", i, err)
+		}
+		transport, err := newTransport(target.TLS)
+		if err != nil {
+			return nil, fmt.Errorf("targets[%d]: %w", i, err)
+		}
+		router.routes = append(router.routes, &Route{
+			target: target,
+			base:   base,
+			client: &http.Client{
+				Transport: transport,
+				// Redirects are the caller's to follow, as with a direct request
+				CheckRedirect: func(*http.Request, []*http.Request) error {
+					return http.ErrUseLastResponse
+				},
+			},
+			tls:   transport.TLSClientConfig,
+			cache: router.cache,
+		})
+	}
+	return router, nil
+}
+
+func newTransport(config *types.TargetTLS) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// Targets are local services, never reached through the host's proxy
+	transport.Proxy = nil
+	if config == nil {
+		return transport, nil
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         config.ServerName,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+	if config.CAFile != "" {
+		pem, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tls caFile: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("tls caFile %s holds no PEM certificates", config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if config.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load tls client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	transport.TLSClientConfig = tlsConfig
+	return transport, nil
+}
+
+// Len returns the number of targets
+func (r *Router) Len() int {
+	if r == nil {
+		return 0
+	}
+	return len(r.routes)
+}
+
+// Match returns the first route whose target matches request, or nil when
+// the request is not for a target
+func (r *Router) Match(request types.ForwardedRequest) *Route {
+	if r == nil {
+		return nil
+	}
+	for _, route := range r.routes {
+		if route.matches(request) {
+			return route
+		}
+	}
+	return nil
+}
+
+// Name returns the name of the route's target
+func (r *Route) Name() string {
+	return r.target.Name
+}
+
+func (r *Route) matches(request types.ForwardedRequest) bool {
+	if prefix := strings.TrimRight(r.target.PathPrefix, "/"); r.target.PathPrefix != "" {
+		requested := requestPath(request.Path)
+		if prefix != "" && requested != prefix && !strings.HasPrefix(requested, prefix+"/") {
+			return false
+		}
+	}
+	if r.target.Header != "" {
+		values, ok := header(request.Headers, r.target.Header)
+		if !ok {
+			return false
+		}
+		if r.target.HeaderValue != "" && !contains(values, r.target.HeaderValue) {
+			return false
+		}
+	}
+	return true
+}
+
+// requestPath returns the cleaned path of a request without its query, so
+// dot segments cannot lead a request out of a target's prefix. A trailing
+// slash is kept, as services may treat it differently.
+func requestPath(requestPath string) string {
+	requestPath, _, _ = strings.Cut(requestPath, "?")
+	cleaned := path.Clean("/" + requestPath)
+	if strings.HasSuffix(requestPath, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// header returns the values of the named header, matched case-insensitively
+func header(headers map[string]interface{}, name string) ([]string, bool) {
+	for key, value := range headers {
+		if strings.EqualFold(key, name) {
+			return headerValues(value), true
+		}
+	}
+	return nil, false
+}
+
+func headerValues(value interface{}) []string {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case string:
+		return []string{v}
+	case []interface{}:
+		var values []string
+		for _, item := range v {
+			values = append(values, fmt.Sprint(item))
+		}
+		return values
+	default:
+		return []string{fmt.Sprint(v)}
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Forward sends request to the route's target and returns its response, and
+// whether it was served from the cache. The request's own timeoutMillis
+// applies when it is shorter than the target's. Failures to reach the target
+// are returned as 502 and 504 responses, so the backend sees them as it would
+// from a proxy.
+func (r *Route) Forward(ctx context.Context, request types.ForwardedRequest) (types.ForwardedResponse, bool) {
+	timeout := r.timeout(request)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	httpRequest, err := r.newRequest(ctx, request)
+	if err != nil {
+		return ErrorResponse(http.StatusBadRequest, err), false
+	}
+
+	cacheable := r.cache != nil && httpRequest.Method == http.MethodGet && !bypassCache(httpRequest.Header)
+	key := ""
+	if cacheable {
+		key = cacheKey(r.target.Name, httpRequest.URL)
+		if response, ok := r.cache.get(key, httpRequest, time.Now()); ok {
+			return response, true
+		}
+	}
+
+	resp, err := r.client.Do(httpRequest)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return r.timeoutResponse(timeout), false
+		}
+		return r.unreachableResponse(err), false
+	}
+	defer resp.Body.Close()
+
+	response, size, err := r.readResponse(resp)
+	if err != nil {
+		return ErrorResponse(http.StatusBadGateway, err), false
+	}
+	if cacheable {
+		r.cache.put(key, httpRequest, resp, response, size, time.Now())
+	}
+	return response, false
+}
+
+// timeout is the target's timeout, or the request's timeoutMillis when shorter
+func (r *Route) timeout(request types.ForwardedRequest) time.Duration {
+	timeout := r.target.GetTimeout()
+	if request.Options != nil && request.Options.TimeoutMillis != nil && *request.Options.TimeoutMillis > 0 {
+		if requested := time.Duration(*request.Options.TimeoutMillis) * time.Millisecond; requested < timeout {
+			timeout = requested
+		}
+	}
+	return timeout
+}
+
+func (r *Route) timeoutResponse(timeout time.Duration) types.ForwardedResponse {
+	return ErrorResponse(http.StatusGatewayTimeout, fmt.Errorf("target %s did not respond within %s", r.target.Name, timeout))
+}
+
+func (r *Route) unreachableResponse(err error) types.ForwardedResponse {
+	return ErrorResponse(http.StatusBadGateway, fmt.Errorf("target %s is unreachable: %w", r.target.Name, err))
+}
+
+// readResponse reads the body of resp into the response for the backend and
+// returns its size
+func (r *Route) readResponse(resp *http.Response) (types.ForwardedResponse, int, error) {
+	body, err := io.ReadAll(io.LimitReader(resp.Body, MaxResponseBytes+1))
+	if err != nil {
+		return types.ForwardedResponse{}, 0, fmt.Errorf("failed to read the response of target %s: %w", r.target.Name, err)
+	}
+	if len(body) > MaxResponseBytes {
+		return types.ForwardedResponse{}, 0, fmt.Errorf("response of target %s exceeds %d MiB", r.target.Name, MaxResponseBytes>>20)
+	}
+
+	response := responseHead(resp)
+	response.Data, response.ContentEncoding = types.EncodeBody(resp.Header.Get("Content-Type"), body)
+	return response, len(body), nil
+}
+
+// responseHead returns the status and headers of resp
+func responseHead(resp *http.Response) types.ForwardedResponse {
+	response := types.ForwardedResponse{
+		Headers:    make(map[string]interface{}),
+		Status:     resp.StatusCode,
+		StatusText: http.StatusText(resp.StatusCode),
+	}
+	for key, values := range resp.Header {
+		if !hopHeaders[key] {
+			response.Headers[strings.ToLower(key)] = strings.Join(values, ", ")
+		}
+	}
+	return response
+}
+
+// newRequest builds the HTTP request to the target, with data as the body
+func (r *Route) newRequest(ctx context.Context, request types.ForwardedRequest) (*http.Request, error) {
+	target, err := r.targetURL(request)
+	if err != nil {
+		return nil, err
+	}
+
+	body, contentType, err := types.DecodeBody(request.Data, request.ContentEncoding)
+	if err != nil {
+		return nil, err
+	}
+
+	method := strings.ToUpper(request.Method)
+	if method == "" {
+		method = http.MethodGet
+	}
+	httpRequest, err := http.NewRequestWithContext(ctx, method, target.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	for key, value := range request.Headers {
+		canonical := http.CanonicalHeaderKey(key)
+		if hopHeaders[canonical] || backendHeaders[canonical] {
+			continue
+		}
+		for _, v := range headerValues(value) {
+			httpRequest.Header.Add(canonical, v)
+		}
+	}
+	if contentType != "" && httpRequest.Header.Get("Content-Type") == "" {
+		httpRequest.Header.Set("Content-Type", contentType)
+	}
+	return httpRequest, nil
+}
+
+// targetURL returns the URL of request at the target: the request path below
+// the target URL, with params added to the query
+func (r *Route) targetURL(request types.ForwardedRequest) (*url.URL, error) {
+	_, rawQuery, _ := strings.Cut(request.Path, "?")
+	targetPath := requestPath(request.Path)
+	if r.target.StripPrefix {
+		targetPath = strings.TrimPrefix(targetPath, strings.TrimRight(r.target.PathPrefix, "/"))
+	}
+	if targetPath != "" && !strings.HasPrefix(targetPath, "/") {
+		targetPath = "/" + targetPath
+	}
+
+	target := *r.base
+	target.Path = strings.TrimRight(target.Path, "/") + targetPath
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("invalid query: %w", err)
+	}
+	for key, value := range request.Params {
+		for _, v := range headerValues(value) {
+			query.Add(key, v)
+		}
+	}
+	target.RawQuery = query.Encode()
+	return &target, nil
+}
+
+// ErrorResponse is a response of the agent itself, in place of one from a
+// target
+func ErrorResponse(status int, err error) types.ForwardedResponse {
+	return types.ForwardedResponse{
+		Headers:    map[string]interface{}{"content-type": "application/json"},
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Data: map[string]interface{}{
+			"success": false,
+			"error":   err.Error(),
+		},
+	}
+}
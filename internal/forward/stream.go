@@ -0,0 +1,262 @@
+package forward
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"p0-ssh-agent/types"
+)
+
+// Limits of streams to targets
+const (
+	// StreamChunkBytes bounds the event stream data sent in one message; whole
+	// lines are sent together up to it
+	StreamChunkBytes = 32 << 10
+
+	// MaxStreamMessageBytes bounds a WebSocket message in either direction
+	MaxStreamMessageBytes = 1 << 20
+
+	// streamWriteTimeout bounds a write to a target's WebSocket
+	streamWriteTimeout = 10 * time.Second
+)
+
+// webSocketHeaders belong to the handshake the agent makes with the target
+// and are never forwarded
+var webSocketHeaders = map[string]bool{
+	"Sec-Websocket-Accept":     true,
+	"Sec-Websocket-Extensions": true,
+	"Sec-Websocket-Key":        true,
+	"Sec-Websocket-Version":    true,
+}
+
+// Stream is the body of a streaming response: an event stream, read in whole
+// lines, or the messages of a WebSocket
+type Stream interface {
+	// Receive blocks for the next data from the target and reports whether
+	// it is a binary WebSocket message. It returns io.EOF once the target
+	// ended the stream.
+	Receive() ([]byte, bool, error)
+
+	// Send passes a message to a WebSocket target; event streams refuse it
+	Send(data []byte, binary bool) error
+
+	// Close ends the stream, which makes a blocked Receive return
+	Close() error
+}
+
+// IsStream reports whether request opens a WebSocket or an event stream,
+// which are forwarded with Open rather than Forward
+func IsStream(request types.ForwardedRequest) bool {
+	return isUpgrade(request) || acceptsEventStream(request)
+}
+
+func isUpgrade(request types.ForwardedRequest) bool {
+	values, _ := header(request.Headers, "Upgrade")
+	for _, value := range values {
+		if strings.EqualFold(strings.TrimSpace(value), "websocket") {
+			return true
+		}
+	}
+	return false
+}
+
+func acceptsEventStream(request types.ForwardedRequest) bool {
+	values, _ := header(request.Headers, "Accept")
+	for _, value := range values {
+		if strings.Contains(strings.ToLower(value), "text/event-stream") {
+			return true
+		}
+	}
+	return false
+}
+
+// Open forwards a WebSocket upgrade or an event stream request. When the
+// target accepts the WebSocket or answers with an event stream, it returns
+// the response head and the stream its body follows on; any other response is
+// returned whole, as by Forward, without a stream. The timeout only bounds
+// the wait for the response head, as streams stay open until either side
+// closes them.
+func (r *Route) Open(request types.ForwardedRequest) (types.ForwardedResponse, Stream) {
+	if isUpgrade(request) {
+		return r.openWebSocket(request)
+	}
+	return r.openEventStream(request)
+}
+
+func (r *Route) openEventStream(request types.ForwardedRequest) (types.ForwardedResponse, Stream) {
+	ctx, cancel := context.WithCancel(context.Background())
+	httpRequest, err := r.newRequest(ctx, request)
+	if err != nil {
+		cancel()
+		return ErrorResponse(http.StatusBadRequest, err), nil
+	}
+
+	timeout := r.timeout(request)
+	timer := time.AfterFunc(timeout, cancel)
+	resp, err := r.client.Do(httpRequest)
+	if !timer.Stop() {
+		if err == nil {
+			resp.Body.Close()
+		}
+		return r.timeoutResponse(timeout), nil
+	}
+	if err != nil {
+		cancel()
+		return r.unreachableResponse(err), nil
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if resp.StatusCode != http.StatusOK || mediaType != "text/event-stream" {
+		defer cancel()
+		defer resp.Body.Close()
+		defer time.AfterFunc(timeout, cancel).Stop()
+
+		response, _, err := r.readResponse(resp)
+		if err != nil {
+			return ErrorResponse(http.StatusBadGateway, err), nil
+		}
+		return response, nil
+	}
+
+	return responseHead(resp), &eventStream{
+		body:   resp.Body,
+		reader: bufio.NewReaderSize(resp.Body, StreamChunkBytes),
+		cancel: cancel,
+	}
+}
+
+func (r *Route) openWebSocket(request types.ForwardedRequest) (types.ForwardedResponse, Stream) {
+	target, err := r.targetURL(request)
+	if err != nil {
+		return ErrorResponse(http.StatusBadRequest, err), nil
+	}
+	if target.Scheme == "https" {
+		target.Scheme = "wss"
+	} else {
+		target.Scheme = "ws"
+	}
+
+	requestHeader := http.Header{}
+	for key, value := range request.Headers {
+		canonical := http.CanonicalHeaderKey(key)
+		if hopHeaders[canonical] || backendHeaders[canonical] || webSocketHeaders[canonical] {
+			continue
+		}
+		for _, v := range headerValues(value) {
+			requestHeader.Add(canonical, v)
+		}
+	}
+
+	timeout := r.timeout(request)
+	dialer := &websocket.Dialer{
+		TLSClientConfig:  r.tls,
+		HandshakeTimeout: timeout,
+	}
+	conn, resp, err := dialer.Dial(target.String(), requestHeader)
+	if err != nil {
+		// The target answered without upgrading, e.g. with 401 or 404
+		if resp != nil {
+			defer resp.Body.Close()
+			if response, _, readErr := r.readResponse(resp); readErr == nil {
+				return response, nil
+			}
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return r.timeoutResponse(timeout), nil
+		}
+		return r.unreachableResponse(err), nil
+	}
+
+	conn.SetReadLimit(MaxStreamMessageBytes)
+	return responseHead(resp), &webSocketStream{conn: conn}
+}
+
+// eventStream reads a text/event-stream body
+type eventStream struct {
+	body   io.ReadCloser
+	reader *bufio.Reader
+	cancel context.CancelFunc
+}
+
+// Receive returns the lines the target has sent, waiting for at least one.
+// Lines are never split unless longer than StreamChunkBytes.
+func (s *eventStream) Receive() ([]byte, bool, error) {
+	line, err := s.reader.ReadSlice('\n')
+	data := append([]byte(nil), line...)
+	for err == nil && s.reader.Buffered() > 0 && len(data) < StreamChunkBytes {
+		line, err = s.reader.ReadSlice('\n')
+		data = append(data, line...)
+	}
+	if errors.Is(err, bufio.ErrBufferFull) {
+		err = nil
+	}
+	// The error is returned again by the next read
+	if len(data) > 0 {
+		return data, false, nil
+	}
+	return nil, false, err
+}
+
+func (s *eventStream) Send([]byte, bool) error {
+	return fmt.Errorf("event streams only carry data from the target")
+}
+
+func (s *eventStream) Close() error {
+	s.cancel()
+	return s.body.Close()
+}
+
+// webSocketStream relays the messages of a WebSocket to a target
+type webSocketStream struct {
+	conn *websocket.Conn
+
+	// mu serializes writes, which gorilla/websocket requires
+	mu sync.Mutex
+}
+
+func (s *webSocketStream) Receive() ([]byte, bool, error) {
+	messageType, data, err := s.conn.ReadMessage()
+	if err != nil {
+		if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived) {
+			return nil, false, io.EOF
+		}
+		return nil, false, err
+	}
+	return data, messageType == websocket.BinaryMessage, nil
+}
+
+func (s *webSocketStream) Send(data []byte, binary bool) error {
+	if len(data) > MaxStreamMessageBytes {
+		return fmt.Errorf("message exceeds %d MiB", MaxStreamMessageBytes>>20)
+	}
+	messageType := websocket.TextMessage
+	if binary {
+		messageType = websocket.BinaryMessage
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout)); err != nil {
+		return err
+	}
+	return s.conn.WriteMessage(messageType, data)
+}
+
+// Close tells the target the stream is over before closing the connection
+func (s *webSocketStream) Close() error {
+	message := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	s.conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+	return s.conn.Close()
+}
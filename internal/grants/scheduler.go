@@ -0,0 +1,338 @@
+package grants
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/internal/audit"
+	"p0-ssh-agent/scripts"
+)
+
+const (
+	// tickInterval is how often the scheduler checks for grants to activate or expire
+	tickInterval = time.Second
+
+	// retryInterval spaces out retries of revokes that failed at validTo
+	retryInterval = 30 * time.Second
+
+	// ExpiringSoonWindow is how close to validTo an active grant counts as expiring soon
+	ExpiringSoonWindow = 15 * time.Minute
+)
+
+// Scheduler activates scheduled grants at validFrom and revokes them at validTo.
+// It runs independently of the tunnel so windows are honored while disconnected.
+type Scheduler struct {
+	store  *Store
+	dryRun bool
+	logger *logrus.Logger
+
+	// hold keeps due grants scheduled while it returns true
+	hold func() bool
+}
+
+func NewScheduler(store *Store, dryRun bool, logger *logrus.Logger) *Scheduler {
+	return &Scheduler{
+		store:  store,
+		dryRun: dryRun,
+		logger: logger,
+	}
+}
+
+// SetHold makes grants that are due wait while hold returns true, e.g. while
+// the host refuses provisioning. Windows still end on time.
+func (s *Scheduler) SetHold(hold func() bool) {
+	s.hold = hold
+}
+
+// Run processes due grants until stop is closed
+func (s *Scheduler) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+
+	s.logger.Info("⏰ Grant window scheduler started")
+
+	s.process(time.Now())
+	for {
+		select {
+		case now := <-ticker.C:
+			s.process(now)
+		case <-stop:
+			s.logger.Info("⏰ Grant window scheduler stopped")
+			return
+		}
+	}
+}
+
+// Schedule handles a grant request with a window. Grants whose window has
+// started are executed immediately, under ctx as a grant without a window
+// would be; future grants are held until validFrom.
+func (s *Scheduler) Schedule(ctx context.Context, command string, req scripts.ProvisioningRequest, window Window) scripts.ProvisioningResult {
+	now := time.Now()
+
+	if !window.To.IsZero() && !now.Before(window.To) {
+		return scripts.ProvisioningResult{
+			Success: false,
+			Error:   "grant window has already ended at " + window.To.UTC().Format(time.RFC3339),
+		}
+	}
+
+	record := Record{
+		Key:       Key(req.RequestID, command),
+		Command:   command,
+		Request:   req,
+		ValidFrom: window.From.UTC(),
+		ValidTo:   window.To.UTC(),
+		Status:    StatusScheduled,
+	}
+
+	if !window.From.IsZero() && now.Before(window.From) {
+		if err := s.store.Put(record); err != nil {
+			return scripts.ProvisioningResult{Success: false, Error: err.Error()}
+		}
+
+		s.logger.WithFields(logrus.Fields{
+			"key":        record.Key,
+			"valid_from": record.ValidFrom.Format(time.RFC3339),
+			"valid_to":   formatBound(record.ValidTo),
+		}).Info("⏰ Grant scheduled for future activation")
+
+		return scripts.ProvisioningResult{
+			Success: true,
+			Status:  StatusScheduled,
+			Message: "Grant scheduled for activation at " + record.ValidFrom.Format(time.RFC3339),
+		}
+	}
+
+	result := scripts.ExecuteScriptContext(ctx, command, req, s.dryRun, s.logger)
+	if !result.Success || window.To.IsZero() {
+		return result
+	}
+
+	record.Status = StatusActive
+	if err := s.store.Put(record); err != nil {
+		s.logger.WithError(err).Error("Failed to record grant window - grant will not expire automatically")
+		return scripts.ProvisioningResult{
+			Success: false,
+			Error:   "grant applied but its expiry could not be recorded: " + err.Error(),
+		}
+	}
+
+	return result
+}
+
+// ScheduleRevoke holds a revoke until at, e.g. to give a user time to save
+// work before their sessions are terminated. The revoke is recorded as
+// pending, so it still runs if the agent restarts and a new grant of the
+// request can cancel it.
+func (s *Scheduler) ScheduleRevoke(command string, req scripts.ProvisioningRequest, at time.Time) scripts.ProvisioningResult {
+	record := Record{
+		Key:     Key(req.RequestID, command),
+		Command: command,
+		Request: req,
+		ValidTo: at.UTC(),
+		Status:  StatusRevokePending,
+	}
+
+	if err := s.store.Put(record); err != nil {
+		return scripts.ProvisioningResult{Success: false, Error: err.Error()}
+	}
+
+	s.logger.WithFields(logrus.Fields{
+		"key": record.Key,
+		"at":  record.ValidTo.Format(time.RFC3339),
+	}).Info("⏰ Revoke scheduled after grace period")
+
+	return scripts.ProvisioningResult{
+		Success: true,
+		Status:  StatusScheduled,
+		Message: "Revoke scheduled for " + record.ValidTo.Format(time.RFC3339),
+	}
+}
+
+// Cancel marks a tracked grant as revoked so it is neither activated nor expired later
+func (s *Scheduler) Cancel(requestID, command string) {
+	key := Key(requestID, command)
+	record, ok := s.store.Get(key)
+	if !ok || record.IsFinished() {
+		return
+	}
+
+	record.Status = StatusRevoked
+	if err := s.store.Put(record); err != nil {
+		s.logger.WithError(err).WithField("key", key).Error("Failed to record grant cancellation")
+		return
+	}
+
+	s.logger.WithField("key", key).Info("⏰ Tracked grant cancelled by revoke request")
+}
+
+// CancelPendingRevokes drops the revokes of requestID held by
+// ScheduleRevoke, as a new grant of the request gives the access back, e.g.
+// the sessions a graced provisionSession revoke would end. It returns the
+// keys it cancelled.
+func (s *Scheduler) CancelPendingRevokes(requestID string) []string {
+	var cancelled []string
+	for _, record := range s.store.List() {
+		if record.Request.RequestID != requestID || record.Status != StatusRevokePending {
+			continue
+		}
+
+		record.Status = StatusCancelled
+		if err := s.store.Put(record); err != nil {
+			s.logger.WithError(err).WithField("key", record.Key).Error("Failed to record cancellation of pending revoke")
+			continue
+		}
+		s.logger.WithField("key", record.Key).Info("⏰ Pending revoke cancelled by new grant")
+		cancelled = append(cancelled, record.Key)
+	}
+	return cancelled
+}
+
+// CancelMatching cancels every grant still waiting for or inside its window
+// whose request matches, and returns their keys
+func (s *Scheduler) CancelMatching(match func(scripts.ProvisioningRequest) bool) []string {
+	var cancelled []string
+	for _, record := range s.Pending() {
+		if match(record.Request) {
+			s.Cancel(record.Request.RequestID, record.Command)
+			cancelled = append(cancelled, record.Key)
+		}
+	}
+	return cancelled
+}
+
+// Tracks reports whether the scheduler still has work for a grant, so other
+// components leave its expiry to the scheduler
+func (s *Scheduler) Tracks(requestID, command string) bool {
+	record, ok := s.store.Get(Key(requestID, command))
+	return ok && !record.IsFinished()
+}
+
+// Pending returns the grants waiting for their window or still active
+func (s *Scheduler) Pending() []Record {
+	var pending []Record
+	for _, record := range s.store.List() {
+		if !record.IsFinished() {
+			pending = append(pending, record)
+		}
+	}
+	return pending
+}
+
+// Backlog returns the current grant backlog for reporting in heartbeats
+func (s *Scheduler) Backlog() Backlog {
+	return s.store.Backlog(time.Now(), ExpiringSoonWindow)
+}
+
+func (s *Scheduler) process(now time.Time) {
+	records := s.store.List()
+	// A request's account must exist before its keys, sudo rules and the
+	// like are activated, whatever order their keys sort in
+	sort.SliceStable(records, func(i, j int) bool {
+		return activateOrder(records[i].Command) < activateOrder(records[j].Command)
+	})
+
+	for _, record := range records {
+		switch record.Status {
+		case StatusScheduled:
+			if !record.ValidTo.IsZero() && !now.Before(record.ValidTo) {
+				// The whole window passed while the agent was down; nothing to grant
+				s.transition(record, StatusExpired, "")
+			} else if !now.Before(record.ValidFrom) && (s.hold == nil || !s.hold()) {
+				s.activate(record)
+			}
+		case StatusActive, StatusRevokePending:
+			if record.LastError != "" && now.Sub(record.UpdatedAt) < retryInterval {
+				continue
+			}
+			if !record.ValidTo.IsZero() && !now.Before(record.ValidTo) {
+				s.deactivate(record)
+			}
+		}
+	}
+
+	if err := s.store.Prune(now); err != nil {
+		s.logger.WithError(err).Warn("Failed to prune grant store")
+	}
+}
+
+func activateOrder(command string) int {
+	if scripts.Command(command) == scripts.CommandProvisionUser {
+		return 0
+	}
+	return 1
+}
+
+func (s *Scheduler) activate(record Record) {
+	req := record.Request
+	req.Action = "grant"
+	req.Origin = schedulerOrigin(req.Origin)
+
+	s.logger.WithField("key", record.Key).Info("⏰ Activating scheduled grant")
+
+	// No request waits for a window boundary, so only the configured script
+	// timeout of the command bounds it
+	result := scripts.ExecuteScriptContext(context.Background(), record.Command, req, s.dryRun, s.logger)
+	if !result.Success {
+		s.transition(record, StatusFailed, result.Error)
+		return
+	}
+
+	s.transition(record, StatusActive, "")
+}
+
+func (s *Scheduler) deactivate(record Record) {
+	req := record.Request
+	req.Action = "revoke"
+	req.Origin = schedulerOrigin(req.Origin)
+
+	finished := StatusExpired
+	if record.Status == StatusRevokePending {
+		finished = StatusRevoked
+		s.logger.WithField("key", record.Key).Info("⏰ Grace period ended, revoking access")
+	} else {
+		s.logger.WithField("key", record.Key).Info("⏰ Grant window ended, revoking access")
+	}
+
+	result := scripts.ExecuteScriptContext(context.Background(), record.Command, req, s.dryRun, s.logger)
+	if !result.Success {
+		// Keep the record active so the revoke is retried on the next tick
+		record.LastError = result.Error
+		if err := s.store.Put(record); err != nil {
+			s.logger.WithError(err).Error("Failed to record grant revoke failure")
+		}
+		s.logger.WithField("key", record.Key).WithField("error", result.Error).Error("❌ Failed to revoke expired grant, will retry")
+		return
+	}
+
+	s.transition(record, finished, "")
+}
+
+func (s *Scheduler) transition(record Record, status, lastError string) {
+	record.Status = status
+	record.LastError = lastError
+	if err := s.store.Put(record); err != nil {
+		s.logger.WithError(err).WithField("key", record.Key).Error("Failed to update grant store")
+	}
+}
+
+// schedulerOrigin marks actions taken at a window boundary, keeping the
+// backend request that scheduled the grant
+func schedulerOrigin(origin *audit.Origin) *audit.Origin {
+	scheduled := audit.Origin{}
+	if origin != nil {
+		scheduled = *origin
+	}
+	scheduled.Source = "scheduler"
+	return &scheduled
+}
+
+func formatBound(t time.Time) string {
+	if t.IsZero() {
+		return "none"
+	}
+	return t.Format(time.RFC3339)
+}
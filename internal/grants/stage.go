@@ -0,0 +1,180 @@
+package grants
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/internal/schema"
+	"p0-ssh-agent/scripts"
+)
+
+// StatusStaged is the result status of a pre-staged batch
+const StatusStaged = "staged"
+
+// StageRequest pre-stages a batch of grants, e.g. for a maintenance window.
+// Every item is held inactive and activated together at activateAt, whether
+// or not the agent is connected by then.
+type StageRequest struct {
+	RequestID  string       `json:"requestId"`
+	ActivateAt string       `json:"activateAt"`
+	TimeZone   string       `json:"timeZone,omitempty"`
+	Items      []StagedItem `json:"items"`
+}
+
+// StagedItem is a single grant of a batch. The action is always "grant"; the
+// item may end at its own validTo but starts with the batch.
+type StagedItem struct {
+	Command string `json:"command"`
+	scripts.ProvisioningRequest
+}
+
+// Stage holds every item of a batch until activateAt. The batch is rejected
+// as a whole if any item is invalid, so a window never starts half-staged.
+func (s *Scheduler) Stage(req StageRequest) scripts.ProvisioningResult {
+	records, err := stagedRecords(req, time.Now())
+	var invalid *scripts.ValidationError
+	if errors.As(err, &invalid) {
+		return scripts.ProvisioningResult{Success: false, Error: err.Error(), Data: invalid}
+	}
+	if err != nil {
+		return scripts.ProvisioningResult{Success: false, Error: err.Error()}
+	}
+
+	for _, record := range records {
+		if existing, ok := s.store.Get(record.Key); ok && !existing.IsFinished() {
+			return scripts.ProvisioningResult{
+				Success: false,
+				Error:   fmt.Sprintf("grant %s is already %s", record.Key, existing.Status),
+			}
+		}
+	}
+
+	if err := s.store.PutAll(records); err != nil {
+		return scripts.ProvisioningResult{Success: false, Error: err.Error()}
+	}
+
+	activateAt := records[0].ValidFrom.Format(time.RFC3339)
+	s.logger.WithFields(logrus.Fields{
+		"batch":       req.RequestID,
+		"grants":      len(records),
+		"activate_at": activateAt,
+	}).Info("⏰ Grant batch staged for activation")
+
+	return scripts.ProvisioningResult{
+		Success: true,
+		Status:  StatusStaged,
+		Message: fmt.Sprintf("Staged %d grant(s) for activation at %s", len(records), activateAt),
+		Data: map[string]interface{}{
+			"batch":      req.RequestID,
+			"activateAt": activateAt,
+			"staged":     len(records),
+		},
+	}
+}
+
+// validateItem checks an item against the schema of its command, as the
+// agent checks the request when the item is sent on its own. Fields of the
+// returned ValidationError are prefixed with the item's place in the batch.
+func validateItem(i int, item StagedItem) error {
+	item.Action = "grant"
+	item.Origin = nil
+	encoded, err := json.Marshal(item)
+	if err != nil {
+		return fmt.Errorf("item %d: %w", i, err)
+	}
+	var data interface{}
+	if err := json.Unmarshal(encoded, &data); err != nil {
+		return fmt.Errorf("item %d: %w", i, err)
+	}
+
+	invalid, err := scripts.ValidateRequest(item.Command, data)
+	if err != nil {
+		return fmt.Errorf("item %d: %w", i, err)
+	}
+	if invalid == nil {
+		return nil
+	}
+
+	fieldErrs := make([]schema.FieldError, len(invalid.Errors))
+	for j, fieldErr := range invalid.Errors {
+		fieldErrs[j] = fieldErr
+		fieldErrs[j].Field = fmt.Sprintf("items[%d]", i)
+		if fieldErr.Field != "" {
+			fieldErrs[j].Field += "." + fieldErr.Field
+		}
+	}
+	return &scripts.ValidationError{Command: string(scripts.CommandStageGrants), Errors: fieldErrs}
+}
+
+// stagedRecords validates a batch and returns its records, scheduled for
+// activateAt and tagged with the batch ID
+func stagedRecords(req StageRequest, now time.Time) ([]Record, error) {
+	if req.RequestID == "" {
+		return nil, fmt.Errorf("requestId is required for a staged batch")
+	}
+	if req.ActivateAt == "" {
+		return nil, fmt.Errorf("activateAt is required for a staged batch")
+	}
+	if len(req.Items) == 0 {
+		return nil, fmt.Errorf("staged batch has no items")
+	}
+
+	records := make([]Record, 0, len(req.Items))
+	keys := make(map[string]bool)
+	for i, item := range req.Items {
+		switch scripts.Command(item.Command) {
+		case scripts.CommandProvisionSession, scripts.CommandBulkRevoke, scripts.CommandStageGrants:
+			return nil, fmt.Errorf("item %d: %s cannot be staged", i, item.Command)
+		}
+		if !scripts.IsKnownCommand(item.Command) {
+			return nil, fmt.Errorf("item %d: unknown command %q", i, item.Command)
+		}
+		if item.RequestID == "" || item.UserName == "" {
+			return nil, fmt.Errorf("item %d: requestId and userName are required", i)
+		}
+		if err := validateItem(i, item); err != nil {
+			return nil, err
+		}
+		if item.ValidFrom != "" {
+			return nil, fmt.Errorf("item %d: validFrom is set by the batch activateAt", i)
+		}
+
+		timeZone := item.TimeZone
+		if timeZone == "" {
+			timeZone = req.TimeZone
+		}
+		window, err := ParseWindow(req.ActivateAt, item.ValidTo, timeZone)
+		if err == nil {
+			window, err = CommandWindow(item.Command, item.ProvisioningRequest, window)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("item %d: %w", i, err)
+		}
+		if !now.Before(window.From) {
+			return nil, fmt.Errorf("activateAt %s has already passed", window.From.UTC().Format(time.RFC3339))
+		}
+
+		key := Key(item.RequestID, item.Command)
+		if keys[key] {
+			return nil, fmt.Errorf("item %d: duplicate grant %s", i, key)
+		}
+		keys[key] = true
+
+		request := item.ProvisioningRequest
+		request.Action = "grant"
+		records = append(records, Record{
+			Key:       key,
+			Command:   item.Command,
+			Request:   request,
+			ValidFrom: window.From.UTC(),
+			ValidTo:   window.To.UTC(),
+			Status:    StatusScheduled,
+			Batch:     req.RequestID,
+		})
+	}
+	return records, nil
+}
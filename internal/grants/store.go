@@ -0,0 +1,214 @@
+package grants
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"p0-ssh-agent/internal/state"
+	"p0-ssh-agent/scripts"
+)
+
+// FileName is the grant store inside the agent state directory
+const FileName = "grants.json"
+
+// Status values of a tracked grant
+const (
+	StatusScheduled = "scheduled"
+	StatusActive    = "active"
+	StatusExpired   = "expired"
+	StatusRevoked   = "revoked"
+	StatusFailed    = "failed"
+
+	// StatusRevokePending is a revoke held until ValidTo; a new grant of the
+	// request cancels it
+	StatusRevokePending = "revokePending"
+
+	// StatusCancelled is a pending revoke a new grant cancelled
+	StatusCancelled = "cancelled"
+)
+
+// retention is how long finished grants are kept in the store for inspection
+const retention = 7 * 24 * time.Hour
+
+// Record is a grant held locally so it can be activated and deactivated on time
+type Record struct {
+	Key       string                      `json:"key"`
+	Command   string                      `json:"command"`
+	Request   scripts.ProvisioningRequest `json:"request"`
+	ValidFrom time.Time                   `json:"validFrom,omitempty"`
+	ValidTo   time.Time                   `json:"validTo,omitempty"`
+	Status    string                      `json:"status"`
+	LastError string                      `json:"lastError,omitempty"`
+	Batch     string                      `json:"batch,omitempty"`
+	UpdatedAt time.Time                   `json:"updatedAt"`
+}
+
+// IsFinished reports whether the grant needs no further action
+func (r Record) IsFinished() bool {
+	return r.Status == StatusExpired || r.Status == StatusRevoked || r.Status == StatusFailed || r.Status == StatusCancelled
+}
+
+// Key identifies the grant created by one command of a provisioning request
+func Key(requestID, command string) string {
+	return requestID + "/" + command
+}
+
+// Store persists grant records as JSON in the state directory
+type Store struct {
+	mu      sync.Mutex
+	path    string
+	records map[string]Record
+}
+
+// Open loads the store from stateDir, starting empty if the file does not exist
+func Open(stateDir string) (*Store, error) {
+	store := &Store{
+		path:    filepath.Join(stateDir, FileName),
+		records: make(map[string]Record),
+	}
+
+	var records []Record
+	if err := state.ReadJSON(store.path, &records); err != nil {
+		return nil, fmt.Errorf("failed to read grant store: %w", err)
+	}
+
+	for _, record := range records {
+		store.records[record.Key] = record
+	}
+
+	return store, nil
+}
+
+// Get returns the record for key
+func (s *Store) Get(key string) (Record, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, ok := s.records[key]
+	return record, ok
+}
+
+// Put inserts or replaces a record and persists the store
+func (s *Store) Put(record Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record.UpdatedAt = time.Now().UTC()
+	s.records[record.Key] = record
+	return s.save()
+}
+
+// PutAll inserts or replaces records and persists them in one write
+func (s *Store) PutAll(records []Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+	for _, record := range records {
+		record.UpdatedAt = now
+		s.records[record.Key] = record
+	}
+	return s.save()
+}
+
+// List returns all records sorted by key
+func (s *Store) List() []Record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records := make([]Record, 0, len(s.records))
+	for _, record := range s.records {
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Key < records[j].Key })
+	return records
+}
+
+// IsGrantFinished reports whether every grant tracked for requestID and one
+// of commands has expired or been revoked. Requests without such a grant are
+// never considered finished, whatever their other grants.
+func (s *Store) IsGrantFinished(requestID string, commands ...scripts.Command) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	found := false
+	for _, command := range commands {
+		record, ok := s.records[Key(requestID, string(command))]
+		if !ok {
+			continue
+		}
+		if record.Status != StatusExpired && record.Status != StatusRevoked {
+			return false
+		}
+		found = true
+	}
+	return found
+}
+
+// Backlog summarizes grants that still need attention
+type Backlog struct {
+	Queued       int
+	Failed       int
+	ExpiringSoon int
+}
+
+// Backlog counts scheduled grants, grants that failed to activate or to be
+// revoked, and active grants whose window ends within the given duration
+func (s *Store) Backlog(now time.Time, within time.Duration) Backlog {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var backlog Backlog
+	for _, record := range s.records {
+		switch record.Status {
+		case StatusScheduled:
+			backlog.Queued++
+		case StatusFailed:
+			backlog.Failed++
+		case StatusActive, StatusRevokePending:
+			if record.LastError != "" {
+				backlog.Failed++
+			}
+			if !record.ValidTo.IsZero() && record.ValidTo.Sub(now) <= within {
+				backlog.ExpiringSoon++
+			}
+		}
+	}
+	return backlog
+}
+
+// Prune drops finished records older than the retention period
+func (s *Store) Prune(now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pruned := false
+	for key, record := range s.records {
+		if record.IsFinished() && now.Sub(record.UpdatedAt) > retention {
+			delete(s.records, key)
+			pruned = true
+		}
+	}
+
+	if !pruned {
+		return nil
+	}
+	return s.save()
+}
+
+// save writes the store with the file handling of the provisioning state
+func (s *Store) save() error {
+	records := make([]Record, 0, len(s.records))
+	for _, record := range s.records {
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Key < records[j].Key })
+
+	if err := state.WriteJSON(s.path, records); err != nil {
+		return fmt.Errorf("failed to write grant store: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package grants
+
+import (
+	"testing"
+	"time"
+
+	"p0-ssh-agent/scripts"
+)
+
+// TestSudoEndingBeforeKeys tracks only the sudo grant of a request, the way
+// the scheduler does when sudoExpiresAt ends it before the SSH access
+func TestSudoEndingBeforeKeys(t *testing.T) {
+	store, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().UTC()
+	req := scripts.ProvisioningRequest{
+		RequestID:     "req-1",
+		UserName:      "alice",
+		Action:        "grant",
+		ValidTo:       now.Add(8 * time.Hour).Format(time.RFC3339),
+		SudoExpiresAt: now.Add(-time.Minute).Format(time.RFC3339),
+	}
+	window, err := ParseWindow("", req.ValidTo, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sudoWindow, err := CommandWindow(string(scripts.CommandProvisionSudo), req, window)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sudoWindow.To.Before(window.To) {
+		t.Fatalf("sudo window ends %s, want before %s", sudoWindow.To, window.To)
+	}
+
+	sudo := string(scripts.CommandProvisionSudo)
+	if err := store.Put(Record{Key: Key(req.RequestID, sudo), Command: sudo, Request: req, ValidTo: sudoWindow.To, Status: StatusExpired}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		commands []scripts.Command
+		want     bool
+	}{
+		{name: "sudo", commands: []scripts.Command{scripts.CommandProvisionSudo}, want: true},
+		{name: "keys", commands: []scripts.Command{scripts.CommandProvisionAuthorizedKeys, scripts.CommandProvisionCAKeys}},
+		{name: "no commands"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := store.IsGrantFinished(req.RequestID, tt.commands...); got != tt.want {
+				t.Errorf("IsGrantFinished(%v) = %v, want %v", tt.commands, got, tt.want)
+			}
+		})
+	}
+
+	keys := string(scripts.CommandProvisionAuthorizedKeys)
+	if err := store.Put(Record{Key: Key(req.RequestID, keys), Command: keys, Request: req, ValidTo: window.To, Status: StatusActive}); err != nil {
+		t.Fatal(err)
+	}
+	if store.IsGrantFinished(req.RequestID, scripts.CommandProvisionAuthorizedKeys, scripts.CommandProvisionSudo) {
+		t.Error("a request with an active key grant counts as finished")
+	}
+}
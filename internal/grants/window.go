@@ -0,0 +1,46 @@
+package grants
+
+import (
+	"fmt"
+	"time"
+
+	"p0-ssh-agent/internal/timewindow"
+	"p0-ssh-agent/scripts"
+)
+
+// Window is the period during which a grant is active. Zero bounds are open.
+type Window = timewindow.Window
+
+// ParseWindow parses validFrom/validTo. Values with an explicit offset (RFC 3339)
+// are used as-is; local values are resolved in timeZone, which defaults to UTC.
+func ParseWindow(validFrom, validTo, timeZone string) (Window, error) {
+	return timewindow.Parse(validFrom, validTo, timeZone)
+}
+
+// CommandWindow narrows the window of a grant to when the command's own
+// artifact ends. A provisionSudo grant with sudoExpiresAt ends then, or at
+// the grant's expiresAt or validTo if earlier, so the scheduler revokes sudo
+// while the SSH access of the same grant stays.
+func CommandWindow(command string, req scripts.ProvisioningRequest, window Window) (Window, error) {
+	if scripts.Command(command) != scripts.CommandProvisionSudo || req.SudoExpiresAt == "" {
+		return window, nil
+	}
+
+	sudoExpiresAt, err := timewindow.ParseTime("sudoExpiresAt", req.SudoExpiresAt, req.TimeZone)
+	if err != nil {
+		return Window{}, err
+	}
+	if !window.From.IsZero() && !sudoExpiresAt.After(window.From) {
+		return Window{}, fmt.Errorf("sudoExpiresAt (%s) must be after validFrom (%s)",
+			sudoExpiresAt.Format(time.RFC3339), window.From.Format(time.RFC3339))
+	}
+
+	if window.To.IsZero() || sudoExpiresAt.Before(window.To) {
+		window.To = sudoExpiresAt
+	}
+	// Sudo never outlasts the grant it elevates
+	if expiresAt, err := timewindow.ParseTime("expiresAt", req.ExpiresAt, req.TimeZone); err == nil && !expiresAt.IsZero() && expiresAt.Before(window.To) {
+		window.To = expiresAt
+	}
+	return window, nil
+}
@@ -0,0 +1,198 @@
+package harness
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+	"github.com/sourcegraph/jsonrpc2"
+	jsonrpc2websocket "github.com/sourcegraph/jsonrpc2/websocket"
+
+	"p0-ssh-agent/internal/jwt"
+	"p0-ssh-agent/types"
+)
+
+// BackendHandler answers one method the agent calls on the backend
+type BackendHandler func(params json.RawMessage) (interface{}, error)
+
+// Backend is a scripted stand-in for the P0 tunnel. It accepts the agent's
+// WebSocket, answers setClientId, deliverResults, requestReplay and
+// notifications with success unless told otherwise, records every message
+// and sends provisioning requests to the agent with Call.
+type Backend struct {
+	server   *httptest.Server
+	upgrader websocket.Upgrader
+
+	mu        sync.Mutex
+	conn      *jsonrpc2.Conn
+	connected chan struct{}
+	handlers  map[string]BackendHandler
+	received  map[string][]json.RawMessage
+	authz     []string
+}
+
+// NewBackend starts a backend on a loopback port; Close stops it
+func NewBackend() *Backend {
+	b := &Backend{
+		connected: make(chan struct{}, 1),
+		handlers:  make(map[string]BackendHandler),
+		received:  make(map[string][]json.RawMessage),
+	}
+	b.server = httptest.NewServer(http.HandlerFunc(b.serve))
+	return b
+}
+
+// URL is the tunnel URL to configure the agent with
+func (b *Backend) URL() string {
+	return "ws" + strings.TrimPrefix(b.server.URL, "http")
+}
+
+// Handle replaces the answer to a method the agent calls
+func (b *Backend) Handle(method string, handler BackendHandler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers[method] = handler
+}
+
+// Received returns the params of every call or notification of method
+func (b *Backend) Received(method string) []json.RawMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]json.RawMessage(nil), b.received[method]...)
+}
+
+// Authorizations returns the Authorization header of every connection
+func (b *Backend) Authorizations() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]string(nil), b.authz...)
+}
+
+// WaitConnected blocks until the agent has connected and called setClientId
+func (b *Backend) WaitConnected(ctx context.Context) error {
+	select {
+	case <-b.connected:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Call sends a provisioning request to the agent, as the backend forwards
+// it, and returns the agent's response
+func (b *Backend) Call(ctx context.Context, data map[string]interface{}) (types.ForwardedResponse, error) {
+	return b.Forward(ctx, types.ForwardedRequest{
+		Headers: map[string]interface{}{"content-type": "application/json"},
+		Method:  "POST",
+		Path:    "/",
+		Data:    data,
+	})
+}
+
+// Forward sends request to the agent as is, e.g. one for a target with a
+// binary body built with types.EncodeBody, and returns the agent's response.
+// types.DecodeBody recovers the bytes of the response body.
+func (b *Backend) Forward(ctx context.Context, request types.ForwardedRequest) (types.ForwardedResponse, error) {
+	var response types.ForwardedResponse
+
+	b.mu.Lock()
+	conn := b.conn
+	b.mu.Unlock()
+	if conn == nil {
+		return response, fmt.Errorf("agent is not connected")
+	}
+
+	if err := conn.Call(ctx, "call", request, &response); err != nil {
+		return response, fmt.Errorf("call failed: %w", err)
+	}
+	return response, nil
+}
+
+// Disconnect drops the agent's connection, as a tunnel outage would
+func (b *Backend) Disconnect() {
+	b.mu.Lock()
+	conn := b.conn
+	b.conn = nil
+	b.mu.Unlock()
+
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// Close disconnects the agent and stops the server
+func (b *Backend) Close() {
+	b.Disconnect()
+	b.server.Close()
+}
+
+func (b *Backend) serve(w http.ResponseWriter, r *http.Request) {
+	wsConn, err := b.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	b.mu.Lock()
+	b.authz = append(b.authz, r.Header.Get("Authorization"))
+	b.mu.Unlock()
+
+	conn := jsonrpc2.NewConn(context.Background(), jsonrpc2websocket.NewObjectStream(wsConn), jsonrpc2.AsyncHandler(jsonrpc2.HandlerWithError(b.handle)))
+
+	b.mu.Lock()
+	b.conn = conn
+	b.mu.Unlock()
+
+	<-conn.DisconnectNotify()
+}
+
+func (b *Backend) handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) (interface{}, error) {
+	var params json.RawMessage
+	if req.Params != nil {
+		params = append(params, *req.Params...)
+	}
+
+	b.mu.Lock()
+	b.received[req.Method] = append(b.received[req.Method], params)
+	handler := b.handlers[req.Method]
+	b.mu.Unlock()
+
+	if req.Method == "setClientId" {
+		select {
+		case b.connected <- struct{}{}:
+		default:
+		}
+	}
+
+	if handler != nil {
+		return handler(params)
+	}
+	return map[string]interface{}{"ok": true}, nil
+}
+
+// AgentConfig returns a configuration for an agent that keeps its state in
+// the sandbox and connects to tunnelURL, with a freshly generated JWT key
+func (s *Sandbox) AgentConfig(tunnelURL string) (*types.Config, error) {
+	keyPath := filepath.Join(s.Root, ".harness", "keys")
+	logger := logrus.New()
+	logger.SetLevel(logrus.WarnLevel)
+
+	if err := jwt.NewManager(logger).GenerateKeyPair(keyPath); err != nil {
+		return nil, fmt.Errorf("failed to generate agent key: %w", err)
+	}
+
+	config := types.DefaultConfig()
+	config.OrgID = "harness"
+	config.HostID = "harness-host"
+	config.Hostname = "harness-host"
+	config.KeyPath = keyPath
+	config.StateDir = s.StateDir
+	config.TunnelHost = tunnelURL
+	return config, nil
+}
@@ -0,0 +1,187 @@
+package harness
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// passthrough commands only touch files, so they run for real against the
+// sandbox once sudo is stripped. Their path arguments are already under the
+// sandbox root because the scripts resolve host paths through it.
+var passthrough = map[string]bool{
+	"cat":    true,
+	"cp":     true,
+	"grep":   true,
+	"mkdir":  true,
+	"mktemp": true,
+	"mv":     true,
+	"rm":     true,
+	"rmdir":  true,
+	"sed":    true,
+	"tee":    true,
+	"test":   true,
+	"touch":  true,
+	"chmod":  true,
+}
+
+// fakeScript records stdin in $1, prints $2 and exits with $3. With more
+// arguments it instead runs them with the recorded stdin.
+const fakeScript = `in="$1"; out="$2"; code="$3"; shift 3
+cat > "$in"
+if [ "$#" -gt 0 ]; then exec "$@" < "$in"; fi
+cat "$out"; exit "$code"`
+
+// Call is one command the scripts ran
+type Call struct {
+	Args      []string
+	stdinPath string
+}
+
+// Stdin returns what the scripts wrote to the command's standard input
+func (c Call) Stdin() string {
+	data, _ := os.ReadFile(c.stdinPath)
+	return string(data)
+}
+
+// Rule scripts the answer to commands starting with its prefix
+type Rule struct {
+	prefix []string
+	output string
+	exit   int
+	times  int
+	used   int
+}
+
+// Output sets what the command prints
+func (r *Rule) Output(output string) *Rule {
+	r.output = output
+	return r
+}
+
+// Exit sets the command's exit code
+func (r *Rule) Exit(code int) *Rule {
+	r.exit = code
+	return r
+}
+
+// Times limits the rule to answering n commands; later ones fall through to
+// the other rules, e.g. for a check that passes once and then fails
+func (r *Rule) Times(n int) *Rule {
+	r.times = n
+	return r
+}
+
+// Executor stands in for the host's commands. File commands run against the
+// sandbox; everything else, such as useradd, systemctl or pkill, is only
+// recorded and answered by the first matching rule, or succeeds silently.
+// Commands run through /bin/sh, so the executor needs a Unix host.
+type Executor struct {
+	dir string
+
+	mu    sync.Mutex
+	rules []*Rule
+	calls []Call
+}
+
+// NewExecutor keeps recorded input and scripted output in dir
+func NewExecutor(dir string) (*Executor, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create executor directory: %w", err)
+	}
+	return &Executor{dir: dir}, nil
+}
+
+// On adds a rule for commands starting with args; a leading sudo is ignored.
+// Later rules take precedence.
+func (e *Executor) On(args ...string) *Rule {
+	rule := &Rule{prefix: args}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.rules = append([]*Rule{rule}, e.rules...)
+	return rule
+}
+
+// Command implements scripts.Host.Command
+func (e *Executor) Command(ctx context.Context, name string, arg ...string) *exec.Cmd {
+	args := append([]string{name}, arg...)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	n := len(e.calls)
+	stdinPath := filepath.Join(e.dir, fmt.Sprintf("%04d.stdin", n))
+	outPath := filepath.Join(e.dir, fmt.Sprintf("%04d.out", n))
+	e.calls = append(e.calls, Call{Args: args, stdinPath: stdinPath})
+
+	run := withoutSudo(args)
+	rule := e.match(run)
+
+	var output string
+	code := 0
+	if rule != nil {
+		output, code = rule.output, rule.exit
+	}
+	os.WriteFile(outPath, []byte(output), 0600)
+
+	shellArgs := []string{"-c", fakeScript, "p0-harness", stdinPath, outPath, strconv.Itoa(code)}
+	if rule == nil && passthrough[run[0]] {
+		shellArgs = append(shellArgs, run...)
+	}
+	return exec.CommandContext(ctx, "/bin/sh", shellArgs...)
+}
+
+func (e *Executor) match(args []string) *Rule {
+	for _, rule := range e.rules {
+		if rule.times > 0 && rule.used >= rule.times {
+			continue
+		}
+		if hasPrefix(args, rule.prefix) {
+			rule.used++
+			return rule
+		}
+	}
+	return nil
+}
+
+// Calls returns every command run so far, in order
+func (e *Executor) Calls() []Call {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]Call(nil), e.calls...)
+}
+
+// Ran reports whether a command starting with args was run; a leading sudo
+// is ignored
+func (e *Executor) Ran(args ...string) bool {
+	for _, call := range e.Calls() {
+		if hasPrefix(withoutSudo(call.Args), args) {
+			return true
+		}
+	}
+	return false
+}
+
+func withoutSudo(args []string) []string {
+	if len(args) > 1 && args[0] == "sudo" {
+		return args[1:]
+	}
+	return args
+}
+
+func hasPrefix(args, prefix []string) bool {
+	if len(prefix) > len(args) {
+		return false
+	}
+	for i := range prefix {
+		if args[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
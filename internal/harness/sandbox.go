@@ -0,0 +1,133 @@
+package harness
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/internal/audit"
+	"p0-ssh-agent/internal/filebackup"
+	"p0-ssh-agent/internal/state"
+	"p0-ssh-agent/scripts"
+)
+
+// firstUID is where sandbox accounts start, inside the JIT user range
+const firstUID = 65536
+
+// Sandbox points the provisioning scripts at a temporary directory: host
+// paths such as /etc/sudoers-p0 land under Root, the state directory is
+// Root/var/lib/p0-ssh-agent, accounts exist only in the sandbox and commands
+// go to a recording Executor. Nothing needs root.
+//
+// Scripts keep their configuration in package variables, so only one sandbox
+// may be open at a time and tests using one must not run in parallel.
+type Sandbox struct {
+	Root     string
+	StateDir string
+	Executor *Executor
+
+	mu      sync.Mutex
+	users   map[string]*user.User
+	restore []func()
+}
+
+// NewSandbox opens a sandbox in root, which should be an empty temporary
+// directory such as t.TempDir(). Close it to restore the real host.
+func NewSandbox(root string) (*Sandbox, error) {
+	executor, err := NewExecutor(filepath.Join(root, ".harness"))
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Sandbox{
+		Root:     root,
+		StateDir: filepath.Join(root, "var", "lib", "p0-ssh-agent"),
+		Executor: executor,
+		users:    make(map[string]*user.User),
+	}
+
+	for _, dir := range []string{s.StateDir, s.Path("/etc"), s.Path("/home")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create sandbox directory: %w", err)
+		}
+	}
+
+	s.restore = append(s.restore, scripts.SetHost(scripts.Host{
+		Root:       root,
+		Command:    executor.Command,
+		Sudo:       true,
+		LookupUser: s.lookupUser,
+		CreateUser: func(_ context.Context, username string, logger *logrus.Logger) error {
+			_, err := s.AddUser(username)
+			return err
+		},
+	}))
+
+	scripts.SetStatePath(state.Path(s.StateDir))
+	scripts.SetAuditLogPath(audit.Path(s.StateDir))
+	scripts.SetFileBackupDir(filebackup.Dir(s.StateDir))
+	scripts.SetCertificateAuthorityDir(scripts.CertificateAuthorityDir(s.StateDir))
+
+	return s, nil
+}
+
+// Path returns where an absolute host path lives in the sandbox
+func (s *Sandbox) Path(hostPath string) string {
+	return filepath.Join(s.Root, hostPath)
+}
+
+// ReadFile reads a host path from the sandbox
+func (s *Sandbox) ReadFile(hostPath string) (string, error) {
+	data, err := os.ReadFile(s.Path(hostPath))
+	return string(data), err
+}
+
+// AddUser creates a sandbox account with a home directory under Root/home
+func (s *Sandbox) AddUser(username string) (*user.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.users[username]; ok {
+		return existing, nil
+	}
+
+	uid := strconv.Itoa(firstUID + len(s.users))
+	account := &user.User{
+		Uid:      uid,
+		Gid:      uid,
+		Username: username,
+		Name:     username,
+		HomeDir:  s.Path(filepath.Join("/home", username)),
+	}
+	if err := os.MkdirAll(account.HomeDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create home directory: %w", err)
+	}
+
+	s.users[username] = account
+	return account, nil
+}
+
+func (s *Sandbox) lookupUser(username string) (*user.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if account, ok := s.users[username]; ok {
+		return account, nil
+	}
+	return nil, user.UnknownUserError(username)
+}
+
+// Close restores the real host. State paths are left pointing into the
+// sandbox until the next sandbox or agent sets them.
+func (s *Sandbox) Close() {
+	for i := len(s.restore) - 1; i >= 0; i-- {
+		s.restore[i]()
+	}
+	s.restore = nil
+}
@@ -0,0 +1,183 @@
+package install
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/internal/bundle"
+	"p0-ssh-agent/internal/config"
+	"p0-ssh-agent/internal/jwt"
+	"p0-ssh-agent/scripts"
+	"p0-ssh-agent/types"
+)
+
+const (
+	bundleConfigEntry     = "config.yaml"
+	bundlePrivateKeyEntry = "keys/" + jwt.PrivateKeyFile
+	bundlePublicKeyEntry  = "keys/" + jwt.PublicKeyFile
+	bundleTrustedCAEntry  = "trusted-ca.pub"
+)
+
+// bundleTarget describes where a bundle entry is installed and with which permissions
+type bundleTarget struct {
+	path       string
+	permission os.FileMode
+}
+
+// ImportBundle installs pre-seeded config, keys and trusted CA from a tar bundle.
+// Bundles are produced by provisioning pipelines for golden images and may contain:
+//
+//	config.yaml            -> configPath
+//	keys/jwk.private.json  -> the bundled config's key directory, or keyPath (0600)
+//	keys/jwk.public.json   -> the bundled config's key directory, or keyPath (0644)
+//	trusted-ca.pub         -> trusted by sshd as after registration
+//
+// It returns the bundled config, or nil when the bundle has none.
+func ImportBundle(bundlePath, configPath, keyPath string, logger *logrus.Logger) (*types.Config, error) {
+	logger.WithField("bundle", bundlePath).Info("📦 Importing pre-seeded bundle")
+
+	entries, err := bundle.ReadFile(bundlePath)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := validateBundle(entries, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keys go where the bundled config will look for them
+	keyDir := keyPath
+	if cfg != nil {
+		keyDir = cfg.GetKeyDir()
+	}
+	targets := map[string]bundleTarget{
+		bundleConfigEntry:     {path: configPath, permission: 0644},
+		bundlePrivateKeyEntry: {path: filepath.Join(keyDir, jwt.PrivateKeyFile), permission: 0600},
+		bundlePublicKeyEntry:  {path: filepath.Join(keyDir, jwt.PublicKeyFile), permission: 0644},
+	}
+
+	for _, entry := range entries {
+		target, ok := targets[entry.Name]
+		if !ok {
+			continue
+		}
+		if err := bundle.Install(entry, target.path, target.permission, logger); err != nil {
+			return nil, err
+		}
+	}
+
+	if caEntry, ok := bundle.Find(entries, bundleTrustedCAEntry); ok {
+		if err := scripts.InstallTrustedCA(context.Background(), string(caEntry.Data), logger); err != nil {
+			return nil, fmt.Errorf("failed to trust the bundled CA: %w", err)
+		}
+	}
+
+	logger.WithField("entries", len(entries)).Info("✅ Bundle imported successfully")
+	return cfg, nil
+}
+
+// validateBundle checks every entry before anything is installed and returns
+// the bundled config, if any
+func validateBundle(entries []bundle.Entry, logger *logrus.Logger) (*types.Config, error) {
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("bundle is empty")
+	}
+
+	for _, entry := range entries {
+		if !isBundleEntry(entry.Name) {
+			return nil, fmt.Errorf("unexpected entry %q in bundle (allowed: %s)", entry.Name, strings.Join(bundleEntries, ", "))
+		}
+	}
+
+	_, hasPrivate := bundle.Find(entries, bundlePrivateKeyEntry)
+	_, hasPublic := bundle.Find(entries, bundlePublicKeyEntry)
+	if hasPrivate != hasPublic {
+		return nil, fmt.Errorf("bundle must contain both %s and %s or neither", bundlePrivateKeyEntry, bundlePublicKeyEntry)
+	}
+
+	var cfg *types.Config
+	keyProfile := ""
+	if configEntry, ok := bundle.Find(entries, bundleConfigEntry); ok {
+		var err error
+		if cfg, err = validateConfig(configEntry); err != nil {
+			return nil, err
+		}
+		keyProfile = cfg.KeyProfile
+	}
+
+	// The keys must belong to the key profile the bundled config uses
+	if hasPrivate {
+		if err := validateKeys(entries, keyProfile, logger); err != nil {
+			return nil, err
+		}
+	}
+
+	if caEntry, ok := bundle.Find(entries, bundleTrustedCAEntry); ok {
+		if strings.TrimSpace(string(caEntry.Data)) == "" {
+			return nil, fmt.Errorf("%s is empty", bundleTrustedCAEntry)
+		}
+		if runtime.GOOS == "windows" {
+			return nil, fmt.Errorf("%s cannot be imported: trusting the P0 CA is not supported on Windows", bundleTrustedCAEntry)
+		}
+	}
+
+	return cfg, nil
+}
+
+func validateKeys(entries []bundle.Entry, keyProfile string, logger *logrus.Logger) error {
+	tmpDir, err := os.MkdirTemp("", "p0-bundle-keys-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary key directory: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for _, name := range []string{bundlePrivateKeyEntry, bundlePublicKeyEntry} {
+		entry, _ := bundle.Find(entries, name)
+		if err := os.WriteFile(filepath.Join(tmpDir, filepath.Base(name)), entry.Data, 0600); err != nil {
+			return fmt.Errorf("failed to stage %s: %w", name, err)
+		}
+	}
+
+	manager := jwt.NewManager(logger)
+	manager.SetProfile(keyProfile)
+	if err := manager.LoadKey(tmpDir); err != nil {
+		return fmt.Errorf("bundle keys are invalid: %w", err)
+	}
+
+	return nil
+}
+
+func validateConfig(entry bundle.Entry) (*types.Config, error) {
+	// The temporary file keeps the .yaml suffix so viper can infer the format
+	tmpPath, err := bundle.WriteTemp(entry)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmpPath)
+
+	cfg, err := config.LoadWithOverrides(tmpPath, nil)
+	if err != nil {
+		return nil, fmt.Errorf("bundle config is invalid: %w", err)
+	}
+
+	return cfg, nil
+}
+
+// bundleEntries are the entries a bundle may contain
+var bundleEntries = []string{bundleConfigEntry, bundlePrivateKeyEntry, bundlePublicKeyEntry, bundleTrustedCAEntry}
+
+func isBundleEntry(name string) bool {
+	for _, entry := range bundleEntries {
+		if entry == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,242 @@
+package install
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/internal/config"
+	"p0-ssh-agent/internal/elevate"
+	"p0-ssh-agent/internal/osplugins"
+	"p0-ssh-agent/types"
+)
+
+const (
+	// ConfigDir is the standard configuration directory used by all OS plugins
+	ConfigDir = "/etc/p0-ssh-agent"
+
+	// DefaultConfigPath is the standard location of the agent configuration file
+	DefaultConfigPath = "/etc/p0-ssh-agent/config.yaml"
+
+	// DefaultKeyPath is the standard location of the JWT key pair
+	DefaultKeyPath = "/etc/p0-ssh-agent/keys"
+)
+
+// ConfigPath returns configPath, or DefaultConfigPath for commands run
+// without --config
+func ConfigPath(configPath string) string {
+	if configPath == "" {
+		return DefaultConfigPath
+	}
+	return configPath
+}
+
+// Run installs the binary, directories, JWT keys and service definition
+// Resolved paths are written back to installConfig.
+func Run(logger *logrus.Logger, osPlugin osplugins.OSPlugin, installConfig *osplugins.InstallConfig) error {
+	// Security check
+	if os.Geteuid() == 0 && !installConfig.AllowRoot {
+		if !elevate.SudoAvailable() {
+			return fmt.Errorf("install should not be run as root, but this host has no sudo to run it as a regular user; use --allow-root to install as root")
+		}
+		return fmt.Errorf("install should not be run as root, please run as regular user with sudo privileges (or use --allow-root flag to bypass this check)")
+	}
+
+	if os.Geteuid() == 0 && installConfig.AllowRoot {
+		logger.Warn("⚠️  Running as root - this bypasses security restrictions and is not recommended")
+	}
+
+	// Every step below writes system locations; fail once here rather than on each of them
+	if err := elevate.Check(); err != nil {
+		return fmt.Errorf("cannot install: %w", err)
+	}
+
+	if err := ResolveLayout(installConfig, logger); err != nil {
+		return err
+	}
+
+	// Get current executable
+	currentExe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to get current executable path: %w", err)
+	}
+
+	// Install binary using OS-specific install directories
+	installDirs := installDirectories(osPlugin, installConfig.WritableDir)
+	var destPath string
+	var installSuccess bool
+
+	for _, installDir := range installDirs {
+		destPath = filepath.Join(installDir, binaryName())
+
+		// Check if binary already exists at this location
+		if _, err := os.Stat(destPath); err == nil {
+			logger.WithField("path", destPath).Info("✅ Binary already exists at system location")
+			installSuccess = true
+			break
+		}
+
+		// Try to install to this directory
+		logger.WithField("installDir", installDir).Info("📦 Attempting to install binary...")
+		if err := makeInstallDir(installDir); err != nil {
+			logger.WithError(err).WithField("installDir", installDir).Warn("Failed to create install directory, trying next...")
+			continue
+		}
+		if err := copyBinary(currentExe, destPath, logger); err != nil {
+			logger.WithError(err).WithField("installDir", installDir).Warn("Failed to install to directory, trying next...")
+			continue
+		}
+
+		logger.WithField("path", destPath).Info("✅ Binary installed successfully")
+		installSuccess = true
+		break
+	}
+
+	if !installSuccess {
+		return fmt.Errorf("failed to install binary to any of the available directories: %v", installDirs)
+	}
+
+	// Create config and key directories using OS plugin
+	keyPath := installConfig.KeyPath
+
+	dirsToSetup := []string{filepath.Dir(installConfig.ConfigPath), keyPath}
+	if err := osPlugin.SetupDirectories(dirsToSetup, "root", logger); err != nil {
+		return fmt.Errorf("failed to setup directories: %w", err)
+	}
+
+	// Set proper permissions on key directory (readable for public key access, private key will be protected individually)
+	// On Windows the plugin has already set the directory ACL
+	if runtime.GOOS != "windows" {
+		if err := elevate.Privileged().Chmod(keyPath, 0755); err != nil {
+			return fmt.Errorf("failed to set key directory permissions: %w", err)
+		}
+	}
+
+	// Install operator-provided keys, config and CA before generating anything
+	keyProfile := ""
+	if installConfig.BundlePath != "" {
+		bundled, err := ImportBundle(installConfig.BundlePath, installConfig.ConfigPath, keyPath, logger)
+		if err != nil {
+			return fmt.Errorf("failed to import bundle: %w", err)
+		}
+		// Keys the bundle lacks are generated where its config looks for them
+		if bundled != nil {
+			keyPath, keyProfile = bundled.KeyPath, bundled.KeyProfile
+		}
+	}
+
+	// Create the writable state directory, honoring stateDir from an imported config
+	stateDir := resolveStateDir(*installConfig)
+	installConfig.StateDir = stateDir
+	if err := osPlugin.SetupStateDirectory(stateDir, logger); err != nil {
+		return fmt.Errorf("failed to setup state directory: %w", err)
+	}
+
+	// Generate JWT keys
+	if err := generateJWTKeys(keyPath, keyProfile, destPath, logger); err != nil {
+		return fmt.Errorf("failed to generate JWT keys: %w", err)
+	}
+
+	// Create systemd service
+	if err := osPlugin.CreateSystemdService(installConfig.ServiceName, destPath, installConfig.ConfigPath, stateDir, logger); err != nil {
+		return fmt.Errorf("failed to create systemd service: %w", err)
+	}
+
+	return nil
+}
+
+func resolveStateDir(installConfig osplugins.InstallConfig) string {
+	if installConfig.StateDir != "" {
+		return installConfig.StateDir
+	}
+
+	if _, err := os.Stat(installConfig.ConfigPath); err == nil {
+		if cfg, err := config.LoadWithOverrides(installConfig.ConfigPath, nil); err == nil && cfg.StateDir != "" {
+			return cfg.StateDir
+		}
+	}
+
+	return types.DefaultStateDir
+}
+
+func copyBinary(srcPath, destPath string, logger *logrus.Logger) error {
+	logger.WithFields(logrus.Fields{
+		"src":  srcPath,
+		"dest": destPath,
+	}).Debug("Copying binary as root")
+
+	// Copy the binary to the system location as root
+	files := elevate.Privileged()
+	if err := files.Copy(srcPath, destPath); err != nil {
+		return fmt.Errorf("failed to copy binary: %w", err)
+	}
+
+	// Set executable permissions as root
+	if err := files.Chmod(destPath, 0755); err != nil {
+		return fmt.Errorf("failed to set executable permissions: %w", err)
+	}
+
+	return nil
+}
+
+func generateJWTKeys(keyPath, keyProfile, executablePath string, logger *logrus.Logger) error {
+	// Check if keys already exist
+	keyDir := keyPath
+	if keyProfile != "" {
+		keyDir = filepath.Join(keyPath, keyProfile)
+	}
+	privateKeyPath := filepath.Join(keyDir, "jwk.private.json")
+	publicKeyPath := filepath.Join(keyDir, "jwk.public.json")
+
+	if _, err := os.Stat(privateKeyPath); err == nil {
+		if _, err := os.Stat(publicKeyPath); err == nil {
+			logger.Info("✅ JWT keys already exist")
+			return nil
+		}
+	}
+
+	// Generate new keys as root. Elevated Windows shells run it directly; the
+	// key directory ACL protects the keys.
+	args := []string{"keygen", "--key-path", keyPath}
+	if keyProfile != "" {
+		args = append(args, "--profile", keyProfile)
+	}
+	cmd := elevate.Command(executablePath, args...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to generate JWT keys: %w (output: %s)", err, string(output))
+	}
+
+	if runtime.GOOS == "windows" {
+		logger.Info("✅ JWT keys generated successfully")
+		return nil
+	}
+
+	// Set appropriate permissions: public key readable by all, private key root-only
+	files := elevate.Privileged()
+	if err := files.Chmod(publicKeyPath, 0644); err != nil {
+		return fmt.Errorf("failed to set public key permissions: %w", err)
+	}
+
+	if err := files.Chmod(privateKeyPath, 0600); err != nil {
+		return fmt.Errorf("failed to set private key permissions: %w", err)
+	}
+
+	logger.Info("✅ JWT keys generated successfully")
+	return nil
+}
+
+// binaryName is the installed executable name; Windows needs the .exe suffix
+func binaryName() string {
+	if runtime.GOOS == "windows" {
+		return "p0-ssh-agent.exe"
+	}
+	return "p0-ssh-agent"
+}
+
+func makeInstallDir(dir string) error {
+	return elevate.Privileged().MkdirAll(dir)
+}
@@ -0,0 +1,83 @@
+package install
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/internal/osplugins"
+	"p0-ssh-agent/types"
+)
+
+// systemdUnitDir is where service units are written
+const systemdUnitDir = "/etc/systemd/system"
+
+// ResolveLayout fills in installation paths. On appliances with a read-only root,
+// mutable paths (keys, state, and the config when /etc is read-only) are relocated
+// under WritableDir. Explicitly set paths are kept.
+func ResolveLayout(installConfig *osplugins.InstallConfig, logger *logrus.Logger) error {
+	readOnlyRoot := osplugins.IsReadOnlyMount("/")
+
+	if installConfig.WritableDir == "" {
+		if readOnlyRoot {
+			return fmt.Errorf("root filesystem is read-only: re-run with --writable-dir pointing at a writable volume (e.g. /data/p0-ssh-agent)")
+		}
+		if installConfig.KeyPath == "" {
+			installConfig.KeyPath = DefaultKeyPath
+		}
+		return nil
+	}
+
+	writableDir := filepath.Clean(installConfig.WritableDir)
+	if !filepath.IsAbs(writableDir) {
+		return fmt.Errorf("writable directory %q must be an absolute path", installConfig.WritableDir)
+	}
+	if osplugins.IsReadOnlyMount(writableDir) {
+		return fmt.Errorf("writable directory %s is on a read-only filesystem", writableDir)
+	}
+	installConfig.WritableDir = writableDir
+
+	if installConfig.KeyPath == "" || installConfig.KeyPath == DefaultKeyPath {
+		installConfig.KeyPath = filepath.Join(writableDir, "keys")
+	}
+
+	if installConfig.StateDir == "" || installConfig.StateDir == types.DefaultStateDir {
+		installConfig.StateDir = filepath.Join(writableDir, "state")
+	}
+
+	if osplugins.IsReadOnlyMount(filepath.Dir(installConfig.ConfigPath)) {
+		installConfig.ConfigPath = filepath.Join(writableDir, "config.yaml")
+	}
+
+	if osplugins.IsReadOnlyMount(systemdUnitDir) {
+		return fmt.Errorf("%s is read-only: the service unit cannot be installed; make it writable (e.g. via an overlay) and re-run", systemdUnitDir)
+	}
+
+	logger.WithFields(logrus.Fields{
+		"read_only_root": readOnlyRoot,
+		"writable_dir":   writableDir,
+		"config_path":    installConfig.ConfigPath,
+		"key_path":       installConfig.KeyPath,
+		"state_dir":      installConfig.StateDir,
+	}).Info("📁 Relocating mutable paths to writable volume")
+
+	return nil
+}
+
+// installDirectories returns the binary directories to try, skipping read-only
+// ones and falling back to the writable volume
+func installDirectories(osPlugin osplugins.OSPlugin, writableDir string) []string {
+	var dirs []string
+	for _, dir := range osPlugin.GetInstallDirectories() {
+		if !osplugins.IsReadOnlyMount(dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+
+	if writableDir != "" {
+		dirs = append(dirs, filepath.Join(writableDir, "bin"))
+	}
+
+	return dirs
+}
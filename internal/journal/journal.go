@@ -0,0 +1,149 @@
+package journal
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"p0-ssh-agent/internal/filelock"
+	"p0-ssh-agent/types"
+)
+
+// FileName is the outbound journal inside the agent state directory
+const FileName = "journal.json"
+
+// MaxEntries bounds the journal; the oldest results are dropped first
+const MaxEntries = 1000
+
+// Path returns the journal path for a state directory
+func Path(stateDir string) string {
+	return filepath.Join(stateDir, FileName)
+}
+
+// Journal holds the responses the agent could not deliver and when it last
+// heard from the backend. LastContact is what replay requests ask from.
+type Journal struct {
+	LastContact time.Time                 `json:"lastContact,omitempty"`
+	Entries     []types.UndeliveredResult `json:"entries"`
+}
+
+// Load returns the journal. A missing file is an empty journal.
+func Load(path string) (Journal, error) {
+	var journal Journal
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return journal, nil
+	}
+	if err != nil {
+		return journal, fmt.Errorf("failed to read journal: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &journal); err != nil {
+		return journal, fmt.Errorf("failed to parse journal %s: %w", path, err)
+	}
+	return journal, nil
+}
+
+// Append records an undelivered result, assigning its ID and time
+func Append(path string, entry types.UndeliveredResult) (types.UndeliveredResult, error) {
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return entry, fmt.Errorf("failed to generate journal entry id: %w", err)
+	}
+	entry.ID = hex.EncodeToString(id[:])
+	entry.RecordedAt = time.Now().UTC()
+
+	err := update(path, func(journal *Journal) {
+		journal.Entries = append(journal.Entries, entry)
+		if excess := len(journal.Entries) - MaxEntries; excess > 0 {
+			journal.Entries = journal.Entries[excess:]
+		}
+	})
+	return entry, err
+}
+
+// Remove drops delivered entries
+func Remove(path string, ids []string) error {
+	return update(path, func(journal *Journal) {
+		journal.Entries = without(journal.Entries, ids)
+	})
+}
+
+// MarkAttempt counts a failed delivery of the given entries
+func MarkAttempt(path string, ids []string, deliveryErr error) error {
+	return update(path, func(journal *Journal) {
+		for _, id := range ids {
+			for i := range journal.Entries {
+				if journal.Entries[i].ID == id {
+					journal.Entries[i].Attempts++
+					journal.Entries[i].LastError = deliveryErr.Error()
+				}
+			}
+		}
+	})
+}
+
+// Touch records that the backend was reachable at t
+func Touch(path string, t time.Time) error {
+	return update(path, func(journal *Journal) {
+		journal.LastContact = t.UTC()
+	})
+}
+
+func without(entries []types.UndeliveredResult, ids []string) []types.UndeliveredResult {
+	drop := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		drop[id] = true
+	}
+
+	kept := entries[:0]
+	for _, entry := range entries {
+		if !drop[entry.ID] {
+			kept = append(kept, entry)
+		}
+	}
+	return kept
+}
+
+// update rewrites the journal under a lock so the agent and the queue CLI
+// never see a half-written file
+func update(path string, change func(*Journal)) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+
+	release, err := filelock.Acquire(path + ".lock")
+	if err != nil {
+		return fmt.Errorf("failed to lock journal: %w", err)
+	}
+	defer release()
+
+	journal, err := Load(path)
+	if err != nil {
+		return err
+	}
+
+	change(&journal)
+
+	if journal.Entries == nil {
+		journal.Entries = []types.UndeliveredResult{}
+	}
+	data, err := json.MarshalIndent(journal, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal journal: %w", err)
+	}
+
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to write journal: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to replace journal: %w", err)
+	}
+	return nil
+}
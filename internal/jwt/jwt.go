@@ -5,9 +5,13 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-jose/go-jose/v3"
@@ -20,6 +24,20 @@ const (
 
 	PrivateKeyFile = "jwk.private.json"
 	PublicKeyFile  = "jwk.public.json"
+
+	// DefaultLifetime is how long tokens from CreateJWT are valid
+	DefaultLifetime = 7 * 24 * time.Hour
+)
+
+var (
+	// ErrKeyNotFound is returned when a key file does not exist; keygen creates them
+	ErrKeyNotFound = errors.New("JWT key not found")
+
+	// ErrInvalidKey is returned when a key file exists but holds no usable key
+	ErrInvalidKey = errors.New("invalid JWT key")
+
+	// ErrKeyNotLoaded is returned when signing before a key is loaded or generated
+	ErrKeyNotLoaded = errors.New("signer not initialized - call LoadKey or GenerateKeyPair first")
 )
 
 type CustomClaims struct {
@@ -27,16 +45,81 @@ type CustomClaims struct {
 	jwt.Claims
 }
 
-type Manager struct {
-	logger     *logrus.Logger
+// keyState is one loaded key pair. It is never changed once published, so a
+// reload swaps the whole state while the provisioning lane, the heartbeat and
+// the reauthenticator sign with the one they picked up.
+type keyState struct {
 	privateJWK jose.JSONWebKey
 	publicJWK  jose.JSONWebKey
 	signer     jose.Signer
+	modTime    time.Time
+}
+
+type Manager struct {
+	logger *logrus.Logger
+
+	// key is the loaded key pair, nil until LoadKey or GenerateKeyPair succeeds
+	key atomic.Pointer[keyState]
+
+	// profile is the key profile the loaded or generated key must belong to
+	profile string
+
+	// timingMu guards the token timing below, which a reload changes while
+	// the heartbeat and reauthenticator create tokens
+	timingMu sync.RWMutex
+
+	// notBefore backdates nbf and iat; leeway extends exp
+	notBefore time.Duration
+	leeway    time.Duration
+
+	// lifetime is how long tokens from CreateJWT are valid, before leeway
+	lifetime time.Duration
 }
 
 func NewManager(logger *logrus.Logger) *Manager {
 	return &Manager{
-		logger: logger,
+		logger:   logger,
+		lifetime: DefaultLifetime,
+	}
+}
+
+// SetLifetime sets how long tokens from CreateJWT are valid
+func (m *Manager) SetLifetime(lifetime time.Duration) {
+	m.timingMu.Lock()
+	defer m.timingMu.Unlock()
+	m.lifetime = lifetime
+}
+
+// Lifetime returns how long tokens from CreateJWT are valid, before leeway
+func (m *Manager) Lifetime() time.Duration {
+	m.timingMu.RLock()
+	defer m.timingMu.RUnlock()
+	return m.lifetime
+}
+
+// SetClockSkew makes tokens tolerate clock drift between the agent and the
+// backend: nbf and iat are backdated by notBefore and exp is pushed back by leeway
+func (m *Manager) SetClockSkew(notBefore, leeway time.Duration) {
+	m.timingMu.Lock()
+	defer m.timingMu.Unlock()
+	m.notBefore = notBefore
+	m.leeway = leeway
+}
+
+// claims returns the registered claims of a token valid for lifetime
+func (m *Manager) claims(clientID string, lifetime time.Duration) jwt.Claims {
+	m.timingMu.RLock()
+	notBefore, leeway := m.notBefore, m.leeway
+	m.timingMu.RUnlock()
+
+	now := time.Now()
+	return jwt.Claims{
+		Issuer:    "kd-client",
+		Subject:   clientID,
+		Audience:  jwt.Audience{"p0.dev"},
+		IssuedAt:  jwt.NewNumericDate(now.Add(-notBefore)),
+		NotBefore: jwt.NewNumericDate(now.Add(-notBefore)),
+		Expiry:    jwt.NewNumericDate(now.Add(lifetime + leeway)),
 	}
 }
 
@@ -62,12 +145,14 @@ func (m *Manager) LoadKey(path string) error {
 	}
 
 	if _, err := os.Stat(privateKeyPath); os.IsNotExist(err) {
-		return fmt.Errorf("JWT private key not found at %s\n\n💡 Generate keys first with: p0-ssh-agent keygen --path %s", privateKeyPath, path)
+		return fmt.Errorf("%w at %s\n\n💡 Generate keys first with: p0-ssh-agent keygen --path %s", ErrKeyNotFound, privateKeyPath, path)
 	}
 
 	privateJWK, err := m.loadPrivateJWK(privateKeyPath)
-	if err != nil {
+	if errors.Is(err, ErrInvalidKey) {
 		return fmt.Errorf("failed to load private JWK from %s: %w\n\n💡 The key file exists but is invalid. Try regenerating with: p0-ssh-agent keygen --path %s --force", privateKeyPath, err, path)
+	} else if err != nil {
+		return fmt.Errorf("failed to load private JWK from %s: %w", privateKeyPath, err)
 	}
 
 	publicJWK, err := m.loadPublicJWK(publicKeyPath)
@@ -75,14 +160,24 @@ func (m *Manager) LoadKey(path string) error {
 		return fmt.Errorf("failed to load public JWK from %s: %w", publicKeyPath, err)
 	}
 
+	if err := m.checkProfile(path, publicJWK.KeyID); err != nil {
+		return err
+	}
+
 	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES384, Key: privateJWK}, (&jose.SignerOptions{}).WithType("JWT"))
 	if err != nil {
-		return fmt.Errorf("failed to create signer: %w", err)
+		return fmt.Errorf("%w: failed to create signer: %w", ErrInvalidKey, err)
 	}
 
-	m.privateJWK = privateJWK
-	m.publicJWK = publicJWK
-	m.signer = signer
+	key := &keyState{
+		privateJWK: privateJWK,
+		publicJWK:  publicJWK,
+		signer:     signer,
+	}
+	if info, err := os.Stat(privateKeyPath); err == nil {
+		key.modTime = info.ModTime()
+	}
+	m.key.Store(key)
 	m.logger.WithField("path", privateKeyPath).Info("Successfully loaded JWT JWK keys")
 	return nil
 }
@@ -100,16 +195,21 @@ func (m *Manager) GenerateKeyPair(path string) error {
 		return fmt.Errorf("failed to generate key pair: %w", err)
 	}
 
-	privateJWK := jose.JSONWebKey{
-		Key:       privateKey,
-		KeyID:     "", // Can be set if needed
+	publicJWK := jose.JSONWebKey{
+		Key:       &privateKey.PublicKey,
 		Algorithm: string(jose.ES384),
 		Use:       "sig",
 	}
 
-	publicJWK := jose.JSONWebKey{
-		Key:       &privateKey.PublicKey,
-		KeyID:     "", // Should match private key ID if set
+	keyID, err := m.newKeyID(publicJWK)
+	if err != nil {
+		return err
+	}
+	publicJWK.KeyID = keyID
+
+	privateJWK := jose.JSONWebKey{
+		Key:       privateKey,
+		KeyID:     keyID,
 		Algorithm: string(jose.ES384),
 		Use:       "sig",
 	}
@@ -133,9 +233,15 @@ func (m *Manager) GenerateKeyPair(path string) error {
 		return fmt.Errorf("failed to create signer: %w", err)
 	}
 
-	m.privateJWK = privateJWK
-	m.publicJWK = publicJWK
-	m.signer = signer
+	key := &keyState{
+		privateJWK: privateJWK,
+		publicJWK:  publicJWK,
+		signer:     signer,
+	}
+	if info, err := os.Stat(privateKeyPath); err == nil {
+		key.modTime = info.ModTime()
+	}
+	m.key.Store(key)
 
 	m.logger.Info("Generated new ES384 JWK key pair")
 	return nil
@@ -172,6 +278,9 @@ func (m *Manager) checkDirectoryPermissions(path string) error {
 func (m *Manager) loadPrivateJWK(path string) (jose.JSONWebKey, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return jose.JSONWebKey{}, fmt.Errorf("%w at %s", ErrKeyNotFound, path)
+		}
 		return jose.JSONWebKey{}, fmt.Errorf("cannot read JWK file: %w", err)
 	}
 
@@ -181,7 +290,7 @@ func (m *Manager) loadPrivateJWK(path string) (jose.JSONWebKey, error) {
 		if len(preview) > 200 {
 			preview = preview[:200] + "..."
 		}
-		return jose.JSONWebKey{}, fmt.Errorf("failed to parse JWK JSON: %w\nFile content preview: %s", err, preview)
+		return jose.JSONWebKey{}, fmt.Errorf("%w: failed to parse JWK JSON: %w\nFile content preview: %s", ErrInvalidKey, err, preview)
 	}
 
 	return jwk, nil
@@ -190,6 +299,9 @@ func (m *Manager) loadPrivateJWK(path string) (jose.JSONWebKey, error) {
 func (m *Manager) loadPublicJWK(path string) (jose.JSONWebKey, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return jose.JSONWebKey{}, fmt.Errorf("%w at %s", ErrKeyNotFound, path)
+		}
 		return jose.JSONWebKey{}, fmt.Errorf("cannot read JWK file: %w", err)
 	}
 
@@ -199,7 +311,7 @@ func (m *Manager) loadPublicJWK(path string) (jose.JSONWebKey, error) {
 		if len(preview) > 200 {
 			preview = preview[:200] + "..."
 		}
-		return jose.JSONWebKey{}, fmt.Errorf("failed to parse JWK JSON: %w\nFile content preview: %s", err, preview)
+		return jose.JSONWebKey{}, fmt.Errorf("%w: failed to parse JWK JSON: %w\nFile content preview: %s", ErrInvalidKey, err, preview)
 	}
 
 	return jwk, nil
@@ -224,23 +336,17 @@ func (m *Manager) saveJWK(path string, jwk jose.JSONWebKey, includePrivate bool)
 }
 
 func (m *Manager) CreateJWT(clientID string) (string, error) {
-	if m.signer == nil {
-		return "", fmt.Errorf("signer not initialized - call LoadKey or GenerateKeyPair first")
+	key := m.key.Load()
+	if key == nil {
+		return "", ErrKeyNotLoaded
 	}
 
-	now := time.Now()
 	claims := CustomClaims{
 		TunnelID: "my-tunnel-id",
-		Claims: jwt.Claims{
-			Issuer:   "kd-client",
-			Subject:  clientID,
-			Audience: jwt.Audience{"p0.dev"},
-			IssuedAt: jwt.NewNumericDate(now),
-			Expiry:   jwt.NewNumericDate(now.Add(7 * 24 * time.Hour)), // One week
-		},
+		Claims:   m.claims(clientID, m.Lifetime()),
 	}
 
-	token, err := jwt.Signed(m.signer).Claims(claims).CompactSerialize()
+	token, err := jwt.Signed(key.signer).Claims(claims).CompactSerialize()
 	if err != nil {
 		return "", fmt.Errorf("failed to create JWT: %w", err)
 	}
@@ -249,23 +355,17 @@ func (m *Manager) CreateJWT(clientID string) (string, error) {
 }
 
 func (m *Manager) CreateJWTWithOptions(clientID, tunnelID string, expiration time.Duration) (string, error) {
-	if m.signer == nil {
-		return "", fmt.Errorf("signer not initialized - call LoadKey or GenerateKeyPair first")
+	key := m.key.Load()
+	if key == nil {
+		return "", ErrKeyNotLoaded
 	}
 
-	now := time.Now()
 	claims := CustomClaims{
 		TunnelID: tunnelID,
-		Claims: jwt.Claims{
-			Issuer:   "kd-client",
-			Subject:  clientID,
-			Audience: jwt.Audience{"p0.dev"},
-			IssuedAt: jwt.NewNumericDate(now),
-			Expiry:   jwt.NewNumericDate(now.Add(expiration)),
-		},
+		Claims:   m.claims(clientID, expiration),
 	}
 
-	token, err := jwt.Signed(m.signer).Claims(claims).CompactSerialize()
+	token, err := jwt.Signed(key.signer).Claims(claims).CompactSerialize()
 	if err != nil {
 		return "", fmt.Errorf("failed to create JWT: %w", err)
 	}
@@ -0,0 +1,140 @@
+package jwt
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
+	"github.com/sirupsen/logrus"
+)
+
+func newTestManager() *Manager {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return NewManager(logger)
+}
+
+// generate writes a new key pair into dir and returns its kid
+func generate(t *testing.T, dir string) string {
+	t.Helper()
+	m := newTestManager()
+	if err := m.GenerateKeyPair(dir); err != nil {
+		t.Fatalf("GenerateKeyPair: %v", err)
+	}
+	keyID, err := m.KeyID()
+	if err != nil {
+		t.Fatalf("KeyID: %v", err)
+	}
+	return keyID
+}
+
+func TestSigningBeforeLoad(t *testing.T) {
+	m := newTestManager()
+	if _, err := m.CreateJWT("client"); err != ErrKeyNotLoaded {
+		t.Errorf("CreateJWT error = %v, want %v", err, ErrKeyNotLoaded)
+	}
+	if _, err := m.SignResponse([]byte("{}")); err != ErrKeyNotLoaded {
+		t.Errorf("SignResponse error = %v, want %v", err, ErrKeyNotLoaded)
+	}
+	if _, err := m.KeyID(); err != ErrKeyNotLoaded {
+		t.Errorf("KeyID error = %v, want %v", err, ErrKeyNotLoaded)
+	}
+}
+
+func TestReloadIfChanged(t *testing.T) {
+	dir := t.TempDir()
+	oldKeyID := generate(t, dir)
+
+	m := newTestManager()
+	if err := m.LoadKey(dir); err != nil {
+		t.Fatalf("LoadKey: %v", err)
+	}
+	if reloaded, err := m.ReloadIfChanged(dir); err != nil || reloaded {
+		t.Fatalf("ReloadIfChanged on an unchanged key = %v, %v, want false, nil", reloaded, err)
+	}
+
+	staging := filepath.Join(dir, StagingDir)
+	newKeyID := generate(t, staging)
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(filepath.Join(staging, PrivateKeyFile), later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := InstallKeyPair(staging, dir); err != nil {
+		t.Fatalf("InstallKeyPair: %v", err)
+	}
+
+	if reloaded, err := m.ReloadIfChanged(dir); err != nil || !reloaded {
+		t.Fatalf("ReloadIfChanged on a rotated key = %v, %v, want true, nil", reloaded, err)
+	}
+	keyID, err := m.KeyID()
+	if err != nil {
+		t.Fatalf("KeyID: %v", err)
+	}
+	if keyID == oldKeyID || keyID != newKeyID {
+		t.Errorf("KeyID after reload = %s, want the rotated key %s", keyID, newKeyID)
+	}
+}
+
+// TestReloadWhileSigning reloads the key while tokens and responses are signed
+// from other goroutines; run with -race to check the key is published safely
+func TestReloadWhileSigning(t *testing.T) {
+	dir := t.TempDir()
+	generate(t, dir)
+
+	m := newTestManager()
+	if err := m.LoadKey(dir); err != nil {
+		t.Fatalf("LoadKey: %v", err)
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				signed, err := m.SignResponse([]byte(`{"ok":true}`))
+				if err != nil {
+					t.Errorf("SignResponse: %v", err)
+					return
+				}
+				object, err := jose.ParseSigned(signed)
+				if err != nil {
+					t.Errorf("ParseSigned: %v", err)
+					return
+				}
+				if object.Signatures[0].Header.KeyID == "" {
+					t.Error("signed response has no kid")
+					return
+				}
+				if _, err := m.CreateJWT("client"); err != nil {
+					t.Errorf("CreateJWT: %v", err)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 20; i++ {
+		if err := m.LoadKey(dir); err != nil {
+			t.Errorf("LoadKey: %v", err)
+			break
+		}
+		if _, err := m.ReloadIfChanged(dir); err != nil {
+			t.Errorf("ReloadIfChanged: %v", err)
+			break
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
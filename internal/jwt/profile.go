@@ -0,0 +1,74 @@
+package jwt
+
+import (
+	"crypto"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/go-jose/go-jose/v3"
+)
+
+// keyIDSeparator joins a key profile to the key thumbprint in kid. Base64url
+// thumbprints never contain it, so the profile can be read back from any kid.
+const keyIDSeparator = "."
+
+// SetProfile makes the manager generate keys for profile and refuse to load a
+// key generated for another one. The empty profile is the default key.
+func (m *Manager) SetProfile(profile string) {
+	m.profile = profile
+}
+
+// Profile returns the key profile set with SetProfile
+func (m *Manager) Profile() string {
+	return m.profile
+}
+
+// KeyIDProfile returns the key profile recorded in kid, "" for the default key
+func KeyIDProfile(kid string) string {
+	if i := strings.LastIndex(kid, keyIDSeparator); i >= 0 {
+		return kid[:i]
+	}
+	return ""
+}
+
+// newKeyID returns the kid of a new key: its thumbprint, prefixed with the
+// profile when one is set
+func (m *Manager) newKeyID(publicJWK jose.JSONWebKey) (string, error) {
+	thumbprint, err := thumbprint(publicJWK)
+	if err != nil {
+		return "", err
+	}
+	if m.profile == "" {
+		return thumbprint, nil
+	}
+	return m.profile + keyIDSeparator + thumbprint, nil
+}
+
+// checkProfile refuses a key whose kid names another profile, so a key copied
+// between environments is not used as the identity of the wrong backend. Keys
+// generated before kid was recorded are accepted for any profile.
+func (m *Manager) checkProfile(path, kid string) error {
+	if kid == "" {
+		return nil
+	}
+	if profile := KeyIDProfile(kid); profile != m.profile {
+		return fmt.Errorf("%w: the key in %s belongs to key profile %s, not %s", ErrInvalidKey, path, profileName(profile), profileName(m.profile))
+	}
+	return nil
+}
+
+func profileName(profile string) string {
+	if profile == "" {
+		return "default"
+	}
+	return fmt.Sprintf("%q", profile)
+}
+
+func thumbprint(publicJWK jose.JSONWebKey) (string, error) {
+	sum, err := publicJWK.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return "", fmt.Errorf("failed to compute key thumbprint: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(sum), nil
+}
@@ -0,0 +1,93 @@
+package jwt
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// The replaced key pair is kept after a rotation for rollback. The names
+	// keep the .private.json suffix that fetchFile always refuses to serve.
+	PreviousPrivateKeyFile = "jwk.previous.private.json"
+	PreviousPublicKeyFile  = "jwk.previous.public.json"
+
+	// StagingDir holds a new key pair inside the key directory until it is installed
+	StagingDir = ".rotate"
+)
+
+// InstallKeyPair moves the key pair generated in stagingDir into path and keeps
+// the replaced pair as the previous key. Each file is swapped with a rename on
+// the same filesystem, so readers never see a partially written key.
+func InstallKeyPair(stagingDir, path string) error {
+	files := []struct {
+		current  string
+		previous string
+	}{
+		{PublicKeyFile, PreviousPublicKeyFile},
+		{PrivateKeyFile, PreviousPrivateKeyFile},
+	}
+
+	for _, file := range files {
+		if _, err := os.Stat(filepath.Join(stagingDir, file.current)); err != nil {
+			return fmt.Errorf("staged key incomplete: %w", err)
+		}
+	}
+
+	for _, file := range files {
+		if err := keepPrevious(filepath.Join(path, file.current), filepath.Join(path, file.previous)); err != nil {
+			return err
+		}
+	}
+
+	// The signing key is swapped last
+	for _, file := range files {
+		if err := os.Rename(filepath.Join(stagingDir, file.current), filepath.Join(path, file.current)); err != nil {
+			return fmt.Errorf("failed to install %s: %w", file.current, err)
+		}
+	}
+
+	return os.RemoveAll(stagingDir)
+}
+
+func keepPrevious(currentPath, previousPath string) error {
+	info, err := os.Stat(currentPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %w", currentPath, err)
+	}
+
+	data, err := os.ReadFile(currentPath)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", currentPath, err)
+	}
+
+	// An earlier previous key may be read-only
+	if err := os.Remove(previousPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to replace %s: %w", previousPath, err)
+	}
+	if err := os.WriteFile(previousPath, data, info.Mode().Perm()); err != nil {
+		return fmt.Errorf("failed to keep previous key %s: %w", previousPath, err)
+	}
+	return nil
+}
+
+// ReloadIfChanged loads the key again when the private key file was replaced,
+// e.g. by rotate-keys, since it was last loaded. On failure the loaded key is kept.
+func (m *Manager) ReloadIfChanged(path string) (bool, error) {
+	info, err := os.Stat(filepath.Join(path, PrivateKeyFile))
+	if err != nil {
+		return false, err
+	}
+
+	if key := m.key.Load(); key != nil && info.ModTime().Equal(key.modTime) {
+		return false, nil
+	}
+
+	if err := m.LoadKey(path); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,54 @@
+package jwt
+
+import (
+	"fmt"
+
+	"github.com/go-jose/go-jose/v3"
+)
+
+// ResponseSignatureType is the typ header of signed provisioning responses
+const ResponseSignatureType = "p0-response+jws"
+
+// KeyID returns the kid recorded when the key was generated, or the RFC 7638
+// thumbprint of an older key without one. It is sent as kid so the backend can
+// pick the right key while an old one is still accepted.
+func (m *Manager) KeyID() (string, error) {
+	key := m.key.Load()
+	if key == nil {
+		return "", ErrKeyNotLoaded
+	}
+	return key.keyID()
+}
+
+func (k *keyState) keyID() (string, error) {
+	if k.publicJWK.KeyID != "" {
+		return k.publicJWK.KeyID, nil
+	}
+	return thumbprint(k.publicJWK)
+}
+
+// SignResponse returns payload as a compact JWS signed with the agent key
+func (m *Manager) SignResponse(payload []byte) (string, error) {
+	key := m.key.Load()
+	if key == nil {
+		return "", ErrKeyNotLoaded
+	}
+
+	keyID, err := key.keyID()
+	if err != nil {
+		return "", err
+	}
+
+	options := (&jose.SignerOptions{}).WithType(ResponseSignatureType).WithHeader("kid", keyID)
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES384, Key: key.privateJWK}, options)
+	if err != nil {
+		return "", fmt.Errorf("failed to create response signer: %w", err)
+	}
+
+	signed, err := signer.Sign(payload)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign response: %w", err)
+	}
+
+	return signed.CompactSerialize()
+}
@@ -0,0 +1,83 @@
+package labels
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	awsMetadataURL     = "http://169.254.169.254/latest"
+	awsMetadataTimeout = 2 * time.Second
+)
+
+// awsInstanceTags reads instance tags through IMDSv2. Tags must be allowed in
+// instance metadata (InstanceMetadataTags=enabled) for the listing to exist.
+func awsInstanceTags() ([]string, error) {
+	// The metadata service is link-local and must never go through a proxy
+	client := &http.Client{
+		Timeout:   awsMetadataTimeout,
+		Transport: &http.Transport{Proxy: nil},
+	}
+
+	tokenRequest, err := http.NewRequest(http.MethodPut, awsMetadataURL+"/api/token", nil)
+	if err != nil {
+		return nil, err
+	}
+	tokenRequest.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+
+	token, err := awsMetadataCall(client, tokenRequest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get IMDSv2 token: %w", err)
+	}
+
+	keys, err := awsMetadataGet(client, token, "/meta-data/tags/instance/")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list instance tags: %w", err)
+	}
+
+	var tags []string
+	for _, key := range strings.Split(keys, "\n") {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			continue
+		}
+
+		value, err := awsMetadataGet(client, token, "/meta-data/tags/instance/"+key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read instance tag %s: %w", key, err)
+		}
+		tags = append(tags, key+"="+value)
+	}
+
+	return tags, nil
+}
+
+func awsMetadataGet(client *http.Client, token, path string) (string, error) {
+	request, err := http.NewRequest(http.MethodGet, awsMetadataURL+path, nil)
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("X-aws-ec2-metadata-token", token)
+	return awsMetadataCall(client, request)
+}
+
+func awsMetadataCall(client *http.Client, request *http.Request) (string, error) {
+	resp, err := client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata service returned %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(body)), nil
+}
@@ -0,0 +1,203 @@
+package labels
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/types"
+)
+
+const (
+	// scriptTimeout bounds a labelScript run so a hung script cannot delay heartbeats
+	scriptTimeout = 10 * time.Second
+
+	// cloudCacheTTL is how long cloud tags are reused before the metadata service is queried again
+	cloudCacheTTL = 5 * time.Minute
+)
+
+// placeholderPattern matches {{name}} and {{name:argument}} in label values
+var placeholderPattern = regexp.MustCompile(`\{\{\s*([A-Za-z]+)(?::([^}]*))?\s*\}\}`)
+
+// Evaluate returns the host labels for a heartbeat: configured labels with
+// placeholders expanded, then cloud tags, then labelScript output. A later
+// source replaces an earlier label with the same key. Failing sources are
+// logged and skipped so the remaining labels are still reported.
+func Evaluate(config *types.Config, logger *logrus.Logger) []string {
+	set := newLabelSet()
+
+	for _, label := range config.Labels {
+		expanded, ok := Expand(label, config.GetCollection(), logger)
+		if !ok {
+			logger.WithField("label", label).Debug("Label uses a placeholder disableCollection withholds, not reporting it")
+			continue
+		}
+		set.add(expanded)
+	}
+
+	if config.CloudLabels != "" {
+		tags, err := cloudLabels(config.CloudLabels)
+		if err != nil {
+			logger.WithError(err).WithField("provider", config.CloudLabels).Warn("Failed to read cloud tags for labels")
+		}
+		for _, label := range tags {
+			set.add(label)
+		}
+	}
+
+	if config.LabelScript != "" {
+		output, err := runScript(config.LabelScript)
+		if err != nil {
+			logger.WithError(err).WithField("script", config.LabelScript).Warn("Label script failed, its labels are not reported")
+		}
+		for _, label := range output {
+			set.add(label)
+		}
+	}
+
+	return set.labels()
+}
+
+// Expand replaces placeholders in a label. Supported: {{uname}} (kernel
+// release), {{hostname}}, {{os}}, {{arch}} and {{env:NAME}}. Unknown
+// placeholders are left in place. ok is false when the label uses
+// {{hostname}} while collection withholds it, so the label is not reported.
+func Expand(label string, collection types.Collection, logger *logrus.Logger) (expanded string, ok bool) {
+	ok = true
+	expanded = placeholderPattern.ReplaceAllStringFunc(label, func(match string) string {
+		parts := placeholderPattern.FindStringSubmatch(match)
+		name, argument := parts[1], parts[2]
+
+		switch name {
+		case "uname":
+			return kernelRelease()
+		case "hostname":
+			if !collection.Allows(types.CollectHostname) {
+				ok = false
+				return ""
+			}
+			hostname, _ := os.Hostname()
+			return hostname
+		case "os":
+			return runtime.GOOS
+		case "arch":
+			return runtime.GOARCH
+		case "env":
+			return os.Getenv(argument)
+		}
+
+		logger.WithField("placeholder", match).Warn("Unknown label placeholder")
+		return match
+	})
+	return expanded, ok
+}
+
+func kernelRelease() string {
+	if data, err := os.ReadFile("/proc/sys/kernel/osrelease"); err == nil {
+		return strings.TrimSpace(string(data))
+	}
+	if output, err := exec.Command("uname", "-r").Output(); err == nil {
+		return strings.TrimSpace(string(output))
+	}
+	return "unknown"
+}
+
+// runScript executes the label script and returns its key=value lines.
+// Blank lines and lines starting with # are ignored.
+func runScript(path string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), scriptTimeout)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, path).Output()
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("timed out after %s", scriptTimeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var result []string
+	scanner := bufio.NewScanner(strings.NewReader(string(output)))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !strings.Contains(line, "=") {
+			return nil, fmt.Errorf("invalid label %q: expected key=value", line)
+		}
+		result = append(result, line)
+	}
+	return result, nil
+}
+
+var (
+	cloudCacheMu      sync.Mutex
+	cloudCacheLabels  []string
+	cloudCacheExpires time.Time
+)
+
+// cloudLabels returns instance tags from the provider's metadata service,
+// reusing the last answer for cloudCacheTTL
+func cloudLabels(provider string) ([]string, error) {
+	cloudCacheMu.Lock()
+	defer cloudCacheMu.Unlock()
+
+	if time.Now().Before(cloudCacheExpires) {
+		return cloudCacheLabels, nil
+	}
+
+	var tags []string
+	var err error
+	switch provider {
+	case "aws":
+		tags, err = awsInstanceTags()
+	default:
+		err = fmt.Errorf("unsupported cloudLabels provider %q", provider)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cloudCacheLabels = tags
+	cloudCacheExpires = time.Now().Add(cloudCacheTTL)
+	return tags, nil
+}
+
+// labelSet keeps labels in first-seen order while letting later values win
+type labelSet struct {
+	order  []string
+	values map[string]string
+}
+
+func newLabelSet() *labelSet {
+	return &labelSet{values: make(map[string]string)}
+}
+
+func (s *labelSet) add(label string) {
+	key := label
+	if i := strings.Index(label, "="); i >= 0 {
+		key = label[:i]
+	}
+	if _, ok := s.values[key]; !ok {
+		s.order = append(s.order, key)
+	}
+	s.values[key] = label
+}
+
+func (s *labelSet) labels() []string {
+	result := make([]string, 0, len(s.order))
+	for _, key := range s.order {
+		result = append(result, s.values[key])
+	}
+	return result
+}
@@ -0,0 +1,145 @@
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Default is the registry served by the agent's /metrics endpoint
+var Default = NewRegistry()
+
+// Agent metrics, updated by the client and the provisioning scripts
+var (
+	Connected = Default.NewGauge(
+		"p0_agent_connected",
+		"Whether the tunnel to the P0 backend is connected (1) or not (0).")
+
+	Reconnects = Default.NewCounter(
+		"p0_agent_reconnects_total",
+		"Number of forced reconnections to the P0 backend.")
+
+	ReconnectAttempts = Default.NewGauge(
+		"p0_agent_reconnect_attempts",
+		"Failed connection attempts counted by the reconnect backoff; 0 while connected.")
+
+	ReconnectBackoff = Default.NewGauge(
+		"p0_agent_reconnect_backoff_seconds",
+		"Delay before the next connection attempt; 0 while connected.")
+
+	Reauthentications = Default.NewCounter(
+		"p0_agent_reauthentications_total",
+		"Renewals of the tunnel token over the connection, by result (ok, rejected, failed).",
+		"result")
+
+	EndpointSwitches = Default.NewCounter(
+		"p0_agent_endpoint_switches_total",
+		"Number of times the agent moved to another tunnel endpoint: a faster one, a failover or a failback.")
+
+	HeartbeatLatency = Default.NewHistogram(
+		"p0_agent_heartbeat_latency_seconds",
+		"Round-trip time of setClientId heartbeats.",
+		DefaultBuckets)
+
+	HeartbeatFailures = Default.NewCounter(
+		"p0_agent_heartbeat_failures_total",
+		"Number of failed heartbeats.")
+
+	LastHeartbeat = Default.NewGauge(
+		"p0_agent_last_heartbeat_timestamp_seconds",
+		"Unix time of the last successful heartbeat.")
+
+	SSHDHealthy = Default.NewGauge(
+		"p0_agent_sshd_healthy",
+		"Whether sshd is running, listening and has a valid configuration (1) or not (0), as last reported in a heartbeat.")
+
+	HostDisabled = Default.NewGauge(
+		"p0_agent_host_disabled",
+		"Whether the kill switch file is present and grants are refused (1) or not (0).")
+
+	UndeliveredResults = Default.NewGauge(
+		"p0_agent_undelivered_results",
+		"Responses held in the journal until the backend is reachable again.")
+
+	ProvisioningRequests = Default.NewCounter(
+		"p0_agent_provisioning_requests_total",
+		"Provisioning requests received from the backend, by command.",
+		"command")
+
+	ProvisioningFailures = Default.NewCounter(
+		"p0_agent_provisioning_failures_total",
+		"Provisioning requests that failed, by command.",
+		"command")
+
+	TargetRequests = Default.NewCounter(
+		"p0_agent_target_requests_total",
+		"Requests forwarded to targets, by target and response status class (2xx, 4xx, 5xx).",
+		"target", "status")
+
+	TargetStreams = Default.NewGauge(
+		"p0_agent_target_streams",
+		"Event streams and WebSockets open to targets.")
+
+	TargetCacheHits = Default.NewCounter(
+		"p0_agent_target_cache_hits_total",
+		"Requests to targets answered from targetCache, by target.",
+		"target")
+
+	NoopRevokes = Default.NewCounter(
+		"p0_agent_noop_revokes_total",
+		"Revokes answered from the provisioning state because the grant was already revoked, by command.",
+		"command")
+
+	MalformedBlocks = Default.NewCounter(
+		"p0_agent_malformed_blocks_total",
+		"Managed blocks found without their end marker on revoke, by file name.",
+		"file")
+
+	ProvisioningTimeouts = Default.NewCounter(
+		"p0_agent_provisioning_timeouts_total",
+		"Provisioning commands terminated because they ran past their timeout, by command.",
+		"command")
+
+	ScriptDuration = Default.NewHistogram(
+		"p0_agent_script_duration_seconds",
+		"Execution time of provisioning scripts, by command.",
+		DefaultBuckets,
+		"command")
+)
+
+// Unlabeled series start at zero so they are present before the first event
+func init() {
+	Connected.Set(0)
+	LastHeartbeat.Set(0)
+	Reconnects.Add(0)
+	ReconnectAttempts.Set(0)
+	ReconnectBackoff.Set(0)
+	EndpointSwitches.Add(0)
+	HeartbeatFailures.Add(0)
+	UndeliveredResults.Set(0)
+	HostDisabled.Set(0)
+	TargetStreams.Set(0)
+}
+
+// Serve exposes the default registry on address until the server is closed
+func Serve(address string, logger *logrus.Logger) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Default.Handler())
+
+	server := &http.Server{
+		Addr:              address,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	go func() {
+		logger.WithField("address", address).Info("📈 Serving metrics on /metrics")
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.WithError(err).Error("Metrics endpoint stopped")
+		}
+	}()
+
+	return server
+}
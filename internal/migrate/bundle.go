@@ -0,0 +1,44 @@
+package migrate
+
+import (
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+
+	"p0-ssh-agent/internal/bundle"
+	"p0-ssh-agent/internal/jwt"
+	"p0-ssh-agent/types"
+)
+
+// WriteBundle stores the converted config and keys as an install bundle in a
+// private temporary file, so install imports them like a pre-seeded host.
+// The caller removes the file.
+func WriteBundle(legacy *Legacy, config *types.Config, keys Keys) (string, error) {
+	body, err := yaml.Marshal(config)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal configuration: %w", err)
+	}
+	configYAML := fmt.Sprintf("# P0 SSH Agent Configuration File\n# Migrated from the legacy install in %s\n\n%s", legacy.Dir, body)
+
+	entries := []bundle.Entry{
+		{Name: "config.yaml", Mode: 0644, Data: []byte(configYAML)},
+		{Name: "keys/" + jwt.PrivateKeyFile, Mode: 0600, Data: keys.Private},
+		{Name: "keys/" + jwt.PublicKeyFile, Mode: 0644, Data: keys.Public},
+	}
+
+	file, err := os.CreateTemp("", "p0-migrate-*.tar")
+	if err != nil {
+		return "", fmt.Errorf("failed to create migration bundle: %w", err)
+	}
+	if err := bundle.Write(file, entries); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return "", err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return "", fmt.Errorf("failed to write migration bundle: %w", err)
+	}
+	return file.Name(), nil
+}
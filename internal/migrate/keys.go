@@ -0,0 +1,136 @@
+package migrate
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-jose/go-jose/v3"
+
+	"p0-ssh-agent/internal/jwt"
+)
+
+// legacyKeySuffixes are the file names the older releases stored their
+// private key under, as PEM
+var legacyKeySuffixes = []string{".pem", ".key"}
+
+// Keys is a key pair in the current JWK format, with the file it came from
+type Keys struct {
+	Source  string
+	Private []byte
+	Public  []byte
+}
+
+// ConvertKeys reads the key pair in jwkPath. A pair already in the current
+// format is taken as is; otherwise the PEM private key is converted, keeping
+// the key the backend registered.
+func ConvertKeys(jwkPath string) (Keys, error) {
+	privatePath := filepath.Join(jwkPath, jwt.PrivateKeyFile)
+	publicPath := filepath.Join(jwkPath, jwt.PublicKeyFile)
+	if private, err := os.ReadFile(privatePath); err == nil {
+		public, err := os.ReadFile(publicPath)
+		if err != nil {
+			return Keys{}, fmt.Errorf("found %s without its public key: %w", privatePath, err)
+		}
+		return Keys{Source: privatePath, Private: private, Public: public}, nil
+	}
+
+	entries, err := os.ReadDir(jwkPath)
+	if err != nil {
+		return Keys{}, fmt.Errorf("failed to read legacy key directory: %w", err)
+	}
+
+	var candidates []string
+	for _, entry := range entries {
+		for _, suffix := range legacyKeySuffixes {
+			if !entry.IsDir() && strings.HasSuffix(entry.Name(), suffix) {
+				candidates = append(candidates, filepath.Join(jwkPath, entry.Name()))
+			}
+		}
+	}
+	sort.Strings(candidates)
+
+	for _, candidate := range candidates {
+		data, err := os.ReadFile(candidate)
+		if err != nil {
+			return Keys{}, fmt.Errorf("failed to read %s: %w", candidate, err)
+		}
+		key, ok, err := parsePrivateKey(data)
+		if err != nil {
+			return Keys{}, fmt.Errorf("%s: %w", candidate, err)
+		}
+		if !ok {
+			continue
+		}
+
+		keys, err := encodeKeys(key)
+		if err != nil {
+			return Keys{}, err
+		}
+		keys.Source = candidate
+		return keys, nil
+	}
+
+	return Keys{}, fmt.Errorf("no private key found in %s (looked for %s or a PEM key)", jwkPath, jwt.PrivateKeyFile)
+}
+
+// parsePrivateKey decodes an EC private key in SEC 1 or PKCS #8 PEM. ok is
+// false when data holds no private key, e.g. a public key or certificate.
+func parsePrivateKey(data []byte) (*ecdsa.PrivateKey, bool, error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, false, nil
+		}
+
+		var key interface{}
+		var err error
+		switch block.Type {
+		case "EC PRIVATE KEY":
+			key, err = x509.ParseECPrivateKey(block.Bytes)
+		case "PRIVATE KEY":
+			key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to parse private key: %w", err)
+		}
+
+		ecKey, ok := key.(*ecdsa.PrivateKey)
+		if !ok {
+			return nil, false, fmt.Errorf("private key is %T, only EC keys can be converted", key)
+		}
+		if ecKey.Curve != elliptic.P384() {
+			return nil, false, fmt.Errorf("private key uses curve %s, %s needs P-384", ecKey.Curve.Params().Name, jwt.Algorithm)
+		}
+		return ecKey, true, nil
+	}
+}
+
+// encodeKeys writes key the way keygen does
+func encodeKeys(key *ecdsa.PrivateKey) (Keys, error) {
+	privateJWK := jose.JSONWebKey{
+		Key:       key,
+		Algorithm: string(jose.ES384),
+		Use:       "sig",
+	}
+
+	private, err := json.MarshalIndent(privateJWK, "", "  ")
+	if err != nil {
+		return Keys{}, fmt.Errorf("failed to marshal private JWK: %w", err)
+	}
+	public, err := json.MarshalIndent(privateJWK.Public(), "", "  ")
+	if err != nil {
+		return Keys{}, fmt.Errorf("failed to marshal public JWK: %w", err)
+	}
+	return Keys{Private: private, Public: public}, nil
+}
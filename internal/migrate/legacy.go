@@ -0,0 +1,306 @@
+package migrate
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	agentconfig "p0-ssh-agent/internal/config"
+	"p0-ssh-agent/types"
+)
+
+// UnitDir is where the legacy installer wrote its service unit
+const UnitDir = "/etc/systemd/system"
+
+// legacyDirName is the directory the older releases shipped their binary in,
+// e.g. /opt/p0-ssh-agent/p0-ssh-agent
+const legacyDirName = "p0-ssh-agent"
+
+// legacyConfigFiles are looked up in the legacy directory when the unit does
+// not pass --config
+var legacyConfigFiles = []string{"config.yaml", "p0-ssh-agent.yaml"}
+
+// Legacy is an installation made from the older nested p0-ssh-agent/ binary,
+// configured through flags on its ExecStart line
+type Legacy struct {
+	UnitPath   string
+	Binary     string
+	Dir        string
+	ConfigPath string
+
+	OrgID         string
+	HostID        string
+	TunnelHost    string
+	TunnelPort    int
+	TunnelPath    string
+	TunnelTimeout int
+	JWKPath       string
+	EnvironmentID string
+	Labels        []string
+
+	// Ignored are the flags and keys that have no equivalent and are dropped
+	Ignored []string
+}
+
+// UnitPath returns the unit file of serviceName
+func UnitPath(serviceName string) string {
+	return filepath.Join(UnitDir, serviceName+".service")
+}
+
+// Detect reads a service unit and returns the legacy installation it starts,
+// or nil when the unit is missing or already runs the current layout
+func Detect(unitPath string) (*Legacy, error) {
+	data, err := os.ReadFile(unitPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", unitPath, err)
+	}
+
+	execStart := ""
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(strings.TrimSpace(scanner.Text()), "ExecStart="); ok {
+			execStart = value
+		}
+	}
+	args := strings.Fields(execStart)
+	if len(args) == 0 {
+		return nil, nil
+	}
+
+	flags, positional := parseFlags(args[1:])
+	binary := args[0]
+	nested := filepath.Base(filepath.Dir(binary)) == legacyDirName
+	if !nested && flags["jwk-path"] == nil {
+		return nil, nil
+	}
+
+	legacy := &Legacy{
+		UnitPath: unitPath,
+		Binary:   binary,
+		Dir:      filepath.Dir(binary),
+	}
+	for _, arg := range positional {
+		if arg != "start" {
+			legacy.Ignored = append(legacy.Ignored, arg)
+		}
+	}
+
+	legacy.ConfigPath = last(flags["config"])
+	if legacy.ConfigPath == "" {
+		for _, name := range legacyConfigFiles {
+			candidate := filepath.Join(legacy.Dir, name)
+			if _, err := os.Stat(candidate); err == nil {
+				legacy.ConfigPath = candidate
+				break
+			}
+		}
+	}
+	if legacy.ConfigPath != "" {
+		if err := legacy.readConfig(legacy.ConfigPath); err != nil {
+			return nil, err
+		}
+	}
+
+	// Flags on the ExecStart line override the config file, as they did
+	if err := legacy.applyFlags(flags); err != nil {
+		return nil, err
+	}
+
+	if legacy.JWKPath == "" {
+		legacy.JWKPath = legacy.Dir
+	}
+	sort.Strings(legacy.Ignored)
+	return legacy, nil
+}
+
+// parseFlags collects --name value and --name=value pairs. Repeated flags keep
+// every value in order.
+func parseFlags(args []string) (map[string][]string, []string) {
+	flags := make(map[string][]string)
+	var positional []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		name, ok := strings.CutPrefix(arg, "--")
+		if !ok {
+			positional = append(positional, arg)
+			continue
+		}
+		if key, value, found := strings.Cut(name, "="); found {
+			flags[key] = append(flags[key], value)
+			continue
+		}
+		value := ""
+		if i+1 < len(args) && !strings.HasPrefix(args[i+1], "--") {
+			value = args[i+1]
+			i++
+		}
+		flags[name] = append(flags[name], value)
+	}
+	return flags, positional
+}
+
+func last(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[len(values)-1]
+}
+
+func (l *Legacy) applyFlags(flags map[string][]string) error {
+	for name, values := range flags {
+		value := last(values)
+		switch name {
+		case "config", "verbose":
+		case "org-id":
+			l.OrgID = value
+		case "host-id":
+			l.HostID = value
+		case "tunnel-host":
+			l.TunnelHost = value
+		case "tunnel-path":
+			l.TunnelPath = value
+		case "jwk-path", "key-path":
+			l.JWKPath = value
+		case "environment":
+			l.EnvironmentID = value
+		case "tunnel-port", "tunnel-timeout":
+			number, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid --%s %q in %s", name, value, l.UnitPath)
+			}
+			if name == "tunnel-port" {
+				l.TunnelPort = number
+			} else {
+				l.TunnelTimeout = number
+			}
+		case "labels":
+			l.Labels = nil
+			for _, value := range values {
+				l.Labels = append(l.Labels, splitList(value)...)
+			}
+		default:
+			l.Ignored = append(l.Ignored, "--"+name)
+		}
+	}
+	return nil
+}
+
+// legacyConfig is the config file of the older releases
+type legacyConfig struct {
+	OrgID           string      `yaml:"orgId"`
+	HostID          string      `yaml:"hostId"`
+	TunnelHost      string      `yaml:"tunnelHost"`
+	TunnelPort      int         `yaml:"tunnelPort"`
+	TunnelPath      string      `yaml:"tunnelPath"`
+	TunnelTimeoutMs int         `yaml:"tunnelTimeoutMs"`
+	JWKPath         string      `yaml:"jwkPath"`
+	Environment     string      `yaml:"environment"`
+	EnvironmentID   string      `yaml:"environmentId"`
+	Labels          interface{} `yaml:"labels"`
+}
+
+func (l *Legacy) readConfig(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read legacy config %s: %w", path, err)
+	}
+
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("failed to parse legacy config %s: %w", path, err)
+	}
+	var cfg legacyConfig
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("failed to parse legacy config %s: %w", path, err)
+	}
+
+	known := map[string]bool{
+		"orgId": true, "hostId": true, "tunnelHost": true, "tunnelPort": true, "tunnelPath": true,
+		"tunnelTimeoutMs": true, "jwkPath": true, "environment": true, "environmentId": true, "labels": true,
+	}
+	for key := range raw {
+		if !known[key] {
+			l.Ignored = append(l.Ignored, key)
+		}
+	}
+
+	l.OrgID = cfg.OrgID
+	l.HostID = cfg.HostID
+	l.TunnelHost = cfg.TunnelHost
+	l.TunnelPort = cfg.TunnelPort
+	l.TunnelPath = cfg.TunnelPath
+	l.TunnelTimeout = cfg.TunnelTimeoutMs
+	l.JWKPath = cfg.JWKPath
+	l.EnvironmentID = cfg.EnvironmentID
+	if l.EnvironmentID == "" {
+		l.EnvironmentID = cfg.Environment
+	}
+
+	switch labels := cfg.Labels.(type) {
+	case string:
+		l.Labels = splitList(labels)
+	case []interface{}:
+		for _, label := range labels {
+			l.Labels = append(l.Labels, fmt.Sprint(label))
+		}
+	}
+	return nil
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Config converts the legacy settings to the current configuration. The
+// tunnel port and path are folded into the tunnel URL.
+func (l *Legacy) Config(keyPath, stateDir string) (*types.Config, error) {
+	if l.OrgID == "" || l.HostID == "" {
+		return nil, fmt.Errorf("legacy install at %s has no org ID or host ID; re-register with 'p0-ssh-agent register' instead", l.Dir)
+	}
+
+	config := types.DefaultConfig()
+	config.OrgID = l.OrgID
+	config.HostID = l.HostID
+	config.KeyPath = keyPath
+	config.StateDir = stateDir
+
+	tunnelHost := l.TunnelHost
+	if tunnelHost == "" {
+		tunnelHost = config.TunnelHost
+	}
+	tunnelURL, err := agentconfig.NormalizeTunnelHost(tunnelHost, l.TunnelPort, l.TunnelPath)
+	if err != nil {
+		return nil, fmt.Errorf("legacy tunnel settings: %w", err)
+	}
+	config.TunnelHost = tunnelURL
+
+	if l.TunnelTimeout > 0 {
+		config.TunnelTimeoutMs = l.TunnelTimeout
+	}
+	if l.EnvironmentID != "" {
+		config.EnvironmentId = l.EnvironmentID
+	}
+	if len(l.Labels) > 0 {
+		config.Labels = l.Labels
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("legacy settings produce an invalid configuration: %w", err)
+	}
+	return config, nil
+}
@@ -0,0 +1,285 @@
+package osplugins
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/internal/elevate"
+)
+
+// OpenRCInitDir holds OpenRC init scripts
+const OpenRCInitDir = "/etc/init.d"
+
+// AlpinePlugin supports Alpine Linux, which runs OpenRC instead of systemd
+// and ships busybox versions of adduser and deluser that take different flags
+// from the shadow-utils tools.
+type AlpinePlugin struct {
+	*LinuxPlugin
+	release OSRelease
+}
+
+// NewAlpinePlugin creates a new Alpine plugin instance
+func NewAlpinePlugin() *AlpinePlugin {
+	return &AlpinePlugin{
+		LinuxPlugin: NewLinuxPlugin(),
+		release:     ReadOSRelease(),
+	}
+}
+
+func (p *AlpinePlugin) GetName() string {
+	return "alpine"
+}
+
+// Detect checks for /etc/alpine-release, falling back to os-release
+func (p *AlpinePlugin) Detect() bool {
+	if _, err := os.Stat("/etc/alpine-release"); err == nil {
+		return true
+	}
+	return p.release.Is("alpine")
+}
+
+// CreateSystemdService installs an OpenRC init script in place of a systemd
+// unit. Like the unit it is not added to a runlevel or started.
+func (p *AlpinePlugin) CreateSystemdService(serviceName, executablePath, configPath, stateDir string, logger *logrus.Logger) error {
+	logger.Info("Creating OpenRC init script")
+
+	scriptPath := OpenRCScriptPath(serviceName)
+	if err := p.writeServiceFile(scriptPath, OpenRCScript(serviceName, executablePath, configPath, stateDir), logger); err != nil {
+		return fmt.Errorf("failed to write init script: %w", err)
+	}
+
+	// writeServiceFile leaves the file readable; init scripts must be executable
+	if err := elevate.Privileged().Chmod(scriptPath, 0755); err != nil {
+		return fmt.Errorf("failed to make %s executable: %w", scriptPath, err)
+	}
+
+	logger.Info("✅ OpenRC init script created successfully")
+	return nil
+}
+
+// OpenRCScriptPath returns the init script of serviceName
+func OpenRCScriptPath(serviceName string) string {
+	return OpenRCInitDir + "/" + serviceName
+}
+
+// OpenRCScript renders the agent's OpenRC init script. supervise-daemon
+// restarts the agent like Restart=always does under systemd; output goes to
+// /var/log/<service>.log as there is no journal.
+func OpenRCScript(serviceName, executablePath, configPath, stateDir string) string {
+	return fmt.Sprintf(`#!/sbin/openrc-run
+
+name="P0 SSH Agent"
+description="P0 SSH Agent - Secure SSH access management"
+
+supervisor="supervise-daemon"
+command="%s"
+command_args="start --config %s"
+directory="%s"
+output_log="/var/log/%s.log"
+error_log="/var/log/%s.log"
+
+respawn_delay=5
+respawn_max=10
+respawn_period=60
+
+extra_started_commands="reload"
+
+depend() {
+	need net
+	use dns logger
+	after firewall sshd
+}
+
+start_pre() {
+	# Agent state (grant records, journals) must stay writable
+	checkpath --directory --owner root:root --mode 0700 %s
+}
+
+reload() {
+	ebegin "Reloading ${RC_SVCNAME} configuration"
+	supervise-daemon "${RC_SVCNAME}" --signal HUP
+	eend $?
+}
+`, executablePath, configPath, filepath.Dir(configPath), serviceName, serviceName, stateDir)
+}
+
+// alpineShell returns bash when it is installed and busybox ash otherwise
+func alpineShell() string {
+	if _, err := os.Stat("/bin/bash"); err == nil {
+		return "/bin/bash"
+	}
+	return "/bin/ash"
+}
+
+// CreateUser creates a JIT account with busybox addgroup and adduser
+func (p *AlpinePlugin) CreateUser(ctx context.Context, username string, logger *logrus.Logger) error {
+	logger.WithField("user", username).Info("Creating JIT user")
+
+	if _, err := user.Lookup(username); err == nil {
+		logger.WithField("user", username).Info("✅ JIT user already exists")
+		return nil
+	}
+
+	uid, err := findNextAvailableUID()
+	if err != nil {
+		return fmt.Errorf("failed to find available UID: %w", err)
+	}
+	id := strconv.Itoa(uid)
+
+	logger.WithFields(logrus.Fields{
+		"username": username,
+		"uid":      uid,
+	}).Info("Creating new JIT user with UID")
+
+	if output, err := elevate.CombinedOutput(elevate.CommandContext(ctx, "addgroup", "-g", id, username)); err != nil {
+		return fmt.Errorf("failed to create group: %v (output: %s)", err, strings.TrimSpace(string(output)))
+	}
+
+	// -D creates the account without a password
+	output, err := elevate.CombinedOutput(elevate.CommandContext(ctx, "adduser", "-D", "-u", id, "-G", username, "-s", alpineShell(), "-h", "/home/"+username, username))
+	if err != nil {
+		elevate.CommandContext(ctx, "delgroup", username).Run()
+		return fmt.Errorf("failed to create user: %v (output: %s)", err, strings.TrimSpace(string(output)))
+	}
+
+	// adduser -D stores the password as "!", which sshd treats as a locked
+	// account and refuses even for key logins; "*" disables the password only
+	chpasswd := elevate.CommandContext(ctx, "chpasswd", "-e")
+	chpasswd.Stdin = strings.NewReader(username + ":*\n")
+	if output, err := elevate.CombinedOutput(chpasswd); err != nil {
+		return fmt.Errorf("failed to unlock %s for key logins: %v (output: %s)", username, err, strings.TrimSpace(string(output)))
+	}
+
+	logger.WithField("user", username).Info("✅ JIT user created successfully")
+	return nil
+}
+
+// RemoveUser removes a JIT account with busybox deluser and its group
+func (p *AlpinePlugin) RemoveUser(ctx context.Context, username string, logger *logrus.Logger) error {
+	logger.WithField("user", username).Info("Removing JIT user")
+
+	if _, err := user.Lookup(username); err != nil {
+		logger.WithField("user", username).Info("User does not exist, nothing to remove")
+		return nil
+	}
+
+	if output, err := elevate.CombinedOutput(elevate.CommandContext(ctx, "deluser", "--remove-home", username)); err != nil {
+		logger.WithError(err).WithField("output", string(output)).Error("Failed to remove JIT user")
+		return fmt.Errorf("failed to remove JIT user: %w", err)
+	}
+
+	// Older busybox releases keep the user's group
+	if _, err := user.LookupGroup(username); err == nil {
+		if err := elevate.CommandContext(ctx, "delgroup", username).Run(); err != nil {
+			logger.WithError(err).WithField("group", username).Warn("Failed to remove JIT user group")
+		}
+	}
+
+	logger.WithField("user", username).Info("✅ JIT user removed successfully")
+	return nil
+}
+
+func (p *AlpinePlugin) UninstallService(serviceName string, logger *logrus.Logger) error {
+	logger.WithField("service", serviceName).Info("Uninstalling OpenRC service")
+
+	if exec.Command("rc-service", serviceName, "status").Run() == nil {
+		logger.Info("Service is running, stopping...")
+		if err := elevate.Command("rc-service", serviceName, "stop").Run(); err != nil {
+			logger.WithError(err).Warn("Failed to stop service")
+		} else {
+			logger.Info("Service stopped")
+		}
+	}
+
+	if _, err := os.Stat("/etc/runlevels/default/" + serviceName); err == nil {
+		logger.Info("Service is enabled, removing it from the default runlevel...")
+		if err := elevate.Command("rc-update", "del", serviceName, "default").Run(); err != nil {
+			logger.WithError(err).Warn("Failed to remove service from runlevel")
+		} else {
+			logger.Info("Service disabled")
+		}
+	}
+
+	scriptPath := OpenRCScriptPath(serviceName)
+	if _, err := os.Stat(scriptPath); err == nil {
+		if err := elevate.Privileged().Remove(scriptPath); err != nil {
+			logger.WithError(err).Warn("Failed to remove init script")
+		} else {
+			logger.WithField("path", scriptPath).Info("Init script removed")
+		}
+	}
+
+	return nil
+}
+
+func (p *AlpinePlugin) CleanupInstallation(serviceName string, logger *logrus.Logger) error {
+	if err := p.LinuxPlugin.CleanupInstallation(serviceName, logger); err != nil {
+		return err
+	}
+
+	logPath := fmt.Sprintf("/var/log/%s.log", serviceName)
+	if _, err := os.Stat(logPath); err == nil {
+		if err := elevate.Privileged().Remove(logPath); err != nil {
+			logger.WithError(err).WithField("path", logPath).Warn("Failed to remove log file")
+		}
+	}
+	return nil
+}
+
+func (p *AlpinePlugin) DisplayInstallationSuccess(serviceName, configPath string, verbose bool) {
+	if verbose {
+		fmt.Println("\n📊 Installation Summary:")
+		fmt.Printf("   ✅ Service Name: %s\n", serviceName)
+		fmt.Printf("   ✅ Service User: root (for system operations)\n")
+		fmt.Printf("   ✅ Config Path: %s\n", configPath)
+		fmt.Printf("   ✅ OpenRC Service: %s (not started)\n", OpenRCScriptPath(serviceName))
+		fmt.Printf("   ✅ JWT Keys: Generated\n")
+	}
+
+	fmt.Println("\n🏔️ Alpine Installation Complete!")
+	fmt.Println("\nStart the service:")
+	fmt.Printf("  • Start service:     sudo rc-service %s start\n", serviceName)
+	fmt.Printf("  • Enable on boot:    sudo rc-update add %s default\n", serviceName)
+	fmt.Printf("  • Check status:      sudo rc-service %s status\n", serviceName)
+	fmt.Printf("  • Restart service:   sudo rc-service %s restart\n", serviceName)
+	fmt.Printf("  • Live logs:         sudo tail -f /var/log/%s.log\n", serviceName)
+}
+
+func (p *AlpinePlugin) DisplayUninstallationSuccess(hasErrors bool, errors []error) {
+	fmt.Println("\n" + strings.Repeat("=", 60))
+	if hasErrors {
+		fmt.Println("⚠️ Alpine Uninstallation Completed with Errors")
+	} else {
+		fmt.Println("✅ Alpine Uninstallation Completed Successfully")
+	}
+	fmt.Println(strings.Repeat("=", 60))
+
+	fmt.Println("\n📋 What was removed:")
+	fmt.Println("   🗑️ OpenRC service (/etc/init.d/p0-ssh-agent)")
+	fmt.Println("   🗑️ Configuration directory (/etc/p0-ssh-agent/)")
+	fmt.Println("   🗑️ Log file (/var/log/p0-ssh-agent.log)")
+	fmt.Println("   🗑️ State directory (/var/lib/p0-ssh-agent/)")
+	fmt.Println("   🗑️ System binary from install directories")
+
+	if hasErrors {
+		fmt.Println("\n❌ Errors encountered:")
+		for _, err := range errors {
+			fmt.Printf("   • %s\n", err.Error())
+		}
+		fmt.Println("\n💡 You may need to manually clean up remaining files")
+		fmt.Println("💡 Check: sudo rc-service p0-ssh-agent status")
+		fmt.Println("💡 Check: ls -la /etc/p0-ssh-agent/")
+	} else {
+		fmt.Println("\n🎉 P0 SSH Agent has been completely removed from your system")
+	}
+
+	fmt.Println("\n" + strings.Repeat("=", 60))
+}
@@ -0,0 +1,129 @@
+package osplugins
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/internal/elevate"
+)
+
+// ARMPlugin supports single-board computer distributions such as Raspberry Pi OS
+// and Armbian. It reuses the Linux plugin and adjusts for SBC quirks: no RTC
+// (the clock must be synced before JWTs are minted) and overlayfs root filesystems.
+type ARMPlugin struct {
+	*LinuxPlugin
+	release OSRelease
+}
+
+// NewARMPlugin creates a new ARM SBC plugin instance
+func NewARMPlugin() *ARMPlugin {
+	return &ARMPlugin{
+		LinuxPlugin: NewLinuxPlugin(),
+		release:     ReadOSRelease(),
+	}
+}
+
+func (p *ARMPlugin) GetName() string {
+	return "arm-sbc"
+}
+
+// Detect checks for an ARM CPU running a known SBC distribution
+func (p *ARMPlugin) Detect() bool {
+	if runtime.GOARCH != "arm" && runtime.GOARCH != "arm64" {
+		return false
+	}
+	return p.DistroFamily() != ""
+}
+
+// DistroFamily returns "raspberrypi", "armbian" or "" when neither is detected
+func (p *ARMPlugin) DistroFamily() string {
+	if p.release.Is("raspbian") {
+		return "raspberrypi"
+	}
+	if _, err := os.Stat("/etc/armbian-release"); err == nil {
+		return "armbian"
+	}
+	// 64-bit Raspberry Pi OS reports ID=debian; the device tree identifies the board
+	if model, err := os.ReadFile("/proc/device-tree/model"); err == nil && strings.Contains(string(model), "Raspberry Pi") {
+		return "raspberrypi"
+	}
+	return ""
+}
+
+func (p *ARMPlugin) GetInstallDirectories() []string {
+	return []string{
+		"/usr/local/bin", // Standard on Raspberry Pi OS and Armbian
+		"/opt/p0/bin",    // Custom location fallback
+		"/usr/bin",       // Fallback
+	}
+}
+
+func (p *ARMPlugin) CreateSystemdService(serviceName, executablePath, configPath, stateDir string, logger *logrus.Logger) error {
+	logger.WithField("family", p.DistroFamily()).Info("Creating systemd service file for ARM SBC")
+
+	serviceContent := SystemdUnit(serviceName, executablePath, configPath)
+
+	// SBCs have no RTC, so wait for time sync before authenticating with time-bound JWTs
+	serviceContent = strings.Replace(serviceContent,
+		"After=network-online.target\n",
+		"After=network-online.target time-sync.target\n", 1)
+
+	serviceFilePath := fmt.Sprintf("/etc/systemd/system/%s.service", serviceName)
+	if err := p.writeServiceFile(serviceFilePath, serviceContent, logger); err != nil {
+		return fmt.Errorf("failed to write service file: %w", err)
+	}
+
+	// time-sync.target is only reached when a wait-sync service is enabled
+	if err := elevate.Command("systemctl", "enable", "systemd-time-wait-sync.service").Run(); err != nil {
+		logger.WithError(err).Warn("Could not enable systemd-time-wait-sync; the agent may start before the clock is set")
+	}
+
+	cmd := elevate.Command("systemctl", "daemon-reload")
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to reload systemd: %w", err)
+	}
+
+	p.warnOverlayRoot(logger)
+
+	logger.Info("✅ Systemd service created successfully")
+	return nil
+}
+
+func (p *ARMPlugin) SetupDirectories(dirs []string, owner string, logger *logrus.Logger) error {
+	p.warnOverlayRoot(logger)
+	return p.LinuxPlugin.SetupDirectories(dirs, owner, logger)
+}
+
+func (p *ARMPlugin) DisplayInstallationSuccess(serviceName, configPath string, verbose bool) {
+	p.LinuxPlugin.DisplayInstallationSuccess(serviceName, configPath, verbose)
+
+	if overlay, ok := DetectOverlayRoot(); ok {
+		fmt.Println("\n⚠️  Overlay root filesystem detected")
+		fmt.Printf("   Changes were written to the writable layer (%s) and are lost on reboot.\n", overlayUpper(overlay))
+		fmt.Println("   Persist them by disabling the overlay (raspi-config / armbian-config),")
+		fmt.Println("   re-running the install, then re-enabling it.")
+	}
+}
+
+func (p *ARMPlugin) warnOverlayRoot(logger *logrus.Logger) {
+	overlay, ok := DetectOverlayRoot()
+	if !ok {
+		return
+	}
+
+	logger.WithFields(logrus.Fields{
+		"lower": overlay.LowerDir,
+		"upper": overlayUpper(overlay),
+	}).Warn("⚠️  Root filesystem is an overlay - files are written to the writable layer and will not survive a reboot")
+}
+
+func overlayUpper(overlay OverlayRoot) string {
+	if overlay.UpperDir == "" {
+		return "unknown"
+	}
+	return overlay.UpperDir
+}
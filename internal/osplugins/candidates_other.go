@@ -0,0 +1,14 @@
+//go:build !windows && !freebsd
+
+package osplugins
+
+// candidatePlugins lists plugins from most to least specific
+func candidatePlugins() []OSPlugin {
+	return []OSPlugin{
+		NewNixOSPlugin(),
+		NewARMPlugin(),
+		NewAlpinePlugin(),
+		NewRHELPlugin(),
+		NewLinuxPlugin(),
+	}
+}
@@ -0,0 +1,10 @@
+//go:build windows
+
+package osplugins
+
+// candidatePlugins lists plugins from most to least specific
+func candidatePlugins() []OSPlugin {
+	return []OSPlugin{
+		NewWindowsPlugin(),
+	}
+}
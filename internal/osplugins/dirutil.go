@@ -0,0 +1,32 @@
+package osplugins
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/internal/elevate"
+)
+
+// SetupStateDirectory creates the agent state directory owned by root and
+// readable only by root, since it holds grant records and journals
+func SetupStateDirectory(stateDir string, logger *logrus.Logger) error {
+	logger.WithField("dir", stateDir).Info("Creating state directory")
+
+	files := elevate.Privileged()
+	if err := files.MkdirAll(stateDir); err != nil {
+		return fmt.Errorf("failed to create state directory %s: %w", stateDir, err)
+	}
+
+	// Group 0 is root on Linux but wheel on FreeBSD
+	if err := files.Chown(stateDir, 0, 0); err != nil {
+		return fmt.Errorf("failed to set ownership for %s: %w", stateDir, err)
+	}
+
+	if err := files.Chmod(stateDir, 0700); err != nil {
+		return fmt.Errorf("failed to set permissions for %s: %w", stateDir, err)
+	}
+
+	logger.WithField("dir", stateDir).Info("✅ State directory created successfully")
+	return nil
+}
@@ -0,0 +1,376 @@
+//go:build freebsd
+
+package osplugins
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/internal/elevate"
+)
+
+// RCDir holds the rc.d scripts of installed software
+const RCDir = "/usr/local/etc/rc.d"
+
+// freebsdSkelDir holds the dot files copied into new home directories
+const freebsdSkelDir = "/usr/share/skel"
+
+// FreeBSDPlugin supports FreeBSD, which runs rc.d instead of systemd,
+// manages accounts with pw(8) and names the group of root wheel
+type FreeBSDPlugin struct {
+	*LinuxPlugin
+}
+
+// NewFreeBSDPlugin creates a new FreeBSD plugin instance
+func NewFreeBSDPlugin() *FreeBSDPlugin {
+	return &FreeBSDPlugin{
+		LinuxPlugin: NewLinuxPlugin(),
+	}
+}
+
+func (p *FreeBSDPlugin) GetName() string {
+	return "freebsd"
+}
+
+// Detect always returns true as the plugin is only built for FreeBSD
+func (p *FreeBSDPlugin) Detect() bool {
+	return true
+}
+
+// GetInstallDirectories follows hier(7): software that is not part of the
+// base system lives under /usr/local, daemons in sbin
+func (p *FreeBSDPlugin) GetInstallDirectories() []string {
+	return []string{
+		"/usr/local/sbin",
+		"/usr/local/bin",
+	}
+}
+
+// GetSudoersDir returns where the sudo port installs its configuration
+func (p *FreeBSDPlugin) GetSudoersDir() string {
+	return "/usr/local/etc"
+}
+
+// SSHKeygenPath is the base system's ssh-keygen
+func (p *FreeBSDPlugin) SSHKeygenPath() string {
+	return "/usr/bin/ssh-keygen"
+}
+
+// SSHDPath is the base system's sshd
+func (p *FreeBSDPlugin) SSHDPath() string {
+	return "/usr/sbin/sshd"
+}
+
+// ServiceStatus asks rc.d about a script installed under /usr/local/etc/rc.d
+func (p *FreeBSDPlugin) ServiceStatus(name string) ServiceStatus {
+	var status ServiceStatus
+
+	if _, err := os.Stat(RCScriptPath(name)); err != nil {
+		return status
+	}
+	status.Installed = true
+
+	// rc.conf variables cannot contain dashes
+	enable := strings.ReplaceAll(name, "-", "_") + "_enable"
+	if output, err := exec.Command("sysrc", "-n", enable).Output(); err == nil {
+		value := strings.ToLower(strings.TrimSpace(string(output)))
+		status.Enabled = value == "yes" || value == "true" || value == "on" || value == "1"
+	}
+	status.Active = exec.Command("service", name, "onestatus").Run() == nil
+	return status
+}
+
+// ShuttingDown is always false: rc.d stops services the same way at shutdown as on request
+func (p *FreeBSDPlugin) ShuttingDown() bool {
+	return false
+}
+
+// SupportsUserSlices is false, as resource limits use systemd
+func (p *FreeBSDPlugin) SupportsUserSlices() bool {
+	return false
+}
+
+// CreateSystemdService installs an rc.d script in place of a systemd unit.
+// Like the unit it is not enabled or started.
+func (p *FreeBSDPlugin) CreateSystemdService(serviceName, executablePath, configPath, stateDir string, logger *logrus.Logger) error {
+	logger.Info("Creating rc.d script")
+
+	if err := elevate.Privileged().MkdirAll(RCDir); err != nil {
+		return fmt.Errorf("failed to create %s: %w", RCDir, err)
+	}
+
+	scriptPath := RCScriptPath(serviceName)
+	if err := p.writeServiceFile(scriptPath, RCScript(serviceName, executablePath, configPath, stateDir), logger); err != nil {
+		return fmt.Errorf("failed to write rc.d script: %w", err)
+	}
+
+	// writeServiceFile leaves the file readable; rc.d scripts must be executable
+	if err := elevate.Privileged().Chmod(scriptPath, 0555); err != nil {
+		return fmt.Errorf("failed to make %s executable: %w", scriptPath, err)
+	}
+
+	logger.Info("✅ rc.d script created successfully")
+	return nil
+}
+
+// RCScriptPath returns the rc.d script of serviceName
+func RCScriptPath(serviceName string) string {
+	return RCDir + "/" + serviceName
+}
+
+// RCName is the name rc.subr knows serviceName by. It prefixes the
+// service's rc.conf variables, so it cannot contain dashes.
+func RCName(serviceName string) string {
+	return strings.ReplaceAll(serviceName, "-", "_")
+}
+
+// RCScript renders the agent's rc.d script. daemon(8) restarts the agent like
+// Restart=always does under systemd and writes its output to
+// /var/log/<service>.log; reload sends SIGHUP to the agent itself.
+func RCScript(serviceName, executablePath, configPath, stateDir string) string {
+	name := RCName(serviceName)
+
+	return fmt.Sprintf(`#!/bin/sh
+
+# PROVIDE: %[1]s
+# REQUIRE: LOGIN NETWORKING sshd
+# KEYWORD: shutdown
+
+. /etc/rc.subr
+
+name="%[1]s"
+rcvar="%[1]s_enable"
+desc="P0 SSH Agent - Secure SSH access management"
+
+load_rc_config $name
+
+: ${%[1]s_enable:="NO"}
+: ${%[1]s_config:="%[4]s"}
+
+pidfile="/var/run/%[2]s.pid"
+child_pidfile="/var/run/%[2]s.child.pid"
+command="/usr/sbin/daemon"
+command_args="-R 5 -P ${pidfile} -p ${child_pidfile} -t %[2]s -o /var/log/%[2]s.log %[3]s start --config ${%[1]s_config}"
+
+extra_commands="reload"
+start_precmd="%[1]s_prestart"
+reload_cmd="%[1]s_reload"
+
+%[1]s_prestart()
+{
+	# Agent state (grant records, journals) must stay writable
+	install -d -o root -g wheel -m 0700 %[5]s
+}
+
+%[1]s_reload()
+{
+	if [ ! -f "${child_pidfile}" ]; then
+		echo "${name} is not running."
+		return 1
+	fi
+	kill -HUP $(cat "${child_pidfile}")
+}
+
+run_rc_command "$1"
+`, name, serviceName, executablePath, configPath, stateDir)
+}
+
+// freebsdShell returns bash from ports when it is installed and sh otherwise
+func freebsdShell() string {
+	if _, err := os.Stat("/usr/local/bin/bash"); err == nil {
+		return "/usr/local/bin/bash"
+	}
+	return "/bin/sh"
+}
+
+// CreateUser creates a JIT account with pw, populating its home directory
+// from /usr/share/skel (pw turns the skeleton's dot.* files into .*)
+func (p *FreeBSDPlugin) CreateUser(ctx context.Context, username string, logger *logrus.Logger) error {
+	logger.WithField("user", username).Info("Creating JIT user")
+
+	if _, err := user.Lookup(username); err == nil {
+		logger.WithField("user", username).Info("✅ JIT user already exists")
+		return nil
+	}
+
+	uid, err := findNextAvailableUID()
+	if err != nil {
+		return fmt.Errorf("failed to find available UID: %w", err)
+	}
+	id := strconv.Itoa(uid)
+
+	logger.WithFields(logrus.Fields{
+		"username": username,
+		"uid":      uid,
+	}).Info("Creating new JIT user with UID")
+
+	if output, err := elevate.CombinedOutput(elevate.CommandContext(ctx, "pw", "groupadd", "-n", username, "-g", id)); err != nil {
+		return fmt.Errorf("failed to create group: %v (output: %s)", err, strings.TrimSpace(string(output)))
+	}
+
+	// -h - sets the password to "*": password logins are refused, key logins
+	// are not, unlike a *LOCKED* account
+	output, err := elevate.CombinedOutput(elevate.CommandContext(ctx, "pw", "useradd", "-n", username, "-u", id, "-g", username,
+		"-d", "/home/"+username, "-m", "-k", freebsdSkelDir, "-s", freebsdShell(), "-h", "-"))
+	if err != nil {
+		elevate.CommandContext(ctx, "pw", "groupdel", "-n", username).Run()
+		return fmt.Errorf("failed to create user: %v (output: %s)", err, strings.TrimSpace(string(output)))
+	}
+
+	logger.WithField("user", username).Info("✅ JIT user created successfully")
+	return nil
+}
+
+// RemoveUser removes a JIT account, its home directory and its group
+func (p *FreeBSDPlugin) RemoveUser(ctx context.Context, username string, logger *logrus.Logger) error {
+	logger.WithField("user", username).Info("Removing JIT user")
+
+	if _, err := user.Lookup(username); err != nil {
+		logger.WithField("user", username).Info("User does not exist, nothing to remove")
+		return nil
+	}
+
+	if output, err := elevate.CombinedOutput(elevate.CommandContext(ctx, "pw", "userdel", "-n", username, "-r")); err != nil {
+		logger.WithError(err).WithField("output", string(output)).Error("Failed to remove JIT user")
+		return fmt.Errorf("failed to remove JIT user: %w", err)
+	}
+
+	// pw userdel keeps the group when another account is a member of it
+	if _, err := user.LookupGroup(username); err == nil {
+		if err := elevate.CommandContext(ctx, "pw", "groupdel", "-n", username).Run(); err != nil {
+			logger.WithError(err).WithField("group", username).Warn("Failed to remove JIT user group")
+		}
+	}
+
+	logger.WithField("user", username).Info("✅ JIT user removed successfully")
+	return nil
+}
+
+func (p *FreeBSDPlugin) UninstallService(serviceName string, logger *logrus.Logger) error {
+	logger.WithField("service", serviceName).Info("Uninstalling rc.d service")
+
+	scriptPath := RCScriptPath(serviceName)
+	if _, err := os.Stat(scriptPath); err == nil {
+		// onestatus and onestop work whether or not the service is enabled
+		if exec.Command("service", serviceName, "onestatus").Run() == nil {
+			logger.Info("Service is running, stopping...")
+			if err := elevate.Command("service", serviceName, "onestop").Run(); err != nil {
+				logger.WithError(err).Warn("Failed to stop service")
+			} else {
+				logger.Info("Service stopped")
+			}
+		}
+	}
+
+	enable := RCName(serviceName) + "_enable"
+	if output, err := exec.Command("sysrc", "-n", enable).Output(); err == nil && strings.TrimSpace(string(output)) != "" {
+		logger.Info("Removing service from rc.conf...")
+		if err := elevate.Command("sysrc", "-x", enable).Run(); err != nil {
+			logger.WithError(err).Warn("Failed to remove service from rc.conf")
+		} else {
+			logger.Info("Service disabled")
+		}
+	}
+
+	if _, err := os.Stat(scriptPath); err == nil {
+		if err := elevate.Privileged().Remove(scriptPath); err != nil {
+			logger.WithError(err).Warn("Failed to remove rc.d script")
+		} else {
+			logger.WithField("path", scriptPath).Info("rc.d script removed")
+		}
+	}
+
+	return nil
+}
+
+func (p *FreeBSDPlugin) CleanupInstallation(serviceName string, logger *logrus.Logger) error {
+	logger.Info("Performing FreeBSD-specific cleanup")
+
+	paths := []string{
+		"/etc/p0-ssh-agent",
+		"/var/lib/p0-ssh-agent",
+		fmt.Sprintf("/var/log/%s.log", serviceName),
+		fmt.Sprintf("/var/run/%s.pid", serviceName),
+		fmt.Sprintf("/var/run/%s.child.pid", serviceName),
+	}
+	for _, path := range paths {
+		if _, err := os.Stat(path); err == nil {
+			if err := elevate.Privileged().RemoveAll(path); err != nil {
+				logger.WithError(err).WithField("path", path).Warn("Failed to remove path")
+			} else {
+				logger.WithField("path", path).Info("Path removed")
+			}
+		}
+	}
+
+	for _, dir := range p.GetInstallDirectories() {
+		binaryPath := dir + "/p0-ssh-agent"
+		if _, err := os.Stat(binaryPath); err == nil {
+			if err := elevate.Privileged().Remove(binaryPath); err != nil {
+				logger.WithError(err).WithField("path", binaryPath).Warn("Failed to remove binary")
+			} else {
+				logger.WithField("path", binaryPath).Info("Binary removed")
+			}
+			break // Only remove from the first directory where it's found
+		}
+	}
+
+	return nil
+}
+
+func (p *FreeBSDPlugin) DisplayInstallationSuccess(serviceName, configPath string, verbose bool) {
+	if verbose {
+		fmt.Println("\n📊 Installation Summary:")
+		fmt.Printf("   ✅ Service Name: %s\n", serviceName)
+		fmt.Printf("   ✅ Service User: root (for system operations)\n")
+		fmt.Printf("   ✅ Config Path: %s\n", configPath)
+		fmt.Printf("   ✅ rc.d Service: %s (not enabled)\n", RCScriptPath(serviceName))
+		fmt.Printf("   ✅ JWT Keys: Generated\n")
+	}
+
+	fmt.Println("\n😈 FreeBSD Installation Complete!")
+	fmt.Println("\nStart the service:")
+	fmt.Printf("  • Enable on boot:    sudo sysrc %s_enable=YES\n", RCName(serviceName))
+	fmt.Printf("  • Start service:     sudo service %s start\n", serviceName)
+	fmt.Printf("  • Check status:      sudo service %s status\n", serviceName)
+	fmt.Printf("  • Restart service:   sudo service %s restart\n", serviceName)
+	fmt.Printf("  • Live logs:         sudo tail -f /var/log/%s.log\n", serviceName)
+}
+
+func (p *FreeBSDPlugin) DisplayUninstallationSuccess(hasErrors bool, errors []error) {
+	fmt.Println("\n" + strings.Repeat("=", 60))
+	if hasErrors {
+		fmt.Println("⚠️ FreeBSD Uninstallation Completed with Errors")
+	} else {
+		fmt.Println("✅ FreeBSD Uninstallation Completed Successfully")
+	}
+	fmt.Println(strings.Repeat("=", 60))
+
+	fmt.Println("\n📋 What was removed:")
+	fmt.Println("   🗑️ rc.d service (/usr/local/etc/rc.d/p0-ssh-agent)")
+	fmt.Println("   🗑️ Configuration directory (/etc/p0-ssh-agent/)")
+	fmt.Println("   🗑️ Log file (/var/log/p0-ssh-agent.log)")
+	fmt.Println("   🗑️ State directory (/var/lib/p0-ssh-agent/)")
+	fmt.Println("   🗑️ System binary from install directories")
+
+	if hasErrors {
+		fmt.Println("\n❌ Errors encountered:")
+		for _, err := range errors {
+			fmt.Printf("   • %s\n", err.Error())
+		}
+		fmt.Println("\n💡 You may need to manually clean up remaining files")
+		fmt.Println("💡 Check: sudo service p0-ssh-agent onestatus")
+		fmt.Println("💡 Check: ls -la /etc/p0-ssh-agent/")
+	} else {
+		fmt.Println("\n🎉 P0 SSH Agent has been completely removed from your system")
+	}
+
+	fmt.Println("\n" + strings.Repeat("=", 60))
+}
@@ -1,6 +1,8 @@
 package osplugins
 
 import (
+	"context"
+
 	"github.com/sirupsen/logrus"
 )
 
@@ -15,17 +17,62 @@ type OSPlugin interface {
 	// GetInstallDirectories returns prioritized list of binary installation directories
 	GetInstallDirectories() []string
 
-	// CreateSystemdService handles systemd service creation for this OS
-	CreateSystemdService(serviceName, executablePath, configPath string, logger *logrus.Logger) error
+	// GetSudoersDir returns the directory holding sudoers and sudoers.d
+	GetSudoersDir() string
+
+	// SSHHostKeyPaths lists the host public keys in order of preference
+	SSHHostKeyPaths() []string
+
+	// SSHKeygenPath is the ssh-keygen binary used when a key cannot be parsed natively
+	SSHKeygenPath() string
+
+	// SSHDPath is the sshd binary, which is often not on the PATH of the
+	// agent or of sudo
+	SSHDPath() string
+
+	// ServiceStatus reports whether a service is installed, enabled and running
+	ServiceStatus(name string) ServiceStatus
+
+	// ShuttingDown reports whether the host is powering off or rebooting,
+	// where the OS can tell
+	ShuttingDown() bool
+
+	// AuthorizedKeysFiles lists the files sshd reads the keys of the user
+	// with homeDir from where the OS fixes them, as Windows does for
+	// administrators. Nil means sshd_config decides.
+	AuthorizedKeysFiles(homeDir string) []string
+
+	// GrantAuthorizedKeysFile picks the file of AuthorizedKeysFiles a key
+	// granted to username is written to
+	GrantAuthorizedKeysFile(ctx context.Context, username, homeDir string) (string, error)
+
+	// RestrictAuthorizedKeysFile sets the permissions sshd requires on the
+	// file GrantAuthorizedKeysFile picked for username
+	RestrictAuthorizedKeysFile(ctx context.Context, path, username string) error
+
+	// SupportsUserSlices reports whether resource limits can be set on
+	// systemd user slices
+	SupportsUserSlices() bool
+
+	// SupportsSessionRecording reports whether sessions can be forced
+	// through the session recorder
+	SupportsSessionRecording() bool
+
+	// CreateSystemdService handles systemd service creation for this OS.
+	// stateDir is declared where the OS creates it with the service.
+	CreateSystemdService(serviceName, executablePath, configPath, stateDir string, logger *logrus.Logger) error
 
 	// SetupDirectories creates and configures necessary directories
 	SetupDirectories(dirs []string, owner string, logger *logrus.Logger) error
 
+	// SetupStateDirectory creates the writable agent state directory
+	SetupStateDirectory(stateDir string, logger *logrus.Logger) error
+
 	// CreateUser creates a user dynamically for JIT access (used by P0 scripts)
-	CreateUser(username string, logger *logrus.Logger) error
+	CreateUser(ctx context.Context, username string, logger *logrus.Logger) error
 
 	// RemoveUser removes a dynamically created user (cleanup)
-	RemoveUser(username string, logger *logrus.Logger) error
+	RemoveUser(ctx context.Context, username string, logger *logrus.Logger) error
 
 	// UninstallService handles OS-specific service uninstallation
 	UninstallService(serviceName string, logger *logrus.Logger) error
@@ -40,6 +87,13 @@ type OSPlugin interface {
 	DisplayUninstallationSuccess(hasErrors bool, errors []error)
 }
 
+// ServiceStatus is the state of a system service
+type ServiceStatus struct {
+	Installed bool
+	Enabled   bool
+	Active    bool
+}
+
 // InstallConfig contains parameters needed for installation
 type InstallConfig struct {
 	ServiceName    string
@@ -47,5 +101,8 @@ type InstallConfig struct {
 	ConfigPath     string
 	KeyPath        string
 	LogPath        string
+	StateDir       string
+	WritableDir    string
 	AllowRoot      bool
+	BundlePath     string
 }
@@ -1,6 +1,7 @@
 package osplugins
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/exec"
@@ -8,6 +9,8 @@ import (
 	"strings"
 
 	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/internal/elevate"
 )
 
 type LinuxPlugin struct{}
@@ -38,17 +41,99 @@ func (p *LinuxPlugin) GetInstallDirectories() []string {
 	}
 }
 
-func (p *LinuxPlugin) CreateSystemdService(serviceName, executablePath, configPath string, logger *logrus.Logger) error {
+func (p *LinuxPlugin) GetSudoersDir() string {
+	return "/etc"
+}
+
+// openSSHHostKeyPaths are the host keys of OpenSSH's default layout
+var openSSHHostKeyPaths = []string{
+	"/etc/ssh/ssh_host_ed25519_key.pub",
+	"/etc/ssh/ssh_host_rsa_key.pub",
+	"/etc/ssh/ssh_host_ecdsa_key.pub",
+}
+
+func (p *LinuxPlugin) SSHHostKeyPaths() []string {
+	return openSSHHostKeyPaths
+}
+
+func (p *LinuxPlugin) SSHKeygenPath() string {
+	return "ssh-keygen"
+}
+
+// sshdPaths are where distributions install sshd
+var sshdPaths = []string{"/usr/sbin/sshd", "/usr/bin/sshd", "/sbin/sshd", "/usr/local/sbin/sshd"}
+
+func (p *LinuxPlugin) SSHDPath() string {
+	for _, path := range sshdPaths {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return "sshd"
+}
+
+// ServiceStatus asks systemd, or OpenRC where the service was installed as
+// an init script, as on Alpine
+func (p *LinuxPlugin) ServiceStatus(name string) ServiceStatus {
+	var status ServiceStatus
+
+	if _, err := os.Stat("/sbin/openrc-run"); err == nil {
+		if _, err := os.Stat(OpenRCScriptPath(name)); err == nil {
+			status.Installed = true
+			_, err := os.Stat("/etc/runlevels/default/" + name)
+			status.Enabled = err == nil
+			status.Active = exec.Command("rc-service", name, "status").Run() == nil
+			return status
+		}
+	}
+
+	if _, err := os.Stat(fmt.Sprintf("/etc/systemd/system/%s.service", name)); err == nil {
+		status.Installed = true
+	}
+	status.Enabled = exec.Command("systemctl", "is-enabled", name).Run() == nil
+	status.Active = exec.Command("systemctl", "is-active", name).Run() == nil
+	return status
+}
+
+// ShuttingDown asks systemd, which reports "stopping" (with a non-zero exit
+// status) while the system goes down
+func (p *LinuxPlugin) ShuttingDown() bool {
+	output, _ := exec.Command("systemctl", "is-system-running").Output()
+	return strings.TrimSpace(string(output)) == "stopping"
+}
+
+// AuthorizedKeysFiles is nil, as sshd_config decides
+func (p *LinuxPlugin) AuthorizedKeysFiles(homeDir string) []string {
+	return nil
+}
+
+func (p *LinuxPlugin) GrantAuthorizedKeysFile(ctx context.Context, username, homeDir string) (string, error) {
+	return "", fmt.Errorf("authorized keys files are set in sshd_config on %s", p.GetName())
+}
+
+func (p *LinuxPlugin) RestrictAuthorizedKeysFile(ctx context.Context, path, username string) error {
+	return nil
+}
+
+func (p *LinuxPlugin) SupportsUserSlices() bool {
+	return true
+}
+
+func (p *LinuxPlugin) SupportsSessionRecording() bool {
+	return true
+}
+
+func (p *LinuxPlugin) CreateSystemdService(serviceName, executablePath, configPath, stateDir string, logger *logrus.Logger) error {
 	logger.Info("Creating systemd service file")
 
-	serviceContent := p.generateSystemdService(serviceName, executablePath, configPath)
+	serviceContent := SystemdUnit(serviceName, executablePath, configPath)
 	serviceFilePath := fmt.Sprintf("/etc/systemd/system/%s.service", serviceName)
 
 	if err := p.writeServiceFile(serviceFilePath, serviceContent, logger); err != nil {
 		return fmt.Errorf("failed to write service file: %w", err)
 	}
 
-	cmd := exec.Command("sudo", "systemctl", "daemon-reload")
+	cmd := elevate.Command("systemctl", "daemon-reload")
 	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("failed to reload systemd: %w", err)
 	}
@@ -62,6 +147,7 @@ func (p *LinuxPlugin) GetConfigDirectory() string {
 }
 
 func (p *LinuxPlugin) SetupDirectories(dirs []string, owner string, logger *logrus.Logger) error {
+	files := elevate.Privileged()
 	for _, dir := range dirs {
 		if dir == "" {
 			continue
@@ -69,18 +155,15 @@ func (p *LinuxPlugin) SetupDirectories(dirs []string, owner string, logger *logr
 
 		logger.WithField("dir", dir).Info("Creating directory")
 
-		cmd := exec.Command("sudo", "mkdir", "-p", dir)
-		if err := cmd.Run(); err != nil {
+		if err := files.MkdirAll(dir); err != nil {
 			return fmt.Errorf("failed to create directory %s: %w", dir, err)
 		}
 
-		cmd = exec.Command("sudo", "chown", "-R", "root:root", dir)
-		if err := cmd.Run(); err != nil {
+		if err := files.ChownAll(dir, 0, 0); err != nil {
 			return fmt.Errorf("failed to set ownership for %s: %w", dir, err)
 		}
 
-		cmd = exec.Command("sudo", "chmod", "755", dir)
-		if err := cmd.Run(); err != nil {
+		if err := files.Chmod(dir, 0755); err != nil {
 			return fmt.Errorf("failed to set permissions for %s: %w", dir, err)
 		}
 
@@ -90,7 +173,13 @@ func (p *LinuxPlugin) SetupDirectories(dirs []string, owner string, logger *logr
 	return nil
 }
 
-func (p *LinuxPlugin) generateSystemdService(serviceName, executablePath, configPath string) string {
+func (p *LinuxPlugin) SetupStateDirectory(stateDir string, logger *logrus.Logger) error {
+	return SetupStateDirectory(stateDir, logger)
+}
+
+// SystemdUnit renders the agent's service unit. install writes it to
+// /etc/systemd/system; the deb and rpm packages ship the same unit.
+func SystemdUnit(serviceName, executablePath, configPath string) string {
 	workingDir := filepath.Dir(configPath)
 
 	return fmt.Sprintf(`[Unit]
@@ -140,13 +229,12 @@ func (p *LinuxPlugin) writeServiceFile(filePath, content string, logger *logrus.
 		return fmt.Errorf("failed to write temporary file: %w", err)
 	}
 
-	cmd := exec.Command("sudo", "mv", tempFile, filePath)
-	if err := cmd.Run(); err != nil {
+	files := elevate.Privileged()
+	if err := files.Rename(tempFile, filePath); err != nil {
 		return fmt.Errorf("failed to move service file: %w", err)
 	}
 
-	cmd = exec.Command("sudo", "chmod", "644", filePath)
-	if err := cmd.Run(); err != nil {
+	if err := files.Chmod(filePath, 0644); err != nil {
 		logger.WithError(err).Warn("Failed to set service file permissions")
 	}
 
@@ -154,14 +242,14 @@ func (p *LinuxPlugin) writeServiceFile(filePath, content string, logger *logrus.
 	return nil
 }
 
-func (p *LinuxPlugin) CreateUser(username string, logger *logrus.Logger) error {
+func (p *LinuxPlugin) CreateUser(ctx context.Context, username string, logger *logrus.Logger) error {
 	// Use utility function with standard Linux shell path
-	return CreateUser(username, "/bin/bash", logger)
+	return CreateUser(ctx, username, "/bin/bash", logger)
 }
 
-func (p *LinuxPlugin) RemoveUser(username string, logger *logrus.Logger) error {
+func (p *LinuxPlugin) RemoveUser(ctx context.Context, username string, logger *logrus.Logger) error {
 	// Use utility function
-	return RemoveUser(username, logger)
+	return RemoveUser(ctx, username, logger)
 }
 
 func (p *LinuxPlugin) UninstallService(serviceName string, logger *logrus.Logger) error {
@@ -171,7 +259,7 @@ func (p *LinuxPlugin) UninstallService(serviceName string, logger *logrus.Logger
 	cmd := exec.Command("systemctl", "is-active", serviceName)
 	if err := cmd.Run(); err == nil {
 		logger.Info("Service is running, stopping...")
-		cmd = exec.Command("sudo", "systemctl", "stop", serviceName)
+		cmd = elevate.Command("systemctl", "stop", serviceName)
 		if err := cmd.Run(); err != nil {
 			logger.WithError(err).Warn("Failed to stop service")
 		} else {
@@ -183,7 +271,7 @@ func (p *LinuxPlugin) UninstallService(serviceName string, logger *logrus.Logger
 	cmd = exec.Command("systemctl", "is-enabled", serviceName)
 	if err := cmd.Run(); err == nil {
 		logger.Info("Service is enabled, disabling...")
-		cmd = exec.Command("sudo", "systemctl", "disable", serviceName)
+		cmd = elevate.Command("systemctl", "disable", serviceName)
 		if err := cmd.Run(); err != nil {
 			logger.WithError(err).Warn("Failed to disable service")
 		} else {
@@ -194,8 +282,7 @@ func (p *LinuxPlugin) UninstallService(serviceName string, logger *logrus.Logger
 	// Remove service file
 	serviceFilePath := fmt.Sprintf("/etc/systemd/system/%s.service", serviceName)
 	if _, err := os.Stat(serviceFilePath); err == nil {
-		cmd = exec.Command("sudo", "rm", "-f", serviceFilePath)
-		if err := cmd.Run(); err != nil {
+		if err := elevate.Privileged().Remove(serviceFilePath); err != nil {
 			logger.WithError(err).Warn("Failed to remove service file")
 		} else {
 			logger.WithField("path", serviceFilePath).Info("Service file removed")
@@ -203,7 +290,7 @@ func (p *LinuxPlugin) UninstallService(serviceName string, logger *logrus.Logger
 	}
 
 	// Reload systemd daemon
-	cmd = exec.Command("sudo", "systemctl", "daemon-reload")
+	cmd = elevate.Command("systemctl", "daemon-reload")
 	if err := cmd.Run(); err != nil {
 		logger.WithError(err).Warn("Failed to reload systemd daemon")
 	} else {
@@ -220,12 +307,12 @@ func (p *LinuxPlugin) CleanupInstallation(serviceName string, logger *logrus.Log
 	dirs := []string{
 		"/etc/p0-ssh-agent",
 		"/var/log/p0-ssh-agent",
+		"/var/lib/p0-ssh-agent",
 	}
 
 	for _, dir := range dirs {
 		if _, err := os.Stat(dir); err == nil {
-			cmd := exec.Command("sudo", "rm", "-rf", dir)
-			if err := cmd.Run(); err != nil {
+			if err := elevate.Privileged().RemoveAll(dir); err != nil {
 				logger.WithError(err).WithField("dir", dir).Warn("Failed to remove directory")
 			} else {
 				logger.WithField("dir", dir).Info("Directory removed")
@@ -238,8 +325,7 @@ func (p *LinuxPlugin) CleanupInstallation(serviceName string, logger *logrus.Log
 	for _, dir := range installDirs {
 		binaryPath := fmt.Sprintf("%s/p0-ssh-agent", dir)
 		if _, err := os.Stat(binaryPath); err == nil {
-			cmd := exec.Command("sudo", "rm", "-f", binaryPath)
-			if err := cmd.Run(); err != nil {
+			if err := elevate.Privileged().Remove(binaryPath); err != nil {
 				logger.WithError(err).WithField("path", binaryPath).Warn("Failed to remove binary")
 			} else {
 				logger.WithField("path", binaryPath).Info("Binary removed")
@@ -284,6 +370,7 @@ func (p *LinuxPlugin) DisplayUninstallationSuccess(hasErrors bool, errors []erro
 	fmt.Println("   🗑️ Systemd service (p0-ssh-agent)")
 	fmt.Println("   🗑️ Configuration directory (/etc/p0-ssh-agent/)")
 	fmt.Println("   🗑️ Log directory (/var/log/p0-ssh-agent/)")
+	fmt.Println("   🗑️ State directory (/var/lib/p0-ssh-agent/)")
 	fmt.Println("   🗑️ System binary from install directories")
 	fmt.Println("   🗑️ Service files and permissions")
 
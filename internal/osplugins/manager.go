@@ -2,17 +2,72 @@ package osplugins
 
 import (
 	"fmt"
+	"io"
+	"strings"
 	"sync"
 
 	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/types"
 )
 
 var (
 	registry = make(map[string]OSPlugin)
 	mutex    sync.RWMutex
 	loaded   = false
+	override string
 )
 
+func init() {
+	types.SetOSPluginNames(Names)
+}
+
+// Candidate is a plugin that can run on this OS and whether it detected the host
+type Candidate struct {
+	Name     string
+	Detected bool
+}
+
+// SetOverride forces the plugin named name instead of auto-detection. The
+// agent sets it from osPlugin; empty restores auto-detection. Changing it
+// drops the plugin selected so far.
+func SetOverride(name string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if name == override {
+		return
+	}
+	override = name
+	registry = make(map[string]OSPlugin)
+	loaded = false
+}
+
+// Override returns the plugin name set with SetOverride
+func Override() string {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return override
+}
+
+// Candidates runs detection for every plugin available on this OS, in the
+// order auto-detection checks them
+func Candidates() []Candidate {
+	var candidates []Candidate
+	for _, plugin := range candidatePlugins() {
+		candidates = append(candidates, Candidate{Name: plugin.GetName(), Detected: plugin.Detect()})
+	}
+	return candidates
+}
+
+// Names lists the plugins available on this OS, which osPlugin may name
+func Names() []string {
+	var names []string
+	for _, plugin := range candidatePlugins() {
+		names = append(names, plugin.GetName())
+	}
+	return names
+}
+
 // Register adds an OS plugin to the registry
 func Register(plugin OSPlugin) {
 	mutex.Lock()
@@ -29,18 +84,25 @@ func LoadPlugins(logger *logrus.Logger) error {
 		return nil // Already loaded
 	}
 
-	// Create plugins for detection
-	nixosPlugin := NewNixOSPlugin()
-	linuxPlugin := NewLinuxPlugin()
-
-	// Register NixOS plugin if detected
-	if nixosPlugin.Detect() {
-		logger.Info("Detected NixOS system, registering NixOS plugin")
-		registry[nixosPlugin.GetName()] = nixosPlugin
-	} else {
-		// Fallback to Linux plugin
-		logger.Info("Using Linux plugin as fallback")
-		registry[linuxPlugin.GetName()] = linuxPlugin
+	if override != "" {
+		for _, plugin := range candidatePlugins() {
+			if plugin.GetName() == override {
+				logger.WithField("plugin", override).Info("Using OS plugin set by osPlugin")
+				registry[override] = plugin
+				loaded = true
+				return nil
+			}
+		}
+		return fmt.Errorf("unknown OS plugin %q, available on this system: %s", override, strings.Join(Names(), ", "))
+	}
+
+	// Candidates are checked in order; the generic plugin for the OS always matches last
+	for _, plugin := range candidatePlugins() {
+		if plugin.Detect() {
+			logger.WithField("plugin", plugin.GetName()).Info("Detected OS plugin")
+			registry[plugin.GetName()] = plugin
+			break
+		}
 	}
 
 	loaded = true
@@ -73,6 +135,31 @@ func GetPlugin(logger *logrus.Logger) (OSPlugin, error) {
 	return nil, fmt.Errorf("no OS plugins found in registry")
 }
 
+// Selected returns the plugin for this host without logging the selection,
+// for the many callers that only ask it about the host. When none can be
+// selected, such as with an osPlugin unknown to this OS, it returns the
+// generic plugin of the OS, which auto-detection always falls back to.
+func Selected() OSPlugin {
+	quiet := logrus.New()
+	quiet.SetOutput(io.Discard)
+	if err := LoadPlugins(quiet); err == nil {
+		mutex.RLock()
+		defer mutex.RUnlock()
+		for _, plugin := range registry {
+			return plugin
+		}
+	}
+
+	candidates := candidatePlugins()
+	return candidates[len(candidates)-1]
+}
+
+// SudoersDir returns the sudoers directory of the plugin for this host.
+// Every sudo grant asks.
+func SudoersDir() string {
+	return Selected().GetSudoersDir()
+}
+
 // ListPlugins returns all registered plugins
 func ListPlugins() []string {
 	mutex.RLock()
@@ -1,6 +1,7 @@
 package osplugins
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/exec"
@@ -8,6 +9,8 @@ import (
 	"strings"
 
 	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/internal/elevate"
 )
 
 type NixOSPlugin struct{}
@@ -40,12 +43,7 @@ func (p *NixOSPlugin) Detect() bool {
 		return true
 	}
 	// Check for nixos in os-release
-	if content, err := os.ReadFile("/etc/os-release"); err == nil {
-		if strings.Contains(strings.ToLower(string(content)), "nixos") {
-			return true
-		}
-	}
-	return false
+	return ReadOSRelease().Is("nixos")
 }
 
 func (p *NixOSPlugin) GetInstallDirectories() []string {
@@ -55,9 +53,62 @@ func (p *NixOSPlugin) GetInstallDirectories() []string {
 	}
 }
 
-func (p *NixOSPlugin) CreateSystemdService(serviceName, executablePath, configPath string, logger *logrus.Logger) error {
+func (p *NixOSPlugin) GetSudoersDir() string {
+	return "/etc"
+}
+
+func (p *NixOSPlugin) SSHHostKeyPaths() []string {
+	return openSSHHostKeyPaths
+}
+
+func (p *NixOSPlugin) SSHKeygenPath() string {
+	return "ssh-keygen"
+}
+
+// SSHDPath is sshd of the current system profile
+func (p *NixOSPlugin) SSHDPath() string {
+	if _, err := os.Stat("/run/current-system/sw/bin/sshd"); err == nil {
+		return "/run/current-system/sw/bin/sshd"
+	}
+	return "sshd"
+}
+
+// ServiceStatus asks systemd, as on other distributions
+func (p *NixOSPlugin) ServiceStatus(name string) ServiceStatus {
+	return NewLinuxPlugin().ServiceStatus(name)
+}
+
+func (p *NixOSPlugin) ShuttingDown() bool {
+	return NewLinuxPlugin().ShuttingDown()
+}
+
+func (p *NixOSPlugin) AuthorizedKeysFiles(homeDir string) []string {
+	return nil
+}
+
+func (p *NixOSPlugin) GrantAuthorizedKeysFile(ctx context.Context, username, homeDir string) (string, error) {
+	return "", fmt.Errorf("authorized keys files are set in sshd_config on %s", p.GetName())
+}
+
+func (p *NixOSPlugin) RestrictAuthorizedKeysFile(ctx context.Context, path, username string) error {
+	return nil
+}
+
+func (p *NixOSPlugin) SupportsUserSlices() bool {
+	return true
+}
+
+func (p *NixOSPlugin) SupportsSessionRecording() bool {
+	return true
+}
+
+func (p *NixOSPlugin) CreateSystemdService(serviceName, executablePath, configPath, stateDir string, logger *logrus.Logger) error {
 	logger.Info("🐧 NixOS detected - generating configuration snippet instead of direct service creation")
-	return p.generateNixOSServiceConfig(serviceName, executablePath, configPath, logger)
+	return p.generateNixOSServiceConfig(serviceName, executablePath, configPath, stateDir, logger)
+}
+
+func (p *NixOSPlugin) SetupStateDirectory(stateDir string, logger *logrus.Logger) error {
+	return SetupStateDirectory(stateDir, logger)
 }
 
 func (p *NixOSPlugin) GetConfigDirectory() string {
@@ -65,6 +116,7 @@ func (p *NixOSPlugin) GetConfigDirectory() string {
 }
 
 func (p *NixOSPlugin) SetupDirectories(dirs []string, owner string, logger *logrus.Logger) error {
+	files := elevate.Privileged()
 	for _, dir := range dirs {
 		if dir == "" {
 			continue
@@ -72,18 +124,15 @@ func (p *NixOSPlugin) SetupDirectories(dirs []string, owner string, logger *logr
 
 		logger.WithField("dir", dir).Info("Creating directory")
 
-		cmd := exec.Command("sudo", "mkdir", "-p", dir)
-		if err := cmd.Run(); err != nil {
+		if err := files.MkdirAll(dir); err != nil {
 			return fmt.Errorf("failed to create directory %s: %w", dir, err)
 		}
 
-		cmd = exec.Command("sudo", "chown", "-R", "root:root", dir)
-		if err := cmd.Run(); err != nil {
+		if err := files.ChownAll(dir, 0, 0); err != nil {
 			return fmt.Errorf("failed to set ownership for %s: %w", dir, err)
 		}
 
-		cmd = exec.Command("sudo", "chmod", "755", dir)
-		if err := cmd.Run(); err != nil {
+		if err := files.Chmod(dir, 0755); err != nil {
 			return fmt.Errorf("failed to set permissions for %s: %w", dir, err)
 		}
 
@@ -93,10 +142,10 @@ func (p *NixOSPlugin) SetupDirectories(dirs []string, owner string, logger *logr
 	return nil
 }
 
-func (p *NixOSPlugin) generateNixOSServiceConfig(serviceName, executablePath, configPath string, logger *logrus.Logger) error {
+func (p *NixOSPlugin) generateNixOSServiceConfig(serviceName, executablePath, configPath, stateDir string, logger *logrus.Logger) error {
 	moduleDestPath := "/etc/nixos/modules/jit/p0-ssh-agent.nix"
 
-	moduleContent := p.generateNixOSModule(executablePath, configPath)
+	moduleContent := p.generateNixOSModule(executablePath, configPath, stateDir)
 
 	if err := p.installNixOSModuleDirectly(moduleContent, moduleDestPath, logger); err != nil {
 		logger.WithError(err).Error("Failed to install NixOS module")
@@ -107,7 +156,7 @@ func (p *NixOSPlugin) generateNixOSServiceConfig(serviceName, executablePath, co
 	return nil
 }
 
-func (p *NixOSPlugin) generateNixOSModule(executablePath, configPath string) string {
+func (p *NixOSPlugin) generateNixOSModule(executablePath, configPath, stateDir string) string {
 	return fmt.Sprintf(`{ config, lib, ... }:
 
 with lib;
@@ -120,6 +169,9 @@ in {
   };
   
   config = mkIf cfg.enable {
+    # Agent state directory (grant records, journals)
+    systemd.tmpfiles.rules = [ "d %s 0700 root root -" ];
+
     # Main systemd service
     systemd.services.p0-ssh-agent = {
       enable = true;
@@ -162,7 +214,7 @@ in {
       };
     };
   };
-}`, executablePath, configPath)
+}`, stateDir, executablePath, configPath)
 }
 
 func (p *NixOSPlugin) installNixOSModuleDirectly(moduleContent, destPath string, logger *logrus.Logger) error {
@@ -176,12 +228,9 @@ func (p *NixOSPlugin) installNixOSModuleDirectly(moduleContent, destPath string,
 	moduleDir := filepath.Dir(destPath)
 	logger.WithField("directory", moduleDir).Info("Creating NixOS modules directory")
 
-	// Create the full directory path with verbose output for debugging
-	cmd := exec.Command("sudo", "mkdir", "-p", "-v", moduleDir)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to create modules directory %s: %w\nOutput: %s", moduleDir, err, string(output))
-	} else {
-		logger.WithField("output", string(output)).Debug("Directory creation output")
+	files := elevate.Privileged()
+	if err := files.MkdirAll(moduleDir); err != nil {
+		return fmt.Errorf("failed to create modules directory %s: %w", moduleDir, err)
 	}
 
 	// Verify the directory was created
@@ -191,14 +240,12 @@ func (p *NixOSPlugin) installNixOSModuleDirectly(moduleContent, destPath string,
 
 	// Copy module file to final location
 	logger.WithField("destination", destPath).Info("Installing NixOS module file")
-	cmd = exec.Command("sudo", "cp", tempPath, destPath)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to install module file: %w\nOutput: %s", err, string(output))
+	if err := files.Copy(tempPath, destPath); err != nil {
+		return fmt.Errorf("failed to install module file: %w", err)
 	}
 
 	// Set proper permissions
-	cmd = exec.Command("sudo", "chmod", "644", destPath)
-	if err := cmd.Run(); err != nil {
+	if err := files.Chmod(destPath, 0644); err != nil {
 		logger.WithError(err).Warn("Failed to set module file permissions")
 	}
 
@@ -209,18 +256,18 @@ func (p *NixOSPlugin) installNixOSModuleDirectly(moduleContent, destPath string,
 	return nil
 }
 
-func (p *NixOSPlugin) CreateUser(username string, logger *logrus.Logger) error {
+func (p *NixOSPlugin) CreateUser(ctx context.Context, username string, logger *logrus.Logger) error {
 	logger.WithField("user", username).Info("Creating JIT user with NixOS shell path")
 
 	// Use utility function with NixOS-specific shell path
-	return CreateUser(username, p.getNixOSShellPath(), logger)
+	return CreateUser(ctx, username, p.getNixOSShellPath(), logger)
 }
 
-func (p *NixOSPlugin) RemoveUser(username string, logger *logrus.Logger) error {
+func (p *NixOSPlugin) RemoveUser(ctx context.Context, username string, logger *logrus.Logger) error {
 	logger.WithField("user", username).Info("Removing JIT user")
 
 	// Use utility function
-	return RemoveUser(username, logger)
+	return RemoveUser(ctx, username, logger)
 }
 
 func (p *NixOSPlugin) UninstallService(serviceName string, logger *logrus.Logger) error {
@@ -230,7 +277,7 @@ func (p *NixOSPlugin) UninstallService(serviceName string, logger *logrus.Logger
 	cmd := exec.Command("systemctl", "is-active", serviceName)
 	if err := cmd.Run(); err == nil {
 		logger.Info("Service is running, stopping...")
-		cmd = exec.Command("sudo", "systemctl", "stop", serviceName)
+		cmd = elevate.Command("systemctl", "stop", serviceName)
 		if err := cmd.Run(); err != nil {
 			logger.WithError(err).Warn("Failed to stop service")
 		} else {
@@ -251,12 +298,12 @@ func (p *NixOSPlugin) CleanupInstallation(serviceName string, logger *logrus.Log
 	dirs := []string{
 		"/etc/p0-ssh-agent",     // Config directory
 		"/var/log/p0-ssh-agent", // Log directory
+		"/var/lib/p0-ssh-agent", // State directory
 	}
 
 	for _, dir := range dirs {
 		if _, err := os.Stat(dir); err == nil {
-			cmd := exec.Command("sudo", "rm", "-rf", dir)
-			if err := cmd.Run(); err != nil {
+			if err := elevate.Privileged().RemoveAll(dir); err != nil {
 				logger.WithError(err).WithField("dir", dir).Warn("Failed to remove directory")
 			} else {
 				logger.WithField("dir", dir).Info("Directory removed")
@@ -269,8 +316,7 @@ func (p *NixOSPlugin) CleanupInstallation(serviceName string, logger *logrus.Log
 	for _, dir := range installDirs {
 		binaryPath := fmt.Sprintf("%s/p0-ssh-agent", dir)
 		if _, err := os.Stat(binaryPath); err == nil {
-			cmd := exec.Command("sudo", "rm", "-f", binaryPath)
-			if err := cmd.Run(); err != nil {
+			if err := elevate.Privileged().Remove(binaryPath); err != nil {
 				logger.WithError(err).WithField("path", binaryPath).Warn("Failed to remove binary")
 			} else {
 				logger.WithField("path", binaryPath).Info("Binary removed")
@@ -282,8 +328,7 @@ func (p *NixOSPlugin) CleanupInstallation(serviceName string, logger *logrus.Log
 	// Remove the NixOS module file we generated
 	moduleFilePath := "/etc/nixos/modules/jit/p0-ssh-agent.nix"
 	if _, err := os.Stat(moduleFilePath); err == nil {
-		cmd := exec.Command("sudo", "rm", "-f", moduleFilePath)
-		if err := cmd.Run(); err != nil {
+		if err := elevate.Privileged().Remove(moduleFilePath); err != nil {
 			logger.WithError(err).WithField("path", moduleFilePath).Warn("Failed to remove NixOS module file")
 		} else {
 			logger.WithField("path", moduleFilePath).Info("NixOS module file removed")
@@ -0,0 +1,58 @@
+package osplugins
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+// osReleasePath is the standard location of distribution identification data
+const osReleasePath = "/etc/os-release"
+
+// OSRelease holds the key/value pairs from /etc/os-release
+type OSRelease map[string]string
+
+// ReadOSRelease parses /etc/os-release, returning an empty map when it is missing
+func ReadOSRelease() OSRelease {
+	release := OSRelease{}
+
+	file, err := os.Open(osReleasePath)
+	if err != nil {
+		return release
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		release[key] = strings.Trim(value, `"'`)
+	}
+
+	return release
+}
+
+// ID returns the lowercase distribution ID (e.g. "raspbian", "debian")
+func (r OSRelease) ID() string {
+	return strings.ToLower(r["ID"])
+}
+
+// Is reports whether ID or ID_LIKE matches any of the given distribution IDs
+func (r OSRelease) Is(ids ...string) bool {
+	candidates := append([]string{r.ID()}, strings.Fields(strings.ToLower(r["ID_LIKE"]))...)
+	for _, candidate := range candidates {
+		for _, id := range ids {
+			if candidate == id {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,429 @@
+package osplugins
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/internal/elevate"
+)
+
+// rhelUnitPath is the service PATH on RHEL-family hosts: sudo's secure_path
+// order, so distribution tools in /usr/sbin are never shadowed by /usr/local
+const rhelUnitPath = "/usr/sbin:/usr/bin:/usr/local/sbin:/usr/local/bin"
+
+// selinuxEnforcePath exists whenever SELinux is enabled, enforcing or permissive
+const selinuxEnforcePath = "/sys/fs/selinux/enforce"
+
+var (
+	selinuxUserMu sync.RWMutex
+	selinuxUser   string
+)
+
+// SetSELinuxUser sets the SELinux user JIT accounts are mapped to on
+// RHEL-family hosts. The agent sets it from selinuxUser; empty leaves new
+// accounts to the policy's default login mapping.
+func SetSELinuxUser(name string) {
+	selinuxUserMu.Lock()
+	defer selinuxUserMu.Unlock()
+	selinuxUser = name
+}
+
+func currentSELinuxUser() string {
+	selinuxUserMu.RLock()
+	defer selinuxUserMu.RUnlock()
+	return selinuxUser
+}
+
+// RHELPlugin supports Red Hat Enterprise Linux and its rebuilds (CentOS,
+// Rocky, AlmaLinux, Oracle Linux) and Fedora. It reuses the Linux plugin and
+// adjusts for SELinux: files the install moves into place get their default
+// labels back, a binary outside the system directories is labeled so systemd
+// may execute it, and JIT accounts can be mapped to a confined SELinux user.
+type RHELPlugin struct {
+	*LinuxPlugin
+	release OSRelease
+}
+
+// NewRHELPlugin creates a new RHEL-family plugin instance
+func NewRHELPlugin() *RHELPlugin {
+	return &RHELPlugin{
+		LinuxPlugin: NewLinuxPlugin(),
+		release:     ReadOSRelease(),
+	}
+}
+
+func (p *RHELPlugin) GetName() string {
+	return "rhel"
+}
+
+// Detect checks os-release for a RHEL-family distribution, falling back to
+// /etc/redhat-release on releases that predate os-release
+func (p *RHELPlugin) Detect() bool {
+	if p.release.Is("rhel", "centos", "fedora") {
+		return true
+	}
+	_, err := os.Stat("/etc/redhat-release")
+	return err == nil
+}
+
+func (p *RHELPlugin) GetInstallDirectories() []string {
+	return []string{
+		"/usr/bin",       // Where the rpm installs, and on sudo's secure_path unlike /usr/local/bin
+		"/usr/local/bin", // Fallback
+		"/opt/p0/bin",    // Custom location fallback, labeled bin_t at install
+	}
+}
+
+func (p *RHELPlugin) CreateSystemdService(serviceName, executablePath, configPath, stateDir string, logger *logrus.Logger) error {
+	logger.WithField("distribution", p.release.ID()).Info("Creating systemd service file for RHEL family")
+
+	serviceContent := strings.Replace(SystemdUnit(serviceName, executablePath, configPath),
+		"Environment=PATH=/usr/local/bin:/usr/bin:/bin:/sbin:/usr/sbin\n",
+		"Environment=PATH="+rhelUnitPath+"\n", 1)
+
+	serviceFilePath := fmt.Sprintf("/etc/systemd/system/%s.service", serviceName)
+	if err := p.writeServiceFile(serviceFilePath, serviceContent, logger); err != nil {
+		return fmt.Errorf("failed to write service file: %w", err)
+	}
+
+	if selinuxEnabled() {
+		// The unit was moved from /tmp and would keep a label systemd cannot read
+		if err := labelExecutable(executablePath, logger); err != nil {
+			return err
+		}
+		if err := restoreContext(logger, serviceFilePath); err != nil {
+			return err
+		}
+		labelSSHPorts(logger)
+	}
+	for _, port := range firewalldClosedSSHPorts() {
+		logger.WithField("port", port).Warn("⚠️  firewalld does not allow the sshd port; SSH access granted by the agent cannot be used until it is opened")
+	}
+
+	cmd := elevate.Command("systemctl", "daemon-reload")
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to reload systemd: %w", err)
+	}
+
+	logger.Info("✅ Systemd service created successfully")
+	return nil
+}
+
+func (p *RHELPlugin) SetupDirectories(dirs []string, owner string, logger *logrus.Logger) error {
+	if err := p.LinuxPlugin.SetupDirectories(dirs, owner, logger); err != nil {
+		return err
+	}
+	if !selinuxEnabled() {
+		return nil
+	}
+
+	var created []string
+	for _, dir := range dirs {
+		if dir != "" {
+			created = append(created, dir)
+		}
+	}
+	return restoreContext(logger, created...)
+}
+
+func (p *RHELPlugin) SetupStateDirectory(stateDir string, logger *logrus.Logger) error {
+	if err := SetupStateDirectory(stateDir, logger); err != nil {
+		return err
+	}
+	if !selinuxEnabled() {
+		return nil
+	}
+	return restoreContext(logger, stateDir)
+}
+
+// CreateUser creates a JIT account with the shared helper, which prefers the
+// shadow-utils tools in /usr/sbin. With selinuxUser set on an SELinux host
+// the account is mapped to that SELinux user with useradd -Z, so JIT logins
+// run confined, and the mapping is checked before the account is used.
+func (p *RHELPlugin) CreateUser(ctx context.Context, username string, logger *logrus.Logger) error {
+	seUser := currentSELinuxUser()
+	if seUser == "" {
+		return CreateUser(ctx, username, "/bin/bash", logger)
+	}
+	if !selinuxEnabled() {
+		logger.WithField("selinux_user", seUser).Warn("⚠️  selinuxUser is set but SELinux is disabled; creating the JIT user unconfined")
+		return CreateUser(ctx, username, "/bin/bash", logger)
+	}
+
+	_, err := user.Lookup(username)
+	existed := err == nil
+	if err := CreateUser(ctx, username, "/bin/bash", logger, "-Z", seUser); err != nil {
+		return err
+	}
+
+	if err := checkSELinuxLogin(ctx, username, seUser); err != nil {
+		// A new account must not be used unconfined; an existing one is
+		// not the agent's to remove
+		if !existed {
+			p.RemoveUser(ctx, username, logger)
+		}
+		return err
+	}
+	logger.WithFields(logrus.Fields{"user": username, "selinux_user": seUser}).Info("🛡️ JIT user mapped to SELinux user")
+	return nil
+}
+
+// checkSELinuxLogin verifies that username logs in as the SELinux user
+// seUser, as listed by semanage login -l
+func checkSELinuxLogin(ctx context.Context, username, seUser string) error {
+	if !commandExists(sbin("semanage")) {
+		return fmt.Errorf("cannot verify the SELinux mapping of %s: semanage not found (install policycoreutils-python-utils)", username)
+	}
+	output, err := elevate.Output(elevate.CommandContext(ctx, sbin("semanage"), "login", "-l"))
+	if err != nil {
+		return fmt.Errorf("failed to list SELinux login mappings: %w", err)
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == username {
+			if fields[1] != seUser {
+				return fmt.Errorf("%s is mapped to SELinux user %s, not %s", username, fields[1], seUser)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("%s has no SELinux login mapping to %s", username, seUser)
+}
+
+// RemoveUser removes a JIT account together with its SELinux login mapping
+func (p *RHELPlugin) RemoveUser(ctx context.Context, username string, logger *logrus.Logger) error {
+	logger.WithField("user", username).Info("Removing JIT user")
+
+	if _, err := user.Lookup(username); err != nil {
+		logger.WithField("user", username).Info("User does not exist, nothing to remove")
+		return nil
+	}
+
+	args := []string{"--remove"}
+	if selinuxEnabled() {
+		args = append(args, "-Z")
+	}
+	args = append(args, username)
+
+	if output, err := elevate.CombinedOutput(elevate.CommandContext(ctx, sbin("userdel"), args...)); err != nil {
+		logger.WithError(err).WithField("output", string(output)).Error("Failed to remove JIT user")
+		return fmt.Errorf("failed to remove JIT user: %w", err)
+	}
+
+	logger.WithField("user", username).Info("✅ JIT user removed successfully")
+	return nil
+}
+
+func (p *RHELPlugin) CleanupInstallation(serviceName string, logger *logrus.Logger) error {
+	if err := p.LinuxPlugin.CleanupInstallation(serviceName, logger); err != nil {
+		return err
+	}
+
+	// Drop the file context rule added for a binary under /opt
+	for _, dir := range p.GetInstallDirectories() {
+		if needsExecLabel(dir) && commandExists(sbin("semanage")) {
+			elevate.Command(sbin("semanage"), "fcontext", "-d", fcontextPattern(dir)).Run()
+		}
+	}
+	return nil
+}
+
+func (p *RHELPlugin) DisplayInstallationSuccess(serviceName, configPath string, verbose bool) {
+	p.LinuxPlugin.DisplayInstallationSuccess(serviceName, configPath, verbose)
+
+	if !selinuxEnabled() {
+		return
+	}
+	fmt.Println("\n🛡️  SELinux is enabled")
+	fmt.Println("   Installed files were relabeled with restorecon.")
+	if seUser := currentSELinuxUser(); seUser != "" {
+		fmt.Printf("   JIT users are mapped to the SELinux user %s.\n", seUser)
+	}
+	for _, port := range unlabeledSSHPorts() {
+		fmt.Printf("   ⚠️  sshd listens on port %d, which is not labeled ssh_port_t. Label it with:\n", port)
+		fmt.Printf("      sudo semanage port -a -t ssh_port_t -p tcp %d\n", port)
+	}
+	for _, port := range firewalldClosedSSHPorts() {
+		fmt.Printf("   ⚠️  firewalld does not allow sshd port %d. Open it with:\n", port)
+		fmt.Printf("      sudo firewall-cmd --permanent --add-port=%d/tcp && sudo firewall-cmd --reload\n", port)
+	}
+}
+
+func selinuxEnabled() bool {
+	_, err := os.Stat(selinuxEnforcePath)
+	return err == nil
+}
+
+// restoreContext resets paths to the labels the policy assigns them
+func restoreContext(logger *logrus.Logger, paths ...string) error {
+	if len(paths) == 0 {
+		return nil
+	}
+	if !commandExists(sbin("restorecon")) {
+		logger.Warn("⚠️  SELinux is enabled but restorecon was not found (install policycoreutils); files keep their current labels")
+		return nil
+	}
+
+	args := append([]string{"-R"}, paths...)
+	if output, err := elevate.CombinedOutput(elevate.Command(sbin("restorecon"), args...)); err != nil {
+		return fmt.Errorf("failed to restore SELinux contexts of %s: %v (output: %s)", strings.Join(paths, ", "), err, strings.TrimSpace(string(output)))
+	}
+	logger.WithField("paths", paths).Debug("Restored SELinux contexts")
+	return nil
+}
+
+// needsExecLabel reports whether files in dir are labeled without the
+// execute permission for systemd by default, as everything under /opt is
+func needsExecLabel(dir string) bool {
+	return dir == "/opt" || strings.HasPrefix(dir, "/opt/")
+}
+
+func fcontextPattern(dir string) string {
+	return dir + "(/.*)?"
+}
+
+// labelExecutable lets systemd execute a binary installed outside the system
+// directories by adding a bin_t file context rule for its directory
+func labelExecutable(executablePath string, logger *logrus.Logger) error {
+	dir := filepath.Dir(executablePath)
+	if needsExecLabel(dir) {
+		if !commandExists(sbin("semanage")) {
+			logger.WithField("dir", dir).Warn("⚠️  semanage not found (install policycoreutils-python-utils); systemd may be denied executing the agent")
+		} else {
+			// -a fails when the rule exists, -m when it does not
+			pattern := fcontextPattern(dir)
+			if err := elevate.Command(sbin("semanage"), "fcontext", "-a", "-t", "bin_t", pattern).Run(); err != nil {
+				if output, err := elevate.CombinedOutput(elevate.Command(sbin("semanage"), "fcontext", "-m", "-t", "bin_t", pattern)); err != nil {
+					return fmt.Errorf("failed to label %s for execution: %v (output: %s)", dir, err, strings.TrimSpace(string(output)))
+				}
+			}
+			logger.WithField("dir", dir).Info("🛡️ Labeled install directory bin_t")
+		}
+	}
+	return restoreContext(logger, executablePath)
+}
+
+// labelSSHPorts labels the ports sshd listens on ssh_port_t, so sshd can
+// still bind them after a restart in enforcing mode. A port that cannot be
+// labeled is reported at the end of the installation.
+func labelSSHPorts(logger *logrus.Logger) {
+	for _, port := range unlabeledSSHPorts() {
+		number := strconv.Itoa(port)
+		// -a fails when the port has another type, -m when it has none
+		if err := elevate.Command(sbin("semanage"), "port", "-a", "-t", "ssh_port_t", "-p", "tcp", number).Run(); err != nil {
+			if output, err := elevate.CombinedOutput(elevate.Command(sbin("semanage"), "port", "-m", "-t", "ssh_port_t", "-p", "tcp", number)); err != nil {
+				logger.WithError(err).WithFields(logrus.Fields{
+					"port":   port,
+					"output": strings.TrimSpace(string(output)),
+				}).Warn("⚠️  Failed to label sshd port ssh_port_t")
+				continue
+			}
+		}
+		logger.WithField("port", port).Info("🛡️ Labeled sshd port ssh_port_t")
+	}
+}
+
+// sshdPorts returns the ports sshd listens on: those of its ListenAddress
+// lines when they name one, and its Port lines otherwise
+func sshdPorts() []int {
+	config, err := exec.Command(sbin("sshd"), "-T").Output()
+	if err != nil {
+		return nil
+	}
+
+	var ports, listenPorts []int
+	add := func(list []int, value string) []int {
+		port, err := strconv.Atoi(value)
+		if err != nil {
+			return list
+		}
+		for _, existing := range list {
+			if existing == port {
+				return list
+			}
+		}
+		return append(list, port)
+	}
+	for _, line := range strings.Split(string(config), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "port":
+			ports = add(ports, fields[1])
+		case "listenaddress":
+			if _, port, err := net.SplitHostPort(fields[1]); err == nil {
+				listenPorts = add(listenPorts, port)
+			}
+		}
+	}
+	if len(listenPorts) > 0 {
+		return listenPorts
+	}
+	return ports
+}
+
+// firewalldClosedSSHPorts returns the ports sshd listens on that a running
+// firewalld does not open, through the ssh service or a port rule
+func firewalldClosedSSHPorts() []int {
+	if !commandExists("firewall-cmd") || exec.Command("firewall-cmd", "--state").Run() != nil {
+		return nil
+	}
+
+	var closed []int
+	for _, port := range sshdPorts() {
+		if port == 22 && exec.Command("firewall-cmd", "--query-service=ssh").Run() == nil {
+			continue
+		}
+		if exec.Command("firewall-cmd", fmt.Sprintf("--query-port=%d/tcp", port)).Run() == nil {
+			continue
+		}
+		closed = append(closed, port)
+	}
+	return closed
+}
+
+// unlabeledSSHPorts returns the ports sshd listens on that the SELinux
+// policy does not allow it to bind, which only goes unnoticed until sshd
+// restarts in enforcing mode
+func unlabeledSSHPorts() []int {
+	if !commandExists(sbin("semanage")) {
+		return nil
+	}
+	labels, err := exec.Command(sbin("semanage"), "port", "-l").Output()
+	if err != nil {
+		return nil
+	}
+
+	labeled := map[int]bool{}
+	for _, line := range strings.Split(string(labels), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[0] != "ssh_port_t" || fields[1] != "tcp" {
+			continue
+		}
+		for _, port := range strings.Split(strings.Join(fields[2:], ""), ",") {
+			if number, err := strconv.Atoi(port); err == nil {
+				labeled[number] = true
+			}
+		}
+	}
+
+	var unlabeled []int
+	for _, port := range sshdPorts() {
+		if !labeled[port] {
+			unlabeled = append(unlabeled, port)
+		}
+	}
+	return unlabeled
+}
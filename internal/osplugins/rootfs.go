@@ -0,0 +1,92 @@
+package osplugins
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+// OverlayRoot describes a root filesystem mounted as overlayfs, as done by
+// overlayroot on Raspberry Pi OS and Armbian to protect SD cards
+type OverlayRoot struct {
+	// LowerDir is the read-only base layer
+	LowerDir string
+	// UpperDir is the writable layer that receives all changes
+	UpperDir string
+}
+
+// DetectOverlayRoot reports whether / is an overlayfs mount
+func DetectOverlayRoot() (OverlayRoot, bool) {
+	file, err := os.Open("/proc/mounts")
+	if err != nil {
+		return OverlayRoot{}, false
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[1] != "/" || fields[2] != "overlay" {
+			continue
+		}
+
+		overlay := OverlayRoot{}
+		for _, option := range strings.Split(fields[3], ",") {
+			if key, value, ok := strings.Cut(option, "="); ok {
+				switch key {
+				case "lowerdir":
+					overlay.LowerDir = value
+				case "upperdir":
+					overlay.UpperDir = value
+				}
+			}
+		}
+		return overlay, true
+	}
+
+	return OverlayRoot{}, false
+}
+
+// IsReadOnlyMount reports whether path lives on a filesystem mounted read-only,
+// using the longest matching mount point in /proc/mounts
+func IsReadOnlyMount(path string) bool {
+	file, err := os.Open("/proc/mounts")
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	longest := ""
+	readOnly := false
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+
+		mountPoint := fields[1]
+		if !isUnderMount(path, mountPoint) || len(mountPoint) < len(longest) {
+			continue
+		}
+
+		longest = mountPoint
+		readOnly = false
+		for _, option := range strings.Split(fields[3], ",") {
+			if option == "ro" {
+				readOnly = true
+				break
+			}
+		}
+	}
+
+	return readOnly
+}
+
+func isUnderMount(path, mountPoint string) bool {
+	if mountPoint == "/" {
+		return strings.HasPrefix(path, "/")
+	}
+	return path == mountPoint || strings.HasPrefix(path, mountPoint+"/")
+}
@@ -1,16 +1,25 @@
 package osplugins
 
 import (
+	"context"
 	"fmt"
+	"os"
 	"os/exec"
 	"os/user"
+	"path/filepath"
 	"strconv"
+	"strings"
 
 	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/internal/elevate"
 )
 
-// CreateUser creates a user dynamically for JIT access with configurable shell path
-func CreateUser(username string, shellPath string, logger *logrus.Logger) error {
+// CreateUser creates a user dynamically for JIT access with configurable shell
+// path. useraddArgs go to useradd ahead of the user name, e.g. -Z to map the
+// account to an SELinux user; adduser, which cannot take them, is then not
+// tried.
+func CreateUser(ctx context.Context, username string, shellPath string, logger *logrus.Logger, useraddArgs ...string) error {
 	logger.WithField("user", username).Info("Creating JIT user")
 
 	// Check if user already exists
@@ -31,8 +40,11 @@ func CreateUser(username string, shellPath string, logger *logrus.Logger) error
 	}).Info("Creating new JIT user with UID")
 
 	// Try useradd first, then fallback to adduser
-	if err := createUserWithUseradd(username, newUID, shellPath, logger); err != nil {
-		if err := createUserWithAdduser(username, newUID, shellPath, logger); err != nil {
+	if err := createUserWithUseradd(ctx, username, newUID, shellPath, useraddArgs, logger); err != nil {
+		if len(useraddArgs) > 0 {
+			return err
+		}
+		if err := createUserWithAdduser(ctx, username, newUID, shellPath, logger); err != nil {
 			return fmt.Errorf("failed to create user: neither useradd nor adduser succeeded: %w", err)
 		}
 	}
@@ -42,7 +54,7 @@ func CreateUser(username string, shellPath string, logger *logrus.Logger) error
 }
 
 // RemoveUser removes a dynamically created user
-func RemoveUser(username string, logger *logrus.Logger) error {
+func RemoveUser(ctx context.Context, username string, logger *logrus.Logger) error {
 	logger.WithField("user", username).Info("Removing JIT user")
 
 	// Check if user exists
@@ -53,8 +65,8 @@ func RemoveUser(username string, logger *logrus.Logger) error {
 	}
 
 	// Remove user with userdel
-	cmd = exec.Command("sudo", "userdel", "--remove", username)
-	output, err := cmd.CombinedOutput()
+	cmd = elevate.CommandContext(ctx, "userdel", "--remove", username)
+	output, err := elevate.CombinedOutput(cmd)
 	if err != nil {
 		logger.WithError(err).WithField("output", string(output)).Error("Failed to remove JIT user")
 		return fmt.Errorf("failed to remove JIT user: %w", err)
@@ -83,34 +95,46 @@ func commandExists(command string) bool {
 	return err == nil
 }
 
-func createUserWithUseradd(username string, uid int, shellPath string, logger *logrus.Logger) error {
-	if !commandExists("groupadd") || !commandExists("useradd") {
+// sbin returns the /usr/sbin path of an administrative tool when it exists
+// there, so the tool the distribution ships is used whatever PATH says
+func sbin(tool string) string {
+	path := filepath.Join("/usr/sbin", tool)
+	if _, err := os.Stat(path); err == nil {
+		return path
+	}
+	return tool
+}
+
+func createUserWithUseradd(ctx context.Context, username string, uid int, shellPath string, useraddArgs []string, logger *logrus.Logger) error {
+	if !commandExists(sbin("groupadd")) || !commandExists(sbin("useradd")) {
 		return fmt.Errorf("groupadd or useradd not found")
 	}
 
 	logger.Debug("Creating user with useradd/groupadd")
 
-	cmd := exec.Command("sudo", "groupadd", "-g", strconv.Itoa(uid), username)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to create group: %v", err)
+	id := strconv.Itoa(uid)
+	if output, err := elevate.CombinedOutput(elevate.CommandContext(ctx, sbin("groupadd"), "-g", id, username)); err != nil {
+		return fmt.Errorf("failed to create group: %v (output: %s)", err, strings.TrimSpace(string(output)))
 	}
 
-	cmd = exec.Command("sudo", "useradd", "-m", "-u", strconv.Itoa(uid), "-g", strconv.Itoa(uid), username, "-s", shellPath)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to create user: %v", err)
+	args := append([]string{"-m", "-u", id, "-g", id, "-s", shellPath}, useraddArgs...)
+	args = append(args, username)
+	if output, err := elevate.CombinedOutput(elevate.CommandContext(ctx, sbin("useradd"), args...)); err != nil {
+		elevate.CommandContext(ctx, sbin("groupdel"), username).Run()
+		return fmt.Errorf("failed to create user: %v (output: %s)", err, strings.TrimSpace(string(output)))
 	}
 
 	return nil
 }
 
-func createUserWithAdduser(username string, uid int, shellPath string, logger *logrus.Logger) error {
+func createUserWithAdduser(ctx context.Context, username string, uid int, shellPath string, logger *logrus.Logger) error {
 	if !commandExists("adduser") {
 		return fmt.Errorf("adduser not found")
 	}
 
 	logger.Debug("Creating user with adduser")
 
-	cmd := exec.Command("sudo", "adduser", "-u", strconv.Itoa(uid), "--gecos", username, "--disabled-password", "--shell", shellPath, username)
+	cmd := elevate.CommandContext(ctx, "adduser", "-u", strconv.Itoa(uid), "--gecos", username, "--disabled-password", "--shell", shellPath, username)
 	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("failed to create user with adduser: %v", err)
 	}
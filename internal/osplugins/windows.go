@@ -0,0 +1,537 @@
+//go:build windows
+
+package osplugins
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+
+	"p0-ssh-agent/internal/elevate"
+)
+
+// Well-known SIDs, used instead of group and account names because those are localized
+const (
+	administratorsSID = "S-1-5-32-544"
+	usersSID          = "S-1-5-32-545"
+	systemSID         = "S-1-5-18"
+)
+
+// hresultAlreadyExists is HRESULT_FROM_WIN32(ERROR_ALREADY_EXISTS), returned by
+// CreateProfile when the user already has a profile
+const hresultAlreadyExists = 0x800700B7
+
+var (
+	userenv           = windows.NewLazySystemDLL("userenv.dll")
+	procCreateProfile = userenv.NewProc("CreateProfile")
+	procDeleteProfile = userenv.NewProc("DeleteProfileW")
+)
+
+// WindowsPlugin registers the agent with the Windows service control manager
+// and manages local JIT accounts for OpenSSH Server
+type WindowsPlugin struct{}
+
+// NewWindowsPlugin creates a new Windows plugin instance
+func NewWindowsPlugin() *WindowsPlugin {
+	return &WindowsPlugin{}
+}
+
+func (p *WindowsPlugin) GetName() string {
+	return "windows"
+}
+
+// Detect always returns true; this plugin is only built for Windows
+func (p *WindowsPlugin) Detect() bool {
+	return true
+}
+
+func (p *WindowsPlugin) GetInstallDirectories() []string {
+	programFiles := os.Getenv("ProgramFiles")
+	if programFiles == "" {
+		programFiles = `C:\Program Files`
+	}
+	return []string{filepath.Join(programFiles, "P0 SSH Agent")}
+}
+
+// GetSudoersDir returns the Linux location; sudo grants are not supported
+// on Windows
+func (p *WindowsPlugin) GetSudoersDir() string {
+	return "/etc"
+}
+
+// SSHHostKeyPaths follows the Win32-OpenSSH layout under ProgramData
+func (p *WindowsPlugin) SSHHostKeyPaths() []string {
+	sshDir := sshConfigDir()
+	return []string{
+		filepath.Join(sshDir, "ssh_host_ed25519_key.pub"),
+		filepath.Join(sshDir, "ssh_host_rsa_key.pub"),
+		filepath.Join(sshDir, "ssh_host_ecdsa_key.pub"),
+	}
+}
+
+// SSHKeygenPath prefers the OpenSSH client that ships with Windows
+func (p *WindowsPlugin) SSHKeygenPath() string {
+	systemRoot := os.Getenv("SystemRoot")
+	if systemRoot == "" {
+		systemRoot = `C:\Windows`
+	}
+
+	bundled := filepath.Join(systemRoot, "System32", "OpenSSH", "ssh-keygen.exe")
+	if _, err := os.Stat(bundled); err == nil {
+		return bundled
+	}
+	return "ssh-keygen.exe"
+}
+
+// SSHDPath prefers the OpenSSH server that ships with Windows
+func (p *WindowsPlugin) SSHDPath() string {
+	systemRoot := os.Getenv("SystemRoot")
+	if systemRoot == "" {
+		systemRoot = `C:\Windows`
+	}
+
+	bundled := filepath.Join(systemRoot, "System32", "OpenSSH", "sshd.exe")
+	if _, err := os.Stat(bundled); err == nil {
+		return bundled
+	}
+	return "sshd.exe"
+}
+
+// ServiceStatus asks the service control manager
+func (p *WindowsPlugin) ServiceStatus(name string) ServiceStatus {
+	var status ServiceStatus
+
+	config, err := exec.Command("sc.exe", "qc", name).Output()
+	if err != nil {
+		return status
+	}
+	status.Installed = true
+	status.Enabled = strings.Contains(string(config), "AUTO_START")
+
+	if state, err := exec.Command("sc.exe", "query", name).Output(); err == nil {
+		status.Active = strings.Contains(string(state), "RUNNING")
+	}
+	return status
+}
+
+// smShuttingDown is the GetSystemMetrics index that is non-zero while the
+// session is shutting down
+const smShuttingDown = 0x2000
+
+var procGetSystemMetrics = windows.NewLazySystemDLL("user32.dll").NewProc("GetSystemMetrics")
+
+func (p *WindowsPlugin) ShuttingDown() bool {
+	if procGetSystemMetrics.Find() != nil {
+		return false
+	}
+	shuttingDown, _, _ := procGetSystemMetrics.Call(smShuttingDown)
+	return shuttingDown != 0
+}
+
+// AuthorizedKeysFiles lists the user's own file and the one OpenSSH Server
+// reads for members of the Administrators group instead of it
+func (p *WindowsPlugin) AuthorizedKeysFiles(homeDir string) []string {
+	return []string{filepath.Join(homeDir, ".ssh", "authorized_keys"), adminAuthorizedKeysPath()}
+}
+
+// GrantAuthorizedKeysFile picks the administrators' file for members of the
+// Administrators group, whose own authorized_keys is ignored
+func (p *WindowsPlugin) GrantAuthorizedKeysFile(ctx context.Context, username, homeDir string) (string, error) {
+	script := `$ErrorActionPreference = 'Stop'
+$names = @(Get-LocalGroupMember -SID '` + administratorsSID + `' | ForEach-Object { ($_.Name -split '\\')[-1] })
+if ($names -contains $env:P0_USER) { 'yes' } else { 'no' }`
+
+	output, err := runPowerShell(ctx, script, "P0_USER="+username)
+	if err != nil {
+		return "", fmt.Errorf("failed to read Administrators group: %w (output: %s)", err, strings.TrimSpace(string(output)))
+	}
+	if strings.TrimSpace(string(output)) == "yes" {
+		return adminAuthorizedKeysPath(), nil
+	}
+	return filepath.Join(homeDir, ".ssh", "authorized_keys"), nil
+}
+
+// RestrictAuthorizedKeysFile sets the ACL sshd's StrictModes expects: no
+// inherited entries, full control for SYSTEM and Administrators and, for a
+// user's own file, read access for that user
+func (p *WindowsPlugin) RestrictAuthorizedKeysFile(ctx context.Context, path, username string) error {
+	grants := []string{"*" + systemSID + ":F", "*" + administratorsSID + ":F"}
+	if path != adminAuthorizedKeysPath() {
+		grants = append(grants, username+":R")
+	}
+	return setACL(path, grants...)
+}
+
+// SupportsUserSlices is false, as resource limits use systemd
+func (p *WindowsPlugin) SupportsUserSlices() bool {
+	return false
+}
+
+// SupportsSessionRecording is false, as the recorder needs a Unix pty
+func (p *WindowsPlugin) SupportsSessionRecording() bool {
+	return false
+}
+
+// CreateSystemdService registers the agent as an automatically started
+// Windows service that the service control manager restarts on failure
+func (p *WindowsPlugin) CreateSystemdService(serviceName, executablePath, configPath, stateDir string, logger *logrus.Logger) error {
+	logger.Info("Registering Windows service")
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to the service control manager: %w", err)
+	}
+	defer m.Disconnect()
+
+	service, err := m.OpenService(serviceName)
+	if err == nil {
+		logger.WithField("service", serviceName).Info("Service already exists, updating its configuration")
+		cfg, err := service.Config()
+		if err != nil {
+			service.Close()
+			return fmt.Errorf("failed to read service configuration: %w", err)
+		}
+		cfg.BinaryPathName = fmt.Sprintf("%s start --config %s", syscall.EscapeArg(executablePath), syscall.EscapeArg(configPath))
+		cfg.StartType = mgr.StartAutomatic
+		if err := service.UpdateConfig(cfg); err != nil {
+			service.Close()
+			return fmt.Errorf("failed to update service configuration: %w", err)
+		}
+	} else {
+		service, err = m.CreateService(serviceName, executablePath, mgr.Config{
+			DisplayName: "P0 SSH Agent",
+			Description: "P0 SSH Agent - Secure SSH access management",
+			StartType:   mgr.StartAutomatic,
+		}, "start", "--config", configPath)
+		if err != nil {
+			return fmt.Errorf("failed to create service: %w", err)
+		}
+	}
+	defer service.Close()
+
+	restart := mgr.RecoveryAction{Type: mgr.ServiceRestart, Delay: 5 * time.Second}
+	if err := service.SetRecoveryActions([]mgr.RecoveryAction{restart, restart, restart}, 60); err != nil {
+		logger.WithError(err).Warn("Failed to set service recovery actions")
+	}
+
+	logger.Info("✅ Windows service registered successfully")
+	return nil
+}
+
+// SetupDirectories creates dirs writable only by SYSTEM and Administrators
+// and readable by local users, like the root-owned 755 directories on Linux
+func (p *WindowsPlugin) SetupDirectories(dirs []string, owner string, logger *logrus.Logger) error {
+	for _, dir := range dirs {
+		if dir == "" {
+			continue
+		}
+
+		logger.WithField("dir", dir).Info("Creating directory")
+
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create directory %s: %w", dir, err)
+		}
+
+		if err := setACL(dir, "*"+systemSID+":(OI)(CI)F", "*"+administratorsSID+":(OI)(CI)F", "*"+usersSID+":(OI)(CI)RX"); err != nil {
+			return fmt.Errorf("failed to set permissions for %s: %w", dir, err)
+		}
+
+		logger.WithField("dir", dir).Info("✅ Directory created successfully")
+	}
+
+	return nil
+}
+
+// SetupStateDirectory creates the state directory accessible only to SYSTEM
+// and Administrators, since it holds grant records and journals
+func (p *WindowsPlugin) SetupStateDirectory(stateDir string, logger *logrus.Logger) error {
+	logger.WithField("dir", stateDir).Info("Creating state directory")
+
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return fmt.Errorf("failed to create state directory %s: %w", stateDir, err)
+	}
+
+	if err := setACL(stateDir, "*"+systemSID+":(OI)(CI)F", "*"+administratorsSID+":(OI)(CI)F"); err != nil {
+		return fmt.Errorf("failed to set permissions for %s: %w", stateDir, err)
+	}
+
+	logger.WithField("dir", stateDir).Info("✅ State directory created successfully")
+	return nil
+}
+
+// CreateUser creates a local account with a random password that is never
+// stored, so the account can only be used with SSH keys, and creates its
+// profile so the home directory exists before the first login
+func (p *WindowsPlugin) CreateUser(ctx context.Context, username string, logger *logrus.Logger) error {
+	logger.WithField("user", username).Info("Creating JIT user")
+
+	if _, _, _, err := windows.LookupSID("", username); err == nil {
+		logger.WithField("user", username).Info("✅ JIT user already exists")
+		return createProfile(username)
+	}
+
+	password, err := randomPassword()
+	if err != nil {
+		return err
+	}
+
+	script := `$ErrorActionPreference = 'Stop'
+$password = ConvertTo-SecureString $env:P0_PASSWORD -AsPlainText -Force
+New-LocalUser -Name $env:P0_USER -Password $password -PasswordNeverExpires -UserMayNotChangePassword -Description 'P0 JIT user' | Out-Null
+Add-LocalGroupMember -SID '` + usersSID + `' -Member $env:P0_USER -ErrorAction SilentlyContinue`
+
+	if output, err := runPowerShell(ctx, script, "P0_USER="+username, "P0_PASSWORD="+password); err != nil {
+		logger.WithError(err).WithField("output", string(output)).Error("Failed to create JIT user")
+		return fmt.Errorf("failed to create JIT user: %w", err)
+	}
+
+	if err := createProfile(username); err != nil {
+		return err
+	}
+
+	logger.WithField("user", username).Info("✅ JIT user created successfully")
+	return nil
+}
+
+// RemoveUser deletes the user's profile and then the local account
+func (p *WindowsPlugin) RemoveUser(ctx context.Context, username string, logger *logrus.Logger) error {
+	logger.WithField("user", username).Info("Removing JIT user")
+
+	sid, _, _, err := windows.LookupSID("", username)
+	if err != nil {
+		logger.WithField("user", username).Info("User does not exist, nothing to remove")
+		return nil
+	}
+
+	if err := deleteProfile(sid); err != nil {
+		logger.WithError(err).WithField("user", username).Warn("Failed to delete user profile")
+	}
+
+	if output, err := runPowerShell(ctx, `Remove-LocalUser -Name $env:P0_USER -ErrorAction Stop`, "P0_USER="+username); err != nil {
+		logger.WithError(err).WithField("output", string(output)).Error("Failed to remove JIT user")
+		return fmt.Errorf("failed to remove JIT user: %w", err)
+	}
+
+	logger.WithField("user", username).Info("✅ JIT user removed successfully")
+	return nil
+}
+
+func (p *WindowsPlugin) UninstallService(serviceName string, logger *logrus.Logger) error {
+	logger.WithField("service", serviceName).Info("Uninstalling Windows service")
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to the service control manager: %w", err)
+	}
+	defer m.Disconnect()
+
+	service, err := m.OpenService(serviceName)
+	if err != nil {
+		logger.WithField("service", serviceName).Info("Service is not registered, nothing to remove")
+		return nil
+	}
+	defer service.Close()
+
+	// Stop service if running
+	if status, err := service.Query(); err == nil && status.State != svc.Stopped {
+		logger.Info("Service is running, stopping...")
+		if _, err := service.Control(svc.Stop); err != nil {
+			logger.WithError(err).Warn("Failed to stop service")
+		} else if err := waitForState(service, svc.Stopped, 30*time.Second); err != nil {
+			logger.WithError(err).Warn("Service did not stop in time")
+		} else {
+			logger.Info("Service stopped")
+		}
+	}
+
+	if err := service.Delete(); err != nil {
+		return fmt.Errorf("failed to delete service: %w", err)
+	}
+
+	logger.Info("Service removed")
+	return nil
+}
+
+func (p *WindowsPlugin) CleanupInstallation(serviceName string, logger *logrus.Logger) error {
+	logger.Info("Performing Windows-specific cleanup")
+
+	// The standard paths resolve on the system drive, e.g. C:\etc\p0-ssh-agent
+	dirs := []string{
+		filepath.FromSlash("/etc/p0-ssh-agent"),
+		filepath.FromSlash("/var/log/p0-ssh-agent"),
+		filepath.FromSlash("/var/lib/p0-ssh-agent"),
+	}
+	dirs = append(dirs, p.GetInstallDirectories()...)
+
+	for _, dir := range dirs {
+		if _, err := os.Stat(dir); err == nil {
+			if err := os.RemoveAll(dir); err != nil {
+				logger.WithError(err).WithField("dir", dir).Warn("Failed to remove directory")
+			} else {
+				logger.WithField("dir", dir).Info("Directory removed")
+			}
+		}
+	}
+
+	return nil
+}
+
+func (p *WindowsPlugin) DisplayInstallationSuccess(serviceName, configPath string, verbose bool) {
+	if verbose {
+		fmt.Println("\n📊 Installation Summary:")
+		fmt.Printf("   ✅ Service Name: %s\n", serviceName)
+		fmt.Printf("   ✅ Service Account: LocalSystem\n")
+		fmt.Printf("   ✅ Config Path: %s\n", configPath)
+		fmt.Printf("   ✅ Windows Service: Registered, automatic start (not started)\n")
+		fmt.Printf("   ✅ JWT Keys: Generated\n")
+	}
+
+	fmt.Println("\n🪟 Windows Installation Complete!")
+	fmt.Println("\nStart the service (elevated PowerShell):")
+	fmt.Printf("  • Start service:     Start-Service %s\n", serviceName)
+	fmt.Printf("  • Check status:      Get-Service %s\n", serviceName)
+	fmt.Printf("  • Restart service:   Restart-Service %s\n", serviceName)
+	fmt.Printf("  • Stop service:      Stop-Service %s\n", serviceName)
+}
+
+func (p *WindowsPlugin) DisplayUninstallationSuccess(hasErrors bool, errors []error) {
+	fmt.Println("\n" + strings.Repeat("=", 60))
+	if hasErrors {
+		fmt.Println("⚠️ Windows Uninstallation Completed with Errors")
+	} else {
+		fmt.Println("✅ Windows Uninstallation Completed Successfully")
+	}
+	fmt.Println(strings.Repeat("=", 60))
+
+	fmt.Println("\n📋 What was removed:")
+	fmt.Println("   🗑️ Windows service (p0-ssh-agent)")
+	fmt.Println("   🗑️ Configuration, log and state directories")
+	fmt.Println("   🗑️ Program directory")
+
+	if hasErrors {
+		fmt.Println("\n❌ Errors encountered:")
+		for _, err := range errors {
+			fmt.Printf("   • %s\n", err.Error())
+		}
+		fmt.Println("\n💡 You may need to manually clean up remaining files")
+		fmt.Println("💡 Check: Get-Service p0-ssh-agent")
+	} else {
+		fmt.Println("\n🎉 P0 SSH Agent has been completely removed from your system")
+	}
+
+	fmt.Println("\n" + strings.Repeat("=", 60))
+}
+
+// setACL replaces the ACL of path with the given icacls grants, dropping inherited entries
+func setACL(path string, grants ...string) error {
+	args := append([]string{path, "/inheritance:r", "/grant:r"}, grants...)
+	if output, err := elevate.CombinedOutput(elevate.Exec("icacls", args...)); err != nil {
+		return fmt.Errorf("icacls failed: %w (output: %s)", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// sshConfigDir is where Win32-OpenSSH keeps sshd_config and the host keys
+func sshConfigDir() string {
+	programData := os.Getenv("ProgramData")
+	if programData == "" {
+		programData = `C:\ProgramData`
+	}
+	return filepath.Join(programData, "ssh")
+}
+
+// adminAuthorizedKeysPath is where OpenSSH Server reads keys for members of
+// the Administrators group
+func adminAuthorizedKeysPath() string {
+	return filepath.Join(sshConfigDir(), "administrators_authorized_keys")
+}
+
+// runPowerShell runs script with the given KEY=value environment entries.
+// Values are passed through the environment so they are never parsed as code.
+func runPowerShell(ctx context.Context, script string, env ...string) ([]byte, error) {
+	cmd := elevate.ExecContext(ctx, "powershell.exe", "-NoProfile", "-NonInteractive", "-Command", script)
+	cmd.Env = append(os.Environ(), env...)
+	return elevate.CombinedOutput(cmd)
+}
+
+// randomPassword returns a password that satisfies the default complexity policy
+func randomPassword() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate password: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf) + "aA1!", nil
+}
+
+func createProfile(username string) error {
+	sid, _, _, err := windows.LookupSID("", username)
+	if err != nil {
+		return fmt.Errorf("failed to look up SID of %s: %w", username, err)
+	}
+
+	sidPtr, err := windows.UTF16PtrFromString(sid.String())
+	if err != nil {
+		return err
+	}
+	namePtr, err := windows.UTF16PtrFromString(username)
+	if err != nil {
+		return err
+	}
+
+	path := make([]uint16, windows.MAX_PATH)
+	hr, _, _ := procCreateProfile.Call(
+		uintptr(unsafe.Pointer(sidPtr)),
+		uintptr(unsafe.Pointer(namePtr)),
+		uintptr(unsafe.Pointer(&path[0])),
+		uintptr(len(path)),
+	)
+	if hr != 0 && uint32(hr) != hresultAlreadyExists {
+		return fmt.Errorf("failed to create profile for %s: HRESULT 0x%08X", username, uint32(hr))
+	}
+	return nil
+}
+
+func deleteProfile(sid *windows.SID) error {
+	sidPtr, err := windows.UTF16PtrFromString(sid.String())
+	if err != nil {
+		return err
+	}
+
+	ok, _, callErr := procDeleteProfile.Call(uintptr(unsafe.Pointer(sidPtr)), 0, 0)
+	if ok == 0 {
+		if errors.Is(callErr, windows.ERROR_FILE_NOT_FOUND) {
+			return nil
+		}
+		return callErr
+	}
+	return nil
+}
+
+func waitForState(service *mgr.Service, state svc.State, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		status, err := service.Query()
+		if err != nil {
+			return err
+		}
+		if status.State == state {
+			return nil
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	return fmt.Errorf("timed out after %s", timeout)
+}
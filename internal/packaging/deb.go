@@ -0,0 +1,162 @@
+package packaging
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// writeDeb writes a Debian binary package: an ar archive holding
+// debian-binary, control.tar.gz and data.tar.gz, in that order
+func writeDeb(w io.Writer, s Spec, files []File, scripts Scripts) error {
+	arch, err := Architecture(FormatDeb, s.Arch)
+	if err != nil {
+		return err
+	}
+	version, err := NormalizeVersion(s.Version)
+	if err != nil {
+		return err
+	}
+
+	data, err := tarGz(s.BuildTime, func(tw *tar.Writer) error {
+		for _, file := range files {
+			if err := writeTarEntry(tw, "."+file.Path, file, s.BuildTime); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to build data archive: %w", err)
+	}
+
+	var md5sums strings.Builder
+	var installedSize int64
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		installedSize += int64(len(file.Data))
+		fmt.Fprintf(&md5sums, "%x  %s\n", md5.Sum(file.Data), strings.TrimPrefix(file.Path, "/"))
+	}
+
+	var control strings.Builder
+	fmt.Fprintf(&control, "Package: %s\n", PackageName)
+	fmt.Fprintf(&control, "Version: %s-%s\n", version, s.Release)
+	fmt.Fprintf(&control, "Architecture: %s\n", arch)
+	fmt.Fprintf(&control, "Maintainer: %s\n", s.Maintainer)
+	fmt.Fprintf(&control, "Installed-Size: %d\n", (installedSize+1023)/1024)
+	fmt.Fprintf(&control, "Section: admin\n")
+	fmt.Fprintf(&control, "Priority: optional\n")
+	fmt.Fprintf(&control, "Homepage: %s\n", homepage)
+	fmt.Fprintf(&control, "Description: %s\n", summary)
+	for _, line := range strings.Split(description, "\n") {
+		fmt.Fprintf(&control, " %s\n", line)
+	}
+
+	controlFiles := []File{
+		{Path: "control", Mode: 0644, Data: []byte(control.String())},
+		{Path: "md5sums", Mode: 0644, Data: []byte(md5sums.String())},
+		{Path: "postinst", Mode: 0755, Data: []byte(scripts.PostInstall)},
+		{Path: "prerm", Mode: 0755, Data: []byte(scripts.PreRemove)},
+		{Path: "postrm", Mode: 0755, Data: []byte(scripts.PostRemove)},
+	}
+	controlArchive, err := tarGz(s.BuildTime, func(tw *tar.Writer) error {
+		for _, file := range controlFiles {
+			if err := writeTarEntry(tw, "./"+file.Path, file, s.BuildTime); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to build control archive: %w", err)
+	}
+
+	ar := arWriter{w: w, mtime: s.BuildTime}
+	if _, err := io.WriteString(w, "!<arch>\n"); err != nil {
+		return err
+	}
+	if err := ar.add("debian-binary", []byte("2.0\n")); err != nil {
+		return err
+	}
+	if err := ar.add("control.tar.gz", controlArchive); err != nil {
+		return err
+	}
+	return ar.add("data.tar.gz", data)
+}
+
+// tarGz builds a gzip-compressed tar archive
+func tarGz(mtime time.Time, write func(*tar.Writer) error) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.ModTime = mtime
+	tw := tar.NewWriter(gz)
+
+	if err := write(tw); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeTarEntry(tw *tar.Writer, name string, file File, mtime time.Time) error {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    int64(file.Mode.Perm()),
+		ModTime: mtime,
+		Uname:   "root",
+		Gname:   "root",
+		Format:  tar.FormatGNU,
+	}
+	if file.IsDir() {
+		header.Typeflag = tar.TypeDir
+		header.Name += "/"
+	} else {
+		header.Typeflag = tar.TypeReg
+		header.Size = int64(len(file.Data))
+	}
+
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if !file.IsDir() {
+		if _, err := tw.Write(file.Data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// arWriter writes members of a common-format ar archive
+type arWriter struct {
+	w     io.Writer
+	mtime time.Time
+}
+
+func (a arWriter) add(name string, data []byte) error {
+	header := fmt.Sprintf("%-16s%-12d%-6d%-6d%-8o%-10d`\n", name, a.mtime.Unix(), 0, 0, 0100644, len(data))
+	if _, err := io.WriteString(a.w, header); err != nil {
+		return err
+	}
+	if _, err := a.w.Write(data); err != nil {
+		return err
+	}
+	// Members start on even offsets
+	if len(data)%2 == 1 {
+		if _, err := io.WriteString(a.w, "\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
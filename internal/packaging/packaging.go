@@ -0,0 +1,303 @@
+package packaging
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"p0-ssh-agent/internal/install"
+	"p0-ssh-agent/internal/jwt"
+	"p0-ssh-agent/internal/osplugins"
+	"p0-ssh-agent/types"
+)
+
+// Package formats
+const (
+	FormatDeb = "deb"
+	FormatRPM = "rpm"
+)
+
+const (
+	// PackageName is the name of the deb and rpm packages
+	PackageName = "p0-ssh-agent"
+
+	// BinaryPath is where the packages install the agent
+	BinaryPath = "/usr/bin/p0-ssh-agent"
+
+	// SkeletonPath holds the configuration skeleton; postinst copies it to
+	// install.DefaultConfigPath unless a configuration already exists, so
+	// register can rewrite the config without dpkg or rpm treating it as modified
+	SkeletonPath = "/usr/share/p0-ssh-agent/config.yaml"
+
+	summary     = "P0 SSH Agent - just-in-time SSH access managed by P0"
+	description = `Connects to the P0 backend over an outbound WebSocket and provisions
+just-in-time SSH access on this host: users, authorized keys, sudo rules
+and certificates, revoked when the grant ends.`
+	homepage = "https://docs.p0.com/"
+)
+
+// Spec describes one package build
+type Spec struct {
+	// Format is FormatDeb or FormatRPM
+	Format string
+	// Version is the upstream version; see NormalizeVersion
+	Version string
+	// Release is the deb revision or rpm release
+	Release string
+	// Arch is the Go architecture of Binary, e.g. amd64
+	Arch string
+	// Binary is the Linux agent binary to package
+	Binary string
+	// ServiceName names the systemd unit
+	ServiceName string
+	// Maintainer is recorded in the package metadata
+	Maintainer string
+	// BuildTime stamps files and metadata
+	BuildTime time.Time
+}
+
+// File is one entry of the package payload
+type File struct {
+	Path string
+	Mode os.FileMode
+	Data []byte
+}
+
+// IsDir reports whether the entry is a directory
+func (f File) IsDir() bool {
+	return f.Mode.IsDir()
+}
+
+// Scripts are the maintainer scripts, written to work with both dpkg and rpm
+// arguments
+type Scripts struct {
+	PostInstall string
+	PreRemove   string
+	PostRemove  string
+}
+
+// goArchitectures maps Go architectures to deb and rpm names
+var goArchitectures = map[string][2]string{
+	"amd64": {"amd64", "x86_64"},
+	"arm64": {"arm64", "aarch64"},
+	"arm":   {"armhf", "armv7hl"},
+	"386":   {"i386", "i686"},
+}
+
+// Architecture returns the package architecture for a Go architecture
+func Architecture(format, goArch string) (string, error) {
+	names, ok := goArchitectures[goArch]
+	if !ok {
+		return "", fmt.Errorf("architecture %q cannot be packaged (supported: amd64, arm64, arm, 386)", goArch)
+	}
+	if format == FormatRPM {
+		return names[1], nil
+	}
+	return names[0], nil
+}
+
+var versionPattern = regexp.MustCompile(`^[0-9][A-Za-z0-9.+~]*$`)
+
+// NormalizeVersion turns a build version such as "v1.4.0-3-gabc123-dirty"
+// into one both dpkg and rpm order correctly, e.g. "1.4.0+3.gabc123.dirty".
+// Versions without a leading number, such as "dev", sort before any release.
+func NormalizeVersion(version string) (string, error) {
+	v := strings.TrimPrefix(strings.TrimSpace(version), "v")
+	if head, tail, found := strings.Cut(v, "-"); found {
+		v = head + "+" + strings.ReplaceAll(tail, "-", ".")
+	}
+	if v == "" || v[0] < '0' || v[0] > '9' {
+		v = "0.0.0~" + v
+	}
+	if !versionPattern.MatchString(v) {
+		return "", fmt.Errorf("version %q cannot be used in a package", version)
+	}
+	return v, nil
+}
+
+// FileName returns the conventional file name of the package
+func (s Spec) FileName() (string, error) {
+	arch, err := Architecture(s.Format, s.Arch)
+	if err != nil {
+		return "", err
+	}
+	version, err := NormalizeVersion(s.Version)
+	if err != nil {
+		return "", err
+	}
+
+	if s.Format == FormatRPM {
+		return fmt.Sprintf("%s-%s-%s.%s.rpm", PackageName, version, s.Release, arch), nil
+	}
+	return fmt.Sprintf("%s_%s-%s_%s.deb", PackageName, version, s.Release, arch), nil
+}
+
+// unitDir is where each distribution family keeps packaged units
+func (s Spec) unitDir() string {
+	if s.Format == FormatRPM {
+		return "/usr/lib/systemd/system"
+	}
+	return "/lib/systemd/system"
+}
+
+// Contents returns the payload: the binary, the same systemd unit install
+// writes, the configuration skeleton and the agent directories. Parent
+// directories are listed before their children.
+func Contents(s Spec) ([]File, error) {
+	binary, err := os.ReadFile(s.Binary)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read binary: %w", err)
+	}
+
+	skeleton, err := configSkeleton()
+	if err != nil {
+		return nil, err
+	}
+
+	unit := osplugins.SystemdUnit(s.ServiceName, BinaryPath, install.DefaultConfigPath)
+
+	files := []File{
+		{Path: BinaryPath, Mode: 0755, Data: binary},
+		{Path: path.Join(s.unitDir(), s.ServiceName+".service"), Mode: 0644, Data: []byte(unit)},
+		{Path: SkeletonPath, Mode: 0644, Data: skeleton},
+		{Path: install.ConfigDir, Mode: os.ModeDir | 0755},
+		{Path: install.DefaultKeyPath, Mode: os.ModeDir | 0755},
+		{Path: types.DefaultStateDir, Mode: os.ModeDir | 0700},
+	}
+	return withParents(files), nil
+}
+
+// withParents adds the missing parent directories of every entry and sorts
+// the payload by path, which puts directories before their contents
+func withParents(files []File) []File {
+	seen := make(map[string]bool)
+	for _, file := range files {
+		seen[file.Path] = true
+	}
+
+	for _, file := range files {
+		for dir := path.Dir(file.Path); dir != "/" && !seen[dir]; dir = path.Dir(dir) {
+			seen[dir] = true
+			files = append(files, File{Path: dir, Mode: os.ModeDir | 0755})
+		}
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files
+}
+
+// ownedDirectory reports whether the package owns a directory, rather than
+// sharing a system one such as /usr/bin
+func ownedDirectory(dir string) bool {
+	for _, owned := range []string{install.ConfigDir, path.Dir(SkeletonPath), types.DefaultStateDir} {
+		if dir == owned || strings.HasPrefix(dir, owned+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func configSkeleton() ([]byte, error) {
+	body, err := yaml.Marshal(types.DefaultConfig())
+	if err != nil {
+		return nil, fmt.Errorf("failed to render configuration skeleton: %w", err)
+	}
+
+	header := "# Installed by the p0-ssh-agent package. `p0-ssh-agent register` fills in\n" +
+		"# orgId, hostId and tunnelHost; see the README for every option.\n"
+	return append([]byte(header), body...), nil
+}
+
+// MaintainerScripts renders postinst, prerm and postrm. They accept dpkg
+// arguments ("configure", "remove", "purge", ...) and rpm ones (the number
+// of installed instances left, 0 on erase).
+func MaintainerScripts(s Spec) Scripts {
+	service := s.ServiceName + ".service"
+	privateKey := path.Join(install.DefaultKeyPath, jwt.PrivateKeyFile)
+	publicKey := path.Join(install.DefaultKeyPath, jwt.PublicKeyFile)
+
+	return Scripts{
+		PostInstall: fmt.Sprintf(`#!/bin/sh
+set -e
+
+if [ ! -f %[1]s ]; then
+	install -m 0644 %[2]s %[1]s
+fi
+
+if [ ! -f %[3]s ]; then
+	%[4]s keygen --key-path %[5]s
+	chmod 644 %[6]s
+	chmod 600 %[3]s
+fi
+
+if [ -d /run/systemd/system ]; then
+	systemctl daemon-reload || true
+	# Upgrades restart a running agent; new installs wait for registration.
+	# A running agent reports the restart to the backend as an upgrade.
+	%[4]s control going-down --reason upgrade >/dev/null 2>&1 || true
+	systemctl try-restart %[7]s || true
+fi
+
+if ! grep -q '^orgId: .' %[1]s 2>/dev/null; then
+	echo "p0-ssh-agent installed. Register it with 'p0-ssh-agent register --url ... --auth ...',"
+	echo "then start it with 'systemctl enable --now %[7]s'."
+fi
+`, install.DefaultConfigPath, SkeletonPath, privateKey, BinaryPath, install.DefaultKeyPath, publicKey, service),
+
+		PreRemove: fmt.Sprintf(`#!/bin/sh
+set -e
+
+# Stop the agent on removal, not on upgrade
+case "$1" in
+	remove|0)
+		if [ -d /run/systemd/system ]; then
+			systemctl disable --now %s || true
+		fi
+		;;
+esac
+`, service),
+
+		PostRemove: `#!/bin/sh
+set -e
+
+# Configuration, keys and state are kept so a reinstall keeps its registration
+case "$1" in
+	remove|purge|0)
+		if [ -d /run/systemd/system ]; then
+			systemctl daemon-reload || true
+		fi
+		;;
+esac
+`,
+	}
+}
+
+// Build writes the package described by s to w
+func Build(s Spec, w io.Writer) error {
+	if s.Release == "" {
+		s.Release = "1"
+	}
+	if s.BuildTime.IsZero() {
+		s.BuildTime = time.Now()
+	}
+
+	files, err := Contents(s)
+	if err != nil {
+		return err
+	}
+
+	switch s.Format {
+	case FormatDeb:
+		return writeDeb(w, s, files, MaintainerScripts(s))
+	case FormatRPM:
+		return writeRPM(w, s, files, MaintainerScripts(s))
+	}
+	return fmt.Errorf("unsupported package format %q (use %s or %s)", s.Format, FormatDeb, FormatRPM)
+}
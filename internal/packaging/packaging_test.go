@@ -0,0 +1,399 @@
+package packaging
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// testSpec is a package build whose output only changes with the packager
+func testSpec(t *testing.T, format string) Spec {
+	t.Helper()
+	binary := filepath.Join(t.TempDir(), "p0-ssh-agent")
+	if err := os.WriteFile(binary, []byte("#!/bin/sh\necho agent\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return Spec{
+		Format:      format,
+		Version:     "v1.4.0-3-gabc123",
+		Release:     "2",
+		Arch:        "amd64",
+		Binary:      binary,
+		ServiceName: "p0-ssh-agent",
+		Maintainer:  "P0 Security",
+		BuildTime:   time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC),
+	}
+}
+
+// checkGolden compares got with testdata/name, or rewrites it with -update
+func checkGolden(t *testing.T, name, got string) {
+	t.Helper()
+	golden := filepath.Join("testdata", name)
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(golden), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(golden, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("%v (run go test -update to create it)", err)
+	}
+	if got != string(want) {
+		t.Errorf("%s differs from the golden file (run go test -update if the change is intended)\n got:\n%s\nwant:\n%s", name, got, want)
+	}
+}
+
+func TestMaintainerScripts(t *testing.T) {
+	scripts := MaintainerScripts(testSpec(t, FormatDeb))
+	for name, script := range map[string]string{
+		"postinst": scripts.PostInstall,
+		"prerm":    scripts.PreRemove,
+		"postrm":   scripts.PostRemove,
+	} {
+		t.Run(name, func(t *testing.T) {
+			checkGolden(t, filepath.Join("scripts", name), script)
+		})
+	}
+}
+
+func TestBuildDeb(t *testing.T) {
+	spec := testSpec(t, FormatDeb)
+	var pkg bytes.Buffer
+	if err := Build(spec, &pkg); err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+
+	members := readAr(t, pkg.Bytes())
+	var names []string
+	for _, member := range members {
+		names = append(names, member.name)
+	}
+	if got := strings.Join(names, " "); got != "debian-binary control.tar.gz data.tar.gz" {
+		t.Fatalf("ar members %q, want debian-binary, control.tar.gz and data.tar.gz", got)
+	}
+	if got := string(members[0].data); got != "2.0\n" {
+		t.Errorf("debian-binary %q, want %q", got, "2.0\n")
+	}
+
+	control := byName(readTarGz(t, members[1].data))
+	scripts := MaintainerScripts(spec)
+	for name, want := range map[string]string{
+		"./postinst": scripts.PostInstall,
+		"./prerm":    scripts.PreRemove,
+		"./postrm":   scripts.PostRemove,
+	} {
+		if control[name] != want {
+			t.Errorf("%s in control.tar.gz is not the maintainer script", name)
+		}
+	}
+	checkGolden(t, filepath.Join("deb", "control"), control["./control"])
+	checkGolden(t, filepath.Join("deb", "md5sums"), control["./md5sums"])
+	checkGolden(t, filepath.Join("deb", "data"), listing(readTarGz(t, members[2].data)))
+}
+
+func TestBuildRPM(t *testing.T) {
+	spec := testSpec(t, FormatRPM)
+	var pkg bytes.Buffer
+	if err := Build(spec, &pkg); err != nil {
+		t.Fatalf("Build: %v", err)
+	}
+
+	data := pkg.Bytes()
+	if len(data) < 96 || !bytes.Equal(data[:4], []byte{0xed, 0xab, 0xee, 0xdb}) {
+		t.Fatal("package does not start with an RPM lead")
+	}
+	if name := string(bytes.TrimRight(data[10:76], "\x00")); name != "p0-ssh-agent-1.4.0+3.gabc123-2" {
+		t.Errorf("lead names %q", name)
+	}
+
+	signature, rest := readRPMHeader(t, data[96:])
+	if pad := (len(data) - 96 - len(rest)) % 8; pad != 0 {
+		rest = rest[8-pad:]
+	}
+	header, payload := readRPMHeader(t, rest)
+
+	if size := signature.int32s(rpmSigTagSize); len(size) != 1 || int(size[0]) != len(rest) {
+		t.Errorf("signature size %v, want %d", size, len(rest))
+	}
+	if _, err := gzip.NewReader(bytes.NewReader(payload)); err != nil {
+		t.Errorf("payload is not gzip-compressed: %v", err)
+	}
+
+	scripts := MaintainerScripts(spec)
+	for tag, want := range map[int32]string{
+		rpmTagPostIn: scripts.PostInstall,
+		rpmTagPreUn:  scripts.PreRemove,
+		rpmTagPostUn: scripts.PostRemove,
+	} {
+		if header.string(tag) != want {
+			t.Errorf("header tag %d is not the maintainer script", tag)
+		}
+	}
+	checkGolden(t, filepath.Join("rpm", "spec"), header.spec())
+}
+
+func TestFileName(t *testing.T) {
+	tests := []struct {
+		format, version, arch string
+		want                  string
+	}{
+		{FormatDeb, "v1.4.0", "amd64", "p0-ssh-agent_1.4.0-1_amd64.deb"},
+		{FormatDeb, "v1.4.0-3-gabc123-dirty", "arm", "p0-ssh-agent_1.4.0+3.gabc123.dirty-1_armhf.deb"},
+		{FormatRPM, "1.4.0", "arm64", "p0-ssh-agent-1.4.0-1.aarch64.rpm"},
+		{FormatRPM, "dev", "386", "p0-ssh-agent-0.0.0~dev-1.i686.rpm"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			got, err := Spec{Format: tt.format, Version: tt.version, Release: "1", Arch: tt.arch}.FileName()
+			if err != nil {
+				t.Fatalf("FileName: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("FileName = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := (Spec{Format: FormatDeb, Version: "1.0 beta", Arch: "amd64"}).FileName(); err == nil {
+		t.Error("FileName accepted a version with a space")
+	}
+	if _, err := (Spec{Format: FormatDeb, Version: "1.0", Arch: "riscv64"}).FileName(); err == nil {
+		t.Error("FileName accepted an unsupported architecture")
+	}
+}
+
+type arMember struct {
+	name string
+	data []byte
+}
+
+func readAr(t *testing.T, data []byte) []arMember {
+	t.Helper()
+	if !bytes.HasPrefix(data, []byte("!<arch>\n")) {
+		t.Fatal("package is not an ar archive")
+	}
+	data = data[8:]
+
+	var members []arMember
+	for len(data) > 0 {
+		if len(data) < 60 {
+			t.Fatalf("truncated ar header: %q", data)
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(string(data[48:58])))
+		if err != nil || len(data) < 60+size {
+			t.Fatalf("invalid ar member size %q", data[48:58])
+		}
+		members = append(members, arMember{name: strings.TrimSpace(string(data[:16])), data: data[60 : 60+size]})
+		data = data[60+size+size%2:]
+	}
+	return members
+}
+
+// tarEntry is one entry of a tar archive
+type tarEntry struct {
+	name string
+	mode int64
+	data string
+}
+
+func readTarGz(t *testing.T, data []byte) []tarEntry {
+	t.Helper()
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var entries []tarEntry
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, tarEntry{name: header.Name, mode: header.Mode, data: string(body)})
+	}
+}
+
+// byName returns the contents of the archive's entries by name
+func byName(entries []tarEntry) map[string]string {
+	files := make(map[string]string)
+	for _, entry := range entries {
+		files[entry.name] = entry.data
+	}
+	return files
+}
+
+// listing lists the modes and paths of an archive, one per line
+func listing(entries []tarEntry) string {
+	var b strings.Builder
+	for _, entry := range entries {
+		fmt.Fprintf(&b, "%04o %s\n", entry.mode, entry.name)
+	}
+	return b.String()
+}
+
+// parsedHeader holds the entries of an RPM header by tag
+type parsedHeader map[int32]parsedEntry
+
+type parsedEntry struct {
+	kind, count int32
+	data        []byte
+}
+
+// readRPMHeader parses the header at the start of data and returns it with
+// the bytes that follow it
+func readRPMHeader(t *testing.T, data []byte) (parsedHeader, []byte) {
+	t.Helper()
+	if len(data) < 16 || !bytes.Equal(data[:4], []byte{0x8e, 0xad, 0xe8, 0x01}) {
+		t.Fatal("missing RPM header magic")
+	}
+	count := int(binary.BigEndian.Uint32(data[8:]))
+	storeSize := int(binary.BigEndian.Uint32(data[12:]))
+	storeStart := 16 + 16*count
+	if len(data) < storeStart+storeSize {
+		t.Fatal("truncated RPM header")
+	}
+	store := data[storeStart : storeStart+storeSize]
+
+	header := make(parsedHeader)
+	for i := 0; i < count; i++ {
+		index := data[16+16*i:]
+		tag := int32(binary.BigEndian.Uint32(index))
+		kind := int32(binary.BigEndian.Uint32(index[4:]))
+		offset := int(binary.BigEndian.Uint32(index[8:]))
+		if offset < 0 || offset > len(store) {
+			t.Fatalf("tag %d has offset %d outside the store", tag, offset)
+		}
+		header[tag] = parsedEntry{kind: kind, count: int32(binary.BigEndian.Uint32(index[12:])), data: store[offset:]}
+	}
+	return header, data[storeStart+storeSize:]
+}
+
+func (h parsedHeader) strings(tag int32) []string {
+	entry, ok := h[tag]
+	if !ok {
+		return nil
+	}
+	values := strings.SplitN(string(entry.data), "\x00", int(entry.count)+1)
+	return values[:entry.count]
+}
+
+func (h parsedHeader) string(tag int32) string {
+	if values := h.strings(tag); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func (h parsedHeader) int32s(tag int32) []int32 {
+	entry := h[tag]
+	values := make([]int32, entry.count)
+	for i := range values {
+		values[i] = int32(binary.BigEndian.Uint32(entry.data[4*i:]))
+	}
+	return values
+}
+
+func (h parsedHeader) int16s(tag int32) []uint16 {
+	entry := h[tag]
+	values := make([]uint16, entry.count)
+	for i := range values {
+		values[i] = binary.BigEndian.Uint16(entry.data[2*i:])
+	}
+	return values
+}
+
+// spec renders the header as the spec file rpm would have built it from
+func (h parsedHeader) spec() string {
+	var b strings.Builder
+	for _, field := range []struct {
+		name string
+		tag  int32
+	}{
+		{"Name", rpmTagName},
+		{"Version", rpmTagVersion},
+		{"Release", rpmTagRelease},
+		{"Summary", rpmTagSummary},
+		{"License", rpmTagLicense},
+		{"Group", rpmTagGroup},
+		{"URL", rpmTagURL},
+		{"Packager", rpmTagPackager},
+		{"BuildArch", rpmTagArch},
+		{"BuildHost", rpmTagBuildHost},
+	} {
+		fmt.Fprintf(&b, "%s: %s\n", field.name, h.string(field.tag))
+	}
+	fmt.Fprintf(&b, "BuildTime: %d\n", h.int32s(rpmTagBuildTime)[0])
+	fmt.Fprintf(&b, "Size: %d\n", h.int32s(rpmTagSize)[0])
+
+	provideVersions := h.strings(rpmTagProvideVersion)
+	for i, name := range h.strings(rpmTagProvideName) {
+		fmt.Fprintf(&b, "Provides: %s = %s\n", name, provideVersions[i])
+	}
+	requireVersions := h.strings(rpmTagRequireVersion)
+	requireFlags := h.int32s(rpmTagRequireFlags)
+	for i, name := range h.strings(rpmTagRequireName) {
+		if requireVersions[i] == "" {
+			fmt.Fprintf(&b, "Requires: %s\n", name)
+			continue
+		}
+		fmt.Fprintf(&b, "Requires: %s <= %s (flags %#x)\n", name, requireVersions[i], requireFlags[i])
+	}
+	fmt.Fprintf(&b, "Payload: %s %s %s\n", h.string(rpmTagPayloadFormat), h.string(rpmTagPayloadCompressor), h.string(rpmTagPayloadFlags))
+
+	fmt.Fprintf(&b, "\n%%description\n%s\n", h.string(rpmTagDescription))
+
+	dirNames := h.strings(rpmTagDirNames)
+	dirIndexes := h.int32s(rpmTagDirIndexes)
+	modes := h.int16s(rpmTagFileModes)
+	sizes := h.int32s(rpmTagFileSizes)
+	digests := h.strings(rpmTagFileDigests)
+	users := h.strings(rpmTagFileUserName)
+	groups := h.strings(rpmTagFileGroupName)
+	b.WriteString("\n%files\n")
+	for i, base := range h.strings(rpmTagBaseNames) {
+		entry := fmt.Sprintf("%%attr(%04o,%s,%s) %s%s", modes[i]&07777, users[i], groups[i], dirNames[dirIndexes[i]], base)
+		if modes[i]&040000 != 0 {
+			fmt.Fprintf(&b, "%%dir %s\n", entry)
+			continue
+		}
+		fmt.Fprintf(&b, "%s\n# size %d sha256 %s\n", entry, sizes[i], digests[i])
+	}
+
+	for _, script := range []struct {
+		name      string
+		tag, prog int32
+	}{
+		{"post", rpmTagPostIn, rpmTagPostInProg},
+		{"preun", rpmTagPreUn, rpmTagPreUnProg},
+		{"postun", rpmTagPostUn, rpmTagPostUnProg},
+	} {
+		fmt.Fprintf(&b, "\n%%%s -p %s\n%s", script.name, h.string(script.prog), h.string(script.tag))
+	}
+	return b.String()
+}
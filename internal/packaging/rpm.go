@@ -0,0 +1,408 @@
+package packaging
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// RPM header tags used by writeRPM, from rpmtag.h
+const (
+	rpmTagHeaderSignatures = 62
+	rpmTagHeaderImmutable  = 63
+	rpmTagHeaderI18NTable  = 100
+
+	rpmSigTagSHA1        = 269
+	rpmSigTagSHA256      = 273
+	rpmSigTagSize        = 1000
+	rpmSigTagMD5         = 1004
+	rpmSigTagPayloadSize = 1007
+
+	rpmTagName              = 1000
+	rpmTagVersion           = 1001
+	rpmTagRelease           = 1002
+	rpmTagSummary           = 1004
+	rpmTagDescription       = 1005
+	rpmTagBuildTime         = 1006
+	rpmTagBuildHost         = 1007
+	rpmTagSize              = 1009
+	rpmTagLicense           = 1014
+	rpmTagPackager          = 1015
+	rpmTagGroup             = 1016
+	rpmTagURL               = 1020
+	rpmTagOS                = 1021
+	rpmTagArch              = 1022
+	rpmTagPostIn            = 1024
+	rpmTagPreUn             = 1025
+	rpmTagPostUn            = 1026
+	rpmTagFileSizes         = 1028
+	rpmTagFileModes         = 1030
+	rpmTagFileRDevs         = 1033
+	rpmTagFileMTimes        = 1034
+	rpmTagFileDigests       = 1035
+	rpmTagFileLinkTos       = 1036
+	rpmTagFileFlags         = 1037
+	rpmTagFileUserName      = 1039
+	rpmTagFileGroupName     = 1040
+	rpmTagSourceRPM         = 1044
+	rpmTagFileVerifyFlags   = 1045
+	rpmTagProvideName       = 1047
+	rpmTagRequireFlags      = 1048
+	rpmTagRequireName       = 1049
+	rpmTagRequireVersion    = 1050
+	rpmTagRPMVersion        = 1064
+	rpmTagPostInProg        = 1086
+	rpmTagPreUnProg         = 1087
+	rpmTagPostUnProg        = 1088
+	rpmTagFileDevices       = 1095
+	rpmTagFileInodes        = 1096
+	rpmTagFileLangs         = 1097
+	rpmTagProvideFlags      = 1112
+	rpmTagProvideVersion    = 1113
+	rpmTagDirIndexes        = 1116
+	rpmTagBaseNames         = 1117
+	rpmTagDirNames          = 1118
+	rpmTagPayloadFormat     = 1124
+	rpmTagPayloadCompressor = 1125
+	rpmTagPayloadFlags      = 1126
+	rpmTagFileDigestAlgo    = 5011
+)
+
+// RPM header value types
+const (
+	rpmTypeInt16       = 3
+	rpmTypeInt32       = 4
+	rpmTypeString      = 6
+	rpmTypeBin         = 7
+	rpmTypeStringArray = 8
+	rpmTypeI18NString  = 9
+)
+
+const (
+	rpmSenseEqual  = 0x08
+	rpmSenseLess   = 0x02
+	rpmSenseRPMLib = 1 << 24
+
+	// rpmDigestSHA256 is PGPHASHALGO_SHA256, the algorithm of file digests
+	rpmDigestSHA256 = 8
+)
+
+// rpmLibRequires are the rpmlib features the payload relies on
+var rpmLibRequires = [][2]string{
+	{"rpmlib(CompressedFileNames)", "3.0.4-1"},
+	{"rpmlib(FileDigests)", "4.6.0-1"},
+	{"rpmlib(PayloadFilesHavePrefix)", "4.0-1"},
+}
+
+// writeRPM writes an RPM v3 package: lead, signature header, header and a
+// gzip-compressed cpio payload. Only directories the package owns are listed;
+// rpm creates system directories such as /usr/bin from the filesystem package.
+func writeRPM(w io.Writer, s Spec, files []File, scripts Scripts) error {
+	arch, err := Architecture(FormatRPM, s.Arch)
+	if err != nil {
+		return err
+	}
+	version, err := NormalizeVersion(s.Version)
+	if err != nil {
+		return err
+	}
+
+	var owned []File
+	for _, file := range files {
+		if !file.IsDir() || ownedDirectory(file.Path) {
+			owned = append(owned, file)
+		}
+	}
+
+	mtime := int32(s.BuildTime.Unix())
+	cpio, err := cpioArchive(owned, mtime)
+	if err != nil {
+		return fmt.Errorf("failed to build payload: %w", err)
+	}
+
+	var payload bytes.Buffer
+	gz, _ := gzip.NewWriterLevel(&payload, gzip.BestCompression)
+	gz.ModTime = s.BuildTime
+	if _, err := gz.Write(cpio); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+
+	var (
+		sizes, mtimes, flags, verify, devices, inodes, dirIndexes []int32
+		modes, rdevs                                              []uint16
+		digests, linkTos, users, groups, langs, baseNames         []string
+		dirNames                                                  []string
+		totalSize                                                 int32
+	)
+	dirIndex := make(map[string]int32)
+	for i, file := range owned {
+		dir, base := path.Split(file.Path)
+		if _, ok := dirIndex[dir]; !ok {
+			dirIndex[dir] = int32(len(dirNames))
+			dirNames = append(dirNames, dir)
+		}
+
+		mode := uint16(0100000) | uint16(file.Mode.Perm())
+		digest := fmt.Sprintf("%x", sha256.Sum256(file.Data))
+		size := int32(len(file.Data))
+		if file.IsDir() {
+			mode = uint16(040000) | uint16(file.Mode.Perm())
+			digest = ""
+			size = 0
+		}
+		totalSize += size
+
+		sizes = append(sizes, size)
+		modes = append(modes, mode)
+		rdevs = append(rdevs, 0)
+		mtimes = append(mtimes, mtime)
+		digests = append(digests, digest)
+		linkTos = append(linkTos, "")
+		flags = append(flags, 0)
+		users = append(users, "root")
+		groups = append(groups, "root")
+		verify = append(verify, -1)
+		devices = append(devices, 1)
+		inodes = append(inodes, int32(i+1))
+		langs = append(langs, "")
+		dirIndexes = append(dirIndexes, dirIndex[dir])
+		baseNames = append(baseNames, base)
+	}
+
+	requireNames := []string{"/bin/sh"}
+	requireVersions := []string{""}
+	requireFlags := []int32{0}
+	for _, lib := range rpmLibRequires {
+		requireNames = append(requireNames, lib[0])
+		requireVersions = append(requireVersions, lib[1])
+		requireFlags = append(requireFlags, rpmSenseRPMLib|rpmSenseLess|rpmSenseEqual)
+	}
+
+	h := &rpmHeader{}
+	h.stringArray(rpmTagHeaderI18NTable, []string{"C"})
+	h.string(rpmTagName, PackageName)
+	h.string(rpmTagVersion, version)
+	h.string(rpmTagRelease, s.Release)
+	h.i18n(rpmTagSummary, summary)
+	h.i18n(rpmTagDescription, description)
+	h.int32(rpmTagBuildTime, mtime)
+	h.string(rpmTagBuildHost, "localhost")
+	h.int32(rpmTagSize, totalSize)
+	h.string(rpmTagLicense, "Proprietary")
+	h.string(rpmTagPackager, s.Maintainer)
+	h.i18n(rpmTagGroup, "System Environment/Daemons")
+	h.string(rpmTagURL, homepage)
+	h.string(rpmTagOS, "linux")
+	h.string(rpmTagArch, arch)
+	h.string(rpmTagPostIn, scripts.PostInstall)
+	h.string(rpmTagPreUn, scripts.PreRemove)
+	h.string(rpmTagPostUn, scripts.PostRemove)
+	h.string(rpmTagPostInProg, "/bin/sh")
+	h.string(rpmTagPreUnProg, "/bin/sh")
+	h.string(rpmTagPostUnProg, "/bin/sh")
+	h.int32(rpmTagFileSizes, sizes...)
+	h.int16(rpmTagFileModes, modes...)
+	h.int16(rpmTagFileRDevs, rdevs...)
+	h.int32(rpmTagFileMTimes, mtimes...)
+	h.stringArray(rpmTagFileDigests, digests)
+	h.stringArray(rpmTagFileLinkTos, linkTos)
+	h.int32(rpmTagFileFlags, flags...)
+	h.stringArray(rpmTagFileUserName, users)
+	h.stringArray(rpmTagFileGroupName, groups)
+	h.string(rpmTagSourceRPM, fmt.Sprintf("%s-%s-%s.src.rpm", PackageName, version, s.Release))
+	h.int32(rpmTagFileVerifyFlags, verify...)
+	h.stringArray(rpmTagProvideName, []string{PackageName})
+	h.int32(rpmTagProvideFlags, rpmSenseEqual)
+	h.stringArray(rpmTagProvideVersion, []string{version + "-" + s.Release})
+	h.int32(rpmTagRequireFlags, requireFlags...)
+	h.stringArray(rpmTagRequireName, requireNames)
+	h.stringArray(rpmTagRequireVersion, requireVersions)
+	h.string(rpmTagRPMVersion, "4.16.0")
+	h.int32(rpmTagFileDevices, devices...)
+	h.int32(rpmTagFileInodes, inodes...)
+	h.stringArray(rpmTagFileLangs, langs)
+	h.int32(rpmTagDirIndexes, dirIndexes...)
+	h.stringArray(rpmTagBaseNames, baseNames)
+	h.stringArray(rpmTagDirNames, dirNames)
+	h.string(rpmTagPayloadFormat, "cpio")
+	h.string(rpmTagPayloadCompressor, "gzip")
+	h.string(rpmTagPayloadFlags, "9")
+	h.int32(rpmTagFileDigestAlgo, rpmDigestSHA256)
+	header := h.marshal(rpmTagHeaderImmutable)
+
+	headerSHA1 := sha1.Sum(header)
+	headerSHA256 := sha256.Sum256(header)
+	signed := md5.New()
+	signed.Write(header)
+	signed.Write(payload.Bytes())
+
+	sig := &rpmHeader{}
+	sig.string(rpmSigTagSHA1, fmt.Sprintf("%x", headerSHA1))
+	sig.string(rpmSigTagSHA256, fmt.Sprintf("%x", headerSHA256))
+	sig.int32(rpmSigTagSize, int32(len(header)+payload.Len()))
+	sig.bin(rpmSigTagMD5, signed.Sum(nil))
+	sig.int32(rpmSigTagPayloadSize, int32(len(cpio)))
+	signature := sig.marshal(rpmTagHeaderSignatures)
+	// The header that follows the signature starts on an 8-byte boundary
+	if pad := len(signature) % 8; pad != 0 {
+		signature = append(signature, make([]byte, 8-pad)...)
+	}
+
+	for _, part := range [][]byte{rpmLead(fmt.Sprintf("%s-%s-%s", PackageName, version, s.Release)), signature, header, payload.Bytes()} {
+		if _, err := w.Write(part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rpmLead is the legacy 96-byte preamble of a binary package
+func rpmLead(name string) []byte {
+	lead := make([]byte, 96)
+	copy(lead, []byte{0xed, 0xab, 0xee, 0xdb, 3, 0})
+	binary.BigEndian.PutUint16(lead[6:], 0) // binary package
+	binary.BigEndian.PutUint16(lead[8:], 1) // archnum, unused by rpm 4
+	copy(lead[10:75], name)
+	binary.BigEndian.PutUint16(lead[76:], 1) // Linux
+	binary.BigEndian.PutUint16(lead[78:], 5) // header-style signature
+	return lead
+}
+
+type rpmEntry struct {
+	tag, kind, count int32
+	data             []byte
+}
+
+// rpmHeader collects tagged values and serializes them as an RPM header
+type rpmHeader struct {
+	entries []rpmEntry
+}
+
+func (h *rpmHeader) add(tag, kind int32, count int, data []byte) {
+	h.entries = append(h.entries, rpmEntry{tag: tag, kind: kind, count: int32(count), data: data})
+}
+
+func (h *rpmHeader) string(tag int32, value string) {
+	h.add(tag, rpmTypeString, 1, append([]byte(value), 0))
+}
+
+func (h *rpmHeader) i18n(tag int32, value string) {
+	h.add(tag, rpmTypeI18NString, 1, append([]byte(value), 0))
+}
+
+func (h *rpmHeader) stringArray(tag int32, values []string) {
+	var data []byte
+	for _, value := range values {
+		data = append(append(data, value...), 0)
+	}
+	h.add(tag, rpmTypeStringArray, len(values), data)
+}
+
+func (h *rpmHeader) bin(tag int32, value []byte) {
+	h.add(tag, rpmTypeBin, len(value), value)
+}
+
+func (h *rpmHeader) int32(tag int32, values ...int32) {
+	data := make([]byte, 4*len(values))
+	for i, value := range values {
+		binary.BigEndian.PutUint32(data[4*i:], uint32(value))
+	}
+	h.add(tag, rpmTypeInt32, len(values), data)
+}
+
+func (h *rpmHeader) int16(tag int32, values ...uint16) {
+	data := make([]byte, 2*len(values))
+	for i, value := range values {
+		binary.BigEndian.PutUint16(data[2*i:], value)
+	}
+	h.add(tag, rpmTypeInt16, len(values), data)
+}
+
+// marshal serializes the header with a region tag covering every entry,
+// as rpm expects of the signature and immutable headers
+func (h *rpmHeader) marshal(regionTag int32) []byte {
+	entries := append([]rpmEntry(nil), h.entries...)
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].tag < entries[j].tag })
+
+	var store bytes.Buffer
+	offsets := make([]int32, len(entries))
+	for i, entry := range entries {
+		align := 1
+		switch entry.kind {
+		case rpmTypeInt16:
+			align = 2
+		case rpmTypeInt32:
+			align = 4
+		}
+		for store.Len()%align != 0 {
+			store.WriteByte(0)
+		}
+		offsets[i] = int32(store.Len())
+		store.Write(entry.data)
+	}
+
+	count := int32(len(entries) + 1)
+	trailerOffset := int32(store.Len())
+	trailer := make([]byte, 16)
+	binary.BigEndian.PutUint32(trailer[0:], uint32(regionTag))
+	binary.BigEndian.PutUint32(trailer[4:], rpmTypeBin)
+	binary.BigEndian.PutUint32(trailer[8:], uint32(-count*16))
+	binary.BigEndian.PutUint32(trailer[12:], 16)
+	store.Write(trailer)
+
+	var out bytes.Buffer
+	out.Write([]byte{0x8e, 0xad, 0xe8, 0x01, 0, 0, 0, 0})
+	binary.Write(&out, binary.BigEndian, count)
+	binary.Write(&out, binary.BigEndian, int32(store.Len()))
+	binary.Write(&out, binary.BigEndian, []int32{regionTag, rpmTypeBin, trailerOffset, 16})
+	for i, entry := range entries {
+		binary.Write(&out, binary.BigEndian, []int32{entry.tag, entry.kind, offsets[i], entry.count})
+	}
+	out.Write(store.Bytes())
+	return out.Bytes()
+}
+
+// cpioArchive writes files in the SVR4 "newc" format with ./-prefixed names
+func cpioArchive(files []File, mtime int32) ([]byte, error) {
+	var buf bytes.Buffer
+	write := func(name string, ino int, mode uint32, data []byte) {
+		fmt.Fprintf(&buf, "070701%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x",
+			ino, mode, 0, 0, 1, uint32(mtime), len(data), 0, 0, 0, 0, len(name)+1, 0)
+		buf.WriteString(name)
+		buf.WriteByte(0)
+		for buf.Len()%4 != 0 {
+			buf.WriteByte(0)
+		}
+		buf.Write(data)
+		for buf.Len()%4 != 0 {
+			buf.WriteByte(0)
+		}
+	}
+
+	for i, file := range files {
+		if !strings.HasPrefix(file.Path, "/") {
+			return nil, fmt.Errorf("payload path %q is not absolute", file.Path)
+		}
+		mode := uint32(0100000) | uint32(file.Mode.Perm())
+		data := file.Data
+		if file.Mode&os.ModeDir != 0 {
+			mode = uint32(040000) | uint32(file.Mode.Perm())
+			data = nil
+		}
+		write("."+file.Path, i+1, mode, data)
+	}
+	write("TRAILER!!!", 0, 0, nil)
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,58 @@
+package policy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"time"
+
+	"p0-ssh-agent/types"
+)
+
+// RuleHostDisabled identifies requests refused by the host's kill switch
+const RuleHostDisabled = "hostDisabled"
+
+// maxDisabledReasonBytes bounds the reason read from the kill switch file
+const maxDisabledReasonBytes = 1024
+
+// CheckDisabled returns the kill switch state while a file exists at path, or
+// nil when there is none. The first line of the file, if any, is the reason.
+// A path that cannot be checked, e.g. for lack of permission, counts as
+// disabled, so the switch fails closed for grants.
+func CheckDisabled(path string) *types.HostDisabled {
+	info, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return &types.HostDisabled{File: path, Reason: fmt.Sprintf("kill switch cannot be checked: %v", err)}
+	}
+
+	disabled := &types.HostDisabled{
+		File:  path,
+		Since: info.ModTime().UTC().Format(time.RFC3339),
+	}
+	if file, err := os.Open(path); err == nil {
+		defer file.Close()
+		line, _ := bufio.NewReader(io.LimitReader(file, maxDisabledReasonBytes)).ReadString('\n')
+		disabled.Reason = strings.TrimSpace(line)
+	}
+	return disabled
+}
+
+// DisabledViolation is the error returned for grants refused by the kill
+// switch
+func DisabledViolation(disabled *types.HostDisabled) *Violation {
+	message := "grants are disabled on this host by " + disabled.File
+	if disabled.Reason != "" {
+		message += ": " + disabled.Reason
+	}
+	return &Violation{
+		Rule:    RuleHostDisabled,
+		Message: message,
+	}
+}
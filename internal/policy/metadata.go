@@ -0,0 +1,69 @@
+package policy
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MetadataHeaderPrefix introduces metadata sent as request headers, e.g.
+// X-P0-Metadata-Ticket carries the "ticket" field
+const MetadataHeaderPrefix = "x-p0-metadata-"
+
+// StatusRejected is the result status of a request refused by policy
+const StatusRejected = "rejected"
+
+// RuleRequiredMetadata identifies violations of requiredMetadata
+const RuleRequiredMetadata = "requiredMetadata"
+
+// Violation is the structured error returned to the backend when a request
+// does not satisfy the agent's policy
+type Violation struct {
+	Rule    string   `json:"rule"`
+	Missing []string `json:"missing,omitempty"`
+	Message string   `json:"message"`
+}
+
+func (v *Violation) Error() string {
+	return v.Message
+}
+
+// RequireMetadata checks that every required field has a non-empty value in
+// the payload metadata or in an X-P0-Metadata-<field> header. Field names are
+// case-insensitive. It returns nil when all fields are present.
+func RequireMetadata(required []string, metadata map[string]string, headers map[string]string) *Violation {
+	if len(required) == 0 {
+		return nil
+	}
+
+	present := make(map[string]bool)
+	for field, value := range metadata {
+		if strings.TrimSpace(value) != "" {
+			present[strings.ToLower(field)] = true
+		}
+	}
+	for key, value := range headers {
+		lower := strings.ToLower(key)
+		if !strings.HasPrefix(lower, MetadataHeaderPrefix) {
+			continue
+		}
+		if strings.TrimSpace(value) != "" {
+			present[strings.TrimPrefix(lower, MetadataHeaderPrefix)] = true
+		}
+	}
+
+	var missing []string
+	for _, field := range required {
+		if !present[strings.ToLower(field)] {
+			missing = append(missing, field)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	return &Violation{
+		Rule:    RuleRequiredMetadata,
+		Missing: missing,
+		Message: fmt.Sprintf("grant rejected by host policy: missing required metadata %s", strings.Join(missing, ", ")),
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !freebsd && !darwin
+
+package recording
+
+import (
+	"fmt"
+	"net"
+)
+
+// Sessions are only recorded on Linux, FreeBSD and macOS
+func peerCredentials(conn net.Conn) (uid, pid int, err error) {
+	return 0, 0, fmt.Errorf("session recording is not supported on this OS")
+}
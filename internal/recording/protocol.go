@@ -0,0 +1,129 @@
+package recording
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Streams of a recording. The wrapper sends each in frames and the agent
+// writes it to the recording's file with the stream's extension.
+const (
+	streamStart byte = iota
+	streamLog
+	streamTiming
+	streamTlog
+	streamStdin
+	streamStdout
+	streamStderr
+
+	// streamExit carries the exit code and ends the session
+	streamExit
+)
+
+// streamExts are the extensions of the files of each recorded stream
+var streamExts = map[byte]string{
+	streamLog:    ".log",
+	streamTiming: ".timing",
+	streamTlog:   ".tlog",
+	streamStdin:  ".stdin",
+	streamStdout: ".stdout",
+	streamStderr: ".stderr",
+}
+
+// maxFrame bounds the data of one frame
+const maxFrame = 64 << 10
+
+// start opens a session. It is what the wrapper knows of the session; the
+// agent takes the user and pid from the socket instead.
+type start struct {
+	RequestIDs []string `json:"requestIds"`
+	Command    string   `json:"command,omitempty"`
+	Client     string   `json:"client,omitempty"`
+	TTY        bool     `json:"tty"`
+	Recorder   string   `json:"recorder"`
+	PID        int      `json:"pid"`
+}
+
+// writeFrame sends data of stream as a frame: the stream, the length of the
+// data as a big-endian uint32, then the data
+func writeFrame(w io.Writer, stream byte, data []byte) error {
+	header := make([]byte, 5)
+	header[0] = stream
+	binary.BigEndian.PutUint32(header[1:], uint32(len(data)))
+	if _, err := w.Write(append(header, data...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// readFrame reads the next frame written by writeFrame
+func readFrame(r *bufio.Reader) (byte, []byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > maxFrame {
+		return 0, nil, fmt.Errorf("frame of %d bytes exceeds %d", size, maxFrame)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 0, nil, err
+	}
+	return header[0], data, nil
+}
+
+// sink sends the streams of a session to the agent. The first failed write
+// calls onFail, which ends the session: it must not go on unrecorded.
+type sink struct {
+	mu     sync.Mutex
+	w      io.Writer
+	err    error
+	onFail func()
+}
+
+func (s *sink) send(stream byte, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+
+	for {
+		chunk := data
+		if len(chunk) > maxFrame {
+			chunk = chunk[:maxFrame]
+		}
+		if err := writeFrame(s.w, stream, chunk); err != nil {
+			s.err = fmt.Errorf("lost the connection to the session recorder: %w", err)
+			if s.onFail != nil {
+				go s.onFail()
+			}
+			return s.err
+		}
+		data = data[len(chunk):]
+		if len(data) == 0 {
+			return nil
+		}
+	}
+}
+
+// writer returns a writer sending to stream
+func (s *sink) writer(stream byte) io.Writer {
+	return streamWriter{sink: s, stream: stream}
+}
+
+type streamWriter struct {
+	sink   *sink
+	stream byte
+}
+
+func (w streamWriter) Write(p []byte) (int, error) {
+	if err := w.sink.send(w.stream, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,317 @@
+package recording
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"p0-ssh-agent/types"
+)
+
+// MetadataExt names the file describing a recording; the recorder's own
+// files share its base name
+const MetadataExt = ".json"
+
+// Metadata describes a recorded session. The agent writes it when the
+// session starts and again with EndedAt when it ends, with ExitCode unless
+// the wrapper went away without one.
+type Metadata struct {
+	UserName   string   `json:"userName"`
+	RequestIDs []string `json:"requestIds"`
+	Command    string   `json:"command,omitempty"`
+	Client     string   `json:"client,omitempty"`
+	TTY        bool     `json:"tty"`
+
+	// Recorder is script or tlog, or pipe for sessions without a terminal
+	Recorder string `json:"recorder"`
+
+	PID       int    `json:"pid"`
+	StartedAt string `json:"startedAt"`
+	EndedAt   string `json:"endedAt,omitempty"`
+	ExitCode  *int   `json:"exitCode,omitempty"`
+}
+
+// recorderPipe marks sessions without a terminal, such as scp, sftp and
+// remote commands. Their standard streams are recorded as they pass through
+// the wrapper: a recorder would put them on a pty and corrupt binary data.
+const recorderPipe = "pipe"
+
+// sftpServers are where distributions install sftp-server, which serves the
+// internal-sftp subsystem once ForceCommand is in the way
+var sftpServers = []string{
+	"/usr/lib/openssh/sftp-server",
+	"/usr/libexec/openssh/sftp-server",
+	"/usr/lib/ssh/sftp-server",
+	"/usr/libexec/sftp-server",
+}
+
+// Options configure Run
+type Options struct {
+	Recorder   string
+	Socket     string
+	RequestIDs []string
+}
+
+// Run is the ForceCommand of recorded users. It runs the command the client
+// asked for, or a login shell, and returns its exit code. Everything the
+// session records is sent to the agent on Socket, which owns the files; the
+// session is refused when the agent does not take it and ended when the
+// agent stops receiving it.
+func Run(options Options) (int, error) {
+	shell := os.Getenv("SHELL")
+	if shell == "" {
+		shell = "/bin/sh"
+	}
+	original := os.Getenv("SSH_ORIGINAL_COMMAND")
+	tty := os.Getenv("SSH_TTY") != ""
+
+	session := start{
+		RequestIDs: options.RequestIDs,
+		Command:    original,
+		Client:     os.Getenv("SSH_CONNECTION"),
+		TTY:        tty,
+		Recorder:   options.Recorder,
+		PID:        os.Getpid(),
+	}
+	if !tty {
+		session.Recorder = recorderPipe
+	}
+
+	conn, err := open(options.Socket, session)
+	if err != nil {
+		return 1, err
+	}
+	defer conn.Close()
+
+	out := &sink{w: conn}
+	var code int
+	if tty {
+		code, err = runRecorder(out, session.Recorder, shell, original)
+	} else {
+		code, err = runPiped(out, shell, original)
+	}
+
+	exit := make([]byte, 4)
+	binary.BigEndian.PutUint32(exit, uint32(code))
+	if sendErr := out.send(streamExit, exit); sendErr != nil && err == nil {
+		err = sendErr
+	}
+	return code, err
+}
+
+// open starts the session with the agent and waits for it to accept
+func open(socket string, session start) (net.Conn, error) {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("the agent is not recording sessions: %w", err)
+	}
+
+	data, err := json.Marshal(session)
+	if err == nil {
+		err = writeFrame(conn, streamStart, data)
+	}
+	var reply string
+	if err == nil {
+		reply, err = bufio.NewReader(conn).ReadString('\n')
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("the agent did not start the recording: %w", err)
+	}
+	if reply = strings.TrimSpace(reply); reply != replyOK {
+		conn.Close()
+		return nil, fmt.Errorf("the agent refused the recording: %s", reply)
+	}
+	return conn, nil
+}
+
+// runRecorder runs the session on a pty under recorder. The recorder writes
+// to FIFOs in a private directory, which the wrapper forwards to the agent.
+func runRecorder(out *sink, recorder, shell, original string) (int, error) {
+	dir, err := os.MkdirTemp("", "p0-recording-")
+	if err != nil {
+		return 1, fmt.Errorf("failed to create the recorder's directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A login shell when the client asked for no command
+	run := original
+	if run == "" {
+		run = "exec " + shellQuote(shell) + " -l"
+	}
+
+	var streams []byte
+	var cmd *exec.Cmd
+	fifo := func(stream byte) string {
+		streams = append(streams, stream)
+		return filepath.Join(dir, "session"+streamExts[stream])
+	}
+	switch recorder {
+	case types.SessionRecorderTlog:
+		cmd = exec.Command("tlog-rec-session", "--writer=file", "--file-path="+fifo(streamTlog), "-c", run)
+	case types.SessionRecorderScript:
+		cmd = scriptCommand(shell, run, fifo(streamLog), fifo(streamTiming))
+	default:
+		return 1, fmt.Errorf("unknown recorder %q", recorder)
+	}
+
+	out.onFail = func() { terminate(cmd) }
+	var copies sync.WaitGroup
+	for _, stream := range streams {
+		path := filepath.Join(dir, "session"+streamExts[stream])
+		if err := mkfifo(path); err != nil {
+			return 1, fmt.Errorf("failed to create %s: %w", path, err)
+		}
+		copies.Add(1)
+		go func(stream byte) {
+			defer copies.Done()
+			forward(out, stream, path)
+		}(stream)
+	}
+
+	code, err := runForwardingSignals(cmd)
+
+	// Readers still waiting for a recorder that never opened its files
+	for _, stream := range streams {
+		unblockFIFO(filepath.Join(dir, "session"+streamExts[stream]))
+	}
+	copies.Wait()
+	return code, err
+}
+
+// forward sends what the recorder writes to the FIFO at path to the agent.
+// Should the agent stop receiving, the FIFO is closed and the recorder,
+// failing to write, ends the session.
+func forward(out *sink, stream byte, path string) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	io.Copy(out.writer(stream), file)
+}
+
+// runPiped runs a session without a terminal, recording its standard streams
+// as they pass through
+func runPiped(out *sink, shell, original string) (int, error) {
+	cmd, err := plainCommand(shell, original)
+	if err != nil {
+		return 1, err
+	}
+
+	cmd.Stdin = io.TeeReader(os.Stdin, out.writer(streamStdin))
+	cmd.Stdout = io.MultiWriter(os.Stdout, out.writer(streamStdout))
+	cmd.Stderr = io.MultiWriter(os.Stderr, out.writer(streamStderr))
+	// The client may hold stdin open after the command exits
+	cmd.WaitDelay = time.Second
+
+	out.onFail = func() { terminate(cmd) }
+	return runSignaled(cmd)
+}
+
+// plainCommand returns the command of a session without a terminal
+func plainCommand(shell, original string) (*exec.Cmd, error) {
+	if original == "" {
+		return exec.Command(shell, "-l"), nil
+	}
+	if original == "internal-sftp" {
+		server, err := sftpServer()
+		if err != nil {
+			return nil, err
+		}
+		return exec.Command(server), nil
+	}
+	return exec.Command(shell, "-c", original), nil
+}
+
+// scriptCommand records keystrokes and output with util-linux script 2.35 or
+// later, output only with older versions, and input and output with the -r
+// option of the BSD script
+func scriptCommand(shell, run, logPath, timingPath string) *exec.Cmd {
+	if runtime.GOOS != "linux" {
+		return exec.Command("script", "-q", "-F", "-r", logPath, shell, "-c", run)
+	}
+
+	help, _ := exec.Command("script", "--help").CombinedOutput()
+	if strings.Contains(string(help), "--log-io") {
+		return exec.Command("script", "-q", "-f", "-e", "--log-io", logPath, "--log-timing", timingPath, "-c", run)
+	}
+	return exec.Command("script", "-q", "-f", "-e", "--timing="+timingPath, "-c", run, logPath)
+}
+
+func sftpServer() (string, error) {
+	for _, path := range sftpServers {
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("sftp-server not found in %s", strings.Join(sftpServers, ", "))
+}
+
+// runForwardingSignals runs cmd on the session's standard streams, passing
+// on hangups and terminations so the recorder can close its files
+func runForwardingSignals(cmd *exec.Cmd) (int, error) {
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	return runSignaled(cmd)
+}
+
+// runSignaled runs cmd, passing on hangups and terminations, and returns
+// its exit code
+func runSignaled(cmd *exec.Cmd) (int, error) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	if err := cmd.Start(); err != nil {
+		return 127, err
+	}
+	go func() {
+		for sig := range signals {
+			cmd.Process.Signal(sig)
+		}
+	}()
+
+	// ErrWaitDelay is only returned for a command that exited cleanly
+	err := cmd.Wait()
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil, errors.Is(err, exec.ErrWaitDelay):
+		return 0, nil
+	case errors.As(err, &exitErr):
+		if code := exitErr.ExitCode(); code >= 0 {
+			return code, nil
+		}
+		// Killed by a signal, reported the way shells do
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return 128 + int(status.Signal()), nil
+		}
+		return 1, nil
+	default:
+		return 1, err
+	}
+}
+
+// terminate ends the session once it can no longer be recorded
+func terminate(cmd *exec.Cmd) {
+	if cmd.Process != nil {
+		cmd.Process.Kill()
+	}
+}
+
+// shellQuote quotes value for sh -c
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
@@ -0,0 +1,374 @@
+package recording
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/internal/unixsocket"
+)
+
+// replyOK accepts a session; any other reply line is the reason it was refused
+const replyOK = "ok"
+
+// startTimeout bounds how long a wrapper may take to start its session
+const startTimeout = 10 * time.Second
+
+// spoolScanInterval is how often the size of the spool is measured again;
+// in between, what sessions record is added to the last measurement
+const spoolScanInterval = 10 * time.Second
+
+// ErrSpoolFull ends or refuses sessions while the spool holds maxSpoolBytes
+var ErrSpoolFull = errors.New("the session recording spool is full")
+
+// namePattern matches request IDs and user names safe in a file name
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._@-]*$`)
+
+// live holds the base names of the recordings this process is writing
+var live sync.Map
+
+// Recorded reports whether the sessions of a user are forced through the
+// recorder, and the requests they are recorded for
+type Recorded func(userName string) (requestIDs []string, ok bool)
+
+// ServerConfig configure Serve
+type ServerConfig struct {
+	SpoolDir string
+
+	// Recorded decides which users may send sessions and what they are
+	// credited to; the start a wrapper sends is never trusted for either
+	Recorded Recorded
+
+	// MaxRecordingBytes ends a session once it recorded that much
+	MaxRecordingBytes int64
+
+	// MaxSpoolBytes ends sessions and refuses new ones while the spool holds that much
+	MaxSpoolBytes int64
+}
+
+// Server records the sessions the wrappers of recorded users send it. The
+// files are created by the agent in a spool only it can read, so the users
+// recorded cannot change them.
+type Server struct {
+	config   ServerConfig
+	listener net.Listener
+	logger   *logrus.Logger
+	wg       sync.WaitGroup
+
+	// spoolMu guards the size of the spool as last measured at scanned, plus
+	// what sessions recorded since
+	spoolMu   sync.Mutex
+	spoolUsed int64
+	scanned   time.Time
+}
+
+// Serve creates the spool and records sessions sent to socketPath until
+// closed. The socket is world-accessible, as every recorded user connects,
+// but only sessions of users config.Recorded reports are taken.
+func Serve(socketPath string, config ServerConfig, logger *logrus.Logger) (*Server, error) {
+	spoolDir := config.SpoolDir
+	if err := os.MkdirAll(spoolDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", spoolDir, err)
+	}
+	if err := os.Chmod(spoolDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to set permissions on %s: %w", spoolDir, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create the recording socket directory: %w", err)
+	}
+	listener, err := unixsocket.Listen(socketPath, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &Server{config: config, listener: listener, logger: logger}
+	server.wg.Add(1)
+	go server.accept()
+
+	logger.WithField("socket", socketPath).Info("🎥 Recording sessions")
+	return server, nil
+}
+
+// Close stops accepting sessions and removes the socket. Sessions being
+// recorded go on until they end.
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) accept() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.logger.WithError(err).Error("Recording socket stopped")
+			}
+			return
+		}
+		go s.record(conn)
+	}
+}
+
+// record writes the session sent on conn to the spool
+func (s *Server) record(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	meta, err := s.open(conn, reader)
+	if err != nil {
+		s.logger.WithError(err).Warn("🎥 Refused a session recording")
+		fmt.Fprintf(conn, "%s\n", err)
+		return
+	}
+
+	if !s.reserve(0) {
+		s.logger.WithField("user", meta.UserName).Error("🎥 Refused a session recording: the spool is full")
+		fmt.Fprintf(conn, "%s\n", ErrSpoolFull)
+		return
+	}
+
+	rec, err := create(s.config.SpoolDir, meta)
+	if err != nil {
+		s.logger.WithError(err).Error("🎥 Failed to start a session recording")
+		fmt.Fprintf(conn, "failed to start the recording\n")
+		return
+	}
+	defer rec.close()
+
+	if _, err := fmt.Fprintf(conn, "%s\n", replyOK); err != nil {
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	for {
+		stream, data, err := readFrame(reader)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				s.logger.WithError(err).WithField("recording", rec.base).Warn("🎥 Session recording ended early")
+			}
+			return
+		}
+		if stream == streamExit && len(data) == 4 {
+			code := int(int32(binary.BigEndian.Uint32(data)))
+			rec.meta.ExitCode = &code
+			return
+		}
+		if err := s.write(rec, stream, data); err != nil {
+			s.logger.WithError(err).WithField("recording", rec.base).Error("🎥 Failed to write a session recording")
+			return
+		}
+	}
+}
+
+// write records data of stream within the recording and spool limits
+func (s *Server) write(rec *recording, stream byte, data []byte) error {
+	size := int64(len(data))
+	if rec.size+size > s.config.MaxRecordingBytes {
+		return fmt.Errorf("the session recorded more than %d bytes", s.config.MaxRecordingBytes)
+	}
+	if !s.reserve(size) {
+		return ErrSpoolFull
+	}
+	rec.size += size
+	return rec.write(stream, data)
+}
+
+// reserve reports whether the spool has room for size more bytes and counts
+// them as used when it does
+func (s *Server) reserve(size int64) bool {
+	s.spoolMu.Lock()
+	defer s.spoolMu.Unlock()
+
+	if time.Since(s.scanned) > spoolScanInterval {
+		s.spoolUsed = spoolSize(s.config.SpoolDir)
+		s.scanned = time.Now()
+	}
+	if s.spoolUsed+size > s.config.MaxSpoolBytes {
+		return false
+	}
+	s.spoolUsed += size
+	return true
+}
+
+// spoolSize returns the size of the files in spoolDir, set aside recordings
+// included
+func spoolSize(spoolDir string) int64 {
+	var size int64
+	filepath.WalkDir(spoolDir, func(_ string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return nil
+		}
+		if info, err := entry.Info(); err == nil {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// open reads the start of a session. The user and pid come from the socket,
+// where the kernel can tell them, and the requests from the agent.
+func (s *Server) open(conn net.Conn, reader *bufio.Reader) (Metadata, error) {
+	uid, pid, err := peerCredentials(conn)
+	if err != nil {
+		return Metadata{}, fmt.Errorf("failed to identify the session's user: %w", err)
+	}
+
+	u, err := user.LookupId(strconv.Itoa(uid))
+	if err != nil {
+		return Metadata{}, fmt.Errorf("failed to identify the session's user: %w", err)
+	}
+	userName := u.Username
+
+	recorded, ok := s.config.Recorded(userName)
+	if !ok {
+		return Metadata{}, fmt.Errorf("sessions of %s are not recorded", userName)
+	}
+	var requestIDs []string
+	for _, requestID := range recorded {
+		if namePattern.MatchString(requestID) {
+			requestIDs = append(requestIDs, requestID)
+		}
+	}
+
+	conn.SetReadDeadline(time.Now().Add(startTimeout))
+	stream, data, err := readFrame(reader)
+	if err != nil || stream != streamStart {
+		return Metadata{}, fmt.Errorf("invalid session start")
+	}
+	var session start
+	if err := json.Unmarshal(data, &session); err != nil {
+		return Metadata{}, fmt.Errorf("invalid session start: %w", err)
+	}
+	if pid == 0 {
+		pid = session.PID
+	}
+
+	return Metadata{
+		UserName:   userName,
+		RequestIDs: requestIDs,
+		Command:    session.Command,
+		Client:     session.Client,
+		TTY:        session.TTY,
+		Recorder:   session.Recorder,
+		PID:        pid,
+		StartedAt:  time.Now().UTC().Format(time.RFC3339Nano),
+	}, nil
+}
+
+// recording is a session being written to the spool
+type recording struct {
+	base  string
+	meta  Metadata
+	files map[byte]*os.File
+
+	// size is how much the session recorded
+	size int64
+}
+
+// create writes the metadata of a new recording
+func create(spoolDir string, meta Metadata) (*recording, error) {
+	rec := &recording{
+		base:  filepath.Join(spoolDir, BaseName(meta)),
+		meta:  meta,
+		files: make(map[byte]*os.File),
+	}
+	if _, loaded := live.LoadOrStore(rec.base, true); loaded {
+		return nil, fmt.Errorf("recording %s already exists", rec.base)
+	}
+	if err := rec.writeMetadata(); err != nil {
+		live.Delete(rec.base)
+		return nil, err
+	}
+	return rec, nil
+}
+
+// write appends data to the file of stream, creating it on first use
+func (r *recording) write(stream byte, data []byte) error {
+	ext, ok := streamExts[stream]
+	if !ok {
+		return fmt.Errorf("unknown stream %d", stream)
+	}
+	file := r.files[stream]
+	if file == nil {
+		var err error
+		file, err = os.OpenFile(r.base+ext, os.O_WRONLY|os.O_CREATE|os.O_EXCL|noFollow, 0600)
+		if err != nil {
+			return err
+		}
+		r.files[stream] = file
+	}
+	_, err := file.Write(data)
+	return err
+}
+
+// close records the end of the session
+func (r *recording) close() {
+	for _, file := range r.files {
+		file.Close()
+	}
+	r.meta.EndedAt = time.Now().UTC().Format(time.RFC3339Nano)
+	r.writeMetadata()
+	live.Delete(r.base)
+}
+
+// writeMetadata replaces the metadata of the recording, never following a
+// link in its place
+func (r *recording) writeMetadata() error {
+	data, err := json.MarshalIndent(r.meta, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal session metadata: %w", err)
+	}
+
+	tmpPath := r.base + MetadataExt + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|noFollow, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write session metadata: %w", err)
+	}
+	_, err = file.Write(append(data, '\n'))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, r.base+MetadataExt)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write session metadata: %w", err)
+	}
+	return nil
+}
+
+// BaseName names the files of a recording after its first request, the user,
+// when it started and the wrapper's pid
+func BaseName(meta Metadata) string {
+	requestID := "unknown"
+	if len(meta.RequestIDs) > 0 {
+		requestID = meta.RequestIDs[0]
+	}
+	userName := meta.UserName
+	if !namePattern.MatchString(userName) {
+		userName = "unknown"
+	}
+	started := time.Now().UTC()
+	if t, err := time.Parse(time.RFC3339Nano, meta.StartedAt); err == nil {
+		started = t
+	}
+	return fmt.Sprintf("%s.%s.%s.%d", requestID, userName, started.Format("20060102T150405Z"), meta.PID)
+}
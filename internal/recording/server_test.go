@@ -0,0 +1,204 @@
+//go:build linux
+
+package recording
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// serve records sessions of the current user, credited to requestIDs, in a
+// temporary spool until the test ends
+func serve(t *testing.T, config ServerConfig, requestIDs ...string) (socket string, spoolDir string) {
+	t.Helper()
+	dir := t.TempDir()
+	socket = filepath.Join(dir, "recording.sock")
+	config.SpoolDir = filepath.Join(dir, "spool")
+	if config.Recorded == nil {
+		current, err := user.Current()
+		if err != nil {
+			t.Skipf("current user unknown: %v", err)
+		}
+		config.Recorded = func(userName string) ([]string, bool) {
+			return requestIDs, userName == current.Username
+		}
+	}
+	if config.MaxRecordingBytes == 0 {
+		config.MaxRecordingBytes = 1 << 20
+	}
+	if config.MaxSpoolBytes == 0 {
+		config.MaxSpoolBytes = 1 << 20
+	}
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	server, err := Serve(socket, config, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return socket, config.SpoolDir
+}
+
+// waitFinished waits for the agent to finish the recordings in spoolDir
+func waitFinished(t *testing.T, spoolDir string) []Recording {
+	t.Helper()
+	var recordings []Recording
+	var err error
+	for i := 0; i < 100 && len(recordings) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		if recordings, err = Finished(spoolDir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return recordings
+}
+
+func TestServerRecordsSession(t *testing.T) {
+	socket, spoolDir := serve(t, ServerConfig{}, "req-1", "../escape")
+
+	// The requests come from the agent, not from the wrapper
+	conn, err := open(socket, start{RequestIDs: []string{"forged"}, Command: "bash", Recorder: recorderPipe})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &sink{w: conn}
+	fmt.Fprint(out.writer(streamStdin), "id\n")
+	fmt.Fprint(out.writer(streamStdout), "uid=1000(alice)\n")
+	if err := out.send(streamExit, []byte{0, 0, 0, 3}); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	// The session ends once the agent has read the connection to its end
+	recordings := waitFinished(t, spoolDir)
+	if len(recordings) != 1 {
+		t.Fatalf("finished recordings %v, want one", recordings)
+	}
+	got := recordings[0]
+
+	if !strings.HasPrefix(got.Name, "req-1.") {
+		t.Errorf("name %q does not start with the request", got.Name)
+	}
+	if got.Metadata.PID == 0 || got.Metadata.UserName == "" || got.Metadata.EndedAt == "" {
+		t.Errorf("metadata %+v lacks the pid, user or end the agent records", got.Metadata)
+	}
+	if len(got.Metadata.RequestIDs) != 1 {
+		t.Errorf("request IDs %q, want only the one safe in a file name", got.Metadata.RequestIDs)
+	}
+	if got.Metadata.ExitCode == nil || *got.Metadata.ExitCode != 3 {
+		t.Errorf("exit code %v, want 3", got.Metadata.ExitCode)
+	}
+
+	stdout, err := os.ReadFile(filepath.Join(spoolDir, got.Name+".stdout"))
+	if err != nil || string(stdout) != "uid=1000(alice)\n" {
+		t.Errorf("stdout %q (%v)", stdout, err)
+	}
+	info, err := os.Stat(spoolDir)
+	if err != nil || info.Mode().Perm() != 0700 {
+		t.Errorf("spool mode %v (%v), want 0700", info.Mode().Perm(), err)
+	}
+}
+
+func TestServerRefusesUnrecordedUser(t *testing.T) {
+	socket, spoolDir := serve(t, ServerConfig{
+		Recorded: func(string) ([]string, bool) { return nil, false },
+	})
+
+	if conn, err := open(socket, start{RequestIDs: []string{"req-1"}, Recorder: recorderPipe}); err == nil {
+		conn.Close()
+		t.Fatal("a user without a forced recording started one")
+	}
+	if recordings, err := Finished(spoolDir); err != nil || len(recordings) != 0 {
+		t.Errorf("Finished = %v, %v; want none", recordings, err)
+	}
+}
+
+func TestServerEndsOversizedRecording(t *testing.T) {
+	socket, spoolDir := serve(t, ServerConfig{MaxRecordingBytes: 1024}, "req-1")
+
+	conn, err := open(socket, start{Recorder: recorderPipe})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	out := &sink{w: conn}
+	chunk := strings.Repeat("x", 512)
+	var sendErr error
+	for i := 0; i < 100 && sendErr == nil; i++ {
+		sendErr = out.send(streamStdout, []byte(chunk))
+		time.Sleep(time.Millisecond)
+	}
+	if sendErr == nil {
+		t.Fatal("the agent kept receiving past maxRecordingBytes")
+	}
+
+	recordings := waitFinished(t, spoolDir)
+	if len(recordings) != 1 {
+		t.Fatalf("finished recordings %v, want one", recordings)
+	}
+	stdout, err := os.ReadFile(filepath.Join(spoolDir, recordings[0].Name+".stdout"))
+	if err != nil || len(stdout) > 1024 {
+		t.Errorf("recorded %d bytes (%v), want at most 1024", len(stdout), err)
+	}
+}
+
+func TestServerRefusesSessionsWhenSpoolFull(t *testing.T) {
+	socket, spoolDir := serve(t, ServerConfig{MaxSpoolBytes: 1024}, "req-1")
+
+	if err := os.WriteFile(filepath.Join(spoolDir, "old.log"), make([]byte, 2048), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if conn, err := open(socket, start{Recorder: recorderPipe}); err == nil {
+		conn.Close()
+		t.Fatal("a session started with the spool full")
+	}
+}
+
+type rejectingShipper struct{}
+
+func (rejectingShipper) Name() string { return "rejecting" }
+
+func (rejectingShipper) Ship(Recording) error {
+	return fmt.Errorf("%w: too large", ErrRejected)
+}
+
+func TestShipFinishedSetsAsideRejected(t *testing.T) {
+	spoolDir := t.TempDir()
+	meta, _ := json.Marshal(Metadata{UserName: "alice", EndedAt: "2026-03-01T09:00:00Z"})
+	files := map[string][]byte{"req-1.alice.20260301T090000Z.42.json": meta, "req-1.alice.20260301T090000Z.42.log": []byte("output")}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(spoolDir, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A link in the spool is never followed
+	if err := os.Symlink("/etc/passwd", filepath.Join(spoolDir, "req-2.bob.20260301T090000Z.43.json")); err != nil {
+		t.Fatal(err)
+	}
+
+	shipped, err := ShipFinished(spoolDir, rejectingShipper{})
+	if shipped != 0 || err == nil {
+		t.Fatalf("ShipFinished = %d, %v; want 0 and the rejection", shipped, err)
+	}
+	for name := range files {
+		if _, err := os.Stat(filepath.Join(spoolDir, RejectedDir, name)); err != nil {
+			t.Errorf("%s not set aside: %v", name, err)
+		}
+	}
+
+	// Set aside recordings are not shipped again
+	if recordings, err := Finished(spoolDir); err != nil || len(recordings) != 0 {
+		t.Errorf("Finished = %v, %v; want none", recordings, err)
+	}
+}
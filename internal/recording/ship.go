@@ -0,0 +1,254 @@
+package recording
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"p0-ssh-agent/internal/awsv4"
+	"p0-ssh-agent/internal/elevate"
+	"p0-ssh-agent/types"
+)
+
+// MaxTunnelSize bounds the files of one recording sent over the tunnel, which
+// carries them in a single message
+const MaxTunnelSize = 16 << 20
+
+// ErrRejected is returned by a Shipper for a recording its destination will
+// never accept. Such a recording is set aside rather than retried.
+var ErrRejected = errors.New("recording rejected")
+
+// Shipper delivers finished recordings to their destination
+type Shipper interface {
+	// Name identifies the destination in logs
+	Name() string
+
+	// Ship delivers every file of recording. The spool is only cleaned up
+	// when it succeeds.
+	Ship(recording Recording) error
+}
+
+// Upload sends a recording to the backend with the tunnel destination
+type Upload func(request types.UploadSessionRecordingRequest) error
+
+// NewShipper builds the shipper of the configured destination. hostID names
+// this host in object keys of the s3 destination; upload is used by the
+// tunnel destination.
+func NewShipper(config *types.SessionRecording, hostID string, upload Upload) (Shipper, error) {
+	switch config.GetDestination() {
+	case types.RecordingDestinationLocal:
+		return &localShipper{dir: config.GetDir()}, nil
+	case types.RecordingDestinationS3:
+		return &s3Shipper{
+			bucket:   config.Bucket,
+			region:   config.Region,
+			prefix:   config.Prefix,
+			endpoint: strings.TrimRight(config.Endpoint, "/"),
+			hostID:   hostID,
+			client:   &http.Client{Timeout: config.GetTimeout()},
+		}, nil
+	case types.RecordingDestinationTunnel:
+		return &tunnelShipper{upload: upload}, nil
+	default:
+		return nil, fmt.Errorf("unknown session recording destination %q", config.GetDestination())
+	}
+}
+
+// ShipFinished ships the finished recordings in spoolDir and removes those
+// that were delivered. It returns how many were and the errors of the rest,
+// which stay for the next attempt unless they were rejected and set aside.
+func ShipFinished(spoolDir string, shipper Shipper) (int, error) {
+	recordings, err := Finished(spoolDir)
+	if err != nil {
+		return 0, err
+	}
+
+	shipped := 0
+	var errs []error
+	for _, recording := range recordings {
+		if err := shipper.Ship(recording); err != nil {
+			if errors.Is(err, ErrRejected) {
+				if asideErr := SetAside(spoolDir, recording); asideErr != nil {
+					err = errors.Join(err, asideErr)
+				} else {
+					err = fmt.Errorf("%w; kept in %s", err, filepath.Join(spoolDir, RejectedDir))
+				}
+			}
+			errs = append(errs, fmt.Errorf("%s: %w", recording.Name, err))
+			continue
+		}
+		if err := Remove(recording); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", recording.Name, err))
+			continue
+		}
+		shipped++
+	}
+	return shipped, errors.Join(errs...)
+}
+
+// localShipper moves recordings into a directory only root may read
+type localShipper struct {
+	dir string
+}
+
+func (s *localShipper) Name() string {
+	return s.dir
+}
+
+func (s *localShipper) Ship(recording Recording) error {
+	fs := elevate.Privileged()
+	if err := fs.MkdirAll(s.dir); err != nil {
+		return fmt.Errorf("failed to create %s: %w", s.dir, err)
+	}
+	if err := fs.Chmod(s.dir, 0700); err != nil {
+		return fmt.Errorf("failed to set permissions on %s: %w", s.dir, err)
+	}
+
+	for _, path := range recording.Files {
+		target := filepath.Join(s.dir, filepath.Base(path))
+		if err := fs.Rename(path, target); err != nil {
+			return fmt.Errorf("failed to move %s: %w", path, err)
+		}
+		// Owned by root like the rest of the directory, whoever the agent runs as
+		if err := fs.Chown(target, 0, 0); err != nil {
+			return fmt.Errorf("failed to set the owner of %s: %w", target, err)
+		}
+	}
+	return nil
+}
+
+// s3Shipper stores every file of a recording as its own object, named
+// <prefix><hostId>/<yyyy>/<mm>/<dd>/<file>. Objects are never rewritten, as
+// for s3 audit sinks.
+type s3Shipper struct {
+	bucket   string
+	region   string
+	prefix   string
+	endpoint string
+	hostID   string
+	client   *http.Client
+}
+
+func (s *s3Shipper) Name() string {
+	return "s3://" + s.bucket + "/" + s.prefix
+}
+
+// objectURL uses virtual-hosted addressing on AWS and path addressing on a
+// custom endpoint
+func (s *s3Shipper) objectURL(key string) (*url.URL, error) {
+	escaped := (&url.URL{Path: "/" + key}).EscapedPath()
+	if s.endpoint != "" {
+		return url.Parse(s.endpoint + "/" + s.bucket + escaped)
+	}
+	return url.Parse(fmt.Sprintf("https://%s.s3.%s.amazonaws.com%s", s.bucket, s.region, escaped))
+}
+
+func (s *s3Shipper) Ship(recording Recording) error {
+	accessKey, secretKey := os.Getenv(awsv4.AccessKeyIDEnv), os.Getenv(awsv4.SecretAccessKeyEnv)
+	if accessKey == "" || secretKey == "" {
+		return fmt.Errorf("%s and %s must be set in the agent's environment", awsv4.AccessKeyIDEnv, awsv4.SecretAccessKeyEnv)
+	}
+
+	day := time.Now().UTC()
+	if t, err := time.Parse(time.RFC3339Nano, recording.Metadata.StartedAt); err == nil {
+		day = t.UTC()
+	}
+
+	for _, path := range recording.Files {
+		body, err := readSpoolFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		key := fmt.Sprintf("%s%s/%s/%s", s.prefix, s.hostID, day.Format("2006/01/02"), filepath.Base(path))
+		if err := s.put(key, body, accessKey, secretKey); err != nil {
+			return fmt.Errorf("failed to upload %s: %w", filepath.Base(path), err)
+		}
+	}
+	return nil
+}
+
+func (s *s3Shipper) put(key string, body []byte, accessKey, secretKey string) error {
+	target, err := s.objectURL(key)
+	if err != nil {
+		return fmt.Errorf("invalid object URL: %w", err)
+	}
+	request, err := http.NewRequest(http.MethodPut, target.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	digest := md5.Sum(body)
+	request.Header.Set("Content-Type", "application/octet-stream")
+	request.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(digest[:]))
+	request.Header.Set("If-None-Match", "*")
+	if token := os.Getenv(awsv4.SessionTokenEnv); token != "" {
+		request.Header.Set("X-Amz-Security-Token", token)
+	}
+	awsv4.Sign(request, body, accessKey, secretKey, s.region, "s3", time.Now().UTC())
+
+	resp, err := s.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	detail, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+
+	// The object was stored by an earlier attempt
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		return nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("bucket returned %s: %s", resp.Status, strings.TrimSpace(string(detail)))
+	}
+	return nil
+}
+
+// tunnelShipper sends recordings to the backend with uploadSessionRecording
+type tunnelShipper struct {
+	upload Upload
+}
+
+func (s *tunnelShipper) Name() string {
+	return "tunnel"
+}
+
+func (s *tunnelShipper) Ship(recording Recording) error {
+	request := types.UploadSessionRecordingRequest{
+		RequestIDs: recording.Metadata.RequestIDs,
+		UserName:   recording.Metadata.UserName,
+		Recording:  recording.Name,
+	}
+
+	var size int64
+	for _, path := range recording.Files {
+		file, info, err := openSpoolFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		size += info.Size()
+		if size > MaxTunnelSize {
+			file.Close()
+			return fmt.Errorf("%w: it exceeds the %d MiB the tunnel carries", ErrRejected, MaxTunnelSize>>20)
+		}
+		data, err := io.ReadAll(file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		request.Files = append(request.Files, types.RecordingFile{
+			Name: filepath.Base(path),
+			Data: base64.StdEncoding.EncodeToString(data),
+		})
+	}
+
+	return s.upload(request)
+}
@@ -0,0 +1,128 @@
+package recording
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Recording is a session recording waiting in the spool
+type Recording struct {
+	// Name is the base name shared by the files of the recording
+	Name     string
+	Metadata Metadata
+
+	// Files are the paths of the metadata and recorder files
+	Files []string
+}
+
+// RejectedDir is the directory of the spool recordings are set aside in
+// when their destination will never accept them
+const RejectedDir = "rejected"
+
+// Finished returns the recordings in spoolDir whose session has ended, or
+// whose end was never recorded because the agent stopped meanwhile
+func Finished(spoolDir string) ([]Recording, error) {
+	entries, err := os.ReadDir(spoolDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", spoolDir, err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	var recordings []Recording
+	for _, name := range names {
+		if !strings.HasSuffix(name, MetadataExt) {
+			continue
+		}
+		base := strings.TrimSuffix(name, MetadataExt)
+
+		if _, recording := live.Load(filepath.Join(spoolDir, base)); recording {
+			continue
+		}
+		data, err := readSpoolFile(filepath.Join(spoolDir, name))
+		if err != nil {
+			continue
+		}
+		var meta Metadata
+		if err := json.Unmarshal(data, &meta); err != nil {
+			continue
+		}
+
+		recording := Recording{Name: base, Metadata: meta}
+		for _, other := range names {
+			if strings.HasPrefix(other, base+".") {
+				recording.Files = append(recording.Files, filepath.Join(spoolDir, other))
+			}
+		}
+		recordings = append(recordings, recording)
+	}
+	return recordings, nil
+}
+
+// Remove deletes the files of recording from the spool
+func Remove(recording Recording) error {
+	for _, path := range recording.Files {
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// SetAside moves the files of recording to RejectedDir of spoolDir, where
+// they are kept but no longer shipped
+func SetAside(spoolDir string, recording Recording) error {
+	dir := filepath.Join(spoolDir, RejectedDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %w", dir, err)
+	}
+	for _, path := range recording.Files {
+		if err := os.Rename(path, filepath.Join(dir, filepath.Base(path))); err != nil {
+			return fmt.Errorf("failed to move %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// openSpoolFile opens a file of the spool for reading. It fails on anything
+// but a regular file, such as a link put in its place.
+func openSpoolFile(path string) (*os.File, os.FileInfo, error) {
+	file, err := os.OpenFile(path, os.O_RDONLY|noFollow, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	if !info.Mode().IsRegular() {
+		file.Close()
+		return nil, nil, fmt.Errorf("%s is not a regular file", path)
+	}
+	return file, info, nil
+}
+
+// readSpoolFile reads a file of the spool opened with openSpoolFile
+func readSpoolFile(path string) ([]byte, error) {
+	file, _, err := openSpoolFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
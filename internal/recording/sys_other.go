@@ -0,0 +1,14 @@
+//go:build !unix
+
+package recording
+
+import "fmt"
+
+// Sessions are only recorded on unix
+const noFollow = 0
+
+func mkfifo(path string) error {
+	return fmt.Errorf("session recording is not supported on this OS")
+}
+
+func unblockFIFO(path string) {}
@@ -0,0 +1,23 @@
+//go:build unix
+
+package recording
+
+import (
+	"os"
+	"syscall"
+)
+
+// noFollow makes opening a spool file fail on a symbolic link
+const noFollow = syscall.O_NOFOLLOW
+
+func mkfifo(path string) error {
+	return syscall.Mkfifo(path, 0600)
+}
+
+// unblockFIFO releases a reader of the FIFO at path still waiting for a
+// writer, which sees the end of the file at once
+func unblockFIFO(path string) {
+	if file, err := os.OpenFile(path, os.O_WRONLY|syscall.O_NONBLOCK, 0); err == nil {
+		file.Close()
+	}
+}
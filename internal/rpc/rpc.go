@@ -3,9 +3,14 @@ package rpc
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"strings"
+	"io"
+	"net"
+	"sort"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/sourcegraph/jsonrpc2"
@@ -14,34 +19,126 @@ import (
 
 type MethodHandler func(ctx context.Context, params json.RawMessage) (interface{}, error)
 
+// ReplyFailedHandler receives a handler's result when the reply could not be
+// sent, typically because the connection dropped while the handler ran
+type ReplyFailedHandler func(method string, params json.RawMessage, result interface{}, err error)
+
+// ErrConnectionLost is passed to the disconnect callback for connections that
+// dropped without Close, such as when the peer stopped answering pings
+var ErrConnectionLost = errors.New("tunnel connection lost")
+
+// CodeShuttingDown is returned for requests that arrive while the client drains
+const CodeShuttingDown = -32001
+
+// LaneDefault is the lane of methods registered with AddMethod
+const LaneDefault = "default"
+
+// Requests are handled on lanes rather than on the connection's read loop.
+// Each lane handles its requests one at a time in arrival order, and lanes run
+// independently, so a slow handler delays neither other lanes nor replies to
+// the agent's own calls such as heartbeats.
+type lane struct {
+	mu      sync.Mutex
+	queue   []job
+	running bool
+}
+
+// LaneFunc picks the lane of a request from its params. An empty lane
+// leaves the request on the lane its method was registered with.
+type LaneFunc func(params json.RawMessage) string
+
+type job struct {
+	ctx  context.Context
+	conn *jsonrpc2.Conn
+	req  *jsonrpc2.Request
+}
+
 type Client struct {
 	mu          sync.RWMutex
 	methods     map[string]MethodHandler
+	methodLanes map[string]string
+	laneFuncs   map[string]LaneFunc
+	lanes       map[string]*lane
 	conn        *jsonrpc2.Conn
 	ctx         context.Context
 	cancel      context.CancelFunc
 	wsConn      *websocket.Conn
 	connected   chan struct{}
 	onConnected func()
+	onReplyFail ReplyFailedHandler
+	onDisconn   func(error)
+
+	// writeTimeout bounds each write to connections made from now on
+	writeTimeout time.Duration
+
+	// pingInterval and pongTimeout probe the liveness of connections made
+	// from now on; a zero pingInterval sends no pings
+	pingInterval time.Duration
+	pongTimeout  time.Duration
+
+	drainMu  sync.Mutex
+	draining bool
+	inFlight sync.WaitGroup
 }
 
 func NewClient() *Client {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	return &Client{
-		methods:   make(map[string]MethodHandler),
-		ctx:       ctx,
-		cancel:    cancel,
-		connected: make(chan struct{}, 1),
+		methods:     make(map[string]MethodHandler),
+		methodLanes: make(map[string]string),
+		laneFuncs:   make(map[string]LaneFunc),
+		lanes:       make(map[string]*lane),
+		ctx:         ctx,
+		cancel:      cancel,
+		connected:   make(chan struct{}, 1),
 	}
 }
 
+// SetOnConnected registers the callback run once connections made from now
+// on are established
 func (c *Client) SetOnConnected(callback func()) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	c.onConnected = callback
 }
 
+// SetOnReplyFailed registers the handler for results whose reply was lost
+func (c *Client) SetOnReplyFailed(handler ReplyFailedHandler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onReplyFail = handler
+}
+
+// SetWriteTimeout bounds each message written to connections made from now
+// on. A write that misses the deadline fails and breaks the connection, which
+// the client then reconnects. Zero waits indefinitely.
+func (c *Client) SetWriteTimeout(timeout time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeTimeout = timeout
+}
+
+// SetPing makes connections made from now on send a WebSocket ping every
+// interval. A connection that receives no pong within interval plus timeout
+// of the last one fails its read and is closed, so a half-open connection is
+// noticed within seconds instead of at the next heartbeat. Zero interval
+// disables pings.
+func (c *Client) SetPing(interval, timeout time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pingInterval = interval
+	c.pongTimeout = timeout
+}
+
+// SetOnDisconnected registers the callback for connections made from now on
+// that drop without Close
+func (c *Client) SetOnDisconnected(callback func(error)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onDisconn = callback
+}
+
 func (c *Client) ConnectWebSocket(wsConn *websocket.Conn) error {
 	return c.ConnectWebSocketWithContext(context.Background(), wsConn)
 }
@@ -49,9 +146,30 @@ func (c *Client) ConnectWebSocket(wsConn *websocket.Conn) error {
 func (c *Client) ConnectWebSocketWithContext(ctx context.Context, wsConn *websocket.Conn) error {
 	c.mu.Lock()
 	c.wsConn = wsConn
+	// Calls after a reconnect must not inherit the context Close cancelled
+	if c.ctx.Err() != nil {
+		c.ctx, c.cancel = context.WithCancel(context.Background())
+	}
+	writeTimeout := c.writeTimeout
+	pingInterval, pongTimeout := c.pingInterval, c.pongTimeout
+	onConnected, onDisconn := c.onConnected, c.onDisconn
 	c.mu.Unlock()
 
-	stream := jsonrpc2websocket.NewObjectStream(wsConn)
+	var stream jsonrpc2.ObjectStream = jsonrpc2websocket.NewObjectStream(wsConn)
+	if writeTimeout > 0 {
+		stream = &deadlineStream{ObjectStream: stream, conn: wsConn, timeout: writeTimeout}
+	}
+
+	// The deadline and pong handler must be in place before the read loop starts
+	if pingInterval > 0 {
+		extend := func(string) error {
+			return wsConn.SetReadDeadline(time.Now().Add(pingInterval + pongTimeout))
+		}
+		if err := extend(""); err != nil {
+			return fmt.Errorf("failed to set read deadline: %w", err)
+		}
+		wsConn.SetPongHandler(extend)
+	}
 
 	conn := jsonrpc2.NewConn(ctx, stream, c)
 
@@ -59,15 +177,16 @@ func (c *Client) ConnectWebSocketWithContext(ctx context.Context, wsConn *websoc
 	c.conn = conn
 	c.mu.Unlock()
 
+	if pingInterval > 0 {
+		go ping(wsConn, conn, pingInterval, pongTimeout)
+	}
+	go c.watch(conn, onDisconn)
+
 	select {
 	case c.connected <- struct{}{}:
 	default:
 	}
 
-	c.mu.RLock()
-	onConnected := c.onConnected
-	c.mu.RUnlock()
-
 	if onConnected != nil {
 		go onConnected()
 	}
@@ -81,9 +200,17 @@ func (c *Client) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.
 	}
 
 	c.mu.RLock()
-	handler, exists := c.methods[req.Method]
+	_, exists := c.methods[req.Method]
+	laneName := c.methodLanes[req.Method]
+	laneOf := c.laneFuncs[req.Method]
 	c.mu.RUnlock()
 
+	if laneOf != nil && req.Params != nil {
+		if name := laneOf(*req.Params); name != "" {
+			laneName = name
+		}
+	}
+
 	if !exists {
 		conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
 			Code:    jsonrpc2.CodeMethodNotFound,
@@ -92,6 +219,63 @@ func (c *Client) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.
 		return
 	}
 
+	if !c.begin() {
+		conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+			Code:    CodeShuttingDown,
+			Message: "agent is shutting down and no longer accepts requests",
+		})
+		return
+	}
+
+	c.enqueue(laneName, job{ctx: ctx, conn: conn, req: req})
+}
+
+// enqueue adds a request to its lane and starts the lane's worker if idle
+func (c *Client) enqueue(name string, j job) {
+	c.mu.Lock()
+	l, ok := c.lanes[name]
+	if !ok {
+		l = &lane{}
+		c.lanes[name] = l
+	}
+	c.mu.Unlock()
+
+	l.mu.Lock()
+	l.queue = append(l.queue, j)
+	start := !l.running
+	l.running = true
+	l.mu.Unlock()
+
+	if start {
+		go c.runLane(l)
+	}
+}
+
+// runLane handles queued requests until the lane is empty
+func (c *Client) runLane(l *lane) {
+	for {
+		l.mu.Lock()
+		if len(l.queue) == 0 {
+			l.running = false
+			l.mu.Unlock()
+			return
+		}
+		j := l.queue[0]
+		l.queue = l.queue[1:]
+		l.mu.Unlock()
+
+		c.handle(j.ctx, j.conn, j.req)
+	}
+}
+
+// handle runs the handler of an accepted request and replies
+func (c *Client) handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+	defer c.inFlight.Done()
+
+	c.mu.RLock()
+	handler := c.methods[req.Method]
+	c.mu.RUnlock()
+
 	var params json.RawMessage
 	if req.Params != nil {
 		params = *req.Params
@@ -106,16 +290,102 @@ func (c *Client) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.
 		return
 	}
 
-	conn.Reply(ctx, req.ID, result)
+	if err := conn.Reply(ctx, req.ID, result); err != nil {
+		c.mu.RLock()
+		onReplyFail := c.onReplyFail
+		c.mu.RUnlock()
+
+		if onReplyFail != nil {
+			onReplyFail(req.Method, params, result, err)
+		}
+	}
+}
+
+// begin counts a request as in flight unless the client is draining
+func (c *Client) begin() bool {
+	c.drainMu.Lock()
+	defer c.drainMu.Unlock()
+
+	if c.draining {
+		return false
+	}
+	c.inFlight.Add(1)
+	return true
+}
+
+// Drain stops accepting requests and returns a channel that is closed once
+// every request already being handled has been replied to
+func (c *Client) Drain() <-chan struct{} {
+	c.drainMu.Lock()
+	c.draining = true
+	c.drainMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		c.inFlight.Wait()
+		close(done)
+	}()
+	return done
 }
 
 func (c *Client) AddMethod(method string, handler MethodHandler) {
+	c.AddMethodInLane(method, LaneDefault, handler)
+}
+
+// AddMethodInLane registers a handler whose requests are handled on the named
+// lane, apart from methods on other lanes
+func (c *Client) AddMethodInLane(method, lane string, handler MethodHandler) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	c.methods[method] = handler
+	c.methodLanes[method] = lane
+}
+
+// SetLaneFunc moves requests of method off its lane by what they carry, e.g.
+// a long-running command that would hold up the others
+func (c *Client) SetLaneFunc(method string, laneOf LaneFunc) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.laneFuncs[method] = laneOf
+}
+
+// Methods returns the names of the registered methods, sorted
+func (c *Client) Methods() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	names := make([]string, 0, len(c.methods))
+	for name := range c.methods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
 
 func (c *Client) Call(method string, params interface{}) (json.RawMessage, error) {
+	c.mu.RLock()
+	ctx := c.ctx
+	c.mu.RUnlock()
+
+	return c.call(ctx, method, params)
+}
+
+// CallWithTimeout is Call with a deadline for the reply, so a peer that stops
+// answering fails the call instead of blocking it until the connection drops
+func (c *Client) CallWithTimeout(method string, params interface{}, timeout time.Duration) (json.RawMessage, error) {
+	c.mu.RLock()
+	ctx, cancel := context.WithTimeout(c.ctx, timeout)
+	c.mu.RUnlock()
+	defer cancel()
+
+	result, err := c.call(ctx, method, params)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil, fmt.Errorf("no reply to %s within %s: %w", method, timeout, err)
+	}
+	return result, err
+}
+
+func (c *Client) call(ctx context.Context, method string, params interface{}) (json.RawMessage, error) {
 	c.mu.RLock()
 	conn := c.conn
 	c.mu.RUnlock()
@@ -125,7 +395,7 @@ func (c *Client) Call(method string, params interface{}) (json.RawMessage, error
 	}
 
 	var result json.RawMessage
-	err := conn.Call(c.ctx, method, params, &result)
+	err := conn.Call(ctx, method, params, &result)
 	if err != nil {
 		if isConnectionError(err) {
 			return nil, fmt.Errorf("connection lost: %w", err)
@@ -136,38 +406,100 @@ func (c *Client) Call(method string, params interface{}) (json.RawMessage, error
 	return result, nil
 }
 
-func isConnectionError(err error) bool {
-	if err == nil {
-		return false
+// Notify sends a JSON-RPC notification, which expects no response
+func (c *Client) Notify(method string, params interface{}) error {
+	c.mu.RLock()
+	conn := c.conn
+	c.mu.RUnlock()
+
+	if conn == nil {
+		return fmt.Errorf("not connected")
 	}
-	errStr := err.Error()
-	return strings.Contains(errStr, "connection") ||
-		strings.Contains(errStr, "EOF") ||
-		strings.Contains(errStr, "broken pipe") ||
-		strings.Contains(errStr, "reset by peer") ||
-		strings.Contains(errStr, "timeout") ||
-		strings.Contains(errStr, "i/o timeout") ||
-		strings.Contains(errStr, "websocket: close") ||
-		strings.Contains(errStr, "protocol error") ||
-		strings.Contains(errStr, "network is unreachable") ||
-		strings.Contains(errStr, "no route to host")
+
+	c.mu.RLock()
+	ctx := c.ctx
+	c.mu.RUnlock()
+
+	if err := conn.Notify(ctx, method, params); err != nil {
+		return fmt.Errorf("RPC notify failed: %w", err)
+	}
+
+	return nil
+}
+
+// IsMethodNotFound reports whether the peer does not implement the called method
+func IsMethodNotFound(err error) bool {
+	var rpcErr *jsonrpc2.Error
+	return errors.As(err, &rpcErr) && rpcErr.Code == jsonrpc2.CodeMethodNotFound
+}
+
+// isConnectionError reports whether err means the connection is gone rather
+// than the call failing on a live connection
+func isConnectionError(err error) bool {
+	var closeErr *websocket.CloseError
+	var opErr *net.OpError
+	return errors.Is(err, jsonrpc2.ErrClosed) ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.As(err, &closeErr) ||
+		errors.As(err, &opErr)
 }
 
 func (c *Client) WaitUntilConnected() error {
+	c.mu.RLock()
+	ctx := c.ctx
+	c.mu.RUnlock()
+
 	select {
 	case <-c.connected:
 		return nil
-	case <-c.ctx.Done():
-		return c.ctx.Err()
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
-func (c *Client) Close() error {
-	c.cancel()
+// ping sends WebSocket pings every interval until conn closes. Replies move
+// the read deadline set in ConnectWebSocketWithContext forward.
+func ping(wsConn *websocket.Conn, conn *jsonrpc2.Conn, interval, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := wsConn.WriteControl(websocket.PingMessage, nil, time.Now().Add(timeout)); err != nil {
+				conn.Close()
+				return
+			}
+		case <-conn.DisconnectNotify():
+			return
+		}
+	}
+}
+
+// watch calls the disconnect callback when conn drops while it is still the
+// client's connection, i.e. not through Close or a newer connection
+func (c *Client) watch(conn *jsonrpc2.Conn, onDisconn func(error)) {
+	<-conn.DisconnectNotify()
+
+	c.mu.RLock()
+	current := c.conn == conn
+	c.mu.RUnlock()
+
+	if current && onDisconn != nil {
+		onDisconn(ErrConnectionLost)
+	}
+}
 
+func (c *Client) Close() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	c.cancel()
+
 	if c.conn != nil {
 		c.conn.Close()
 		c.conn = nil
@@ -180,3 +512,18 @@ func (c *Client) Close() error {
 
 	return nil
 }
+
+// deadlineStream sets a write deadline before each message. jsonrpc2 writes
+// one message at a time, so the deadline always belongs to the write after it.
+type deadlineStream struct {
+	jsonrpc2.ObjectStream
+	conn    *websocket.Conn
+	timeout time.Duration
+}
+
+func (s *deadlineStream) WriteObject(obj interface{}) error {
+	if err := s.conn.SetWriteDeadline(time.Now().Add(s.timeout)); err != nil {
+		return err
+	}
+	return s.ObjectStream.WriteObject(obj)
+}
@@ -0,0 +1,397 @@
+// Package schema validates decoded JSON against JSON Schemas. It implements
+// the subset the agent's embedded schemas use: type, enum, const, required,
+// properties, additionalProperties, items, minItems, maxItems, minLength,
+// maxLength, pattern, format, minimum, maximum, allOf, if/then/else and $ref
+// to another schema of the same registry by name. Formats are the names of
+// patterns registered with AddFormat.
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// FieldError is one way a value does not match its schema. Field is the path
+// of the offending value, such as "resources.tasksMax" or "items[2].command",
+// and is empty for the value as a whole.
+type FieldError struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+func (e FieldError) Error() string {
+	if e.Field == "" {
+		return e.Reason
+	}
+	return e.Field + ": " + e.Reason
+}
+
+// Schema is a compiled JSON Schema
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 typeList           `json:"type,omitempty"`
+	Enum                 []interface{}      `json:"enum,omitempty"`
+	Const                json.RawMessage    `json:"const,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	MinItems             *int               `json:"minItems,omitempty"`
+	MaxItems             *int               `json:"maxItems,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	AllOf                []*Schema          `json:"allOf,omitempty"`
+	If                   *Schema            `json:"if,omitempty"`
+	Then                 *Schema            `json:"then,omitempty"`
+	Else                 *Schema            `json:"else,omitempty"`
+
+	// never is the false schema, which no value matches
+	never   bool
+	pattern *regexp.Regexp
+}
+
+// UnmarshalJSON accepts the boolean schemas true and false as well as objects
+func (s *Schema) UnmarshalJSON(data []byte) error {
+	switch strings.TrimSpace(string(data)) {
+	case "true":
+		*s = Schema{}
+		return nil
+	case "false":
+		*s = Schema{never: true}
+		return nil
+	}
+
+	type plain Schema
+	return json.Unmarshal(data, (*plain)(s))
+}
+
+// typeList is the type keyword, a single name or a list of names
+type typeList []string
+
+func (t *typeList) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*t = typeList{name}
+		return nil
+	}
+	var names []string
+	if err := json.Unmarshal(data, &names); err != nil {
+		return fmt.Errorf("type must be a name or a list of names")
+	}
+	*t = names
+	return nil
+}
+
+var typeNames = map[string]bool{
+	"null": true, "boolean": true, "object": true, "array": true,
+	"number": true, "integer": true, "string": true,
+}
+
+// Registry holds named schemas that may refer to each other with $ref
+type Registry struct {
+	schemas map[string]*Schema
+	formats map[string]*regexp.Regexp
+}
+
+// NewRegistry returns an empty registry
+func NewRegistry() *Registry {
+	return &Registry{schemas: make(map[string]*Schema), formats: make(map[string]*regexp.Regexp)}
+}
+
+// AddFormat registers the pattern strings of format name must match, so a
+// schema can share a pattern with the code instead of copying it
+func (r *Registry) AddFormat(name string, pattern *regexp.Regexp) {
+	r.formats[name] = pattern
+}
+
+// Add compiles the schema in data under name
+func (r *Registry) Add(name string, data []byte) error {
+	var s Schema
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("schema %s: %w", name, err)
+	}
+	if err := s.compile(); err != nil {
+		return fmt.Errorf("schema %s: %w", name, err)
+	}
+	r.schemas[name] = &s
+	return nil
+}
+
+// Has reports whether a schema was added under name
+func (r *Registry) Has(name string) bool {
+	_, ok := r.schemas[name]
+	return ok
+}
+
+// Check reports a $ref to a schema that was never added and a format that
+// was never registered
+func (r *Registry) Check() error {
+	names := make([]string, 0, len(r.schemas))
+	for name := range r.schemas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		var missing, unknownFormat string
+		r.schemas[name].walk(func(s *Schema) {
+			if s.Ref != "" && !r.Has(s.Ref) && missing == "" {
+				missing = s.Ref
+			}
+			if _, ok := r.formats[s.Format]; s.Format != "" && !ok && unknownFormat == "" {
+				unknownFormat = s.Format
+			}
+		})
+		if missing != "" {
+			return fmt.Errorf("schema %s: $ref to unknown schema %s", name, missing)
+		}
+		if unknownFormat != "" {
+			return fmt.Errorf("schema %s: unknown format %s", name, unknownFormat)
+		}
+	}
+	return nil
+}
+
+// Validate checks value, as decoded by encoding/json into an interface{},
+// against the schema named name and returns every mismatch
+func (r *Registry) Validate(name string, value interface{}) ([]FieldError, error) {
+	s, ok := r.schemas[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown schema %s", name)
+	}
+
+	var errs []FieldError
+	r.validate(s, value, "", &errs)
+	return errs, nil
+}
+
+func (s *Schema) compile() error {
+	var err error
+	s.walk(func(s *Schema) {
+		for _, name := range s.Type {
+			if !typeNames[name] && err == nil {
+				err = fmt.Errorf("unknown type %q", name)
+			}
+		}
+		if s.Pattern != "" && s.pattern == nil {
+			pattern, compileErr := regexp.Compile(s.Pattern)
+			if compileErr != nil && err == nil {
+				err = fmt.Errorf("invalid pattern %q: %w", s.Pattern, compileErr)
+			}
+			s.pattern = pattern
+		}
+	})
+	return err
+}
+
+// walk calls fn for s and every schema nested in it
+func (s *Schema) walk(fn func(*Schema)) {
+	if s == nil {
+		return
+	}
+	fn(s)
+	for _, property := range s.Properties {
+		property.walk(fn)
+	}
+	for _, sub := range s.AllOf {
+		sub.walk(fn)
+	}
+	for _, sub := range []*Schema{s.AdditionalProperties, s.Items, s.If, s.Then, s.Else} {
+		sub.walk(fn)
+	}
+}
+
+func (r *Registry) validate(s *Schema, value interface{}, path string, errs *[]FieldError) {
+	add := func(reason string, args ...interface{}) {
+		*errs = append(*errs, FieldError{Field: path, Reason: fmt.Sprintf(reason, args...)})
+	}
+
+	if s.never {
+		add("is not allowed")
+		return
+	}
+
+	if s.Ref != "" {
+		if ref, ok := r.schemas[s.Ref]; ok {
+			r.validate(ref, value, path, errs)
+		} else {
+			add("refers to unknown schema %s", s.Ref)
+		}
+	}
+
+	if len(s.Type) > 0 && !hasType(value, s.Type) {
+		add("must be %s", describeTypes(s.Type))
+		// The remaining keywords assume the right type
+		return
+	}
+
+	if len(s.Enum) > 0 {
+		found := false
+		for _, allowed := range s.Enum {
+			if reflect.DeepEqual(value, allowed) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			add("must be one of %s", describeValues(s.Enum))
+		}
+	}
+
+	if len(s.Const) > 0 {
+		var constant interface{}
+		if err := json.Unmarshal(s.Const, &constant); err == nil && !reflect.DeepEqual(value, constant) {
+			add("must be %s", string(s.Const))
+		}
+	}
+
+	switch v := value.(type) {
+	case string:
+		length := utf8.RuneCountInString(v)
+		if s.MinLength != nil && length < *s.MinLength {
+			if *s.MinLength == 1 {
+				add("must not be empty")
+			} else {
+				add("must be at least %d characters", *s.MinLength)
+			}
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			add("must be at most %d characters", *s.MaxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			add("must match %s", s.Pattern)
+		}
+		if format, ok := r.formats[s.Format]; ok && !format.MatchString(v) {
+			add("must match %s", format)
+		}
+	case float64:
+		if s.Minimum != nil && v < *s.Minimum {
+			add("must be at least %v", *s.Minimum)
+		}
+		if s.Maximum != nil && v > *s.Maximum {
+			add("must be at most %v", *s.Maximum)
+		}
+	case []interface{}:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			add("must have at least %d items", *s.MinItems)
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			add("must have at most %d items", *s.MaxItems)
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				r.validate(s.Items, item, fmt.Sprintf("%s[%d]", path, i), errs)
+			}
+		}
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				*errs = append(*errs, FieldError{Field: join(path, name), Reason: "is required"})
+			}
+		}
+
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			if property, ok := s.Properties[name]; ok {
+				r.validate(property, v[name], join(path, name), errs)
+			} else if s.AdditionalProperties != nil {
+				r.validate(s.AdditionalProperties, v[name], join(path, name), errs)
+			}
+		}
+	}
+
+	for _, sub := range s.AllOf {
+		r.validate(sub, value, path, errs)
+	}
+
+	if s.If != nil {
+		var condition []FieldError
+		r.validate(s.If, value, path, &condition)
+		if len(condition) == 0 && s.Then != nil {
+			r.validate(s.Then, value, path, errs)
+		} else if len(condition) > 0 && s.Else != nil {
+			r.validate(s.Else, value, path, errs)
+		}
+	}
+}
+
+func hasType(value interface{}, names []string) bool {
+	for _, name := range names {
+		switch v := value.(type) {
+		case nil:
+			if name == "null" {
+				return true
+			}
+		case bool:
+			if name == "boolean" {
+				return true
+			}
+		case string:
+			if name == "string" {
+				return true
+			}
+		case float64:
+			if name == "number" || (name == "integer" && v == math.Trunc(v)) {
+				return true
+			}
+		case []interface{}:
+			if name == "array" {
+				return true
+			}
+		case map[string]interface{}:
+			if name == "object" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var typeArticles = map[string]string{
+	"null":    "null",
+	"boolean": "a boolean",
+	"object":  "an object",
+	"array":   "an array",
+	"number":  "a number",
+	"integer": "an integer",
+	"string":  "a string",
+}
+
+func describeTypes(names []string) string {
+	described := make([]string, len(names))
+	for i, name := range names {
+		described[i] = typeArticles[name]
+	}
+	return strings.Join(described, " or ")
+}
+
+func describeValues(values []interface{}) string {
+	described := make([]string, len(values))
+	for i, value := range values {
+		data, _ := json.Marshal(value)
+		described[i] = string(data)
+	}
+	return strings.Join(described, ", ")
+}
+
+func join(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
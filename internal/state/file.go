@@ -0,0 +1,85 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"p0-ssh-agent/internal/filelock"
+)
+
+// ReadJSON decodes the JSON file at path into v. A missing file leaves v as
+// it is.
+func ReadJSON(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return nil
+}
+
+// WriteJSON replaces the file at path with v, locked against the agent and
+// the commands that record beside it
+func WriteJSON(path string, v interface{}) error {
+	release, err := lock(path)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return write(path, v)
+}
+
+// UpdateJSON locks the file at path, reads it into v, lets change modify v
+// and writes v back
+func UpdateJSON(path string, v interface{}, change func() error) error {
+	release, err := lock(path)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if err := ReadJSON(path, v); err != nil {
+		return err
+	}
+	if err := change(); err != nil {
+		return err
+	}
+	return write(path, v)
+}
+
+func lock(path string) (release func(), err error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create state directory: %w", err)
+	}
+	release, err = filelock.Acquire(path + ".lock")
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+	}
+	return release, nil
+}
+
+// write writes v beside path and renames it, so a crash never leaves the
+// file truncated
+func write(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s: %w", path, err)
+	}
+
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// FileName is the provisioning state inside the agent state directory
+const FileName = "provisioning.json"
+
+// Status values of a recorded grant
+const (
+	StatusGranted = "granted"
+	StatusRevoked = "revoked"
+)
+
+// retention is how long revoked grants are kept for inspection and reconcile
+const retention = 30 * 24 * time.Hour
+
+// Path returns the provisioning state path for a state directory
+func Path(stateDir string) string {
+	return filepath.Join(stateDir, FileName)
+}
+
+// Grant is what the agent last applied for one command of a provisioning
+// request. Request holds the request as executed, so the grant can be
+// re-applied or revoked without the backend resending it.
+type Grant struct {
+	Key       string          `json:"key"`
+	RequestID string          `json:"requestId"`
+	Command   string          `json:"command"`
+	UserName  string          `json:"userName"`
+	Status    string          `json:"status"`
+	Request   json.RawMessage `json:"request"`
+	ExpiresAt time.Time       `json:"expiresAt,omitempty"`
+	GrantedAt time.Time       `json:"grantedAt,omitempty"`
+	RevokedAt time.Time       `json:"revokedAt,omitempty"`
+	UpdatedAt time.Time       `json:"updatedAt"`
+
+	// Files are the files the grant wrote to, where they depend on the
+	// configuration at the time, such as the authorized keys file
+	Files []string `json:"files,omitempty"`
+
+	// PriorSessions are the logind sessions the user had when a login grant
+	// was made, which cannot have been opened with it. SessionsRecorded is
+	// false when they could not be listed.
+	PriorSessions    []string `json:"priorSessions,omitempty"`
+	SessionsRecorded bool     `json:"sessionsRecorded,omitempty"`
+}
+
+// Key identifies the grant created by one command of a provisioning request
+func Key(requestID, command string) string {
+	return requestID + "/" + command
+}
+
+// Expired reports whether a granted entry has outlived its expiry
+func (g Grant) Expired(now time.Time) bool {
+	return g.Status == StatusGranted && !g.ExpiresAt.IsZero() && !now.Before(g.ExpiresAt)
+}
+
+// Load returns every recorded grant sorted by key. A missing file has none.
+func Load(path string) ([]Grant, error) {
+	grants, err := read(path)
+	if err != nil {
+		return nil, err
+	}
+	return sorted(grants), nil
+}
+
+// Get returns the grant recorded for requestID and command
+func Get(path, requestID, command string) (Grant, bool, error) {
+	grants, err := read(path)
+	if err != nil {
+		return Grant{}, false, err
+	}
+	grant, ok := grants[Key(requestID, command)]
+	return grant, ok, nil
+}
+
+// Put records grant, keeping the grant time, prior sessions and files of an
+// earlier grant of the same key, and drops revoked grants past retention.
+// The file is locked while it is rewritten so the agent and the command CLI
+// can record concurrently.
+func Put(path string, grant Grant) error {
+	return update(path, func(grants map[string]Grant) {
+		now := time.Now().UTC()
+		grant.Key = Key(grant.RequestID, grant.Command)
+		grant.UpdatedAt = now
+
+		previous, ok := grants[grant.Key]
+		switch grant.Status {
+		case StatusGranted:
+			grant.GrantedAt = now
+			if ok && previous.Status == StatusGranted && !previous.GrantedAt.IsZero() {
+				grant.GrantedAt = previous.GrantedAt
+			}
+			// A repeated grant does not reset what the first one found
+			if ok && previous.Status == StatusGranted && previous.SessionsRecorded {
+				grant.PriorSessions = previous.PriorSessions
+				grant.SessionsRecorded = true
+			}
+		case StatusRevoked:
+			grant.RevokedAt = now
+			if ok {
+				grant.GrantedAt = previous.GrantedAt
+				grant.Files = previous.Files
+			}
+		}
+
+		grants[grant.Key] = grant
+
+		for key, existing := range grants {
+			if existing.Status == StatusRevoked && now.Sub(existing.UpdatedAt) > retention {
+				delete(grants, key)
+			}
+		}
+	})
+}
+
+func update(path string, change func(map[string]Grant)) error {
+	var list []Grant
+	err := UpdateJSON(path, &list, func() error {
+		grants := byKey(list)
+		change(grants)
+		list = sorted(grants)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update provisioning state: %w", err)
+	}
+	return nil
+}
+
+func read(path string) (map[string]Grant, error) {
+	var list []Grant
+	if err := ReadJSON(path, &list); err != nil {
+		return nil, fmt.Errorf("failed to read provisioning state: %w", err)
+	}
+	return byKey(list), nil
+}
+
+func byKey(list []Grant) map[string]Grant {
+	grants := make(map[string]Grant, len(list))
+	for _, grant := range list {
+		grants[grant.Key] = grant
+	}
+	return grants
+}
+
+func sorted(grants map[string]Grant) []Grant {
+	list := make([]Grant, 0, len(grants))
+	for _, grant := range grants {
+		list = append(list, grant)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+	return list
+}
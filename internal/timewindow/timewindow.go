@@ -0,0 +1,96 @@
+// Package timewindow parses the times of provisioning requests: validFrom,
+// validTo, expiresAt and sudoExpiresAt. Every place that reads one of them
+// goes through here, so a value the scheduler accepts is never ignored when
+// the grant is recorded or expired.
+package timewindow
+
+import (
+	"fmt"
+	"time"
+)
+
+// localLayouts are accepted for values without a UTC offset; they are
+// interpreted in the request's timeZone
+var localLayouts = []string{
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+}
+
+// Window is the period during which a grant is active. Zero bounds are open.
+type Window struct {
+	From time.Time
+	To   time.Time
+}
+
+// IsZero reports whether the window places no restriction on the grant
+func (w Window) IsZero() bool {
+	return w.From.IsZero() && w.To.IsZero()
+}
+
+// Parse parses validFrom/validTo. Values with an explicit offset (RFC 3339)
+// are used as-is; local values are resolved in timeZone, which defaults to UTC.
+func Parse(validFrom, validTo, timeZone string) (Window, error) {
+	location, err := loadLocation(timeZone)
+	if err != nil {
+		return Window{}, err
+	}
+
+	var window Window
+	if window.From, err = parseTime("validFrom", validFrom, location); err != nil {
+		return Window{}, err
+	}
+	if window.To, err = parseTime("validTo", validTo, location); err != nil {
+		return Window{}, err
+	}
+
+	if !window.From.IsZero() && !window.To.IsZero() && !window.To.After(window.From) {
+		return Window{}, fmt.Errorf("validTo (%s) must be after validFrom (%s)",
+			window.To.Format(time.RFC3339), window.From.Format(time.RFC3339))
+	}
+
+	return window, nil
+}
+
+// ParseTime parses the request time named field in the formats Parse
+// accepts. An empty value is the zero time.
+func ParseTime(field, value, timeZone string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	location, err := loadLocation(timeZone)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return parseTime(field, value, location)
+}
+
+func loadLocation(timeZone string) (*time.Location, error) {
+	if timeZone == "" {
+		return time.UTC, nil
+	}
+	location, err := time.LoadLocation(timeZone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timeZone %q: %w", timeZone, err)
+	}
+	return location, nil
+}
+
+func parseTime(field, value string, location *time.Location) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	for _, layout := range localLayouts {
+		if t, err := time.ParseInLocation(layout, value, location); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("invalid %s %q: expected RFC 3339 (2006-01-02T15:04:05Z07:00) or local time (2006-01-02T15:04:05) with timeZone", field, value)
+}
@@ -0,0 +1,124 @@
+package timewindow
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skipf("time zone database unavailable: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		validFrom string
+		validTo   string
+		timeZone  string
+		want      Window
+		wantErr   string
+	}{
+		{
+			name: "no bounds",
+		},
+		{
+			name:      "RFC 3339 keeps its offset",
+			validFrom: "2026-03-01T09:00:00+02:00",
+			validTo:   "2026-03-01T17:00:00Z",
+			timeZone:  "Europe/Berlin",
+			want: Window{
+				From: time.Date(2026, 3, 1, 7, 0, 0, 0, time.UTC),
+				To:   time.Date(2026, 3, 1, 17, 0, 0, 0, time.UTC),
+			},
+		},
+		{
+			name:      "local time defaults to UTC",
+			validFrom: "2026-03-01T09:00",
+			want:      Window{From: time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)},
+		},
+		{
+			name:     "local time in the request's time zone",
+			validTo:  "2026-03-01 17:30:15",
+			timeZone: "Europe/Berlin",
+			want:     Window{To: time.Date(2026, 3, 1, 17, 30, 15, 0, berlin)},
+		},
+		{
+			name:      "end before start",
+			validFrom: "2026-03-01T17:00:00Z",
+			validTo:   "2026-03-01T09:00:00Z",
+			wantErr:   "validTo (2026-03-01T09:00:00Z) must be after validFrom (2026-03-01T17:00:00Z)",
+		},
+		{
+			name:      "empty window",
+			validFrom: "2026-03-01T09:00:00Z",
+			validTo:   "2026-03-01T09:00:00Z",
+			wantErr:   "must be after validFrom",
+		},
+		{
+			name:      "unknown format",
+			validFrom: "03/01/2026 9am",
+			wantErr:   `invalid validFrom "03/01/2026 9am"`,
+		},
+		{
+			name:     "unknown time zone",
+			validTo:  "2026-03-01T09:00",
+			timeZone: "Mars/Olympus",
+			wantErr:  `invalid timeZone "Mars/Olympus"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(tt.validFrom, tt.validTo, tt.timeZone)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Parse error %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			if !got.From.Equal(tt.want.From) || !got.To.Equal(tt.want.To) {
+				t.Errorf("Parse = %v, want %v", got, tt.want)
+			}
+			if got.IsZero() != tt.want.IsZero() {
+				t.Errorf("IsZero = %v, want %v", got.IsZero(), tt.want.IsZero())
+			}
+		})
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    time.Time
+		wantErr string
+	}{
+		{name: "empty is the zero time"},
+		{name: "RFC 3339", value: "2026-03-01T09:00:00-05:00", want: time.Date(2026, 3, 1, 14, 0, 0, 0, time.UTC)},
+		{name: "local time", value: "2026-03-01T09:00:00", want: time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)},
+		{name: "invalid", value: "tomorrow", wantErr: `invalid expiresAt "tomorrow"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseTime("expiresAt", tt.value, "")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ParseTime error %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseTime: %v", err)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("ParseTime = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+// Package unixsocket listens on the unix sockets the agent serves its local
+// APIs on
+package unixsocket
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// dialTimeout bounds the check for a process already listening on the socket
+const dialTimeout = time.Second
+
+// Listen listens on the unix socket at path and sets its mode. A socket
+// left behind by a previous run is replaced, but one another process is
+// still listening on is not.
+func Listen(path string, mode os.FileMode) (net.Listener, error) {
+	if err := removeStale(path); err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", path, err)
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to set the mode of %s: %w", path, err)
+	}
+	return listener, nil
+}
+
+func removeStale(path string) error {
+	if _, err := os.Lstat(path); os.IsNotExist(err) {
+		return nil
+	}
+
+	if conn, err := net.DialTimeout("unix", path, dialTimeout); err == nil {
+		conn.Close()
+		return fmt.Errorf("another process is already listening on %s", path)
+	}
+
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("failed to remove stale socket %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package userdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"runtime"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/scripts"
+	"p0-ssh-agent/types"
+)
+
+// Enabled reports whether cfg resolves JIT users through userdb on this
+// platform. Elsewhere than Linux they are always local accounts.
+func Enabled(cfg *types.Config) bool {
+	return runtime.GOOS == "linux" && cfg.GetUserResolution() == types.UserResolutionUserdb
+}
+
+// Configure points the scripts at the identity store when Enabled
+func Configure(cfg *types.Config) {
+	if Enabled(cfg) {
+		scripts.SetHost(Host(cfg.StateDir))
+	}
+}
+
+// Host returns the scripts host for userResolution userdb: JIT users are
+// added to the identity store in stateDir instead of /etc/passwd, and
+// removed from it once their last grant is revoked. Local accounts still
+// resolve first, so existing users keep their own records.
+func Host(stateDir string) scripts.Host {
+	path := Path(stateDir)
+
+	return scripts.Host{
+		LookupUser: func(username string) (*user.User, error) {
+			local, err := user.Lookup(username)
+			if err == nil {
+				return local, nil
+			}
+			var unknown user.UnknownUserError
+			if !errors.As(err, &unknown) {
+				return nil, err
+			}
+
+			identity, ok, err := Lookup(path, username)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				return nil, user.UnknownUserError(username)
+			}
+			return identity.User(), nil
+		},
+		CreateUser: func(_ context.Context, username string, logger *logrus.Logger) error {
+			identity, err := Add(path, username)
+			if err != nil {
+				return err
+			}
+			if err := createHome(identity); err != nil {
+				return err
+			}
+
+			logger.WithFields(logrus.Fields{
+				"username": username,
+				"uid":      identity.UID,
+			}).Info("👥 JIT user added to userdb")
+			return nil
+		},
+		RemoveUser: func(_ context.Context, username string, logger *logrus.Logger) error {
+			removed, err := Remove(path, username)
+			if err != nil {
+				return err
+			}
+			if removed {
+				logger.WithField("username", username).Info("👥 JIT user removed from userdb")
+			}
+			return nil
+		},
+	}
+}
+
+// createHome creates the home directory owned by the user. Files a previous
+// grant left behind are kept, as the user gets the same UID back.
+func createHome(identity Identity) error {
+	if err := os.MkdirAll(identity.HomeDirectory, 0700); err != nil {
+		return fmt.Errorf("failed to create home directory: %w", err)
+	}
+	if err := os.Chown(identity.HomeDirectory, identity.UID, identity.UID); err != nil {
+		return fmt.Errorf("failed to set home directory owner: %w", err)
+	}
+	return nil
+}
+
+// nsswitchPath is read to check that NSS consults systemd for users
+const nsswitchPath = "/etc/nsswitch.conf"
+
+// CheckNSS reports an error unless the passwd database in nsswitch.conf
+// includes systemd, through which userdb users resolve
+func CheckNSS() error {
+	data, err := os.ReadFile(nsswitchPath)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", nsswitchPath, err)
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(strings.SplitN(line, "#", 2)[0])
+		if len(fields) == 0 || fields[0] != "passwd:" {
+			continue
+		}
+		for _, source := range fields[1:] {
+			if source == "systemd" {
+				return nil
+			}
+		}
+		return fmt.Errorf("the passwd line of %s does not include systemd", nsswitchPath)
+	}
+	return fmt.Errorf("%s has no passwd line", nsswitchPath)
+}
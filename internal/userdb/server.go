@@ -0,0 +1,304 @@
+package userdb
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/internal/unixsocket"
+)
+
+// ServiceName is the userdb service the agent provides. nss-systemd and
+// userdbctl find it as a socket of the same name in SocketDir.
+const ServiceName = "io.p0.ssh-agent"
+
+// SocketDir is where systemd looks for userdb services
+const SocketDir = "/run/systemd/userdb"
+
+// Varlink errors of the io.systemd.UserDatabase interface
+const (
+	errNoRecordFound          = "io.systemd.UserDatabase.NoRecordFound"
+	errBadService             = "io.systemd.UserDatabase.BadService"
+	errConflictingRecordFound = "io.systemd.UserDatabase.ConflictingRecordFound"
+	errMethodNotFound         = "org.varlink.service.MethodNotFound"
+	errInvalidParameter       = "org.varlink.service.InvalidParameter"
+)
+
+// Limits of the userdb socket, which every local user can reach
+const (
+	// maxMessage bounds one call; lookups are a few hundred bytes
+	maxMessage = 64 << 10
+
+	// readTimeout closes a connection that sends no call for that long
+	readTimeout = 30 * time.Second
+
+	// maxConnections bounds the connections served at once; more are closed
+	maxConnections = 64
+)
+
+// errMessageTooLarge closes a connection whose call exceeds maxMessage
+var errMessageTooLarge = fmt.Errorf("userdb call exceeds %d bytes", maxMessage)
+
+// SocketPath returns where the agent's userdb service listens
+func SocketPath() string {
+	return filepath.Join(SocketDir, ServiceName)
+}
+
+type call struct {
+	Method     string          `json:"method"`
+	Parameters json.RawMessage `json:"parameters"`
+	More       bool            `json:"more"`
+	Oneway     bool            `json:"oneway"`
+}
+
+type reply struct {
+	Parameters interface{} `json:"parameters"`
+	Continues  bool        `json:"continues,omitempty"`
+	Error      string      `json:"error,omitempty"`
+}
+
+// lookup holds the parameters of GetUserRecord, GetGroupRecord and GetMemberships
+type lookup struct {
+	UID       *int   `json:"uid"`
+	UserName  string `json:"userName"`
+	GID       *int   `json:"gid"`
+	GroupName string `json:"groupName"`
+	Service   string `json:"service"`
+}
+
+// Server answers userdb queries for the identities in a store
+type Server struct {
+	path     string
+	listener net.Listener
+	logger   *logrus.Logger
+	wg       sync.WaitGroup
+
+	// slots holds a token for each connection being served
+	slots chan struct{}
+}
+
+// Serve listens on socketPath and resolves users and their primary groups
+// from the identity store at storePath until closed. The socket is
+// world-accessible: every process resolving a user name asks it.
+func Serve(socketPath, storePath string, logger *logrus.Logger) (*Server, error) {
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create userdb directory: %w", err)
+	}
+	listener, err := unixsocket.Listen(socketPath, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &Server{
+		path:     storePath,
+		listener: listener,
+		logger:   logger,
+		slots:    make(chan struct{}, maxConnections),
+	}
+	server.wg.Add(1)
+	go server.accept()
+
+	logger.WithField("socket", socketPath).Info("👥 Serving JIT users through userdb")
+	return server, nil
+}
+
+// Close stops accepting queries and removes the socket
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) accept() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.logger.WithError(err).Error("userdb socket stopped")
+			}
+			return
+		}
+		select {
+		case s.slots <- struct{}{}:
+		default:
+			s.logger.Warn("Too many userdb connections, closing one")
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer func() { <-s.slots }()
+			s.serve(conn)
+		}()
+	}
+}
+
+// serve answers calls on one connection. Varlink messages are JSON objects
+// terminated by a NUL byte.
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(readTimeout))
+		message, err := readMessage(reader)
+		if err != nil {
+			if errors.Is(err, errMessageTooLarge) {
+				s.logger.Debug("Oversized userdb call, closing the connection")
+			}
+			return
+		}
+
+		var c call
+		if err := json.Unmarshal(message, &c); err != nil {
+			s.logger.WithError(err).Debug("Malformed userdb call")
+			return
+		}
+
+		replies := s.handle(c)
+		if c.Oneway {
+			continue
+		}
+		for _, r := range replies {
+			data, err := json.Marshal(r)
+			if err != nil {
+				return
+			}
+			if _, err := conn.Write(append(data, 0)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readMessage reads the next message without its NUL terminator, keeping at
+// most maxMessage bytes of it
+func readMessage(reader *bufio.Reader) ([]byte, error) {
+	var message []byte
+	for {
+		chunk, err := reader.ReadSlice(0)
+		if len(message)+len(chunk) > maxMessage+1 {
+			return nil, errMessageTooLarge
+		}
+		message = append(message, chunk...)
+		switch {
+		case err == nil:
+			return message[:len(message)-1], nil
+		case !errors.Is(err, bufio.ErrBufferFull):
+			return nil, err
+		}
+	}
+}
+
+func (s *Server) handle(c call) []reply {
+	var params lookup
+	if len(c.Parameters) > 0 {
+		if err := json.Unmarshal(c.Parameters, &params); err != nil {
+			return []reply{failure(errInvalidParameter)}
+		}
+	}
+
+	switch c.Method {
+	case "io.systemd.UserDatabase.GetUserRecord":
+		if params.Service != ServiceName {
+			return []reply{failure(errBadService)}
+		}
+		return s.records(c.More, func(identity Identity) (bool, bool) {
+			return matches(params.UID, params.UserName, identity)
+		}, userRecord)
+	case "io.systemd.UserDatabase.GetGroupRecord":
+		if params.Service != ServiceName {
+			return []reply{failure(errBadService)}
+		}
+		return s.records(c.More, func(identity Identity) (bool, bool) {
+			return matches(params.GID, params.GroupName, identity)
+		}, groupRecord)
+	case "io.systemd.UserDatabase.GetMemberships":
+		if params.Service != ServiceName {
+			return []reply{failure(errBadService)}
+		}
+		// Each JIT user only belongs to its own primary group
+		return []reply{failure(errNoRecordFound)}
+	}
+
+	return []reply{{Error: errMethodNotFound, Parameters: map[string]string{"method": c.Method}}}
+}
+
+// records replies with every identity selected by match, as continued
+// replies when more is set. match returns whether the identity is selected
+// and whether it conflicts with the query, matching by ID but not by name.
+func (s *Server) records(more bool, match func(Identity) (bool, bool), record func(Identity) interface{}) []reply {
+	identities, err := List(s.path)
+	if err != nil {
+		s.logger.WithError(err).Error("Failed to read identity store for userdb")
+		return []reply{failure(errNoRecordFound)}
+	}
+
+	var replies []reply
+	for _, identity := range identities {
+		selected, conflict := match(identity)
+		if conflict {
+			return []reply{failure(errConflictingRecordFound)}
+		}
+		if !selected {
+			continue
+		}
+		replies = append(replies, reply{
+			Parameters: map[string]interface{}{"record": record(identity), "incomplete": false},
+			Continues:  true,
+		})
+		if !more {
+			break
+		}
+	}
+
+	if len(replies) == 0 {
+		return []reply{failure(errNoRecordFound)}
+	}
+	replies[len(replies)-1].Continues = false
+	return replies
+}
+
+// matches selects identity by id and name; a query without either enumerates
+func matches(id *int, name string, identity Identity) (selected, conflict bool) {
+	idMatch := id == nil || *id == identity.UID
+	nameMatch := name == "" || name == identity.UserName
+	if id != nil && name != "" && idMatch != nameMatch {
+		return false, true
+	}
+	return idMatch && nameMatch, false
+}
+
+func userRecord(identity Identity) interface{} {
+	return map[string]interface{}{
+		"userName":      identity.UserName,
+		"uid":           identity.UID,
+		"gid":           identity.UID,
+		"realName":      identity.UserName,
+		"homeDirectory": identity.HomeDirectory,
+		"shell":         identity.Shell,
+		"disposition":   "regular",
+		"service":       ServiceName,
+	}
+}
+
+func groupRecord(identity Identity) interface{} {
+	return map[string]interface{}{
+		"groupName":   identity.UserName,
+		"gid":         identity.UID,
+		"disposition": "regular",
+		"service":     ServiceName,
+	}
+}
+
+func failure(name string) reply {
+	return reply{Error: name, Parameters: struct{}{}}
+}
@@ -0,0 +1,142 @@
+package userdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// serveStore serves a store holding alice until the test ends
+func serveStore(t *testing.T) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("userdb is only served on Linux")
+	}
+
+	dir := t.TempDir()
+	store := Path(dir)
+	if _, err := Add(store, "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	socket := filepath.Join(dir, ServiceName)
+	server, err := Serve(socket, store, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return socket
+}
+
+func dial(t *testing.T, socket string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	return conn
+}
+
+func TestServeUserRecord(t *testing.T) {
+	conn := dial(t, serveStore(t))
+
+	message := `{"method":"io.systemd.UserDatabase.GetUserRecord","parameters":{"userName":"alice","service":"` + ServiceName + `"}}`
+	if _, err := conn.Write(append([]byte(message), 0)); err != nil {
+		t.Fatal(err)
+	}
+	data, err := bufio.NewReader(conn).ReadBytes(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var r struct {
+		Parameters struct {
+			Record struct {
+				UserName string `json:"userName"`
+				UID      int    `json:"uid"`
+			} `json:"record"`
+		} `json:"parameters"`
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(data[:len(data)-1], &r); err != nil {
+		t.Fatalf("reply %q: %v", data, err)
+	}
+	if r.Error != "" || r.Parameters.Record.UserName != "alice" || r.Parameters.Record.UID < minUID {
+		t.Errorf("reply %s, want alice's record", data)
+	}
+}
+
+func TestServeClosesOversizedMessage(t *testing.T) {
+	conn := dial(t, serveStore(t))
+
+	// Far more than maxMessage without a terminator; the agent stops
+	// reading, so the write may fail once the connection is closed
+	go conn.Write(bytes.Repeat([]byte("a"), 4*maxMessage))
+
+	if _, err := bufio.NewReader(conn).ReadBytes(0); err == nil {
+		t.Fatal("the agent replied to an oversized message")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("the agent kept the connection open after an oversized message")
+	}
+}
+
+func TestReadMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    []string
+		wantErr error
+	}{
+		{
+			name:  "messages in turn",
+			input: "{}\x00{\"a\":1}\x00",
+			want:  []string{"{}", `{"a":1}`},
+		},
+		{
+			name:  "largest message",
+			input: strings.Repeat("a", maxMessage) + "\x00",
+			want:  []string{strings.Repeat("a", maxMessage)},
+		},
+		{
+			name:    "too large",
+			input:   strings.Repeat("a", maxMessage+1) + "\x00",
+			wantErr: errMessageTooLarge,
+		},
+		{
+			name:    "unterminated",
+			input:   "{}",
+			wantErr: io.EOF,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := bufio.NewReader(strings.NewReader(tt.input))
+			for _, want := range tt.want {
+				got, err := readMessage(reader)
+				if err != nil || string(got) != want {
+					t.Fatalf("readMessage = %.20q, %v; want %.20q", got, err, want)
+				}
+			}
+			if tt.wantErr != nil {
+				if _, err := readMessage(reader); !errors.Is(err, tt.wantErr) {
+					t.Errorf("readMessage error = %v, want %v", err, tt.wantErr)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package userdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"p0-ssh-agent/internal/filelock"
+)
+
+// FileName is the identity store inside the agent state directory
+const FileName = "userdb.json"
+
+// JIT users get UIDs from the same range as local JIT accounts
+const (
+	minUID = 65536
+	maxUID = 90000
+)
+
+// DefaultShell is the login shell of JIT users, as for local JIT accounts
+const DefaultShell = "/bin/bash"
+
+// Path returns the identity store path for a state directory
+func Path(stateDir string) string {
+	return filepath.Join(stateDir, FileName)
+}
+
+// Identity is a JIT user resolved from the agent's state. Removed identities
+// are kept inactive so the user gets the same UID back and no other user
+// inherits files it left behind.
+type Identity struct {
+	UserName      string    `json:"userName"`
+	UID           int       `json:"uid"`
+	HomeDirectory string    `json:"homeDirectory"`
+	Shell         string    `json:"shell"`
+	Active        bool      `json:"active"`
+	UpdatedAt     time.Time `json:"updatedAt"`
+}
+
+// User returns the identity as an account, with a primary group of the same ID
+func (i Identity) User() *user.User {
+	id := strconv.Itoa(i.UID)
+	return &user.User{
+		Uid:      id,
+		Gid:      id,
+		Username: i.UserName,
+		Name:     i.UserName,
+		HomeDir:  i.HomeDirectory,
+	}
+}
+
+// Lookup returns the active identity named userName
+func Lookup(path, userName string) (Identity, bool, error) {
+	identities, err := read(path)
+	if err != nil {
+		return Identity{}, false, err
+	}
+	identity, ok := identities[userName]
+	return identity, ok && identity.Active, nil
+}
+
+// LookupUID returns the active identity with uid
+func LookupUID(path string, uid int) (Identity, bool, error) {
+	identities, err := read(path)
+	if err != nil {
+		return Identity{}, false, err
+	}
+	for _, identity := range identities {
+		if identity.UID == uid && identity.Active {
+			return identity, true, nil
+		}
+	}
+	return Identity{}, false, nil
+}
+
+// List returns the active identities sorted by UID
+func List(path string) ([]Identity, error) {
+	identities, err := read(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var active []Identity
+	for _, identity := range identities {
+		if identity.Active {
+			active = append(active, identity)
+		}
+	}
+	sort.Slice(active, func(i, j int) bool { return active[i].UID < active[j].UID })
+	return active, nil
+}
+
+// Add activates userName, reusing the UID it had before or allocating the
+// lowest one that neither the store nor a local account holds
+func Add(path, userName string) (Identity, error) {
+	var added Identity
+	err := update(path, func(identities map[string]Identity) error {
+		identity, ok := identities[userName]
+		if !ok {
+			uid, err := allocateUID(identities)
+			if err != nil {
+				return err
+			}
+			identity = Identity{
+				UserName:      userName,
+				UID:           uid,
+				HomeDirectory: filepath.Join("/home", userName),
+				Shell:         DefaultShell,
+			}
+		}
+
+		identity.Active = true
+		identity.UpdatedAt = time.Now().UTC()
+		identities[userName] = identity
+		added = identity
+		return nil
+	})
+	return added, err
+}
+
+// Remove deactivates userName. removed is false when it was not active.
+func Remove(path, userName string) (removed bool, err error) {
+	err = update(path, func(identities map[string]Identity) error {
+		identity, ok := identities[userName]
+		if !ok || !identity.Active {
+			return nil
+		}
+		identity.Active = false
+		identity.UpdatedAt = time.Now().UTC()
+		identities[userName] = identity
+		removed = true
+		return nil
+	})
+	return removed, err
+}
+
+func allocateUID(identities map[string]Identity) (int, error) {
+	taken := make(map[int]bool)
+	for _, identity := range identities {
+		taken[identity.UID] = true
+	}
+
+	for uid := minUID; uid <= maxUID; uid++ {
+		if taken[uid] {
+			continue
+		}
+		if _, err := user.LookupId(strconv.Itoa(uid)); err == nil {
+			continue
+		}
+		return uid, nil
+	}
+	return 0, fmt.Errorf("no available UID found in range %d-%d", minUID, maxUID)
+}
+
+func update(path string, change func(map[string]Identity) error) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+
+	release, err := filelock.Acquire(path + ".lock")
+	if err != nil {
+		return fmt.Errorf("failed to lock identity store: %w", err)
+	}
+	defer release()
+
+	identities, err := read(path)
+	if err != nil {
+		return err
+	}
+
+	if err := change(identities); err != nil {
+		return err
+	}
+
+	list := make([]Identity, 0, len(identities))
+	for _, identity := range identities {
+		list = append(list, identity)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].UID < list[j].UID })
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal identity store: %w", err)
+	}
+
+	// The store is read by the userdb service on every lookup, so it is
+	// replaced in one rename and readable by it without the lock
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to write identity store: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to replace identity store: %w", err)
+	}
+	return nil
+}
+
+func read(path string) (map[string]Identity, error) {
+	identities := make(map[string]Identity)
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return identities, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read identity store: %w", err)
+	}
+
+	var list []Identity
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse identity store %s: %w", path, err)
+	}
+	for _, identity := range list {
+		identities[identity.UserName] = identity
+	}
+	return identities, nil
+}
@@ -0,0 +1,24 @@
+// Package version holds the build information stamped into the binary by
+// the Makefile's -ldflags
+package version
+
+var (
+	version   = "dev"
+	buildTime = "unknown"
+	gitCommit = "unknown"
+)
+
+// GetVersion returns the current version
+func GetVersion() string {
+	return version
+}
+
+// GetBuildTime returns the build time
+func GetBuildTime() string {
+	return buildTime
+}
+
+// GetGitCommit returns the git commit hash
+func GetGitCommit() string {
+	return gitCommit
+}
@@ -0,0 +1,168 @@
+package scripts
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"p0-ssh-agent/internal/state"
+	"p0-ssh-agent/types"
+)
+
+// utmpPath is where glibc records current logins
+const utmpPath = "/var/run/utmp"
+
+// Layout of glibc's struct utmp on 64-bit and 32-bit Linux alike
+const (
+	utmpRecordSize  = 384
+	utmpUserProcess = 7
+	utmpLineOffset  = 8
+	utmpLineSize    = 32
+	utmpUserOffset  = 44
+	utmpUserSize    = 32
+	utmpHostOffset  = 76
+	utmpHostSize    = 256
+	utmpTimeOffset  = 340
+)
+
+// ActiveSessions lists the logins on the host, marking those of users the
+// agent holds an active grant for. Linux hosts read utmp; elsewhere, or
+// where utmp is not kept, who is parsed instead.
+func ActiveSessions(ctx context.Context) ([]types.ActiveSession, error) {
+	var data []byte
+	readErr := os.ErrNotExist
+	if runtime.GOOS == "linux" {
+		data, readErr = os.ReadFile(hostPath(utmpPath))
+	}
+
+	var sessions []types.ActiveSession
+	if readErr == nil {
+		sessions = parseUtmp(data)
+	} else {
+		var err error
+		if sessions, err = whoSessions(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	managed := managedRequests()
+	for i := range sessions {
+		if requestIDs := managed[sessions[i].UserName]; len(requestIDs) > 0 {
+			sessions[i].Managed = true
+			sessions[i].RequestIDs = requestIDs
+		}
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].StartedAt != sessions[j].StartedAt {
+			return sessions[i].StartedAt < sessions[j].StartedAt
+		}
+		return sessions[i].TTY < sessions[j].TTY
+	})
+	return sessions, nil
+}
+
+// parseUtmp returns the user processes in utmp whose process still runs;
+// entries of sessions that ended uncleanly can stay behind
+func parseUtmp(data []byte) []types.ActiveSession {
+	var sessions []types.ActiveSession
+	for offset := 0; offset+utmpRecordSize <= len(data); offset += utmpRecordSize {
+		record := data[offset : offset+utmpRecordSize]
+		if int16(binary.NativeEndian.Uint16(record[0:2])) != utmpUserProcess {
+			continue
+		}
+
+		pid := int(int32(binary.NativeEndian.Uint32(record[4:8])))
+		if _, err := os.Stat("/proc/" + strconv.Itoa(pid)); err != nil {
+			continue
+		}
+
+		started := int64(int32(binary.NativeEndian.Uint32(record[utmpTimeOffset : utmpTimeOffset+4])))
+		sessions = append(sessions, types.ActiveSession{
+			UserName:  cString(record[utmpUserOffset : utmpUserOffset+utmpUserSize]),
+			TTY:       cString(record[utmpLineOffset : utmpLineOffset+utmpLineSize]),
+			Host:      cString(record[utmpHostOffset : utmpHostOffset+utmpHostSize]),
+			PID:       pid,
+			StartedAt: time.Unix(started, 0).UTC().Format(time.RFC3339),
+		})
+	}
+	return sessions
+}
+
+func cString(field []byte) string {
+	if i := bytes.IndexByte(field, 0); i >= 0 {
+		field = field[:i]
+	}
+	return string(field)
+}
+
+// whoSessions parses who, which prints the time as 2006-01-02 15:04 or, in
+// the C locale and on BSD, as Jan _2 15:04 in the local time zone
+func whoSessions(ctx context.Context) ([]types.ActiveSession, error) {
+	output, err := outputOf(command(quiet(ctx), "who"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list logins: %w", err)
+	}
+
+	now := time.Now()
+	var sessions []types.ActiveSession
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		host := ""
+		if open := strings.LastIndex(line, "("); open >= 0 && strings.HasSuffix(line, ")") {
+			host = line[open+1 : len(line)-1]
+			line = line[:open]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			continue
+		}
+
+		session := types.ActiveSession{UserName: fields[0], TTY: fields[1], Host: host}
+		if started, err := time.ParseInLocation("2006-01-02 15:04", fields[2]+" "+fields[3], time.Local); err == nil {
+			session.StartedAt = started.UTC().Format(time.RFC3339)
+		} else if len(fields) >= 5 {
+			if started, err := time.ParseInLocation("Jan 2 15:04", strings.Join(fields[2:5], " "), time.Local); err == nil {
+				// The year is not printed; a login is never in the future
+				started = started.AddDate(now.Year(), 0, 0)
+				if started.After(now) {
+					started = started.AddDate(-1, 0, 0)
+				}
+				session.StartedAt = started.UTC().Format(time.RFC3339)
+			}
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
+
+// managedRequests returns the requests of the active grants of each user
+func managedRequests() map[string][]string {
+	grants, err := state.Load(currentStatePath())
+	if err != nil {
+		return nil
+	}
+
+	now := time.Now()
+	managed := make(map[string][]string)
+	for _, grant := range grants {
+		if grant.Status != state.StatusGranted || grant.Expired(now) {
+			continue
+		}
+		managed[grant.UserName] = appendMissing(managed[grant.UserName], grant.RequestID)
+	}
+	for _, requestIDs := range managed {
+		sort.Strings(requestIDs)
+	}
+	return managed
+}
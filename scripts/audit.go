@@ -0,0 +1,143 @@
+package scripts
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/internal/audit"
+	"p0-ssh-agent/types"
+)
+
+var (
+	auditMu    sync.RWMutex
+	auditPath  = audit.Path(types.DefaultStateDir)
+	auditSinks []audit.Sink
+
+	// auditAppended wakes the agent's audit shipper when an entry is recorded
+	auditAppended = make(chan struct{}, 1)
+)
+
+// SetAuditLogPath sets where provisioning actions are recorded. Local
+// commands append to the agent's log, so its hash chain covers them too.
+func SetAuditLogPath(path string) {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	auditPath = path
+}
+
+// SetAuditSinks sets the destinations that receive a copy of every entry
+// appended to the audit log, built from auditSinks. Sinks new to the log
+// receive the entries appended from now on.
+func SetAuditSinks(sinks []audit.Sink) error {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	auditSinks = sinks
+	return audit.InitCursors(auditPath, sinks)
+}
+
+// ConfigureAuditSinks builds the sinks in configs and sets them
+func ConfigureAuditSinks(configs []types.AuditSink, hostID string) error {
+	sinks, err := audit.NewSinks(configs, hostID)
+	if err != nil {
+		return err
+	}
+	return SetAuditSinks(sinks)
+}
+
+// AuditAppended signals when an entry was appended to the audit log, so the
+// agent ships it without waiting for its next pass
+func AuditAppended() <-chan struct{} {
+	return auditAppended
+}
+
+// ShipAuditLog delivers the entries of the audit log the sinks have not
+// received yet and returns how many it delivered
+func ShipAuditLog() (int, error) {
+	auditMu.RLock()
+	path := auditPath
+	sinks := auditSinks
+	auditMu.RUnlock()
+
+	return audit.Ship(path, sinks)
+}
+
+// FlushAuditLog ships pending entries before a command exits. Entries a
+// sink does not take stay pending and are delivered by the agent.
+func FlushAuditLog(logger *logrus.Logger) {
+	if _, err := ShipAuditLog(); err != nil {
+		logger.WithError(err).Warn("⚠️ Failed to deliver audit log entries to a sink, the agent will retry")
+	}
+}
+
+// recordAudit appends the outcome of a provisioning action to the audit log
+// and wakes the shipper that delivers it to the audit sinks. Failing to
+// record is logged loudly but does not undo the action.
+func recordAudit(command string, req ProvisioningRequest, dryRun bool, result ProvisioningResult, logger *logrus.Logger) {
+	auditMu.RLock()
+	path := auditPath
+	auditMu.RUnlock()
+
+	origin := req.Origin
+	if origin == nil {
+		origin = &audit.Origin{Source: "unknown"}
+	}
+
+	entry, err := audit.Append(path, audit.Entry{
+		RequestID: req.RequestID,
+		Command:   command,
+		UserName:  req.UserName,
+		Action:    req.Action,
+		DryRun:    dryRun,
+		Success:   result.Success,
+		Status:    result.Status,
+		Message:   result.Message,
+		Error:     result.Error,
+		Metadata:  req.Metadata,
+		Origin:    origin,
+	})
+	if err != nil {
+		logger.WithError(err).WithField("audit_log", path).Error("🚨 Failed to write audit log entry")
+		return
+	}
+
+	logger.WithFields(logrus.Fields{
+		"audit_seq":  entry.Seq,
+		"request_id": req.RequestID,
+	}).Debug("Recorded audit log entry")
+
+	// Sinks get the chained entry from the shipper, so copies can be checked
+	// against the log
+	select {
+	case auditAppended <- struct{}{}:
+	default:
+	}
+}
+
+// RecordRejected records a request refused before any script ran, such as a
+// grant that fails the agent's metadata policy
+func RecordRejected(command string, req ProvisioningRequest, dryRun bool, result ProvisioningResult, logger *logrus.Logger) {
+	recordAudit(command, req, dryRun, result, logger)
+}
+
+// RecordTargetCall records a call the agent forwarded to a target. It is
+// recorded under the forward command, so sink filters can tell target calls
+// from provisioning.
+func RecordTargetCall(target string, status int, cached bool, origin *audit.Origin, logger *logrus.Logger) {
+	req := ProvisioningRequest{
+		Origin: origin,
+		Metadata: map[string]string{
+			"target": target,
+			"status": strconv.Itoa(status),
+			"cached": strconv.FormatBool(cached),
+		},
+	}
+	result := ProvisioningResult{
+		Success: status < http.StatusBadRequest,
+		Message: fmt.Sprintf("Forwarded to target %s: %d %s", target, status, http.StatusText(status)),
+	}
+	recordAudit("forward", req, false, result, logger)
+}
@@ -0,0 +1,175 @@
+package scripts
+
+import (
+	"context"
+	"fmt"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"p0-ssh-agent/types"
+)
+
+var (
+	authorizedKeysMu   sync.RWMutex
+	authorizedKeysFile string
+)
+
+// SetAuthorizedKeysFile sets the AuthorizedKeysFile template that keys and
+// CA keys are provisioned to. The agent sets it from authorizedKeysLayout;
+// an empty template is detected from sshd_config each time it is used.
+func SetAuthorizedKeysFile(template string) {
+	authorizedKeysMu.Lock()
+	defer authorizedKeysMu.Unlock()
+	authorizedKeysFile = template
+}
+
+func currentAuthorizedKeysFile(ctx context.Context) (string, error) {
+	authorizedKeysMu.RLock()
+	template := authorizedKeysFile
+	authorizedKeysMu.RUnlock()
+
+	template, _, err := ResolveAuthorizedKeysFile(ctx, template)
+	return template, err
+}
+
+// ResolveAuthorizedKeysFile returns template, or when it is empty the one
+// detected from sshd_config along with the file that sets it. source is
+// empty for a configured template and when sshd uses its default.
+func ResolveAuthorizedKeysFile(ctx context.Context, template string) (resolved, source string, err error) {
+	if template != "" {
+		return template, "", nil
+	}
+	return DetectAuthorizedKeysFile(ctx)
+}
+
+// DetectAuthorizedKeysFile picks, from the AuthorizedKeysFile entries sshd
+// applies to every user, the one keys should go to: ~/.ssh/authorized_keys
+// when sshd lists it, so existing hosts keep their files, and otherwise the
+// first entry with a per-user token. source names the file that sets it, or
+// is empty for sshd's default. When sshd reads no per-user file, keys
+// written anywhere would be ignored, so it fails rather than guess.
+func DetectAuthorizedKeysFile(ctx context.Context) (template, source string, err error) {
+	entries, err := SSHDAuthorizedKeysFiles(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	if _, file := sshdDirective(ctx, sshdConfigPath, "AuthorizedKeysFile", 0); file != "" {
+		source = file
+	}
+
+	for _, entry := range entries {
+		if entry == types.HomeAuthorizedKeysFile {
+			return entry, source, nil
+		}
+	}
+	for _, entry := range entries {
+		if strings.Contains(entry, "%h") || strings.Contains(entry, "%u") || strings.Contains(entry, "%U") {
+			return entry, source, nil
+		}
+	}
+	return "", "", fmt.Errorf("sshd reads no per-user authorized keys file (AuthorizedKeysFile %q); set authorizedKeysLayout to a file sshd reads", strings.Join(entries, " "))
+}
+
+// ExpandAuthorizedKeysFile resolves an AuthorizedKeysFile template for a user
+// the way sshd does: %h is the home directory, %u the user name, %U the
+// numeric user ID and %% a literal percent sign
+func ExpandAuthorizedKeysFile(template string, userInfo *user.User) string {
+	var path strings.Builder
+	for i := 0; i < len(template); i++ {
+		if template[i] != '%' || i+1 == len(template) {
+			path.WriteByte(template[i])
+			continue
+		}
+		i++
+		switch template[i] {
+		case 'h':
+			path.WriteString(userInfo.HomeDir)
+		case 'u':
+			path.WriteString(userInfo.Username)
+		case 'U':
+			path.WriteString(userInfo.Uid)
+		default:
+			path.WriteByte(template[i])
+		}
+	}
+	return path.String()
+}
+
+// authorizedKeysFileFor returns where the user's provisioned keys are kept,
+// with the mode and owner the file is created with. Files in ~/.ssh belong
+// to the user as sshd expects; anywhere else they are root-owned and
+// world-readable, since sshd reads them with the user's privileges.
+func authorizedKeysFileFor(ctx context.Context, userInfo *user.User) (path, permission, owner string, err error) {
+	template, err := currentAuthorizedKeysFile(ctx)
+	if err != nil {
+		return "", "", "", err
+	}
+	path = ExpandAuthorizedKeysFile(template, userInfo)
+	if !strings.HasPrefix(template, "%h") {
+		path = hostPath(path)
+	}
+
+	if filepath.Dir(path) == filepath.Join(userInfo.HomeDir, ".ssh") {
+		return path, "600", userInfo.Username, nil
+	}
+	return path, "644", "root", nil
+}
+
+// authorizedKeysFilesFor lists every file a revoke cleans for the user: the
+// files the grant recorded writing to, the currently configured one and
+// ~/.ssh/authorized_keys, so keys granted before the layout changed are
+// still removed
+func authorizedKeysFilesFor(ctx context.Context, userInfo *user.User, granted []string) []string {
+	paths := append([]string{}, granted...)
+	if path, _, _, err := authorizedKeysFileFor(ctx, userInfo); err == nil {
+		paths = append(paths, path)
+	}
+	paths = append(paths, ExpandAuthorizedKeysFile(types.HomeAuthorizedKeysFile, userInfo))
+
+	var unique []string
+	seen := make(map[string]bool)
+	for _, path := range paths {
+		if !seen[path] {
+			seen[path] = true
+			unique = append(unique, path)
+		}
+	}
+	return unique
+}
+
+// NormalizeAuthorizedKeysFile rewrites an sshd AuthorizedKeysFile entry as a
+// template comparable with authorizedKeysLayout: relative entries are
+// relative to the home directory, as sshd treats them
+func NormalizeAuthorizedKeysFile(entry string) string {
+	if strings.HasPrefix(entry, "/") || strings.HasPrefix(entry, "%h/") {
+		return entry
+	}
+	return "%h/" + strings.TrimPrefix(entry, "~/")
+}
+
+// SSHDAuthorizedKeysFiles returns the AuthorizedKeysFile entries of the
+// effective sshd configuration, normalized. Match blocks are not applied, so
+// a layout set only for some users is not reflected.
+func SSHDAuthorizedKeysFiles(ctx context.Context) ([]string, error) {
+	output, err := outputOf(privileged(quiet(ctx), "sshd", "-T"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read effective sshd configuration: %w", err)
+	}
+
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "authorizedkeysfile" {
+			continue
+		}
+		var entries []string
+		for _, entry := range fields[1:] {
+			if entry != "none" {
+				entries = append(entries, NormalizeAuthorizedKeysFile(entry))
+			}
+		}
+		return entries, nil
+	}
+	return []string{types.HomeAuthorizedKeysFile}, nil
+}
@@ -0,0 +1,177 @@
+package scripts
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// BulkRevokeRequest revokes many grants in one call, e.g. after an off-boarding event
+type BulkRevokeRequest struct {
+	RequestID string           `json:"requestId"`
+	Items     []BulkRevokeItem `json:"items"`
+}
+
+// BulkRevokeItem is a single revocation. The action is always forced to "revoke".
+type BulkRevokeItem struct {
+	Command string `json:"command"`
+	ProvisioningRequest
+}
+
+type BulkRevokeItemResult struct {
+	Index     int    `json:"index"`
+	Command   string `json:"command"`
+	UserName  string `json:"userName"`
+	RequestID string `json:"requestId"`
+	Success   bool   `json:"success"`
+	Message   string `json:"message,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// BulkRevokeProgress is reported after every completed item
+type BulkRevokeProgress struct {
+	Completed int
+	Total     int
+	Succeeded int
+	Failed    int
+}
+
+// BulkRevoke processes revocations with at most concurrency workers. Items for the
+// same user are serialized, so removing the account never races the revoke of its
+// keys. Files shared between users, such as /etc/sudoers-p0, are edited under
+// their managed-file lock like every grant and revoke, so workers and requests
+// handled beside the bulk revoke never overwrite each other's changes.
+func BulkRevoke(req BulkRevokeRequest, concurrency int, dryRun bool, onProgress func(BulkRevokeProgress), logger *logrus.Logger) ProvisioningResult {
+	total := len(req.Items)
+	if total == 0 {
+		return ProvisioningResult{
+			Success: true,
+			Message: "No items to revoke",
+			Data:    []BulkRevokeItemResult{},
+		}
+	}
+
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	if concurrency > total {
+		concurrency = total
+	}
+
+	logger.WithFields(logrus.Fields{
+		"request_id":  req.RequestID,
+		"items":       total,
+		"concurrency": concurrency,
+		"dry_run":     dryRun,
+	}).Info("🧹 Starting bulk revoke")
+
+	results := make([]BulkRevokeItemResult, total)
+	userLocks := make(map[string]*sync.Mutex)
+	for _, item := range req.Items {
+		if _, ok := userLocks[item.UserName]; !ok {
+			userLocks[item.UserName] = &sync.Mutex{}
+		}
+	}
+
+	var (
+		progressMu sync.Mutex
+		progress   = BulkRevokeProgress{Total: total}
+		wg         sync.WaitGroup
+		indexes    = make(chan int)
+
+		// updates carries every snapshot to the reporter, which alone calls
+		// onProgress, so a slow notification never holds up the workers
+		updates  = make(chan BulkRevokeProgress, total)
+		reported = make(chan struct{})
+	)
+
+	go func() {
+		defer close(reported)
+		for snapshot := range updates {
+			// Only the latest of the snapshots queued meanwhile is reported
+			for pending := len(updates); pending > 0; pending-- {
+				snapshot = <-updates
+			}
+			if onProgress != nil {
+				onProgress(snapshot)
+			}
+		}
+	}()
+
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				item := req.Items[i]
+
+				lock := userLocks[item.UserName]
+				lock.Lock()
+				results[i] = revokeItem(i, item, dryRun, logger)
+				lock.Unlock()
+
+				progressMu.Lock()
+				progress.Completed++
+				if results[i].Success {
+					progress.Succeeded++
+				} else {
+					progress.Failed++
+				}
+				updates <- progress
+				progressMu.Unlock()
+			}
+		}()
+	}
+
+	for i := range req.Items {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	close(updates)
+	<-reported
+
+	logger.WithFields(logrus.Fields{
+		"request_id": req.RequestID,
+		"succeeded":  progress.Succeeded,
+		"failed":     progress.Failed,
+	}).Info("🧹 Bulk revoke finished")
+
+	if progress.Failed > 0 {
+		return ProvisioningResult{
+			Success: false,
+			Error:   fmt.Sprintf("%d of %d revocations failed", progress.Failed, total),
+			Data:    results,
+		}
+	}
+
+	return ProvisioningResult{
+		Success: true,
+		Message: fmt.Sprintf("Revoked %d grants", total),
+		Data:    results,
+	}
+}
+
+func revokeItem(index int, item BulkRevokeItem, dryRun bool, logger *logrus.Logger) BulkRevokeItemResult {
+	result := BulkRevokeItemResult{
+		Index:     index,
+		Command:   item.Command,
+		UserName:  item.UserName,
+		RequestID: item.RequestID,
+	}
+
+	if Command(item.Command) == CommandBulkRevoke {
+		result.Error = "nested bulkRevoke is not allowed"
+		return result
+	}
+
+	req := item.ProvisioningRequest
+	req.Action = "revoke"
+
+	scriptResult := ExecuteScript(item.Command, req, dryRun, logger)
+	result.Success = scriptResult.Success
+	result.Message = scriptResult.Message
+	result.Error = scriptResult.Error
+	return result
+}
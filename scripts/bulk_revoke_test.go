@@ -0,0 +1,57 @@
+package scripts
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestBulkRevokeProgressDoesNotHoldUpWorkers(t *testing.T) {
+	const total = 50
+
+	// Nested bulk revokes fail at once without touching the host
+	req := BulkRevokeRequest{RequestID: "bulk-1"}
+	for i := 0; i < total; i++ {
+		req.Items = append(req.Items, BulkRevokeItem{Command: string(CommandBulkRevoke)})
+	}
+
+	release := make(chan struct{})
+	var calls []BulkRevokeProgress
+	onProgress := func(progress BulkRevokeProgress) {
+		calls = append(calls, progress)
+		if len(calls) == 1 {
+			<-release
+		}
+	}
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	done := make(chan ProvisioningResult)
+	go func() {
+		done <- BulkRevoke(req, 4, false, onProgress, logger)
+	}()
+
+	// The workers finish while the first notification is stuck
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("BulkRevoke did not return")
+	}
+
+	// What completed behind the stuck notification is reported at once
+	if len(calls) == 0 || len(calls) > 2 {
+		t.Fatalf("onProgress called with %+v, want the first snapshot and the final one", calls)
+	}
+	last := calls[len(calls)-1]
+	if last.Completed != total || last.Failed != total || last.Total != total {
+		t.Errorf("final progress %+v, want %d of %d completed and failed", last, total, total)
+	}
+	if len(calls) == 2 && calls[0].Completed >= last.Completed {
+		t.Errorf("progress went from %d to %d completed", calls[0].Completed, last.Completed)
+	}
+}
@@ -0,0 +1,120 @@
+package scripts
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"p0-ssh-agent/types"
+)
+
+const (
+	// certAuthorityKeyFile holds the host-local user CA private key
+	certAuthorityKeyFile = "user_ca_key"
+
+	// certificateClockSkew backdates certificates so hosts with a slightly
+	// slow clock accept them immediately
+	certificateClockSkew = 5 * time.Minute
+)
+
+// certificateExtensions are granted to locally signed certificates. X11 and
+// agent forwarding are left out; port forwarding is still limited by sshd.
+var certificateExtensions = map[string]string{
+	"permit-pty":             "",
+	"permit-user-rc":         "",
+	"permit-port-forwarding": "",
+}
+
+var (
+	certAuthorityMu  sync.Mutex
+	certAuthorityDir = CertificateAuthorityDir(types.DefaultStateDir)
+)
+
+// CertificateAuthorityDir returns where the local user CA is kept for a state directory
+func CertificateAuthorityDir(stateDir string) string {
+	return filepath.Join(stateDir, "ssh-ca")
+}
+
+// SetCertificateAuthorityDir sets where the host-local user CA key is kept.
+// The directory must survive restarts: a new key would not match the one
+// sshd already trusts.
+func SetCertificateAuthorityDir(dir string) {
+	certAuthorityMu.Lock()
+	defer certAuthorityMu.Unlock()
+	certAuthorityDir = dir
+}
+
+// localCertificateAuthority loads the host-local user CA, creating an
+// Ed25519 key on first use. Only this host trusts it, so certificates it
+// signs are scoped to this host.
+func localCertificateAuthority() (ssh.Signer, error) {
+	certAuthorityMu.Lock()
+	defer certAuthorityMu.Unlock()
+
+	keyPath := filepath.Join(certAuthorityDir, certAuthorityKeyFile)
+
+	if data, err := os.ReadFile(keyPath); err == nil {
+		signer, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse local CA key %s: %w", keyPath, err)
+		}
+		return signer, nil
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read local CA key: %w", err)
+	}
+
+	if err := os.MkdirAll(certAuthorityDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create CA directory: %w", err)
+	}
+
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate local CA key: %w", err)
+	}
+
+	hostname, _ := os.Hostname()
+	block, err := ssh.MarshalPrivateKey(privateKey, "p0-ssh-agent user CA "+hostname)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode local CA key: %w", err)
+	}
+
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(block), 0600); err != nil {
+		return nil, fmt.Errorf("failed to write local CA key: %w", err)
+	}
+
+	return ssh.NewSignerFromKey(privateKey)
+}
+
+// signUserCertificate issues a user certificate for publicKey valid until validBefore
+func signUserCertificate(ca ssh.Signer, publicKey ssh.PublicKey, keyID string, principals []string, validBefore time.Time) (*ssh.Certificate, error) {
+	var serial [8]byte
+	if _, err := rand.Read(serial[:]); err != nil {
+		return nil, fmt.Errorf("failed to generate certificate serial: %w", err)
+	}
+
+	cert := &ssh.Certificate{
+		Key:             publicKey,
+		Serial:          binary.BigEndian.Uint64(serial[:]),
+		CertType:        ssh.UserCert,
+		KeyId:           keyID,
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(time.Now().Add(-certificateClockSkew).Unix()),
+		ValidBefore:     uint64(validBefore.Unix()),
+		Permissions: ssh.Permissions{
+			Extensions: certificateExtensions,
+		},
+	}
+
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		return nil, fmt.Errorf("failed to sign certificate: %w", err)
+	}
+	return cert, nil
+}
@@ -0,0 +1,119 @@
+package scripts
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/internal/audit"
+	"p0-ssh-agent/internal/state"
+)
+
+// loginCommands grant a way to log in. Sessions are terminated only when one
+// of them expires; sudo rules, forwarding and notices may end earlier than
+// the rest of a grant without ending its sessions.
+var loginCommands = map[string]bool{
+	string(CommandProvisionAuthorizedKeys): true,
+	string(CommandProvisionCAKeys):         true,
+	string(CommandProvisionCertificate):    true,
+	string(CommandProvisionUser):           true,
+}
+
+// expiryOrder revokes access paths before the account-level entries, so no
+// new login can start while the user's sessions are being terminated
+var expiryOrder = map[string]int{
+	string(CommandProvisionAuthorizedKeys): 0,
+	string(CommandProvisionCAKeys):         0,
+	string(CommandProvisionCertificate):    0,
+	string(CommandProvisionSudo):           1,
+	string(CommandProvisionPortForward):    1,
+	string(CommandProvisionBanner):         2,
+	string(CommandProvisionUser):           2,
+}
+
+// RevokeExpired revokes every recorded grant whose expiry has passed at now,
+// except those skip claims, then terminates the sessions of each user and
+// request whose login access it revoked. source is the audit origin of the
+// revokes. It returns the grants revoked; a failed revoke stays granted and
+// is retried by the next call.
+func RevokeExpired(now time.Time, skip func(requestID, command string) bool, source string, dryRun bool, logger *logrus.Logger) ([]state.Grant, error) {
+	grants, err := state.Load(currentStatePath())
+	if err != nil {
+		return nil, err
+	}
+
+	var expired []state.Grant
+	for _, grant := range grants {
+		if grant.Expired(now) && (skip == nil || !skip(grant.RequestID, grant.Command)) {
+			expired = append(expired, grant)
+		}
+	}
+	if len(expired) == 0 {
+		return nil, nil
+	}
+
+	sort.SliceStable(expired, func(i, j int) bool {
+		if expired[i].RequestID != expired[j].RequestID {
+			return expired[i].RequestID < expired[j].RequestID
+		}
+		return expiryOrder[expired[i].Command] < expiryOrder[expired[j].Command]
+	})
+
+	// Sessions are terminated once per user and request, after all of the
+	// request's expired grants are gone. provisionSession keeps sessions
+	// opened with another grant the user still holds.
+	type session struct{ requestID, username string }
+	sessions := make(map[session]bool)
+	var revoked []state.Grant
+	for _, grant := range expired {
+		if revokeExpiredGrant(grant, source, dryRun, logger) {
+			revoked = append(revoked, grant)
+			if loginCommands[grant.Command] {
+				sessions[session{grant.RequestID, grant.UserName}] = true
+			}
+		}
+	}
+
+	for s := range sessions {
+		result := ExecuteScript(string(CommandProvisionSession), ProvisioningRequest{
+			UserName:  s.username,
+			Action:    "revoke",
+			RequestID: s.requestID,
+			Force:     true,
+			Origin:    &audit.Origin{Source: source},
+		}, dryRun, logger)
+		if !result.Success {
+			logger.WithField("username", s.username).WithField("error", result.Error).Error("❌ Failed to terminate sessions of expired grant")
+		}
+	}
+	return revoked, nil
+}
+
+// revokeExpiredGrant revokes one expired grant and reports whether it succeeded
+func revokeExpiredGrant(grant state.Grant, source string, dryRun bool, logger *logrus.Logger) bool {
+	var req ProvisioningRequest
+	if err := json.Unmarshal(grant.Request, &req); err != nil {
+		logger.WithError(err).WithField("key", grant.Key).Error("Recorded grant is unreadable, cannot revoke it on expiry")
+		return false
+	}
+	req.Action = "revoke"
+	req.Origin = &audit.Origin{Source: source}
+
+	logger.WithFields(logrus.Fields{
+		"key":        grant.Key,
+		"username":   grant.UserName,
+		"expired_at": grant.ExpiresAt.Format(time.RFC3339),
+	}).Info("⌛ Grant expired, revoking access")
+
+	result := ExecuteScript(grant.Command, req, dryRun, logger)
+	if !result.Success {
+		logger.WithFields(logrus.Fields{
+			"key":   grant.Key,
+			"error": result.Error,
+		}).Error("❌ Failed to revoke expired grant, will retry")
+		return false
+	}
+	return true
+}
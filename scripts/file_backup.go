@@ -0,0 +1,46 @@
+package scripts
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/internal/filebackup"
+	"p0-ssh-agent/types"
+)
+
+var (
+	fileBackupMu  sync.RWMutex
+	fileBackupDir = filebackup.Dir(types.DefaultStateDir)
+)
+
+// SetFileBackupDir sets where managed files are copied before each modification.
+// restore-file lists the copies from there, so commands that edit files
+// outside the agent set the same directory.
+func SetFileBackupDir(dir string) {
+	fileBackupMu.Lock()
+	defer fileBackupMu.Unlock()
+	fileBackupDir = dir
+}
+
+// backupManagedFile saves a copy of filePath before it is changed. A failed
+// backup is logged but does not block the change, so revocations always proceed.
+func backupManagedFile(filePath string, logger *logrus.Logger) {
+	fileBackupMu.RLock()
+	dir := fileBackupDir
+	fileBackupMu.RUnlock()
+
+	backup, err := filebackup.Save(dir, filePath, time.Now())
+	if err != nil {
+		logger.WithError(err).WithField("file", filePath).Warn("⚠️ Failed to back up managed file before modification")
+		return
+	}
+
+	if backup != nil {
+		logger.WithFields(logrus.Fields{
+			"file":   filePath,
+			"backup": backup.Storage,
+		}).Debug("Backed up managed file")
+	}
+}
@@ -0,0 +1,176 @@
+package scripts
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/internal/elevate"
+)
+
+// Host is how the scripts reach the machine they provision. The default runs
+// commands and looks up accounts on the real host; the integration harness in
+// internal/harness swaps in a recording fake rooted in a temporary directory.
+type Host struct {
+	// Root prefixes every host path the scripts read or write, e.g.
+	// /etc/sudoers-p0. Paths written into configuration stay unprefixed.
+	Root string
+
+	// Command builds external commands, including sudo invocations, that
+	// end with ctx. The default builds them with elevate.ExecContext, so the
+	// processes of a provisioning command that times out are terminated and
+	// those of other commands are not.
+	Command func(ctx context.Context, name string, arg ...string) *exec.Cmd
+
+	// Direct changes root-owned files with the os package instead of sudo
+	// commands such as tee and chmod. The default host sets it when the agent
+	// runs as root or on Windows; a host without it gets every change through
+	// Command.
+	Direct bool
+
+	// Sudo keeps SetHost from defaulting Direct, so every change goes through
+	// Command even when the agent runs as root. The integration harness sets
+	// it to record the changes; real hosts leave it unset.
+	Sudo bool
+
+	// LookupUser resolves local accounts and their home directories
+	LookupUser func(username string) (*user.User, error)
+
+	// CreateUser creates a JIT account. Nil uses the OS plugin.
+	CreateUser func(ctx context.Context, username string, logger *logrus.Logger) error
+
+	// RemoveUser removes a JIT account once its last grant is revoked. Nil
+	// keeps the account, as local accounts always are.
+	RemoveUser func(ctx context.Context, username string, logger *logrus.Logger) error
+}
+
+var (
+	hostMu      sync.RWMutex
+	currentHost = defaultHost()
+)
+
+func defaultHost() Host {
+	return Host{
+		Root:       "/",
+		Command:    elevate.ExecContext,
+		Direct:     elevate.Privileged().Direct,
+		LookupUser: user.Lookup,
+	}
+}
+
+// SetHost replaces how scripts reach the host and returns a function that
+// restores the previous one. Unset fields keep their defaults; Direct does
+// unless Sudo is set.
+func SetHost(host Host) (restore func()) {
+	defaults := defaultHost()
+	if host.Root == "" {
+		host.Root = defaults.Root
+	}
+	if host.Command == nil {
+		host.Command = defaults.Command
+	}
+	if host.LookupUser == nil {
+		host.LookupUser = defaults.LookupUser
+	}
+	if !host.Direct && !host.Sudo {
+		host.Direct = defaults.Direct
+	}
+
+	hostMu.Lock()
+	previous := currentHost
+	currentHost = host
+	hostMu.Unlock()
+
+	return func() {
+		hostMu.Lock()
+		currentHost = previous
+		hostMu.Unlock()
+	}
+}
+
+func activeHost() Host {
+	hostMu.RLock()
+	defer hostMu.RUnlock()
+	return currentHost
+}
+
+// command builds an external command through the active host, ending with ctx
+func command(ctx context.Context, name string, arg ...string) *exec.Cmd {
+	return activeHost().Command(ctx, name, arg...)
+}
+
+// privileged builds a command that needs root through the active host: as is
+// on a Direct host, which is root already and may have no sudo, and through
+// sudo otherwise. Every privileged command of the scripts is built here.
+func privileged(ctx context.Context, name string, arg ...string) *exec.Cmd {
+	if activeHost().Direct {
+		return command(ctx, name, arg...)
+	}
+	return command(ctx, "sudo", append([]string{name}, arg...)...)
+}
+
+// outputOf runs cmd and returns its standard output, keeping at most the
+// maxOutputBytes of scriptLimits
+func outputOf(cmd *exec.Cmd) ([]byte, error) {
+	return elevate.Output(cmd)
+}
+
+// combinedOutputOf runs cmd and returns its standard output and error,
+// keeping at most the maxOutputBytes of scriptLimits
+func combinedOutputOf(cmd *exec.Cmd) ([]byte, error) {
+	return elevate.CombinedOutput(cmd)
+}
+
+// quiet returns ctx for commands that read what the scripts act on, such as
+// sshd -T or ps. Their output is data rather than progress, so it is not
+// copied to the output of the provisioning command.
+func quiet(ctx context.Context) context.Context {
+	return elevate.WithoutOutput(ctx)
+}
+
+// files changes root-owned host files: directly on a Direct host, and through
+// sudo commands ending with ctx otherwise. What those commands print is file
+// content and is never streamed.
+func files(ctx context.Context) elevate.Files {
+	ctx = quiet(ctx)
+	return elevate.Files{
+		Direct: activeHost().Direct,
+		Command: func(name string, arg ...string) *exec.Cmd {
+			return privileged(ctx, name, arg...)
+		},
+	}
+}
+
+// chownToUser gives path to username and the user's primary group. A
+// symlink is changed itself, never the file it points to.
+func chownToUser(ctx context.Context, path, username string) error {
+	userInfo, err := lookupUser(username)
+	if err != nil {
+		return err
+	}
+	uid, err := strconv.Atoi(userInfo.Uid)
+	if err != nil {
+		return fmt.Errorf("user %s has no numeric UID: %w", username, err)
+	}
+	gid, err := strconv.Atoi(userInfo.Gid)
+	if err != nil {
+		return fmt.Errorf("user %s has no numeric GID: %w", username, err)
+	}
+	return files(ctx).Chown(path, uid, gid)
+}
+
+// hostPath places an absolute host path under the active host root
+func hostPath(path string) string {
+	return filepath.Join(activeHost().Root, path)
+}
+
+// lookupUser resolves a local account through the active host
+func lookupUser(username string) (*user.User, error) {
+	return activeHost().LookupUser(username)
+}
@@ -0,0 +1,42 @@
+package scripts
+
+import (
+	"testing"
+
+	"p0-ssh-agent/internal/elevate"
+)
+
+func TestSetHostDirect(t *testing.T) {
+	tests := []struct {
+		name string
+		host Host
+		want bool
+	}{
+		{
+			name: "unset keeps the default",
+			host: Host{Root: t.TempDir()},
+			want: elevate.Privileged().Direct,
+		},
+		{
+			name: "set is kept",
+			host: Host{Direct: true},
+			want: true,
+		},
+		{
+			name: "sudo opts out",
+			host: Host{Sudo: true},
+			want: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			restore := SetHost(tt.host)
+			defer restore()
+
+			if got := activeHost().Direct; got != tt.want {
+				t.Errorf("Direct = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,262 @@
+package scripts
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/internal/elevate"
+	"p0-ssh-agent/internal/filelock"
+)
+
+// managedFile is a file with managed blocks read into memory for editing.
+// Blocks and lines are changed in memory and written back by save in one
+// atomic replacement, so an edit never leaves a partially written file and
+// never depends on how the existing entries are separated.
+type managedFile struct {
+	path    string
+	mode    os.FileMode
+	lines   []string
+	exists  bool
+	changed bool
+
+	// added is set when lines were added or replaced, not only removed
+	added bool
+}
+
+// managedFileLocks holds a mutex per path, as every edit reads, modifies and
+// replaces the whole file. The mutex keeps the agent's own edits apart where
+// flock is not available.
+var managedFileLocks sync.Map
+
+// lockManagedFile serializes the edits of filePath and returns the unlock.
+// Besides the agent's own mutex it holds a flock on a lock file in the state
+// directory, so CLI commands run beside the agent, such as revoke-local, wait
+// for each other too. The lock file is never placed next to filePath, where
+// the owner of a home directory could have put a symlink.
+func lockManagedFile(filePath string) (func(), error) {
+	value, _ := managedFileLocks.LoadOrStore(filePath, &sync.Mutex{})
+	mu := value.(*sync.Mutex)
+	mu.Lock()
+
+	dir := filepath.Join(filepath.Dir(currentStatePath()), "locks")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		mu.Unlock()
+		return nil, fmt.Errorf("failed to create lock directory: %w", err)
+	}
+	sum := sha256.Sum256([]byte(filePath))
+	release, err := filelock.Acquire(filepath.Join(dir, hex.EncodeToString(sum[:8])+".lock"))
+	if err != nil {
+		mu.Unlock()
+		return nil, fmt.Errorf("failed to lock %s: %w", filePath, err)
+	}
+	return func() {
+		release()
+		mu.Unlock()
+	}, nil
+}
+
+// openManagedFile reads filePath for editing. A missing file is empty and is
+// created with mode when saved; an existing one keeps its mode and owner.
+// Symlinks are refused, both for filePath and its directory: a user could
+// otherwise point ~/.ssh or ~/.ssh/authorized_keys at a file only root may
+// change and have the agent write to it.
+func openManagedFile(ctx context.Context, filePath string, mode os.FileMode) (*managedFile, error) {
+	file := &managedFile{path: filePath, mode: mode}
+
+	fs := files(ctx)
+	dirKind, dirExists, err := fs.FileType(filepath.Dir(filePath))
+	if err != nil {
+		return nil, fmt.Errorf("failed to check %s: %w", filepath.Dir(filePath), err)
+	}
+	if dirExists && !dirKind.IsDir() {
+		return nil, fmt.Errorf("refusing to edit %s: %s is not a directory", filePath, filepath.Dir(filePath))
+	}
+
+	kind, exists, err := fs.FileType(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check %s: %w", filePath, err)
+	}
+	if !exists {
+		return file, nil
+	}
+	if !kind.IsRegular() {
+		return nil, fmt.Errorf("refusing to edit %s: %w", filePath, elevate.ErrNotRegular)
+	}
+
+	lines, err := readManagedFile(ctx, filePath)
+	if err != nil {
+		return nil, err
+	}
+	file.lines = lines
+	file.exists = true
+	return file, nil
+}
+
+// readManagedFile returns the file's lines without the trailing newline. Only
+// a regular file is read, never the target of a symlink.
+func readManagedFile(ctx context.Context, filePath string) ([]string, error) {
+	output, err := files(ctx).ReadRegularFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", filePath, err)
+	}
+
+	content := strings.TrimSuffix(string(output), "\n")
+	if content == "" {
+		return nil, nil
+	}
+	return strings.Split(content, "\n"), nil
+}
+
+// hasBlock reports whether the file holds an intact block for requestID with
+// exactly content
+func (f *managedFile) hasBlock(requestID, content string) bool {
+	wanted := contentChecksum(strings.Split(strings.TrimRight(content, "\n"), "\n"))
+	for _, block := range parseBlocks(f.lines) {
+		if block.RequestID == requestID && !block.Legacy && !block.Tampered() && block.Checksum == wanted {
+			return true
+		}
+	}
+	return false
+}
+
+// setBlock makes content the only block for requestID. It takes the place of
+// the first existing block for requestID, such as a legacy or hand-edited one,
+// or is added at the end of the file.
+func (f *managedFile) setBlock(requestID, content string) {
+	rendered := strings.Split(strings.TrimSuffix(renderBlock(requestID, content), "\n"), "\n")
+
+	var updated []string
+	next, placed := 0, false
+	for _, block := range parseBlocks(f.lines) {
+		if block.RequestID != requestID {
+			continue
+		}
+		updated = append(updated, f.lines[next:block.Start]...)
+		if !placed {
+			updated = append(updated, rendered...)
+			placed = true
+		}
+		next = block.End + 1
+	}
+	updated = append(updated, f.lines[next:]...)
+	if !placed {
+		updated = append(updated, rendered...)
+	}
+
+	f.lines = updated
+	f.changed = true
+	f.added = true
+}
+
+// removeBlocks deletes every block for requestID and returns the ones whose
+// content had been modified by hand. Of an unterminated block, the begin
+// marker is removed along with the lines up to the next marker that are
+// lines of content, what the grant wrote, if known.
+func (f *managedFile) removeBlocks(requestID, content string) []managedBlock {
+	written := make(map[string]bool)
+	for _, line := range strings.Split(content, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			written[line] = true
+		}
+	}
+
+	var tampered []managedBlock
+	remove := make(map[int]bool)
+	for _, block := range parseBlocks(f.lines) {
+		if block.RequestID != requestID {
+			continue
+		}
+		if block.Tampered() {
+			tampered = append(tampered, block)
+		}
+		for i := block.Start; i <= block.End; i++ {
+			remove[i] = true
+		}
+		if !block.Unterminated {
+			continue
+		}
+		for i := block.End + 1; i < len(f.lines) && !isMarkerLine(f.lines[i]); i++ {
+			if written[strings.TrimSpace(f.lines[i])] {
+				remove[i] = true
+			}
+		}
+	}
+
+	if len(remove) == 0 {
+		return nil
+	}
+
+	kept := make([]string, 0, len(f.lines)-len(remove))
+	for i, line := range f.lines {
+		if !remove[i] {
+			kept = append(kept, line)
+		}
+	}
+
+	f.lines = kept
+	f.changed = true
+	return tampered
+}
+
+// hasLine reports whether any line contains text, as grep -F would
+func (f *managedFile) hasLine(text string) bool {
+	for _, line := range f.lines {
+		if strings.Contains(line, text) {
+			return true
+		}
+	}
+	return false
+}
+
+// setLine replaces the line at index i
+func (f *managedFile) setLine(i int, line string) {
+	f.lines[i] = line
+	f.changed = true
+	f.added = true
+}
+
+// addLine adds line at the end of the file
+func (f *managedFile) addLine(line string) {
+	f.lines = append(f.lines, line)
+	f.changed = true
+	f.added = true
+}
+
+// save writes the edited file back if anything changed, after backing up the
+// previous content. Sudoers files are only replaced by a copy visudo accepts,
+// unless the edit only removed lines.
+func (f *managedFile) save(ctx context.Context, logger *logrus.Logger) error {
+	if !f.changed {
+		return nil
+	}
+
+	if f.exists {
+		backupManagedFile(f.path, logger)
+	}
+
+	content := ""
+	if len(f.lines) > 0 {
+		content = strings.Join(f.lines, "\n") + "\n"
+	}
+
+	if isSudoersFile(f.path) {
+		if err := writeSudoers(ctx, f.path, content, !f.added, logger); err != nil {
+			return err
+		}
+	} else if err := files(ctx).ReplaceFile(f.path, []byte(content), f.mode); err != nil {
+		return fmt.Errorf("failed to write %s: %w", f.path, err)
+	}
+
+	f.exists = true
+	f.changed = false
+	f.added = false
+	return nil
+}
@@ -0,0 +1,140 @@
+package scripts
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Managed content is wrapped in begin/end markers. The end marker carries a
+// checksum of the lines in between so removal is exact and hand edits inside
+// a block are detected:
+//
+//	# BEGIN P0 RequestID: req-123
+//	ssh-ed25519 AAAA... user@example
+//	# END P0 RequestID: req-123 sha256:9f86d0...
+const (
+	beginMarkerPrefix = "# BEGIN P0 RequestID: "
+	endMarkerPrefix   = "# END P0 RequestID: "
+	checksumPrefix    = "sha256:"
+
+	// legacyMarkerPrefix tagged the single line that followed it in older releases
+	legacyMarkerPrefix = "# RequestID: "
+)
+
+// StatusMalformed is the result status of a revoke that found the request's
+// block without its end marker. The grant is removed as far as it can be
+// told apart from the rest of the file, which should be checked by hand.
+const StatusMalformed = "malformed"
+
+// worseStatus returns the status of two removals to report for both:
+// StatusMalformed over "tampered" over none
+func worseStatus(a, b string) string {
+	for _, status := range []string{StatusMalformed, "tampered"} {
+		if a == status || b == status {
+			return status
+		}
+	}
+	return ""
+}
+
+// managedBlock is one RequestID-tagged block, as line indexes into the file
+type managedBlock struct {
+	RequestID string
+	Start     int
+	End       int
+	Content   []string
+	Checksum  string
+	Legacy    bool
+
+	// Unterminated marks a begin marker without its end marker, e.g. after
+	// a hand edit, whose extent is unknown: the block is the marker line alone
+	Unterminated bool
+}
+
+// Tampered reports whether the lines between the markers no longer match the
+// checksum, or can no longer be told apart
+func (b managedBlock) Tampered() bool {
+	return b.Unterminated || (!b.Legacy && b.Checksum != contentChecksum(b.Content))
+}
+
+func contentChecksum(lines []string) string {
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return checksumPrefix + hex.EncodeToString(sum[:])
+}
+
+// isMarkerLine reports whether line begins or ends a block
+func isMarkerLine(line string) bool {
+	return strings.HasPrefix(line, beginMarkerPrefix) || strings.HasPrefix(line, endMarkerPrefix) || strings.HasPrefix(line, legacyMarkerPrefix)
+}
+
+func renderBlock(requestID, content string) string {
+	lines := strings.Split(strings.TrimRight(content, "\n"), "\n")
+
+	var b strings.Builder
+	b.WriteString(beginMarkerPrefix + requestID + "\n")
+	for _, line := range lines {
+		b.WriteString(line + "\n")
+	}
+	fmt.Fprintf(&b, "%s%s %s\n", endMarkerPrefix, requestID, contentChecksum(lines))
+	return b.String()
+}
+
+// parseBlocks finds all managed blocks. A begin marker without a matching end
+// marker is returned as an Unterminated block of its own line, so that the
+// rest of the file can still be edited.
+func parseBlocks(lines []string) []managedBlock {
+	var blocks []managedBlock
+
+	for i := 0; i < len(lines); i++ {
+		if requestID, ok := strings.CutPrefix(lines[i], beginMarkerPrefix); ok {
+			end := -1
+			for j := i + 1; j < len(lines); j++ {
+				if strings.HasPrefix(lines[j], endMarkerPrefix+requestID+" ") {
+					end = j
+					break
+				}
+				if strings.HasPrefix(lines[j], beginMarkerPrefix) {
+					break
+				}
+			}
+			if end < 0 {
+				blocks = append(blocks, managedBlock{
+					RequestID:    requestID,
+					Start:        i,
+					End:          i,
+					Unterminated: true,
+				})
+				continue
+			}
+
+			blocks = append(blocks, managedBlock{
+				RequestID: requestID,
+				Start:     i,
+				End:       end,
+				Content:   lines[i+1 : end],
+				Checksum:  strings.TrimPrefix(lines[end], endMarkerPrefix+requestID+" "),
+			})
+			i = end
+			continue
+		}
+
+		if requestID, ok := strings.CutPrefix(lines[i], legacyMarkerPrefix); ok {
+			end := i
+			if i+1 < len(lines) && lines[i+1] != "" {
+				end = i + 1
+			}
+			blocks = append(blocks, managedBlock{
+				RequestID: requestID,
+				Start:     i,
+				End:       end,
+				Content:   lines[i+1 : end+1],
+				Legacy:    true,
+			})
+			i = end
+		}
+	}
+
+	return blocks
+}
@@ -0,0 +1,116 @@
+package scripts
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// blockLines returns the lines of rendered blocks, without the final newline
+func blockLines(rendered ...string) []string {
+	return strings.Split(strings.TrimSuffix(strings.Join(rendered, ""), "\n"), "\n")
+}
+
+func TestParseBlocks(t *testing.T) {
+	// blockSummary is what a test expects of a parsed block
+	type blockSummary struct {
+		RequestID    string
+		Start, End   int
+		Content      []string
+		Legacy       bool
+		Unterminated bool
+		Tampered     bool
+	}
+
+	tampered := blockLines(renderBlock("req-1", "ssh-ed25519 AAAA one"))
+	tampered[1] = "ssh-ed25519 AAAA edited"
+
+	tests := []struct {
+		name  string
+		lines []string
+		want  []blockSummary
+	}{
+		{
+			name:  "no blocks",
+			lines: []string{"ssh-ed25519 AAAA mine", ""},
+		},
+		{
+			name:  "one block between other lines",
+			lines: append(append([]string{"ssh-ed25519 AAAA mine"}, blockLines(renderBlock("req-1", "ssh-ed25519 AAAA one"))...), "# trailing"),
+			want: []blockSummary{
+				{RequestID: "req-1", Start: 1, End: 3, Content: []string{"ssh-ed25519 AAAA one"}},
+			},
+		},
+		{
+			name:  "several blocks with several lines",
+			lines: blockLines(renderBlock("req-1", "line a\nline b"), renderBlock("req-2", "line c")),
+			want: []blockSummary{
+				{RequestID: "req-1", Start: 0, End: 3, Content: []string{"line a", "line b"}},
+				{RequestID: "req-2", Start: 4, End: 6, Content: []string{"line c"}},
+			},
+		},
+		{
+			name:  "content edited by hand",
+			lines: tampered,
+			want: []blockSummary{
+				{RequestID: "req-1", Start: 0, End: 2, Content: []string{"ssh-ed25519 AAAA edited"}, Tampered: true},
+			},
+		},
+		{
+			name:  "end marker removed",
+			lines: []string{beginMarkerPrefix + "req-1", "ssh-ed25519 AAAA one"},
+			want: []blockSummary{
+				{RequestID: "req-1", Start: 0, End: 0, Unterminated: true, Tampered: true},
+			},
+		},
+		{
+			name:  "block left open before the next one",
+			lines: append([]string{beginMarkerPrefix + "req-1", "line a"}, blockLines(renderBlock("req-2", "line b"))...),
+			want: []blockSummary{
+				{RequestID: "req-1", Start: 0, End: 0, Unterminated: true, Tampered: true},
+				{RequestID: "req-2", Start: 2, End: 4, Content: []string{"line b"}},
+			},
+		},
+		{
+			name:  "end marker of another request",
+			lines: []string{beginMarkerPrefix + "req-1", "line a", endMarkerPrefix + "req-2 " + contentChecksum([]string{"line a"})},
+			want: []blockSummary{
+				{RequestID: "req-1", Start: 0, End: 0, Unterminated: true, Tampered: true},
+			},
+		},
+		{
+			name:  "legacy marker tags the next line",
+			lines: []string{legacyMarkerPrefix + "req-1", "ssh-ed25519 AAAA one", "ssh-ed25519 AAAA mine"},
+			want: []blockSummary{
+				{RequestID: "req-1", Start: 0, End: 1, Content: []string{"ssh-ed25519 AAAA one"}, Legacy: true},
+			},
+		},
+		{
+			name:  "legacy marker before a blank line",
+			lines: []string{legacyMarkerPrefix + "req-1", ""},
+			want: []blockSummary{
+				{RequestID: "req-1", Start: 0, End: 0, Content: []string{}, Legacy: true},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []blockSummary
+			for _, block := range parseBlocks(tt.lines) {
+				got = append(got, blockSummary{
+					RequestID:    block.RequestID,
+					Start:        block.Start,
+					End:          block.End,
+					Content:      block.Content,
+					Legacy:       block.Legacy,
+					Unterminated: block.Unterminated,
+					Tampered:     block.Tampered(),
+				})
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseBlocks\n got %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,230 @@
+package scripts
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// bannerDir holds the notices sshd shows as the Banner of one user
+	bannerDir = "/etc/ssh/p0-banners"
+
+	// sshdBannerPrefix names the drop-ins that set the Banner of a user
+	sshdBannerPrefix = "p0-banner-"
+
+	// legacyMotdDir held the notices of earlier versions, which pam_motd
+	// showed to every user logging in
+	legacyMotdDir = "/etc/motd.d"
+)
+
+// sshdBannerIncludeLine is added to sshd_config when it does not already
+// include the drop-in directory
+var sshdBannerIncludeLine = fmt.Sprintf("Include %s/%s*.conf", sshdDropInDir, sshdBannerPrefix)
+
+func ProvisionBanner(ctx context.Context, req ProvisioningRequest, logger *logrus.Logger) ProvisioningResult {
+	logger.WithFields(logrus.Fields{
+		"username":   req.UserName,
+		"action":     req.Action,
+		"request_id": req.RequestID,
+		"valid_to":   req.ValidTo,
+	}).Info("📢 Provisioning login notice")
+
+	if !isValidUsername(req.UserName) {
+		return ProvisioningResult{
+			Success: false,
+			Error:   ErrInvalidUsername.Error(),
+		}
+	}
+
+	// The request ID becomes part of the file name
+	if !requestIDPattern.MatchString(req.RequestID) {
+		return ProvisioningResult{
+			Success: false,
+			Error:   "invalid requestId: must match ^[A-Za-z0-9][A-Za-z0-9._-]*$",
+		}
+	}
+
+	switch req.Action {
+	case "grant":
+		return grantBanner(ctx, req, logger)
+	case "revoke":
+		return revokeBanner(ctx, req.RequestID, logger)
+	default:
+		return ProvisioningResult{
+			Success: false,
+			Error:   "invalid action: must be 'grant' or 'revoke'",
+		}
+	}
+}
+
+// bannerPath is the notice of requestID, as written into sshd configuration
+func bannerPath(requestID string) string {
+	return filepath.Join(bannerDir, requestID)
+}
+
+// bannerDropInPath is the drop-in that shows the notice of requestID
+func bannerDropInPath(requestID string) string {
+	return filepath.Join(sshdDropInDir, sshdBannerPrefix+requestID+".conf")
+}
+
+// grantBanner shows the notice to the user of req alone: sshd sends it as
+// the Banner of a Match User block when the user connects. A user with
+// several grants sees the notice of one of them, as sshd takes the first
+// Banner that matches.
+func grantBanner(ctx context.Context, req ProvisioningRequest, logger *logrus.Logger) ProvisioningResult {
+	noticePath := hostPath(bannerPath(req.RequestID))
+	dropInPath := hostPath(bannerDropInPath(req.RequestID))
+	notice := buildNotice(req)
+	dropIn := buildBannerBlock(req)
+
+	existingNotice, noticeErr := os.ReadFile(noticePath)
+	existingDropIn, dropInErr := os.ReadFile(dropInPath)
+	if noticeErr == nil && dropInErr == nil && string(existingNotice) == notice && string(existingDropIn) == dropIn {
+		logger.WithField("file", noticePath).Debug("Login notice already up to date")
+		return ProvisioningResult{
+			Success: true,
+			Message: "Login notice already exists",
+		}
+	}
+
+	snapshot := snapshotSSHD(ctx, noticePath, dropInPath)
+	if err := ensureSSHDInclude(ctx, sshdBannerIncludeLine, logger); err != nil {
+		return ProvisioningResult{
+			Success: false,
+			Error:   err.Error(),
+		}
+	}
+
+	fs := files(ctx)
+	if err := fs.MkdirAll(hostPath(bannerDir)); err != nil {
+		snapshot.restore()
+		return ProvisioningResult{
+			Success: false,
+			Error:   fmt.Sprintf("failed to create directory %s: %v", bannerDir, err),
+		}
+	}
+
+	for _, file := range []struct{ path, content string }{{noticePath, notice}, {dropInPath, dropIn}} {
+		if err := fs.WriteFile(file.path, []byte(file.content)); err != nil {
+			snapshot.restore()
+			return ProvisioningResult{
+				Success: false,
+				Error:   fmt.Sprintf("failed to write %s: %v", file.path, err),
+			}
+		}
+		if err := fs.Chmod(file.path, 0644); err != nil {
+			snapshot.restore()
+			return ProvisioningResult{
+				Success: false,
+				Error:   fmt.Sprintf("failed to set permissions on %s: %v", file.path, err),
+			}
+		}
+	}
+
+	if err := snapshot.check(ctx, "login notice"); err != nil {
+		return ProvisioningResult{
+			Success: false,
+			Error:   err.Error(),
+		}
+	}
+
+	if err := reloadSSHD(ctx, logger); err != nil {
+		return ProvisioningResult{
+			Success: false,
+			Error:   err.Error(),
+		}
+	}
+
+	return ProvisioningResult{
+		Success: true,
+		Message: fmt.Sprintf("Login notice installed for %s at %s", req.UserName, noticePath),
+	}
+}
+
+// revokeBanner removes the notice of requestID, and one earlier versions put
+// in /etc/motd.d
+func revokeBanner(ctx context.Context, requestID string, logger *logrus.Logger) ProvisioningResult {
+	noticePath := hostPath(bannerPath(requestID))
+	dropInPath := hostPath(bannerDropInPath(requestID))
+	legacyPath := hostPath(filepath.Join(legacyMotdDir, "p0-"+requestID))
+
+	fs := files(ctx)
+	if fileExists(legacyPath) {
+		logger.WithField("file", legacyPath).Debug("Removing login notice of an earlier version")
+		if err := fs.Remove(legacyPath); err != nil {
+			return ProvisioningResult{
+				Success: false,
+				Error:   fmt.Sprintf("failed to remove %s: %v", legacyPath, err),
+			}
+		}
+	}
+
+	if !fileExists(dropInPath) && !fileExists(noticePath) {
+		return ProvisioningResult{
+			Success: true,
+			Message: "Login notice does not exist, nothing to remove",
+		}
+	}
+
+	logger.WithField("file", noticePath).Debug("Removing login notice")
+
+	// The drop-in goes first, so sshd never points at a missing notice
+	for _, path := range []string{dropInPath, noticePath} {
+		if err := fs.Remove(path); err != nil && fileExists(path) {
+			return ProvisioningResult{
+				Success: false,
+				Error:   fmt.Sprintf("failed to remove %s: %v", path, err),
+			}
+		}
+	}
+
+	if err := reloadSSHD(ctx, logger); err != nil {
+		return ProvisioningResult{
+			Success: false,
+			Error:   err.Error(),
+		}
+	}
+
+	return ProvisioningResult{
+		Success: true,
+		Message: fmt.Sprintf("Login notice removed successfully for RequestID: %s", requestID),
+	}
+}
+
+// buildBannerBlock renders the Match block that shows the notice of req to
+// its user. The trailing "Match all" ends the block so directives that follow
+// the include stay global.
+func buildBannerBlock(req ProvisioningRequest) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# RequestID: %s\n", req.RequestID)
+	fmt.Fprintf(&b, "Match User %s\n", req.UserName)
+	fmt.Fprintf(&b, "    Banner %s\n", bannerPath(req.RequestID))
+	b.WriteString("Match all\n")
+	return b.String()
+}
+
+// buildNotice renders the legal notice. sshd sends the file verbatim, so the
+// RequestID tag lives in the file name and the notice text rather than a comment.
+func buildNotice(req ProvisioningRequest) string {
+	expiry := "when revoked"
+	if req.ValidTo != "" {
+		expiry = req.ValidTo
+		if req.TimeZone != "" {
+			expiry = fmt.Sprintf("%s (%s)", req.ValidTo, req.TimeZone)
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("*******************************************************************\n")
+	b.WriteString("NOTICE: Just-in-time access granted through P0\n")
+	fmt.Fprintf(&b, "User %s was granted temporary access (request %s).\n", req.UserName, req.RequestID)
+	b.WriteString("This session is monitored and all activity may be recorded for audit.\n")
+	fmt.Fprintf(&b, "Access expires: %s\n", expiry)
+	b.WriteString("*******************************************************************\n")
+	return b.String()
+}
@@ -0,0 +1,376 @@
+package scripts
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	trustedUserCAKeysPath  = "/etc/ssh/p0_trusted_user_ca_keys"
+	authorizedPrincipalDir = "/etc/ssh/p0_principals"
+	certificateDropInPath  = "/etc/ssh/sshd_config.d/p0-certificates.conf"
+
+	// DefaultCertificateTTL is the lifetime of locally signed certificates
+	DefaultCertificateTTL = time.Hour
+
+	// MaxCertificateTTL bounds certificateTtlSeconds
+	MaxCertificateTTL = 24 * time.Hour
+)
+
+// certificateDropIn points sshd at the files provisionCertificate used before
+// grants moved to authorized_keys. It is only rewritten, never created, so
+// hosts with grants from then keep working until those are revoked. Once
+// registration has installed the P0 CA drop-in, that one sets
+// TrustedUserCAKeys for both.
+func certificateDropIn() string {
+	trusted := ""
+	if trustedCAKeysFile() == trustedUserCAKeysPath {
+		trusted = "TrustedUserCAKeys " + trustedUserCAKeysPath + "\n"
+	}
+	return fmt.Sprintf(`# Managed by p0-ssh-agent: certificate-based JIT access
+%sAuthorizedPrincipalsFile %s/%%u
+`, trusted, authorizedPrincipalDir)
+}
+
+// CertificateResult is returned in ProvisioningResult.Data for a grant
+type CertificateResult struct {
+	Certificate string   `json:"certificate,omitempty"`
+	KeyID       string   `json:"keyId"`
+	Serial      uint64   `json:"serial"`
+	Principals  []string `json:"principals"`
+	ValidBefore string   `json:"validBefore"`
+	SignedBy    string   `json:"signedBy"`
+}
+
+// ProvisionCertificate grants access through SSH certificates instead of
+// plain keys. The CA is trusted for the user alone with a cert-authority
+// entry in the user's authorized keys file, limited to the allowed
+// principals and marked with the request ID, so revocation takes effect
+// immediately even while the certificate is still valid. A CA in the
+// host-wide TrustedUserCAKeys would let its certificates log in as any
+// user named in their principals.
+func ProvisionCertificate(ctx context.Context, req ProvisioningRequest, logger *logrus.Logger) ProvisioningResult {
+	logger.WithFields(logrus.Fields{
+		"username":        req.UserName,
+		"action":          req.Action,
+		"request_id":      req.RequestID,
+		"has_certificate": req.Certificate != "",
+		"has_ca_key":      req.CAPublicKey != "",
+	}).Info("📜 Provisioning SSH certificate access")
+
+	if !isValidUsername(req.UserName) {
+		return ProvisioningResult{
+			Success: false,
+			Error:   ErrInvalidUsername.Error(),
+		}
+	}
+
+	if !requestIDPattern.MatchString(req.RequestID) {
+		return ProvisioningResult{
+			Success: false,
+			Error:   "invalid requestId: must match ^[A-Za-z0-9][A-Za-z0-9._-]*$",
+		}
+	}
+
+	switch req.Action {
+	case "grant":
+		return grantCertificate(ctx, req, logger)
+	case "revoke":
+		return revokeCertificate(ctx, req, logger)
+	default:
+		return ProvisioningResult{
+			Success: false,
+			Error:   "invalid action: must be 'grant' or 'revoke'",
+		}
+	}
+}
+
+func grantCertificate(ctx context.Context, req ProvisioningRequest, logger *logrus.Logger) ProvisioningResult {
+	var (
+		ca     ssh.PublicKey
+		result CertificateResult
+		err    error
+	)
+
+	// Three modes: validate a certificate signed by the backend CA, trust a
+	// CA for the given principals, or sign the user's key with the local CA
+	switch {
+	case req.Certificate != "":
+		ca, result, err = acceptCertificate(req)
+	case req.CAPublicKey != "" && req.CAPublicKey != "N/A":
+		ca, result, err = trustCertificateAuthority(req)
+	case req.PublicKey != "" && req.PublicKey != "N/A":
+		ca, result, err = issueCertificate(req)
+	default:
+		err = fmt.Errorf("one of certificate, caPublicKey or publicKey is required")
+	}
+	if err != nil {
+		return ProvisioningResult{
+			Success: false,
+			Error:   err.Error(),
+		}
+	}
+
+	userInfo, err := lookupUser(req.UserName)
+	if err != nil {
+		return ProvisioningResult{
+			Success: false,
+			Error:   fmt.Sprintf("user %s not found: %v", req.UserName, err),
+		}
+	}
+
+	caLine := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(ca)))
+	authorizedKeysPath, permission, owner, err := authorizedKeysFileFor(ctx, userInfo)
+	if err != nil {
+		return ProvisioningResult{
+			Success: false,
+			Error:   err.Error(),
+		}
+	}
+	if res := ensureContentInFile(ctx, caKeyEntry(caLine, result.Principals...), req.RequestID, authorizedKeysPath, permission, owner, logger); !res.Success {
+		return res
+	}
+
+	logger.WithFields(logrus.Fields{
+		"username":   req.UserName,
+		"key_id":     result.KeyID,
+		"serial":     result.Serial,
+		"principals": result.Principals,
+		"signed_by":  result.SignedBy,
+	}).Info("✅ Certificate access granted")
+
+	return ProvisioningResult{
+		Success: true,
+		Message: fmt.Sprintf("Certificate access granted for %s until %s", req.UserName, result.ValidBefore),
+		Data:    result,
+		files:   []string{authorizedKeysPath},
+	}
+}
+
+// acceptCertificate validates a user certificate signed by the backend CA,
+// caPublicKey, and authorizes exactly its principals
+func acceptCertificate(req ProvisioningRequest) (ssh.PublicKey, CertificateResult, error) {
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(req.Certificate))
+	if err != nil {
+		return nil, CertificateResult{}, fmt.Errorf("invalid certificate: %w", err)
+	}
+
+	cert, ok := parsed.(*ssh.Certificate)
+	if !ok {
+		return nil, CertificateResult{}, fmt.Errorf("certificate is a plain public key, not an SSH certificate")
+	}
+	if cert.CertType != ssh.UserCert {
+		return nil, CertificateResult{}, fmt.Errorf("certificate is not a user certificate")
+	}
+	if cert.ValidBefore == ssh.CertTimeInfinity {
+		return nil, CertificateResult{}, fmt.Errorf("certificate never expires; JIT certificates must be short-lived")
+	}
+	if len(cert.ValidPrincipals) == 0 {
+		return nil, CertificateResult{}, fmt.Errorf("certificate has no principals and would be valid for any user")
+	}
+	if err := validatePrincipals(cert.ValidPrincipals); err != nil {
+		return nil, CertificateResult{}, err
+	}
+
+	// Without the expected CA any self-signed certificate would be trusted
+	if req.CAPublicKey == "" || req.CAPublicKey == "N/A" {
+		return nil, CertificateResult{}, fmt.Errorf("caPublicKey is required with certificate")
+	}
+	expected, _, _, _, err := ssh.ParseAuthorizedKey([]byte(req.CAPublicKey))
+	if err != nil {
+		return nil, CertificateResult{}, fmt.Errorf("invalid caPublicKey: %w", err)
+	}
+	if !bytes.Equal(expected.Marshal(), cert.SignatureKey.Marshal()) {
+		return nil, CertificateResult{}, fmt.Errorf("certificate is not signed by caPublicKey")
+	}
+
+	// CheckCert verifies the signature and validity window
+	checker := &ssh.CertChecker{SupportedCriticalOptions: []string{"force-command", "source-address"}}
+	if err := checker.CheckCert(cert.ValidPrincipals[0], cert); err != nil {
+		return nil, CertificateResult{}, fmt.Errorf("certificate rejected: %w", err)
+	}
+
+	return cert.SignatureKey, CertificateResult{
+		KeyID:       cert.KeyId,
+		Serial:      cert.Serial,
+		Principals:  cert.ValidPrincipals,
+		ValidBefore: time.Unix(int64(cert.ValidBefore), 0).UTC().Format(time.RFC3339),
+		SignedBy:    ssh.FingerprintSHA256(cert.SignatureKey),
+	}, nil
+}
+
+// trustCertificateAuthority trusts an externally managed CA for the
+// requested principals, defaulting to the username
+func trustCertificateAuthority(req ProvisioningRequest) (ssh.PublicKey, CertificateResult, error) {
+	ca, _, _, _, err := ssh.ParseAuthorizedKey([]byte(req.CAPublicKey))
+	if err != nil {
+		return nil, CertificateResult{}, fmt.Errorf("invalid caPublicKey: %w", err)
+	}
+
+	principals := req.Principals
+	if len(principals) == 0 {
+		principals = []string{req.UserName}
+	}
+	if err := validatePrincipals(principals); err != nil {
+		return nil, CertificateResult{}, err
+	}
+
+	validBefore := "when revoked"
+	if req.ValidTo != "" {
+		validBefore = req.ValidTo
+	}
+
+	return ca, CertificateResult{
+		Principals:  principals,
+		ValidBefore: validBefore,
+		SignedBy:    ssh.FingerprintSHA256(ca),
+	}, nil
+}
+
+// issueCertificate signs the user's public key with the host-local CA. The
+// certificate carries a principal unique to the request, so removing the
+// request's authorized keys entry revokes it.
+func issueCertificate(req ProvisioningRequest) (ssh.PublicKey, CertificateResult, error) {
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(req.PublicKey))
+	if err != nil {
+		return nil, CertificateResult{}, fmt.Errorf("invalid publicKey: %w", err)
+	}
+	if _, ok := publicKey.(*ssh.Certificate); ok {
+		return nil, CertificateResult{}, fmt.Errorf("publicKey is already a certificate; pass it as certificate instead")
+	}
+
+	ttl, err := certificateTTL(req)
+	if err != nil {
+		return nil, CertificateResult{}, err
+	}
+
+	ca, err := localCertificateAuthority()
+	if err != nil {
+		return nil, CertificateResult{}, err
+	}
+
+	keyID := fmt.Sprintf("p0:%s:%s", req.RequestID, req.UserName)
+	principals := []string{"p0-" + req.RequestID}
+	cert, err := signUserCertificate(ca, publicKey, keyID, principals, time.Now().Add(ttl))
+	if err != nil {
+		return nil, CertificateResult{}, err
+	}
+
+	return ca.PublicKey(), CertificateResult{
+		Certificate: strings.TrimSpace(string(ssh.MarshalAuthorizedKey(cert))),
+		KeyID:       keyID,
+		Serial:      cert.Serial,
+		Principals:  principals,
+		ValidBefore: time.Unix(int64(cert.ValidBefore), 0).UTC().Format(time.RFC3339),
+		SignedBy:    ssh.FingerprintSHA256(ca.PublicKey()),
+	}, nil
+}
+
+// certificateTTL returns the certificate lifetime, never extending past validTo
+func certificateTTL(req ProvisioningRequest) (time.Duration, error) {
+	ttl := DefaultCertificateTTL
+	if req.CertificateTTLSeconds != 0 {
+		ttl = time.Duration(req.CertificateTTLSeconds) * time.Second
+		if ttl <= 0 || ttl > MaxCertificateTTL {
+			return 0, fmt.Errorf("certificateTtlSeconds must be between 1 and %d", int(MaxCertificateTTL.Seconds()))
+		}
+	}
+
+	if req.ValidTo != "" {
+		if validTo, err := time.Parse(time.RFC3339, req.ValidTo); err == nil {
+			if remaining := time.Until(validTo); remaining < ttl {
+				if remaining <= 0 {
+					return 0, fmt.Errorf("validTo %s is in the past", req.ValidTo)
+				}
+				ttl = remaining
+			}
+		}
+	}
+
+	return ttl, nil
+}
+
+func validatePrincipals(principals []string) error {
+	for _, principal := range principals {
+		if principal == "" || strings.ContainsAny(principal, " \t\r\n#,") {
+			return fmt.Errorf("invalid principal %q", principal)
+		}
+	}
+	return nil
+}
+
+func revokeCertificate(ctx context.Context, req ProvisioningRequest, logger *logrus.Logger) ProvisioningResult {
+	status := ""
+	if userInfo, err := lookupUser(req.UserName); err == nil {
+		res := removeContentFromFiles(ctx, req.RequestID, "", authorizedKeysFilesFor(ctx, userInfo, req.grantedFiles), logger)
+		if !res.Success {
+			return res
+		}
+		status = res.Status
+	}
+
+	// Grants made before the CA moved to authorized_keys wrote the principals
+	// and the CA to shared files, the CA possibly copied over by registration
+	paths := []string{hostPath(filepath.Join(authorizedPrincipalDir, req.UserName)), hostPath(TrustedCAPath), hostPath(trustedUserCAKeysPath)}
+	res := removeContentFromFiles(ctx, req.RequestID, "", paths, logger)
+	if !res.Success {
+		return res
+	}
+
+	return ProvisioningResult{
+		Success: true,
+		Message: fmt.Sprintf("Certificate access revoked successfully for RequestID: %s", req.RequestID),
+		Status:  worseStatus(status, res.Status),
+	}
+}
+
+// sshdDirective returns the arguments of the first keyword line sshd reads
+// from path outside a Match block, and the file it is in. sshd_config is
+// mode 600 on some distributions, so it is read with privileges when needed.
+func sshdDirective(ctx context.Context, path, keyword string, depth int) ([]string, string) {
+	content, err := os.ReadFile(hostPath(path))
+	if os.IsPermission(err) {
+		content, err = files(ctx).ReadFile(hostPath(path))
+	}
+	if err != nil || depth > 4 {
+		return nil, ""
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		switch {
+		// Settings inside Match blocks are not what sshd -T reports
+		case strings.EqualFold(fields[0], "Match"):
+			return nil, ""
+		case strings.EqualFold(fields[0], keyword):
+			return fields[1:], path
+		case strings.EqualFold(fields[0], "Include"):
+			for _, pattern := range fields[1:] {
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join(filepath.Dir(sshdConfigPath), pattern)
+				}
+				matches, _ := filepath.Glob(hostPath(pattern))
+				sort.Strings(matches)
+				for _, match := range matches {
+					included := filepath.Join("/", strings.TrimPrefix(match, hostPath("/")))
+					if values, source := sshdDirective(ctx, included, keyword, depth+1); source != "" {
+						return values, source
+					}
+				}
+			}
+		}
+	}
+	return nil, ""
+}
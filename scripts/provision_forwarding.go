@@ -0,0 +1,404 @@
+package scripts
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/internal/elevate"
+)
+
+const (
+	sshdConfigPath   = "/etc/ssh/sshd_config"
+	sshdDropInDir    = "/etc/ssh/sshd_config.d"
+	sshdDropInPrefix = "p0-forward-"
+)
+
+// sshdIncludeLine is added to sshd_config when it does not already include the drop-in directory
+var sshdIncludeLine = fmt.Sprintf("Include %s/%s*.conf", sshdDropInDir, sshdDropInPrefix)
+
+func ProvisionPortForward(ctx context.Context, req ProvisioningRequest, logger *logrus.Logger) ProvisioningResult {
+	logger.WithFields(logrus.Fields{
+		"username":    req.UserName,
+		"action":      req.Action,
+		"request_id":  req.RequestID,
+		"permit_open": strings.Join(req.PermitOpen, " "),
+	}).Info("🔀 Provisioning port forwarding")
+
+	if !isValidUsername(req.UserName) {
+		return ProvisioningResult{
+			Success: false,
+			Error:   ErrInvalidUsername.Error(),
+		}
+	}
+
+	// The request ID becomes part of the file name
+	if !requestIDPattern.MatchString(req.RequestID) {
+		return ProvisioningResult{
+			Success: false,
+			Error:   "invalid requestId: must match ^[A-Za-z0-9][A-Za-z0-9._-]*$",
+		}
+	}
+
+	switch req.Action {
+	case "grant":
+		return grantPortForward(ctx, req, logger)
+	case "revoke":
+		return revokePortForward(ctx, req, logger)
+	default:
+		return ProvisioningResult{
+			Success: false,
+			Error:   "invalid action: must be 'grant' or 'revoke'",
+		}
+	}
+}
+
+// forwardingDropInPath is the drop-in holding the forwarding rules of
+// username. Every request of the user has a block in it, and the Match block
+// at its end permits the targets of all of them, as sshd only applies the
+// first PermitOpen that matches.
+func forwardingDropInPath(username string) string {
+	return hostPath(filepath.Join(sshdDropInDir, sshdDropInPrefix+username+".conf"))
+}
+
+// legacyForwardingDropInPath is the drop-in earlier versions wrote per request
+func legacyForwardingDropInPath(requestID string) string {
+	return hostPath(filepath.Join(sshdDropInDir, sshdDropInPrefix+requestID+".conf"))
+}
+
+func grantPortForward(ctx context.Context, req ProvisioningRequest, logger *logrus.Logger) ProvisioningResult {
+	for _, target := range req.PermitOpen {
+		if !isValidPermitOpen(target) {
+			return ProvisioningResult{
+				Success: false,
+				Error:   fmt.Sprintf("invalid permitOpen entry %q: must be host:port, any or none", target),
+			}
+		}
+	}
+
+	dropInPath := forwardingDropInPath(req.UserName)
+	unlock, err := lockManagedFile(dropInPath)
+	if err != nil {
+		return ProvisioningResult{
+			Success: false,
+			Error:   err.Error(),
+		}
+	}
+	defer unlock()
+
+	file, err := openManagedFile(ctx, dropInPath, 0644)
+	if err != nil {
+		return ProvisioningResult{
+			Success: false,
+			Error:   err.Error(),
+		}
+	}
+	previous := append([]string(nil), file.lines...)
+
+	file.setBlock(req.RequestID, buildForwardingBlock(req))
+	file.lines = buildForwardingRules(file.lines, req.UserName)
+	if file.exists && strings.Join(file.lines, "\n") == strings.Join(previous, "\n") {
+		return ProvisioningResult{
+			Success: true,
+			Message: "Port forwarding already granted",
+		}
+	}
+
+	snapshot := snapshotSSHD(ctx, dropInPath)
+	if err := ensureSSHDInclude(ctx, sshdIncludeLine, logger); err != nil {
+		return ProvisioningResult{
+			Success: false,
+			Error:   err.Error(),
+		}
+	}
+
+	if err := file.save(ctx, logger); err != nil {
+		snapshot.restore()
+		return ProvisioningResult{
+			Success: false,
+			Error:   err.Error(),
+		}
+	}
+
+	if err := snapshot.check(ctx, "forwarding rule"); err != nil {
+		return ProvisioningResult{
+			Success: false,
+			Error:   err.Error(),
+		}
+	}
+
+	if err := reloadSSHD(ctx, logger); err != nil {
+		return ProvisioningResult{
+			Success: false,
+			Error:   err.Error(),
+		}
+	}
+
+	return ProvisioningResult{
+		Success: true,
+		Message: fmt.Sprintf("Port forwarding granted for %s", req.UserName),
+	}
+}
+
+func revokePortForward(ctx context.Context, req ProvisioningRequest, logger *logrus.Logger) ProvisioningResult {
+	changed, err := removeForwarding(ctx, req.UserName, req.RequestID, logger)
+	if err != nil {
+		return ProvisioningResult{
+			Success: false,
+			Error:   err.Error(),
+		}
+	}
+	if !changed {
+		return ProvisioningResult{
+			Success: true,
+			Message: "Port forwarding rule does not exist, nothing to remove",
+		}
+	}
+
+	if err := reloadSSHD(ctx, logger); err != nil {
+		return ProvisioningResult{
+			Success: false,
+			Error:   err.Error(),
+		}
+	}
+
+	return ProvisioningResult{
+		Success: true,
+		Message: fmt.Sprintf("Port forwarding revoked successfully for RequestID: %s", req.RequestID),
+	}
+}
+
+// removeForwarding removes the block of requestID from the drop-in of
+// username, and the drop-in an earlier version wrote for the request. The
+// drop-in goes once no request is left in it. sshd is not reloaded.
+func removeForwarding(ctx context.Context, username, requestID string, logger *logrus.Logger) (bool, error) {
+	changed := false
+	legacyPath := legacyForwardingDropInPath(requestID)
+	if legacyID, _ := forwardingDropInOwner(legacyPath); legacyID == requestID {
+		backupManagedFile(legacyPath, logger)
+		if err := files(ctx).Remove(legacyPath); err != nil {
+			return false, fmt.Errorf("failed to remove %s: %w", legacyPath, err)
+		}
+		changed = true
+	}
+
+	dropInPath := forwardingDropInPath(username)
+	if !fileExists(dropInPath) {
+		return changed, nil
+	}
+	unlock, err := lockManagedFile(dropInPath)
+	if err != nil {
+		return changed, err
+	}
+	defer unlock()
+
+	file, err := openManagedFile(ctx, dropInPath, 0644)
+	if err != nil {
+		return changed, err
+	}
+	file.removeBlocks(requestID, "")
+	if !file.changed {
+		return changed, nil
+	}
+
+	file.lines = buildForwardingRules(file.lines, username)
+	if len(file.lines) == 0 {
+		backupManagedFile(dropInPath, logger)
+		if err := files(ctx).Remove(dropInPath); err != nil {
+			return changed, fmt.Errorf("failed to remove %s: %w", dropInPath, err)
+		}
+		return true, nil
+	}
+	if err := file.save(ctx, logger); err != nil {
+		return changed, err
+	}
+	return true, nil
+}
+
+// forwardingPermitOpenPrefix starts the line of a request's block that lists
+// its targets
+const forwardingPermitOpenPrefix = "# permitOpen "
+
+// buildForwardingBlock renders the block of req: the targets it permits, as
+// a comment. A request without targets permits none.
+func buildForwardingBlock(req ProvisioningRequest) string {
+	permitOpen := "none"
+	if len(req.PermitOpen) > 0 {
+		permitOpen = strings.Join(req.PermitOpen, " ")
+	}
+	return forwardingPermitOpenPrefix + permitOpen
+}
+
+// buildForwardingRules returns the blocks in lines followed by the Match
+// block for username that permits the targets of all of them, or nothing
+// when no block is left. The trailing "Match all" ends the Match block so
+// directives that follow the include stay global.
+func buildForwardingRules(lines []string, username string) []string {
+	blocks := parseBlocks(lines)
+	if len(blocks) == 0 {
+		return nil
+	}
+
+	var rules []string
+	var targets []string
+	seen := make(map[string]bool)
+	for _, block := range blocks {
+		rules = append(rules, lines[block.Start:block.End+1]...)
+		for _, line := range block.Content {
+			for _, target := range strings.Fields(strings.TrimPrefix(line, forwardingPermitOpenPrefix)) {
+				if target != "none" && !seen[target] {
+					seen[target] = true
+					targets = append(targets, target)
+				}
+			}
+		}
+	}
+
+	permitOpen := "none"
+	switch {
+	case seen["any"]:
+		permitOpen = "any"
+	case len(targets) > 0:
+		permitOpen = strings.Join(targets, " ")
+	}
+
+	return append(rules,
+		"Match User "+username,
+		"    AllowTcpForwarding local",
+		"    PermitOpen "+permitOpen,
+		"Match all",
+	)
+}
+
+func isValidPermitOpen(target string) bool {
+	if target == "any" || target == "none" {
+		return true
+	}
+
+	separator := strings.LastIndex(target, ":")
+	if separator <= 0 {
+		return false
+	}
+
+	host, port := target[:separator], target[separator+1:]
+	if strings.ContainsAny(host, " \t\n#") {
+		return false
+	}
+
+	if port == "*" {
+		return true
+	}
+
+	portNumber, err := strconv.Atoi(port)
+	return err == nil && portNumber > 0 && portNumber <= 65535
+}
+
+// ensureSSHDInclude makes sure sshd reads the drop-in directory, adding
+// includeLine otherwise. The include is prepended since directives after a
+// Match block in sshd_config are conditional.
+func ensureSSHDInclude(ctx context.Context, includeLine string, logger *logrus.Logger) error {
+	if err := files(ctx).MkdirAll(hostPath(sshdDropInDir)); err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", sshdDropInDir, err)
+	}
+
+	for _, line := range []string{"Include " + sshdDropInDir + "/*.conf", includeLine} {
+		if privileged(ctx, "grep", "-qxF", line, hostPath(sshdConfigPath)).Run() == nil {
+			return nil
+		}
+	}
+
+	logger.WithField("file", sshdConfigPath).Info("Adding drop-in include to sshd configuration")
+
+	backupManagedFile(hostPath(sshdConfigPath), logger)
+
+	cmd := privileged(ctx, "sed", "-i", "1i "+includeLine, hostPath(sshdConfigPath))
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to add include to %s (on NixOS add %q to services.openssh.extraConfig): %w", sshdConfigPath, includeLine, err)
+	}
+
+	return nil
+}
+
+// sshdSnapshot holds sshd configuration files as they were before a change,
+// so the change can be undone when sshd refuses it
+type sshdSnapshot struct {
+	fs    elevate.Files
+	files []snapshotFile
+}
+
+type snapshotFile struct {
+	path    string
+	data    []byte
+	existed bool
+}
+
+// snapshotSSHD records the files at paths, which are host paths, along with
+// sshd_config, where ensureSSHDInclude may add an Include
+func snapshotSSHD(ctx context.Context, paths ...string) *sshdSnapshot {
+	snapshot := &sshdSnapshot{fs: files(ctx)}
+	for _, path := range append([]string{hostPath(sshdConfigPath)}, paths...) {
+		data, err := snapshot.fs.ReadFile(path)
+		snapshot.files = append(snapshot.files, snapshotFile{path: path, data: data, existed: err == nil})
+	}
+	return snapshot
+}
+
+// restore puts every file back as recorded and removes those that did not
+// exist. It is best effort: the change has already failed.
+func (s *sshdSnapshot) restore() {
+	for _, file := range s.files {
+		if file.existed {
+			s.fs.WriteFile(file.path, file.data)
+		} else {
+			s.fs.Remove(file.path)
+		}
+	}
+}
+
+// check runs sshd -t and restores the snapshot when sshd refuses the
+// configuration, so sshd is never left with one it would fail to load on its
+// next restart. change names what was written, for the error.
+func (s *sshdSnapshot) check(ctx context.Context, change string) error {
+	output, err := combinedOutputOf(privileged(ctx, "sshd", "-t"))
+	if err == nil {
+		return nil
+	}
+	s.restore()
+	return fmt.Errorf("sshd rejected the %s: %v (output: %s)", change, err, strings.TrimSpace(string(output)))
+}
+
+func reloadSSHD(ctx context.Context, logger *logrus.Logger) error {
+	if !commandExists("systemctl") {
+		// OpenRC, as on Alpine
+		if commandExists("rc-service") {
+			if err := privileged(ctx, "rc-service", "sshd", "reload").Run(); err != nil {
+				return fmt.Errorf("failed to reload sshd: %w", err)
+			}
+			logger.WithField("service", "sshd").Debug("Reloaded sshd")
+			return nil
+		}
+		// rc.d, as on FreeBSD
+		if commandExists("service") {
+			if err := privileged(ctx, "service", "sshd", "reload").Run(); err != nil {
+				return fmt.Errorf("failed to reload sshd: %w", err)
+			}
+			logger.WithField("service", "sshd").Debug("Reloaded sshd")
+			return nil
+		}
+		return fmt.Errorf("reloading sshd requires systemd, OpenRC or rc.d")
+	}
+
+	// Debian and Ubuntu name the unit ssh, most other distributions sshd
+	for _, unit := range []string{"sshd", "ssh"} {
+		if err := privileged(ctx, "systemctl", "reload", unit).Run(); err == nil {
+			logger.WithField("unit", unit).Debug("Reloaded sshd")
+			return nil
+		}
+	}
+
+	return fmt.Errorf("failed to reload sshd")
+}
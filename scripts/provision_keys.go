@@ -1,14 +1,17 @@
 package scripts
 
 import (
+	"context"
 	"fmt"
 	"os/user"
-	"path/filepath"
+	"strings"
 
 	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/internal/osplugins"
 )
 
-func ProvisionAuthorizedKeys(req ProvisioningRequest, logger *logrus.Logger) ProvisioningResult {
+func ProvisionAuthorizedKeys(ctx context.Context, req ProvisioningRequest, logger *logrus.Logger) ProvisioningResult {
 	logger.WithFields(logrus.Fields{
 		"username":    req.UserName,
 		"action":      req.Action,
@@ -23,7 +26,7 @@ func ProvisionAuthorizedKeys(req ProvisioningRequest, logger *logrus.Logger) Pro
 		}
 	}
 
-	userInfo, err := user.Lookup(req.UserName)
+	userInfo, err := lookupUser(req.UserName)
 	if err != nil {
 		return ProvisioningResult{
 			Success: false,
@@ -31,13 +34,60 @@ func ProvisionAuthorizedKeys(req ProvisioningRequest, logger *logrus.Logger) Pro
 		}
 	}
 
-	authorizedKeysPath := filepath.Join(userInfo.HomeDir, ".ssh", "authorized_keys")
+	plugin := osplugins.Selected()
+	if files := plugin.AuthorizedKeysFiles(userInfo.HomeDir); files != nil {
+		return provisionFixedAuthorizedKeys(ctx, plugin, req, userInfo, files, logger)
+	}
+
+	switch req.Action {
+	case "grant":
+		authorizedKeysPath, permission, owner, err := authorizedKeysFileFor(ctx, userInfo)
+		if err != nil {
+			return ProvisioningResult{
+				Success: false,
+				Error:   err.Error(),
+			}
+		}
+		return grantAuthorizedKey(ctx, req.PublicKey, req.RequestID, authorizedKeysPath, permission, owner, logger)
+	case "revoke":
+		return revokeAuthorizedKey(ctx, req.RequestID, req.PublicKey, authorizedKeysFilesFor(ctx, userInfo, req.grantedFiles), logger)
+	default:
+		return ProvisioningResult{
+			Success: false,
+			Error:   "invalid action: must be 'grant' or 'revoke'",
+		}
+	}
+}
 
+// provisionFixedAuthorizedKeys manages the key in the files the OS reads it
+// from rather than the ones set in sshd_config
+func provisionFixedAuthorizedKeys(ctx context.Context, plugin osplugins.OSPlugin, req ProvisioningRequest, userInfo *user.User, files []string, logger *logrus.Logger) ProvisioningResult {
 	switch req.Action {
 	case "grant":
-		return grantAuthorizedKey(req.PublicKey, req.RequestID, authorizedKeysPath, req.UserName, logger)
+		authorizedKeysPath, err := plugin.GrantAuthorizedKeysFile(ctx, req.UserName, userInfo.HomeDir)
+		if err != nil {
+			return ProvisioningResult{
+				Success: false,
+				Error:   err.Error(),
+			}
+		}
+
+		// Written directly, as the agent service runs as the system account;
+		// the plugin sets the permissions below
+		result := grantAuthorizedKey(ctx, req.PublicKey, req.RequestID, authorizedKeysPath, "600", "", logger)
+		if !result.Success {
+			return result
+		}
+		if err := plugin.RestrictAuthorizedKeysFile(ctx, authorizedKeysPath, req.UserName); err != nil {
+			return ProvisioningResult{
+				Success: false,
+				Error:   fmt.Sprintf("failed to set permissions on %s: %v", authorizedKeysPath, err),
+			}
+		}
+		return result
 	case "revoke":
-		return revokeAuthorizedKey(req.RequestID, authorizedKeysPath, logger)
+		// Which file the grant picked may have changed since, so all are cleaned
+		return revokeAuthorizedKey(ctx, req.RequestID, req.PublicKey, files, logger)
 	default:
 		return ProvisioningResult{
 			Success: false,
@@ -46,14 +96,14 @@ func ProvisionAuthorizedKeys(req ProvisioningRequest, logger *logrus.Logger) Pro
 	}
 }
 
-func grantAuthorizedKey(publicKey, requestID, authorizedKeysPath, username string, logger *logrus.Logger) ProvisioningResult {
+func grantAuthorizedKey(ctx context.Context, publicKey, requestID, authorizedKeysPath, permission, owner string, logger *logrus.Logger) ProvisioningResult {
 	logger.WithFields(logrus.Fields{
 		"path":       authorizedKeysPath,
-		"username":   username,
+		"owner":      owner,
 		"request_id": requestID,
 	}).Debug("Granting SSH key access")
 
-	result := ensureContentInFile(publicKey, requestID, authorizedKeysPath, "600", username, logger)
+	result := ensureContentInFile(ctx, publicKey, requestID, authorizedKeysPath, permission, owner, logger)
 	if !result.Success {
 		return result
 	}
@@ -61,28 +111,50 @@ func grantAuthorizedKey(publicKey, requestID, authorizedKeysPath, username strin
 	return ProvisioningResult{
 		Success: true,
 		Message: fmt.Sprintf("SSH public key added to %s successfully", authorizedKeysPath),
+		files:   []string{authorizedKeysPath},
 	}
 }
 
-func revokeAuthorizedKey(requestID, authorizedKeysPath string, logger *logrus.Logger) ProvisioningResult {
+// revokeAuthorizedKey removes the request's key, publicKey if known, from
+// every file it may have been granted in
+func revokeAuthorizedKey(ctx context.Context, requestID, publicKey string, authorizedKeysPaths []string, logger *logrus.Logger) ProvisioningResult {
 	logger.WithFields(logrus.Fields{
-		"path":       authorizedKeysPath,
+		"paths":      authorizedKeysPaths,
 		"request_id": requestID,
 	}).Debug("Revoking SSH key access")
 
-	result := removeContentFromFile(requestID, authorizedKeysPath, logger)
+	if publicKey == "N/A" {
+		publicKey = ""
+	}
+	result := removeContentFromFiles(ctx, requestID, publicKey, authorizedKeysPaths, logger)
 	if !result.Success {
 		return result
 	}
 
 	return ProvisioningResult{
 		Success: true,
-		Message: fmt.Sprintf("SSH public key removed from %s successfully", authorizedKeysPath),
+		Message: fmt.Sprintf("SSH public key removed from %s successfully", strings.Join(authorizedKeysPaths, ", ")),
+		Status:  result.Status,
+	}
+}
+
+// removeContentFromFiles removes the request's block from every file,
+// reporting "tampered" if any of them had been edited by hand, or
+// StatusMalformed if one had lost its end marker
+func removeContentFromFiles(ctx context.Context, requestID, content string, filePaths []string, logger *logrus.Logger) ProvisioningResult {
+	status := ""
+	for _, filePath := range filePaths {
+		result := removeContentFromFile(ctx, requestID, content, filePath, logger)
+		if !result.Success {
+			return result
+		}
+		status = worseStatus(status, result.Status)
 	}
+	return ProvisioningResult{Success: true, Status: status}
 }
 
 // ProvisionCAKeys provisions CA public keys with cert-authority and principals parameters
-func ProvisionCAKeys(req ProvisioningRequest, logger *logrus.Logger) ProvisioningResult {
+func ProvisionCAKeys(ctx context.Context, req ProvisioningRequest, logger *logrus.Logger) ProvisioningResult {
 	logger.WithFields(logrus.Fields{
 		"username":   req.UserName,
 		"action":     req.Action,
@@ -97,7 +169,7 @@ func ProvisionCAKeys(req ProvisioningRequest, logger *logrus.Logger) Provisionin
 		}
 	}
 
-	userInfo, err := user.Lookup(req.UserName)
+	userInfo, err := lookupUser(req.UserName)
 	if err != nil {
 		return ProvisioningResult{
 			Success: false,
@@ -105,13 +177,18 @@ func ProvisionCAKeys(req ProvisioningRequest, logger *logrus.Logger) Provisionin
 		}
 	}
 
-	authorizedKeysPath := filepath.Join(userInfo.HomeDir, ".ssh", "authorized_keys")
-
 	switch req.Action {
 	case "grant":
-		return grantCAKey(req.CAPublicKey, req.RequestID, authorizedKeysPath, req.UserName, logger)
+		authorizedKeysPath, permission, owner, err := authorizedKeysFileFor(ctx, userInfo)
+		if err != nil {
+			return ProvisioningResult{
+				Success: false,
+				Error:   err.Error(),
+			}
+		}
+		return grantCAKey(ctx, req.CAPublicKey, req.RequestID, authorizedKeysPath, permission, owner, req.UserName, logger)
 	case "revoke":
-		return revokeCAKey(req.RequestID, authorizedKeysPath, logger)
+		return revokeCAKey(ctx, req.RequestID, caKeyEntry(req.CAPublicKey, req.UserName), authorizedKeysFilesFor(ctx, userInfo, req.grantedFiles), logger)
 	default:
 		return ProvisioningResult{
 			Success: false,
@@ -120,41 +197,47 @@ func ProvisionCAKeys(req ProvisioningRequest, logger *logrus.Logger) Provisionin
 	}
 }
 
-func grantCAKey(caPublicKey, requestID, authorizedKeysPath, username string, logger *logrus.Logger) ProvisioningResult {
+func grantCAKey(ctx context.Context, caPublicKey, requestID, authorizedKeysPath, permission, owner, username string, logger *logrus.Logger) ProvisioningResult {
 	logger.WithFields(logrus.Fields{
 		"path":       authorizedKeysPath,
 		"username":   username,
 		"request_id": requestID,
 	}).Debug("Granting CA key access")
 
-	// Format CA key with cert-authority and principals parameters
-	caKeyEntry := fmt.Sprintf("cert-authority,principals=\"%s\" %s", username, caPublicKey)
-
-	result := ensureContentInFile(caKeyEntry, requestID, authorizedKeysPath, "600", username, logger)
+	entry := caKeyEntry(caPublicKey, username)
+	result := ensureContentInFile(ctx, entry, requestID, authorizedKeysPath, permission, owner, logger)
 	if !result.Success {
 		return result
 	}
 
 	return ProvisioningResult{
 		Success: true,
-		Message: fmt.Sprintf("CA public key added to %s successfully with %s", authorizedKeysPath, caKeyEntry),
+		Message: fmt.Sprintf("CA public key added to %s successfully with %s", authorizedKeysPath, entry),
+		files:   []string{authorizedKeysPath},
 	}
 }
 
-func revokeCAKey(requestID, authorizedKeysPath string, logger *logrus.Logger) ProvisioningResult {
+// caKeyEntry is the authorized_keys line trusting caPublicKey for
+// certificates carrying one of principals
+func caKeyEntry(caPublicKey string, principals ...string) string {
+	return fmt.Sprintf("cert-authority,principals=\"%s\" %s", strings.Join(principals, ","), caPublicKey)
+}
+
+func revokeCAKey(ctx context.Context, requestID, entry string, authorizedKeysPaths []string, logger *logrus.Logger) ProvisioningResult {
 	logger.WithFields(logrus.Fields{
-		"path":       authorizedKeysPath,
+		"paths":      authorizedKeysPaths,
 		"request_id": requestID,
 	}).Debug("Revoking CA key access")
 
-	result := removeContentFromFile(requestID, authorizedKeysPath, logger)
+	result := removeContentFromFiles(ctx, requestID, entry, authorizedKeysPaths, logger)
 	if !result.Success {
 		return result
 	}
 
 	return ProvisioningResult{
 		Success: true,
-		Message: fmt.Sprintf("CA public key removed from %s successfully", authorizedKeysPath),
+		Message: fmt.Sprintf("CA public key removed from %s successfully", strings.Join(authorizedKeysPaths, ", ")),
+		Status:  result.Status,
 	}
 }
 
@@ -1,7 +1,10 @@
 package scripts
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"os"
 	"os/exec"
 	"os/user"
 	"strconv"
@@ -11,7 +14,7 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-func ProvisionSession(req ProvisioningRequest, logger *logrus.Logger) ProvisioningResult {
+func ProvisionSession(ctx context.Context, req ProvisioningRequest, logger *logrus.Logger) ProvisioningResult {
 	logger.WithFields(logrus.Fields{
 		"username":   req.UserName,
 		"action":     req.Action,
@@ -21,7 +24,7 @@ func ProvisionSession(req ProvisioningRequest, logger *logrus.Logger) Provisioni
 	if !isValidUsername(req.UserName) {
 		return ProvisioningResult{
 			Success: false,
-			Error:   "invalid username format: must match ^[a-z][-a-z0-9_]*$",
+			Error:   ErrInvalidUsername.Error(),
 		}
 	}
 
@@ -32,17 +35,67 @@ func ProvisionSession(req ProvisioningRequest, logger *logrus.Logger) Provisioni
 		}
 	}
 
-	return killUserSSHConnections(req.UserName, logger)
+	// A user with access from another request keeps the sessions opened with it
+	if !req.AllSessions && hasOtherGrants(req.UserName, req.RequestID) {
+		if result, ok := killRequestSessions(ctx, req, logger); ok {
+			return result
+		}
+		logger.WithFields(logrus.Fields{
+			"username":   req.UserName,
+			"request_id": req.RequestID,
+		}).Warn("⚠️ Cannot attribute sessions to the request, terminating all of the user's sessions")
+	}
+
+	return killUserSSHConnections(ctx, req.UserName, logger)
 }
 
-func killUserSSHConnections(username string, logger *logrus.Logger) ProvisioningResult {
+// logindStopTimeout is how long processes get to exit after the user is
+// terminated through systemd before they are signalled directly
+const logindStopTimeout = 5 * time.Second
+
+// systemdRunning reports whether systemd is the init system, so logind
+// tracks user sessions
+func systemdRunning() bool {
+	info, err := os.Stat(hostPath("/run/systemd/system"))
+	return err == nil && info.IsDir()
+}
+
+// waitForUserProcesses polls until no process runs as uid or timeout passes
+func waitForUserProcesses(ctx context.Context, uid string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		err := command(quiet(ctx), "pgrep", "-u", uid).Run()
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+func killUserSSHConnections(ctx context.Context, username string, logger *logrus.Logger) ProvisioningResult {
 	logger.WithField("username", username).Info("🔍 Terminating all user sessions and processes")
 
-	// Method 1: Try systemd user slice termination first (most effective on systemd systems)
+	// Method 1: On systemd hosts let logind end every session and the user's
+	// systemd manager, which also cleans up lingering user units and scopes
 	terminated := false
-	if commandExists("systemctl") {
+	if systemdRunning() && commandExists("loginctl") {
+		logger.Debug("Attempting to terminate user via loginctl")
+		cmd := privileged(ctx, "loginctl", "terminate-user", username)
+		if err := cmd.Run(); err != nil {
+			logger.WithError(err).Debug("loginctl terminate-user failed, falling back to the user slice")
+		} else {
+			logger.Info("User sessions terminated via loginctl")
+			terminated = true
+		}
+	}
+
+	// Method 2: Kill the systemd user slice
+	if !terminated && commandExists("systemctl") {
 		logger.Debug("Attempting to terminate user slice via systemctl")
-		cmd := exec.Command("sudo", "systemctl", "kill", fmt.Sprintf("user-%s.slice", username))
+		cmd := privileged(ctx, "systemctl", "kill", fmt.Sprintf("user-%s.slice", username))
 		if err := cmd.Run(); err != nil {
 			logger.WithError(err).Debug("Failed to kill user slice, falling back to process-level termination")
 		} else {
@@ -51,8 +104,17 @@ func killUserSSHConnections(username string, logger *logrus.Logger) Provisioning
 		}
 	}
 
-	// Method 2: Get user ID and find all processes owned by the user
-	userInfo, err := user.Lookup(username)
+	// Method 3: Get user ID and find all processes owned by the user
+	userInfo, err := lookupUser(username)
+	var unknown user.UnknownUserError
+	if errors.As(err, &unknown) {
+		// A removed JIT user has no sessions left to end
+		logger.WithField("username", username).Info("ℹ️ User does not exist, no sessions to terminate")
+		return ProvisioningResult{
+			Success: true,
+			Message: fmt.Sprintf("User %s does not exist", username),
+		}
+	}
 	if err != nil {
 		return ProvisioningResult{
 			Success: false,
@@ -60,9 +122,14 @@ func killUserSSHConnections(username string, logger *logrus.Logger) Provisioning
 		}
 	}
 
+	// logind stops sessions asynchronously; only signal what outlives it
+	if terminated {
+		waitForUserProcesses(ctx, userInfo.Uid, logindStopTimeout)
+	}
+
 	// Find all processes owned by the user using pgrep
-	cmd := exec.Command("pgrep", "-u", userInfo.Uid)
-	output, err := cmd.Output()
+	cmd := command(quiet(ctx), "pgrep", "-u", userInfo.Uid)
+	output, err := outputOf(cmd)
 	if err != nil {
 		// No processes found is not an error
 		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
@@ -70,7 +137,7 @@ func killUserSSHConnections(username string, logger *logrus.Logger) Provisioning
 			if terminated {
 				return ProvisioningResult{
 					Success: true,
-					Message: fmt.Sprintf("Successfully terminated user slice for %s", username),
+					Message: fmt.Sprintf("Successfully terminated sessions and user manager for %s", username),
 				}
 			}
 			return ProvisioningResult{
@@ -113,13 +180,13 @@ func killUserSSHConnections(username string, logger *logrus.Logger) Provisioning
 	}
 
 	logger.WithFields(logrus.Fields{
-		"username": username,
+		"username":  username,
 		"pid_count": len(validPids),
-		"pids": strings.Join(validPids, ","),
+		"pids":      strings.Join(validPids, ","),
 	}).Info("🎯 Found user processes to terminate")
 
 	// Kill processes gracefully first (SIGTERM)
-	cmd = exec.Command("sudo", "pkill", "-TERM", "-u", userInfo.Uid)
+	cmd = privileged(ctx, "pkill", "-TERM", "-u", userInfo.Uid)
 	if err := cmd.Run(); err != nil {
 		logger.WithError(err).Debug("SIGTERM failed, trying SIGKILL")
 	} else {
@@ -129,7 +196,7 @@ func killUserSSHConnections(username string, logger *logrus.Logger) Provisioning
 	}
 
 	// Force kill remaining processes (SIGKILL)
-	cmd = exec.Command("sudo", "pkill", "-KILL", "-u", userInfo.Uid)
+	cmd = privileged(ctx, "pkill", "-KILL", "-u", userInfo.Uid)
 	if err := cmd.Run(); err != nil {
 		logger.WithError(err).Debug("SIGKILL failed - processes may have already terminated")
 	} else {
@@ -137,11 +204,11 @@ func killUserSSHConnections(username string, logger *logrus.Logger) Provisioning
 	}
 
 	// Verify termination by checking if processes still exist
-	cmd = exec.Command("pgrep", "-u", userInfo.Uid)
+	cmd = command(quiet(ctx), "pgrep", "-u", userInfo.Uid)
 	if err := cmd.Run(); err != nil {
 		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
 			logger.WithFields(logrus.Fields{
-				"username": username,
+				"username":         username,
 				"terminated_count": len(validPids),
 			}).Info("✅ All user processes terminated successfully")
 
@@ -158,4 +225,4 @@ func killUserSSHConnections(username string, logger *logrus.Logger) Provisioning
 		Success: true,
 		Message: fmt.Sprintf("Termination signals sent to %d processes for user %s", len(validPids), username),
 	}
-}
\ No newline at end of file
+}
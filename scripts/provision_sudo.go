@@ -1,34 +1,73 @@
 package scripts
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"strings"
 
 	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/types"
 )
 
-func ProvisionSudo(req ProvisioningRequest, logger *logrus.Logger) ProvisioningResult {
+// SudoSpec narrows a sudo grant. Without one the user may run any command as
+// any user without a password.
+type SudoSpec struct {
+	// Commands are absolute paths, optionally followed by arguments. Empty
+	// allows every command.
+	Commands []string `json:"commands,omitempty"`
+
+	// RunAs are the users the commands may run as. Empty allows every user.
+	RunAs []string `json:"runAs,omitempty"`
+
+	// NoPassword skips the password prompt; it defaults to true
+	NoPassword *bool `json:"noPassword,omitempty"`
+}
+
+// sudoersSpecialChars must be escaped in sudoers command specifications; they
+// are refused instead so a request can never change the rule's structure
+const sudoersSpecialChars = ",:=\\#\"!"
+
+func ProvisionSudo(ctx context.Context, req ProvisioningRequest, logger *logrus.Logger) ProvisioningResult {
 	logger.WithFields(logrus.Fields{
 		"username":   req.UserName,
 		"action":     req.Action,
 		"request_id": req.RequestID,
 		"sudo":       req.Sudo,
+		"sudo_spec":  req.SudoSpec != nil,
 	}).Info("⚡ Provisioning sudo access")
 
-	if !req.Sudo && req.Action == "grant" {
+	if !req.Sudo && req.SudoSpec == nil && req.Action == "grant" {
 		return ProvisioningResult{
 			Success: true,
 			Message: "Sudo access not requested, skipping sudo provisioning",
 		}
 	}
 
-	sudoersFile := "/etc/sudoers-p0"
-	sudoRule := fmt.Sprintf("%s ALL=(ALL) NOPASSWD: ALL", req.UserName)
+	sudoersFile := hostPath(sudoersIncludePath())
 
 	switch req.Action {
 	case "grant":
-		return grantSudoAccess(sudoRule, req.RequestID, sudoersFile, logger)
+		sudoRule, err := buildSudoRule(req.UserName, req.SudoSpec)
+		if err != nil {
+			return ProvisioningResult{
+				Success: false,
+				Error:   err.Error(),
+			}
+		}
+		if currentSudoersLayout() == types.SudoersLayoutDropIn {
+			return grantSudoDropIn(ctx, sudoRule, req.RequestID, logger)
+		}
+		return grantSudoAccess(ctx, sudoRule, req.RequestID, sudoersFile, logger)
 	case "revoke":
-		return revokeSudoAccess(req.RequestID, sudoersFile, logger)
+		// The rule is only needed if the block lost its end marker
+		sudoRule, _ := buildSudoRule(req.UserName, req.SudoSpec)
+		result := revokeSudoAccess(ctx, req.RequestID, sudoRule, sudoersFile, logger)
+		if result.Success && isValidUsername(req.UserName) {
+			endSudoProcesses(ctx, req.UserName, req.RequestID, logger)
+		}
+		return result
 	default:
 		return ProvisioningResult{
 			Success: false,
@@ -37,19 +76,97 @@ func ProvisionSudo(req ProvisioningRequest, logger *logrus.Logger) ProvisioningR
 	}
 }
 
-func grantSudoAccess(sudoRule, requestID, sudoersFile string, logger *logrus.Logger) ProvisioningResult {
+// buildSudoRule renders the sudoers rule for userName, refusing any value
+// that is not a plain user name or command
+func buildSudoRule(userName string, spec *SudoSpec) (string, error) {
+	if !isValidUsername(userName) {
+		return "", ErrInvalidUsername
+	}
+	if spec == nil {
+		return fmt.Sprintf("%s ALL=(ALL) NOPASSWD: ALL", userName), nil
+	}
+
+	runAs := []string{"ALL"}
+	if len(spec.RunAs) > 0 {
+		runAs = spec.RunAs
+	}
+	for _, target := range runAs {
+		if target != "ALL" && !isValidUsername(target) {
+			return "", fmt.Errorf("invalid sudo runAs user %q: must be ALL or match ^[a-z][-a-z0-9_]*$", target)
+		}
+	}
+
+	commands := []string{"ALL"}
+	if len(spec.Commands) > 0 {
+		commands = make([]string, 0, len(spec.Commands))
+		for _, cmd := range spec.Commands {
+			normalized, err := sudoCommand(cmd)
+			if err != nil {
+				return "", err
+			}
+			commands = append(commands, normalized)
+		}
+	}
+
+	tag := "NOPASSWD:"
+	if spec.NoPassword != nil && !*spec.NoPassword {
+		tag = "PASSWD:"
+	}
+
+	return fmt.Sprintf("%s ALL=(%s) %s %s", userName, strings.Join(runAs, ", "), tag, strings.Join(commands, ", ")), nil
+}
+
+// sudoCommand validates one allowed command and collapses its whitespace
+func sudoCommand(cmd string) (string, error) {
+	fields := strings.Fields(cmd)
+	if len(fields) == 0 {
+		return "", fmt.Errorf("invalid sudo command: empty")
+	}
+	if len(fields) == 1 && fields[0] == "ALL" {
+		return "ALL", nil
+	}
+	if !strings.HasPrefix(fields[0], "/") {
+		return "", fmt.Errorf("invalid sudo command %q: must start with an absolute path", cmd)
+	}
+	for _, r := range cmd {
+		if r < 0x20 || r == 0x7f || strings.ContainsRune(sudoersSpecialChars, r) {
+			return "", fmt.Errorf("invalid sudo command %q: must not contain control characters or any of %s", cmd, sudoersSpecialChars)
+		}
+	}
+	return strings.Join(fields, " "), nil
+}
+
+func grantSudoAccess(ctx context.Context, sudoRule, requestID, sudoersFile string, logger *logrus.Logger) ProvisioningResult {
 	logger.WithFields(logrus.Fields{
 		"rule":       sudoRule,
 		"request_id": requestID,
 		"file":       sudoersFile,
 	}).Debug("Granting sudo access")
 
-	result := ensureContentInFile(sudoRule, requestID, sudoersFile, "440", "root", logger)
+	// sudoersFile is shared by every user, so the rule is checked and
+	// written under its lock: other grants and revokes, such as those of a
+	// bulk revoke, cannot change it in between
+	unlock, err := lockManagedFile(sudoersFile)
+	if err != nil {
+		return ProvisioningResult{
+			Success: false,
+			Error:   err.Error(),
+		}
+	}
+	if err := checkSudoers(ctx, sudoRule, requestID, sudoersFile, logger); err != nil {
+		unlock()
+		return ProvisioningResult{
+			Success: false,
+			Error:   err.Error(),
+		}
+	}
+	result := ensureContentInLockedFile(ctx, sudoRule, requestID, sudoersFile, "440", "root", logger)
+	unlock()
 	if !result.Success {
 		return result
 	}
 
-	includeResult := ensureLineInFile("#include sudoers-p0", "/etc/sudoers", logger)
+	includeResult := ensureSudoersInclude(ctx, "include", sudoersIncludeTarget, logger)
 	if !includeResult.Success {
 		return includeResult
 	}
@@ -60,19 +177,161 @@ func grantSudoAccess(sudoRule, requestID, sudoersFile string, logger *logrus.Log
 	}
 }
 
-func revokeSudoAccess(requestID, sudoersFile string, logger *logrus.Logger) ProvisioningResult {
+// checkSudoers runs visudo -cf on sudoersFile with the rule's block added, so
+// a rule sudo would reject never reaches the file it includes. A sudoers file
+// with a syntax error locks every user out of sudo.
+func checkSudoers(ctx context.Context, sudoRule, requestID, sudoersFile string, logger *logrus.Logger) error {
+	if !commandExists("visudo") {
+		logger.Warn("visudo not found, installing sudo rule without a syntax check")
+		return nil
+	}
+
+	var current []string
+	if fileExists(sudoersFile) {
+		lines, err := readManagedFile(ctx, sudoersFile)
+		if err != nil {
+			return err
+		}
+		current = lines
+	}
+
+	candidate, err := os.CreateTemp("", "sudoers-p0-*")
+	if err != nil {
+		return fmt.Errorf("failed to create candidate sudoers file: %w", err)
+	}
+	defer os.Remove(candidate.Name())
+
+	content := ""
+	if len(current) > 0 {
+		content = strings.Join(current, "\n") + "\n"
+	}
+	content += renderBlock(requestID, sudoRule)
+
+	if _, err := candidate.WriteString(content); err != nil {
+		candidate.Close()
+		return fmt.Errorf("failed to write candidate sudoers file: %w", err)
+	}
+	if err := candidate.Close(); err != nil {
+		return fmt.Errorf("failed to write candidate sudoers file: %w", err)
+	}
+
+	output, err := combinedOutputOf(privileged(ctx, "visudo", "-cf", candidate.Name()))
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"rule":   sudoRule,
+			"output": strings.TrimSpace(string(output)),
+		}).Error("❌ visudo rejected sudo rule")
+		return fmt.Errorf("sudo rule rejected by visudo: %s", strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func revokeSudoAccess(ctx context.Context, requestID, sudoRule, sudoersFile string, logger *logrus.Logger) ProvisioningResult {
 	logger.WithFields(logrus.Fields{
 		"request_id": requestID,
 		"file":       sudoersFile,
 	}).Debug("Revoking sudo access")
 
-	result := removeContentFromFile(requestID, sudoersFile, logger)
+	result := removeContentFromFile(ctx, requestID, sudoRule, sudoersFile, logger)
 	if !result.Success {
 		return result
 	}
 
+	// The grant may have been made with the other sudoersLayout
+	if err := removeSudoDropIn(ctx, requestID, logger); err != nil {
+		return ProvisioningResult{
+			Success: false,
+			Error:   err.Error(),
+		}
+	}
+
 	return ProvisioningResult{
 		Success: true,
 		Message: fmt.Sprintf("Sudo access revoked successfully for RequestID: %s", requestID),
+		Status:  result.Status,
+	}
+}
+
+// grantSudoDropIn writes the rule to the request's own file in /etc/sudoers.d,
+// as a managed block so reconcile and tamper detection work as for
+// /etc/sudoers-p0
+func grantSudoDropIn(ctx context.Context, sudoRule, requestID string, logger *logrus.Logger) ProvisioningResult {
+	dropIn, ok := sudoersDropInPath(requestID)
+	if !ok {
+		return ProvisioningResult{
+			Success: false,
+			Error:   fmt.Sprintf("invalid requestId %q for sudoersLayout dropin: must match %s, as sudo skips drop-ins whose name contains a dot", requestID, sudoersDropInIDPattern),
+		}
+	}
+	logger.WithFields(logrus.Fields{
+		"rule":       sudoRule,
+		"request_id": requestID,
+		"file":       dropIn,
+	}).Debug("Granting sudo access")
+
+	if err := checkSudoers(ctx, sudoRule, requestID, dropIn, logger); err != nil {
+		return ProvisioningResult{
+			Success: false,
+			Error:   err.Error(),
+		}
 	}
-}
\ No newline at end of file
+
+	content := renderBlock(requestID, sudoRule)
+	current, readErr := os.ReadFile(dropIn)
+	if readErr != nil || string(current) != content {
+		if err := files(ctx).MkdirAll(hostPath(sudoersDropInDir())); err != nil {
+			return ProvisioningResult{
+				Success: false,
+				Error:   fmt.Sprintf("failed to create %s: %v", sudoersDropInDir(), err),
+			}
+		}
+		if readErr == nil {
+			backupManagedFile(dropIn, logger)
+		}
+		if err := writeSudoers(ctx, dropIn, content, false, logger); err != nil {
+			return ProvisioningResult{
+				Success: false,
+				Error:   err.Error(),
+			}
+		}
+	}
+
+	includeResult := ensureSudoersInclude(ctx, "includedir", sudoersDropInDir(), logger)
+	if !includeResult.Success {
+		return includeResult
+	}
+
+	return ProvisioningResult{
+		Success: true,
+		Message: fmt.Sprintf("Sudo access granted successfully for rule: %s", sudoRule),
+	}
+}
+
+// removeSudoDropIn deletes the request's drop-in, if any. Removing a file
+// cannot break the remaining sudoers configuration, so no check is needed.
+func removeSudoDropIn(ctx context.Context, requestID string, logger *logrus.Logger) error {
+	dropIn, ok := sudoersDropInPath(requestID)
+	if !ok || !fileExists(dropIn) {
+		return nil
+	}
+
+	if lines, err := readManagedFile(ctx, dropIn); err == nil {
+		blocks := parseBlocks(lines)
+		tampered := len(blocks) == 0
+		for _, block := range blocks {
+			tampered = tampered || block.Tampered()
+		}
+		if tampered {
+			logger.WithFields(logrus.Fields{
+				"file":       dropIn,
+				"request_id": requestID,
+			}).Warn("⚠️ Sudoers drop-in was modified by hand - removed it anyway")
+		}
+	}
+
+	backupManagedFile(dropIn, logger)
+	if err := files(ctx).Remove(dropIn); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", dropIn, err)
+	}
+	return nil
+}
@@ -1,15 +1,15 @@
 package scripts
 
 import (
+	"context"
 	"fmt"
-	"os/user"
 
 	"github.com/sirupsen/logrus"
 
 	"p0-ssh-agent/internal/osplugins"
 )
 
-func ProvisionUser(req ProvisioningRequest, logger *logrus.Logger) ProvisioningResult {
+func ProvisionUser(ctx context.Context, req ProvisioningRequest, logger *logrus.Logger) ProvisioningResult {
 	logger.WithFields(logrus.Fields{
 		"username":   req.UserName,
 		"action":     req.Action,
@@ -19,14 +19,45 @@ func ProvisionUser(req ProvisioningRequest, logger *logrus.Logger) ProvisioningR
 	if !isValidUsername(req.UserName) {
 		return ProvisioningResult{
 			Success: false,
-			Error:   "invalid username format: must match ^[a-z][-a-z0-9_]*$",
+			Error:   ErrInvalidUsername.Error(),
 		}
 	}
 
 	switch req.Action {
 	case "grant":
-		return ensureUserExists(req, logger)
+		result := ensureUserExists(ctx, req, logger)
+		if !result.Success {
+			return result
+		}
+		if plugin := osplugins.Selected(); !plugin.SupportsUserSlices() {
+			if req.Resources != nil {
+				logger.WithField("username", req.UserName).Warnf("Resource limits use systemd slices and are not applied on %s", plugin.GetName())
+			}
+			return result
+		}
+		if err := applyUserSliceLimits(ctx, req.UserName, req.RequestID, req.Resources, logger); err != nil {
+			return ProvisioningResult{
+				Success: false,
+				Error:   fmt.Sprintf("failed to apply resource limits: %v", err),
+			}
+		}
+		if res := grantRegistrationPrincipal(ctx, req.UserName, req.RequestID, logger); !res.Success {
+			return res
+		}
+		return result
 	case "revoke":
+		if res := revokeRegistrationPrincipal(ctx, req.UserName, req.RequestID, logger); !res.Success {
+			return res
+		}
+		if err := removeUserSliceLimits(ctx, req.UserName, req.RequestID, logger); err != nil {
+			return ProvisioningResult{
+				Success: false,
+				Error:   fmt.Sprintf("failed to remove resource limits: %v", err),
+			}
+		}
+		if remove := activeHost().RemoveUser; remove != nil && !hasOtherGrants(req.UserName, req.RequestID) {
+			return removeUser(ctx, req, remove, logger)
+		}
 		return ProvisioningResult{
 			Success: true,
 			Message: "User access revocation handled by other provisioning functions",
@@ -39,8 +70,26 @@ func ProvisionUser(req ProvisioningRequest, logger *logrus.Logger) ProvisioningR
 	}
 }
 
-func ensureUserExists(req ProvisioningRequest, logger *logrus.Logger) ProvisioningResult {
-	if _, err := user.Lookup(req.UserName); err == nil {
+// removeUser ends the user's sessions, which would otherwise run under a UID
+// nothing resolves any more, then removes the account
+func removeUser(ctx context.Context, req ProvisioningRequest, remove func(context.Context, string, *logrus.Logger) error, logger *logrus.Logger) ProvisioningResult {
+	if result := killUserSSHConnections(ctx, req.UserName, logger); !result.Success {
+		return result
+	}
+	if err := remove(ctx, req.UserName, logger); err != nil {
+		return ProvisioningResult{
+			Success: false,
+			Error:   fmt.Sprintf("failed to remove user: %v", err),
+		}
+	}
+	return ProvisioningResult{
+		Success: true,
+		Message: fmt.Sprintf("User %s removed", req.UserName),
+	}
+}
+
+func ensureUserExists(ctx context.Context, req ProvisioningRequest, logger *logrus.Logger) ProvisioningResult {
+	if _, err := lookupUser(req.UserName); err == nil {
 		logger.WithField("username", req.UserName).Debug("User already exists")
 		return ProvisioningResult{
 			Success: true,
@@ -48,6 +97,19 @@ func ensureUserExists(req ProvisioningRequest, logger *logrus.Logger) Provisioni
 		}
 	}
 
+	if create := activeHost().CreateUser; create != nil {
+		if err := create(ctx, req.UserName, logger); err != nil {
+			return ProvisioningResult{
+				Success: false,
+				Error:   fmt.Sprintf("failed to create user: %v", err),
+			}
+		}
+		return ProvisioningResult{
+			Success: true,
+			Message: fmt.Sprintf("User %s created successfully", req.UserName),
+		}
+	}
+
 	// Get the appropriate OS plugin
 	osPlugin, err := osplugins.GetPlugin(logger)
 	if err != nil {
@@ -63,7 +125,7 @@ func ensureUserExists(req ProvisioningRequest, logger *logrus.Logger) Provisioni
 	}).Info("Creating new JIT user")
 
 	// Use the OS plugin to create the JIT user
-	if err := osPlugin.CreateUser(req.UserName, logger); err != nil {
+	if err := osPlugin.CreateUser(ctx, req.UserName, logger); err != nil {
 		return ProvisioningResult{
 			Success: false,
 			Error:   fmt.Sprintf("failed to create user with %s plugin: %v", osPlugin.GetName(), err),
@@ -0,0 +1,85 @@
+package scripts
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	finishedLookupMu sync.RWMutex
+	finishedLookup   func(requestID string, commands ...Command) bool
+)
+
+// SetFinishedGrantLookup registers how the shared file helpers learn that
+// the grants of a RequestID made by commands have expired or been revoked.
+// The agent wires this to its grant store; when unset, no opportunistic
+// pruning happens.
+func SetFinishedGrantLookup(lookup func(requestID string, commands ...Command) bool) {
+	finishedLookupMu.Lock()
+	defer finishedLookupMu.Unlock()
+	finishedLookup = lookup
+}
+
+func isGrantFinished(requestID string, commands []Command) bool {
+	finishedLookupMu.RLock()
+	defer finishedLookupMu.RUnlock()
+	return finishedLookup != nil && finishedLookup(requestID, commands...)
+}
+
+// blockCommands are the commands whose grants write the blocks of the
+// managed file at path. A request's grants of other commands, such as a
+// sudo grant ending before the SSH access of the same request, say nothing
+// about these blocks.
+func blockCommands(path string) []Command {
+	switch {
+	case path == hostPath(sudoersIncludePath()):
+		return []Command{CommandProvisionSudo}
+	case path == hostPath(TrustedCAPath), path == hostPath(trustedUserCAKeysPath):
+		return []Command{CommandProvisionCertificate}
+	case strings.HasPrefix(path, hostPath(authorizedPrincipalDir)+string(filepath.Separator)):
+		return []Command{CommandProvisionUser, CommandProvisionCertificate}
+	default:
+		// An authorized keys file
+		return []Command{CommandProvisionAuthorizedKeys, CommandProvisionCAKeys, CommandProvisionCertificate}
+	}
+}
+
+// pruneFinished removes the blocks whose own grant is finished, except those
+// of keepRequestID which the caller is about to act on. Pruning is best
+// effort, so a file that cannot be parsed is left alone.
+func (f *managedFile) pruneFinished(keepRequestID string, logger *logrus.Logger) {
+	finishedLookupMu.RLock()
+	enabled := finishedLookup != nil
+	finishedLookupMu.RUnlock()
+	if !enabled {
+		return
+	}
+
+	blocks := parseBlocks(f.lines)
+	commands := blockCommands(f.path)
+
+	pruned := make(map[string]bool)
+	for _, block := range blocks {
+		requestID := block.RequestID
+		// An unterminated block is left for its revoke, which knows its content
+		if requestID == keepRequestID || pruned[requestID] || block.Unterminated || !isGrantFinished(requestID, commands) {
+			continue
+		}
+		pruned[requestID] = true
+
+		logger.WithFields(logrus.Fields{
+			"file":       f.path,
+			"request_id": requestID,
+		}).Info("🧹 Pruning block of expired or revoked request")
+
+		if tampered := f.removeBlocks(requestID, ""); len(tampered) > 0 {
+			logger.WithFields(logrus.Fields{
+				"file":       f.path,
+				"request_id": requestID,
+			}).Warn("⚠️ Pruned block had been modified by hand")
+		}
+	}
+}
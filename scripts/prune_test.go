@@ -0,0 +1,53 @@
+package scripts
+
+import (
+	"io"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// TestPruneKeepsKeysAfterSudo ends the sudo grant of a request while its key
+// grant goes on: the sudoers block is pruned, the authorized_keys block stays
+func TestPruneKeepsKeysAfterSudo(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	SetFinishedGrantLookup(func(requestID string, commands ...Command) bool {
+		for _, command := range commands {
+			if requestID == "req-1" && command == CommandProvisionSudo {
+				return true
+			}
+		}
+		return false
+	})
+	t.Cleanup(func() { SetFinishedGrantLookup(nil) })
+
+	tests := []struct {
+		name    string
+		path    string
+		content string
+		pruned  bool
+	}{
+		{name: "authorized keys", path: filepath.Join(t.TempDir(), ".ssh", "authorized_keys"), content: "ssh-ed25519 AAAA alice"},
+		{name: "sudoers", path: hostPath(sudoersIncludePath()), content: "alice ALL=(ALL) NOPASSWD: ALL", pruned: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lines := blockLines(renderBlock("req-1", tt.content), renderBlock("req-2", tt.content))
+			file := &managedFile{path: tt.path, lines: append([]string(nil), lines...)}
+
+			file.pruneFinished("req-2", logger)
+
+			want := lines
+			if tt.pruned {
+				want = blockLines(renderBlock("req-2", tt.content))
+			}
+			if !reflect.DeepEqual(file.lines, want) {
+				t.Errorf("lines after pruning = %q, want %q", file.lines, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,217 @@
+package scripts
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/internal/audit"
+	"p0-ssh-agent/internal/osplugins"
+	"p0-ssh-agent/internal/state"
+)
+
+// Drift is a recorded grant whose effect on the host no longer matches the
+// provisioning state
+type Drift struct {
+	Key       string `json:"key"`
+	RequestID string `json:"requestId"`
+	Command   string `json:"command"`
+	UserName  string `json:"userName"`
+	Expected  string `json:"expected"`
+	Problem   string `json:"problem"`
+	Repair    string `json:"repair"`
+
+	request ProvisioningRequest
+}
+
+// FindDrift compares every recorded grant with the host: granted entries
+// must still be applied, revoked entries must stay removed, and granted
+// entries past their expiry should have been revoked
+func FindDrift(ctx context.Context, now time.Time, logger *logrus.Logger) ([]Drift, error) {
+	grants, err := state.Load(currentStatePath())
+	if err != nil {
+		return nil, err
+	}
+
+	var drifts []Drift
+	for _, grant := range grants {
+		var req ProvisioningRequest
+		if err := json.Unmarshal(grant.Request, &req); err != nil {
+			logger.WithError(err).WithField("key", grant.Key).Warn("Skipping unreadable recorded grant")
+			continue
+		}
+		req.grantedFiles = grant.Files
+
+		drift := Drift{
+			Key:       grant.Key,
+			RequestID: grant.RequestID,
+			Command:   grant.Command,
+			UserName:  grant.UserName,
+			Expected:  grant.Status,
+			request:   req,
+		}
+
+		if grant.Expired(now) {
+			drift.Expected = state.StatusRevoked
+			drift.Problem = fmt.Sprintf("expired at %s but was never revoked", grant.ExpiresAt.Format(time.RFC3339))
+			drift.Repair = "revoke"
+			drifts = append(drifts, drift)
+			continue
+		}
+
+		applied, checkable, err := isApplied(ctx, grant.Command, req)
+		if err != nil {
+			logger.WithError(err).WithField("key", grant.Key).Warn("Could not check recorded grant")
+			continue
+		}
+		if !checkable {
+			continue
+		}
+
+		switch {
+		case grant.Status == state.StatusGranted && !applied:
+			drift.Problem = appliedDescription(grant.Command) + " is missing"
+			drift.Repair = "grant"
+		case grant.Status == state.StatusRevoked && applied:
+			drift.Problem = appliedDescription(grant.Command) + " is still present after revoke"
+			drift.Repair = "revoke"
+		default:
+			continue
+		}
+		drifts = append(drifts, drift)
+	}
+
+	// Users must exist before their keys and sudo rules are restored
+	sort.SliceStable(drifts, func(i, j int) bool {
+		return repairOrder(drifts[i]) < repairOrder(drifts[j])
+	})
+	return drifts, nil
+}
+
+// RepairDrift re-runs the recorded request with the action that brings the
+// host back in line with the provisioning state
+func RepairDrift(drift Drift, dryRun bool, logger *logrus.Logger) ProvisioningResult {
+	req := drift.request
+	req.Action = drift.Repair
+	// The state already says revoked; the host is what disagrees
+	req.Force = drift.Repair == "revoke"
+	req.Origin = &audit.Origin{Source: "reconcile"}
+	return ExecuteScript(drift.Command, req, dryRun, logger)
+}
+
+func repairOrder(drift Drift) int {
+	if drift.Repair == "grant" && drift.Command == string(CommandProvisionUser) {
+		return 0
+	}
+	return 1
+}
+
+func appliedDescription(command string) string {
+	switch Command(command) {
+	case CommandProvisionUser:
+		return "user account"
+	case CommandProvisionAuthorizedKeys:
+		return "authorized key"
+	case CommandProvisionCAKeys:
+		return "CA key entry"
+	case CommandProvisionSudo:
+		return "sudo rule"
+	case CommandProvisionBanner:
+		return "login notice"
+	case CommandProvisionPortForward:
+		return "port forwarding rule"
+	case CommandProvisionCertificate:
+		return "certificate authority entry"
+	}
+	return command
+}
+
+// isApplied reports whether what command granted for req is present on the
+// host. checkable is false when the command leaves nothing to look for in the
+// recorded state, such as a revoked user, which is never deleted.
+func isApplied(ctx context.Context, command string, req ProvisioningRequest) (applied, checkable bool, err error) {
+	switch Command(command) {
+	case CommandProvisionUser:
+		if req.Action == "revoke" {
+			return false, false, nil
+		}
+		_, err := lookupUser(req.UserName)
+		return err == nil, true, nil
+	case CommandProvisionAuthorizedKeys, CommandProvisionCAKeys:
+		userInfo, err := lookupUser(req.UserName)
+		if err != nil {
+			return false, true, nil
+		}
+		paths := osplugins.Selected().AuthorizedKeysFiles(userInfo.HomeDir)
+		if paths == nil {
+			paths = authorizedKeysFilesFor(ctx, userInfo, req.grantedFiles)
+		}
+		for _, path := range paths {
+			found, err := hasRequestBlock(ctx, path, req.RequestID)
+			if err != nil || found {
+				return found, true, err
+			}
+		}
+		return false, true, nil
+	case CommandProvisionSudo:
+		found, err := hasRequestBlock(ctx, hostPath(sudoersIncludePath()), req.RequestID)
+		if err != nil || found {
+			return found, true, err
+		}
+		if dropIn, ok := sudoersDropInPath(req.RequestID); ok {
+			found, err = hasRequestBlock(ctx, dropIn, req.RequestID)
+		}
+		return found, true, err
+	case CommandProvisionCertificate:
+		// Older grants kept the principals in a shared directory
+		paths := []string{hostPath(filepath.Join(authorizedPrincipalDir, req.UserName))}
+		if userInfo, err := lookupUser(req.UserName); err == nil {
+			paths = append(authorizedKeysFilesFor(ctx, userInfo, req.grantedFiles), paths...)
+		}
+		for _, path := range paths {
+			found, err := hasRequestBlock(ctx, path, req.RequestID)
+			if err != nil || found {
+				return found, true, err
+			}
+		}
+		return false, true, nil
+	case CommandProvisionBanner:
+		return fileExists(hostPath(bannerDropInPath(req.RequestID))), true, nil
+	case CommandProvisionPortForward:
+		if found, err := hasRequestBlock(ctx, forwardingDropInPath(req.UserName), req.RequestID); err != nil || found {
+			return found, true, err
+		}
+		return fileExists(legacyForwardingDropInPath(req.RequestID)), true, nil
+	}
+	return false, false, nil
+}
+
+// hasRequestBlock reports whether filePath holds a block for requestID
+func hasRequestBlock(ctx context.Context, filePath, requestID string) (bool, error) {
+	if !fileExists(filePath) {
+		return false, nil
+	}
+
+	lines, err := readManagedFile(ctx, filePath)
+	if err != nil {
+		return false, err
+	}
+
+	for _, block := range parseBlocks(lines) {
+		if block.RequestID == requestID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
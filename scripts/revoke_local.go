@@ -0,0 +1,209 @@
+package scripts
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/internal/audit"
+	"p0-ssh-agent/internal/state"
+)
+
+// RevokeSource is the audit origin of revokes started on the host itself
+const RevokeSource = "revoke"
+
+// RevokeFilter selects recorded grants for a local revoke. All selects every
+// grant; otherwise UserName and RequestID must both match when set.
+type RevokeFilter struct {
+	All       bool   `json:"all,omitempty"`
+	UserName  string `json:"userName,omitempty"`
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// Validate rejects a filter that selects nothing or mixes All with a narrower selection
+func (f RevokeFilter) Validate() error {
+	if f.All && (f.UserName != "" || f.RequestID != "") {
+		return fmt.Errorf("all cannot be combined with a user or request ID")
+	}
+	if !f.All && f.UserName == "" && f.RequestID == "" {
+		return fmt.Errorf("select all grants, a user or a request ID")
+	}
+	if f.UserName != "" && !isValidUsername(f.UserName) {
+		return ErrInvalidUsername
+	}
+	return nil
+}
+
+// Matches reports whether a grant for userName from requestID is selected
+func (f RevokeFilter) Matches(userName, requestID string) bool {
+	if f.All {
+		return true
+	}
+	if f.UserName != "" && f.UserName != userName {
+		return false
+	}
+	if f.RequestID != "" && f.RequestID != requestID {
+		return false
+	}
+	return true
+}
+
+// RevokeRecorded revokes every granted entry of the provisioning state that
+// filter selects, without the backend: keys, CA keys, sudo rules and the
+// other recorded effects are removed. The host is then swept for P0 blocks
+// and drop-ins that filter selects but the state does not record, and
+// finally the affected users' SSH sessions are terminated. Revokes are
+// forced so a host that drifted is still cleaned, and recorded in the audit
+// log with source "revoke".
+func RevokeRecorded(filter RevokeFilter, dryRun bool, logger *logrus.Logger) ProvisioningResult {
+	if err := filter.Validate(); err != nil {
+		return ProvisioningResult{Success: false, Error: err.Error()}
+	}
+
+	recorded, err := state.Load(currentStatePath())
+	if err != nil {
+		return ProvisioningResult{Success: false, Error: err.Error()}
+	}
+
+	var items []BulkRevokeItem
+	users := make(map[string]bool)
+	known := make(map[string]bool)
+	for _, grant := range recorded {
+		known[grant.UserName] = true
+		if grant.Status != state.StatusGranted || !filter.Matches(grant.UserName, grant.RequestID) {
+			continue
+		}
+		items = append(items, BulkRevokeItem{
+			Command: grant.Command,
+			ProvisioningRequest: ProvisioningRequest{
+				UserName:  grant.UserName,
+				RequestID: grant.RequestID,
+			},
+		})
+		users[grant.UserName] = true
+	}
+
+	// Remove what grants access before the account's own limits, as a backend revoke does
+	sort.SliceStable(items, func(i, j int) bool {
+		return revokeOrder(items[i].Command) < revokeOrder(items[j].Command)
+	})
+
+	logger.WithFields(logrus.Fields{
+		"all":        filter.All,
+		"username":   filter.UserName,
+		"request_id": filter.RequestID,
+		"grants":     len(items),
+		"users":      len(users),
+		"dry_run":    dryRun,
+	}).Warn("🚨 Revoking recorded grants locally")
+
+	var results []BulkRevokeItemResult
+	failed := 0
+	run := func(item BulkRevokeItem) {
+		req := item.ProvisioningRequest
+		req.Action = "revoke"
+		req.Force = true
+		req.Origin = &audit.Origin{Source: RevokeSource}
+
+		result := ExecuteScript(item.Command, req, dryRun, logger)
+		results = append(results, BulkRevokeItemResult{
+			Index:     len(results),
+			Command:   item.Command,
+			UserName:  req.UserName,
+			RequestID: req.RequestID,
+			Success:   result.Success,
+			Message:   result.Message,
+			Error:     result.Error,
+		})
+		if !result.Success {
+			failed++
+		}
+	}
+
+	for _, item := range items {
+		run(item)
+	}
+
+	// Whatever is still marked as the agent's is missing from the state
+	searched := []string{filter.UserName}
+	if filter.UserName == "" {
+		for _, userName := range localUserNames() {
+			known[userName] = true
+		}
+		searched = make([]string, 0, len(known))
+		for userName := range known {
+			searched = append(searched, userName)
+		}
+		sort.Strings(searched)
+	}
+	leftovers := findLeftovers(context.Background(), filter, searched)
+	if dryRun {
+		// The recorded grants are still in place after a dry run
+		recordedIDs := make(map[string]bool, len(items))
+		for _, item := range items {
+			recordedIDs[item.RequestID] = true
+		}
+		unrecorded := leftovers[:0]
+		for _, item := range leftovers {
+			if !recordedIDs[item.requestID] {
+				unrecorded = append(unrecorded, item)
+			}
+		}
+		leftovers = unrecorded
+	}
+	for _, result := range sweepLeftovers(context.Background(), leftovers, len(results), dryRun, logger) {
+		results = append(results, result)
+		if !result.Success {
+			failed++
+		}
+		if result.UserName != "" {
+			users[result.UserName] = true
+		}
+	}
+	grants := len(results)
+
+	names := make([]string, 0, len(users))
+	for userName := range users {
+		names = append(names, userName)
+	}
+	sort.Strings(names)
+
+	for _, userName := range names {
+		item := BulkRevokeItem{
+			Command: string(CommandProvisionSession),
+			ProvisioningRequest: ProvisioningRequest{
+				UserName:  userName,
+				RequestID: filter.RequestID,
+				// Only a request revoke can spare sessions opened with other access
+				AllSessions: filter.RequestID == "",
+			},
+		}
+		if item.RequestID == "" {
+			item.RequestID = "local-revoke"
+		}
+		run(item)
+	}
+
+	if failed > 0 {
+		return ProvisioningResult{
+			Success: false,
+			Error:   fmt.Sprintf("%d of %d revocations failed", failed, len(results)),
+			Data:    results,
+		}
+	}
+
+	return ProvisioningResult{
+		Success: true,
+		Message: fmt.Sprintf("Revoked %d grant(s) of %d user(s)", grants, len(users)),
+		Data:    results,
+	}
+}
+
+func revokeOrder(command string) int {
+	if Command(command) == CommandProvisionUser {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,190 @@
+package scripts
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// leftover is access the agent wrote that a local revoke found on the host
+// after revoking the recorded grants: a P0 block, or a file written for a
+// single request. It is there because the state was lost, edited or never
+// written, e.g. when the agent crashed mid-grant.
+type leftover struct {
+	command   Command
+	path      string
+	userName  string
+	requestID string
+	wholeFile bool
+}
+
+// findLeftovers searches the files the agent grants access in for what filter
+// selects, by marker rather than from the state: the authorized keys files of
+// userNames, /etc/sudoers-p0, the sudoers drop-ins, the forwarding drop-ins
+// and the files of certificate grants made by earlier versions. A block whose
+// user cannot be told is only selected when filter does not name a user.
+func findLeftovers(ctx context.Context, filter RevokeFilter, userNames []string) []leftover {
+	var found []leftover
+	blocks := func(command Command, path, userName string, ruleUser bool) {
+		if !fileExists(path) {
+			return
+		}
+		lines, err := readManagedFile(ctx, path)
+		if err != nil {
+			return
+		}
+		seen := make(map[string]bool)
+		for _, block := range parseBlocks(lines) {
+			owner := userName
+			if ruleUser && len(block.Content) > 0 {
+				if fields := strings.Fields(block.Content[0]); len(fields) > 0 {
+					owner = fields[0]
+				}
+			}
+			if seen[block.RequestID] || block.RequestID == registrationCABlock || !filter.Matches(owner, block.RequestID) {
+				continue
+			}
+			if filter.UserName != "" && owner == "" {
+				continue
+			}
+			seen[block.RequestID] = true
+			found = append(found, leftover{command: command, path: path, userName: owner, requestID: block.RequestID})
+		}
+	}
+
+	for _, userName := range userNames {
+		if userInfo, err := lookupUser(userName); err == nil {
+			for _, path := range authorizedKeysFilesFor(ctx, userInfo, nil) {
+				blocks(CommandProvisionAuthorizedKeys, path, userName, false)
+			}
+		}
+		blocks(CommandProvisionCertificate, hostPath(filepath.Join(authorizedPrincipalDir, userName)), userName, false)
+	}
+	blocks(CommandProvisionCertificate, hostPath(TrustedCAPath), "", false)
+	blocks(CommandProvisionCertificate, hostPath(trustedUserCAKeysPath), "", false)
+	blocks(CommandProvisionSudo, hostPath(sudoersIncludePath()), "", true)
+
+	// A drop-in holds the block of one request and goes as a whole
+	dropIns, _ := filepath.Glob(filepath.Join(hostPath(sudoersDropInDir()), sudoersDropInPrefix+"*"))
+	for _, path := range dropIns {
+		before := len(found)
+		blocks(CommandProvisionSudo, path, "", true)
+		for i := before; i < len(found); i++ {
+			found[i].wholeFile = true
+		}
+	}
+
+	forwards, _ := filepath.Glob(filepath.Join(hostPath(sshdDropInDir), sshdDropInPrefix+"*.conf"))
+	for _, path := range forwards {
+		requestID, userName := forwardingDropInOwner(path)
+		if requestID == "" {
+			// The drop-in of a user holds a block per request
+			blocks(CommandProvisionPortForward, path, userName, false)
+			continue
+		}
+		if !filter.Matches(userName, requestID) {
+			continue
+		}
+		found = append(found, leftover{command: CommandProvisionPortForward, path: path, userName: userName, requestID: requestID, wholeFile: true})
+	}
+
+	return found
+}
+
+// forwardingDropInOwner reads the user of a forwarding drop-in and, for one
+// written per request by an earlier version, the request ID
+func forwardingDropInOwner(path string) (requestID, userName string) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", ""
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		switch {
+		case strings.HasPrefix(line, legacyMarkerPrefix):
+			requestID = strings.TrimSpace(strings.TrimPrefix(line, legacyMarkerPrefix))
+		case len(fields) == 3 && fields[0] == "Match" && fields[1] == "User" && userName == "":
+			userName = fields[2]
+		}
+	}
+	return requestID, userName
+}
+
+// sweepLeftovers removes what findLeftovers found and reports one result per
+// leftover, numbered from index. sshd is reloaded once if a forwarding
+// drop-in went.
+func sweepLeftovers(ctx context.Context, leftovers []leftover, index int, dryRun bool, logger *logrus.Logger) []BulkRevokeItemResult {
+	results := make([]BulkRevokeItemResult, 0, len(leftovers))
+	reload := false
+	for i, item := range leftovers {
+		result := BulkRevokeItemResult{
+			Index:     index + i,
+			Command:   string(item.command),
+			UserName:  item.userName,
+			RequestID: item.requestID,
+			Success:   true,
+			Message:   fmt.Sprintf("Removed unrecorded grant from %s", item.path),
+		}
+
+		logger.WithFields(logrus.Fields{
+			"file":       item.path,
+			"username":   item.userName,
+			"request_id": item.requestID,
+			"dry_run":    dryRun,
+		}).Warn("🧹 Removing grant missing from the provisioning state")
+
+		switch {
+		case dryRun:
+			result.Message = fmt.Sprintf("Would remove unrecorded grant from %s", item.path)
+		case item.wholeFile:
+			backupManagedFile(item.path, logger)
+			if err := files(ctx).Remove(item.path); err != nil {
+				result.Success = false
+				result.Error = fmt.Sprintf("failed to remove %s: %v", item.path, err)
+			}
+			reload = reload || item.command == CommandProvisionPortForward
+		case item.command == CommandProvisionPortForward:
+			if _, err := removeForwarding(ctx, item.userName, item.requestID, logger); err != nil {
+				result.Success = false
+				result.Error = err.Error()
+			}
+			reload = true
+		default:
+			if res := removeContentFromFile(ctx, item.requestID, "", item.path, logger); !res.Success {
+				result.Success = false
+				result.Error = res.Error
+			}
+		}
+		results = append(results, result)
+	}
+
+	if reload {
+		if err := reloadSSHD(ctx, logger); err != nil {
+			logger.WithError(err).Error("❌ Failed to reload sshd after removing forwarding rules")
+		}
+	}
+	return results
+}
+
+// localUserNames returns the accounts in /etc/passwd, so a local revoke of
+// every grant also finds keys of users the state does not mention
+func localUserNames() []string {
+	content, err := os.ReadFile(hostPath("/etc/passwd"))
+	if err != nil {
+		return nil
+	}
+
+	var names []string
+	for _, line := range strings.Split(string(content), "\n") {
+		if name, _, ok := strings.Cut(line, ":"); ok && isValidUsername(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
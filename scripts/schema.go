@@ -0,0 +1,100 @@
+package scripts
+
+import (
+	"embed"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+
+	"p0-ssh-agent/internal/schema"
+)
+
+// StatusInvalid is the result status of a request that does not match the
+// schema of its command
+const StatusInvalid = "invalid"
+
+// schemaFiles hold a JSON Schema per command, named <command>.json, and the
+// provisioningRequest.json they share
+//
+//go:embed schemas/*.json
+var schemaFiles embed.FS
+
+var (
+	requestSchemasOnce sync.Once
+	requestSchemas     *schema.Registry
+	requestSchemasErr  error
+)
+
+// loadRequestSchemas compiles the embedded schemas on first use, with the
+// patterns the provisioning scripts check as the userName and requestId formats
+func loadRequestSchemas() (*schema.Registry, error) {
+	requestSchemasOnce.Do(func() {
+		registry := schema.NewRegistry()
+		registry.AddFormat("userName", usernamePattern)
+		registry.AddFormat("requestId", requestIDPattern)
+
+		entries, err := schemaFiles.ReadDir("schemas")
+		if err != nil {
+			requestSchemasErr = fmt.Errorf("failed to read request schemas: %w", err)
+			return
+		}
+		for _, entry := range entries {
+			data, err := schemaFiles.ReadFile(path.Join("schemas", entry.Name()))
+			if err != nil {
+				requestSchemasErr = fmt.Errorf("failed to read request schema %s: %w", entry.Name(), err)
+				return
+			}
+			if err := registry.Add(entry.Name(), data); err != nil {
+				requestSchemasErr = err
+				return
+			}
+		}
+		if err := registry.Check(); err != nil {
+			requestSchemasErr = err
+			return
+		}
+		requestSchemas = registry
+	})
+	return requestSchemas, requestSchemasErr
+}
+
+// ValidationError lists every field of a request that does not match the
+// schema of its command
+type ValidationError struct {
+	Command string              `json:"command"`
+	Errors  []schema.FieldError `json:"errors"`
+}
+
+func (e *ValidationError) Error() string {
+	reasons := make([]string, len(e.Errors))
+	for i, fieldErr := range e.Errors {
+		reasons[i] = fieldErr.Error()
+	}
+	return fmt.Sprintf("invalid %s request: %s", e.Command, strings.Join(reasons, "; "))
+}
+
+// ValidateRequest checks the payload of a backend request, as decoded from
+// JSON, against the schema of command before anything runs. Commands without
+// a schema are not checked here. The error is set when the embedded schemas
+// cannot be loaded, in which case no request should run.
+func ValidateRequest(command string, data interface{}) (*ValidationError, error) {
+	registry, err := loadRequestSchemas()
+	if err != nil {
+		return nil, err
+	}
+
+	name := command + ".json"
+	if !registry.Has(name) {
+		return nil, nil
+	}
+
+	fieldErrs, err := registry.Validate(name, data)
+	if err != nil {
+		return nil, err
+	}
+	if len(fieldErrs) == 0 {
+		return nil, nil
+	}
+	return &ValidationError{Command: command, Errors: fieldErrs}, nil
+}
@@ -0,0 +1,103 @@
+package scripts
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestValidateRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		data    string
+		// wantFields are the fields reported as invalid, nil when valid
+		wantFields []string
+	}{
+		{
+			name:    "valid grant",
+			command: "provisionSudo",
+			data:    `{"command": "provisionSudo", "userName": "alice", "requestId": "req-1", "action": "grant", "sudo": true}`,
+		},
+		{
+			name:    "valid revoke with metadata",
+			command: "provisionAuthorizedKeys",
+			data:    `{"userName": "alice", "requestId": "req-1", "action": "revoke", "metadata": {"ticket": "CHG-1"}}`,
+		},
+		{
+			name:       "missing action",
+			command:    "provisionUser",
+			data:       `{"userName": "alice", "requestId": "req-1"}`,
+			wantFields: []string{"action"},
+		},
+		{
+			name:       "missing shared fields",
+			command:    "provisionUser",
+			data:       `{"action": "grant"}`,
+			wantFields: []string{"requestId", "userName"},
+		},
+		{
+			name:       "invalid user name and action",
+			command:    "provisionSudo",
+			data:       `{"userName": "Alice; rm", "requestId": "req-1", "action": "delete"}`,
+			wantFields: []string{"action", "userName"},
+		},
+		{
+			name:       "request ID unsafe in a file name",
+			command:    "provisionBanner",
+			data:       `{"userName": "alice", "requestId": "../req-1", "action": "grant"}`,
+			wantFields: []string{"requestId"},
+		},
+		{
+			name:       "wrong types",
+			command:    "provisionSudo",
+			data:       `{"userName": "alice", "requestId": "req-1", "action": "grant", "sudo": "yes", "graceSeconds": -1}`,
+			wantFields: []string{"graceSeconds", "sudo"},
+		},
+		{
+			name:       "nested field out of range",
+			command:    "provisionUser",
+			data:       `{"userName": "alice", "requestId": "req-1", "action": "grant", "resources": {"ioWeight": 20000}}`,
+			wantFields: []string{"resources.ioWeight"},
+		},
+		{
+			name:       "payload that is not an object",
+			command:    "provisionUser",
+			data:       `"grant"`,
+			wantFields: []string{""},
+		},
+		{
+			name:    "command without a schema",
+			command: "describeSomething",
+			data:    `{"anything": 1}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var data interface{}
+			if err := json.Unmarshal([]byte(tt.data), &data); err != nil {
+				t.Fatalf("invalid test data: %v", err)
+			}
+
+			invalid, err := ValidateRequest(tt.command, data)
+			if err != nil {
+				t.Fatalf("ValidateRequest: %v", err)
+			}
+			var got []string
+			if invalid != nil {
+				if invalid.Command != tt.command {
+					t.Errorf("error names command %q, want %q", invalid.Command, tt.command)
+				}
+				for _, fieldErr := range invalid.Errors {
+					got = append(got, fieldErr.Field)
+				}
+				sort.Strings(got)
+			}
+			if !reflect.DeepEqual(got, tt.wantFields) {
+				t.Errorf("invalid fields %q, want %q (%v)", got, tt.wantFields, invalid)
+			}
+		})
+	}
+}
@@ -0,0 +1,330 @@
+package scripts
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+
+	"p0-ssh-agent/internal/state"
+)
+
+// authLogPaths are searched for sshd's login line when the journal has none
+var authLogPaths = []string{"/var/log/auth.log", "/var/log/secure"}
+
+var (
+	fingerprintPattern = regexp.MustCompile(`SHA256:[A-Za-z0-9+/=]+`)
+	keyIDPattern       = regexp.MustCompile(` ID (\S+) \(serial`)
+)
+
+// loginSession is a logind session and the process that leads it, which for
+// SSH logins is the sshd process that authenticated the user
+type loginSession struct {
+	ID     string
+	Leader string
+}
+
+// sessionMatcher recognizes the sshd login line of a session opened with
+// the access one request granted
+type sessionMatcher struct {
+	fingerprints   map[string]bool
+	keyIDs         map[string]bool
+	caFingerprints map[string]bool
+}
+
+func (m sessionMatcher) empty() bool {
+	return len(m.fingerprints) == 0 && len(m.keyIDs) == 0 && len(m.caFingerprints) == 0
+}
+
+// matches reports whether an "Accepted publickey" line was produced by the
+// request's key, certificate or CA. sshd logs the key fingerprint first and,
+// for certificates, the key ID and the signing CA's fingerprint after it.
+func (m sessionMatcher) matches(line string) bool {
+	fingerprints := fingerprintPattern.FindAllString(line, -1)
+	if len(fingerprints) > 0 && m.fingerprints[fingerprints[0]] {
+		return true
+	}
+	if match := keyIDPattern.FindStringSubmatch(line); match != nil && m.keyIDs[match[1]] {
+		return true
+	}
+	if i := strings.Index(line, " CA "); i >= 0 {
+		for _, fingerprint := range fingerprintPattern.FindAllString(line[i:], -1) {
+			if m.caFingerprints[fingerprint] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// requestMatcher collects the keys, certificate IDs and CAs recorded for
+// every grant of requestID
+func requestMatcher(requestID string) (sessionMatcher, error) {
+	matcher := sessionMatcher{
+		fingerprints:   make(map[string]bool),
+		keyIDs:         make(map[string]bool),
+		caFingerprints: make(map[string]bool),
+	}
+
+	grants, err := state.Load(currentStatePath())
+	if err != nil {
+		return matcher, err
+	}
+
+	for _, grant := range grants {
+		if grant.RequestID != requestID {
+			continue
+		}
+
+		var req ProvisioningRequest
+		if err := json.Unmarshal(grant.Request, &req); err != nil {
+			continue
+		}
+
+		if key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(req.PublicKey)); err == nil {
+			matcher.fingerprints[ssh.FingerprintSHA256(key)] = true
+		}
+		if key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(req.CAPublicKey)); err == nil {
+			matcher.caFingerprints[ssh.FingerprintSHA256(key)] = true
+		}
+		if key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(req.Certificate)); err == nil {
+			if cert, ok := key.(*ssh.Certificate); ok {
+				matcher.keyIDs[cert.KeyId] = true
+			}
+		}
+		if Command(grant.Command) == CommandProvisionCertificate {
+			matcher.keyIDs[fmt.Sprintf("p0:%s:%s", req.RequestID, req.UserName)] = true
+		}
+	}
+
+	return matcher, nil
+}
+
+// hasOtherGrants reports whether username holds an unexpired grant from a
+// request other than requestID
+func hasOtherGrants(username, requestID string) bool {
+	grants, err := state.Load(currentStatePath())
+	if err != nil {
+		return false
+	}
+
+	now := time.Now()
+	for _, grant := range grants {
+		if grant.UserName == username && grant.RequestID != requestID &&
+			grant.Status == state.StatusGranted && !grant.Expired(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// userLoginSessions lists the user's logind sessions with their leaders
+func userLoginSessions(ctx context.Context, username string) ([]loginSession, error) {
+	ids, err := userSessionIDs(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := make([]loginSession, 0, len(ids))
+	for _, id := range ids {
+		leader, err := outputOf(command(quiet(ctx), "loginctl", "show-session", id, "-p", "Leader", "--value"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read session %s: %w", id, err)
+		}
+		sessions = append(sessions, loginSession{ID: id, Leader: strings.TrimSpace(string(leader))})
+	}
+	return sessions, nil
+}
+
+// userSessionIDs lists the IDs of the user's logind sessions
+func userSessionIDs(ctx context.Context, username string) ([]string, error) {
+	output, err := outputOf(command(quiet(ctx), "loginctl", "list-sessions", "--no-legend"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list login sessions: %w", err)
+	}
+
+	var ids []string
+	scanner := bufio.NewScanner(strings.NewReader(string(output)))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 3 && fields[2] == username {
+			ids = append(ids, fields[0])
+		}
+	}
+	return ids, nil
+}
+
+// priorSessions returns the user's sessions when a login grant is made, for
+// the state. ok is false without logind.
+func priorSessions(ctx context.Context, username string) (ids []string, ok bool) {
+	if !commandExists("loginctl") {
+		return nil, false
+	}
+	ids, err := userSessionIDs(ctx, username)
+	return ids, err == nil
+}
+
+// sessionHistory holds what the state recorded about the sessions the user
+// had when each of their login grants was made
+type sessionHistory struct {
+	// before are the sessions that predate the revoked request, known when
+	// requestKnown is set
+	before       map[string]bool
+	requestKnown bool
+
+	// predateOthers are the sessions that predate every other login grant
+	// the user still holds, known when othersKnown is set
+	predateOthers map[string]bool
+	othersKnown   bool
+}
+
+// loadSessionHistory reads the prior sessions recorded for username's login
+// grants: those of requestID, whatever their status, as a revoke may already
+// have removed them, and the other requests' active ones
+func loadSessionHistory(username, requestID string) sessionHistory {
+	var history sessionHistory
+	grants, err := state.Load(currentStatePath())
+	if err != nil {
+		return history
+	}
+
+	intersect := func(set map[string]bool, ids []string) map[string]bool {
+		next := make(map[string]bool)
+		for _, id := range ids {
+			if set == nil || set[id] {
+				next[id] = true
+			}
+		}
+		return next
+	}
+
+	now := time.Now()
+	othersKnown, others := true, 0
+	for _, grant := range grants {
+		if grant.UserName != username || !loginCommands[grant.Command] {
+			continue
+		}
+		switch {
+		case grant.RequestID == requestID:
+			if grant.SessionsRecorded {
+				history.before = intersect(history.before, grant.PriorSessions)
+				history.requestKnown = true
+			}
+		case grant.Status == state.StatusGranted && !grant.Expired(now):
+			others++
+			if !grant.SessionsRecorded {
+				othersKnown = false
+				continue
+			}
+			history.predateOthers = intersect(history.predateOthers, grant.PriorSessions)
+		}
+	}
+	history.othersKnown = othersKnown && others > 0
+	return history
+}
+
+// acceptedLogin returns the "Accepted publickey" line sshd logged from the
+// session leader, looking in the journal first and then the auth log files
+func acceptedLogin(ctx context.Context, leader string) (string, error) {
+	if output, err := outputOf(privileged(quiet(ctx), "journalctl", "_PID="+leader, "--no-pager", "-o", "cat")); err == nil {
+		for _, line := range strings.Split(string(output), "\n") {
+			if strings.HasPrefix(line, "Accepted publickey ") {
+				return line, nil
+			}
+		}
+	}
+
+	marker := "[" + leader + "]: Accepted publickey "
+	for _, path := range authLogPaths {
+		path = hostPath(path)
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		output, err := outputOf(privileged(quiet(ctx), "grep", "-F", marker, path))
+		if err != nil {
+			continue
+		}
+		lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+		last := lines[len(lines)-1]
+		return last[strings.Index(last, marker)+len("["+leader+"]: "):], nil
+	}
+
+	return "", fmt.Errorf("no sshd login record for process %s", leader)
+}
+
+// killRequestSessions terminates only the user's sessions that logged in
+// with access granted by req.RequestID. A session is the request's when it
+// did not exist yet when the request was granted, and either sshd logged its
+// login with the request's key, certificate or CA, or it already existed
+// when every other grant the user holds was made, so nothing else can have
+// let it in. ok is false when sessions cannot be attributed, in which case
+// nothing was terminated.
+func killRequestSessions(ctx context.Context, req ProvisioningRequest, logger *logrus.Logger) (result ProvisioningResult, ok bool) {
+	if !commandExists("loginctl") {
+		return ProvisioningResult{}, false
+	}
+
+	history := loadSessionHistory(req.UserName, req.RequestID)
+	matcher, err := requestMatcher(req.RequestID)
+	if err != nil || (matcher.empty() && !history.othersKnown) {
+		return ProvisioningResult{}, false
+	}
+
+	sessions, err := userLoginSessions(ctx, req.UserName)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to list login sessions")
+		return ProvisioningResult{}, false
+	}
+
+	var terminated, kept []string
+	for _, session := range sessions {
+		if history.requestKnown && history.before[session.ID] {
+			kept = append(kept, session.ID)
+			continue
+		}
+		if !history.othersKnown || !history.predateOthers[session.ID] {
+			line, err := acceptedLogin(ctx, session.Leader)
+			if err != nil {
+				// Not an SSH key login (console, password) or its log has rotated away
+				logger.WithError(err).WithField("session", session.ID).Debug("Session not attributable to a grant, keeping it")
+				kept = append(kept, session.ID)
+				continue
+			}
+			if !matcher.matches(line) {
+				kept = append(kept, session.ID)
+				continue
+			}
+		}
+
+		if err := privileged(ctx, "loginctl", "terminate-session", session.ID).Run(); err != nil {
+			return ProvisioningResult{
+				Success: false,
+				Error:   fmt.Sprintf("failed to terminate session %s: %v", session.ID, err),
+			}, true
+		}
+		terminated = append(terminated, session.ID)
+	}
+
+	logger.WithFields(logrus.Fields{
+		"username":   req.UserName,
+		"request_id": req.RequestID,
+		"terminated": strings.Join(terminated, ","),
+		"kept":       strings.Join(kept, ","),
+	}).Info("✅ Terminated sessions opened with the revoked grant")
+
+	return ProvisioningResult{
+		Success: true,
+		Message: fmt.Sprintf("Terminated %d session(s) of %s for request %s, kept %d", len(terminated), req.UserName, req.RequestID, len(kept)),
+		Data: map[string]interface{}{
+			"terminated": terminated,
+			"kept":       kept,
+		},
+	}, true
+}
@@ -0,0 +1,249 @@
+package scripts
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/internal/osplugins"
+	"p0-ssh-agent/internal/state"
+	"p0-ssh-agent/types"
+)
+
+// recordingDropInPrefix names the per-user drop-ins forcing sessions through
+// the recorder
+const recordingDropInPrefix = "p0-record-"
+
+// recordingIncludeLine is added to sshd_config when it does not already include the drop-in directory
+var recordingIncludeLine = fmt.Sprintf("Include %s/%s*.conf", sshdDropInDir, recordingDropInPrefix)
+
+var (
+	sessionRecordingMu sync.RWMutex
+	sessionRecording   *types.SessionRecording
+)
+
+// SetSessionRecording sets how the sessions of users granted access are
+// recorded; nil records none. The agent sets it from sessionRecording.
+func SetSessionRecording(recording *types.SessionRecording) {
+	sessionRecordingMu.Lock()
+	defer sessionRecordingMu.Unlock()
+	sessionRecording = recording
+}
+
+func currentSessionRecording() *types.SessionRecording {
+	sessionRecordingMu.RLock()
+	defer sessionRecordingMu.RUnlock()
+	return sessionRecording
+}
+
+// withSessionRecording runs a provisioning script, making sure a login grant
+// is recorded. The recorder is forced on the user before the grant runs, so
+// no session can start unrecorded, and a grant whose recording cannot be set
+// up fails. After a revoke it stays while the user has other login grants.
+func withSessionRecording(ctx context.Context, command string, req ProvisioningRequest, logger *logrus.Logger, run func() ProvisioningResult) ProvisioningResult {
+	recording := currentSessionRecording()
+	if recording == nil || !loginCommands[command] || !osplugins.Selected().SupportsSessionRecording() {
+		return run()
+	}
+
+	switch req.Action {
+	case "grant":
+		if err := ensureSessionRecording(ctx, recording, req.UserName, req.RequestID, logger); err != nil {
+			return ProvisioningResult{
+				Success: false,
+				Error:   fmt.Sprintf("session recording could not be set up, access not granted: %v", err),
+			}
+		}
+		return run()
+	case "revoke":
+		result := run()
+		if result.Success {
+			if err := releaseSessionRecording(ctx, recording, command, req.UserName, req.RequestID, logger); err != nil {
+				logger.WithError(err).WithField("username", req.UserName).Warn("⚠️ Failed to update session recording after revoke")
+			}
+		}
+		return result
+	default:
+		return run()
+	}
+}
+
+// ensureSessionRecording forces the user's sessions through the recorder,
+// attributed to requestID and the user's other active login grants
+func ensureSessionRecording(ctx context.Context, recording *types.SessionRecording, username, requestID string, logger *logrus.Logger) error {
+	// Both end up in sshd_config, ahead of the grant's own validation
+	if !isValidUsername(username) {
+		return fmt.Errorf("invalid username: %q", username)
+	}
+	if !requestIDPattern.MatchString(requestID) {
+		return fmt.Errorf("invalid request ID: %q", requestID)
+	}
+
+	if err := ensureRecordingSpool(ctx, recording.GetSpoolDir()); err != nil {
+		return err
+	}
+
+	requestIDs := activeLoginRequests(username, "", "")
+	requestIDs = appendMissing(requestIDs, requestID)
+	return writeRecordingDropIn(ctx, recording, username, requestIDs, logger)
+}
+
+// releaseSessionRecording updates the user's drop-in after command of
+// requestID was revoked, removing it once no login grant is left
+func releaseSessionRecording(ctx context.Context, recording *types.SessionRecording, command, username, requestID string, logger *logrus.Logger) error {
+	if !isValidUsername(username) {
+		return fmt.Errorf("invalid username: %q", username)
+	}
+
+	requestIDs := activeLoginRequests(username, command, requestID)
+	if len(requestIDs) > 0 {
+		return writeRecordingDropIn(ctx, recording, username, requestIDs, logger)
+	}
+
+	dropInPath := hostPath(recordingDropInPath(username))
+	if _, err := os.Stat(dropInPath); os.IsNotExist(err) {
+		return nil
+	}
+	if err := files(ctx).Remove(dropInPath); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", dropInPath, err)
+	}
+
+	logger.WithField("username", username).Info("🎥 Session recording no longer forced")
+	return reloadSSHD(ctx, logger)
+}
+
+// RecordedRequests reports whether the sessions of username are forced
+// through the recorder, and the requests they are recorded for, taken from
+// the provisioning state. The recording socket only takes sessions of such
+// users, whatever their wrapper claims.
+func RecordedRequests(username string) ([]string, bool) {
+	if !isValidUsername(username) {
+		return nil, false
+	}
+	if _, err := os.Lstat(hostPath(recordingDropInPath(username))); err != nil {
+		return nil, false
+	}
+	return activeLoginRequests(username, "", ""), true
+}
+
+// activeLoginRequests returns the request IDs of the user's login grants in
+// the provisioning state, leaving out command of skipRequestID
+func activeLoginRequests(username, skipCommand, skipRequestID string) []string {
+	grants, err := state.Load(currentStatePath())
+	if err != nil {
+		return nil
+	}
+
+	now := time.Now()
+	var requestIDs []string
+	for _, grant := range grants {
+		if grant.UserName != username || grant.Status != state.StatusGranted || grant.Expired(now) || !loginCommands[grant.Command] {
+			continue
+		}
+		if (grant.Command == skipCommand && grant.RequestID == skipRequestID) || !requestIDPattern.MatchString(grant.RequestID) {
+			continue
+		}
+		requestIDs = appendMissing(requestIDs, grant.RequestID)
+	}
+	sort.Strings(requestIDs)
+	return requestIDs
+}
+
+func appendMissing(values []string, value string) []string {
+	for _, existing := range values {
+		if existing == value {
+			return values
+		}
+	}
+	return append(values, value)
+}
+
+// ensureRecordingSpool creates the spool directory, which only the agent may
+// use: it writes the recordings itself, from what the users' wrappers send
+// to its recording socket.
+func ensureRecordingSpool(ctx context.Context, spoolDir string) error {
+	fs := files(ctx)
+	path := hostPath(spoolDir)
+	if err := fs.MkdirAll(path); err != nil {
+		return fmt.Errorf("failed to create %s: %w", spoolDir, err)
+	}
+	if err := fs.Chown(path, os.Getuid(), os.Getgid()); err != nil {
+		return fmt.Errorf("failed to set the owner of %s: %w", spoolDir, err)
+	}
+	if err := fs.Chmod(path, 0700); err != nil {
+		return fmt.Errorf("failed to set permissions on %s: %w", spoolDir, err)
+	}
+	return nil
+}
+
+func recordingDropInPath(username string) string {
+	return filepath.Join(sshdDropInDir, recordingDropInPrefix+username+".conf")
+}
+
+// writeRecordingDropIn sets ForceCommand for the user to the agent's
+// record-session wrapper, which runs the requested command or login shell
+// under the recorder and sends the recording to the agent
+func writeRecordingDropIn(ctx context.Context, recording *types.SessionRecording, username string, requestIDs []string, logger *logrus.Logger) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to locate the agent binary: %w", err)
+	}
+
+	var b strings.Builder
+	b.WriteString("# Managed by p0-ssh-agent: session recording\n")
+	fmt.Fprintf(&b, "Match User %s\n", username)
+	fmt.Fprintf(&b, "    ForceCommand %s record-session --recorder %s --socket %s --request-id %s\n",
+		shellQuote(executable), recording.GetRecorder(), shellQuote(types.RecordingSocketPath), strings.Join(requestIDs, ","))
+	b.WriteString("Match all\n")
+	content := b.String()
+
+	dropInPath := hostPath(recordingDropInPath(username))
+	if previous, err := os.ReadFile(dropInPath); err == nil && string(previous) == content {
+		return nil
+	}
+
+	snapshot := snapshotSSHD(ctx, dropInPath)
+	if err := ensureSSHDInclude(ctx, recordingIncludeLine, logger); err != nil {
+		return err
+	}
+
+	fs := files(ctx)
+	if err := fs.WriteFile(dropInPath, []byte(content)); err != nil {
+		snapshot.restore()
+		return fmt.Errorf("failed to write %s: %w", dropInPath, err)
+	}
+	if err := fs.Chmod(dropInPath, 0644); err != nil {
+		snapshot.restore()
+		return fmt.Errorf("failed to set permissions on %s: %w", dropInPath, err)
+	}
+
+	if err := snapshot.check(ctx, "session recording rule"); err != nil {
+		return err
+	}
+
+	if err := reloadSSHD(ctx, logger); err != nil {
+		return err
+	}
+
+	logger.WithFields(logrus.Fields{
+		"username":    username,
+		"recorder":    recording.GetRecorder(),
+		"request_ids": requestIDs,
+	}).Info("🎥 Sessions of the user are recorded")
+	return nil
+}
+
+// shellQuote quotes value for the shell sshd runs ForceCommand with
+func shellQuote(value string) string {
+	if value != "" && strings.Trim(value, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789/._-") == "" {
+		return value
+	}
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
@@ -0,0 +1,73 @@
+package scripts
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ttyPattern limits warnings to terminal devices reported by who
+var ttyPattern = regexp.MustCompile(`^(pts/[0-9]+|tty[0-9]+)$`)
+
+// WarnUserSessions writes a notice to every terminal the user is logged in
+// on, telling them their sessions end after grace. Only the user's own
+// terminals are written to, unlike wall. Sessions without a terminal (scp,
+// port forwards) cannot be warned.
+func WarnUserSessions(ctx context.Context, username string, grace time.Duration, logger *logrus.Logger) (int, error) {
+	if !isValidUsername(username) {
+		return 0, ErrInvalidUsername
+	}
+
+	ttys, err := userTTYs(ctx, username)
+	if err != nil {
+		return 0, err
+	}
+
+	notice := fmt.Sprintf("\r\n\a*** P0 access revoked: your SSH sessions on this host will be terminated in %s (at %s). Please save your work. ***\r\n",
+		grace, time.Now().Add(grace).Format("15:04:05 MST"))
+
+	warned := 0
+	for _, tty := range ttys {
+		if err := files(ctx).AppendFile(hostPath("/dev/"+tty), []byte(notice)); err != nil {
+			logger.WithError(err).WithField("tty", tty).Warn("Failed to warn session before termination")
+			continue
+		}
+		warned++
+	}
+
+	logger.WithFields(logrus.Fields{
+		"username": username,
+		"ttys":     warned,
+		"grace":    grace,
+	}).Info("📢 Warned user sessions of pending termination")
+
+	return warned, nil
+}
+
+// userTTYs returns the terminals username is logged in on, according to who
+func userTTYs(ctx context.Context, username string) ([]string, error) {
+	output, err := outputOf(command(quiet(ctx), "who"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list logged in users: %w", err)
+	}
+
+	var ttys []string
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(strings.NewReader(string(output)))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != username {
+			continue
+		}
+		if tty := fields[1]; ttyPattern.MatchString(tty) && !seen[tty] {
+			seen[tty] = true
+			ttys = append(ttys, tty)
+		}
+	}
+	return ttys, nil
+}
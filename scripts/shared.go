@@ -1,7 +1,9 @@
 package scripts
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
@@ -9,15 +11,25 @@ import (
 	"path/filepath"
 	"regexp"
 	"strconv"
-	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/internal/metrics"
 )
 
+// usernamePattern matches the usernames the provisioning scripts accept
+var usernamePattern = regexp.MustCompile(`^[a-z][-a-z0-9_]*$`)
+
+// requestIDPattern matches request IDs that are safe in file names
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// ErrInvalidUsername is returned for usernames the provisioning scripts refuse
+var ErrInvalidUsername = errors.New("invalid username format: must match " + usernamePattern.String())
+
 func isValidUsername(username string) bool {
-	pattern := `^[a-z][-a-z0-9_]*$`
-	matched, _ := regexp.MatchString(pattern, username)
-	return matched
+	return usernamePattern.MatchString(username)
 }
 
 func findNextAvailableUID() (int, error) {
@@ -37,45 +49,68 @@ func commandExists(command string) bool {
 	return err == nil
 }
 
-func ensureContentInFile(content, requestID, filePath, permission, owner string, logger *logrus.Logger) ProvisioningResult {
-	comment := fmt.Sprintf("# RequestID: %s", requestID)
+// ensureContentInFile makes content the managed block of requestID in
+// filePath, replacing any earlier block of the request. A new file gets
+// permission and, unless owner is root, its directory is given to owner.
+func ensureContentInFile(ctx context.Context, content, requestID, filePath, permission, owner string, logger *logrus.Logger) ProvisioningResult {
+	unlock, err := lockManagedFile(filePath)
+	if err != nil {
+		return ProvisioningResult{
+			Success: false,
+			Error:   err.Error(),
+		}
+	}
+	defer unlock()
 
+	return ensureContentInLockedFile(ctx, content, requestID, filePath, permission, owner, logger)
+}
+
+// ensureContentInLockedFile is ensureContentInFile for a caller that holds
+// the lock of filePath, e.g. to check the file and write it as one step
+func ensureContentInLockedFile(ctx context.Context, content, requestID, filePath, permission, owner string, logger *logrus.Logger) ProvisioningResult {
 	logger.WithFields(logrus.Fields{
 		"file":       filePath,
 		"request_id": requestID,
 		"owner":      owner,
 	}).Debug("Ensuring content in file")
 
-	dir := filepath.Dir(filePath)
-	if err := exec.Command("sudo", "mkdir", "-p", dir).Run(); err != nil {
+	mode, err := strconv.ParseUint(permission, 8, 32)
+	if err != nil {
 		return ProvisioningResult{
 			Success: false,
-			Error:   fmt.Sprintf("failed to create directory %s: %v", dir, err),
+			Error:   fmt.Sprintf("invalid permission %q for %s", permission, filePath),
 		}
 	}
 
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		if err := exec.Command("sudo", "touch", filePath).Run(); err != nil {
-			return ProvisioningResult{
-				Success: false,
-				Error:   fmt.Sprintf("failed to create file %s: %v", filePath, err),
-			}
+	dir := filepath.Dir(filePath)
+	_, dirExisted, err := files(ctx).FileType(dir)
+	if err != nil {
+		return ProvisioningResult{
+			Success: false,
+			Error:   fmt.Sprintf("failed to check directory %s: %v", dir, err),
 		}
-		if err := exec.Command("sudo", "chmod", permission, filePath).Run(); err != nil {
-			return ProvisioningResult{
-				Success: false,
-				Error:   fmt.Sprintf("failed to set permissions on %s: %v", filePath, err),
-			}
+	}
+	if err := files(ctx).MkdirAll(dir); err != nil {
+		return ProvisioningResult{
+			Success: false,
+			Error:   fmt.Sprintf("failed to create directory %s: %v", dir, err),
 		}
 	}
 
-	grepCmd := exec.Command("sudo", "grep", "-qF", comment, filePath)
-	commentExists := grepCmd.Run() == nil
+	file, err := openManagedFile(ctx, filePath, os.FileMode(mode))
+	if err != nil {
+		return ProvisioningResult{
+			Success: false,
+			Error:   err.Error(),
+		}
+	}
 
-	grepCmd = exec.Command("sudo", "grep", "-qF", content, filePath)
-	contentExists := grepCmd.Run() == nil
+	file.pruneFinished(requestID, logger)
 
-	if commentExists && contentExists {
+	if file.hasBlock(requestID, content) {
+		if err := file.save(ctx, logger); err != nil {
+			logger.WithError(err).WithField("file", filePath).Warn("Failed to prune expired request blocks")
+		}
 		logger.Debug("Content already exists in file")
 		return ProvisioningResult{
 			Success: true,
@@ -83,19 +118,29 @@ func ensureContentInFile(content, requestID, filePath, permission, owner string,
 		}
 	}
 
-	appendCmd := exec.Command("sudo", "tee", "-a", filePath)
-	appendCmd.Stdin = strings.NewReader(comment + "\n" + content + "\n")
-	if err := appendCmd.Run(); err != nil {
+	fileExisted := file.exists
+	file.setBlock(requestID, content)
+	if err := file.save(ctx, logger); err != nil {
 		return ProvisioningResult{
 			Success: false,
-			Error:   fmt.Sprintf("failed to append content to %s: %v", filePath, err),
+			Error:   fmt.Sprintf("failed to add content to %s: %v", filePath, err),
 		}
 	}
 
+	// Only what the agent just created is given to the owner: anything that
+	// was already there keeps its owner, and is never a symlink's target
 	if owner != "root" && owner != "" {
-		sshDir := filepath.Dir(filePath)
-		if err := exec.Command("sudo", "chown", "-R", owner+":"+owner, sshDir).Run(); err != nil {
-			logger.WithError(err).Warn("Failed to set ownership, but content was added successfully")
+		var created []string
+		if !dirExisted {
+			created = append(created, dir)
+		}
+		if !fileExisted {
+			created = append(created, filePath)
+		}
+		for _, path := range created {
+			if err := chownToUser(ctx, path, owner); err != nil {
+				logger.WithError(err).WithField("path", path).Warn("Failed to set ownership, but content was added successfully")
+			}
 		}
 	}
 
@@ -105,9 +150,12 @@ func ensureContentInFile(content, requestID, filePath, permission, owner string,
 	}
 }
 
-func removeContentFromFile(requestID, filePath string, logger *logrus.Logger) ProvisioningResult {
-	comment := fmt.Sprintf("# RequestID: %s", requestID)
-
+// removeContentFromFile removes the request's blocks from filePath. content
+// is what the grant wrote, or empty when unknown: it is how the lines of a
+// block whose end marker is missing are found. Such a block is removed as
+// far as possible and reported with StatusMalformed, never refused, so a
+// hand edit cannot keep access in place.
+func removeContentFromFile(ctx context.Context, requestID, content, filePath string, logger *logrus.Logger) ProvisioningResult {
 	logger.WithFields(logrus.Fields{
 		"file":       filePath,
 		"request_id": requestID,
@@ -120,51 +168,73 @@ func removeContentFromFile(requestID, filePath string, logger *logrus.Logger) Pr
 		}
 	}
 
-	sedPattern := fmt.Sprintf("/^%s$/,/^$/d", regexp.QuoteMeta(comment))
-	cmd := exec.Command("sudo", "sed", "-i", sedPattern, filePath)
-	if err := cmd.Run(); err != nil {
+	unlock, err := lockManagedFile(filePath)
+	if err != nil {
+		return ProvisioningResult{
+			Success: false,
+			Error:   err.Error(),
+		}
+	}
+	defer unlock()
+
+	file, err := openManagedFile(ctx, filePath, 0644)
+	if err != nil {
 		return ProvisioningResult{
 			Success: false,
 			Error:   fmt.Sprintf("failed to remove content from %s: %v", filePath, err),
 		}
 	}
 
-	return ProvisioningResult{
-		Success: true,
-		Message: fmt.Sprintf("Content removed from %s successfully", filePath),
+	file.pruneFinished(requestID, logger)
+
+	tampered := file.removeBlocks(requestID, content)
+	if err := file.save(ctx, logger); err != nil {
+		return ProvisioningResult{
+			Success: false,
+			Error:   fmt.Sprintf("failed to remove content from %s: %v", filePath, err),
+		}
 	}
-}
 
-func ensureLineInFile(line, filePath string, logger *logrus.Logger) ProvisioningResult {
-	logger.WithFields(logrus.Fields{
-		"file": filePath,
-		"line": line,
-	}).Debug("Ensuring line in file")
+	for _, block := range tampered {
+		if !block.Unterminated {
+			continue
+		}
+		metrics.MalformedBlocks.Inc(filepath.Base(filePath))
+		logger.WithFields(logrus.Fields{
+			"file":       filePath,
+			"request_id": requestID,
+			"line":       block.Start + 1,
+			"content":    content != "",
+		}).Error("🚨 Managed block has no end marker - removed its marker and the granted lines found after it, check the file by hand")
 
-	grepCmd := exec.Command("sudo", "grep", "-qF", line, filePath)
-	if grepCmd.Run() == nil {
 		return ProvisioningResult{
 			Success: true,
-			Message: "Line already exists in file",
+			Message: fmt.Sprintf("Content removed from %s, but its block had no end marker: lines added to it by hand may remain", filePath),
+			Status:  StatusMalformed,
 		}
 	}
 
-	appendCmd := exec.Command("sudo", "tee", "-a", filePath)
-	appendCmd.Stdin = strings.NewReader(line + "\n")
-	if err := appendCmd.Run(); err != nil {
+	if len(tampered) > 0 {
+		logger.WithFields(logrus.Fields{
+			"file":       filePath,
+			"request_id": requestID,
+			"line":       tampered[0].Start + 1,
+		}).Warn("⚠️ Managed block was modified by hand - removed it anyway")
+
 		return ProvisioningResult{
-			Success: false,
-			Error:   fmt.Sprintf("failed to append line to %s: %v", filePath, err),
+			Success: true,
+			Message: fmt.Sprintf("Content removed from %s successfully, but it had been modified outside the agent (checksum mismatch)", filePath),
+			Status:  "tampered",
 		}
 	}
 
 	return ProvisioningResult{
 		Success: true,
-		Message: fmt.Sprintf("Line added to %s successfully", filePath),
+		Message: fmt.Sprintf("Content removed from %s successfully", filePath),
 	}
 }
 
-func ExecuteScript(command string, data interface{}, dryRun bool, logger *logrus.Logger) ProvisioningResult {
+func executeScript(ctx context.Context, command string, data interface{}, dryRun bool, logger *logrus.Logger) ProvisioningResult {
 	dataBytes, err := json.Marshal(data)
 	if err != nil {
 		logger.WithError(err).Error("Failed to marshal script data")
@@ -183,6 +253,27 @@ func ExecuteScript(command string, data interface{}, dryRun bool, logger *logrus
 		}
 	}
 
+	if grant, ok := revokedInState(command, req, logger); ok {
+		logger.WithFields(logrus.Fields{
+			"command":    command,
+			"username":   grant.UserName,
+			"request_id": req.RequestID,
+			"revoked_at": grant.RevokedAt,
+		}).Info("⏭️ Grant already revoked, nothing to do")
+
+		req.UserName = grant.UserName
+		result := ProvisioningResult{
+			Success: true,
+			Message: fmt.Sprintf("%s for user %s was already revoked", command, grant.UserName),
+			Status:  "noop",
+		}
+		metrics.NoopRevokes.Inc(MetricsLabel(command))
+		recordAudit(command, req, dryRun, result, logger)
+		return result
+	}
+
+	req = completeFromState(command, req, logger)
+
 	logger.WithFields(logrus.Fields{
 		"command":    command,
 		"username":   req.UserName,
@@ -199,24 +290,58 @@ func ExecuteScript(command string, data interface{}, dryRun bool, logger *logrus
 			"username": req.UserName,
 			"action":   req.Action,
 		}).Info("🔍 DRY-RUN: Would execute provisioning script (no actual changes made)")
-		
-		return ProvisioningResult{
+
+		result := ProvisioningResult{
 			Success: true,
 			Message: fmt.Sprintf("DRY-RUN: Would execute %s for user %s", command, req.UserName),
 		}
+		recordAudit(command, req, dryRun, result, logger)
+		return result
+	}
+
+	// Listed before the grant, so no session it let in is among them
+	var sessions grantSessions
+	if req.Action == "grant" && loginCommands[command] {
+		sessions.prior, sessions.recorded = priorSessions(ctx, req.UserName)
 	}
 
+	start := time.Now()
+	result := withSessionRecording(ctx, command, req, logger, func() ProvisioningResult {
+		return runScript(ctx, command, req, logger)
+	})
+	metrics.ScriptDuration.Observe(time.Since(start).Seconds(), MetricsLabel(command))
+	recordAudit(command, req, dryRun, result, logger)
+	recordState(command, req, result, sessions, logger)
+	return result
+}
+
+// inFlight counts provisioning scripts that are currently executing,
+// including ones that timed out but have not returned yet
+var inFlight atomic.Int32
+
+// InFlight returns the number of provisioning scripts currently executing
+func InFlight() int {
+	return int(inFlight.Load())
+}
+
+func runScript(ctx context.Context, command string, req ProvisioningRequest, logger *logrus.Logger) ProvisioningResult {
 	switch Command(command) {
 	case CommandProvisionUser:
-		return ProvisionUser(req, logger)
+		return ProvisionUser(ctx, req, logger)
 	case CommandProvisionAuthorizedKeys:
-		return ProvisionAuthorizedKeys(req, logger)
+		return ProvisionAuthorizedKeys(ctx, req, logger)
 	case CommandProvisionCAKeys:
-		return ProvisionCAKeys(req, logger)
+		return ProvisionCAKeys(ctx, req, logger)
 	case CommandProvisionSudo:
-		return ProvisionSudo(req, logger)
+		return ProvisionSudo(ctx, req, logger)
 	case CommandProvisionSession:
-		return ProvisionSession(req, logger)
+		return ProvisionSession(ctx, req, logger)
+	case CommandProvisionBanner:
+		return ProvisionBanner(ctx, req, logger)
+	case CommandProvisionPortForward:
+		return ProvisionPortForward(ctx, req, logger)
+	case CommandProvisionCertificate:
+		return ProvisionCertificate(ctx, req, logger)
 	default:
 		logger.WithField("command", command).Error("Unknown provisioning command")
 		return ProvisioningResult{
@@ -224,4 +349,4 @@ func ExecuteScript(command string, data interface{}, dryRun bool, logger *logrus
 			Error:   fmt.Sprintf("unknown command: %s", command),
 		}
 	}
-}
\ No newline at end of file
+}
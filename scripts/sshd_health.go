@@ -0,0 +1,181 @@
+package scripts
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/types"
+)
+
+// defaultSSHPort is assumed when sshd_config cannot be read
+const defaultSSHPort = 22
+
+// CheckSSHD reports whether sshd could accept logins right now: it is
+// running, something listens on its ports and sshd -T accepts the
+// configuration it would load on the next restart or reload
+func CheckSSHD(ctx context.Context, logger *logrus.Logger) types.SSHDHealth {
+	health := types.SSHDHealth{CheckedAt: time.Now().UTC().Format(time.RFC3339)}
+
+	ports, err := sshdPorts(ctx)
+	if err != nil {
+		logger.WithError(err).Debug("Failed to check the sshd configuration")
+		health.Problems = append(health.Problems, err.Error())
+	} else {
+		health.ConfigValid = true
+	}
+	if len(ports) == 0 {
+		ports = []int{defaultSSHPort}
+	}
+	health.Ports = ports
+
+	health.Running = sshdRunning(ctx)
+	if !health.Running {
+		health.Problems = append(health.Problems, "sshd is not running")
+	}
+
+	health.Listening = true
+	for _, port := range ports {
+		if !portListening(port) {
+			health.Listening = false
+			health.Problems = append(health.Problems, fmt.Sprintf("nothing is listening on port %d", port))
+		}
+	}
+
+	health.Healthy = health.Running && health.Listening && health.ConfigValid
+	return health
+}
+
+// sshdPorts returns the ports of the effective sshd configuration: those of
+// its ListenAddress entries, which sshd -T prints as host:port, or of Port
+// when ListenAddress is not set. sshd -T fails on a configuration sshd would
+// refuse to load, and the error carries its first complaint.
+func sshdPorts(ctx context.Context) ([]int, error) {
+	output, err := outputOf(privileged(quiet(ctx), "sshd", "-T"))
+	if err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return nil, fmt.Errorf("failed to run sshd -T: %w", err)
+		}
+		if lines := strings.SplitN(strings.TrimSpace(string(exitErr.Stderr)), "\n", 2); lines[0] != "" {
+			return nil, fmt.Errorf("sshd configuration is invalid: %s", lines[0])
+		}
+		return nil, fmt.Errorf("sshd configuration is invalid: %w", err)
+	}
+
+	var ports, listenPorts []int
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "port":
+			if port, err := strconv.Atoi(fields[1]); err == nil {
+				ports = appendPort(ports, port)
+			}
+		case "listenaddress":
+			// An rdomain may follow the address
+			if _, value, err := net.SplitHostPort(fields[1]); err == nil {
+				if port, err := strconv.Atoi(value); err == nil {
+					listenPorts = appendPort(listenPorts, port)
+				}
+			}
+		}
+	}
+	if len(listenPorts) > 0 {
+		return listenPorts, nil
+	}
+	return ports, nil
+}
+
+// appendPort adds port to ports unless it is there already
+func appendPort(ports []int, port int) []int {
+	for _, existing := range ports {
+		if existing == port {
+			return ports
+		}
+	}
+	return append(ports, port)
+}
+
+// sshdRunning reports whether the sshd listener runs, or systemd listens for
+// it on distributions that start sshd per connection through ssh.socket
+func sshdRunning(ctx context.Context) bool {
+	if command(quiet(ctx), "pgrep", "-x", "sshd").Run() == nil {
+		return true
+	}
+	if !commandExists("systemctl") {
+		return false
+	}
+	for _, unit := range []string{"ssh.socket", "sshd.socket"} {
+		if command(ctx, "systemctl", "is-active", "--quiet", unit).Run() == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// portListening reports whether a TCP socket listens on port. Linux lists
+// listening sockets in /proc, which avoids connecting to sshd and leaving a
+// line in its log on every heartbeat; elsewhere it connects to localhost.
+func portListening(port int) bool {
+	listening, err := procListening(port)
+	if err == nil {
+		return listening
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("localhost", strconv.Itoa(port)), 2*time.Second)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// procListening looks for port in the LISTEN state in /proc/net/tcp and, when
+// IPv6 is enabled, /proc/net/tcp6
+func procListening(port int) (bool, error) {
+	for _, path := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		file, err := os.Open(path)
+		if os.IsNotExist(err) && path == "/proc/net/tcp6" {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+
+		listening := false
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			// sl local_address rem_address st ...; 0A is TCP_LISTEN
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 4 || fields[3] != "0A" {
+				continue
+			}
+			_, hexPort, ok := strings.Cut(fields[1], ":")
+			if !ok {
+				continue
+			}
+			if value, err := strconv.ParseUint(hexPort, 16, 16); err == nil && int(value) == port {
+				listening = true
+				break
+			}
+		}
+		file.Close()
+
+		if listening {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,185 @@
+package scripts
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/internal/state"
+	"p0-ssh-agent/internal/timewindow"
+	"p0-ssh-agent/types"
+)
+
+var (
+	stateMu   sync.RWMutex
+	statePath = state.Path(types.DefaultStateDir)
+)
+
+// SetStatePath sets where applied grants are recorded.
+// reconcile and revoke read the grants back from the same file.
+func SetStatePath(path string) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	statePath = path
+}
+
+func currentStatePath() string {
+	stateMu.RLock()
+	defer stateMu.RUnlock()
+	return statePath
+}
+
+// isTrackedCommand reports whether a command leaves something behind that
+// reconcile can check. provisionSession only ever terminates processes and
+// bulkRevoke and stageGrants items are recorded under their own commands.
+func isTrackedCommand(command string) bool {
+	switch Command(command) {
+	case CommandProvisionSession, CommandBulkRevoke, CommandStageGrants:
+		return false
+	}
+	return knownCommands[Command(command)]
+}
+
+// grantSessions are the user's logind sessions listed before a login grant
+type grantSessions struct {
+	prior    []string
+	recorded bool
+}
+
+// recordState stores the outcome of a successful grant or revoke in the
+// provisioning state. Failing to record is logged but does not fail the action.
+func recordState(command string, req ProvisioningRequest, result ProvisioningResult, sessions grantSessions, logger *logrus.Logger) {
+	if !result.Success || !isTrackedCommand(command) {
+		return
+	}
+
+	status := state.StatusGranted
+	if req.Action == "revoke" {
+		status = state.StatusRevoked
+	} else if req.Action != "grant" {
+		return
+	}
+
+	stored := req
+	stored.Origin = nil
+	data, err := json.Marshal(stored)
+	if err != nil {
+		logger.WithError(err).Error("Failed to encode request for provisioning state")
+		return
+	}
+
+	grant := state.Grant{
+		RequestID: req.RequestID,
+		Command:   command,
+		UserName:  req.UserName,
+		Status:    status,
+		Request:   data,
+	}
+	grant.ExpiresAt = requestExpiry(command, req)
+	if status == state.StatusGranted {
+		grant.Files = result.files
+		grant.PriorSessions, grant.SessionsRecorded = sessions.prior, sessions.recorded
+	}
+
+	path := currentStatePath()
+	if err := state.Put(path, grant); err != nil {
+		logger.WithError(err).WithField("state", path).Error("🚨 Failed to record provisioning state")
+	}
+}
+
+// requestExpiry is the earliest of validTo and expiresAt, and sudoExpiresAt
+// for provisionSudo, in any format the scheduler accepts; zero when none is
+// set or parses
+func requestExpiry(command string, req ProvisioningRequest) time.Time {
+	values := map[string]string{"validTo": req.ValidTo, "expiresAt": req.ExpiresAt}
+	if Command(command) == CommandProvisionSudo {
+		values["sudoExpiresAt"] = req.SudoExpiresAt
+	}
+
+	var expiry time.Time
+	for field, value := range values {
+		t, err := timewindow.ParseTime(field, value, req.TimeZone)
+		if err != nil || t.IsZero() {
+			continue
+		}
+		if expiry.IsZero() || t.Before(expiry) {
+			expiry = t.UTC()
+		}
+	}
+	return expiry
+}
+
+// revokedInState reports whether the provisioning state already records the
+// revoke as applied, so repeating it would only rescan files and look up users
+// to change nothing. Forced revokes always run; unreadable state is treated as
+// unknown.
+func revokedInState(command string, req ProvisioningRequest, logger *logrus.Logger) (state.Grant, bool) {
+	if req.Action != "revoke" || req.Force || req.RequestID == "" || !isTrackedCommand(command) {
+		return state.Grant{}, false
+	}
+
+	grant, ok, err := state.Get(currentStatePath(), req.RequestID, command)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to read provisioning state, running revoke")
+		return state.Grant{}, false
+	}
+	if !ok || grant.Status != state.StatusRevoked {
+		return state.Grant{}, false
+	}
+	if req.UserName != "" && req.UserName != grant.UserName {
+		return state.Grant{}, false
+	}
+	return grant, true
+}
+
+// completeFromState fills fields a revoke left out from the grant recorded
+// for the same request, so a revoke that only names the request still finds
+// the user and files the grant touched
+func completeFromState(command string, req ProvisioningRequest, logger *logrus.Logger) ProvisioningRequest {
+	if req.Action != "revoke" || !isTrackedCommand(command) {
+		return req
+	}
+
+	grant, ok, err := state.Get(currentStatePath(), req.RequestID, command)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to read provisioning state, revoking with the request as sent")
+		return req
+	}
+	if !ok {
+		return req
+	}
+
+	var granted ProvisioningRequest
+	if err := json.Unmarshal(grant.Request, &granted); err != nil {
+		logger.WithError(err).WithField("key", grant.Key).Warn("Recorded grant is unreadable, revoking with the request as sent")
+		return req
+	}
+
+	if req.UserName == "" {
+		req.UserName = granted.UserName
+	} else if req.UserName != granted.UserName {
+		logger.WithFields(logrus.Fields{
+			"request_id": req.RequestID,
+			"username":   req.UserName,
+			"granted_to": granted.UserName,
+		}).Warn("⚠️ Revoke names a different user than the recorded grant")
+	}
+	if req.PublicKey == "" {
+		req.PublicKey = granted.PublicKey
+	}
+	if req.CAPublicKey == "" {
+		req.CAPublicKey = granted.CAPublicKey
+	}
+	if len(req.Principals) == 0 {
+		req.Principals = granted.Principals
+	}
+	if req.Certificate == "" {
+		req.Certificate = granted.Certificate
+	}
+	if req.UserName == granted.UserName {
+		req.grantedFiles = grant.Files
+	}
+	return req
+}
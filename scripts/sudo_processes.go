@@ -0,0 +1,107 @@
+package scripts
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/internal/state"
+)
+
+// endSudoProcesses terminates what the user runs through sudo: every sudo
+// process the user started and everything below it. Removing the rule only
+// stops new sudo commands, so without this a root shell opened before the
+// grant expired would outlive it. The user's other processes are left alone,
+// as their SSH access may continue. Nothing is done while the user holds
+// another sudo grant.
+func endSudoProcesses(ctx context.Context, username, requestID string, logger *logrus.Logger) {
+	if hasOtherSudoGrant(username, requestID) {
+		logger.WithField("username", username).Debug("User holds another sudo grant, keeping processes run through sudo")
+		return
+	}
+
+	userInfo, err := lookupUser(username)
+	if err != nil {
+		return
+	}
+
+	pids, err := sudoProcessTree(ctx, userInfo.Uid)
+	if err != nil {
+		logger.WithError(err).WithField("username", username).Warn("⚠️ Could not list processes run through sudo")
+		return
+	}
+	if len(pids) == 0 {
+		return
+	}
+
+	logger.WithFields(logrus.Fields{
+		"username": username,
+		"pids":     strings.Join(pids, ","),
+	}).Info("🎯 Terminating processes run through sudo")
+
+	// Interactive root shells ignore SIGTERM
+	if err := privileged(ctx, "kill", append([]string{"-TERM"}, pids...)...).Run(); err == nil {
+		time.Sleep(2 * time.Second)
+	}
+	if remaining, err := sudoProcessTree(ctx, userInfo.Uid); err == nil && len(remaining) > 0 {
+		privileged(ctx, "kill", append([]string{"-KILL"}, remaining...)...).Run()
+	}
+}
+
+// sudoProcessTree returns the PIDs of the sudo processes whose real user is
+// uid, the user who invoked them, and of all their descendants
+func sudoProcessTree(ctx context.Context, uid string) ([]string, error) {
+	output, err := outputOf(command(quiet(ctx), "ps", "-A", "-o", "pid=,ppid=,ruid=,comm="))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list processes: %w", err)
+	}
+
+	children := make(map[string][]string)
+	var queue []string
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			continue
+		}
+		pid, ppid, ruid, name := fields[0], fields[1], fields[2], strings.Join(fields[3:], " ")
+		children[ppid] = append(children[ppid], pid)
+		if ruid == uid && (name == "sudo" || strings.HasSuffix(name, "/sudo")) {
+			queue = append(queue, pid)
+		}
+	}
+
+	var pids []string
+	seen := make(map[string]bool)
+	for len(queue) > 0 {
+		pid := queue[0]
+		queue = queue[1:]
+		if seen[pid] {
+			continue
+		}
+		seen[pid] = true
+		pids = append(pids, pid)
+		queue = append(queue, children[pid]...)
+	}
+	return pids, nil
+}
+
+// hasOtherSudoGrant reports whether username holds an unexpired sudo grant
+// from a request other than requestID
+func hasOtherSudoGrant(username, requestID string) bool {
+	grants, err := state.Load(currentStatePath())
+	if err != nil {
+		return false
+	}
+
+	now := time.Now()
+	for _, grant := range grants {
+		if grant.UserName == username && grant.RequestID != requestID && Command(grant.Command) == CommandProvisionSudo &&
+			grant.Status == state.StatusGranted && !grant.Expired(now) {
+			return true
+		}
+	}
+	return false
+}
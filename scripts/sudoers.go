@@ -0,0 +1,260 @@
+package scripts
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/internal/osplugins"
+	"p0-ssh-agent/types"
+)
+
+// Sudoers files the agent edits, in the sudoers directory of the OS plugin:
+// /etc, or /usr/local/etc on FreeBSD. A syntax error in any of them locks
+// every user out of sudo, so they are only ever replaced by a copy visudo
+// accepted.
+const (
+	// sudoersIncludeTarget is how sudoers refers to sudoersIncludePath
+	sudoersIncludeTarget = "sudoers-p0"
+
+	sudoersDropInPrefix = "p0-"
+)
+
+func sudoersPath() string {
+	return filepath.Join(osplugins.SudoersDir(), "sudoers")
+}
+
+func sudoersIncludePath() string {
+	return filepath.Join(osplugins.SudoersDir(), sudoersIncludeTarget)
+}
+
+func sudoersDropInDir() string {
+	return filepath.Join(osplugins.SudoersDir(), "sudoers.d")
+}
+
+var (
+	sudoersLayoutMu sync.RWMutex
+	sudoersLayout   = types.SudoersLayoutFile
+)
+
+// SetSudoersLayout sets where sudo grants are written. The agent sets it from
+// sudoersLayout; revokes look in both places whatever the layout.
+func SetSudoersLayout(layout string) {
+	sudoersLayoutMu.Lock()
+	defer sudoersLayoutMu.Unlock()
+	sudoersLayout = layout
+}
+
+func currentSudoersLayout() string {
+	sudoersLayoutMu.RLock()
+	defer sudoersLayoutMu.RUnlock()
+	return sudoersLayout
+}
+
+// sudoersDropInIDPattern matches the request IDs that can name a drop-in.
+// sudo skips files in an included directory whose name contains a dot, and
+// mapping dots to another character would give two requests the same file.
+var sudoersDropInIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+
+// sudoersDropInPath returns the drop-in of requestID. ok is false when the
+// request ID cannot name one, so the request has no drop-in.
+func sudoersDropInPath(requestID string) (path string, ok bool) {
+	if !sudoersDropInIDPattern.MatchString(requestID) {
+		return "", false
+	}
+	return hostPath(filepath.Join(sudoersDropInDir(), sudoersDropInPrefix+requestID)), true
+}
+
+func isSudoersFile(filePath string) bool {
+	if filePath == hostPath(sudoersPath()) || filePath == hostPath(sudoersIncludePath()) {
+		return true
+	}
+	return filepath.Dir(filePath) == hostPath(sudoersDropInDir()) && strings.HasPrefix(filepath.Base(filePath), sudoersDropInPrefix)
+}
+
+var sudoVersionPattern = regexp.MustCompile(`version (\d+)\.(\d+)\.(\d+)`)
+
+// includePrefix returns the prefix of include directives the installed sudo
+// expects: "@" from sudo 1.9.1, which deprecates "#include" as it reads like
+// a comment, and "#" for older releases or when the version is unknown
+func includePrefix(ctx context.Context) string {
+	output, err := outputOf(command(quiet(ctx), "visudo", "--version"))
+	if err != nil {
+		return "#"
+	}
+	match := sudoVersionPattern.FindStringSubmatch(string(output))
+	if match == nil {
+		return "#"
+	}
+
+	version := make([]int, 3)
+	for i := range version {
+		version[i], _ = strconv.Atoi(match[i+1])
+	}
+	if version[0] > 1 || (version[0] == 1 && (version[1] > 9 || (version[1] == 9 && version[2] >= 1))) {
+		return "@"
+	}
+	return "#"
+}
+
+// ensureSudoersInclude makes /etc/sudoers read target with an include or
+// includedir directive. An existing directive in either form is kept, except
+// the agent's own "#include sudoers-p0", which is rewritten as "@include"
+// once sudo supports it.
+func ensureSudoersInclude(ctx context.Context, directive, target string, logger *logrus.Logger) ProvisioningResult {
+	mainFile := hostPath(sudoersPath())
+	preferred := includePrefix(ctx) + directive + " " + target
+
+	unlock, err := lockManagedFile(mainFile)
+	if err != nil {
+		return ProvisioningResult{
+			Success: false,
+			Error:   err.Error(),
+		}
+	}
+	defer unlock()
+
+	file, err := openManagedFile(ctx, mainFile, 0440)
+	if err != nil {
+		return ProvisioningResult{
+			Success: false,
+			Error:   err.Error(),
+		}
+	}
+
+	for i, line := range file.lines {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || strings.TrimRight(fields[1], "/") != strings.TrimRight(target, "/") {
+			continue
+		}
+		if fields[0] != "#"+directive && fields[0] != "@"+directive {
+			continue
+		}
+		if line == preferred || target != sudoersIncludeTarget || !strings.HasPrefix(preferred, "@") {
+			return ProvisioningResult{
+				Success: true,
+				Message: "Line already exists in file",
+			}
+		}
+
+		logger.WithField("file", mainFile).Info("🔧 Replacing deprecated #include with @include")
+		file.setLine(i, preferred)
+		if err := file.save(ctx, logger); err != nil {
+			return ProvisioningResult{
+				Success: false,
+				Error:   err.Error(),
+			}
+		}
+		return ProvisioningResult{
+			Success: true,
+			Message: fmt.Sprintf("Include directive in %s updated successfully", mainFile),
+		}
+	}
+
+	file.addLine(preferred)
+	if err := file.save(ctx, logger); err != nil {
+		return ProvisioningResult{
+			Success: false,
+			Error:   err.Error(),
+		}
+	}
+	return ProvisioningResult{
+		Success: true,
+		Message: fmt.Sprintf("Line added to %s successfully", mainFile),
+	}
+}
+
+// writeSudoers replaces a sudoers file with content. The content is written
+// next to it, flushed to disk, checked with visudo -cf and renamed over the
+// file, so sudo never reads a partial or invalid file. For a grant the
+// previous file is kept until the complete sudoers configuration checks out
+// and is restored if it does not, unless it failed the same check before the
+// change. A removal is never held back or rolled back, since that would keep
+// access in place; visudo's objections are only logged. Without visudo on
+// the host the change is installed unchecked.
+func writeSudoers(ctx context.Context, filePath, content string, removal bool, logger *logrus.Logger) error {
+	candidate := filePath + ".p0-new"
+	previous := filePath + ".p0-prev"
+	validate := commandExists("visudo")
+
+	fs := files(ctx)
+	if err := fs.WriteFile(candidate, []byte(content)); err != nil {
+		return fmt.Errorf("failed to write %s: %w", candidate, err)
+	}
+	if err := fs.Chmod(candidate, 0440); err != nil {
+		fs.Remove(candidate)
+		return fmt.Errorf("failed to set permissions on %s: %w", candidate, err)
+	}
+	if err := fs.Chown(candidate, 0, 0); err != nil {
+		fs.Remove(candidate)
+		return fmt.Errorf("failed to set ownership on %s: %w", candidate, err)
+	}
+	if err := fs.Sync(candidate); err != nil {
+		fs.Remove(candidate)
+		return fmt.Errorf("failed to flush %s: %w", candidate, err)
+	}
+
+	if validate {
+		if output, err := combinedOutputOf(privileged(ctx, "visudo", "-cf", candidate)); err != nil {
+			if !removal {
+				fs.Remove(candidate)
+				return fmt.Errorf("sudoers change rejected by visudo: %s", strings.TrimSpace(string(output)))
+			}
+			logger.WithFields(logrus.Fields{
+				"file":   filePath,
+				"output": strings.TrimSpace(string(output)),
+			}).Warn("⚠️ visudo rejects the sudoers file without the removed lines - removing them anyway")
+		}
+	}
+
+	// The include is only valid if the sudoers file that includes it is too.
+	// A main file that was already invalid is not this change's doing.
+	mainFile := hostPath(sudoersPath())
+	checkMain := validate && !removal && fileExists(mainFile)
+	if checkMain {
+		_, err := combinedOutputOf(privileged(ctx, "visudo", "-cf", mainFile))
+		checkMain = err == nil
+	}
+
+	hadPrevious := fileExists(filePath)
+	if hadPrevious && checkMain {
+		if err := fs.Copy(filePath, previous); err != nil {
+			fs.Remove(candidate)
+			return fmt.Errorf("failed to keep previous %s: %w", filePath, err)
+		}
+	}
+
+	if err := fs.Rename(candidate, filePath); err != nil {
+		fs.Remove(candidate)
+		fs.Remove(previous)
+		return fmt.Errorf("failed to replace %s: %w", filePath, err)
+	}
+
+	if checkMain {
+		if output, err := combinedOutputOf(privileged(ctx, "visudo", "-cf", mainFile)); err != nil {
+			if rollbackErr := rollbackSudoers(ctx, filePath, previous, hadPrevious); rollbackErr != nil {
+				return fmt.Errorf("sudoers rejected by visudo after changing %s (%s) and rollback failed: %w", filePath, strings.TrimSpace(string(output)), rollbackErr)
+			}
+			return fmt.Errorf("sudoers rejected by visudo after changing %s, previous file restored: %s", filePath, strings.TrimSpace(string(output)))
+		}
+		if hadPrevious {
+			fs.Remove(previous)
+		}
+	}
+	return nil
+}
+
+// rollbackSudoers puts back the file writeSudoers replaced, or removes the
+// file it created
+func rollbackSudoers(ctx context.Context, filePath, previous string, hadPrevious bool) error {
+	if hadPrevious {
+		return files(ctx).Rename(previous, filePath)
+	}
+	return files(ctx).Remove(filePath)
+}
@@ -0,0 +1,197 @@
+package scripts_test
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/internal/harness"
+	"p0-ssh-agent/scripts"
+	"p0-ssh-agent/types"
+)
+
+func TestProvisionSudo(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "freebsd" {
+		t.Skip("sudoers live in /etc on Linux only")
+	}
+
+	// visudo only has to be found on PATH; the executor answers it
+	bin := t.TempDir()
+	if err := os.WriteFile(filepath.Join(bin, "visudo"), []byte("#!/bin/sh\nexit 0\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	const otherRule = "bob ALL=(ALL) ALL\n"
+	const mainSudoers = "root ALL=(ALL) ALL\n#include sudoers-p0\n"
+
+	tests := []struct {
+		name     string
+		layout   string
+		existing map[string]string
+		// granted is revoked by the test, after a grant made without rules
+		granted bool
+		// rules script visudo, given the sandbox's /etc/sudoers
+		rules       func(e *harness.Executor, mainFile string)
+		wantSuccess bool
+		// wantLines must each be a line of the file
+		wantLines map[string][]string
+		// wantContent is the exact content of the file, "" when it must not exist
+		wantContent map[string]string
+	}{
+		{
+			name:        "grant writes the rule and the include",
+			wantSuccess: true,
+			wantLines: map[string][]string{
+				"/etc/sudoers-p0": {"# BEGIN P0 RequestID: req-1", "alice ALL=(ALL) NOPASSWD: ALL"},
+				"/etc/sudoers":    {"#include sudoers-p0"},
+			},
+		},
+		{
+			name:        "grant keeps other rules and an existing include",
+			existing:    map[string]string{"/etc/sudoers-p0": otherRule, "/etc/sudoers": mainSudoers},
+			wantSuccess: true,
+			wantLines: map[string][]string{
+				"/etc/sudoers-p0": {"bob ALL=(ALL) ALL", "alice ALL=(ALL) NOPASSWD: ALL"},
+			},
+			wantContent: map[string]string{"/etc/sudoers": mainSudoers},
+		},
+		{
+			name:     "rule rejected by visudo is never written",
+			existing: map[string]string{"/etc/sudoers-p0": otherRule, "/etc/sudoers": mainSudoers},
+			rules: func(e *harness.Executor, mainFile string) {
+				e.On("visudo", "-cf").Exit(1).Output("syntax error")
+			},
+			wantContent: map[string]string{"/etc/sudoers-p0": otherRule, "/etc/sudoers": mainSudoers},
+		},
+		{
+			name:     "previous file restored when sudoers rejects the change",
+			existing: map[string]string{"/etc/sudoers-p0": otherRule, "/etc/sudoers": mainSudoers},
+			rules: func(e *harness.Executor, mainFile string) {
+				e.On("visudo", "-cf", mainFile).Exit(1)
+				// The check before the change passes, so the change is to blame
+				e.On("visudo", "-cf", mainFile).Times(1)
+			},
+			wantContent: map[string]string{"/etc/sudoers-p0": otherRule, "/etc/sudoers": mainSudoers},
+		},
+		{
+			name:     "new file removed when sudoers rejects the change",
+			existing: map[string]string{"/etc/sudoers": mainSudoers},
+			rules: func(e *harness.Executor, mainFile string) {
+				e.On("visudo", "-cf", mainFile).Exit(1)
+				e.On("visudo", "-cf", mainFile).Times(1)
+			},
+			wantContent: map[string]string{"/etc/sudoers-p0": "", "/etc/sudoers": mainSudoers},
+		},
+		{
+			name:     "revoke removes the rule even when visudo objects",
+			existing: map[string]string{"/etc/sudoers-p0": otherRule, "/etc/sudoers": mainSudoers},
+			granted:  true,
+			rules: func(e *harness.Executor, mainFile string) {
+				e.On("visudo", "-cf").Exit(1)
+			},
+			wantSuccess: true,
+			wantContent: map[string]string{"/etc/sudoers-p0": otherRule},
+		},
+		{
+			name:        "drop-in layout writes a file per request",
+			layout:      types.SudoersLayoutDropIn,
+			wantSuccess: true,
+			wantLines: map[string][]string{
+				"/etc/sudoers.d/p0-req-1": {"# BEGIN P0 RequestID: req-1", "alice ALL=(ALL) NOPASSWD: ALL"},
+				"/etc/sudoers":            {"#includedir /etc/sudoers.d"},
+			},
+		},
+		{
+			name:        "drop-in revoke removes the file",
+			layout:      types.SudoersLayoutDropIn,
+			granted:     true,
+			wantSuccess: true,
+			wantContent: map[string]string{"/etc/sudoers.d/p0-req-1": ""},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sandbox, err := harness.NewSandbox(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sandbox.Close()
+
+			layout := tt.layout
+			if layout == "" {
+				layout = types.SudoersLayoutFile
+			}
+			scripts.SetSudoersLayout(layout)
+			defer scripts.SetSudoersLayout(types.SudoersLayoutFile)
+
+			for path, content := range tt.existing {
+				if err := os.WriteFile(sandbox.Path(path), []byte(content), 0440); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			logger := logrus.New()
+			logger.SetOutput(io.Discard)
+			req := scripts.ProvisioningRequest{UserName: "alice", RequestID: "req-1", Action: "grant", Sudo: true}
+
+			if tt.granted {
+				if result := scripts.ExecuteScript(string(scripts.CommandProvisionSudo), req, false, logger); !result.Success {
+					t.Fatalf("grant before revoke failed: %s", result.Error)
+				}
+				req.Action = "revoke"
+			}
+			if tt.rules != nil {
+				tt.rules(sandbox.Executor, sandbox.Path("/etc/sudoers"))
+			}
+
+			result := scripts.ExecuteScript(string(scripts.CommandProvisionSudo), req, false, logger)
+			if result.Success != tt.wantSuccess {
+				t.Fatalf("success %v, want %v (error %q)", result.Success, tt.wantSuccess, result.Error)
+			}
+
+			for path, lines := range tt.wantLines {
+				content, err := sandbox.ReadFile(path)
+				if err != nil {
+					t.Fatalf("%s: %v", path, err)
+				}
+				have := strings.Split(content, "\n")
+				for _, line := range lines {
+					if !contains(have, line) {
+						t.Errorf("%s has no line %q:\n%s", path, line, content)
+					}
+				}
+			}
+			for path, want := range tt.wantContent {
+				content, err := sandbox.ReadFile(path)
+				if want == "" {
+					if err == nil {
+						t.Errorf("%s exists:\n%s", path, content)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("%s: %v", path, err)
+				}
+				if content != want {
+					t.Errorf("%s\n got %q\nwant %q", path, content, want)
+				}
+			}
+		})
+	}
+}
+
+func contains(lines []string, line string) bool {
+	for _, have := range lines {
+		if have == line {
+			return true
+		}
+	}
+	return false
+}
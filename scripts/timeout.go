@@ -0,0 +1,184 @@
+package scripts
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"p0-ssh-agent/internal/elevate"
+	"p0-ssh-agent/internal/metrics"
+	"p0-ssh-agent/types"
+)
+
+// StatusTimeout is the result status of a provisioning command that did not
+// finish before its deadline
+const StatusTimeout = "timeout"
+
+// timeoutGrace is how long a timed-out command has to return once its
+// processes were told to exit, e.g. to record its audit entry
+const timeoutGrace = 10 * time.Second
+
+var (
+	scriptLimitsMu sync.RWMutex
+	scriptLimits   types.ScriptLimits
+)
+
+// SetScriptLimits sets the limits of provisioning commands and the processes
+// they start. The agent sets it from scriptLimits; nothing changes when the
+// limits cannot be applied on this host.
+func SetScriptLimits(limits types.ScriptLimits) error {
+	for name := range limits.CommandTimeoutSeconds {
+		if !isKnownCommandName(name) {
+			return fmt.Errorf("scriptLimits: commandTimeoutSeconds has unknown command %q", name)
+		}
+	}
+	if err := elevate.SetLimits(elevate.Limits{
+		Nice:           limits.Nice,
+		Cgroup:         limits.Cgroup,
+		MaxOutputBytes: limits.GetMaxOutputBytes(),
+	}); err != nil {
+		return fmt.Errorf("scriptLimits: %w", err)
+	}
+
+	scriptLimitsMu.Lock()
+	defer scriptLimitsMu.Unlock()
+	scriptLimits = limits
+	return nil
+}
+
+// isKnownCommandName reports whether name is a provisioning command, in any
+// case, as viper lowercases map keys
+func isKnownCommandName(name string) bool {
+	for command := range knownCommands {
+		if strings.EqualFold(string(command), name) {
+			return true
+		}
+	}
+	return false
+}
+
+func currentScriptLimits() types.ScriptLimits {
+	scriptLimitsMu.RLock()
+	defer scriptLimitsMu.RUnlock()
+	return scriptLimits
+}
+
+// ExecuteScript runs a provisioning command within the timeout scriptLimits
+// sets for it
+func ExecuteScript(command string, data interface{}, dryRun bool, logger *logrus.Logger) ProvisioningResult {
+	return ExecuteScriptContext(context.Background(), command, data, dryRun, logger)
+}
+
+type lateResultKey struct{}
+
+// WithLateResult returns a copy of ctx for ExecuteScriptContext that has
+// report called with the result of a command that was answered with
+// StatusTimeout before it finished
+func WithLateResult(ctx context.Context, report func(ProvisioningResult)) context.Context {
+	return context.WithValue(ctx, lateResultKey{}, report)
+}
+
+// ExecuteScriptContext runs a provisioning command until ctx is done or its
+// timeout passes, whichever comes first. The processes the command started
+// are then terminated, and only those, so a hung useradd cannot hold up the
+// agent. Revokes are exempt and always run to completion: one stopped
+// halfway would leave access in place.
+//
+// A timed-out command has timeoutGrace to return; its result is then
+// answered with StatusTimeout unless it succeeded after all. One still
+// running, e.g. blocked in an NSS lookup inside the agent, is left to finish
+// on its own and counts as in flight until it does. It records its outcome
+// in the provisioning state as usual and hands it to the WithLateResult
+// report of ctx.
+func ExecuteScriptContext(ctx context.Context, command string, data interface{}, dryRun bool, logger *logrus.Logger) ProvisioningResult {
+	if requestAction(data) == "revoke" {
+		ctx = context.WithoutCancel(ctx)
+	} else if timeout := currentScriptLimits().GetTimeout(command); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	inFlight.Add(1)
+	if ctx.Done() == nil {
+		defer inFlight.Add(-1)
+		return executeScript(ctx, command, data, dryRun, logger)
+	}
+
+	done := make(chan ProvisioningResult, 1)
+	start := time.Now()
+	go func() {
+		defer inFlight.Add(-1)
+		done <- executeScript(ctx, command, data, dryRun, logger)
+	}()
+
+	select {
+	case result := <-done:
+		return result
+	case <-ctx.Done():
+	}
+
+	select {
+	case result := <-done:
+		// Finished as the deadline passed
+		return result
+	default:
+	}
+
+	elapsed := time.Since(start).Round(time.Millisecond)
+	metrics.ProvisioningTimeouts.Inc(MetricsLabel(command))
+	logger.WithFields(logrus.Fields{
+		"command": command,
+		"elapsed": elapsed.String(),
+	}).Error("⏱️ Provisioning command timed out - terminating its processes")
+
+	result := ProvisioningResult{
+		Success: false,
+		Error:   fmt.Sprintf("%s did not finish within %s and was terminated", command, elapsed),
+		Status:  StatusTimeout,
+	}
+	select {
+	case scriptResult := <-done:
+		if scriptResult.Success {
+			return scriptResult
+		}
+		if scriptResult.Error != "" {
+			result.Error += ": " + scriptResult.Error
+		}
+		return result
+	case <-time.After(timeoutGrace):
+	}
+
+	logger.WithField("command", command).Warn("Timed-out provisioning command is still running, leaving it to finish")
+	report, _ := ctx.Value(lateResultKey{}).(func(ProvisioningResult))
+	go func() {
+		late := <-done
+		logger.WithFields(logrus.Fields{
+			"command": command,
+			"success": late.Success,
+			"error":   late.Error,
+		}).Warn("⏱️ Timed-out provisioning command finished")
+		if report != nil {
+			report(late)
+		}
+	}()
+	return result
+}
+
+// requestAction returns the action of the request in data, which may be a
+// ProvisioningRequest or its JSON form as received
+func requestAction(data interface{}) string {
+	if req, ok := data.(ProvisioningRequest); ok {
+		return req.Action
+	}
+	var req ProvisioningRequest
+	if dataBytes, err := json.Marshal(data); err == nil {
+		json.Unmarshal(dataBytes, &req)
+	}
+	return req.Action
+}
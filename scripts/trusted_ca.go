@@ -0,0 +1,268 @@
+package scripts
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// TrustedCAPath is the CA file sshd trusts user certificates of
+	TrustedCAPath       = "/etc/ssh/p0_trusted_ca.pub"
+	trustedCADropInPath = "/etc/ssh/sshd_config.d/p0-trusted-ca.conf"
+
+	// registrationCABlock is the managed block holding the CA received at
+	// registration, next to the blocks of certificate grants
+	registrationCABlock = "registration"
+)
+
+// trustedCAIncludeLine is added to sshd_config when the drop-in directory is not already included
+var trustedCAIncludeLine = "Include " + trustedCADropInPath
+
+// trustedCADropIn points sshd at the CA file written by InstallTrustedCA.
+// Without AuthorizedPrincipalsFile sshd would let a certificate log in as
+// any user it names; with it, only as a user whose principals file the
+// agent wrote when granting the account, see grantRegistrationPrincipal.
+var trustedCADropIn = fmt.Sprintf(`# Managed by p0-ssh-agent: trust the P0 CA
+TrustedUserCAKeys %s
+AuthorizedPrincipalsFile %s/%%u
+`, TrustedCAPath, authorizedPrincipalDir)
+
+// InstallTrustedCA makes sshd accept user certificates signed by the P0 CA
+// received at registration, for the users provisionUser granted. The CA is
+// written to /etc/ssh/p0_trusted_ca.pub and trusted through an sshd_config.d
+// drop-in, which is only kept when sshd -t accepts the result. sshd is
+// reloaded when the drop-in is new.
+func InstallTrustedCA(ctx context.Context, caKeys string, logger *logrus.Logger) error {
+	keys, err := parseTrustedCA(caKeys)
+	if err != nil {
+		return err
+	}
+
+	// sshd uses the first TrustedUserCAKeys it reads, so a CA file set by
+	// hand would silently win over ours
+	if values, source := sshdDirective(ctx, sshdConfigPath, "TrustedUserCAKeys", 0); len(values) > 0 {
+		value := strings.Join(values, " ")
+		if value != "none" && value != TrustedCAPath && value != trustedUserCAKeysPath {
+			return fmt.Errorf("sshd already sets TrustedUserCAKeys %s in %s; remove it or add the P0 CA to that file instead", value, source)
+		}
+	}
+	// The same goes for the principals file that restricts the CA to JIT users
+	if values, source := sshdDirective(ctx, sshdConfigPath, "AuthorizedPrincipalsFile", 0); len(values) > 0 {
+		value := strings.Join(values, " ")
+		if value != "none" && value != authorizedPrincipalDir+"/%u" {
+			return fmt.Errorf("sshd already sets AuthorizedPrincipalsFile %s in %s; remove it so the P0 CA can be restricted to JIT users", value, source)
+		}
+	}
+
+	existing, _ := os.ReadFile(hostPath(trustedCADropInPath))
+	dropInChanged := string(existing) != trustedCADropIn
+
+	// The CA file goes back to what it was if anything below fails
+	fs := files(ctx)
+	previousCA, previousCAErr := fs.ReadFile(hostPath(TrustedCAPath))
+	restoreCA := func() {
+		if previousCAErr == nil {
+			fs.WriteFile(hostPath(TrustedCAPath), previousCA)
+		} else {
+			fs.Remove(hostPath(TrustedCAPath))
+		}
+	}
+
+	// Certificate grants made before registration trusted their CAs in the
+	// previous file; their blocks move along so they keep working
+	if dropInChanged {
+		if err := moveCertificateCAs(ctx, logger); err != nil {
+			restoreCA()
+			return err
+		}
+	}
+
+	if res := ensureContentInFile(ctx, strings.Join(keys, "\n"), registrationCABlock, hostPath(TrustedCAPath), "644", "root", logger); !res.Success {
+		restoreCA()
+		return fmt.Errorf("failed to write %s: %s", TrustedCAPath, res.Error)
+	}
+
+	// sshd reads the CA file on every login, so only a new drop-in needs a reload
+	if !dropInChanged {
+		logger.WithField("file", TrustedCAPath).Debug("sshd already trusts the P0 CA file")
+		return nil
+	}
+
+	if err := writeTrustedCADropIn(ctx, logger); err != nil {
+		restoreCA()
+		return err
+	}
+
+	if err := reloadSSHD(ctx, logger); err != nil {
+		return err
+	}
+
+	logger.WithFields(logrus.Fields{
+		"file": TrustedCAPath,
+		"keys": len(keys),
+	}).Info("🔐 sshd now trusts the P0 CA")
+	return nil
+}
+
+// parseTrustedCA returns the CA public keys, one per line, refusing anything
+// sshd would not load as a CA
+func parseTrustedCA(caKeys string) ([]string, error) {
+	var keys []string
+	for _, line := range strings.Split(caKeys, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted CA: %w", err)
+		}
+		if _, ok := key.(*ssh.Certificate); ok {
+			return nil, fmt.Errorf("invalid trusted CA: a certificate cannot be a CA key")
+		}
+		keys = append(keys, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))))
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("trusted CA is empty")
+	}
+	return keys, nil
+}
+
+// moveCertificateCAs copies the blocks of certificate grants from the file the
+// certificate drop-in trusted to the registration CA file
+func moveCertificateCAs(ctx context.Context, logger *logrus.Logger) error {
+	previous, err := openManagedFile(ctx, hostPath(trustedUserCAKeysPath), 0644)
+	if err != nil || !previous.exists {
+		return err
+	}
+
+	for _, block := range parseBlocks(previous.lines) {
+		if block.Unterminated {
+			logger.WithFields(logrus.Fields{
+				"file":       previous.path,
+				"request_id": block.RequestID,
+			}).Warn("⚠️ CA block has no end marker, not moving it")
+			continue
+		}
+		if res := ensureContentInFile(ctx, strings.Join(block.Content, "\n"), block.RequestID, hostPath(TrustedCAPath), "644", "root", logger); !res.Success {
+			return fmt.Errorf("failed to move CA of request %s: %s", block.RequestID, res.Error)
+		}
+	}
+	return nil
+}
+
+// writeTrustedCADropIn installs the drop-in and rewrites the certificate
+// drop-in without its own TrustedUserCAKeys. sshd_config, where an Include
+// may be added, and both drop-ins are put back as they were when sshd
+// rejects the result.
+func writeTrustedCADropIn(ctx context.Context, logger *logrus.Logger) error {
+	fs := files(ctx)
+	_, certificateErr := os.Stat(hostPath(certificateDropInPath))
+	snapshot := snapshotSSHD(ctx, hostPath(trustedCADropInPath), hostPath(certificateDropInPath))
+
+	if err := ensureSSHDInclude(ctx, trustedCAIncludeLine, logger); err != nil {
+		snapshot.restore()
+		return err
+	}
+
+	if err := fs.WriteFile(hostPath(trustedCADropInPath), []byte(trustedCADropIn)); err != nil {
+		snapshot.restore()
+		return fmt.Errorf("failed to write %s: %w", trustedCADropInPath, err)
+	}
+	if err := fs.Chmod(hostPath(trustedCADropInPath), 0644); err != nil {
+		snapshot.restore()
+		return fmt.Errorf("failed to set permissions on %s: %w", trustedCADropInPath, err)
+	}
+	if certificateErr == nil {
+		if err := fs.WriteFile(hostPath(certificateDropInPath), []byte(certificateDropIn())); err != nil {
+			snapshot.restore()
+			return fmt.Errorf("failed to write %s: %w", certificateDropInPath, err)
+		}
+	}
+
+	return snapshot.check(ctx, "trusted CA configuration")
+}
+
+// trustedCAKeysFile is the TrustedUserCAKeys file certificate grants add
+// their CA to: the registration CA file once InstallTrustedCA has run, since
+// sshd reads a single one, and otherwise the certificate drop-in's own
+func trustedCAKeysFile() string {
+	if _, err := os.Stat(hostPath(trustedCADropInPath)); err == nil {
+		return TrustedCAPath
+	}
+	return trustedUserCAKeysPath
+}
+
+// registrationPrincipalsPath is the principals file sshd reads for
+// certificates of the registration CA that log in as username
+func registrationPrincipalsPath(username string) string {
+	return hostPath(filepath.Join(authorizedPrincipalDir, username))
+}
+
+// grantRegistrationPrincipal lets certificates of the registration CA log in
+// as username, and only with the username as their principal. The principal
+// is kept in a block of the request, so it goes when the grant is revoked.
+// Nothing is written on hosts that do not trust the registration CA.
+func grantRegistrationPrincipal(ctx context.Context, username, requestID string, logger *logrus.Logger) ProvisioningResult {
+	if _, err := os.Stat(hostPath(trustedCADropInPath)); err != nil {
+		return ProvisioningResult{Success: true}
+	}
+	return ensureContentInFile(ctx, username, requestID, registrationPrincipalsPath(username), "644", "root", logger)
+}
+
+// revokeRegistrationPrincipal removes what grantRegistrationPrincipal wrote
+func revokeRegistrationPrincipal(ctx context.Context, username, requestID string, logger *logrus.Logger) ProvisioningResult {
+	return removeContentFromFile(ctx, requestID, "", registrationPrincipalsPath(username), logger)
+}
+
+// RemoveTrustedCA stops trusting the CA installed at registration. The drop-in
+// and CA file are removed with it unless certificate grants still rely on
+// them, in which case only the registration CA goes.
+func RemoveTrustedCA(ctx context.Context, logger *logrus.Logger) error {
+	if _, err := os.Stat(hostPath(trustedCADropInPath)); os.IsNotExist(err) {
+		logger.Debug("P0 CA trust is not installed")
+		return nil
+	}
+
+	if res := removeContentFromFile(ctx, registrationCABlock, "", hostPath(TrustedCAPath), logger); !res.Success {
+		return fmt.Errorf("failed to remove the P0 CA: %s", res.Error)
+	}
+
+	if _, err := os.Stat(hostPath(TrustedCAPath)); err == nil {
+		lines, err := readManagedFile(ctx, hostPath(TrustedCAPath))
+		if err != nil {
+			return err
+		}
+		if len(lines) > 0 {
+			logger.WithField("file", TrustedCAPath).Info("Keeping the CA file for certificate grants")
+			return nil
+		}
+	}
+
+	fs := files(ctx)
+	if err := fs.Remove(hostPath(trustedCADropInPath)); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", trustedCADropInPath, err)
+	}
+	fs.Remove(hostPath(TrustedCAPath))
+
+	// The certificate drop-in sets TrustedUserCAKeys itself again
+	if _, err := os.Stat(hostPath(certificateDropInPath)); err == nil {
+		if err := fs.WriteFile(hostPath(certificateDropInPath), []byte(certificateDropIn())); err != nil {
+			return fmt.Errorf("failed to write %s: %w", certificateDropInPath, err)
+		}
+	}
+
+	if err := reloadSSHD(ctx, logger); err != nil {
+		return err
+	}
+
+	logger.WithField("file", trustedCADropInPath).Info("🔓 sshd no longer trusts the P0 CA")
+	return nil
+}
@@ -1,18 +1,58 @@
 package scripts
 
+import (
+	"sort"
+
+	"p0-ssh-agent/internal/audit"
+)
+
 type ProvisioningRequest struct {
-	UserName     string `json:"userName"`
-	Action       string `json:"action"`
-	RequestID    string `json:"requestId"`
-	PublicKey    string `json:"publicKey,omitempty"`
-	CAPublicKey  string `json:"caPublicKey,omitempty"`
-	Sudo         bool   `json:"sudo,omitempty"`
+	UserName              string            `json:"userName"`
+	Action                string            `json:"action"`
+	RequestID             string            `json:"requestId"`
+	PublicKey             string            `json:"publicKey,omitempty"`
+	CAPublicKey           string            `json:"caPublicKey,omitempty"`
+	Sudo                  bool              `json:"sudo,omitempty"`
+	SudoSpec              *SudoSpec         `json:"sudoSpec,omitempty"`
+	ValidFrom             string            `json:"validFrom,omitempty"`
+	ValidTo               string            `json:"validTo,omitempty"`
+	ExpiresAt             string            `json:"expiresAt,omitempty"`
+	SudoExpiresAt         string            `json:"sudoExpiresAt,omitempty"`
+	TimeZone              string            `json:"timeZone,omitempty"`
+	Resources             *ResourceLimits   `json:"resources,omitempty"`
+	PermitOpen            []string          `json:"permitOpen,omitempty"`
+	Metadata              map[string]string `json:"metadata,omitempty"`
+	Principals            []string          `json:"principals,omitempty"`
+	Certificate           string            `json:"certificate,omitempty"`
+	CertificateTTLSeconds int               `json:"certificateTtlSeconds,omitempty"`
+	GraceSeconds          int               `json:"graceSeconds,omitempty"`
+	Force                 bool              `json:"force,omitempty"`
+	AllSessions           bool              `json:"allSessions,omitempty"`
+	Origin                *audit.Origin     `json:"origin,omitempty"`
+
+	// grantedFiles are the files the recorded grant wrote to, filled in
+	// for a revoke from the provisioning state, never from the request
+	grantedFiles []string
+}
+
+// ResourceLimits are applied to the user's systemd slice (user-<uid>.slice)
+type ResourceLimits struct {
+	IOWeight       int      `json:"ioWeight,omitempty"`
+	TasksMax       int      `json:"tasksMax,omitempty"`
+	IPAddressAllow []string `json:"ipAddressAllow,omitempty"`
+	IPAddressDeny  []string `json:"ipAddressDeny,omitempty"`
 }
 
 type ProvisioningResult struct {
-	Success bool   `json:"success"`
-	Message string `json:"message"`
-	Error   string `json:"error,omitempty"`
+	Success bool        `json:"success"`
+	Message string      `json:"message"`
+	Error   string      `json:"error,omitempty"`
+	Status  string      `json:"status,omitempty"`
+	Data    interface{} `json:"data,omitempty"`
+
+	// files are the files a grant wrote to, recorded in the provisioning
+	// state so its revoke cleans them whatever the configuration is then
+	files []string
 }
 
 type Command string
@@ -23,4 +63,47 @@ const (
 	CommandProvisionCAKeys         Command = "provisionCAKeys"
 	CommandProvisionSudo           Command = "provisionSudo"
 	CommandProvisionSession        Command = "provisionSession"
+	CommandBulkRevoke              Command = "bulkRevoke"
+	CommandProvisionBanner         Command = "provisionBanner"
+	CommandProvisionPortForward    Command = "provisionPortForward"
+	CommandProvisionCertificate    Command = "provisionCertificate"
+	CommandStageGrants             Command = "stageGrants"
 )
+
+// knownCommands bounds the values used as metric labels
+var knownCommands = map[Command]bool{
+	CommandProvisionUser:           true,
+	CommandProvisionAuthorizedKeys: true,
+	CommandProvisionCAKeys:         true,
+	CommandProvisionSudo:           true,
+	CommandProvisionSession:        true,
+	CommandBulkRevoke:              true,
+	CommandProvisionBanner:         true,
+	CommandProvisionPortForward:    true,
+	CommandProvisionCertificate:    true,
+	CommandStageGrants:             true,
+}
+
+// IsKnownCommand reports whether command is one the agent can run
+func IsKnownCommand(command string) bool {
+	return knownCommands[Command(command)]
+}
+
+// KnownCommands returns every command the agent can run, sorted
+func KnownCommands() []string {
+	commands := make([]string, 0, len(knownCommands))
+	for command := range knownCommands {
+		commands = append(commands, string(command))
+	}
+	sort.Strings(commands)
+	return commands
+}
+
+// MetricsLabel returns command for known commands and "unknown" otherwise,
+// so arbitrary backend input cannot grow metric cardinality
+func MetricsLabel(command string) string {
+	if knownCommands[Command(command)] {
+		return command
+	}
+	return "unknown"
+}
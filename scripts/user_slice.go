@@ -0,0 +1,169 @@
+package scripts
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// sliceControlDir takes precedence over /etc/systemd/system and stays writable
+// on hosts where that directory is managed (e.g. NixOS)
+const sliceControlDir = "/etc/systemd/system.control"
+
+// ipAddressKeywords are the symbolic values accepted by IPAddressAllow/IPAddressDeny
+var ipAddressKeywords = map[string]bool{
+	"any":        true,
+	"localhost":  true,
+	"link-local": true,
+	"multicast":  true,
+}
+
+// Validate checks limits before anything is written
+func (r *ResourceLimits) Validate() error {
+	if r.IOWeight != 0 && (r.IOWeight < 1 || r.IOWeight > 10000) {
+		return fmt.Errorf("ioWeight must be between 1 and 10000, got %d", r.IOWeight)
+	}
+	if r.TasksMax < 0 {
+		return fmt.Errorf("tasksMax must be positive, got %d", r.TasksMax)
+	}
+	for _, address := range append(append([]string{}, r.IPAddressAllow...), r.IPAddressDeny...) {
+		if !isValidIPAddressSpec(address) {
+			return fmt.Errorf("invalid IP address specification %q", address)
+		}
+	}
+	return nil
+}
+
+func isValidIPAddressSpec(address string) bool {
+	if ipAddressKeywords[address] {
+		return true
+	}
+	if net.ParseIP(address) != nil {
+		return true
+	}
+	_, _, err := net.ParseCIDR(address)
+	return err == nil
+}
+
+// directives renders the limits as [Slice] directives
+func (r *ResourceLimits) directives() []string {
+	var lines []string
+	if r.IOWeight > 0 {
+		lines = append(lines, fmt.Sprintf("IOWeight=%d", r.IOWeight))
+	}
+	if r.TasksMax > 0 {
+		lines = append(lines, fmt.Sprintf("TasksMax=%d", r.TasksMax))
+	}
+	if len(r.IPAddressAllow) > 0 {
+		lines = append(lines, "IPAddressAllow="+strings.Join(r.IPAddressAllow, " "))
+	}
+	if len(r.IPAddressDeny) > 0 {
+		lines = append(lines, "IPAddressDeny="+strings.Join(r.IPAddressDeny, " "))
+	}
+	return lines
+}
+
+func userSliceDropIn(uid, requestID string) string {
+	return hostPath(filepath.Join(sliceControlDir, fmt.Sprintf("user-%s.slice.d", uid), fmt.Sprintf("p0-%s.conf", requestID)))
+}
+
+// applyUserSliceLimits writes a RequestID-tagged drop-in for the user's slice
+// and reloads systemd so running sessions pick the limits up
+func applyUserSliceLimits(ctx context.Context, username, requestID string, limits *ResourceLimits, logger *logrus.Logger) error {
+	if limits == nil {
+		return nil
+	}
+
+	if err := limits.Validate(); err != nil {
+		return err
+	}
+
+	directives := limits.directives()
+	if len(directives) == 0 {
+		return nil
+	}
+
+	if !requestIDPattern.MatchString(requestID) {
+		return fmt.Errorf("invalid requestId: must match ^[A-Za-z0-9][A-Za-z0-9._-]*$")
+	}
+
+	if !commandExists("systemctl") {
+		return fmt.Errorf("resource limits require systemd")
+	}
+
+	userInfo, err := lookupUser(username)
+	if err != nil {
+		return fmt.Errorf("failed to lookup user %s: %w", username, err)
+	}
+
+	dropIn := userSliceDropIn(userInfo.Uid, requestID)
+	content := fmt.Sprintf("# RequestID: %s\n[Slice]\n%s\n", requestID, strings.Join(directives, "\n"))
+
+	logger.WithFields(logrus.Fields{
+		"username":   username,
+		"slice":      fmt.Sprintf("user-%s.slice", userInfo.Uid),
+		"request_id": requestID,
+		"limits":     strings.Join(directives, ", "),
+	}).Info("🧱 Applying user slice resource limits")
+
+	fs := files(ctx)
+	if err := fs.MkdirAll(filepath.Dir(dropIn)); err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", filepath.Dir(dropIn), err)
+	}
+
+	if err := fs.WriteFile(dropIn, []byte(content)); err != nil {
+		return fmt.Errorf("failed to write %s: %w", dropIn, err)
+	}
+
+	if err := fs.Chmod(dropIn, 0644); err != nil {
+		return fmt.Errorf("failed to set permissions on %s: %w", dropIn, err)
+	}
+
+	if err := privileged(ctx, "systemctl", "daemon-reload").Run(); err != nil {
+		return fmt.Errorf("failed to reload systemd: %w", err)
+	}
+
+	return nil
+}
+
+// removeUserSliceLimits deletes the drop-in written for requestID, if any
+func removeUserSliceLimits(ctx context.Context, username, requestID string, logger *logrus.Logger) error {
+	if !requestIDPattern.MatchString(requestID) {
+		return nil
+	}
+
+	userInfo, err := lookupUser(username)
+	if err != nil {
+		logger.WithField("username", username).Debug("User not found, no slice limits to remove")
+		return nil
+	}
+
+	dropIn := userSliceDropIn(userInfo.Uid, requestID)
+	if _, err := os.Stat(dropIn); os.IsNotExist(err) {
+		return nil
+	}
+
+	logger.WithFields(logrus.Fields{
+		"username":   username,
+		"request_id": requestID,
+		"file":       dropIn,
+	}).Info("🧹 Removing user slice resource limits")
+
+	if err := files(ctx).Remove(dropIn); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", dropIn, err)
+	}
+
+	// Leave the directory behind if other requests still have drop-ins in it
+	files(ctx).RemoveDir(filepath.Dir(dropIn))
+
+	if err := privileged(ctx, "systemctl", "daemon-reload").Run(); err != nil {
+		return fmt.Errorf("failed to reload systemd: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,142 @@
+package types
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"time"
+)
+
+// Destinations of auditSinks
+const (
+	// AuditSinkFile appends entries as JSON lines to a further file
+	AuditSinkFile = "file"
+
+	// AuditSinkSyslog sends entries to the local or a remote syslog daemon
+	AuditSinkSyslog = "syslog"
+
+	// AuditSinkHTTP posts each entry as JSON to a collector
+	AuditSinkHTTP = "http"
+
+	// AuditSinkS3 stores each entry as its own object in an S3 bucket, so a
+	// bucket with Object Lock keeps them write-once
+	AuditSinkS3 = "s3"
+
+	// DefaultAuditSinkTimeoutSeconds bounds delivery of one entry to one sink
+	DefaultAuditSinkTimeoutSeconds = 5
+)
+
+// AuditSinkTypes lists every value accepted as an audit sink type
+var AuditSinkTypes = []string{AuditSinkFile, AuditSinkSyslog, AuditSinkHTTP, AuditSinkS3}
+
+// AuditSink is a destination that receives a copy of audit log entries.
+// <stateDir>/audit.log is always written and remains the hash-chained record;
+// sinks stream its entries elsewhere as they are appended.
+type AuditSink struct {
+	Type string `json:"type" yaml:"type"`
+
+	// Path is the file of a file sink
+	Path string `json:"path,omitempty" yaml:"path,omitempty"`
+
+	// Network and Address select a remote syslog daemon, e.g. "tcp" and
+	// "logs.example.com:514"; both empty use the local one. Tag defaults to
+	// p0-ssh-agent.
+	Network string `json:"network,omitempty" yaml:"network,omitempty"`
+	Address string `json:"address,omitempty" yaml:"address,omitempty"`
+	Tag     string `json:"tag,omitempty" yaml:"tag,omitempty"`
+
+	// URL and Headers are the endpoint of an http sink. Header values may
+	// reference environment variables as ${NAME}.
+	URL     string            `json:"url,omitempty" yaml:"url,omitempty"`
+	Headers map[string]string `json:"headers,omitempty" yaml:"headers,omitempty"`
+
+	// Bucket, Region and Prefix place the objects of an s3 sink. Endpoint
+	// selects an S3-compatible service instead of AWS.
+	Bucket   string `json:"bucket,omitempty" yaml:"bucket,omitempty"`
+	Region   string `json:"region,omitempty" yaml:"region,omitempty"`
+	Prefix   string `json:"prefix,omitempty" yaml:"prefix,omitempty"`
+	Endpoint string `json:"endpoint,omitempty" yaml:"endpoint,omitempty"`
+
+	TimeoutSeconds int             `json:"timeoutSeconds,omitempty" yaml:"timeoutSeconds,omitempty"`
+	Filter         AuditSinkFilter `json:"filter,omitempty" yaml:"filter,omitempty"`
+}
+
+// AuditSinkFilter selects the entries a sink receives. Empty lists match
+// everything; the lists that are set must all match.
+type AuditSinkFilter struct {
+	Commands []string `json:"commands,omitempty" yaml:"commands,omitempty"`
+	Actions  []string `json:"actions,omitempty" yaml:"actions,omitempty"`
+	Sources  []string `json:"sources,omitempty" yaml:"sources,omitempty"`
+
+	// Outcome is "success" or "failure" to send only those entries
+	Outcome string `json:"outcome,omitempty" yaml:"outcome,omitempty"`
+
+	// SkipDryRun leaves out entries of dry-run requests, which change nothing
+	SkipDryRun bool `json:"skipDryRun,omitempty" yaml:"skipDryRun,omitempty"`
+}
+
+// Outcomes accepted by AuditSinkFilter
+const (
+	AuditOutcomeSuccess = "success"
+	AuditOutcomeFailure = "failure"
+)
+
+// GetTimeout returns how long delivering one entry may take
+func (s AuditSink) GetTimeout() time.Duration {
+	if s.TimeoutSeconds <= 0 {
+		return DefaultAuditSinkTimeoutSeconds * time.Second
+	}
+	return time.Duration(s.TimeoutSeconds) * time.Second
+}
+
+// validate reports the problems of the auditSinks entry at index
+func (s AuditSink) validate(index int) []error {
+	name := fmt.Sprintf("auditSinks[%d]", index)
+	var errs []error
+
+	switch s.Type {
+	case AuditSinkFile:
+		if !filepath.IsAbs(s.Path) {
+			errs = append(errs, fmt.Errorf("%s: file sinks need an absolute path", name))
+		}
+	case AuditSinkSyslog:
+		switch s.Network {
+		case "", "udp", "tcp", "unix", "unixgram":
+		default:
+			errs = append(errs, fmt.Errorf("%s: network must be udp, tcp, unix or unixgram (got %q)", name, s.Network))
+		}
+		if (s.Network == "") != (s.Address == "") {
+			errs = append(errs, fmt.Errorf("%s: network and address must be set together", name))
+		}
+	case AuditSinkHTTP:
+		if u, err := url.Parse(s.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("%s: url %q must be an http(s) URL", name, s.URL))
+		}
+	case AuditSinkS3:
+		if s.Bucket == "" {
+			errs = append(errs, fmt.Errorf("%s: s3 sinks need a bucket", name))
+		}
+		if s.Region == "" {
+			errs = append(errs, fmt.Errorf("%s: s3 sinks need a region", name))
+		}
+		if s.Endpoint != "" {
+			if u, err := url.Parse(s.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				errs = append(errs, fmt.Errorf("%s: endpoint %q must be an http(s) URL", name, s.Endpoint))
+			}
+		}
+	default:
+		errs = append(errs, fmt.Errorf("%s: type must be one of %v (got %q)", name, AuditSinkTypes, s.Type))
+	}
+
+	if s.TimeoutSeconds < 0 {
+		errs = append(errs, fmt.Errorf("%s: timeoutSeconds cannot be negative", name))
+	}
+
+	switch s.Filter.Outcome {
+	case "", AuditOutcomeSuccess, AuditOutcomeFailure:
+	default:
+		errs = append(errs, fmt.Errorf("%s: filter outcome must be %q or %q (got %q)", name, AuditOutcomeSuccess, AuditOutcomeFailure, s.Filter.Outcome))
+	}
+
+	return errs
+}
@@ -0,0 +1,131 @@
+package types
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"strings"
+	"unicode/utf8"
+)
+
+// EncodeBody returns an HTTP body as the Data and ContentEncoding of a
+// ForwardedRequest or ForwardedResponse, so that DecodeBody returns the same
+// bytes. JSON bodies are sent as their value when encoding it again gives
+// back the body, and as a string otherwise; other UTF-8 text as a string;
+// anything else, including text in another charset, base64-encoded with
+// ContentEncodingBase64. Without a content type, bodies that are not valid
+// UTF-8 are treated as binary.
+func EncodeBody(contentType string, body []byte) (interface{}, string) {
+	if len(body) == 0 {
+		return nil, ""
+	}
+
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if contentType == "" || err != nil {
+		mediaType = ""
+	}
+	if charset := params["charset"]; charset != "" && !strings.EqualFold(charset, "utf-8") && !strings.EqualFold(charset, "us-ascii") {
+		return base64.StdEncoding.EncodeToString(body), ContentEncodingBase64
+	}
+
+	if isJSONMediaType(mediaType) {
+		if data, ok := jsonValue(body); ok {
+			return data, ""
+		}
+	}
+	if (mediaType == "" || isTextMediaType(mediaType)) && utf8.Valid(body) {
+		return string(body), ""
+	}
+	return base64.StdEncoding.EncodeToString(body), ContentEncodingBase64
+}
+
+// DecodeBody returns the bytes of Data sent with contentEncoding, and the
+// content type they imply when the sender sets none: strings are sent as they
+// are, ContentEncodingBase64 strings decoded, and any other value encoded as
+// JSON. Responses compressed with ContentEncodingGzipBase64 are uncompressed
+// first.
+func DecodeBody(data interface{}, contentEncoding string) ([]byte, string, error) {
+	switch contentEncoding {
+	case "":
+	case ContentEncodingGzipBase64:
+		encoded, ok := data.(string)
+		if !ok {
+			return nil, "", fmt.Errorf("data with contentEncoding %q must be a string", contentEncoding)
+		}
+		compressed, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid base64 data: %w", err)
+		}
+		reader, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid gzip data: %w", err)
+		}
+		decoder := json.NewDecoder(reader)
+		decoder.UseNumber()
+		data = nil
+		if err := decoder.Decode(&data); err != nil {
+			return nil, "", fmt.Errorf("invalid compressed data: %w", err)
+		}
+	case ContentEncodingBase64:
+		encoded, ok := data.(string)
+		if !ok {
+			return nil, "", fmt.Errorf("data with contentEncoding %q must be a string", contentEncoding)
+		}
+		body, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid base64 data: %w", err)
+		}
+		return body, "application/octet-stream", nil
+	default:
+		return nil, "", fmt.Errorf("unsupported contentEncoding %q", contentEncoding)
+	}
+
+	switch v := data.(type) {
+	case nil:
+		return nil, "", nil
+	case string:
+		return []byte(v), "", nil
+	default:
+		body, err := json.Marshal(v)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to encode data: %w", err)
+		}
+		return body, "application/json", nil
+	}
+}
+
+// jsonValue decodes a JSON body, keeping numbers exactly. ok is false unless
+// encoding the value again, as DecodeBody and the transport do, gives back
+// body itself: whitespace, key order or escaping that differ would be lost.
+func jsonValue(body []byte) (data interface{}, ok bool) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&data); err != nil || decoder.More() {
+		return nil, false
+	}
+	encoded, err := json.Marshal(data)
+	if err != nil || !bytes.Equal(encoded, body) {
+		return nil, false
+	}
+	return data, true
+}
+
+func isJSONMediaType(mediaType string) bool {
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// isTextMediaType reports whether bodies of mediaType are text, which is sent
+// as a string when it is valid UTF-8
+func isTextMediaType(mediaType string) bool {
+	if strings.HasPrefix(mediaType, "text/") || isJSONMediaType(mediaType) || strings.HasSuffix(mediaType, "+xml") {
+		return true
+	}
+	switch mediaType {
+	case "application/xml", "application/javascript", "application/x-www-form-urlencoded", "application/x-ndjson", "application/yaml":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,931 @@
+package types
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ConfigVersion is the configuration schema version written by this agent
+const ConfigVersion = "1.0"
+
+// Default configuration values shared by every binary
+const (
+	DefaultTunnelHost               = "wss://api.p0.app"
+	DefaultKeyPath                  = "/etc/p0-ssh-agent/keys"
+	DefaultStateDir                 = "/var/lib/p0-ssh-agent"
+	DefaultEnvironmentID            = "default"
+	DefaultHeartbeatIntervalSeconds = 60
+	DefaultTunnelTimeoutMs          = 30000
+	DefaultBulkRevokeConcurrency    = 8
+	DefaultShutdownDrainSeconds     = 30
+	DefaultFetchFileMaxBytes        = 1 << 20
+	DefaultEndpointProbeSeconds     = 600
+	DefaultFailoverAfterAttempts    = 3
+	DefaultJWTNotBeforeSeconds      = 60
+	DefaultJWTExpiryLeewaySeconds   = 60
+	DefaultJWTLifetimeSeconds       = 7 * 24 * 3600
+	DefaultControlSocket            = "/run/p0-ssh-agent.sock"
+	DefaultPingIntervalSeconds      = 15
+	DefaultPongTimeoutSeconds       = 10
+	DefaultDisabledFile             = "/etc/p0-ssh-agent/disabled"
+
+	// MaxSessionGraceSeconds bounds how long a revoked user may keep their sessions
+	MaxSessionGraceSeconds = 3600
+
+	// MinSessionReportSeconds bounds how often logged-in sessions are reported
+	MinSessionReportSeconds = 10
+
+	// MaxJWTClockSkewSeconds bounds JWT backdating and expiry leeway
+	MaxJWTClockSkewSeconds = 3600
+
+	// MinJWTLifetimeSeconds bounds how often tunnel JWTs are renewed
+	MinJWTLifetimeSeconds = 300
+
+	// MaxTunnelBufferBytes bounds readBufferBytes and writeBufferBytes
+	MaxTunnelBufferBytes = 1 << 20
+
+	// ControlSocketDisabled as controlSocket turns the control socket off
+	ControlSocketDisabled = "off"
+)
+
+// Endpoint selection modes for tunnelHosts
+const (
+	// EndpointSelectionLatency connects to the endpoint with the lowest connect time
+	EndpointSelectionLatency = "latency"
+
+	// EndpointSelectionPriority connects to the first reachable endpoint in
+	// configured order and fails back to earlier ones once they recover
+	EndpointSelectionPriority = "priority"
+)
+
+// Layouts of authorizedKeysLayout. Any other value is a custom
+// AuthorizedKeysFile template.
+const (
+	// AuthorizedKeysLayoutAuto follows the AuthorizedKeysFile of sshd_config
+	AuthorizedKeysLayoutAuto = "auto"
+
+	// AuthorizedKeysLayoutHome keeps keys in ~/.ssh/authorized_keys
+	AuthorizedKeysLayoutHome = "home"
+
+	// AuthorizedKeysLayoutCentral keeps keys in CentralAuthorizedKeysFile
+	AuthorizedKeysLayoutCentral = "central"
+
+	// HomeAuthorizedKeysFile is the sshd default, as an AuthorizedKeysFile template
+	HomeAuthorizedKeysFile = "%h/.ssh/authorized_keys"
+
+	// CentralAuthorizedKeysFile holds one root-owned key file per user
+	CentralAuthorizedKeysFile = "/etc/ssh/authorized_keys.d/%u"
+)
+
+// Ways of resolving JIT users, set with userResolution
+const (
+	// UserResolutionLocal creates JIT users as local accounts in /etc/passwd
+	UserResolutionLocal = "local"
+
+	// UserResolutionUserdb serves JIT users from the agent's state through
+	// systemd's userdb, so NSS resolves them without local accounts
+	UserResolutionUserdb = "userdb"
+)
+
+// Layouts of sudoersLayout
+const (
+	// SudoersLayoutFile keeps every sudo rule in the single managed file /etc/sudoers-p0
+	SudoersLayoutFile = "file"
+
+	// SudoersLayoutDropIn writes each request's rule to /etc/sudoers.d/p0-<requestId>
+	SudoersLayoutDropIn = "dropin"
+)
+
+// Bandwidth profiles, set with bandwidthProfile or the setBandwidthProfile RPC
+const (
+	// BandwidthProfileStandard sends heartbeats, responses and events as configured
+	BandwidthProfileStandard = "standard"
+
+	// BandwidthProfileLow is for metered satellite and cellular links: longer
+	// heartbeats, compressed frames, batched events and no interface inventory
+	BandwidthProfileLow = "low"
+
+	// LowBandwidthHeartbeatSeconds is the shortest heartbeat interval of the low profile
+	LowBandwidthHeartbeatSeconds = 300
+
+	// LowBandwidthCompressOver is the compressResponsesOver threshold of the
+	// low profile when none is configured
+	LowBandwidthCompressOver = 1024
+)
+
+// System details that disableCollection can keep the agent from gathering
+const (
+	// CollectHostname is the OS hostname, also used in fallback fingerprints
+	CollectHostname = "hostname"
+
+	// CollectPublicIP is the public IP lookup against echo services at registration
+	CollectPublicIP = "publicIp"
+
+	// CollectMACAddresses are interface hardware addresses, in interface
+	// listings and fallback fingerprints
+	CollectMACAddresses = "macAddresses"
+)
+
+// CollectableFields lists every value accepted in disableCollection
+var CollectableFields = []string{CollectHostname, CollectPublicIP, CollectMACAddresses}
+
+// Collection is the set of system details the agent must not gather. The
+// zero value collects everything.
+type Collection []string
+
+// Allows reports whether field may be collected
+func (c Collection) Allows(field string) bool {
+	for _, disabled := range c {
+		if disabled == field {
+			return false
+		}
+	}
+	return true
+}
+
+// Validate rejects fields the agent does not know how to withhold
+func (c Collection) Validate() error {
+	for _, field := range c {
+		known := false
+		for _, collectable := range CollectableFields {
+			known = known || field == collectable
+		}
+		if !known {
+			return fmt.Errorf("disableCollection entry %q is not supported (supported: %s)", field, strings.Join(CollectableFields, ", "))
+		}
+	}
+	return nil
+}
+
+// Omitted returns the disabled fields in CollectableFields order, for the
+// "omitted" marker in payloads, or nil when everything is collected
+func (c Collection) Omitted() []string {
+	var omitted []string
+	for _, field := range CollectableFields {
+		if !c.Allows(field) {
+			omitted = append(omitted, field)
+		}
+	}
+	return omitted
+}
+
+// DefaultFetchFileAllowlist are the files fetchFile may read unless configured otherwise
+var DefaultFetchFileAllowlist = []string{
+	"/etc/os-release",
+	"/etc/ssh/sshd_config",
+	"/etc/ssh/sshd_config.d/*.conf",
+	"/var/log/auth.log",
+	"/var/log/secure",
+}
+
+// selinuxUserPattern matches SELinux user names such as staff_u
+var selinuxUserPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// keyProfilePattern keeps key profile names usable as a directory name and a kid prefix
+var keyProfilePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+// metadataFieldPattern restricts requiredMetadata names so they can also be sent as headers
+var metadataFieldPattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_-]*$`)
+
+// SupportedConfigVersions lists schema versions this agent can read
+var SupportedConfigVersions = []string{"1.0"}
+
+type Config struct {
+	Version                  string   `json:"version" yaml:"version"`
+	OrgID                    string   `json:"orgId" yaml:"orgId"`
+	HostID                   string   `json:"hostId" yaml:"hostId"`
+	Hostname                 string   `json:"hostname" yaml:"hostname"`
+	PublicIP                 string   `json:"publicIp,omitempty" yaml:"publicIp,omitempty"`
+	IPEchoEndpoints          []string `json:"ipEchoEndpoints,omitempty" yaml:"ipEchoEndpoints,omitempty"`
+	PrivateIPOnly            bool     `json:"privateIpOnly,omitempty" yaml:"privateIpOnly,omitempty"`
+	DisableCollection        []string `json:"disableCollection,omitempty" yaml:"disableCollection,omitempty"`
+	KeyPath                  string   `json:"keyPath" yaml:"keyPath"`
+	KeyProfile               string   `json:"keyProfile,omitempty" yaml:"keyProfile,omitempty"`
+	StateDir                 string   `json:"stateDir" yaml:"stateDir"`
+	WritableDir              string   `json:"writableDir,omitempty" yaml:"writableDir,omitempty"`
+	TunnelHost               string   `json:"tunnelHost" yaml:"tunnelHost"`
+	TunnelHosts              []string `json:"tunnelHosts,omitempty" yaml:"tunnelHosts,omitempty"`
+	EndpointProbeSeconds     int      `json:"endpointProbeSeconds,omitempty" yaml:"endpointProbeSeconds,omitempty"`
+	EndpointSelection        string   `json:"endpointSelection,omitempty" yaml:"endpointSelection,omitempty"`
+	FailoverAfterAttempts    int      `json:"failoverAfterAttempts,omitempty" yaml:"failoverAfterAttempts,omitempty"`
+	TunnelPort               int      `json:"tunnelPort,omitempty" yaml:"tunnelPort,omitempty"`
+	TunnelPath               string   `json:"tunnelPath,omitempty" yaml:"tunnelPath,omitempty"`
+	TunnelTimeoutMs          int      `json:"tunnelTimeoutMs" yaml:"tunnelTimeoutMs"`
+	HandshakeTimeoutMs       int      `json:"handshakeTimeoutMs,omitempty" yaml:"handshakeTimeoutMs,omitempty"`
+	TCPKeepAliveSeconds      int      `json:"tcpKeepAliveSeconds,omitempty" yaml:"tcpKeepAliveSeconds,omitempty"`
+	WriteTimeoutSeconds      int      `json:"writeTimeoutSeconds,omitempty" yaml:"writeTimeoutSeconds,omitempty"`
+	PingIntervalSeconds      int      `json:"pingIntervalSeconds,omitempty" yaml:"pingIntervalSeconds,omitempty"`
+	PongTimeoutSeconds       int      `json:"pongTimeoutSeconds,omitempty" yaml:"pongTimeoutSeconds,omitempty"`
+	ReadBufferBytes          int      `json:"readBufferBytes,omitempty" yaml:"readBufferBytes,omitempty"`
+	WriteBufferBytes         int      `json:"writeBufferBytes,omitempty" yaml:"writeBufferBytes,omitempty"`
+	JWTNotBeforeSeconds      int      `json:"jwtNotBeforeSeconds" yaml:"jwtNotBeforeSeconds"`
+	JWTExpiryLeewaySeconds   int      `json:"jwtExpiryLeewaySeconds" yaml:"jwtExpiryLeewaySeconds"`
+	JWTLifetimeSeconds       int      `json:"jwtLifetimeSeconds,omitempty" yaml:"jwtLifetimeSeconds,omitempty"`
+	ProxyURL                 string   `json:"proxyUrl,omitempty" yaml:"proxyUrl,omitempty"`
+	NoProxy                  []string `json:"noProxy,omitempty" yaml:"noProxy,omitempty"`
+	ClientCertPath           string   `json:"clientCertPath,omitempty" yaml:"clientCertPath,omitempty"`
+	ClientKeyPath            string   `json:"clientKeyPath,omitempty" yaml:"clientKeyPath,omitempty"`
+	TLSCAFile                string   `json:"tlsCaFile,omitempty" yaml:"tlsCaFile,omitempty"`
+	TLSServerName            string   `json:"tlsServerName,omitempty" yaml:"tlsServerName,omitempty"`
+	TLSInsecureSkipVerify    bool     `json:"tlsInsecureSkipVerify,omitempty" yaml:"tlsInsecureSkipVerify,omitempty"`
+	Labels                   []string `json:"labels" yaml:"labels"`
+	LabelScript              string   `json:"labelScript,omitempty" yaml:"labelScript,omitempty"`
+	CloudLabels              string   `json:"cloudLabels,omitempty" yaml:"cloudLabels,omitempty"`
+	AuthorizedKeysLayout     string   `json:"authorizedKeysLayout,omitempty" yaml:"authorizedKeysLayout,omitempty"`
+	UserResolution           string   `json:"userResolution,omitempty" yaml:"userResolution,omitempty"`
+	BandwidthProfile         string   `json:"bandwidthProfile,omitempty" yaml:"bandwidthProfile,omitempty"`
+	SudoersLayout            string   `json:"sudoersLayout,omitempty" yaml:"sudoersLayout,omitempty"`
+	SELinuxUser              string   `json:"selinuxUser,omitempty" yaml:"selinuxUser,omitempty"`
+	OSPlugin                 string   `json:"osPlugin,omitempty" yaml:"osPlugin,omitempty"`
+	EnvironmentId            string   `json:"environmentId" yaml:"environmentId"`
+	HeartbeatIntervalSeconds int      `json:"heartbeatIntervalSeconds" yaml:"heartbeatIntervalSeconds"`
+	BulkRevokeConcurrency    int      `json:"bulkRevokeConcurrency" yaml:"bulkRevokeConcurrency"`
+	ShutdownDrainSeconds     int      `json:"shutdownDrainSeconds" yaml:"shutdownDrainSeconds"`
+	SessionGraceSeconds      int      `json:"sessionGraceSeconds,omitempty" yaml:"sessionGraceSeconds,omitempty"`
+	SessionReportSeconds     int      `json:"sessionReportSeconds,omitempty" yaml:"sessionReportSeconds,omitempty"`
+	RPCAllowlist             []string `json:"rpcAllowlist" yaml:"rpcAllowlist"`
+	FetchFileAllowlist       []string `json:"fetchFileAllowlist" yaml:"fetchFileAllowlist"`
+	FetchFileMaxBytes        int      `json:"fetchFileMaxBytes" yaml:"fetchFileMaxBytes"`
+	MetricsAddress           string   `json:"metricsAddress,omitempty" yaml:"metricsAddress,omitempty"`
+	ControlSocket            string   `json:"controlSocket,omitempty" yaml:"controlSocket,omitempty"`
+	RequiredMetadata         []string `json:"requiredMetadata,omitempty" yaml:"requiredMetadata,omitempty"`
+	DisabledFile             string   `json:"disabledFile,omitempty" yaml:"disabledFile,omitempty"`
+	SignResponses            bool     `json:"signResponses,omitempty" yaml:"signResponses,omitempty"`
+	StreamOutput             bool     `json:"streamOutput,omitempty" yaml:"streamOutput,omitempty"`
+	CompressResponsesOver    int      `json:"compressResponsesOver,omitempty" yaml:"compressResponsesOver,omitempty"`
+	DryRun                   bool     `json:"dryRun" yaml:"dryRun"`
+
+	// AuditSinks receive a copy of every audit log entry their filter matches
+	AuditSinks []AuditSink `json:"auditSinks,omitempty" yaml:"auditSinks,omitempty"`
+
+	// Targets are HTTP services forwarded requests are routed to by path or header
+	Targets []Target `json:"targets,omitempty" yaml:"targets,omitempty"`
+
+	// TargetCache keeps cacheable GET responses of targets in memory
+	TargetCache *TargetCache `json:"targetCache,omitempty" yaml:"targetCache,omitempty"`
+
+	// Reconnect is the backoff policy for reconnecting to the tunnel
+	Reconnect Reconnect `json:"reconnect" yaml:"reconnect,omitempty"`
+
+	// ScriptLimits bounds provisioning commands and the processes they start
+	ScriptLimits ScriptLimits `json:"scriptLimits" yaml:"scriptLimits,omitempty"`
+
+	// SessionRecording records the sessions of users the agent grants access to
+	SessionRecording *SessionRecording `json:"sessionRecording,omitempty" yaml:"sessionRecording,omitempty"`
+
+	// ConfigPath is the file the configuration was loaded from, if any
+	ConfigPath string `json:"-" yaml:"-" mapstructure:"-"`
+
+	// Deprecations lists deprecated keys found while loading, for callers to report
+	Deprecations []string `json:"-" yaml:"-" mapstructure:"-"`
+}
+
+// DeprecatedKey describes a configuration key that is still read but should be replaced
+type DeprecatedKey struct {
+	Key         string
+	Replacement string
+	Since       string
+	Note        string
+}
+
+// DeprecatedKeys are accepted for compatibility with older config files and flags
+var DeprecatedKeys = []DeprecatedKey{
+	{Key: "environment", Replacement: "environmentId", Since: "1.0", Note: "renamed for consistency with registration"},
+	{Key: "logPath", Since: "1.0", Note: "logs are written to the systemd journal; the value is ignored"},
+}
+
+// Message describes the deprecation for logs and status output
+func (d DeprecatedKey) Message() string {
+	if d.Replacement != "" {
+		return fmt.Sprintf("%q is deprecated since %s, use %q instead (%s)", d.Key, d.Since, d.Replacement, d.Note)
+	}
+	return fmt.Sprintf("%q is deprecated since %s (%s)", d.Key, d.Since, d.Note)
+}
+
+// DefaultConfig returns a configuration with every optional field set to its default
+func DefaultConfig() *Config {
+	return &Config{
+		Version:                  ConfigVersion,
+		KeyPath:                  DefaultKeyPath,
+		StateDir:                 DefaultStateDir,
+		TunnelHost:               DefaultTunnelHost,
+		TunnelTimeoutMs:          DefaultTunnelTimeoutMs,
+		JWTNotBeforeSeconds:      DefaultJWTNotBeforeSeconds,
+		JWTExpiryLeewaySeconds:   DefaultJWTExpiryLeewaySeconds,
+		Labels:                   []string{},
+		EnvironmentId:            DefaultEnvironmentID,
+		HeartbeatIntervalSeconds: DefaultHeartbeatIntervalSeconds,
+		BulkRevokeConcurrency:    DefaultBulkRevokeConcurrency,
+		ShutdownDrainSeconds:     DefaultShutdownDrainSeconds,
+		RPCAllowlist:             []string{},
+		FetchFileAllowlist:       append([]string{}, DefaultFetchFileAllowlist...),
+		FetchFileMaxBytes:        DefaultFetchFileMaxBytes,
+		EndpointProbeSeconds:     DefaultEndpointProbeSeconds,
+		EndpointSelection:        EndpointSelectionLatency,
+		FailoverAfterAttempts:    DefaultFailoverAfterAttempts,
+		ControlSocket:            DefaultControlSocket,
+	}
+}
+
+func (c *Config) GetClientID() string {
+	return c.OrgID + ":" + c.HostID + ":ssh"
+}
+
+func (c *Config) GetHeartbeatInterval() time.Duration {
+	if c.HeartbeatIntervalSeconds <= 0 {
+		return DefaultHeartbeatIntervalSeconds * time.Second
+	}
+	return time.Duration(c.HeartbeatIntervalSeconds) * time.Second
+}
+
+// GetTunnelTimeout bounds the WebSocket handshake
+func (c *Config) GetTunnelTimeout() time.Duration {
+	if c.TunnelTimeoutMs <= 0 {
+		return DefaultTunnelTimeoutMs * time.Millisecond
+	}
+	return time.Duration(c.TunnelTimeoutMs) * time.Millisecond
+}
+
+// GetHandshakeTimeout bounds the TCP connect, TLS and WebSocket handshakes
+// of the tunnel together, tunnelTimeoutMs unless handshakeTimeoutMs is set
+func (c *Config) GetHandshakeTimeout() time.Duration {
+	if c.HandshakeTimeoutMs <= 0 {
+		return c.GetTunnelTimeout()
+	}
+	return time.Duration(c.HandshakeTimeoutMs) * time.Millisecond
+}
+
+// GetTCPKeepAlive is how long the tunnel's TCP connection may idle before
+// the first keepalive probe, and the time between probes. Zero keeps Go's
+// default of 15 seconds; negative disables keepalives.
+func (c *Config) GetTCPKeepAlive() time.Duration {
+	return time.Duration(c.TCPKeepAliveSeconds) * time.Second
+}
+
+// GetWriteTimeout bounds each write to the tunnel. Zero waits indefinitely,
+// leaving a stalled link to the heartbeat.
+func (c *Config) GetWriteTimeout() time.Duration {
+	return time.Duration(c.WriteTimeoutSeconds) * time.Second
+}
+
+// GetPingInterval is how often the tunnel sends WebSocket pings to detect a
+// dead connection between heartbeats. Zero keeps the default of 15 seconds;
+// negative disables pings.
+func (c *Config) GetPingInterval() time.Duration {
+	if c.PingIntervalSeconds == 0 {
+		return DefaultPingIntervalSeconds * time.Second
+	}
+	if c.PingIntervalSeconds < 0 {
+		return 0
+	}
+	return time.Duration(c.PingIntervalSeconds) * time.Second
+}
+
+// GetPongTimeout is how long past a ping interval the tunnel waits for the
+// pong before it is treated as lost
+func (c *Config) GetPongTimeout() time.Duration {
+	if c.PongTimeoutSeconds <= 0 {
+		return DefaultPongTimeoutSeconds * time.Second
+	}
+	return time.Duration(c.PongTimeoutSeconds) * time.Second
+}
+
+// GetJWTNotBefore is how far nbf and iat of tunnel JWTs are backdated, so a
+// backend clock running behind the agent's still accepts fresh tokens.
+// Zero disables backdating.
+func (c *Config) GetJWTNotBefore() time.Duration {
+	return time.Duration(c.JWTNotBeforeSeconds) * time.Second
+}
+
+// GetJWTExpiryLeeway is added to the lifetime of tunnel JWTs, so a backend
+// clock running ahead of the agent's does not expire them early
+func (c *Config) GetJWTExpiryLeeway() time.Duration {
+	return time.Duration(c.JWTExpiryLeewaySeconds) * time.Second
+}
+
+// GetJWTLifetime is how long tunnel JWTs are valid. The agent renews the
+// token of a connection with reauthenticate before it expires.
+func (c *Config) GetJWTLifetime() time.Duration {
+	if c.JWTLifetimeSeconds <= 0 {
+		return DefaultJWTLifetimeSeconds * time.Second
+	}
+	return time.Duration(c.JWTLifetimeSeconds) * time.Second
+}
+
+// GetCollection returns the system details the agent may not gather
+func (c *Config) GetCollection() Collection {
+	return Collection(c.DisableCollection)
+}
+
+// HasTLSOptions reports whether any tunnel TLS setting differs from the defaults
+func (c *Config) HasTLSOptions() bool {
+	return c.ClientCertPath != "" || c.TLSCAFile != "" || c.TLSServerName != "" || c.TLSInsecureSkipVerify
+}
+
+// GetTunnelEndpoints returns tunnelHost followed by any additional tunnelHosts, without duplicates
+func (c *Config) GetTunnelEndpoints() []string {
+	endpoints := []string{c.TunnelHost}
+	for _, host := range c.TunnelHosts {
+		duplicate := false
+		for _, existing := range endpoints {
+			if existing == host {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			endpoints = append(endpoints, host)
+		}
+	}
+	return endpoints
+}
+
+// GetEndpointProbeInterval is how often tunnel endpoint latency is re-measured
+func (c *Config) GetEndpointProbeInterval() time.Duration {
+	if c.EndpointProbeSeconds <= 0 {
+		return DefaultEndpointProbeSeconds * time.Second
+	}
+	return time.Duration(c.EndpointProbeSeconds) * time.Second
+}
+
+// GetEndpointSelection is how the agent picks among tunnel endpoints
+func (c *Config) GetEndpointSelection() string {
+	if c.EndpointSelection == "" {
+		return EndpointSelectionLatency
+	}
+	return c.EndpointSelection
+}
+
+// GetFailoverAfterAttempts is how many consecutive failed connection attempts
+// move a priority-ordered agent to its next endpoint
+func (c *Config) GetFailoverAfterAttempts() int {
+	if c.FailoverAfterAttempts <= 0 {
+		return DefaultFailoverAfterAttempts
+	}
+	return c.FailoverAfterAttempts
+}
+
+func (c *Config) GetBulkRevokeConcurrency() int {
+	if c.BulkRevokeConcurrency <= 0 {
+		return DefaultBulkRevokeConcurrency
+	}
+	return c.BulkRevokeConcurrency
+}
+
+// GetShutdownDrainTimeout bounds how long shutdown waits for in-flight provisioning
+func (c *Config) GetShutdownDrainTimeout() time.Duration {
+	if c.ShutdownDrainSeconds <= 0 {
+		return DefaultShutdownDrainSeconds * time.Second
+	}
+	return time.Duration(c.ShutdownDrainSeconds) * time.Second
+}
+
+// GetSessionGrace is how long a session revoke waits after warning the user.
+// A per-request value overrides the configured one; both are capped.
+func (c *Config) GetSessionGrace(requestSeconds int) time.Duration {
+	seconds := c.SessionGraceSeconds
+	if requestSeconds > 0 {
+		seconds = requestSeconds
+	}
+	if seconds > MaxSessionGraceSeconds {
+		seconds = MaxSessionGraceSeconds
+	}
+	if seconds <= 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// GetSessionReportInterval is how often logged-in sessions are reported to
+// the backend; 0 when reporting is off
+func (c *Config) GetSessionReportInterval() time.Duration {
+	if c.SessionReportSeconds <= 0 {
+		return 0
+	}
+	return time.Duration(c.SessionReportSeconds) * time.Second
+}
+
+func (c *Config) GetFetchFileMaxBytes() int {
+	if c.FetchFileMaxBytes <= 0 {
+		return DefaultFetchFileMaxBytes
+	}
+	return c.FetchFileMaxBytes
+}
+
+// GetDisabledFile is the kill switch: while a file exists at this path the
+// agent refuses grants
+func (c *Config) GetDisabledFile() string {
+	if c.DisabledFile == "" {
+		return DefaultDisabledFile
+	}
+	return c.DisabledFile
+}
+
+// GetControlSocket is the path of the local control socket, or "" when it is disabled
+func (c *Config) GetControlSocket() string {
+	switch c.ControlSocket {
+	case "":
+		return DefaultControlSocket
+	case ControlSocketDisabled:
+		return ""
+	}
+	return c.ControlSocket
+}
+
+// GetAuthorizedKeysFile returns the AuthorizedKeysFile template keys are
+// provisioned to, with sshd's %h, %u and %U tokens. It is empty for the
+// default auto layout, which is detected from sshd_config.
+func (c *Config) GetAuthorizedKeysFile() string {
+	switch c.AuthorizedKeysLayout {
+	case "", AuthorizedKeysLayoutAuto:
+		return ""
+	case AuthorizedKeysLayoutHome:
+		return HomeAuthorizedKeysFile
+	case AuthorizedKeysLayoutCentral:
+		return CentralAuthorizedKeysFile
+	}
+	return c.AuthorizedKeysLayout
+}
+
+// GetUserResolution returns how JIT users are resolved, local accounts by default
+func (c *Config) GetUserResolution() string {
+	if c.UserResolution == "" {
+		return UserResolutionLocal
+	}
+	return c.UserResolution
+}
+
+// GetSudoersLayout returns where sudo rules are written, the single managed file by default
+func (c *Config) GetSudoersLayout() string {
+	if c.SudoersLayout == "" {
+		return SudoersLayoutFile
+	}
+	return c.SudoersLayout
+}
+
+// GetSessionRecording returns the session recording settings, or nil when
+// sessions are not recorded
+func (c *Config) GetSessionRecording() *SessionRecording {
+	if c.SessionRecording == nil || !c.SessionRecording.Enabled {
+		return nil
+	}
+	return c.SessionRecording
+}
+
+// GetBandwidthProfile returns the configured bandwidth profile, standard by default
+func (c *Config) GetBandwidthProfile() string {
+	if c.BandwidthProfile == "" {
+		return BandwidthProfileStandard
+	}
+	return c.BandwidthProfile
+}
+
+// IsBandwidthProfile reports whether profile is a known bandwidth profile
+func IsBandwidthProfile(profile string) bool {
+	return profile == BandwidthProfileStandard || profile == BandwidthProfileLow
+}
+
+// osPluginNames lists the OS plugins available on this system; see
+// SetOSPluginNames
+var osPluginNames func() []string
+
+// SetOSPluginNames registers how Validate learns the OS plugins osPlugin may
+// name. The osplugins package, which cannot be imported here, registers
+// itself; when unset, osPlugin is only checked when the plugin is loaded.
+func SetOSPluginNames(names func() []string) {
+	osPluginNames = names
+}
+
+// IsKeyProfile reports whether name can be used as a key profile
+func IsKeyProfile(name string) bool {
+	return keyProfilePattern.MatchString(name)
+}
+
+// GetKeyDir returns the directory holding the key pair of the configured key
+// profile: keyPath itself for the default profile, a subdirectory otherwise
+func (c *Config) GetKeyDir() string {
+	if c.KeyProfile == "" {
+		return c.KeyPath
+	}
+	return filepath.Join(c.KeyPath, c.KeyProfile)
+}
+
+// IsRPCAllowed reports whether an optional backend-initiated RPC method is enabled
+func (c *Config) IsRPCAllowed(method string) bool {
+	for _, allowed := range c.RPCAllowlist {
+		if allowed == method {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks every field and reports all problems at once
+func (c *Config) Validate() error {
+	var errs []error
+
+	if !isSupportedVersion(c.Version) {
+		errs = append(errs, fmt.Errorf("unsupported config version %q (supported: %v)", c.Version, SupportedConfigVersions))
+	}
+
+	if c.OrgID == "" {
+		errs = append(errs, fmt.Errorf("orgId is required"))
+	}
+
+	if c.HostID == "" {
+		errs = append(errs, fmt.Errorf("hostId is required"))
+	}
+
+	if c.TunnelHost == "" {
+		errs = append(errs, fmt.Errorf("tunnelHost is required"))
+	}
+
+	if c.KeyPath == "" {
+		errs = append(errs, fmt.Errorf("keyPath is required"))
+	}
+
+	if c.KeyProfile != "" && !IsKeyProfile(c.KeyProfile) {
+		errs = append(errs, fmt.Errorf("keyProfile %q must be lowercase letters, digits, - and _ (at most 63)", c.KeyProfile))
+	}
+
+	if c.OSPlugin != "" && osPluginNames != nil {
+		names := osPluginNames()
+		known := false
+		for _, name := range names {
+			known = known || name == c.OSPlugin
+		}
+		if !known {
+			errs = append(errs, fmt.Errorf("osPlugin %q is not an OS plugin available on this system (available: %s)", c.OSPlugin, strings.Join(names, ", ")))
+		}
+	}
+
+	if c.StateDir == "" {
+		errs = append(errs, fmt.Errorf("stateDir is required"))
+	}
+
+	if c.HeartbeatIntervalSeconds <= 0 {
+		errs = append(errs, fmt.Errorf("heartbeatIntervalSeconds must be greater than 0"))
+	}
+
+	if c.TunnelTimeoutMs < 0 {
+		errs = append(errs, fmt.Errorf("tunnelTimeoutMs cannot be negative"))
+	}
+
+	if c.HandshakeTimeoutMs < 0 {
+		errs = append(errs, fmt.Errorf("handshakeTimeoutMs cannot be negative"))
+	}
+
+	if c.TCPKeepAliveSeconds < -1 {
+		errs = append(errs, fmt.Errorf("tcpKeepAliveSeconds must be -1 (disabled), 0 (default) or positive (got %d)", c.TCPKeepAliveSeconds))
+	}
+
+	if c.WriteTimeoutSeconds < 0 {
+		errs = append(errs, fmt.Errorf("writeTimeoutSeconds cannot be negative"))
+	}
+
+	if c.PingIntervalSeconds < -1 {
+		errs = append(errs, fmt.Errorf("pingIntervalSeconds must be -1 (disabled), 0 (default) or positive (got %d)", c.PingIntervalSeconds))
+	}
+
+	if c.PongTimeoutSeconds < 0 {
+		errs = append(errs, fmt.Errorf("pongTimeoutSeconds cannot be negative"))
+	}
+
+	if c.ReadBufferBytes < 0 || c.ReadBufferBytes > MaxTunnelBufferBytes {
+		errs = append(errs, fmt.Errorf("readBufferBytes must be between 0 and %d (got %d)", MaxTunnelBufferBytes, c.ReadBufferBytes))
+	}
+
+	if c.WriteBufferBytes < 0 || c.WriteBufferBytes > MaxTunnelBufferBytes {
+		errs = append(errs, fmt.Errorf("writeBufferBytes must be between 0 and %d (got %d)", MaxTunnelBufferBytes, c.WriteBufferBytes))
+	}
+
+	if c.PublicIP != "" && net.ParseIP(c.PublicIP) == nil {
+		errs = append(errs, fmt.Errorf("publicIp %q is not a valid IP address", c.PublicIP))
+	}
+
+	for _, endpoint := range c.IPEchoEndpoints {
+		if u, err := url.Parse(endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("ipEchoEndpoints entry %q must be an http(s) URL", endpoint))
+		}
+	}
+
+	if err := c.GetCollection().Validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if c.LabelScript != "" && !filepath.IsAbs(c.LabelScript) {
+		errs = append(errs, fmt.Errorf("labelScript %q must be an absolute path", c.LabelScript))
+	}
+
+	if template := c.GetAuthorizedKeysFile(); template != "" {
+		if err := validateAuthorizedKeysFile(template); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if c.CloudLabels != "" && c.CloudLabels != "aws" {
+		errs = append(errs, fmt.Errorf("cloudLabels %q is not supported (supported: aws)", c.CloudLabels))
+	}
+
+	if c.ProxyURL != "" {
+		if err := validateProxyURL(c.ProxyURL); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if (c.ClientCertPath == "") != (c.ClientKeyPath == "") {
+		errs = append(errs, fmt.Errorf("clientCertPath and clientKeyPath must be set together"))
+	}
+
+	if c.TLSInsecureSkipVerify && c.TLSCAFile != "" {
+		errs = append(errs, fmt.Errorf("tlsInsecureSkipVerify cannot be combined with tlsCaFile"))
+	}
+
+	if c.HasTLSOptions() {
+		for _, endpoint := range c.GetTunnelEndpoints() {
+			if strings.HasPrefix(endpoint, "ws://") {
+				errs = append(errs, fmt.Errorf("TLS options require wss:// tunnel endpoints, got %s", endpoint))
+			}
+		}
+	}
+
+	for _, field := range c.RequiredMetadata {
+		if !metadataFieldPattern.MatchString(field) {
+			errs = append(errs, fmt.Errorf("requiredMetadata entry %q must start with a letter and contain only letters, digits, '-' and '_'", field))
+		}
+	}
+
+	if c.BulkRevokeConcurrency <= 0 {
+		errs = append(errs, fmt.Errorf("bulkRevokeConcurrency must be greater than 0"))
+	}
+
+	if c.SessionGraceSeconds < 0 || c.SessionGraceSeconds > MaxSessionGraceSeconds {
+		errs = append(errs, fmt.Errorf("sessionGraceSeconds must be between 0 and %d", MaxSessionGraceSeconds))
+	}
+
+	if c.SessionReportSeconds < 0 || (c.SessionReportSeconds > 0 && c.SessionReportSeconds < MinSessionReportSeconds) {
+		errs = append(errs, fmt.Errorf("sessionReportSeconds must be 0 (off) or at least %d", MinSessionReportSeconds))
+	}
+
+	if c.JWTNotBeforeSeconds < 0 || c.JWTNotBeforeSeconds > MaxJWTClockSkewSeconds {
+		errs = append(errs, fmt.Errorf("jwtNotBeforeSeconds must be between 0 and %d", MaxJWTClockSkewSeconds))
+	}
+
+	if c.JWTExpiryLeewaySeconds < 0 || c.JWTExpiryLeewaySeconds > MaxJWTClockSkewSeconds {
+		errs = append(errs, fmt.Errorf("jwtExpiryLeewaySeconds must be between 0 and %d", MaxJWTClockSkewSeconds))
+	}
+
+	if c.JWTLifetimeSeconds < 0 || (c.JWTLifetimeSeconds > 0 && c.JWTLifetimeSeconds < MinJWTLifetimeSeconds) {
+		errs = append(errs, fmt.Errorf("jwtLifetimeSeconds must be 0 (default) or at least %d", MinJWTLifetimeSeconds))
+	}
+
+	if c.EndpointProbeSeconds < 0 {
+		errs = append(errs, fmt.Errorf("endpointProbeSeconds cannot be negative"))
+	}
+
+	switch c.EndpointSelection {
+	case "", EndpointSelectionLatency, EndpointSelectionPriority:
+	default:
+		errs = append(errs, fmt.Errorf("endpointSelection must be %q or %q", EndpointSelectionLatency, EndpointSelectionPriority))
+	}
+
+	if c.FailoverAfterAttempts < 0 {
+		errs = append(errs, fmt.Errorf("failoverAfterAttempts cannot be negative"))
+	}
+
+	if c.CompressResponsesOver < 0 {
+		errs = append(errs, fmt.Errorf("compressResponsesOver cannot be negative"))
+	}
+
+	if c.ShutdownDrainSeconds < 0 {
+		errs = append(errs, fmt.Errorf("shutdownDrainSeconds cannot be negative"))
+	}
+
+	if c.ControlSocket != "" && c.ControlSocket != ControlSocketDisabled && !filepath.IsAbs(c.ControlSocket) {
+		errs = append(errs, fmt.Errorf("controlSocket must be an absolute path or %q", ControlSocketDisabled))
+	}
+
+	if c.DisabledFile != "" && !filepath.IsAbs(c.DisabledFile) {
+		errs = append(errs, fmt.Errorf("disabledFile must be an absolute path"))
+	}
+
+	switch c.GetUserResolution() {
+	case UserResolutionLocal, UserResolutionUserdb:
+	default:
+		errs = append(errs, fmt.Errorf("userResolution must be %q or %q (got %q)", UserResolutionLocal, UserResolutionUserdb, c.UserResolution))
+	}
+
+	switch c.GetSudoersLayout() {
+	case SudoersLayoutFile, SudoersLayoutDropIn:
+	default:
+		errs = append(errs, fmt.Errorf("sudoersLayout must be %q or %q (got %q)", SudoersLayoutFile, SudoersLayoutDropIn, c.SudoersLayout))
+	}
+
+	if c.SELinuxUser != "" && !selinuxUserPattern.MatchString(c.SELinuxUser) {
+		errs = append(errs, fmt.Errorf("selinuxUser %q is not a valid SELinux user name", c.SELinuxUser))
+	}
+
+	if !IsBandwidthProfile(c.GetBandwidthProfile()) {
+		errs = append(errs, fmt.Errorf("bandwidthProfile must be %q or %q (got %q)", BandwidthProfileStandard, BandwidthProfileLow, c.BandwidthProfile))
+	}
+
+	if c.FetchFileMaxBytes <= 0 {
+		errs = append(errs, fmt.Errorf("fetchFileMaxBytes must be greater than 0"))
+	}
+
+	for i, sink := range c.AuditSinks {
+		errs = append(errs, sink.validate(i)...)
+	}
+
+	errs = append(errs, c.Reconnect.validate()...)
+	errs = append(errs, c.ScriptLimits.validate()...)
+
+	if c.SessionRecording != nil && c.SessionRecording.Enabled {
+		errs = append(errs, c.SessionRecording.validate()...)
+	}
+
+	targetNames := make(map[string]bool)
+	for i, target := range c.Targets {
+		errs = append(errs, target.validate(i)...)
+		if target.Name != "" && targetNames[target.Name] {
+			errs = append(errs, fmt.Errorf("targets[%d]: name %q is used by another target", i, target.Name))
+		}
+		targetNames[target.Name] = true
+	}
+	if c.TargetCache != nil && c.TargetCache.Enabled {
+		errs = append(errs, c.TargetCache.validate()...)
+	}
+
+	for _, pattern := range c.FetchFileAllowlist {
+		if !filepath.IsAbs(pattern) {
+			errs = append(errs, fmt.Errorf("fetchFileAllowlist entry %q must be an absolute path", pattern))
+		} else if _, err := filepath.Match(pattern, ""); err != nil {
+			errs = append(errs, fmt.Errorf("fetchFileAllowlist entry %q is not a valid pattern: %w", pattern, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateAuthorizedKeysFile accepts templates that give every user their
+// own file, so a key granted to one user never authorizes another
+func validateAuthorizedKeysFile(template string) error {
+	if !strings.HasPrefix(template, "/") && !strings.HasPrefix(template, "%h/") {
+		return fmt.Errorf("authorizedKeysLayout must be %q, %q, %q or a path starting with / or %%h/ (got %q)", AuthorizedKeysLayoutAuto, AuthorizedKeysLayoutHome, AuthorizedKeysLayoutCentral, template)
+	}
+	if strings.ContainsAny(template, " \t\r\n") {
+		return fmt.Errorf("authorizedKeysLayout %q cannot contain whitespace", template)
+	}
+
+	perUser := false
+	for i := 0; i < len(template); i++ {
+		if template[i] != '%' {
+			continue
+		}
+		if i+1 == len(template) {
+			return fmt.Errorf("authorizedKeysLayout %q ends with a lone %%", template)
+		}
+		i++
+		switch template[i] {
+		case 'h', 'u', 'U':
+			perUser = true
+		case '%':
+		default:
+			return fmt.Errorf("authorizedKeysLayout %q uses unsupported token %%%c (supported: %%h, %%u, %%U, %%%%)", template, template[i])
+		}
+	}
+	if !perUser {
+		return fmt.Errorf("authorizedKeysLayout %q must contain %%u, %%U or %%h so each user has their own file", template)
+	}
+	return nil
+}
+
+// validateProxyURL accepts http:// proxies, which the tunnel reaches with CONNECT
+func validateProxyURL(proxyURL string) error {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return fmt.Errorf("proxyUrl is not a valid URL: %w", err)
+	}
+	if u.Scheme != "http" {
+		return fmt.Errorf("proxyUrl must use the http:// scheme (got %q)", u.Scheme)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("proxyUrl must include a host")
+	}
+	return nil
+}
+
+func isSupportedVersion(version string) bool {
+	for _, supported := range SupportedConfigVersions {
+		if version == supported {
+			return true
+		}
+	}
+	return false
+}
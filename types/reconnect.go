@@ -0,0 +1,89 @@
+package types
+
+import (
+	"fmt"
+	"time"
+
+	"p0-ssh-agent/internal/backoff"
+)
+
+// Defaults of reconnect
+const (
+	DefaultReconnectInitialDelaySeconds = 1
+	DefaultReconnectMaxDelaySeconds     = 30
+	DefaultReconnectResetAfterSeconds   = 60
+)
+
+// Reconnect is the policy for reconnecting to the tunnel: delays that double
+// from initialDelaySeconds up to maxDelaySeconds with jitter, and optionally
+// a limit after which the agent exits for its service manager to restart it
+type Reconnect struct {
+	InitialDelaySeconds int            `json:"initialDelaySeconds,omitempty" yaml:"initialDelaySeconds,omitempty"`
+	MaxDelaySeconds     int            `json:"maxDelaySeconds,omitempty" yaml:"maxDelaySeconds,omitempty"`
+	Jitter              backoff.Jitter `json:"jitter,omitempty" yaml:"jitter,omitempty"`
+
+	// MaxAttempts and MaxElapsedSeconds bound a run of failed attempts;
+	// zero retries indefinitely
+	MaxAttempts       int `json:"maxAttempts,omitempty" yaml:"maxAttempts,omitempty"`
+	MaxElapsedSeconds int `json:"maxElapsedSeconds,omitempty" yaml:"maxElapsedSeconds,omitempty"`
+
+	// ResetAfterSeconds is how long a connection must last before the delays
+	// start over, so a flapping connection keeps backing off
+	ResetAfterSeconds int `json:"resetAfterSeconds,omitempty" yaml:"resetAfterSeconds,omitempty"`
+}
+
+// GetInitialDelay returns the delay after the first failed attempt
+func (r Reconnect) GetInitialDelay() time.Duration {
+	if r.InitialDelaySeconds <= 0 {
+		return DefaultReconnectInitialDelaySeconds * time.Second
+	}
+	return time.Duration(r.InitialDelaySeconds) * time.Second
+}
+
+// GetMaxDelay returns the longest delay between attempts
+func (r Reconnect) GetMaxDelay() time.Duration {
+	if r.MaxDelaySeconds <= 0 {
+		return DefaultReconnectMaxDelaySeconds * time.Second
+	}
+	return time.Duration(r.MaxDelaySeconds) * time.Second
+}
+
+// GetJitter returns the jitter applied to delays
+func (r Reconnect) GetJitter() backoff.Jitter {
+	if r.Jitter == "" {
+		return backoff.JitterFull
+	}
+	return r.Jitter
+}
+
+// GetMaxElapsed returns how long attempts may fail before the agent gives
+// up, or zero for no limit
+func (r Reconnect) GetMaxElapsed() time.Duration {
+	return time.Duration(r.MaxElapsedSeconds) * time.Second
+}
+
+// GetResetAfter returns how long a connection must last before the delays
+// start over
+func (r Reconnect) GetResetAfter() time.Duration {
+	if r.ResetAfterSeconds <= 0 {
+		return DefaultReconnectResetAfterSeconds * time.Second
+	}
+	return time.Duration(r.ResetAfterSeconds) * time.Second
+}
+
+// validate reports the problems of the reconnect section
+func (r Reconnect) validate() []error {
+	var errs []error
+	if r.InitialDelaySeconds < 0 || r.MaxDelaySeconds < 0 || r.MaxAttempts < 0 || r.MaxElapsedSeconds < 0 || r.ResetAfterSeconds < 0 {
+		errs = append(errs, fmt.Errorf("reconnect: settings cannot be negative"))
+	}
+	if r.GetMaxDelay() < r.GetInitialDelay() {
+		errs = append(errs, fmt.Errorf("reconnect: maxDelaySeconds (%s) cannot be less than initialDelaySeconds (%s)", r.GetMaxDelay(), r.GetInitialDelay()))
+	}
+	switch r.GetJitter() {
+	case backoff.JitterFull, backoff.JitterEqual, backoff.JitterNone:
+	default:
+		errs = append(errs, fmt.Errorf("reconnect: jitter must be %s, %s or %s (got %q)", backoff.JitterFull, backoff.JitterEqual, backoff.JitterNone, r.Jitter))
+	}
+	return errs
+}
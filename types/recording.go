@@ -0,0 +1,211 @@
+package types
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"time"
+)
+
+// Recorders of sessionRecording
+const (
+	// SessionRecorderScript records with script(1) from util-linux, which
+	// logs keystrokes as well as output from version 2.35
+	SessionRecorderScript = "script"
+
+	// SessionRecorderTlog records with tlog-rec-session
+	SessionRecorderTlog = "tlog"
+)
+
+// Destinations of sessionRecording
+const (
+	// RecordingDestinationLocal moves finished recordings to a directory on the host
+	RecordingDestinationLocal = "local"
+
+	// RecordingDestinationS3 uploads each file of a recording as an object to an S3 bucket
+	RecordingDestinationS3 = "s3"
+
+	// RecordingDestinationTunnel sends recordings to the P0 backend over the tunnel
+	RecordingDestinationTunnel = "tunnel"
+)
+
+// Defaults of sessionRecording
+const (
+	// DefaultRecordingSpoolDir is where sessions are recorded while they run
+	DefaultRecordingSpoolDir = "/var/spool/p0-ssh-agent/sessions"
+
+	// DefaultRecordingDir receives finished recordings with the local destination
+	DefaultRecordingDir = "/var/log/p0-ssh-agent/sessions"
+
+	// DefaultRecordingTimeoutSeconds bounds the upload of one recording
+	DefaultRecordingTimeoutSeconds = 60
+
+	// DefaultMaxRecordingBytes bounds what one session may record
+	DefaultMaxRecordingBytes = 256 << 20
+
+	// DefaultMaxSpoolBytes bounds the recordings waiting in the spool
+	DefaultMaxSpoolBytes = 2 << 30
+)
+
+// RecordingSocketPath is where the agent takes the sessions the wrappers of
+// recorded users send it
+const RecordingSocketPath = "/run/p0-ssh-agent/recording.sock"
+
+// SessionRecording records the terminal sessions of users the agent grants
+// access to and ships the recordings to Destination once they finish
+type SessionRecording struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+
+	// Recorder is script (default) or tlog
+	Recorder string `json:"recorder,omitempty" yaml:"recorder,omitempty"`
+
+	// SpoolDir holds recordings until they are shipped
+	SpoolDir string `json:"spoolDir,omitempty" yaml:"spoolDir,omitempty"`
+
+	// Destination is local (default), s3 or tunnel
+	Destination string `json:"destination,omitempty" yaml:"destination,omitempty"`
+
+	// Dir receives recordings with the local destination
+	Dir string `json:"dir,omitempty" yaml:"dir,omitempty"`
+
+	// Bucket, Region, Prefix and Endpoint place the objects of the s3
+	// destination, as for s3 audit sinks
+	Bucket   string `json:"bucket,omitempty" yaml:"bucket,omitempty"`
+	Region   string `json:"region,omitempty" yaml:"region,omitempty"`
+	Prefix   string `json:"prefix,omitempty" yaml:"prefix,omitempty"`
+	Endpoint string `json:"endpoint,omitempty" yaml:"endpoint,omitempty"`
+
+	TimeoutSeconds int `json:"timeoutSeconds,omitempty" yaml:"timeoutSeconds,omitempty"`
+
+	// MaxRecordingBytes ends a session once it recorded that much
+	MaxRecordingBytes int64 `json:"maxRecordingBytes,omitempty" yaml:"maxRecordingBytes,omitempty"`
+
+	// MaxSpoolBytes ends sessions and refuses new ones while the spool holds that much
+	MaxSpoolBytes int64 `json:"maxSpoolBytes,omitempty" yaml:"maxSpoolBytes,omitempty"`
+}
+
+// GetRecorder returns the recorder, script unless configured
+func (r *SessionRecording) GetRecorder() string {
+	if r.Recorder == "" {
+		return SessionRecorderScript
+	}
+	return r.Recorder
+}
+
+// GetSpoolDir returns where sessions are recorded while they run
+func (r *SessionRecording) GetSpoolDir() string {
+	if r.SpoolDir == "" {
+		return DefaultRecordingSpoolDir
+	}
+	return r.SpoolDir
+}
+
+// GetDestination returns where finished recordings go, local unless configured
+func (r *SessionRecording) GetDestination() string {
+	if r.Destination == "" {
+		return RecordingDestinationLocal
+	}
+	return r.Destination
+}
+
+// GetDir returns the directory of the local destination
+func (r *SessionRecording) GetDir() string {
+	if r.Dir == "" {
+		return DefaultRecordingDir
+	}
+	return r.Dir
+}
+
+// GetTimeout returns how long shipping one recording may take
+func (r *SessionRecording) GetTimeout() time.Duration {
+	if r.TimeoutSeconds <= 0 {
+		return DefaultRecordingTimeoutSeconds * time.Second
+	}
+	return time.Duration(r.TimeoutSeconds) * time.Second
+}
+
+// GetMaxRecordingBytes returns how much one session may record
+func (r *SessionRecording) GetMaxRecordingBytes() int64 {
+	if r.MaxRecordingBytes <= 0 {
+		return DefaultMaxRecordingBytes
+	}
+	return r.MaxRecordingBytes
+}
+
+// GetMaxSpoolBytes returns how much the spool may hold
+func (r *SessionRecording) GetMaxSpoolBytes() int64 {
+	if r.MaxSpoolBytes <= 0 {
+		return DefaultMaxSpoolBytes
+	}
+	return r.MaxSpoolBytes
+}
+
+// validate reports the problems of the sessionRecording section
+func (r *SessionRecording) validate() []error {
+	var errs []error
+
+	switch r.GetRecorder() {
+	case SessionRecorderScript, SessionRecorderTlog:
+	default:
+		errs = append(errs, fmt.Errorf("sessionRecording: recorder must be %q or %q (got %q)", SessionRecorderScript, SessionRecorderTlog, r.Recorder))
+	}
+
+	if !filepath.IsAbs(r.GetSpoolDir()) {
+		errs = append(errs, fmt.Errorf("sessionRecording: spoolDir %q must be an absolute path", r.SpoolDir))
+	}
+
+	switch r.GetDestination() {
+	case RecordingDestinationLocal:
+		if !filepath.IsAbs(r.GetDir()) {
+			errs = append(errs, fmt.Errorf("sessionRecording: dir %q must be an absolute path", r.Dir))
+		} else if filepath.Clean(r.GetDir()) == filepath.Clean(r.GetSpoolDir()) {
+			errs = append(errs, fmt.Errorf("sessionRecording: dir must differ from spoolDir"))
+		}
+	case RecordingDestinationS3:
+		if r.Bucket == "" {
+			errs = append(errs, fmt.Errorf("sessionRecording: the s3 destination needs a bucket"))
+		}
+		if r.Region == "" {
+			errs = append(errs, fmt.Errorf("sessionRecording: the s3 destination needs a region"))
+		}
+		if r.Endpoint != "" {
+			if u, err := url.Parse(r.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				errs = append(errs, fmt.Errorf("sessionRecording: endpoint %q must be an http(s) URL", r.Endpoint))
+			}
+		}
+	case RecordingDestinationTunnel:
+	default:
+		errs = append(errs, fmt.Errorf("sessionRecording: destination must be %q, %q or %q (got %q)", RecordingDestinationLocal, RecordingDestinationS3, RecordingDestinationTunnel, r.Destination))
+	}
+
+	if r.TimeoutSeconds < 0 {
+		errs = append(errs, fmt.Errorf("sessionRecording: timeoutSeconds cannot be negative"))
+	}
+	if r.MaxRecordingBytes < 0 {
+		errs = append(errs, fmt.Errorf("sessionRecording: maxRecordingBytes cannot be negative"))
+	}
+	if r.MaxSpoolBytes < 0 {
+		errs = append(errs, fmt.Errorf("sessionRecording: maxSpoolBytes cannot be negative"))
+	}
+
+	return errs
+}
+
+// RecordingFile is one file of a session recording sent over the tunnel
+type RecordingFile struct {
+	Name string `json:"name"`
+
+	// Data is the content of the file, base64-encoded
+	Data string `json:"data"`
+}
+
+// UploadSessionRecordingRequest carries a finished session recording to the
+// backend with the tunnel destination
+type UploadSessionRecordingRequest struct {
+	ClientID   string          `json:"clientId"`
+	HostID     string          `json:"hostId,omitempty"`
+	RequestIDs []string        `json:"requestIds"`
+	UserName   string          `json:"userName"`
+	Recording  string          `json:"recording"`
+	Files      []RecordingFile `json:"files"`
+}
@@ -0,0 +1,94 @@
+package types
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Defaults of scriptLimits
+const (
+	DefaultScriptTimeoutSeconds = 300
+	DefaultScriptMaxOutputBytes = 1 << 20
+)
+
+// ScriptLimits bounds provisioning commands and the processes they start, so
+// that e.g. a userdel hung on an NFS home cannot hold up the agent
+type ScriptLimits struct {
+	// TimeoutSeconds bounds the wall time of a provisioning command; -1
+	// lets commands run to completion
+	TimeoutSeconds int `json:"timeoutSeconds,omitempty" yaml:"timeoutSeconds,omitempty"`
+
+	// CommandTimeoutSeconds overrides TimeoutSeconds by command name, e.g.
+	// provisionSession
+	CommandTimeoutSeconds map[string]int `json:"commandTimeoutSeconds,omitempty" yaml:"commandTimeoutSeconds,omitempty"`
+
+	// MaxOutputBytes bounds the output of a started process kept in memory
+	MaxOutputBytes int `json:"maxOutputBytes,omitempty" yaml:"maxOutputBytes,omitempty"`
+
+	// Nice runs started processes with this niceness on Unix; 0 leaves it
+	Nice int `json:"nice,omitempty" yaml:"nice,omitempty"`
+
+	// Cgroup starts processes in this cgroup v2 directory on Linux, whose
+	// cpu.max, memory.max and the like then apply to them
+	Cgroup string `json:"cgroup,omitempty" yaml:"cgroup,omitempty"`
+}
+
+// GetDefaultTimeout returns how long commands without a timeout of their own
+// may run, or zero for no limit
+func (l ScriptLimits) GetDefaultTimeout() time.Duration {
+	return scriptTimeout(l.TimeoutSeconds)
+}
+
+// GetTimeout returns how long command may run, or zero for no limit.
+// Command names are case-insensitive, as viper lowercases map keys.
+func (l ScriptLimits) GetTimeout(command string) time.Duration {
+	for name, seconds := range l.CommandTimeoutSeconds {
+		if strings.EqualFold(name, command) {
+			return scriptTimeout(seconds)
+		}
+	}
+	return l.GetDefaultTimeout()
+}
+
+func scriptTimeout(seconds int) time.Duration {
+	switch {
+	case seconds < 0:
+		return 0
+	case seconds == 0:
+		return DefaultScriptTimeoutSeconds * time.Second
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// GetMaxOutputBytes returns how much output of a started process is kept
+func (l ScriptLimits) GetMaxOutputBytes() int {
+	if l.MaxOutputBytes <= 0 {
+		return DefaultScriptMaxOutputBytes
+	}
+	return l.MaxOutputBytes
+}
+
+// validate reports the problems of the scriptLimits section
+func (l ScriptLimits) validate() []error {
+	var errs []error
+	if l.TimeoutSeconds < -1 {
+		errs = append(errs, fmt.Errorf("scriptLimits: timeoutSeconds must be positive, or -1 for no limit"))
+	}
+	for command, seconds := range l.CommandTimeoutSeconds {
+		if seconds < -1 {
+			errs = append(errs, fmt.Errorf("scriptLimits: commandTimeoutSeconds of %s must be positive, or -1 for no limit", command))
+		}
+	}
+	if l.MaxOutputBytes < 0 {
+		errs = append(errs, fmt.Errorf("scriptLimits: maxOutputBytes cannot be negative"))
+	}
+	if l.Nice < -20 || l.Nice > 19 {
+		errs = append(errs, fmt.Errorf("scriptLimits: nice must be between -20 and 19 (got %d)", l.Nice))
+	}
+	if l.Cgroup != "" && !filepath.IsAbs(l.Cgroup) {
+		errs = append(errs, fmt.Errorf("scriptLimits: cgroup must be an absolute path"))
+	}
+	return errs
+}
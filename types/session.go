@@ -0,0 +1,30 @@
+package types
+
+// ActiveSession is a login on the host as recorded in utmp
+type ActiveSession struct {
+	UserName string `json:"userName"`
+
+	// TTY is the terminal of the login, e.g. pts/0
+	TTY string `json:"tty"`
+
+	// Host is where the login came from, as sshd recorded it
+	Host string `json:"host,omitempty"`
+
+	PID       int    `json:"pid,omitempty"`
+	StartedAt string `json:"startedAt"`
+
+	// Managed is set for users the agent holds an active grant for, whose
+	// requests are listed in RequestIDs
+	Managed    bool     `json:"managed"`
+	RequestIDs []string `json:"requestIds,omitempty"`
+}
+
+// ActiveSessionsNotification reports every session logged in on the host. It
+// is sent as the activeSessions notification whenever the sessions change,
+// and periodically while they do not.
+type ActiveSessionsNotification struct {
+	ClientID    string          `json:"clientId"`
+	HostID      string          `json:"hostId,omitempty"`
+	CollectedAt string          `json:"collectedAt"`
+	Sessions    []ActiveSession `json:"sessions"`
+}
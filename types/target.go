@@ -0,0 +1,216 @@
+package types
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Defaults of targets and targetCache
+const (
+	// DefaultTargetTimeoutSeconds bounds a request forwarded to a target
+	DefaultTargetTimeoutSeconds = 30
+
+	// DefaultTargetCacheEntries bounds the responses kept by targetCache
+	DefaultTargetCacheEntries = 256
+
+	// DefaultTargetCacheEntryBytes is the largest body targetCache keeps
+	DefaultTargetCacheEntryBytes = 1 << 20
+
+	// DefaultTargetCacheMaxTTLSeconds caps how long a response is served from
+	// targetCache, whatever its Cache-Control allows
+	DefaultTargetCacheMaxTTLSeconds = 300
+)
+
+// Target is an HTTP service on the host, or reachable from it, that forwarded
+// requests are routed to instead of being run as provisioning commands. A
+// request without a provisioning command goes to the first target whose
+// PathPrefix and Header both match; at least one of them must be set.
+type Target struct {
+	Name string `json:"name" yaml:"name"`
+
+	// URL is where requests go, e.g. http://localhost:3000
+	URL string `json:"url" yaml:"url"`
+
+	// PathPrefix matches request paths equal to it or below it, e.g. /grafana
+	// matches /grafana and /grafana/api/health but not /grafana2
+	PathPrefix string `json:"pathPrefix,omitempty" yaml:"pathPrefix,omitempty"`
+
+	// StripPrefix removes PathPrefix from the path sent to URL
+	StripPrefix bool `json:"stripPrefix,omitempty" yaml:"stripPrefix,omitempty"`
+
+	// Header matches requests carrying it with the value HeaderValue, or with
+	// any value when HeaderValue is empty. Names are case-insensitive.
+	Header      string `json:"header,omitempty" yaml:"header,omitempty"`
+	HeaderValue string `json:"headerValue,omitempty" yaml:"headerValue,omitempty"`
+
+	TimeoutSeconds int        `json:"timeoutSeconds,omitempty" yaml:"timeoutSeconds,omitempty"`
+	TLS            *TargetTLS `json:"tls,omitempty" yaml:"tls,omitempty"`
+}
+
+// TargetTLS configures connections to an https target
+type TargetTLS struct {
+	// CAFile holds the PEM certificates trusted for the target instead of the
+	// system roots
+	CAFile string `json:"caFile,omitempty" yaml:"caFile,omitempty"`
+
+	// CertFile and KeyFile are a client certificate presented to the target
+	CertFile string `json:"certFile,omitempty" yaml:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty" yaml:"keyFile,omitempty"`
+
+	// ServerName is checked against the target's certificate instead of the
+	// host of URL
+	ServerName string `json:"serverName,omitempty" yaml:"serverName,omitempty"`
+
+	// InsecureSkipVerify accepts any certificate; for testing only
+	InsecureSkipVerify bool `json:"insecureSkipVerify,omitempty" yaml:"insecureSkipVerify,omitempty"`
+}
+
+// GetTimeout returns how long a request forwarded to the target may take
+func (t Target) GetTimeout() time.Duration {
+	if t.TimeoutSeconds <= 0 {
+		return DefaultTargetTimeoutSeconds * time.Second
+	}
+	return time.Duration(t.TimeoutSeconds) * time.Second
+}
+
+// validate reports the problems of the targets entry at index
+func (t Target) validate(index int) []error {
+	name := fmt.Sprintf("targets[%d]", index)
+	if t.Name != "" {
+		name = fmt.Sprintf("targets[%d] (%s)", index, t.Name)
+	}
+	var errs []error
+
+	if t.Name == "" {
+		errs = append(errs, fmt.Errorf("%s: name is required", name))
+	}
+	if u, err := url.Parse(t.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("%s: url %q must be an http(s) URL", name, t.URL))
+	} else if u.RawQuery != "" || u.Fragment != "" {
+		errs = append(errs, fmt.Errorf("%s: url %q cannot have a query or fragment", name, t.URL))
+	}
+
+	if t.PathPrefix == "" && t.Header == "" {
+		errs = append(errs, fmt.Errorf("%s: pathPrefix or header is required", name))
+	}
+	if t.PathPrefix != "" && !strings.HasPrefix(t.PathPrefix, "/") {
+		errs = append(errs, fmt.Errorf("%s: pathPrefix %q must start with /", name, t.PathPrefix))
+	} else if t.PathPrefix != "" && strings.Trim(t.PathPrefix, "/") == "" {
+		errs = append(errs, fmt.Errorf("%s: pathPrefix %q would match every request", name, t.PathPrefix))
+	}
+	if t.StripPrefix && t.PathPrefix == "" {
+		errs = append(errs, fmt.Errorf("%s: stripPrefix needs a pathPrefix", name))
+	}
+	if t.Header == "" && t.HeaderValue != "" {
+		errs = append(errs, fmt.Errorf("%s: headerValue needs a header", name))
+	}
+	if t.Header != "" && strings.ToLower(t.Header) == "authorization" {
+		errs = append(errs, fmt.Errorf("%s: routing on the authorization header is not allowed", name))
+	}
+	if strings.ContainsAny(t.Header, " \t\r\n:") {
+		errs = append(errs, fmt.Errorf("%s: header %q is not a valid header name", name, t.Header))
+	}
+
+	if t.TimeoutSeconds < 0 {
+		errs = append(errs, fmt.Errorf("%s: timeoutSeconds cannot be negative", name))
+	}
+
+	if t.TLS != nil {
+		if (t.TLS.CertFile == "") != (t.TLS.KeyFile == "") {
+			errs = append(errs, fmt.Errorf("%s: tls certFile and keyFile must be set together", name))
+		}
+		for _, file := range []string{t.TLS.CAFile, t.TLS.CertFile, t.TLS.KeyFile} {
+			if file != "" && !filepath.IsAbs(file) {
+				errs = append(errs, fmt.Errorf("%s: tls file %q must be an absolute path", name, file))
+			}
+		}
+	}
+
+	return errs
+}
+
+// TargetCache keeps GET responses of targets in memory for as long as their
+// Cache-Control allows, to spare services polled by dashboards
+type TargetCache struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+
+	MaxEntries    int `json:"maxEntries,omitempty" yaml:"maxEntries,omitempty"`
+	MaxEntryBytes int `json:"maxEntryBytes,omitempty" yaml:"maxEntryBytes,omitempty"`
+	MaxTTLSeconds int `json:"maxTtlSeconds,omitempty" yaml:"maxTtlSeconds,omitempty"`
+}
+
+// GetMaxEntries returns how many responses the cache keeps
+func (c *TargetCache) GetMaxEntries() int {
+	if c.MaxEntries <= 0 {
+		return DefaultTargetCacheEntries
+	}
+	return c.MaxEntries
+}
+
+// GetMaxEntryBytes returns the largest body the cache keeps
+func (c *TargetCache) GetMaxEntryBytes() int {
+	if c.MaxEntryBytes <= 0 {
+		return DefaultTargetCacheEntryBytes
+	}
+	return c.MaxEntryBytes
+}
+
+// GetMaxTTL returns the longest a response is served from the cache
+func (c *TargetCache) GetMaxTTL() time.Duration {
+	if c.MaxTTLSeconds <= 0 {
+		return DefaultTargetCacheMaxTTLSeconds * time.Second
+	}
+	return time.Duration(c.MaxTTLSeconds) * time.Second
+}
+
+// validate reports the problems of the targetCache section
+func (c *TargetCache) validate() []error {
+	var errs []error
+	if c.MaxEntries < 0 {
+		errs = append(errs, fmt.Errorf("targetCache: maxEntries cannot be negative"))
+	}
+	if c.MaxEntryBytes < 0 {
+		errs = append(errs, fmt.Errorf("targetCache: maxEntryBytes cannot be negative"))
+	}
+	if c.MaxTTLSeconds < 0 {
+		errs = append(errs, fmt.Errorf("targetCache: maxTtlSeconds cannot be negative"))
+	}
+	return errs
+}
+
+// TargetStreamMessage carries part of an event stream, or one WebSocket
+// message, from a target to the backend as a targetStream notification. Seq
+// counts from 0 per stream, as notifications can arrive before the reply
+// that announced the stream. The last message has Done set, with Error when
+// the stream failed rather than ended.
+type TargetStreamMessage struct {
+	ClientID string `json:"clientId"`
+	StreamID string `json:"streamId"`
+	Seq      int    `json:"seq"`
+	Data     string `json:"data,omitempty"`
+
+	// ContentEncoding is ContentEncodingBase64 for binary data
+	ContentEncoding string `json:"contentEncoding,omitempty"`
+
+	Done  bool   `json:"done,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// TargetStreamSendRequest passes a message from the backend to the target of
+// a WebSocket stream
+type TargetStreamSendRequest struct {
+	StreamID string `json:"streamId"`
+	Data     string `json:"data"`
+
+	// ContentEncoding is ContentEncodingBase64 for a binary message
+	ContentEncoding string `json:"contentEncoding,omitempty"`
+}
+
+// TargetStreamCloseRequest ends a stream the backend no longer reads, e.g.
+// because the browser went away
+type TargetStreamCloseRequest struct {
+	StreamID string `json:"streamId"`
+}
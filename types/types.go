@@ -1,6 +1,7 @@
 package types
 
 import (
+	"encoding/json"
 	"time"
 )
 
@@ -11,6 +12,10 @@ type ForwardedRequest struct {
 	Params  map[string]interface{}   `json:"params"`
 	Data    interface{}              `json:"data"`
 	Options *ForwardedRequestOptions `json:"options,omitempty"`
+
+	// ContentEncoding is ContentEncodingBase64 when Data is the base64 of a
+	// binary body, see DecodeBody
+	ContentEncoding string `json:"contentEncoding,omitempty"`
 }
 
 type ForwardedRequestOptions struct {
@@ -22,42 +27,368 @@ type ForwardedResponse struct {
 	Status     int                    `json:"status"`
 	StatusText string                 `json:"statusText"`
 	Data       interface{}            `json:"data"`
+	Signature  string                 `json:"signature,omitempty"`
+
+	// ContentEncoding is set when Data is a compressed string, see ContentEncodingGzipBase64
+	ContentEncoding string `json:"contentEncoding,omitempty"`
+
+	// StreamID is set when a target answered with an event stream or
+	// accepted a WebSocket; the body follows in targetStream notifications
+	StreamID string `json:"streamId,omitempty"`
+}
+
+// ContentEncodingGzipBase64 marks Data as the base64 of the gzipped JSON encoding of the original data
+const ContentEncodingGzipBase64 = "gzip+base64"
+
+// ContentEncodingBase64 marks Data as the base64 of a binary body, sent to or returned by a target
+const ContentEncodingBase64 = "base64"
+
+// SignedResponse is the JWS payload of ForwardedResponse.Signature. It
+// repeats the response so the backend can use the verified copy, and binds it
+// to the request through a digest of the forwarded params.
+type SignedResponse struct {
+	ClientID      string      `json:"clientId"`
+	RequestDigest string      `json:"requestDigest"`
+	Status        int         `json:"status"`
+	Data          interface{} `json:"data"`
+	IssuedAt      int64       `json:"iat"`
+
+	// ContentEncoding mirrors ForwardedResponse.ContentEncoding; compressed data is signed as sent
+	ContentEncoding string `json:"contentEncoding,omitempty"`
+}
+
+type SetClientIDRequest struct {
+	ClientID    string             `json:"clientId"`
+	Annotations []Annotation       `json:"annotations,omitempty"`
+	Backlog     *GrantBacklog      `json:"backlog,omitempty"`
+	Interfaces  []NetworkInterface `json:"interfaces,omitempty"`
+	Labels      []string           `json:"labels,omitempty"`
+	Endpoint    *TunnelEndpoint    `json:"endpoint,omitempty"`
+	Omitted     []string           `json:"omitted,omitempty"`
+
+	// SSHD reports whether SSH logins to the host can work at all
+	SSHD *SSHDHealth `json:"sshd,omitempty"`
+
+	// Disabled is set while the host's kill switch refuses grants
+	Disabled *HostDisabled `json:"disabled,omitempty"`
+
+	// AuditHead is the newest entry of the audit log. The backend keeps it as
+	// an anchor, so a log truncated or rewritten on the host no longer matches.
+	AuditHead *AuditHead `json:"auditHead,omitempty"`
+
+	// BandwidthProfile is set when the agent runs the low bandwidth profile,
+	// which leaves out Interfaces
+	BandwidthProfile string `json:"bandwidthProfile,omitempty"`
 }
 
-type Config struct {
-	Version                  string   `json:"version" yaml:"version"`
-	OrgID                    string   `json:"orgId" yaml:"orgId"`
-	HostID                   string   `json:"hostId" yaml:"hostId"`
-	Hostname                 string   `json:"hostname" yaml:"hostname"`
-	KeyPath                  string   `json:"keyPath" yaml:"keyPath"`
-	TunnelHost               string   `json:"tunnelHost" yaml:"tunnelHost"`
-	Labels                   []string `json:"labels" yaml:"labels"`
-	EnvironmentId            string   `json:"environmentId" yaml:"environmentId"`
-	HeartbeatIntervalSeconds int      `json:"heartbeatIntervalSeconds" yaml:"heartbeatIntervalSeconds"`
-	DryRun                   bool     `json:"dryRun" yaml:"dryRun"`
+// AuditHead identifies an audit log entry by its sequence number and hash
+type AuditHead struct {
+	Seq  int64  `json:"seq"`
+	Hash string `json:"hash"`
 }
 
-func (c *Config) GetClientID() string {
-	return c.OrgID + ":" + c.HostID + ":ssh"
+// SetClientIDResponse acknowledges a heartbeat. OK is false when the backend
+// no longer recognizes the client, e.g. after it was deregistered or its key
+// was revoked; backends that reply without it are taken to acknowledge.
+type SetClientIDResponse struct {
+	OK       *bool  `json:"ok,omitempty"`
+	ClientID string `json:"clientId,omitempty"`
+	Error    string `json:"error,omitempty"`
 }
 
+// SetBandwidthProfileRequest switches the bandwidth profile until the agent
+// restarts. An empty profile returns to the configured one.
+type SetBandwidthProfileRequest struct {
+	Profile string `json:"profile"`
+}
 
-func (c *Config) GetHeartbeatInterval() time.Duration {
-	return time.Duration(c.HeartbeatIntervalSeconds) * time.Second
+// SetBandwidthProfileResponse reports the profile in effect and where it was set
+type SetBandwidthProfileResponse struct {
+	Profile                  string `json:"profile"`
+	Source                   string `json:"source"`
+	HeartbeatIntervalSeconds int    `json:"heartbeatIntervalSeconds"`
 }
 
+// DescribeAgentResponse reports what this agent build supports and which
+// optional features its configuration enables, for the backend's per-host
+// capability matrix
+type DescribeAgentResponse struct {
+	Version                 string         `json:"version"`
+	GitCommit               string         `json:"gitCommit"`
+	BuildTime               string         `json:"buildTime"`
+	GoVersion               string         `json:"goVersion"`
+	OS                      string         `json:"os"`
+	Arch                    string         `json:"arch"`
+	ConfigVersion           string         `json:"configVersion"`
+	SupportedConfigVersions []string       `json:"supportedConfigVersions"`
+	Commands                []string       `json:"commands"`
+	Methods                 []string       `json:"methods"`
+	Features                []AgentFeature `json:"features"`
+}
 
-type SetClientIDRequest struct {
+// AgentFeature is one row of the capability matrix. Value carries the
+// selected mode of features that have several, such as bandwidthProfile.
+type AgentFeature struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+	Value   string `json:"value,omitempty"`
+}
+
+// UndeliveredResult is a response the agent could not send because the
+// tunnel was down. RequestDigest is the hex SHA-256 of the request params, as
+// in signed responses, so the backend can match it to the request it sent.
+type UndeliveredResult struct {
+	ID            string          `json:"id"`
+	RecordedAt    time.Time       `json:"recordedAt"`
+	Method        string          `json:"method"`
+	RequestDigest string          `json:"requestDigest"`
+	RequestID     string          `json:"requestId,omitempty"`
+	Command       string          `json:"command,omitempty"`
+	UserName      string          `json:"userName,omitempty"`
+	Action        string          `json:"action,omitempty"`
+	Response      json.RawMessage `json:"response"`
+	Attempts      int             `json:"attempts"`
+	LastError     string          `json:"lastError,omitempty"`
+}
+
+// DeliverResultsRequest hands journaled responses to the backend after a reconnect
+type DeliverResultsRequest struct {
+	ClientID string              `json:"clientId"`
+	Results  []UndeliveredResult `json:"results"`
+}
+
+// ReplayRequest asks the backend to re-send requests of the given actions it
+// sent, or tried to send, since the agent was last in contact
+type ReplayRequest struct {
+	ClientID string   `json:"clientId"`
+	Since    string   `json:"since,omitempty"`
+	Actions  []string `json:"actions"`
+}
+
+// Reasons a goingDown call reports
+const (
+	GoingDownShutdown    = "shutdown"
+	GoingDownUpgrade     = "upgrade"
+	GoingDownMaintenance = "maintenance"
+	GoingDownRestart     = "restart"
+)
+
+// GoingDownReasons lists the reasons an operator can announce
+var GoingDownReasons = []string{GoingDownShutdown, GoingDownUpgrade, GoingDownMaintenance, GoingDownRestart}
+
+// GoingDownRequest tells the backend the agent is stopping on purpose, so it
+// can tell a deliberate restart from a crash when marking the host offline
+type GoingDownRequest struct {
 	ClientID string `json:"clientId"`
+	Reason   string `json:"reason"`
+	Message  string `json:"message,omitempty"`
+}
+
+// ReauthenticateRequest presents a fresh tunnel JWT over the connection
+// before the one it was opened with expires. ExpiresAt is an RFC 3339 time.
+type ReauthenticateRequest struct {
+	ClientID  string `json:"clientId"`
+	Token     string `json:"token"`
+	ExpiresAt string `json:"expiresAt"`
+}
+
+// ReauthenticateResponse accepts the token, or refuses it with OK false, e.g.
+// when the client's key was revoked; backends that reply without it are taken
+// to accept.
+type ReauthenticateResponse struct {
+	OK    *bool  `json:"ok,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// TunnelEndpoint reports which tunnel host the agent chose and how fast it answered
+type TunnelEndpoint struct {
+	URL        string  `json:"url"`
+	RTTMs      float64 `json:"rttMs,omitempty"`
+	Candidates int     `json:"candidates"`
+	SelectedAt string  `json:"selectedAt,omitempty"`
+	Priority   int     `json:"priority,omitempty"`
+	Reason     string  `json:"reason,omitempty"`
+}
+
+// GrantBacklog lets the backend spot hosts that are connected but not keeping up with provisioning
+type GrantBacklog struct {
+	Queued       int `json:"queued"`
+	InFlight     int `json:"inFlight"`
+	Failed       int `json:"failed"`
+	ExpiringSoon int `json:"expiringSoon"`
+	Undelivered  int `json:"undelivered"`
+}
+
+// SSHDHealth lets the backend warn requesters that the agent is reachable but
+// SSH logins to the host will fail
+type SSHDHealth struct {
+	Healthy     bool     `json:"healthy"`
+	Running     bool     `json:"running"`
+	Listening   bool     `json:"listening"`
+	ConfigValid bool     `json:"configValid"`
+	Ports       []int    `json:"ports,omitempty"`
+	Problems    []string `json:"problems,omitempty"`
+	CheckedAt   string   `json:"checkedAt"`
+}
+
+// HostDisabled describes the kill switch of a host that refuses grants: the
+// flag file, since when it is there, as an RFC 3339
+// timestamp, and the reason written on its first line
+type HostDisabled struct {
+	File   string `json:"file"`
+	Since  string `json:"since,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Annotation is an operator-provided note carried in heartbeats, e.g. "patching until 3pm"
+type Annotation struct {
+	Message   string `json:"message"`
+	Author    string `json:"author,omitempty"`
+	CreatedAt string `json:"createdAt"`
+	ExpiresAt string `json:"expiresAt,omitempty"`
+}
+
+// ProgressNotification is sent while a long-running request is still executing
+type ProgressNotification struct {
+	ClientID  string `json:"clientId"`
+	RequestID string `json:"requestId,omitempty"`
+	Command   string `json:"command"`
+	Completed int    `json:"completed"`
+	Total     int    `json:"total"`
+	Succeeded int    `json:"succeeded"`
+	Failed    int    `json:"failed"`
+}
+
+// OutputNotification streams the log lines of a provisioning request while it runs
+type OutputNotification struct {
+	ClientID  string       `json:"clientId"`
+	RequestID string       `json:"requestId,omitempty"`
+	Command   string       `json:"command"`
+	Seq       int          `json:"seq"`
+	Lines     []OutputLine `json:"lines,omitempty"`
+	Dropped   int          `json:"dropped,omitempty"`
+	Done      bool         `json:"done,omitempty"`
+}
+
+// OutputLine is one log line of a provisioning request
+type OutputLine struct {
+	Time    string `json:"time"`
+	Level   string `json:"level"`
+	Message string `json:"message"`
+}
+
+type CollectDiagnosticsRequest struct {
+	RequestID string `json:"requestId"`
+}
+
+// DiagnosticsChunk carries one base64-encoded piece of a diagnostics bundle
+type DiagnosticsChunk struct {
+	ClientID  string `json:"clientId"`
+	RequestID string `json:"requestId"`
+	Index     int    `json:"index"`
+	Total     int    `json:"total"`
+	Data      string `json:"data"`
+}
+
+type CollectDiagnosticsResponse struct {
+	RequestID string `json:"requestId"`
+	Size      int    `json:"size"`
+	Chunks    int    `json:"chunks"`
+	SHA256    string `json:"sha256"`
+}
+
+// FetchFileRequest asks for the content of one allowlisted file
+type FetchFileRequest struct {
+	RequestID string `json:"requestId"`
+	Path      string `json:"path"`
+	MaxBytes  int    `json:"maxBytes,omitempty"`
+	Tail      bool   `json:"tail,omitempty"`
+}
+
+type FetchFileResponse struct {
+	RequestID string `json:"requestId"`
+	Path      string `json:"path"`
+	Size      int64  `json:"size"`
+	Offset    int64  `json:"offset"`
+	Length    int    `json:"length"`
+	Truncated bool   `json:"truncated"`
+	SHA256    string `json:"sha256"`
+	Data      string `json:"data"`
 }
 
 type RegistrationRequest struct {
-	Hostname             string            `json:"hostname"`
-	PublicIP             string            `json:"publicIp"`
-	Fingerprint          string            `json:"fingerprint"`
-	FingerprintPublicKey string            `json:"fingerprintPublicKey"`
-	JWKPublicKey         map[string]string `json:"jwkPublicKey"`
-	Labels               []string          `json:"labels,omitempty"`
-	Timestamp            string            `json:"timestamp"`
+	Hostname             string             `json:"hostname"`
+	PublicIP             string             `json:"publicIp"`
+	Fingerprint          string             `json:"fingerprint"`
+	FingerprintPublicKey string             `json:"fingerprintPublicKey"`
+	JWKPublicKey         map[string]string  `json:"jwkPublicKey"`
+	Labels               []string           `json:"labels,omitempty"`
+	Interfaces           []NetworkInterface `json:"interfaces,omitempty"`
+	Timestamp            string             `json:"timestamp"`
+
+	// Omitted names the details disableCollection kept the agent from gathering,
+	// so an empty value is not mistaken for a failed lookup
+	Omitted []string `json:"omitted,omitempty"`
+
+	// Attestation is TPM evidence for the machine identity, when available
+	Attestation *AttestationEvidence `json:"attestation,omitempty"`
+}
+
+// AttestationEvidence is a TPM 2.0 quote of the boot PCRs signed by an
+// attestation key (AK) created under the endorsement key (EK). The quote's
+// qualifying data binds it to the agent's JWT key and the registration time.
+// No credential activation is made, so the evidence does not prove that the
+// AK belongs to the EK. Binary TPM structures are base64 encoded as
+// tpm2-tools writes them.
+type AttestationEvidence struct {
+	Format         string   `json:"format"`
+	EKCertificates []string `json:"ekCertificates,omitempty"`
+	EKPublic       string   `json:"ekPublic"`
+	AKPublic       string   `json:"akPublic"`
+	AKName         string   `json:"akName"`
+	PCRSelection   string   `json:"pcrSelection"`
+	PCRs           string   `json:"pcrs"`
+	Quote          string   `json:"quote"`
+	Signature      string   `json:"signature"`
+	QualifyingData string   `json:"qualifyingData"`
 }
 
+// EnrollmentTokenRequest asks the backend for a delegated registration
+// credential. Hosts registered with it get Labels and nothing broader.
+type EnrollmentTokenRequest struct {
+	TTLSeconds  int      `json:"ttlSeconds"`
+	MaxUses     int      `json:"maxUses"`
+	Labels      []string `json:"labels,omitempty"`
+	Description string   `json:"description,omitempty"`
+}
+
+// EnrollmentTokenResponse carries the minted credential, accepted by register
+type EnrollmentTokenResponse struct {
+	Ok        bool     `json:"ok"`
+	Token     string   `json:"token"`
+	ExpiresAt string   `json:"expiresAt"`
+	MaxUses   int      `json:"maxUses"`
+	Labels    []string `json:"labels,omitempty"`
+}
+
+// NetworkInterface lists the addresses of one interface in CIDR notation,
+// so the backend can route through internal addresses rather than the egress IP
+type NetworkInterface struct {
+	Name      string   `json:"name"`
+	MAC       string   `json:"mac,omitempty"`
+	Addresses []string `json:"addresses"`
+}
+
+// RotateKeyRequest registers a new JWT public key. The backend keeps accepting
+// the current key for OverlapSeconds so connected agents are not cut off.
+type RotateKeyRequest struct {
+	ClientID       string            `json:"clientId"`
+	JWKPublicKey   map[string]string `json:"jwkPublicKey"`
+	OverlapSeconds int               `json:"overlapSeconds"`
+}
+
+type RotateKeyResponse struct {
+	Ok               bool   `json:"ok"`
+	OldKeyValidUntil string `json:"oldKeyValidUntil,omitempty"`
+	Error            string `json:"error,omitempty"`
+}
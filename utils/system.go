@@ -14,8 +14,10 @@ import (
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
 
 	"p0-ssh-agent/internal/jwt"
+	"p0-ssh-agent/internal/osplugins"
 	"p0-ssh-agent/types"
 )
 
@@ -25,12 +27,6 @@ const (
 )
 
 var (
-	sshHostKeyPaths = []string{
-		"/etc/ssh/ssh_host_ed25519_key.pub",
-		"/etc/ssh/ssh_host_rsa_key.pub",
-		"/etc/ssh/ssh_host_ecdsa_key.pub",
-	}
-
 	publicIPServices = []string{
 		"https://api.ipify.org",
 		"https://checkip.amazonaws.com",
@@ -59,17 +55,51 @@ func GetHostname(logger *logrus.Logger, hostnameOverride string) string {
 	return hostname
 }
 
+// IPDiscoveryOptions control how the address reported at registration is found
+type IPDiscoveryOptions struct {
+	// StaticIP is reported as-is without any lookup
+	StaticIP string
+	// Endpoints replace the public IP echo services, e.g. an internal echo endpoint
+	Endpoints []string
+	// PrivateOnly reports a private interface address and makes no external calls
+	PrivateOnly bool
+}
+
 func GetPublicIP(logger *logrus.Logger) string {
+	return DiscoverIP(IPDiscoveryOptions{}, logger)
+}
+
+// DiscoverIP returns the static override, a private interface address, or the
+// first valid answer from the echo endpoints, in that order of precedence
+func DiscoverIP(options IPDiscoveryOptions, logger *logrus.Logger) string {
+	if options.StaticIP != "" {
+		logger.WithField("publicIP", options.StaticIP).Info("🌐 Public IP source: config override")
+		return options.StaticIP
+	}
+
+	if options.PrivateOnly {
+		return getPrivateIP(logger)
+	}
+
+	services := publicIPServices
+	if len(options.Endpoints) > 0 {
+		services = options.Endpoints
+	}
+
+	return getIPFromServices(services, logger)
+}
+
+func getIPFromServices(services []string, logger *logrus.Logger) string {
 	logger.Debug("Starting public IP discovery...")
-	logger.WithField("services", publicIPServices).Debug("Trying public IP services in order")
+	logger.WithField("services", services).Debug("Trying public IP services in order")
 
 	client := &http.Client{Timeout: httpTimeout}
 
-	for i, service := range publicIPServices {
+	for i, service := range services {
 		logger.WithFields(logrus.Fields{
 			"service": service,
 			"attempt": i + 1,
-			"total":   len(publicIPServices),
+			"total":   len(services),
 		}).Debug("Attempting to get public IP from service")
 
 		resp, err := client.Get(service)
@@ -119,7 +149,59 @@ func GetPublicIP(logger *logrus.Logger) string {
 	return ""
 }
 
-func GetMachineFingerprint(logger *logrus.Logger) string {
+// getPrivateIP picks the first private address of an interface that is up,
+// preferring IPv4, for networks where external calls are not allowed
+func getPrivateIP(logger *logrus.Logger) string {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		logger.WithError(err).Warn("Failed to list network interfaces for private IP")
+		return ""
+	}
+
+	var ipv6 string
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+
+		addrs, err := iface.Addrs()
+		if err != nil {
+			logger.WithError(err).WithField("interface", iface.Name).Debug("Failed to read interface addresses")
+			continue
+		}
+
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || !ipNet.IP.IsPrivate() {
+				continue
+			}
+			if ipNet.IP.To4() == nil {
+				if ipv6 == "" {
+					ipv6 = ipNet.IP.String()
+				}
+				continue
+			}
+
+			logger.WithFields(logrus.Fields{
+				"privateIP": ipNet.IP.String(),
+				"interface": iface.Name,
+			}).Info("🌐 Public IP source: private interface address (privateIpOnly)")
+			return ipNet.IP.String()
+		}
+	}
+
+	if ipv6 != "" {
+		logger.WithField("privateIP", ipv6).Info("🌐 Public IP source: private interface address (privateIpOnly)")
+		return ipv6
+	}
+
+	logger.Warn("No private interface address found")
+	return ""
+}
+
+func GetMachineFingerprint(collection types.Collection, logger *logrus.Logger) string {
+	sshHostKeyPaths := osplugins.Selected().SSHHostKeyPaths()
+
 	logger.Debug("Starting machine fingerprint generation...")
 	logger.WithField("sshKeyPaths", sshHostKeyPaths).Debug("Checking SSH host key paths for fingerprinting")
 
@@ -140,10 +222,12 @@ func GetMachineFingerprint(logger *logrus.Logger) string {
 	}
 
 	logger.Warn("No SSH host keys found or usable, falling back to system-based fingerprint")
-	return getFallbackFingerprint(logger)
+	return getFallbackFingerprint(collection, logger)
 }
 
-func GetMachinePublicKey(logger *logrus.Logger) string {
+func GetMachinePublicKey(collection types.Collection, logger *logrus.Logger) string {
+	sshHostKeyPaths := osplugins.Selected().SSHHostKeyPaths()
+
 	logger.Debug("Starting machine public key collection...")
 	logger.WithField("sshKeyPaths", sshHostKeyPaths).Debug("Checking SSH host key paths for public key")
 
@@ -182,72 +266,132 @@ func GetMachinePublicKey(logger *logrus.Logger) string {
 		}
 	}
 
+	for _, keyPath := range sshHostKeyPaths {
+		privateKeyPath := strings.TrimSuffix(keyPath, ".pub")
+		publicKey, err := loadSSHPublicKeyFromPrivate(privateKeyPath)
+		if err != nil {
+			logger.WithError(err).WithField("keyPath", privateKeyPath).Debug("SSH host private key not usable")
+			continue
+		}
+
+		logger.WithFields(logrus.Fields{
+			"keyPath": privateKeyPath,
+			"keyType": publicKey.Type(),
+		}).Info("🔐 Public key source: derived from SSH host private key")
+		return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(publicKey)))
+	}
+
 	logger.Warn("No SSH host public keys found or readable, falling back to generated key")
-	return getFallbackPublicKey(logger)
+	return getFallbackPublicKey(collection, logger)
 }
 
 func getSSHKeyFingerprint(keyPath string, logger *logrus.Logger) string {
+	publicKey, err := loadSSHPublicKey(keyPath)
+	if err != nil {
+		logger.WithError(err).WithField("keyPath", keyPath).Debug("Public key file not usable, trying private key")
+
+		// Hosts that ship without the .pub files can still derive it from the private key
+		privateKeyPath := strings.TrimSuffix(keyPath, ".pub")
+		publicKey, err = loadSSHPublicKeyFromPrivate(privateKeyPath)
+		if err != nil {
+			logger.WithError(err).WithField("keyPath", privateKeyPath).Debug("Private key file not usable")
+			return getSSHKeygenFingerprint(keyPath, logger)
+		}
+		keyPath = privateKeyPath
+	}
+
+	// Same format as `ssh-keygen -l -E sha256`, including the SHA256: prefix
+	fingerprint := ssh.FingerprintSHA256(publicKey)
+	logger.WithFields(logrus.Fields{
+		"keyPath":     keyPath,
+		"keyType":     publicKey.Type(),
+		"fingerprint": fingerprint,
+	}).Debug("Successfully computed SHA256 fingerprint from SSH key")
+	return fingerprint
+}
+
+// getSSHKeygenFingerprint asks ssh-keygen for keys x/crypto/ssh cannot parse,
+// such as newer key types, when the binary is installed
+func getSSHKeygenFingerprint(keyPath string, logger *logrus.Logger) string {
 	if _, err := os.Stat(keyPath); err != nil {
-		logger.WithFields(logrus.Fields{
-			"keyPath": keyPath,
-			"error":   err.Error(),
-		}).Debug("SSH key file does not exist")
 		return ""
 	}
 
-	logger.WithField("keyPath", keyPath).Debug("SSH key file exists, extracting fingerprint with ssh-keygen")
+	sshKeygen, err := exec.LookPath(osplugins.Selected().SSHKeygenPath())
+	if err != nil {
+		logger.WithField("keyPath", keyPath).Debug("ssh-keygen not available, cannot fingerprint key")
+		return ""
+	}
 
-	cmd := exec.Command("ssh-keygen", "-l", "-f", keyPath, "-E", "sha256")
-	output, err := cmd.Output()
+	output, err := exec.Command(sshKeygen, "-l", "-E", "sha256", "-f", keyPath).Output()
 	if err != nil {
-		logger.WithError(err).WithFields(logrus.Fields{
-			"keyPath": keyPath,
-			"command": "ssh-keygen -l -f " + keyPath + " -E sha256",
-		}).Debug("ssh-keygen command failed")
+		logger.WithError(err).WithField("keyPath", keyPath).Debug("ssh-keygen could not fingerprint key")
 		return ""
 	}
 
-	outputStr := string(output)
-	logger.WithFields(logrus.Fields{
-		"keyPath":      keyPath,
-		"sshKeygenOut": outputStr,
-	}).Debug("ssh-keygen output received")
-
-	parts := strings.Fields(outputStr)
-	for _, part := range parts {
-		if strings.HasPrefix(part, "SHA256:") {
-			// Keep the SHA256: prefix to maintain fingerprint format
-			fingerprint := part
-			logger.WithFields(logrus.Fields{
-				"keyPath":     keyPath,
-				"fingerprint": fingerprint,
-			}).Debug("Successfully extracted SHA256 fingerprint from SSH key")
-			return fingerprint
-		}
+	// Output format: "256 SHA256:abc... comment (ED25519)"
+	fields := strings.Fields(string(output))
+	if len(fields) < 2 || !strings.HasPrefix(fields[1], "SHA256:") {
+		logger.WithField("output", strings.TrimSpace(string(output))).Debug("Unexpected ssh-keygen output")
+		return ""
 	}
 
 	logger.WithFields(logrus.Fields{
-		"keyPath": keyPath,
-		"output":  outputStr,
-	}).Warn("Could not parse SHA256 fingerprint from ssh-keygen output")
-	return ""
+		"keyPath":     keyPath,
+		"fingerprint": fields[1],
+	}).Debug("Computed SHA256 fingerprint with ssh-keygen")
+	return fields[1]
 }
 
-func getFallbackFingerprint(logger *logrus.Logger) string {
-	logger.Debug("Generating fallback fingerprint from hostname and MAC addresses...")
+func loadSSHPublicKey(keyPath string) (ssh.PublicKey, error) {
+	data, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
 
-	hostname, err := os.Hostname()
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %w", err)
+	}
+	return publicKey, nil
+}
+
+func loadSSHPublicKeyFromPrivate(keyPath string) (ssh.PublicKey, error) {
+	data, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.ParsePrivateKey(data)
 	if err != nil {
-		logger.WithError(err).Debug("Failed to get hostname for fallback fingerprint")
-		hostname = "unknown"
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+	return signer.PublicKey(), nil
+}
+
+func getFallbackFingerprint(collection types.Collection, logger *logrus.Logger) string {
+	logger.Debug("Generating fallback fingerprint from hostname and MAC addresses...")
+
+	var hostname string
+	if collection.Allows(types.CollectHostname) {
+		var err error
+		hostname, err = os.Hostname()
+		if err != nil {
+			logger.WithError(err).Debug("Failed to get hostname for fallback fingerprint")
+			hostname = "unknown"
+		}
+		logger.WithField("hostname", hostname).Debug("Using hostname for fallback fingerprint")
+	} else {
+		logger.Debug("Hostname collection disabled, leaving it out of the fallback fingerprint")
 	}
-	logger.WithField("hostname", hostname).Debug("Using hostname for fallback fingerprint")
 
 	interfaces, err := net.Interfaces()
 	var macAddresses []string
 	var skippedInterfaces []string
 
-	if err == nil {
+	if !collection.Allows(types.CollectMACAddresses) {
+		logger.Debug("MAC address collection disabled, leaving them out of the fallback fingerprint")
+	} else if err == nil {
 		logger.Debug("Collecting MAC addresses from network interfaces...")
 		for _, i := range interfaces {
 			if len(i.HardwareAddr) > 0 {
@@ -293,13 +437,16 @@ func getFallbackFingerprint(logger *logrus.Logger) string {
 	return fingerprint
 }
 
-func getFallbackPublicKey(logger *logrus.Logger) string {
+func getFallbackPublicKey(collection types.Collection, logger *logrus.Logger) string {
 	logger.Debug("Generating fallback public key from machine information...")
 
-	hostname, err := os.Hostname()
-	if err != nil {
-		logger.WithError(err).Debug("Failed to get hostname for fallback public key")
-		hostname = "unknown"
+	hostname := "unknown"
+	if collection.Allows(types.CollectHostname) {
+		var err error
+		if hostname, err = os.Hostname(); err != nil {
+			logger.WithError(err).Debug("Failed to get hostname for fallback public key")
+			hostname = "unknown"
+		}
 	}
 
 	data := "machine-public-key-" + hostname
@@ -316,6 +463,55 @@ func getFallbackPublicKey(logger *logrus.Logger) string {
 	return key
 }
 
+// GetNetworkInterfaces returns the addresses of every interface that is up,
+// leaving out loopback and link-local addresses. MAC addresses are left empty
+// when their collection is disabled.
+func GetNetworkInterfaces(collection types.Collection, logger *logrus.Logger) []types.NetworkInterface {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		logger.WithError(err).Warn("Failed to list network interfaces")
+		return nil
+	}
+
+	var result []types.NetworkInterface
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+
+		addrs, err := iface.Addrs()
+		if err != nil {
+			logger.WithError(err).WithField("interface", iface.Name).Debug("Failed to read interface addresses")
+			continue
+		}
+
+		var addresses []string
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.IsLoopback() || ipNet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			addresses = append(addresses, ipNet.String())
+		}
+
+		if len(addresses) == 0 {
+			continue
+		}
+
+		networkInterface := types.NetworkInterface{
+			Name:      iface.Name,
+			Addresses: addresses,
+		}
+		if collection.Allows(types.CollectMACAddresses) {
+			networkInterface.MAC = iface.HardwareAddr.String()
+		}
+		result = append(result, networkInterface)
+	}
+
+	logger.WithField("interfaces", len(result)).Debug("Collected network interface addresses")
+	return result
+}
+
 func isValidIP(ip string) bool {
 	return net.ParseIP(ip) != nil
 }
@@ -326,23 +522,33 @@ func GenerateRegistrationCode(hostname, publicIP, fingerprint, publicKey string)
 }
 
 func CreateRegistrationRequest(keyPath string, logger *logrus.Logger) (*types.RegistrationRequest, error) {
-	return CreateRegistrationRequestWithOptions(keyPath, "", nil, logger)
+	return CreateRegistrationRequestWithOptions(keyPath, "", nil, IPDiscoveryOptions{}, nil, logger)
 }
 
-func CreateRegistrationRequestWithOptions(keyPath, customHostname string, labels []string, logger *logrus.Logger) (*types.RegistrationRequest, error) {
+// CreateRegistrationRequestWithOptions gathers what registration reports.
+// Values given explicitly, such as customHostname or a static IP, are always
+// reported; collection only stops the agent from looking them up itself.
+func CreateRegistrationRequestWithOptions(keyPath, customHostname string, labels []string, ipOptions IPDiscoveryOptions, collection types.Collection, logger *logrus.Logger) (*types.RegistrationRequest, error) {
 	logger.Debug("Creating registration request...")
 
 	var hostname string
 	if customHostname != "" {
 		hostname = customHostname
 		logger.WithField("hostname", hostname).Info("🏠 Hostname source: command line override")
-	} else {
+	} else if collection.Allows(types.CollectHostname) {
 		hostname = GetHostname(logger, "")
+	} else {
+		logger.Info("🏠 Hostname source: not collected (disableCollection)")
 	}
 
-	publicIP := GetPublicIP(logger)
-	fingerprint := GetMachineFingerprint(logger)
-	fingerprintPublicKey := GetMachinePublicKey(logger)
+	var publicIP string
+	if ipOptions.StaticIP != "" || ipOptions.PrivateOnly || collection.Allows(types.CollectPublicIP) {
+		publicIP = DiscoverIP(ipOptions, logger)
+	} else {
+		logger.Info("🌐 Public IP source: not collected (disableCollection)")
+	}
+	fingerprint := GetMachineFingerprint(collection, logger)
+	fingerprintPublicKey := GetMachinePublicKey(collection, logger)
 
 	jwkPublicKey, err := GetJWKPublicKey(keyPath, logger)
 	if err != nil {
@@ -356,7 +562,9 @@ func CreateRegistrationRequestWithOptions(keyPath, customHostname string, labels
 		FingerprintPublicKey: fingerprintPublicKey,
 		JWKPublicKey:         jwkPublicKey,
 		Labels:               labels,
+		Interfaces:           GetNetworkInterfaces(collection, logger),
 		Timestamp:            time.Now().UTC().Format(time.RFC3339),
+		Omitted:              collection.Omitted(),
 	}
 
 	logger.WithFields(logrus.Fields{
@@ -368,15 +576,21 @@ func CreateRegistrationRequestWithOptions(keyPath, customHostname string, labels
 }
 
 func GenerateRegistrationRequestCode(keyPath string, logger *logrus.Logger) (string, error) {
-	return GenerateRegistrationRequestCodeWithOptions(keyPath, "", nil, logger)
+	return GenerateRegistrationRequestCodeWithOptions(keyPath, "", nil, IPDiscoveryOptions{}, nil, logger)
 }
 
-func GenerateRegistrationRequestCodeWithOptions(keyPath, customHostname string, labels []string, logger *logrus.Logger) (string, error) {
-	request, err := CreateRegistrationRequestWithOptions(keyPath, customHostname, labels, logger)
+func GenerateRegistrationRequestCodeWithOptions(keyPath, customHostname string, labels []string, ipOptions IPDiscoveryOptions, collection types.Collection, logger *logrus.Logger) (string, error) {
+	request, err := CreateRegistrationRequestWithOptions(keyPath, customHostname, labels, ipOptions, collection, logger)
 	if err != nil {
 		return "", err
 	}
 
+	return EncodeRegistrationRequest(request, logger)
+}
+
+// EncodeRegistrationRequest returns the base64 registration code for a request
+// built with CreateRegistrationRequestWithOptions, e.g. after attaching evidence
+func EncodeRegistrationRequest(request *types.RegistrationRequest, logger *logrus.Logger) (string, error) {
 	jsonData, err := json.Marshal(request)
 	if err != nil {
 		return "", fmt.Errorf("failed to marshal registration request: %w", err)